@@ -0,0 +1,232 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <pthread.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "events.h"
+#include "sync_mqtt.h"
+#include "admin.h"
+
+void admin_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->admin, 0, sizeof(cfg->admin));
+}
+
+int admin_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (strcmp(section, "admin") != 0) return 0;
+    if (!strcmp(key, "token")) {
+        strncpy(cfg->admin.token, value, sizeof(cfg->admin.token) - 1);
+        cfg->admin.token[sizeof(cfg->admin.token) - 1] = '\0';
+    } else {
+        fprintf(stderr, "WARN: ignoring unknown admin key '%s'\n", key);
+    }
+    return 1;
+}
+
+int admin_token_equal(const char *a, const char *b) {
+    size_t la = strlen(a), lb = strlen(b);
+    unsigned char diff = (unsigned char)(la != lb);
+    for (size_t i = 0; i < la; i++) {
+        diff |= (unsigned char)(a[i] ^ b[i % (lb ? lb : 1)]);
+    }
+    return diff == 0;
+}
+
+int admin_authorize(struct mg_connection *c, const config_t *cfg) {
+    const server_listen_t *l = server_listener(cfg, c);
+    if (l && l->admin_exempt) return 1;
+    if (!cfg->admin.token[0]) {
+        send_json_error(c, 403, "admin_disabled");
+        return 0;
+    }
+    const char *presented = mg_get_header(c, "X-Admin-Token");
+    const char *auth = mg_get_header(c, "Authorization");
+    if (!presented && auth && !strncasecmp(auth, "Bearer ", 7)) {
+        presented = auth + 7;
+        while (*presented == ' ') presented++;
+    }
+    if (!presented || !admin_token_equal(presented, cfg->admin.token)) {
+        send_json_error(c, 401, "unauthorized");
+        return 0;
+    }
+    return 1;
+}
+
+/*
+ * POST /admin/promote — turn this slave into a master without a restart.
+ * The registry is seeded from "snapshot" (a GET /sync/slaves payload saved
+ * from the lost master) before registrations are accepted, so nodes keep
+ * their slots when they re-register. An optional "id" takes over the old
+ * master's sync identifier so sync:// references resolve to this node.
+ */
+static int h_admin_promote(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri || strcmp(ri->request_method, "POST") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+    if (!admin_authorize(c, cfg)) {
+        free(cfg);
+        return 1;
+    }
+    if (strcasecmp(cfg->sync_role, "slave") != 0) {
+        JSON_Value *v = json_value_init_object();
+        JSON_Object *o = json_object(v);
+        json_object_set_string(o, "error", "not_a_slave");
+        json_object_set_string(o, "role", cfg->sync_role);
+        send_json(c, v, 409, 1);
+        json_value_free(v);
+        free(cfg);
+        return 1;
+    }
+
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        if (u.body) free(u.body);
+        send_json_error(c, 400, "body_read_failed");
+        free(cfg);
+        return 1;
+    }
+    JSON_Value *root = json_parse_string(u.body ? u.body : "{}");
+    free(u.body);
+    if (!root || json_value_get_type(root) != JSONObject) {
+        if (root) json_value_free(root);
+        send_json_error(c, 400, "bad_json");
+        free(cfg);
+        return 1;
+    }
+    JSON_Object *obj = json_object(root);
+    /* Accept the snapshot wrapped or the saved /sync/slaves body as is. */
+    JSON_Object *snapshot = json_object_get_object(obj, "snapshot");
+    if (!snapshot && json_object_get_array(obj, "slaves")) snapshot = obj;
+    if (json_object_has_value(obj, "snapshot") && !snapshot) {
+        json_value_free(root);
+        send_json_error(c, 400, "invalid_snapshot");
+        free(cfg);
+        return 1;
+    }
+    const char *new_id = json_object_get_string(obj, "id");
+    if (new_id && (!*new_id || strlen(new_id) >= sizeof(cfg->sync_id))) {
+        json_value_free(root);
+        send_json_error(c, 400, "invalid_id");
+        free(cfg);
+        return 1;
+    }
+
+    char previous_master[256];
+    snprintf(previous_master, sizeof(previous_master), "%s", cfg->sync_master_url);
+    fprintf(stderr, "admin: promoting %s to master (requested by %s)\n",
+            cfg->sync_id, ri->remote_addr);
+
+    sync_slave_stop_thread(&app->slave);
+    int seeded = snapshot
+        ? sync_master_seed_snapshot(app, cfg, snapshot, cfg->sync_id, "promote", ri->remote_addr)
+        : 0;
+
+    pthread_mutex_lock(&app->cfg_lock);
+    strncpy(app->base_cfg.sync_role, "master", sizeof(app->base_cfg.sync_role) - 1);
+    app->base_cfg.sync_role[sizeof(app->base_cfg.sync_role) - 1] = '\0';
+    if (new_id) {
+        strncpy(app->base_cfg.sync_id, new_id, sizeof(app->base_cfg.sync_id) - 1);
+        app->base_cfg.sync_id[sizeof(app->base_cfg.sync_id) - 1] = '\0';
+    }
+    app_rebuild_config_locked(app);
+    app->active_override_generation = 0;
+    pthread_mutex_unlock(&app->cfg_lock);
+    app_config_snapshot(app, cfg);
+
+    (void)sync_master_start_thread(app);
+    if (strcmp(cfg->sync_transport, "mqtt") == 0) {
+        (void)sync_mqtt_master_start(app);
+    }
+
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_string(eo, "id", cfg->sync_id);
+    json_object_set_string(eo, "previous_master", previous_master);
+    json_object_set_number(eo, "seeded", seeded);
+    json_object_set_string(eo, "actor", ri->remote_addr);
+    (void)events_emit("promoted", ev);
+
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    json_object_set_string(ro, "status", "promoted");
+    json_object_set_string(ro, "role", "master");
+    json_object_set_string(ro, "id", cfg->sync_id);
+    json_object_set_number(ro, "seeded", seeded);
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+    json_value_free(root);
+    free(cfg);
+    return 1;
+}
+
+/*
+ * POST /admin/flush — write what the master's registry write-behind is
+ * holding back to [sync] registry_path now, e.g. before pulling power.
+ */
+static int h_admin_flush(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri || strcmp(ri->request_method, "POST") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+    if (!admin_authorize(c, cfg)) {
+        free(cfg);
+        return 1;
+    }
+    if (strcasecmp(cfg->sync_role, "master") != 0) {
+        JSON_Value *v = json_value_init_object();
+        JSON_Object *o = json_object(v);
+        json_object_set_string(o, "error", "not_a_master");
+        json_object_set_string(o, "role", cfg->sync_role);
+        send_json(c, v, 409, 1);
+        json_value_free(v);
+        free(cfg);
+        return 1;
+    }
+    if (!cfg->sync_registry_path[0]) {
+        send_json_error(c, 409, "no_registry_path");
+        free(cfg);
+        return 1;
+    }
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    if (sync_master_flush_registry(app, cfg, 1, ro) != 0) {
+        json_object_set_string(ro, "error", "write_failed");
+        send_json(c, resp, 500, 1);
+    } else {
+        json_object_set_string(ro, "status", "flushed");
+        send_json(c, resp, 200, 1);
+    }
+    json_value_free(resp);
+    free(cfg);
+    return 1;
+}
+
+void admin_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    api_set_handler(ctx, "/admin/promote", h_admin_promote, app);
+    api_set_handler(ctx, "/admin/flush", h_admin_flush, app);
+}
@@ -0,0 +1,31 @@
+#ifndef AUTOD_ADMIN_H
+#define AUTOD_ADMIN_H
+
+/* [admin] — operations that change what a node is (role promotion) or force
+ * its state to disk (registry flush). They are disabled until a token is
+ * configured and then require it on every call. */
+typedef struct {
+    char token[128];
+} admin_config_t;
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_context;
+struct mg_connection;
+
+void admin_cfg_defaults(config_t *cfg);
+int admin_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* Check the Authorization: Bearer (or X-Admin-Token) header against
+ * [admin] token. Sends 403 admin_disabled / 401 unauthorized and returns 0
+ * when the request may not proceed. Requests on a listener marked
+ * admin_exempt pass without a token. */
+int admin_authorize(struct mg_connection *c, const config_t *cfg);
+
+/* Length-independent comparison so a secret cannot be guessed byte by byte
+ * from response timing. */
+int admin_token_equal(const char *a, const char *b);
+
+void admin_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
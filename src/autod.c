@@ -1,8 +1,8 @@
 /*
 autod.c — lightweight HTTP control plane (CivetWeb, NO AUTH), with optional LAN scanner
 
-gcc -Os -std=c11 -Wall -Wextra -DNO_SSL -DNO_CGI -DNO_FILES \
-    autod.c scan.c parson.c civetweb.c -o autod -pthread
+gcc -Os -std=c11 -Wall -Wextra -DNO_SSL -DNO_CGI -DNO_FILES -DAUTOD_ZLIB \
+    autod.c sync.c scan.c events.c httpc.c mqtt.c notify.c sync_mqtt.c sync_results.c idempotency.c cluster.c jobs.c sandbox.c profile.c broadcast.c dnscache.c confirm.c catalog.c replica.c admin.c logs.c nodemeta.c debug.c redact.c system.c workflow.c cli.c execcache.c svcpub.c fedmetrics.c blackout.c enroll.c quota.c portcheck.c process.c bandwidth.c deadman.c fleetcfg.c caller.c version.c nodecheck.c gateway.c sshexec.c bench.c decommission.c drill.c discovery.c preflight.c cgroup.c capacity.c nodeid.c jsonq.c integrity.c breaker.c parson.c civetweb.c -o autod -pthread -lz
 strip autod
 */
 
@@ -23,6 +23,7 @@ strip autod
 #include <sys/resource.h>
 #include <fcntl.h>
 #include <limits.h>
+#include <glob.h>
 #ifndef PATH_MAX
 #define PATH_MAX 4096
 #endif
@@ -31,12 +32,37 @@ strip autod
 #include <ifaddrs.h>
 #include <sys/socket.h>
 #include <netinet/in.h>
+#include <netinet/tcp.h>
 #include <arpa/inet.h>
 #include <netdb.h>
 #include <pthread.h>
 #include "civetweb.h"
 #include "parson.h"
 #include "autod.h"
+#include "events.h"
+#include "sync_mqtt.h"
+#include "idempotency.h"
+#include "execcache.h"
+#include "cluster.h"
+#include "broadcast.h"
+#include "dnscache.h"
+#include "httpc.h"
+#include "confirm.h"
+#include "sync_results.h"
+#include "replica.h"
+#include "logs.h"
+#include "workflow.h"
+#include "cli.h"
+#include "debug.h"
+#include "version.h"
+#include "caller.h"
+#include "nodecheck.h"
+#include "gateway.h"
+#include "decommission.h"
+#include "drill.h"
+#include "preflight.h"
+#include "cgroup.h"
+#include "integrity.h"
 
 #if !defined(_WIN32)
 extern char *realpath(const char *path, char *resolved_path);
@@ -74,11 +100,24 @@ static void cfg_defaults(config_t *c) {
     c->port = 8080;
     strncpy(c->bind_addr, "0.0.0.0", sizeof(c->bind_addr)-1);
     c->enable_scan = 0;
+    c->reuse_port = 0;
+    c->drain_timeout_ms = 10000;
+    c->keep_alive_timeout_ms = 500;
+    c->http_max_conns_per_host = HTTPC_DEFAULT_CONNS_PER_HOST;
+    c->http_idle_timeout_ms = HTTPC_DEFAULT_IDLE_TIMEOUT_MS;
+    c->http_proxy.use_env = 1;
     c->extra_subnet_count = 0;
+    c->probe_exclude_count = 0;
+    c->scan_stable_every = 4;
 
     strncpy(c->interpreter, "/usr/bin/exec-handler.sh", sizeof(c->interpreter)-1);
+    strncpy(c->exec_mode, "handler", sizeof(c->exec_mode)-1);
     c->exec_timeout_ms = 5000;
+    c->exec_connect_timeout_ms = 2000;
+    c->exec_deadline_headroom_ms = 1000;
     c->max_output_bytes = 65536;
+    c->idempotency_window_s = 600;
+    c->exec_confirm_ttl_s = 60;
 
     c->include_net_info = 1;
     c->sse_count = 0;
@@ -89,6 +128,32 @@ static void cfg_defaults(config_t *c) {
     strncpy(c->firmware_dir, "/usr/share/firmware", sizeof(c->firmware_dir) - 1);
 
     sync_cfg_defaults(c);
+    notify_cfg_defaults(c);
+    jobs_cfg_defaults(c);
+    sandbox_cfg_defaults(c);
+    catalog_cfg_defaults(c);
+    admin_cfg_defaults(c);
+    profile_cfg_defaults(c);
+    nodemeta_cfg_defaults(c);
+    redact_cfg_defaults(c);
+    system_cfg_defaults(c);
+    svcpub_cfg_defaults(c);
+    fedmetrics_cfg_defaults(c);
+    blackout_cfg_defaults(c);
+    enroll_cfg_defaults(c);
+    quota_cfg_defaults(c);
+    portcheck_cfg_defaults(c);
+    process_cfg_defaults(c);
+    bandwidth_cfg_defaults(c);
+    deadman_cfg_defaults(c);
+    fleetcfg_cfg_defaults(c);
+    gateway_cfg_defaults(c);
+    sshexec_cfg_defaults(c);
+    bench_cfg_defaults(c);
+    discovery_cfg_defaults(c);
+    capacity_cfg_defaults(c);
+    events_cfg_defaults(c);
+    breaker_cfg_defaults(c);
 }
 
 static int cfg_has_cap(const config_t *cfg, const char *cap) {
@@ -104,12 +169,28 @@ static int cfg_has_cap(const config_t *cfg, const char *cap) {
     return 0;
 }
 
+/* "a.b.c.d/len", optionally followed by " interval_s=N" to probe the subnet
+ * on its own schedule as well as during full sweeps. */
 static int parse_extra_subnet(const char *value, scan_extra_subnet_t *out) {
     if (!value || !*value || !out) return -1;
     char copy[64];
     strncpy(copy, value, sizeof(copy) - 1);
     copy[sizeof(copy) - 1] = '\0';
 
+    out->interval_s = 0;
+    char *opt = strpbrk(copy, " \t");
+    if (opt) {
+        *opt++ = '\0';
+        trim(opt);
+        if (*opt) {
+            if (strncmp(opt, "interval_s=", 11) != 0) return -1;
+            char *end = NULL;
+            long iv = strtol(opt + 11, &end, 10);
+            if (!end || end == opt + 11 || *end != '\0' || iv <= 0 || iv > 7 * 86400) return -1;
+            out->interval_s = (unsigned)iv;
+        }
+    }
+
     char *slash = strchr(copy, '/');
     if (!slash) return -1;
     *slash = '\0';
@@ -135,90 +216,710 @@ static int parse_extra_subnet(const char *value, scan_extra_subnet_t *out) {
     return 0;
 }
 
-static int parse_ini(const char *path, config_t *cfg) {
+/* A probe_exclude entry: a CIDR or a single address. */
+static int parse_probe_exclude(const char *value, scan_extra_subnet_t *out) {
+    if (!value || !*value || !out) return -1;
+    char cidr[64];
+    snprintf(cidr, sizeof(cidr), strchr(value, '/') ? "%s" : "%s/32", value);
+    if (parse_extra_subnet(cidr, out) != 0 || out->interval_s) return -1;
+    return 0;
+}
+
+static int cidr_overlaps(const scan_extra_subnet_t *a, const scan_extra_subnet_t *b) {
+    uint32_t mask = a->netmask & b->netmask;
+    return (a->network & mask) == (b->network & mask);
+}
+
+static int cidr_covers(const scan_extra_subnet_t *outer, const scan_extra_subnet_t *inner) {
+    return (outer->netmask & inner->netmask) == outer->netmask &&
+           (inner->network & outer->netmask) == outer->network;
+}
+
+static void format_cidr(const scan_extra_subnet_t *sn, char *out, size_t out_sz) {
+    struct in_addr ia;
+    ia.s_addr = htonl(sn->network);
+    char ip[16];
+    if (!inet_ntop(AF_INET, &ia, ip, sizeof(ip))) ip[0] = '\0';
+    int len = 0;
+    for (uint32_t m = sn->netmask; m; m <<= 1) len++;
+    snprintf(out, out_sz, "%s/%d", ip, len);
+}
+
+/* Overlapping subnets would be probed on two schedules; keep the first. A
+ * subnet that probe_exclude hides entirely is kept but never probed. */
+static int check_extra_subnet(const config_t *cfg, const scan_extra_subnet_t *sn, const char *value) {
+    char other[32];
+    for (unsigned i = 0; i < cfg->extra_subnet_count; i++) {
+        const scan_extra_subnet_t *prev = &cfg->extra_subnets[i];
+        if ((sn->interval_s || prev->interval_s) && cidr_overlaps(sn, prev)) {
+            format_cidr(prev, other, sizeof(other));
+            fprintf(stderr, "WARN: ignoring extra_subnet '%s': overlaps scheduled subnet %s\n",
+                    value, other);
+            return -1;
+        }
+    }
+    for (unsigned i = 0; i < cfg->probe_exclude_count; i++) {
+        if (cidr_covers(&cfg->probe_excludes[i], sn)) {
+            format_cidr(&cfg->probe_excludes[i], other, sizeof(other));
+            fprintf(stderr, "WARN: extra_subnet '%s' is entirely excluded by probe_exclude %s\n",
+                    value, other);
+        }
+    }
+    return 0;
+}
+
+static int addr_is_loopback(const char *addr) {
+    return !strncmp(addr, "127.", 4) || !strncmp(addr, "::ffff:127.", 10) || !strcmp(addr, "::1");
+}
+
+static int addr_is_wildcard(const char *addr) {
+    return !strcmp(addr, "0.0.0.0") || !strcmp(addr, "::");
+}
+
+/* [server] listen = ADDR:PORT [admin_exempt] [tls]; "[::1]:PORT" for IPv6 and
+ * a bare PORT for every interface. */
+static int parse_listen(config_t *cfg, const char *value) {
+    char buf[160];
+    snprintf(buf, sizeof(buf), "%s", value);
+    char *save = NULL;
+    char *spec = strtok_r(buf, " \t,", &save);
+    if (!spec) {
+        fprintf(stderr, "WARN: ignoring empty listen\n");
+        return -1;
+    }
+    if (cfg->listener_count >= SERVER_MAX_LISTEN) {
+        fprintf(stderr, "WARN: ignoring listen '%s' (max %d)\n", value, SERVER_MAX_LISTEN);
+        return -1;
+    }
+    server_listen_t l;
+    memset(&l, 0, sizeof(l));
+    const char *port_s = spec;
+    if (spec[0] == '[') {
+        char *close = strchr(spec, ']');
+        if (!close || close[1] != ':' || (size_t)(close - spec - 1) >= sizeof(l.addr)) {
+            fprintf(stderr, "WARN: ignoring listen '%s' (expected [ADDR]:PORT)\n", value);
+            return -1;
+        }
+        memcpy(l.addr, spec + 1, (size_t)(close - spec - 1));
+        port_s = close + 2;
+    } else {
+        char *colon = strrchr(spec, ':');
+        if (colon) {
+            if ((size_t)(colon - spec) >= sizeof(l.addr) || strchr(spec, ':') != colon) {
+                fprintf(stderr, "WARN: ignoring listen '%s' (expected ADDR:PORT)\n", value);
+                return -1;
+            }
+            memcpy(l.addr, spec, (size_t)(colon - spec));
+            port_s = colon + 1;
+        } else {
+            strcpy(l.addr, "0.0.0.0");
+        }
+    }
+    char *end = NULL;
+    long port = strtol(port_s, &end, 10);
+    if (!*port_s || *end || port < 1 || port > 65535 || !l.addr[0]) {
+        fprintf(stderr, "WARN: ignoring listen '%s' (bad port)\n", value);
+        return -1;
+    }
+    l.port = (int)port;
+    for (char *opt = strtok_r(NULL, " \t,", &save); opt; opt = strtok_r(NULL, " \t,", &save)) {
+        if (!strcmp(opt, "admin_exempt")) {
+            if (!addr_is_loopback(l.addr)) {
+                fprintf(stderr, "WARN: ignoring listen '%s' (admin_exempt needs a loopback address)\n",
+                        value);
+                return -1;
+            }
+            l.admin_exempt = 1;
+        } else if (!strcmp(opt, "tls")) {
+            /* Built with NO_SSL: refuse rather than serve plain HTTP where
+             * TLS was asked for. */
+            fprintf(stderr, "WARN: ignoring listen '%s' (this build has no TLS support)\n", value);
+            return -1;
+        } else {
+            fprintf(stderr, "WARN: ignoring listen '%s' (unknown option '%s')\n", value, opt);
+            return -1;
+        }
+    }
+    cfg->listeners[cfg->listener_count++] = l;
+    return 0;
+}
+
+const server_listen_t *server_listener(const config_t *cfg, struct mg_connection *c) {
+    const struct mg_request_info *ri = c ? mg_get_request_info(c) : NULL;
+    if (!cfg || !ri) return NULL;
+    /* CivetWeb reports only the local port. A connection that came in over
+     * loopback has a loopback peer and one from outside never does, so that
+     * tells apart listeners sharing a port on different addresses. */
+    int from_loopback = addr_is_loopback(ri->remote_addr);
+    const server_listen_t *wildcard = NULL;
+    for (int i = 0; i < cfg->listener_count; i++) {
+        const server_listen_t *l = &cfg->listeners[i];
+        if (l->port != ri->server_port) continue;
+        if (addr_is_wildcard(l->addr)) {
+            if (!wildcard) wildcard = l;
+        } else if (addr_is_loopback(l->addr) == from_loopback) {
+            return l;
+        }
+    }
+    if (cfg->port == ri->server_port && !addr_is_wildcard(cfg->bind_addr) &&
+        addr_is_loopback(cfg->bind_addr) == from_loopback) {
+        return NULL;
+    }
+    return wildcard;
+}
+
+void server_local_address(const config_t *cfg, char *host, size_t host_sz, int *port) {
+    for (int i = 0; i < cfg->listener_count; i++) {
+        if (!strncmp(cfg->listeners[i].addr, "127.", 4)) {
+            snprintf(host, host_sz, "%s", cfg->listeners[i].addr);
+            *port = cfg->listeners[i].port;
+            return;
+        }
+    }
+    snprintf(host, host_sz, "%s", addr_is_wildcard(cfg->bind_addr) ? "127.0.0.1" : cfg->bind_addr);
+    *port = cfg->port;
+}
+
+/* Apply one [section] key = value setting. Shared by the INI parser and the
+ * --section.key=value command-line flags so both accept the same keys.
+ * Returns -1 when there is no such section or key (sections a module owns
+ * warn about their own unknown keys), else 0. */
+static int apply_config_value(config_t *cfg, const char *sect, const char *k, const char *v) {
+    if (sync_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (notify_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (jobs_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (sandbox_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (catalog_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (admin_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (profile_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (nodemeta_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (redact_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (system_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (svcpub_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (fedmetrics_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (blackout_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (enroll_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (quota_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (portcheck_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (process_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (bandwidth_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (deadman_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (fleetcfg_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (gateway_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (sshexec_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (bench_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (discovery_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (capacity_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (events_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (breaker_cfg_parse(cfg, sect, k, v)) {
+        return 0;
+    } else if (strcmp(sect,"server")==0) {
+        if (!strcmp(k,"port")) cfg->port=atoi(v);
+        else if (!strcmp(k,"bind")) strncpy(cfg->bind_addr,v,sizeof(cfg->bind_addr)-1);
+        else if (!strcmp(k,"enable_scan")) cfg->enable_scan=atoi(v);
+        else if (!strcmp(k,"reuse_port")) cfg->reuse_port=atoi(v);
+        else if (!strcmp(k,"listen")) parse_listen(cfg, v);
+        else if (!strcmp(k,"drain_timeout_ms")) cfg->drain_timeout_ms=atoi(v);
+        else if (!strcmp(k,"keep_alive_timeout_ms")) {
+            int n = atoi(v);
+            if (n < 100 || n > 60000) fprintf(stderr, "WARN: ignoring keep_alive_timeout_ms '%s' (100-60000)\n", v);
+            else cfg->keep_alive_timeout_ms = n;
+        }
+        else return -1;
+
+    } else if (strcmp(sect,"exec")==0) {
+        if (!strcmp(k,"interpreter")) strncpy(cfg->interpreter,v,sizeof(cfg->interpreter)-1);
+        else if (!strcmp(k,"interpreter_sha256")) {
+            if (integrity_parse_digest(v, cfg->exec_interpreter_sha256) != 0)
+                fprintf(stderr, "WARN: ignoring interpreter_sha256 '%s' (expected 64 hex digits)\n", v);
+        }
+        else if (!strcmp(k,"mode")) {
+            if (strcasecmp(v,"handler") && strcasecmp(v,"argv"))
+                fprintf(stderr, "WARN: ignoring unknown exec mode '%s'\n", v);
+            else strncpy(cfg->exec_mode, strcasecmp(v,"argv") ? "handler" : "argv", sizeof(cfg->exec_mode)-1);
+        }
+        else if (!strcmp(k,"path")) strncpy(cfg->exec_path,v,sizeof(cfg->exec_path)-1);
+        else if (!strcmp(k,"shell_fallback")) cfg->exec_shell_fallback=atoi(v);
+        else if (!strcmp(k,"cgroup_root")) strncpy(cfg->exec_cgroup_root,v,sizeof(cfg->exec_cgroup_root)-1);
+        else if (!strcmp(k,"timeout_ms")) cfg->exec_timeout_ms=atoi(v);
+        else if (!strcmp(k,"connect_timeout_ms")) {
+            int n = atoi(v);
+            if (n < 100) fprintf(stderr, "WARN: ignoring exec connect_timeout_ms '%s' (>= 100)\n", v);
+            else cfg->exec_connect_timeout_ms = n;
+        }
+        else if (!strcmp(k,"deadline_headroom_ms")) {
+            int n = atoi(v);
+            if (n < 0) fprintf(stderr, "WARN: ignoring negative exec deadline_headroom_ms '%s'\n", v);
+            else cfg->exec_deadline_headroom_ms = n;
+        }
+        else if (!strcmp(k,"max_output_bytes")) cfg->max_output_bytes=atoi(v);
+        else if (!strcmp(k,"idempotency_window_s")) cfg->idempotency_window_s=atoi(v);
+        else if (!strcmp(k,"confirm")) {
+            if (cfg->exec_confirm_count < EXEC_CONFIRM_MAX) {
+                char *dst = cfg->exec_confirm[cfg->exec_confirm_count++];
+                strncpy(dst, v, sizeof(cfg->exec_confirm[0]) - 1);
+                dst[sizeof(cfg->exec_confirm[0]) - 1] = '\0';
+            } else {
+                fprintf(stderr, "WARN: ignoring exec confirm '%s' (max %d)\n", v, EXEC_CONFIRM_MAX);
+            }
+        }
+        else if (!strcmp(k,"confirm_ttl_s")) cfg->exec_confirm_ttl_s=atoi(v);
+        else return -1;
+
+    } else if (strcmp(sect,"http")==0) {
+        if (!strcmp(k,"user_agent")) {
+            if (!*v) fprintf(stderr, "WARN: ignoring empty http user_agent\n");
+            else snprintf(cfg->http_user_agent, sizeof(cfg->http_user_agent), "%s", v);
+        } else if (!strcmp(k,"header")) {
+            char line[sizeof(cfg->http_headers[0])];
+            const char *why = httpc_check_header(v, line, sizeof(line));
+            if (why) {
+                fprintf(stderr, "WARN: ignoring http header '%s' (%s)\n", v, why);
+            } else if (cfg->http_header_count >= HTTPC_MAX_HEADERS) {
+                fprintf(stderr, "WARN: ignoring http header '%s' (max %d)\n", v, HTTPC_MAX_HEADERS);
+            } else {
+                memcpy(cfg->http_headers[cfg->http_header_count++], line, sizeof(line));
+            }
+        } else if (!strcmp(k,"max_conns_per_host")) {
+            int n = atoi(v);
+            if (n < 0 || n > HTTPC_MAX_CONNS_PER_HOST) {
+                fprintf(stderr, "WARN: ignoring http max_conns_per_host '%s' (0-%d)\n",
+                        v, HTTPC_MAX_CONNS_PER_HOST);
+            } else {
+                cfg->http_max_conns_per_host = n;
+            }
+        } else if (!strcmp(k,"idle_timeout_ms")) {
+            int n = atoi(v);
+            if (n < 100 || n > 60000) fprintf(stderr, "WARN: ignoring http idle_timeout_ms '%s' (100-60000)\n", v);
+            else cfg->http_idle_timeout_ms = n;
+        } else if (!strcmp(k,"proxy")) {
+            const char *why = *v ? httpc_check_proxy(v) : NULL;
+            if (why) fprintf(stderr, "WARN: ignoring http proxy '%s' (%s)\n", v, why);
+            else snprintf(cfg->http_proxy.url, sizeof(cfg->http_proxy.url), "%s", v);
+        } else if (!strcmp(k,"no_proxy")) {
+            snprintf(cfg->http_proxy.no_proxy, sizeof(cfg->http_proxy.no_proxy), "%s", v);
+        } else if (!strcmp(k,"proxy_route")) {
+            /* proxy_route = PATTERN PROXY|direct */
+            char pattern[sizeof(cfg->http_proxy.routes[0].pattern)];
+            char proxy[sizeof(cfg->http_proxy.routes[0].proxy)];
+            const char *why = NULL;
+            if (sscanf(v, "%127s %255s", pattern, proxy) != 2) why = "expected PATTERN PROXY|direct";
+            else if (strcasecmp(proxy, "direct") != 0) why = httpc_check_proxy(proxy);
+            if (!why && cfg->http_proxy.route_count >= HTTPC_MAX_PROXY_ROUTES) why = "too many routes";
+            if (why) {
+                fprintf(stderr, "WARN: ignoring http proxy_route '%s' (%s)\n", v, why);
+            } else {
+                int i = cfg->http_proxy.route_count++;
+                memcpy(cfg->http_proxy.routes[i].pattern, pattern, sizeof(pattern));
+                memcpy(cfg->http_proxy.routes[i].proxy, proxy, sizeof(proxy));
+            }
+        } else if (!strcmp(k,"proxy_env")) {
+            cfg->http_proxy.use_env = atoi(v) ? 1 : 0;
+        } else if (!strcmp(k,"proxy_tunnel")) {
+            cfg->http_proxy.tunnel = atoi(v) ? 1 : 0;
+        } else {
+            return -1;
+        }
+
+    } else if (strcmp(sect,"caps")==0) {
+        if (!strcmp(k,"device"))  strncpy(cfg->device,v,sizeof(cfg->device)-1);
+        else if (!strcmp(k,"role"))    strncpy(cfg->role,v,sizeof(cfg->role)-1);
+        else if (!strcmp(k,"version")) strncpy(cfg->version,v,sizeof(cfg->version)-1);
+        else if (!strcmp(k,"caps"))    strncpy(cfg->caps,v,sizeof(cfg->caps)-1);
+        else if (!strcmp(k,"include_net_info")) cfg->include_net_info=atoi(v);
+        else return -1;
+
+    } else if (strcmp(sect,"announce")==0) {
+        if (!strcmp(k,"sse") && cfg->sse_count<16) {
+            char copy[256]; strncpy(copy,v,sizeof(copy)-1); copy[sizeof(copy)-1]='\0';
+            char *at=strchr(copy,'@'); int idx=cfg->sse_count;
+            if (at) { *at='\0'; trim(copy); trim(at+1);
+                strncpy(cfg->sse[idx].name,copy,sizeof(cfg->sse[idx].name)-1);
+                strncpy(cfg->sse[idx].url, at+1,sizeof(cfg->sse[idx].url)-1);
+            } else {
+                snprintf(cfg->sse[idx].name,sizeof(cfg->sse[idx].name),"sse%d", idx+1);
+                strncpy(cfg->sse[idx].url, copy, sizeof(cfg->sse[idx].url)-1);
+            }
+            cfg->sse[idx].name[sizeof(cfg->sse[idx].name)-1]='\0';
+            cfg->sse[idx].url [sizeof(cfg->sse[idx].url )-1]='\0';
+            cfg->sse_count++;
+        } else if (!strcmp(k,"sse")) {
+            fprintf(stderr, "WARN: announce sse capacity reached (16)\n");
+        } else {
+            return -1;
+        }
+
+    } else if (strcmp(sect,"scan")==0) {
+        if ((!strcmp(k,"extra_subnet") || !strcmp(k,"subnet")) && cfg->extra_subnet_count < SCAN_MAX_EXTRA_SUBNETS) {
+            scan_extra_subnet_t sn = {0};
+            if (parse_extra_subnet(v, &sn) != 0) {
+                fprintf(stderr, "WARN: ignoring invalid extra_subnet '%s'\n", v);
+                cfg->cidr_invalid++;
+            } else if (check_extra_subnet(cfg, &sn, v) == 0) {
+                cfg->extra_subnets[cfg->extra_subnet_count++] = sn;
+            }
+        } else if (!strcmp(k,"extra_subnet") || !strcmp(k,"subnet")) {
+            fprintf(stderr, "WARN: extra_subnet capacity reached (%u)\n", SCAN_MAX_EXTRA_SUBNETS);
+        } else if (!strcmp(k,"probe_exclude") && cfg->probe_exclude_count < SCAN_MAX_EXCLUDES) {
+            scan_extra_subnet_t ex = {0};
+            if (parse_probe_exclude(v, &ex) != 0) {
+                fprintf(stderr, "WARN: ignoring invalid probe_exclude '%s'\n", v);
+                cfg->cidr_invalid++;
+            } else {
+                char sub[32];
+                for (unsigned i = 0; i < cfg->extra_subnet_count; i++) {
+                    if (!cidr_covers(&ex, &cfg->extra_subnets[i])) continue;
+                    format_cidr(&cfg->extra_subnets[i], sub, sizeof(sub));
+                    fprintf(stderr, "WARN: probe_exclude '%s' excludes all of extra_subnet %s\n", v, sub);
+                }
+                cfg->probe_excludes[cfg->probe_exclude_count++] = ex;
+            }
+        } else if (!strcmp(k,"probe_exclude")) {
+            fprintf(stderr, "WARN: probe_exclude capacity reached (%u)\n", SCAN_MAX_EXCLUDES);
+        } else if (!strcmp(k,"adaptive")) {
+            cfg->scan_adaptive = atoi(v) != 0;
+        } else if (!strcmp(k,"probe_budget")) {
+            int n = atoi(v);
+            if (n < 0 || n > 2048) fprintf(stderr, "WARN: ignoring probe_budget '%s' (0-2048)\n", v);
+            else cfg->scan_probe_budget = n;
+        } else if (!strcmp(k,"stable_every")) {
+            int n = atoi(v);
+            if (n < 1 || n > 64) fprintf(stderr, "WARN: ignoring stable_every '%s' (1-64)\n", v);
+            else cfg->scan_stable_every = n;
+        } else {
+            return -1;
+        }
+
+    } else if (strcmp(sect,"ui")==0) {
+        if (!strcmp(k,"ui_path"))   strncpy(cfg->ui_path,v,sizeof(cfg->ui_path)-1);
+        else if (!strcmp(k,"serve_ui"))  cfg->serve_ui=atoi(v);
+        else if (!strcmp(k,"ui_public")) cfg->ui_public=atoi(v);
+        else return -1;
+    } else if (strcmp(sect,"files")==0) {
+        if (!strcmp(k,"media_dir")) strncpy(cfg->media_dir, v,
+                                            sizeof(cfg->media_dir) - 1);
+        else if (!strcmp(k,"firmware_dir")) strncpy(cfg->firmware_dir, v,
+                                                     sizeof(cfg->firmware_dir) - 1);
+        else return -1;
+    } else if (strcmp(sect,"startup")==0) {
+        if ((!strcmp(k,"exec") || !strcmp(k,"command")) &&
+            cfg->startup_exec_count < STARTUP_MAX_EXEC) {
+            int idx = cfg->startup_exec_count++;
+            strncpy(cfg->startup_exec[idx].json, v,
+                    sizeof(cfg->startup_exec[idx].json) - 1);
+            cfg->startup_exec[idx].json[sizeof(cfg->startup_exec[idx].json) - 1] = '\0';
+        } else if ((!strcmp(k,"exec") || !strcmp(k,"command")) &&
+                   cfg->startup_exec_count >= STARTUP_MAX_EXEC) {
+            fprintf(stderr,
+                    "WARN: startup exec capacity reached (%d)\n",
+                    STARTUP_MAX_EXEC);
+        } else {
+            return -1;
+        }
+    } else {
+        return -1;
+    }
+    return 0;
+}
+
+#define INI_MAX_INCLUDE_DEPTH 8
+
+/* Files being read, outermost first, to refuse include cycles. */
+typedef struct {
+    char files[INI_MAX_INCLUDE_DEPTH][PATH_MAX];
+    int depth;
+} ini_stack_t;
+
+/* Replace ${NAME} (or ${NAME:-default}) with the environment variable and
+ * $$ with a literal $. Returns -1 after printing an error for an unset
+ * variable, a malformed reference or a result that does not fit. */
+static int ini_expand_env(const char *in, char *out, size_t out_sz, const char *file, int lineno) {
+    size_t o = 0;
+    for (const char *p = in; *p; ) {
+        const char *piece = p;
+        size_t len = 1;
+        char name[128];
+        if (p[0] == '$' && p[1] == '$') {
+            p += 2;
+        } else if (p[0] == '$' && p[1] == '{') {
+            const char *close = strchr(p + 2, '}');
+            const char *dflt = NULL;
+            size_t name_len = close ? (size_t)(close - p - 2) : 0;
+            const char *sep = close ? strstr(p + 2, ":-") : NULL;
+            if (sep && sep < close) {
+                dflt = sep + 2;
+                name_len = (size_t)(sep - p - 2);
+            }
+            if (!close || name_len == 0 || name_len >= sizeof(name)) {
+                fprintf(stderr, "ERROR: %s:%d: malformed variable reference in '%s'\n", file, lineno, in);
+                return -1;
+            }
+            memcpy(name, p + 2, name_len);
+            name[name_len] = '\0';
+            for (size_t i = 0; i < name_len; i++) {
+                if (!isalnum((unsigned char)name[i]) && name[i] != '_') {
+                    fprintf(stderr, "ERROR: %s:%d: bad variable name '%s'\n", file, lineno, name);
+                    return -1;
+                }
+            }
+            piece = getenv(name);
+            if (piece) {
+                len = strlen(piece);
+            } else if (dflt) {
+                piece = dflt;
+                len = (size_t)(close - dflt);
+            } else {
+                fprintf(stderr, "ERROR: %s:%d: environment variable %s is not set\n", file, lineno, name);
+                return -1;
+            }
+            p = close + 1;
+        } else {
+            p++;
+        }
+        if (o + len >= out_sz) {
+            fprintf(stderr, "ERROR: %s:%d: value too long after expanding variables\n", file, lineno);
+            return -1;
+        }
+        memcpy(out + o, piece, len);
+        o += len;
+    }
+    out[o] = '\0';
+    return 0;
+}
+
+static int parse_ini_file(const char *path, config_t *cfg, ini_stack_t *st);
+
+/* include = PATH: read another file (or every match of a glob, in order)
+ * at this point. Relative paths start from the including file's directory. */
+static int parse_ini_include(const char *from, int lineno, const char *spec, config_t *cfg, ini_stack_t *st) {
+    char pattern[PATH_MAX];
+    const char *slash = strrchr(from, '/');
+    if (spec[0] == '/' || !slash) snprintf(pattern, sizeof(pattern), "%s", spec);
+    else snprintf(pattern, sizeof(pattern), "%.*s/%s", (int)(slash - from), from, spec);
+
+    int wildcard = strpbrk(spec, "*?[") != NULL;
+    glob_t g;
+    int grc = glob(pattern, 0, NULL, &g);
+    if (grc == GLOB_NOMATCH && wildcard) return 0;
+    if (grc != 0) {
+        if (grc != GLOB_NOMATCH) globfree(&g);
+        fprintf(stderr, "ERROR: %s:%d: cannot include %s: %s\n", from, lineno, pattern,
+                grc == GLOB_NOMATCH ? strerror(ENOENT) : "glob failed");
+        return -2;
+    }
+    int rc = 0;
+    for (size_t i = 0; i < g.gl_pathc && rc == 0; i++) {
+        rc = parse_ini_file(g.gl_pathv[i], cfg, st);
+        if (rc == -1) {
+            fprintf(stderr, "ERROR: %s:%d: cannot include %s: %s\n", from, lineno, g.gl_pathv[i], strerror(errno));
+            rc = -2;
+        }
+    }
+    globfree(&g);
+    return rc;
+}
+
+/* Returns 0, -1 when path cannot be opened, or -2 after printing errors
+ * (bad include, include cycle, unset variable). Settings read before an
+ * error stay applied. */
+static int parse_ini_file(const char *path, config_t *cfg, ini_stack_t *st) {
+    char real[PATH_MAX];
+    if (!realpath(path, real)) snprintf(real, sizeof(real), "%s", path);
+    for (int i = 0; i < st->depth; i++) {
+        if (strcmp(st->files[i], real) != 0) continue;
+        fprintf(stderr, "ERROR: include cycle:");
+        for (int j = i; j < st->depth; j++) fprintf(stderr, " %s ->", st->files[j]);
+        fprintf(stderr, " %s\n", real);
+        return -2;
+    }
+    if (st->depth >= INI_MAX_INCLUDE_DEPTH) {
+        fprintf(stderr, "ERROR: %s: includes nested deeper than %d\n", path, INI_MAX_INCLUDE_DEPTH);
+        return -2;
+    }
     FILE *f = fopen(path, "r");
     if (!f) return -1;
-    char line[512], sect[64] = "";
+    snprintf(st->files[st->depth++], sizeof(st->files[0]), "%s", real);
+
+    char line[512], value[1024], sect[64] = "";
+    int lineno = 0, rc = 0;
     while (fgets(line, sizeof(line), f)) {
+        lineno++;
         char *p = line; trim(p);
         if (!*p || *p==';' || *p=='#') continue;
         if (*p=='[') { char *r=strchr(p,']'); if(r){*r='\0'; strncpy(sect,p+1,sizeof(sect)-1); sect[sizeof(sect)-1]='\0';} continue; }
         char *eq = strchr(p,'='); if(!eq) continue; *eq='\0';
         char *k=p, *v=eq+1; trim(k); trim(v);
-
-        if (sync_cfg_parse(cfg, sect, k, v)) {
+        if (ini_expand_env(v, value, sizeof(value), path, lineno) != 0) {
+            rc = -2;
             continue;
-        } else if (strcmp(sect,"server")==0) {
-            if (!strcmp(k,"port")) cfg->port=atoi(v);
-            else if (!strcmp(k,"bind")) strncpy(cfg->bind_addr,v,sizeof(cfg->bind_addr)-1);
-            else if (!strcmp(k,"enable_scan")) cfg->enable_scan=atoi(v);
-
-        } else if (strcmp(sect,"exec")==0) {
-            if (!strcmp(k,"interpreter")) strncpy(cfg->interpreter,v,sizeof(cfg->interpreter)-1);
-            else if (!strcmp(k,"timeout_ms")) cfg->exec_timeout_ms=atoi(v);
-            else if (!strcmp(k,"max_output_bytes")) cfg->max_output_bytes=atoi(v);
-
-        } else if (strcmp(sect,"caps")==0) {
-            if (!strcmp(k,"device"))  strncpy(cfg->device,v,sizeof(cfg->device)-1);
-            else if (!strcmp(k,"role"))    strncpy(cfg->role,v,sizeof(cfg->role)-1);
-            else if (!strcmp(k,"version")) strncpy(cfg->version,v,sizeof(cfg->version)-1);
-            else if (!strcmp(k,"caps"))    strncpy(cfg->caps,v,sizeof(cfg->caps)-1);
-            else if (!strcmp(k,"include_net_info")) cfg->include_net_info=atoi(v);
-
-        } else if (strcmp(sect,"announce")==0) {
-            if (!strcmp(k,"sse") && cfg->sse_count<16) {
-                char copy[256]; strncpy(copy,v,sizeof(copy)-1); copy[sizeof(copy)-1]='\0';
-                char *at=strchr(copy,'@'); int idx=cfg->sse_count;
-                if (at) { *at='\0'; trim(copy); trim(at+1);
-                    strncpy(cfg->sse[idx].name,copy,sizeof(cfg->sse[idx].name)-1);
-                    strncpy(cfg->sse[idx].url, at+1,sizeof(cfg->sse[idx].url)-1);
-                } else {
-                    snprintf(cfg->sse[idx].name,sizeof(cfg->sse[idx].name),"sse%d", idx+1);
-                    strncpy(cfg->sse[idx].url, copy, sizeof(cfg->sse[idx].url)-1);
-                }
-                cfg->sse[idx].name[sizeof(cfg->sse[idx].name)-1]='\0';
-                cfg->sse[idx].url [sizeof(cfg->sse[idx].url )-1]='\0';
-                cfg->sse_count++;
-            }
+        }
+        if (!strcmp(k, "include")) {
+            int irc = parse_ini_include(path, lineno, value, cfg, st);
+            if (irc != 0) rc = irc;
+            continue;
+        }
+        if (apply_config_value(cfg, sect, k, value) != 0) {
+            fprintf(stderr, "WARN: %s:%d: ignoring unknown setting '%s' in [%s]\n", path, lineno, k, sect);
+        }
+    }
+    fclose(f);
+    st->depth--;
+    return rc;
+}
 
-        } else if (strcmp(sect,"scan")==0) {
-            if ((!strcmp(k,"extra_subnet") || !strcmp(k,"subnet")) && cfg->extra_subnet_count < SCAN_MAX_EXTRA_SUBNETS) {
-                scan_extra_subnet_t sn = {0};
-                if (parse_extra_subnet(v, &sn) == 0) {
-                    cfg->extra_subnets[cfg->extra_subnet_count++] = sn;
-                } else {
-                    fprintf(stderr, "WARN: ignoring invalid extra_subnet '%s'\n", v);
-                }
-            } else if (!strcmp(k,"extra_subnet") || !strcmp(k,"subnet")) {
-                fprintf(stderr, "WARN: extra_subnet capacity reached (%u)\n", SCAN_MAX_EXTRA_SUBNETS);
-            }
+static int parse_ini(const char *path, config_t *cfg) {
+    ini_stack_t *st = calloc(1, sizeof(*st));
+    if (!st) return -2;
+    int rc = parse_ini_file(path, cfg, st);
+    free(st);
+    return rc;
+}
 
-        } else if (strcmp(sect,"ui")==0) {
-            if (!strcmp(k,"ui_path"))   strncpy(cfg->ui_path,v,sizeof(cfg->ui_path)-1);
-            else if (!strcmp(k,"serve_ui"))  cfg->serve_ui=atoi(v);
-            else if (!strcmp(k,"ui_public")) cfg->ui_public=atoi(v);
-        } else if (strcmp(sect,"files")==0) {
-            if (!strcmp(k,"media_dir")) strncpy(cfg->media_dir, v,
-                                                sizeof(cfg->media_dir) - 1);
-            else if (!strcmp(k,"firmware_dir")) strncpy(cfg->firmware_dir, v,
-                                                         sizeof(cfg->firmware_dir) - 1);
-        } else if (strcmp(sect,"startup")==0) {
-            if ((!strcmp(k,"exec") || !strcmp(k,"command")) &&
-                cfg->startup_exec_count < STARTUP_MAX_EXEC) {
-                int idx = cfg->startup_exec_count++;
-                strncpy(cfg->startup_exec[idx].json, v,
-                        sizeof(cfg->startup_exec[idx].json) - 1);
-                cfg->startup_exec[idx].json[sizeof(cfg->startup_exec[idx].json) - 1] = '\0';
-            } else if ((!strcmp(k,"exec") || !strcmp(k,"command")) &&
-                       cfg->startup_exec_count >= STARTUP_MAX_EXEC) {
-                fprintf(stderr,
-                        "WARN: startup exec capacity reached (%d)\n",
-                        STARTUP_MAX_EXEC);
-            }
+static int apply_env_settings(config_t *cfg);
+
+int config_load(const char *path, config_t *cfg) {
+    cfg_defaults(cfg);
+    int rc = parse_ini(path, cfg);
+    (void)apply_env_settings(cfg);
+    return rc;
+}
+
+/* Apply one --section.key=value flag. The key is the text after the last dot,
+ * so sections that contain dots (sync.slot1, notify.NAME) work as well. */
+static int apply_cli_setting(config_t *cfg, const char *name, const char *value) {
+    char sect[64];
+    const char *dot = strrchr(name, '.');
+    if (!dot || dot == name || !dot[1] || (size_t)(dot - name) >= sizeof(sect)) return -1;
+    memcpy(sect, name, (size_t)(dot - name));
+    sect[dot - name] = '\0';
+
+    char k[64], v[512];
+    strncpy(k, dot + 1, sizeof(k) - 1);
+    k[sizeof(k) - 1] = '\0';
+    strncpy(v, value, sizeof(v) - 1);
+    v[sizeof(v) - 1] = '\0';
+    trim(k); trim(v);
+    return apply_config_value(cfg, sect, k, v);
+}
+
+#define ENV_SETTING_PREFIX "AUTOD_"
+
+/* Apply AUTOD_SECTION__KEY=value variables, e.g. AUTOD_SYNC__ROLE=master or
+ * AUTOD_SYNC__SLOT1__NAME=camera for [sync.slot1] name. Names are matched in
+ * lower case; variables without a "__" (AUTOD_CALLER, AUTOD_FIRMWARE_DIR)
+ * are not settings. Returns how many were applied. */
+static int apply_env_settings(config_t *cfg) {
+    extern char **environ;
+    int applied = 0;
+    for (char **e = environ; e && *e; e++) {
+        if (strncmp(*e, ENV_SETTING_PREFIX, strlen(ENV_SETTING_PREFIX)) != 0) continue;
+        const char *name = *e + strlen(ENV_SETTING_PREFIX);
+        const char *eq = strchr(name, '=');
+        const char *last = NULL;
+        for (const char *p = strstr(name, "__"); p && p < eq; p = strstr(p + 2, "__")) last = p;
+        if (!eq || !last) continue;
+        char sect[64], k[64], v[1024];
+        size_t sect_len = 0;
+        int bad = last == name || last + 2 == eq || (size_t)(eq - last - 2) >= sizeof(k);
+        for (const char *p = name; !bad && p < last; p++) {
+            if (sect_len + 1 >= sizeof(sect)) bad = 1;
+            else if (p[0] == '_' && p[1] == '_') { sect[sect_len++] = '.'; p++; }
+            else sect[sect_len++] = (char)tolower((unsigned char)*p);
+        }
+        if (bad) {
+            fprintf(stderr, "WARN: ignoring environment setting %.*s\n", (int)(eq - *e), *e);
+            continue;
         }
+        sect[sect_len] = '\0';
+        size_t k_len = (size_t)(eq - last - 2);
+        for (size_t i = 0; i < k_len; i++) k[i] = (char)tolower((unsigned char)last[2 + i]);
+        k[k_len] = '\0';
+        strncpy(v, eq + 1, sizeof(v) - 1);
+        v[sizeof(v) - 1] = '\0';
+        trim(v);
+        if (apply_config_value(cfg, sect, k, v) != 0) {
+            fprintf(stderr, "WARN: ignoring environment setting %.*s (no [%s] %s)\n",
+                    (int)(eq - *e), *e, sect, k);
+            continue;
+        }
+        applied++;
     }
-    fclose(f);
-    return 0;
+    return applied;
+}
+
+static void print_usage(const char *prog) {
+    fprintf(stderr,
+            "usage: %s [--no-config] [--section.key=value ...] [config.ini]\n"
+            "       %s --version\n"
+            "       %s --preflight[=json] [--section.key=value ...] [config.ini]\n"
+            "\n"
+            "Every INI key can be given as a flag named after its section and key, e.g.\n"
+            "  --server.port=55667 --exec.interpreter=/usr/bin/exec-handler.sh\n"
+            "  --scan.extra_subnet=192.168.2.0/24 --sync.role=master\n"
+            "  --sync.slot1.name=camera --sync.slot1.exec='{\"path\":\"/sys/start\"}'\n"
+            "Repeatable keys (extra_subnet, exec, sse, confirm) may be passed more than once.\n"
+            "AUTOD_SECTION__KEY=value environment variables (AUTOD_SYNC__ROLE=master,\n"
+            "AUTOD_SYNC__SLOT1__NAME=camera) override the file, and flags override both.\n"
+            "--no-config skips reading the file.\n"
+            "--preflight checks the config, listen ports, master, catalog binaries, state\n"
+            "directories and clock without starting, and exits 1 when a check fails.\n"
+            "\n"
+            "       %s nodes|slots [-o table|wide|json|yaml] [-c COL,...] [-w|--watch[=S]]\n"
+            "             [--url http://master:port] [config.ini]\n"
+            "Lists a running master's registered nodes or sync slots; --watch redraws the\n"
+            "listing every S (default 2) seconds.\n"
+            "\n"
+            "       %s commands [-o table|wide|json|yaml] [-c COL,...] [--url http://host:port]\n"
+            "             [config.ini]\n"
+            "Lists the commands a daemon documents in its /exec/catalog: path, required\n"
+            "roles, parameters and examples.\n"
+            "\n"
+            "       %s nodes import -f nodes.json [--url http://master:port] [config.ini]\n"
+            "Posts an expected-node inventory to a running master's /nodes/import.\n"
+            "\n"
+            "       %s token create|list [--ttl S] [--uses N] [--note TEXT] [--token T]\n"
+            "             [--url http://master:port] [config.ini]\n"
+            "Creates (printing only the token) or lists join tokens for new slaves; the\n"
+            "admin token comes from --token or the config file's [admin] token.\n"
+            "\n"
+            "       %s bench exec|register|echo [-n N | -d S] [-c N] [--rate R] [--path P]\n"
+            "             [--arg A]... [--slot S] [--nodes N] [--max-error-pct P]\n"
+            "             [--max-p99-ms MS] [-o table|json] [--url http://host:port] [config.ini]\n"
+            "Loads a daemon with /exec calls (through /http with --slot), synthetic\n"
+            "registrations or /bench/echo requests and reports throughput, errors and\n"
+            "latency percentiles; register and echo need [bench] enable=1 there.\n"
+            "Without --url these commands talk to this host's [server] listener from the\n"
+            "config file.\n"
+            "\n"
+            "       %s completion bash|zsh|fish\n"
+            "Prints a shell completion script, e.g. source <(%s completion bash).\n",
+            prog, prog, prog, prog, prog, prog, prog, prog, prog, prog);
 }
 
 void fill_scan_config(const config_t *cfg, scan_config_t *scfg) {
@@ -237,6 +938,196 @@ void fill_scan_config(const config_t *cfg, scan_config_t *scfg) {
         memcpy(scfg->extra_subnets, cfg->extra_subnets,
                scfg->extra_subnet_count * sizeof(scan_extra_subnet_t));
     }
+    scfg->adaptive = cfg->scan_adaptive ? 1 : 0;
+    scfg->probe_budget = (unsigned)cfg->scan_probe_budget;
+    scfg->stable_every = (unsigned)cfg->scan_stable_every;
+    scfg->exclude_count = cfg->probe_exclude_count;
+    if (scfg->exclude_count > SCAN_MAX_EXCLUDES) scfg->exclude_count = SCAN_MAX_EXCLUDES;
+    if (scfg->exclude_count > 0) {
+        memcpy(scfg->excludes, cfg->probe_excludes,
+               scfg->exclude_count * sizeof(scan_extra_subnet_t));
+    }
+}
+
+/* How the request being handled addressed the API. CivetWeb runs a request
+ * from begin_request to the end of its handler on one worker thread. */
+enum { API_PATH_LEGACY, API_PATH_VERSIONED, API_PATH_UI };
+static _Thread_local int g_api_path;
+static _Thread_local int g_api_version = AUTOD_WIRE_LEGACY;
+static _Thread_local const char *g_api_local_uri;   /* NULL = local_uri as is */
+static _Thread_local char g_request_id[AUTOD_REQUEST_ID_MAX];
+
+int api_request_version(void) {
+    return g_api_version;
+}
+
+const char *api_request_id(void) {
+    return g_request_id;
+}
+
+const char *api_local_uri(const struct mg_connection *c) {
+    if (g_api_local_uri) return g_api_local_uri;
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    return ri && ri->local_uri ? ri->local_uri : "/";
+}
+
+const char *api_unversioned(const char *path) {
+    if (!path || path[0] != '/' || path[1] != 'v' || !isdigit((unsigned char)path[2])) return path;
+    const char *end = path + 2;
+    while (isdigit((unsigned char)*end)) end++;
+    if (*end == '\0') return "/";
+    return *end == '/' ? end : path;
+}
+
+void api_set_handler(struct mg_context *ctx, const char *uri,
+                     int (*handler)(struct mg_connection *, void *), void *cbdata) {
+    mg_set_request_handler(ctx, uri, handler, cbdata);
+    for (int n = AUTOD_WIRE_VERSION_MIN; n <= AUTOD_WIRE_VERSION; n++) {
+        char versioned[128];
+        /* "/" stands for everything under the prefix that nothing else took. */
+        snprintf(versioned, sizeof(versioned), "/v%d%s", n, strcmp(uri, "/") ? uri : "");
+        mg_set_request_handler(ctx, versioned, handler, cbdata);
+    }
+}
+
+void api_set_request_id(const char *id) {
+    snprintf(g_request_id, sizeof(g_request_id), "%s", id ? id : "");
+    httpc_set_request_id(g_request_id);
+}
+
+/* Keep the caller's X-Request-ID when it is a plain token; otherwise (or
+ * without one) make one up. */
+static void request_id_begin(struct mg_connection *conn) {
+    const char *id = mg_get_header(conn, "X-Request-ID");
+    size_t len = id ? strlen(id) : 0;
+    if (len == 0 || len >= AUTOD_REQUEST_ID_MAX ||
+        strspn(id, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789._:-") != len) {
+        char made[17];
+        random_id(made, sizeof(made));
+        api_set_request_id(made);
+        return;
+    }
+    api_set_request_id(id);
+}
+
+void api_print_headers(struct mg_connection *c, int cors_public) {
+    mg_printf(c, "API-Version: %d\r\n", g_api_version);
+    if (g_request_id[0]) mg_printf(c, "X-Request-ID: %s\r\n", g_request_id);
+    if (g_api_path == API_PATH_LEGACY) {
+        /* The raw request line cannot carry CR/LF, unlike the decoded URI. */
+        const struct mg_request_info *ri = mg_get_request_info(c);
+        const char *raw = (ri && ri->local_uri_raw) ? ri->local_uri_raw : "/";
+        mg_printf(c, "Deprecation: true\r\n");
+        mg_printf(c, "Link: </v%d%s>; rel=\"successor-version\"\r\n", AUTOD_WIRE_LEGACY, raw);
+    }
+    if (cors_public) {
+        mg_printf(c, "Access-Control-Expose-Headers: API-Version, Deprecation, Link, X-Request-ID\r\n");
+    }
+}
+
+static int api_version_error(struct mg_connection *conn, int code, int requested) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "error", "unsupported_api_version");
+    json_object_set_number(o, "requested", requested);
+    json_object_set_number(o, "min", AUTOD_WIRE_VERSION_MIN);
+    json_object_set_number(o, "max", AUTOD_WIRE_VERSION);
+    send_json(conn, v, code, 1);
+    json_value_free(v);
+    return code;
+}
+
+/* Note where a /v<N> prefix ends so handlers see the same paths either way
+ * (api_local_uri), and pick the wire revision: the prefix, else an
+ * Accept-Version header, else the legacy revision. Returns a status when the
+ * request was answered here. */
+static int api_negotiate(struct mg_connection *conn) {
+    const struct mg_request_info *ri = mg_get_request_info(conn);
+    g_api_path = API_PATH_LEGACY;
+    g_api_version = AUTOD_WIRE_LEGACY;
+    g_api_local_uri = NULL;
+    const char *uri = ri ? ri->local_uri : NULL;
+    if (uri && uri[0] == '/' && uri[1] == 'v' && isdigit((unsigned char)uri[2])) {
+        char *end = NULL;
+        long n = strtol(uri + 2, &end, 10);
+        if (*end == '/' || *end == '\0') {
+            g_api_path = API_PATH_VERSIONED;
+            g_api_version = AUTOD_WIRE_VERSION;
+            if (n < AUTOD_WIRE_VERSION_MIN || n > AUTOD_WIRE_VERSION) {
+                return api_version_error(conn, 404, (int)n);
+            }
+            g_api_version = (int)n;
+            g_api_local_uri = *end ? end : "/";
+            return 0;
+        }
+    }
+    const char *accept = mg_get_header(conn, "Accept-Version");
+    if (accept && *accept) {
+        char *end = NULL;
+        long n = strtol(accept, &end, 10);
+        if (end == accept || n < AUTOD_WIRE_VERSION_MIN || n > AUTOD_WIRE_VERSION) {
+            return api_version_error(conn, 406, (int)n);
+        }
+        g_api_version = (int)n;
+    }
+    return 0;
+}
+
+static int on_begin_request(struct mg_connection *conn) {
+    app_t *app = (app_t *)mg_get_user_data(mg_get_context(conn));
+    if (app) {
+        pthread_mutex_lock(&app->inflight_lock);
+        app->inflight++;
+        pthread_mutex_unlock(&app->inflight_lock);
+    }
+    request_id_begin(conn);
+    caller_set("", "anonymous");
+    int handled = api_negotiate(conn);
+    if (handled) return handled;
+    return debug_before_request(conn);
+}
+
+static void on_end_request(const struct mg_connection *conn, int reply_status_code) {
+    (void)reply_status_code;
+    api_set_request_id(NULL);
+    g_api_local_uri = NULL;
+    caller_set(NULL, NULL);
+    app_t *app = (app_t *)mg_get_user_data(mg_get_context(conn));
+    if (app) {
+        pthread_mutex_lock(&app->inflight_lock);
+        if (app->inflight > 0) app->inflight--;
+        pthread_mutex_unlock(&app->inflight_lock);
+    }
+}
+
+static int inflight_count(app_t *app) {
+    pthread_mutex_lock(&app->inflight_lock);
+    int n = app->inflight;
+    pthread_mutex_unlock(&app->inflight_lock);
+    return n;
+}
+
+/* Close the listeners (so a successor bound with reuse_port receives every new
+ * connection) and wait for in-flight requests before mg_stop() tears down the
+ * worker threads. */
+static void drain_http_server(app_t *app, int timeout_ms) {
+    if (!app || !app->ctx) return;
+    int n = inflight_count(app);
+    if (n == 0 || timeout_ms <= 0) return;
+    fprintf(stderr, "autod: draining %d in-flight request(s) (timeout %d ms)\n", n, timeout_ms);
+    mg_stop_listening(app->ctx);
+    long long deadline = now_ms() + timeout_ms;
+    int idle_polls = 0;
+    while (now_ms() < deadline) {
+        struct timespec ts = { 0, 100 * 1000 * 1000 };
+        nanosleep(&ts, NULL);
+        if (inflight_count(app) == 0) {
+            if (++idle_polls >= 3) return;
+        } else {
+            idle_polls = 0;
+        }
+    }
+    fprintf(stderr, "autod: drain timeout, %d request(s) still in flight\n", inflight_count(app));
 }
 
 static int log_civet_message(const struct mg_connection *conn, const char *message) {
@@ -287,6 +1178,47 @@ long long now_ms(void) {
     return (long long)ts.tv_sec*1000LL + ts.tv_nsec/1000000LL;
 }
 
+static int random_hex(char *out, size_t out_sz) {
+    unsigned char raw[32];
+    size_t n = (out_sz - 1) / 2;
+    if (n > sizeof(raw)) n = sizeof(raw);
+    out[0] = '\0';
+    int fd = open("/dev/urandom", O_RDONLY | O_CLOEXEC);
+    if (fd < 0) return -1;
+    size_t got = 0;
+    while (got < n) {
+        ssize_t r = read(fd, raw + got, n - got);
+        if (r < 0 && errno == EINTR) continue;
+        if (r <= 0) break;
+        got += (size_t)r;
+    }
+    close(fd);
+    if (got < n) return -1;
+    for (size_t i = 0; i < n; i++) snprintf(out + i * 2, 3, "%02x", raw[i]);
+    out[n * 2] = '\0';
+    return 0;
+}
+
+int random_token(char *out, size_t out_sz) {
+    if (random_hex(out, out_sz) == 0) return 0;
+    fprintf(stderr, "ERROR: cannot read /dev/urandom; refusing to issue a token\n");
+    return -1;
+}
+
+void random_id(char *out, size_t out_sz) {
+    static unsigned long long counter;
+    if (random_hex(out, out_sz) == 0) return;
+    /* Unique enough to tell requests apart, but guessable: never a secret. */
+    unsigned long long seed = (unsigned long long)now_ms() ^ ((unsigned long long)getpid() << 32) ^
+                              (__atomic_add_fetch(&counter, 1, __ATOMIC_RELAXED) << 16);
+    size_t n = (out_sz - 1) / 2;
+    for (size_t i = 0; i < n; i++) {
+        seed = seed * 6364136223846793005ULL + 1442695040888963407ULL;
+        snprintf(out + i * 2, 3, "%02x", (unsigned)(seed >> 56));
+    }
+    out[n * 2] = '\0';
+}
+
 static void json_add_runtime(JSON_Object *o) {
     FILE *f=fopen("/proc/uptime","r");
     if(f){
@@ -339,8 +1271,6 @@ static void json_add_ifaddrs(JSON_Object *o) {
 
 /* ----------------------- Exec runner ----------------------- */
 
-enum { MAX_BODY_BYTES = 262144 }; /* 256 KiB guard */
-
 static void close_pipe_pair(int pipefd[2]) {
     if (pipefd[0] >= 0) { close(pipefd[0]); pipefd[0] = -1; }
     if (pipefd[1] >= 0) { close(pipefd[1]); pipefd[1] = -1; }
@@ -387,16 +1317,146 @@ static void drain_exec_pipes(int out_fd, int err_fd,
     drain_exec_pipe(err_fd, buf_err, werr, max_bytes);
 }
 
+/* root is the sandbox chroot the file will be executed in (NULL/"" = host). */
+int exec_is_runnable(const char *root, const char *file) {
+    char full[PATH_MAX];
+    if (root && *root) {
+        int n = snprintf(full, sizeof(full), "%s%s", root, file);
+        if (n < 0 || (size_t)n >= sizeof(full)) return 0;
+        file = full;
+    }
+    struct stat st;
+    return stat(file, &st) == 0 && S_ISREG(st.st_mode) && access(file, X_OK) == 0;
+}
+
+/* Resolve a command name the way execvp() would, but against search_path
+ * (falling back to $PATH when empty) inside root. Names containing '/' are
+ * used as-is. */
+int exec_resolve_binary(const char *root, const char *name, const char *search_path,
+                        char *out, size_t out_sz) {
+    if (!name || !*name) return -1;
+    if (strchr(name, '/')) {
+        if (!exec_is_runnable(root, name) || strlen(name) >= out_sz) return -1;
+        strncpy(out, name, out_sz - 1);
+        out[out_sz - 1] = '\0';
+        return 0;
+    }
+    const char *sp = (search_path && *search_path) ? search_path : getenv("PATH");
+    if (!sp || !*sp) sp = "/usr/sbin:/usr/bin:/sbin:/bin";
+    char dirs[1024];
+    strncpy(dirs, sp, sizeof(dirs) - 1);
+    dirs[sizeof(dirs) - 1] = '\0';
+    char *save = NULL;
+    for (char *dir = strtok_r(dirs, ":", &save); dir; dir = strtok_r(NULL, ":", &save)) {
+        if (!*dir) continue;
+        int n = snprintf(out, out_sz, "%s/%s", dir, name);
+        if (n < 0 || (size_t)n >= out_sz) continue;
+        if (exec_is_runnable(root, out)) return 0;
+    }
+    return -1;
+}
+
+/* Build "'name' 'arg1' ..." for sh -c, single-quoting every word. */
+static char *exec_shell_command(const char *name, JSON_Array *args) {
+    size_t narg = args ? json_array_get_count(args) : 0;
+    size_t cap = 1;
+    for (size_t i = 0; i <= narg; i++) {
+        const char *w = i == 0 ? name : json_array_get_string(args, i - 1);
+        cap += 3 + (w ? strlen(w) * 4 : 0);
+    }
+    char *cmd = malloc(cap);
+    if (!cmd) return NULL;
+    size_t o = 0;
+    for (size_t i = 0; i <= narg; i++) {
+        const char *w = i == 0 ? name : json_array_get_string(args, i - 1);
+        if (!w) w = "";
+        if (i > 0) cmd[o++] = ' ';
+        cmd[o++] = '\'';
+        for (const char *p = w; *p; p++) {
+            if (*p == '\'') { memcpy(cmd + o, "'\\''", 4); o += 4; }
+            else cmd[o++] = *p;
+        }
+        cmd[o++] = '\'';
+    }
+    cmd[o] = '\0';
+    return cmd;
+}
+
+/* Env of the exec being run on this thread; exported in the child. */
+static _Thread_local JSON_Object *g_exec_env;
+
+static void exec_context_export(void) {
+    for (size_t i = 0; g_exec_env && i < json_object_get_count(g_exec_env); i++) {
+        setenv(json_object_get_name(g_exec_env, i),
+               json_string(json_object_get_value_at(g_exec_env, i)), 1);
+    }
+}
+
 int run_exec(const config_t *cfg, const char *path, JSON_Array *args,
-                    int timeout_ms, int max_bytes,
-                    int *rc_out, long long *elapsed_ms,
-                    char **out_stdout, char **out_stderr)
+                    int timeout_ms, int max_bytes, const exec_profile_t *profile,
+                    const char *request_id, int *rc_out, long long *elapsed_ms,
+                    char **out_stdout, char **out_stderr,
+                    size_t *out_len, size_t *err_len, exec_usage_t *usage)
 {
     int out_pipe[2] = { -1, -1 }, err_pipe[2] = { -1, -1 };
     char *buf_out = NULL, *buf_err = NULL;
     pid_t pid = -1;
     long long t0 = 0;
+    unsigned long job_id = 0;
+
+    char binary[PATH_MAX];
+    char *shell_cmd = NULL;
+    char cg_dir[PATH_MAX] = "";
+    int reserved = 0;
+
+    uid_t run_uid = 0;
+    gid_t run_gid = 0;
+
+    if (usage) memset(usage, 0, sizeof(*usage));
+    if (profile) {
+        if (profile->timeout_ms > 0) timeout_ms = profile->timeout_ms;
+        if (profile->max_output_bytes > 0) max_bytes = profile->max_output_bytes;
+        if (profile_resolve_user(profile, &run_uid, &run_gid) != 0) {
+            notify_exec_result(cfg, path, -1);
+            return -1;
+        }
+    }
+    /* Binaries of sandboxed commands are looked up inside the chroot. */
+    const sandbox_profile_t *sandbox = sandbox_select(cfg, path);
+    const char *root = sandbox ? sandbox->root : NULL;
+    if (!strcmp(cfg->exec_mode, "argv")) {
+        /* argv mode runs the named binary directly; sh -c is only used when
+         * it cannot be found and shell_fallback allows it (shell builtins,
+         * BusyBox applets without a symlink). */
+        if (exec_resolve_binary(root, path, cfg->exec_path, binary, sizeof(binary)) != 0) {
+            if (!cfg->exec_shell_fallback || !exec_is_runnable(root, "/bin/sh")) {
+                notify_exec_result(cfg, path, -1);
+                return EXEC_ERR_NOT_FOUND;
+            }
+            shell_cmd = exec_shell_command(path, args);
+            if (!shell_cmd) goto fail_before_fork;
+        }
+    } else if (!exec_is_runnable(root, cfg->interpreter)) {
+        fprintf(stderr, "exec: interpreter %s not found or not executable\n", cfg->interpreter);
+        notify_exec_result(cfg, path, -1);
+        return EXEC_ERR_NOT_FOUND;
+    }
 
+    /* Pinned files run only while their SHA-256 still matches. */
+    if (integrity_check_exec(cfg, root, path,
+                             !strcmp(cfg->exec_mode, "argv") && !shell_cmd ? binary : NULL) != 0) {
+        free(shell_cmd);
+        notify_exec_result(cfg, path, -1);
+        return EXEC_ERR_INTEGRITY;
+    }
+    if (capacity_job_acquire(cfg) != 0) {
+        free(shell_cmd);
+        return EXEC_ERR_CAPACITY;
+    }
+    reserved = 1;
+    if (cgroup_limited(profile) && cgroup_create(cfg, profile, cg_dir, sizeof(cg_dir)) != 0) {
+        goto fail_before_fork;
+    }
     if (pipe(out_pipe) < 0) goto fail_before_fork;
     if (pipe(err_pipe) < 0) goto fail_before_fork;
 
@@ -410,20 +1470,37 @@ int run_exec(const config_t *cfg, const char *path, JSON_Array *args,
         close(out_pipe[0]); close(out_pipe[1]);
         close(err_pipe[0]); close(err_pipe[1]);
 
+        if (cg_dir[0] && cgroup_enter(cg_dir) != 0) _exit(126);
+        if (profile_enter(profile) != 0) _exit(126);
+        if (sandbox && sandbox_enter(sandbox) != 0) _exit(126);
+        if (cfg->exec_path[0]) setenv("PATH", cfg->exec_path, 1);
+        caller_export_env();
+        exec_context_export();
+        if (profile_drop_user(profile, run_uid, run_gid) != 0) _exit(126);
+        if (shell_cmd) {
+            execl("/bin/sh", "sh", "-c", shell_cmd, (char*)NULL);
+            dprintf(STDERR_FILENO, "execl /bin/sh failed: %s\n", strerror(errno));
+            _exit(127);
+        }
+
+        int argv_mode = !strcmp(cfg->exec_mode, "argv");
         size_t narg = args ? json_array_get_count(args) : 0;
         size_t ac = 2 + narg + 1;
         char **argv = calloc(ac, sizeof(char*));
         if (!argv) _exit(127);
-        argv[0] = (char*)cfg->interpreter;
-        argv[1] = (char*)path;
-        for (size_t i=0;i<narg;i++) argv[2+i] = (char*)json_array_get_string(args, i);
-        argv[2+narg] = NULL;
-        execv(cfg->interpreter, argv);
+        size_t ai = 0;
+        if (!argv_mode) argv[ai++] = (char*)cfg->interpreter;
+        argv[ai++] = (char*)path;
+        for (size_t i=0;i<narg;i++) argv[ai++] = (char*)json_array_get_string(args, i);
+        argv[ai] = NULL;
+        execv(argv_mode ? binary : cfg->interpreter, argv);
         dprintf(STDERR_FILENO, "execv failed: %s\n", strerror(errno));
         _exit(127);
     }
 
     /* parent */
+    free(shell_cmd); shell_cmd = NULL;
+    job_id = jobs_start(pid, path, request_id);
     close(out_pipe[1]); out_pipe[1] = -1;
     close(err_pipe[1]); err_pipe[1] = -1;
     buf_out = malloc(max_bytes + 1);
@@ -441,7 +1518,8 @@ int run_exec(const config_t *cfg, const char *path, JSON_Array *args,
     int child_done = 0;
 
     while (remain > 0) {
-        int pr = poll(pfds, 2, remain);
+        /* Wake up periodically so the job's process tree gets sampled. */
+        int pr = poll(pfds, 2, remain < 250 ? remain : 250);
         long long t = now_ms();
 
         if (pr < 0) {
@@ -462,11 +1540,12 @@ int run_exec(const config_t *cfg, const char *path, JSON_Array *args,
             }
         }
 
-        pid_t wp = waitpid(pid, &status, WNOHANG);
+        jobs_sample(job_id);
+        pid_t wp = jobs_waitpid(job_id, pid, &status, WNOHANG);
         if (wp == pid) { child_done = 1; break; }
 
         if (!(pfds[0].events || pfds[1].events)) {
-            wp = waitpid(pid, &status, WNOHANG);
+            wp = jobs_waitpid(job_id, pid, &status, WNOHANG);
             if (wp == pid) child_done = 1;
             break;
         }
@@ -480,14 +1559,16 @@ int run_exec(const config_t *cfg, const char *path, JSON_Array *args,
     close_pipe_pair(err_pipe);
 
     int rc = 0;
+    int timed_out = 0;
     if (!child_done) {
-        pid_t wp = waitpid(pid, &status, WNOHANG);
+        pid_t wp = jobs_waitpid(job_id, pid, &status, WNOHANG);
         if (wp == pid) {
             child_done = 1;
         } else {
             kill(pid, SIGKILL);
-            waitpid(pid, &status, 0);
+            jobs_waitpid(job_id, pid, &status, 0);
             rc = 124;
+            timed_out = remain <= 0;
         }
     }
 
@@ -500,8 +1581,22 @@ int run_exec(const config_t *cfg, const char *path, JSON_Array *args,
     *elapsed_ms = now_ms() - t0;
     buf_out[wout] = '\0';
     buf_err[werr] = '\0';
+    /* Secrets are masked before any caller can return or store the output. */
+    size_t olen = (size_t)wout, elen = (size_t)werr;
+    (void)redact_output(cfg, path, &buf_out, &olen);
+    (void)redact_output(cfg, path, &buf_err, &elen);
     *out_stdout = buf_out;
     *out_stderr = buf_err;
+    if (out_len) *out_len = olen;
+    if (err_len) *err_len = elen;
+    jobs_finish(job_id, rc, usage);
+    if (usage) {
+        usage->timed_out = timed_out;
+        usage->timeout_ms = timeout_ms;
+    }
+    if (cg_dir[0]) cgroup_finish(cg_dir, usage);
+    capacity_job_release();
+    notify_exec_result(cfg, path, rc);
     return 0;
 
 fail_after_fork:
@@ -513,11 +1608,19 @@ fail_after_fork:
         kill(pid, SIGKILL);
         while (waitpid(pid, NULL, 0) < 0 && errno == EINTR) {}
     }
+    jobs_finish(job_id, -1, NULL);
+    if (cg_dir[0]) cgroup_finish(cg_dir, NULL);
+    capacity_job_release();
+    notify_exec_result(cfg, path, -1);
     return -1;
 
 fail_before_fork:
+    free(shell_cmd);
     close_pipe_pair(out_pipe);
     close_pipe_pair(err_pipe);
+    if (cg_dir[0]) cgroup_finish(cg_dir, NULL);
+    if (reserved) capacity_job_release();
+    notify_exec_result(cfg, path, -1);
     return -1;
 }
 
@@ -527,15 +1630,41 @@ static const char *reason_phrase_for_status(int code) {
     switch (code) {
     case 200: return "OK";
     case 202: return "Accepted";
+    case 304: return "Not Modified";
     case 400: return "Bad Request";
+    case 401: return "Unauthorized";
+    case 403: return "Forbidden";
     case 404: return "Not Found";
+    case 405: return "Method Not Allowed";
+    case 406: return "Not Acceptable";
+    case 409: return "Conflict";
+    case 413: return "Payload Too Large";
+    case 422: return "Unprocessable Entity";
+    case 423: return "Locked";
+    case 428: return "Precondition Required";
+    case 429: return "Too Many Requests";
     case 500: return "Internal Server Error";
+    case 502: return "Bad Gateway";
+    case 503: return "Service Unavailable";
+    case 504: return "Gateway Timeout";
     default:  return NULL;
     }
 }
 
-static void add_common_headers_extra(struct mg_connection *c, int code, const char *ctype,
-                                     size_t clen, int cors_public, const char *extra) {
+/* Keep-alive is offered only to autod peers that ask for it: an idle
+ * connection holds one of the server's worker threads until
+ * [http] idle_timeout_ms, and dispatch between nodes is what it is for. */
+static const char *response_connection(struct mg_connection *c) {
+    const char *conn = mg_get_header(c, "Connection");
+    if (conn && !strcasecmp(conn, "keep-alive") && mg_get_header(c, "X-Autod-Api")) {
+        return "keep-alive";
+    }
+    return "close";
+}
+
+static void add_common_headers_cache(struct mg_connection *c, int code, const char *ctype,
+                                     size_t clen, int cors_public, const char *extra,
+                                     const char *cache_control) {
     const char *reason = reason_phrase_for_status(code);
     if (reason) {
         mg_printf(c, "HTTP/1.1 %d %s\r\n", code, reason);
@@ -548,11 +1677,17 @@ static void add_common_headers_extra(struct mg_connection *c, int code, const ch
         mg_printf(c, "Access-Control-Allow-Origin: *\r\n");
         mg_printf(c, "Vary: Origin\r\n");
     }
+    api_print_headers(c, cors_public);
     if (extra && *extra) {
         mg_printf(c, "%s", extra);
     }
-    mg_printf(c, "Cache-Control: no-store\r\n");
-    mg_printf(c, "Connection: close\r\n\r\n");
+    mg_printf(c, "Cache-Control: %s\r\n", cache_control ? cache_control : "no-store");
+    mg_printf(c, "Connection: %s\r\n\r\n", response_connection(c));
+}
+
+static void add_common_headers_extra(struct mg_connection *c, int code, const char *ctype,
+                                     size_t clen, int cors_public, const char *extra) {
+    add_common_headers_cache(c, code, ctype, clen, cors_public, extra, NULL);
 }
 
 static void add_common_headers(struct mg_connection *c, int code, const char *ctype,
@@ -564,8 +1699,8 @@ static void add_cors_options(struct mg_connection *c) {
     mg_printf(c,
       "HTTP/1.1 204 No Content\r\n"
       "Access-Control-Allow-Origin: *\r\n"
-      "Access-Control-Allow-Methods: GET,POST,OPTIONS\r\n"
-      "Access-Control-Allow-Headers: Content-Type\r\n"
+      "Access-Control-Allow-Methods: GET,POST,PUT,PATCH,DELETE,OPTIONS\r\n"
+      "Access-Control-Allow-Headers: Content-Type, Idempotency-Key, If-None-Match, If-Modified-Since, Accept-Version, X-Request-ID\r\n"
       "Access-Control-Max-Age: 600\r\n"
       "Content-Length: 0\r\n"
       "Connection: close\r\n\r\n");
@@ -637,8 +1772,97 @@ int read_body(struct mg_connection *c, upload_t *u) {
     return 0;
 }
 
+/* How a read wants its JSON: ?pretty=true indents it (compact by default)
+ * and ?fields=a,b keeps only those members of each item. */
+typedef struct {
+    int pretty;
+    char fields[256];
+} json_view_t;
+
+/* The view a successful GET or HEAD on c asks for. Returns 1 when it differs
+ * from plain compact output. */
+static int json_view_get(struct mg_connection *c, int code, json_view_t *view) {
+    memset(view, 0, sizeof(*view));
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri || !ri->query_string || code < 200 || code >= 300 ||
+        (strcmp(ri->request_method, "GET") != 0 && strcmp(ri->request_method, "HEAD") != 0)) {
+        return 0;
+    }
+    const char *qs = ri->query_string;
+    size_t qlen = strlen(qs);
+    char buf[8];
+    if (mg_get_var(qs, qlen, "pretty", buf, sizeof(buf)) > 0) {
+        view->pretty = !strcmp(buf, "1") || !strcasecmp(buf, "true") || !strcasecmp(buf, "yes");
+    }
+    if (mg_get_var(qs, qlen, "fields", view->fields, sizeof(view->fields)) <= 0) view->fields[0] = '\0';
+    return view->pretty || view->fields[0];
+}
+
+static int json_view_wants(const char *fields, const char *name) {
+    size_t n = strlen(name);
+    for (const char *p = fields; *p; ) {
+        while (*p == ',' || *p == ' ') p++;
+        size_t len = strcspn(p, ", ");
+        if (len == n && !strncmp(p, name, n)) return 1;
+        p += len;
+    }
+    return 0;
+}
+
+static void json_view_project_object(JSON_Object *o, const char *fields) {
+    for (size_t i = json_object_get_count(o); i-- > 0; ) {
+        const char *name = json_object_get_name(o, i);
+        if (name && !json_view_wants(fields, name)) json_object_remove(o, name);
+    }
+}
+
+static int json_view_project_array(JSON_Array *a, const char *fields) {
+    int hit = 0;
+    for (size_t i = 0; i < json_array_get_count(a); i++) {
+        JSON_Object *o = json_array_get_object(a, i);
+        if (!o) continue;
+        json_view_project_object(o, fields);
+        hit = 1;
+    }
+    return hit;
+}
+
+/* Items are the objects of a top-level array, the objects in the arrays of a
+ * top-level object (its other members stay), or else the object itself. */
+static void json_view_project(JSON_Value *v, const char *fields) {
+    if (json_value_get_type(v) == JSONArray) {
+        (void)json_view_project_array(json_array(v), fields);
+        return;
+    }
+    JSON_Object *o = json_object(v);
+    if (!o) return;
+    int hit = 0;
+    for (size_t i = 0; i < json_object_get_count(o); i++) {
+        JSON_Array *a = json_value_get_array(json_object_get_value_at(o, i));
+        if (a && json_view_project_array(a, fields)) hit = 1;
+    }
+    if (!hit) json_view_project_object(o, fields);
+}
+
+/* v serialized the way view asks (v is left alone). */
+static char *json_view_serialize(const JSON_Value *v, const json_view_t *view) {
+    JSON_Value *copy = NULL;
+    if (view && view->fields[0]) {
+        copy = json_value_deep_copy(v);
+        if (copy) {
+            json_view_project(copy, view->fields);
+            v = copy;
+        }
+    }
+    char *s = view && view->pretty ? json_serialize_to_string_pretty(v) : json_serialize_to_string(v);
+    if (copy) json_value_free(copy);
+    return s;
+}
+
 void send_json(struct mg_connection *c, JSON_Value *v, int code, int cors_public) {
-    char *s = json_serialize_to_string(v);
+    json_view_t view;
+    int shaped = json_view_get(c, code, &view);
+    char *s = json_view_serialize(v, shaped ? &view : NULL);
     size_t n = s ? strlen(s) : 0;
     add_common_headers(c, code, "application/json; charset=utf-8", n, cors_public);
     if (n) mg_write(c, s, (int)n);
@@ -652,6 +1876,19 @@ void send_plain(struct mg_connection *c, int code, const char *msg, int cors_pub
     if (n) mg_write(c, text, (int)n);
 }
 
+void send_json_error_field(struct mg_connection *c, int code, const char *error,
+                           const char *key, const char *value) {
+    JSON_Value *v = json_value_init_object();
+    json_object_set_string(json_object(v), "error", error);
+    if (key && value && *value) json_object_set_string(json_object(v), key, value);
+    send_json(c, v, code, 1);
+    json_value_free(v);
+}
+
+void send_json_error(struct mg_connection *c, int code, const char *error) {
+    send_json_error_field(c, code, error, NULL, NULL);
+}
+
 static int format_http_date(time_t when, char *buf, size_t buf_sz) {
     if (!buf || buf_sz == 0) return -1;
 #if defined(_WIN32)
@@ -664,12 +1901,115 @@ static int format_http_date(time_t when, char *buf, size_t buf_sz) {
     return strftime(buf, buf_sz, "%a, %d %b %Y %H:%M:%S GMT", &tmp) ? 0 : -1;
 }
 
+/* Parse an IMF-fixdate ("Sun, 06 Nov 1994 08:49:37 GMT"); -1 if malformed. */
+static long long parse_http_date(const char *s) {
+    static const char months[] = "JanFebMarAprMayJunJulAugSepOctNovDec";
+    char mon[4];
+    int d, y, hh, mm, ss;
+    if (!s || sscanf(s, "%*3s, %d %3s %d %d:%d:%d", &d, mon, &y, &hh, &mm, &ss) != 6) return -1;
+    const char *hit = strstr(months, mon);
+    if (!hit || strlen(mon) != 3 || (hit - months) % 3 != 0) return -1;
+    int m = (int)(hit - months) / 3 + 1;
+    /* days since 1970-01-01, proleptic Gregorian */
+    int yy = y - (m <= 2);
+    long long era = (yy >= 0 ? yy : yy - 399) / 400;
+    long long yoe = yy - era * 400;
+    long long doy = (153 * (m + (m > 2 ? -3 : 9)) + 2) / 5 + d - 1;
+    long long doe = yoe * 365 + yoe / 4 - yoe / 100 + doy;
+    long long days = era * 146097 + doe - 719468;
+    return days * 86400LL + hh * 3600LL + mm * 60LL + ss;
+}
+
+static int etag_list_matches(const char *list, const char *etag) {
+    if (!list || !etag) return 0;
+    size_t elen = strlen(etag);
+    const char *p = list;
+    while (*p) {
+        while (*p == ' ' || *p == '\t' || *p == ',') p++;
+        if (!*p) break;
+        if (*p == '*') return 1;
+        if (!strncmp(p, "W/", 2)) p += 2;
+        const char *end = strchr(p, ',');
+        size_t len = end ? (size_t)(end - p) : strlen(p);
+        while (len > 0 && (p[len - 1] == ' ' || p[len - 1] == '\t')) len--;
+        if (len == elen && !strncmp(p, etag, elen)) return 1;
+        p += len;
+        if (end) p = end + 1;
+    }
+    return 0;
+}
+
+static long long g_http_boot_unix;
+
+/*
+ * Conditional GET for polled read endpoints. The ETag is built from the
+ * endpoint scope, the daemon's start time and a payload version the caller
+ * bumps whenever the underlying data changes, so tags never collide across
+ * restarts. If-None-Match wins over If-Modified-Since as per RFC 9110.
+ */
+void send_json_cached(struct mg_connection *c, const char *body, size_t len,
+                      const char *scope, unsigned long long version,
+                      long long modified_unix, int cors_public) {
+    /* A shaped view is its own representation: rebuilt from the cached body
+     * and tagged apart from the plain one. */
+    json_view_t view;
+    char *shaped = NULL;
+    unsigned long view_tag = 0;
+    if (json_view_get(c, 200, &view) && body) {
+        JSON_Value *v = json_parse_string(body);
+        shaped = v ? json_view_serialize(v, &view) : NULL;
+        if (v) json_value_free(v);
+        if (shaped) {
+            body = shaped;
+            len = strlen(shaped);
+            view_tag = view.pretty ? 5381 * 33 + 'p' : 5381;
+            for (const char *p = view.fields; *p; p++) view_tag = view_tag * 33 + (unsigned char)*p;
+        }
+    }
+    char etag[96];
+    if (view_tag) {
+        snprintf(etag, sizeof(etag), "\"%s-%llx-%llu-%lx\"",
+                 scope ? scope : "r", (unsigned long long)g_http_boot_unix, version, view_tag);
+    } else {
+        snprintf(etag, sizeof(etag), "\"%s-%llx-%llu\"",
+                 scope ? scope : "r", (unsigned long long)g_http_boot_unix, version);
+    }
+    char http_date[64];
+    http_date[0] = '\0';
+    if (modified_unix > 0) format_http_date((time_t)modified_unix, http_date, sizeof(http_date));
+
+    char extra[192];
+    int n = snprintf(extra, sizeof(extra), "ETag: %s\r\n", etag);
+    if (http_date[0] && n > 0 && n < (int)sizeof(extra)) {
+        snprintf(extra + n, sizeof(extra) - (size_t)n, "Last-Modified: %s\r\n", http_date);
+    }
+
+    int not_modified = 0;
+    const char *inm = mg_get_header(c, "If-None-Match");
+    if (inm) {
+        not_modified = etag_list_matches(inm, etag);
+    } else if (modified_unix > 0) {
+        long long ims = parse_http_date(mg_get_header(c, "If-Modified-Since"));
+        if (ims >= 0 && modified_unix <= ims) not_modified = 1;
+    }
+
+    if (not_modified) {
+        add_common_headers_cache(c, 304, "application/json; charset=utf-8", 0,
+                                 cors_public, extra, "no-cache");
+        if (shaped) json_free_serialized_string(shaped);
+        return;
+    }
+    add_common_headers_cache(c, 200, "application/json; charset=utf-8", len,
+                             cors_public, extra, "no-cache");
+    if (len && body) mg_write(c, body, len);
+    if (shaped) json_free_serialized_string(shaped);
+}
+
 /* ----------------------- HTTP Handlers ----------------------- */
 void app_rebuild_config_locked(app_t *app) {
     if (!app) return;
-    config_t merged = app->base_cfg;
-    sync_ensure_id(&merged);
-    app->cfg = merged;
+    app->cfg = app->base_cfg;
+    sync_ensure_id(&app->cfg);
 }
 
 void app_config_snapshot(app_t *app, config_t *out) {
@@ -713,12 +2053,26 @@ static void run_startup_exec_sequence(app_t *app) {
             continue;
         }
 
+        int unknown_profile = 0;
+        const exec_profile_t *profile =
+            profile_select(&cfg, path, json_object_get_string(obj, "profile"), &unknown_profile);
+        if (unknown_profile) {
+            fprintf(stderr,
+                    "startup exec[%d]: unknown profile '%s' for %s\n",
+                    i + 1, json_object_get_string(obj, "profile"), path);
+            json_value_free(cmd);
+            continue;
+        }
+
         char *out = NULL;
         char *err = NULL;
         int rc = 0;
         long long elapsed = 0;
-        int r = run_exec(&cfg, path, args, cfg.exec_timeout_ms,
-                         cfg.max_output_bytes, &rc, &elapsed, &out, &err);
+        sync_results_record(&cfg, "startup", 0, path, "started", 0, 0);
+        int r = run_exec(&cfg, path, args, cfg.exec_timeout_ms, cfg.max_output_bytes,
+                         profile, NULL, &rc, &elapsed, &out, &err, NULL, NULL, NULL);
+        sync_results_record(&cfg, "startup", 0, path, r == 0 ? "finished" : "failed",
+                            r == 0 ? rc : r, elapsed);
         if (r == 0) {
             fprintf(stderr,
                     "startup exec[%d]: %s rc=%d elapsed=%lldms\n",
@@ -731,8 +2085,9 @@ static void run_startup_exec_sequence(app_t *app) {
             }
         } else {
             fprintf(stderr,
-                    "startup exec[%d]: failed to run %s\n",
-                    i + 1, path);
+                    "startup exec[%d]: failed to run %s%s\n",
+                    i + 1, path, r == EXEC_ERR_NOT_FOUND ? " (binary not found)" :
+                    r == EXEC_ERR_INTEGRITY ? " (integrity check failed)" : "");
         }
         if (out) free(out);
         if (err) free(err);
@@ -745,12 +2100,28 @@ static int h_health(struct mg_connection *c, void *ud){
     (void)ud;
     JSON_Value *v=json_value_init_object(); JSON_Object *o=json_object(v);
     json_object_set_string(o,"status","ok");
+    version_build_info(o);
     send_json(c, v, 200, 1);
     json_value_free(v);
     return 1;
 }
 
-static int stream_file(struct mg_connection *c, const char *path, int cors_public, int json_on_missing){
+static int h_version(struct mg_connection *c, void *ud){
+    (void)ud;
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri || (strcmp(ri->request_method, "GET") != 0 && strcmp(ri->request_method, "HEAD") != 0)) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        return 1;
+    }
+    JSON_Value *v=json_value_init_object();
+    version_build_info(json_object(v));
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+    return 1;
+}
+
+static int stream_file(struct mg_connection *c, const config_t *cfg, const char *path,
+                       int cors_public, int json_on_missing){
     const struct mg_request_info *ri = mg_get_request_info(c);
     const char *method = (ri && ri->request_method) ? ri->request_method : "";
     int is_head = (strcmp(method, "HEAD") == 0);
@@ -796,11 +2167,13 @@ static int stream_file(struct mg_connection *c, const char *path, int cors_publi
         return 1;
     }
 
+    bandwidth_stream_t bw;
+    bandwidth_stream_begin(&bw, c, cfg);
     off_t off=0; char buf[64*1024];
     while (off < st.st_size) {
         ssize_t r = read(fd, buf, sizeof(buf));
         if (r <= 0) break;
-        mg_write(c, buf, (size_t)r);
+        if (bandwidth_write(&bw, buf, (size_t)r) <= 0) break;
         off += r;
     }
     close(fd);
@@ -820,8 +2193,7 @@ static int serve_file_share(struct mg_connection *c, const config_t *cfg,
         return 1;
     }
 
-    const char *uri = ri->local_uri ? ri->local_uri : ri->request_uri;
-    if (!uri) return 0;
+    const char *uri = api_local_uri(c);
 
     size_t prefix_len = strlen(uri_prefix);
     size_t root_len = prefix_len;
@@ -922,11 +2294,13 @@ static int serve_file_share(struct mg_connection *c, const config_t *cfg,
         return 1;
     }
 
+    bandwidth_stream_t bw;
+    bandwidth_stream_begin(&bw, c, cfg);
     off_t off = 0; char buf[64 * 1024];
     while (off < st.st_size) {
         ssize_t r = read(fd, buf, sizeof(buf));
         if (r <= 0) break;
-        mg_write(c, buf, (size_t)r);
+        if (bandwidth_write(&bw, buf, (size_t)r) <= 0) break;
         off += r;
     }
     close(fd);
@@ -935,43 +2309,78 @@ static int serve_file_share(struct mg_connection *c, const config_t *cfg,
 
 static int h_media(struct mg_connection *c, void *ud) {
     app_t *app = (app_t *)ud;
-    config_t cfg; app_config_snapshot(app, &cfg);
-    if (!cfg_has_cap(&cfg, "dvr")) {
-        send_plain(c, 404, "not_found", cfg.ui_public);
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    if (!cfg_has_cap(cfg, "dvr")) {
+        send_plain(c, 404, "not_found", cfg->ui_public);
+        free(cfg);
         return 1;
     }
 
     const struct mg_request_info *ri = mg_get_request_info(c);
-    if (!ri || !ri->request_method) return 0;
+    if (!ri || !ri->request_method) {
+        free(cfg);
+        return 0;
+    }
 
-    return serve_file_share(c, &cfg, ri, "/media/", cfg.media_dir,
-                            "DVR_MEDIA_DIR", "/media", "media_unavailable");
+    int rc = serve_file_share(c, cfg, ri, "/media/", cfg->media_dir,
+                              "DVR_MEDIA_DIR", "/media", "media_unavailable");
+    free(cfg);
+    return rc;
 }
 
 static int h_firmware(struct mg_connection *c, void *ud) {
     app_t *app = (app_t *)ud;
-    config_t cfg; app_config_snapshot(app, &cfg);
-    if (!cfg_has_cap(&cfg, "firmware")) {
-        send_plain(c, 404, "not_found", cfg.ui_public);
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    if (!cfg_has_cap(cfg, "firmware")) {
+        send_plain(c, 404, "not_found", cfg->ui_public);
+        free(cfg);
         return 1;
     }
 
     const struct mg_request_info *ri = mg_get_request_info(c);
-    if (!ri || !ri->request_method) return 0;
+    if (!ri || !ri->request_method) {
+        free(cfg);
+        return 0;
+    }
 
-    return serve_file_share(c, &cfg, ri, "/firmware/", cfg.firmware_dir,
-                            "AUTOD_FIRMWARE_DIR", "/usr/share/firmware",
-                            "firmware_unavailable");
+    int rc = serve_file_share(c, cfg, ri, "/firmware/", cfg->firmware_dir,
+                              "AUTOD_FIRMWARE_DIR", "/usr/share/firmware",
+                              "firmware_unavailable");
+    free(cfg);
+    return rc;
 }
 
 static int h_root(struct mg_connection *c, void *ud){
     app_t *app=(app_t*)ud;
-    config_t cfg; app_config_snapshot(app, &cfg);
-    if(!cfg.serve_ui || !cfg.ui_path[0]){
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    /* The UI is not part of the versioned API. */
+    if (g_api_path == API_PATH_VERSIONED) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    g_api_path = API_PATH_UI;
+    if(!cfg->serve_ui || !cfg->ui_path[0]){
         JSON_Value *v=json_value_init_object(); JSON_Object *o=json_object(v);
         json_object_set_string(o,"error","no_ui");
-        send_json(c, v, 404, cfg.ui_public);
+        send_json(c, v, 404, cfg->ui_public);
         json_value_free(v);
+        free(cfg);
         return 1;
     }
 
@@ -979,37 +2388,41 @@ static int h_root(struct mg_connection *c, void *ud){
     const char *method = (ri && ri->request_method) ? ri->request_method : "";
     int is_head = (strcmp(method, "HEAD") == 0);
     if (!is_head && strcmp(method, "GET") != 0) {
-        send_plain(c, 405, "method_not_allowed", cfg.ui_public);
+        send_plain(c, 405, "method_not_allowed", cfg->ui_public);
+        free(cfg);
         return 1;
     }
 
-    const char *req_uri = (ri && ri->local_uri) ? ri->local_uri :
-                          (ri && ri->request_uri) ? ri->request_uri : "/";
-    if (!req_uri) req_uri = "/";
+    const char *req_uri = api_local_uri(c);
 
     char decoded_uri[PATH_MAX];
     int dec = mg_url_decode(req_uri, (int)strlen(req_uri),
                             decoded_uri, (int)sizeof(decoded_uri), 0);
     if (dec <= 0 || dec >= (int)sizeof(decoded_uri)) {
-        send_plain(c, 400, "bad_request", cfg.ui_public);
+        send_plain(c, 400, "bad_request", cfg->ui_public);
+        free(cfg);
         return 1;
     }
     decoded_uri[dec] = '\0';
     const char *uri = decoded_uri;
 
-    const char *basename = cfg.ui_path;
+    const char *basename = cfg->ui_path;
     const char *slash = strrchr(basename, '/');
     if (slash && slash[1]) basename = slash + 1;
 
     if (!strcmp(uri, "/") ||
         (basename && *basename && uri[0]=='/' && strcmp(uri + 1, basename) == 0)) {
-        return stream_file(c, cfg.ui_path, cfg.ui_public, 1);
+        int rc = stream_file(c, cfg, cfg->ui_path, cfg->ui_public, 1);
+        free(cfg);
+        return rc;
     }
 
     const char *rel = uri;
     while (*rel == '/') rel++;
     if (!*rel) {
-        return stream_file(c, cfg.ui_path, cfg.ui_public, 1);
+        int rc = stream_file(c, cfg, cfg->ui_path, cfg->ui_public, 1);
+        free(cfg);
+        return rc;
     }
 
     char rel_copy[PATH_MAX];
@@ -1022,13 +2435,14 @@ static int h_root(struct mg_connection *c, void *ud){
     char *save = NULL;
     for (char *tok = strtok_r(tmp, "/", &save); tok; tok = strtok_r(NULL, "/", &save)) {
         if (!strcmp(tok, "..")) {
-            send_plain(c, 403, "forbidden", cfg.ui_public);
+            send_plain(c, 403, "forbidden", cfg->ui_public);
+            free(cfg);
             return 1;
         }
     }
 
     char base_dir[PATH_MAX];
-    strncpy(base_dir, cfg.ui_path, sizeof(base_dir) - 1);
+    strncpy(base_dir, cfg->ui_path, sizeof(base_dir) - 1);
     base_dir[sizeof(base_dir) - 1] = '\0';
     char *last = strrchr(base_dir, '/');
     if (last) {
@@ -1043,13 +2457,15 @@ static int h_root(struct mg_connection *c, void *ud){
 
     char base_real[PATH_MAX];
     if (!realpath(base_dir, base_real)) {
-        send_plain(c, 404, "not_found", cfg.ui_public);
+        send_plain(c, 404, "not_found", cfg->ui_public);
+        free(cfg);
         return 1;
     }
 
     char joined[PATH_MAX];
     if (snprintf(joined, sizeof(joined), "%s/%s", base_real, rel_copy) >= (int)sizeof(joined)) {
-        send_plain(c, 400, "path_too_long", cfg.ui_public);
+        send_plain(c, 400, "path_too_long", cfg->ui_public);
+        free(cfg);
         return 1;
     }
 
@@ -1058,38 +2474,48 @@ static int h_root(struct mg_connection *c, void *ud){
         size_t base_len = strlen(base_real);
         if (strncmp(resolved, base_real, base_len) != 0 ||
             (resolved[base_len] != '\0' && resolved[base_len] != '/')) {
-            send_plain(c, 403, "forbidden", cfg.ui_public);
+            send_plain(c, 403, "forbidden", cfg->ui_public);
+            free(cfg);
             return 1;
         }
-        return stream_file(c, resolved, cfg.ui_public, 0);
+        int rc = stream_file(c, cfg, resolved, cfg->ui_public, 0);
+        free(cfg);
+        return rc;
     }
 
-    return stream_file(c, joined, cfg.ui_public, 0);
+    int rc = stream_file(c, cfg, joined, cfg->ui_public, 0);
+    free(cfg);
+    return rc;
 }
 
 static int h_caps(struct mg_connection *c, void *ud){
     app_t *app=(app_t*)ud;
-    config_t cfg; app_config_snapshot(app, &cfg);
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
     JSON_Value *v=json_value_init_object(); JSON_Object *o=json_object(v);
-    if(cfg.device[0])  json_object_set_string(o,"device",cfg.device);
-    if(cfg.role[0])    json_object_set_string(o,"role",cfg.role);
-    if(cfg.version[0]) json_object_set_string(o,"version",cfg.version);
+    if(cfg->device[0])  json_object_set_string(o,"device",cfg->device);
+    if(cfg->role[0])    json_object_set_string(o,"role",cfg->role);
+    if(cfg->version[0]) json_object_set_string(o,"version",cfg->version);
 
     JSON_Value *caps_val = NULL;
     JSON_Array *caps_arr = NULL;
-    if(cfg.caps[0]){
+    if(cfg->caps[0]){
         caps_val = json_value_init_array();
         caps_arr = json_array(caps_val);
-        char tmp[256]; strncpy(tmp,cfg.caps,sizeof(tmp)-1); tmp[sizeof(tmp)-1]='\0';
+        char tmp[256]; strncpy(tmp,cfg->caps,sizeof(tmp)-1); tmp[sizeof(tmp)-1]='\0';
         char *tok,*save=NULL; for(tok=strtok_r(tmp,",",&save); tok; tok=strtok_r(NULL,",",&save)){ trim(tok); if(*tok) json_array_append_string(caps_arr,tok); }
     }
 
-    if (cfg.sync_role[0]) {
+    if (cfg->sync_role[0]) {
         if (!caps_arr) {
             caps_val = json_value_init_array();
             caps_arr = json_array(caps_val);
         }
-        sync_append_capabilities(&cfg, caps_arr);
+        sync_append_capabilities(cfg, caps_arr);
     }
 
     if (caps_arr) {
@@ -1097,30 +2523,40 @@ static int h_caps(struct mg_connection *c, void *ud){
     }
 
     json_add_runtime(o);
-    if(cfg.include_net_info) json_add_ifaddrs(o);
-    json_object_set_number(o,"port",cfg.port);
+    if(cfg->include_net_info) json_add_ifaddrs(o);
+    json_object_set_number(o,"port",cfg->port);
+    {
+        JSON_Value *idv=json_value_init_object(); JSON_Object *ido=json_object(idv);
+        json_object_set_string(ido,"id",cfg->sync_id);
+        json_object_set_string(ido,"source",cfg->sync_id_source);
+        if(!strcmp(cfg->sync_id_source,"config")) json_object_set_null(ido,"sources");
+        else json_object_set_string(ido,"sources",cfg->sync_id_sources);
+        if(cfg->sync_id_prefix[0]) json_object_set_string(ido,"prefix",cfg->sync_id_prefix);
+        if(cfg->sync_previous_id[0]) json_object_set_string(ido,"previous_id",cfg->sync_previous_id);
+        json_object_set_value(o,"identity",idv);
+    }
 
-    if (cfg.sse_count>0){
+    if (cfg->sse_count>0){
         JSON_Value *a=json_value_init_array(); JSON_Array *ar=json_array(a);
-        for(int i=0;i<cfg.sse_count;i++){
+        for(int i=0;i<cfg->sse_count;i++){
             JSON_Value *e=json_value_init_object(); JSON_Object *eo=json_object(e);
-            json_object_set_string(eo,"name",cfg.sse[i].name);
+            json_object_set_string(eo,"name",cfg->sse[i].name);
             char resolved[256];
-            substitute_ip_placeholder(c, cfg.sse[i].url, resolved, sizeof(resolved));
+            substitute_ip_placeholder(c, cfg->sse[i].url, resolved, sizeof(resolved));
             json_object_set_string(eo,"url", resolved);
             json_array_append_value(ar,e);
         }
         json_object_set_value(o,"sse",a);
     }
-    if(cfg.serve_ui && cfg.ui_path[0]){
+    if(cfg->serve_ui && cfg->ui_path[0]){
         JSON_Value *ui=json_value_init_object(); JSON_Object *uo=json_object(ui);
-        json_object_set_string(uo,"path",cfg.ui_path);
-        json_object_set_number(uo,"public",cfg.ui_public);
+        json_object_set_string(uo,"path",cfg->ui_path);
+        json_object_set_number(uo,"public",cfg->ui_public);
         json_object_set_value(o,"ui",ui);
     }
-    json_object_set_number(o,"scan_feature_enabled", cfg.enable_scan ? 1 : 0);
+    json_object_set_number(o,"scan_feature_enabled", cfg->enable_scan ? 1 : 0);
 
-    JSON_Value *sync_v = sync_build_status_json(&cfg, &app->slave);
+    JSON_Value *sync_v = sync_build_status_json(cfg, &app->slave);
     if (sync_v) {
         JSON_Object *so = json_object(sync_v);
         json_object_set_number(so, "active_override_generation",
@@ -1128,15 +2564,312 @@ static int h_caps(struct mg_connection *c, void *ud){
         json_object_set_value(o, "sync", sync_v);
     }
 
-    int cors = cfg.ui_public;
+    int cors = cfg->ui_public;
     send_json(c, v, 200, cors);
     json_value_free(v);
+    free(cfg);
+    return 1;
+}
+
+/* Output is passed through as a JSON string only when it is valid UTF-8 without
+ * embedded NULs; anything else is base64-encoded so the bytes survive intact.
+ * Overlong forms, surrogates (U+D800-DFFF) and code points above U+10FFFF are
+ * not valid UTF-8. */
+static int exec_output_is_text(const char *buf, size_t len) {
+    const unsigned char *p = (const unsigned char *)buf;
+    size_t i = 0;
+    while (i < len) {
+        unsigned char ch = p[i];
+        size_t need;
+        unsigned char lo = 0x80, hi = 0xBF;    /* range of the second byte */
+        if (ch == 0) return 0;
+        if (ch < 0x80) { i++; continue; }
+        if (ch >= 0xC2 && ch <= 0xDF) {
+            need = 1;
+        } else if (ch >= 0xE0 && ch <= 0xEF) {
+            need = 2;
+            if (ch == 0xE0) lo = 0xA0;
+            else if (ch == 0xED) hi = 0x9F;
+        } else if (ch >= 0xF0 && ch <= 0xF4) {
+            need = 3;
+            if (ch == 0xF0) lo = 0x90;
+            else if (ch == 0xF4) hi = 0x8F;
+        } else {
+            return 0;
+        }
+        if (i + need >= len) return 0;
+        if (p[i + 1] < lo || p[i + 1] > hi) return 0;
+        for (size_t k = 2; k <= need; k++) {
+            if ((p[i + k] & 0xC0) != 0x80) return 0;
+        }
+        i += need + 1;
+    }
+    return 1;
+}
+
+/* Content type of a raw /exec body, from what the handler wrote: common
+ * image and archive signatures, then JSON or plain text when the output is
+ * valid UTF-8. */
+static const char *exec_sniff_content_type(const char *buf, size_t len) {
+    static const struct { const char *magic; size_t len; const char *type; } k_magic[] = {
+        { "\xFF\xD8\xFF", 3, "image/jpeg" },
+        { "\x89PNG\r\n\x1A\n", 8, "image/png" },
+        { "GIF87a", 6, "image/gif" },
+        { "GIF89a", 6, "image/gif" },
+        { "%PDF-", 5, "application/pdf" },
+        { "\x1F\x8B", 2, "application/gzip" },
+        { "PK\x03\x04", 4, "application/zip" },
+        { "\xFD" "7zXZ", 5, "application/x-xz" },
+    };
+    for (size_t i = 0; i < sizeof(k_magic) / sizeof(k_magic[0]); i++) {
+        if (len >= k_magic[i].len && !memcmp(buf, k_magic[i].magic, k_magic[i].len)) {
+            return k_magic[i].type;
+        }
+    }
+    if (len >= 12 && !memcmp(buf, "RIFF", 4) && !memcmp(buf + 8, "WEBP", 4)) return "image/webp";
+    if (len == 0 || !exec_output_is_text(buf, len)) return "application/octet-stream";
+    size_t i = 0;
+    while (i < len && isspace((unsigned char)buf[i])) i++;
+    if (i < len && (buf[i] == '{' || buf[i] == '[')) {
+        JSON_Value *v = json_parse_string(buf);
+        if (v) {
+            json_value_free(v);
+            return "application/json; charset=utf-8";
+        }
+    }
+    return "text/plain; charset=utf-8";
+}
+
+int exec_set_output(JSON_Object *o, const char *key, const char *buf, size_t len, int force_b64) {
+    if (!force_b64 && exec_output_is_text(buf ? buf : "", buf ? len : 0)) {
+        return json_object_set_string(o, key, buf ? buf : "") == JSONSuccess ? 0 : -1;
+    }
+    size_t cap = ((len + 2) / 3) * 4 + 1;
+    char *b64 = malloc(cap);
+    if (!b64) return -1;
+    size_t b64_len = cap;
+    if (len == 0) {
+        b64[0] = '\0';
+    } else if (mg_base64_encode((const unsigned char *)buf, len, b64, &b64_len) != -1) {
+        free(b64);
+        return -1;
+    }
+    char enc_key[32];
+    snprintf(enc_key, sizeof(enc_key), "%s_encoding", key);
+    int r = json_object_set_string(o, key, b64) == JSONSuccess &&
+            json_object_set_string(o, enc_key, "base64") == JSONSuccess ? 0 : -1;
+    free(b64);
+    return r;
+}
+
+int exec_parse_output_mode(const config_t *cfg, const char *path, const char *requested) {
+    char from_catalog[16];
+    if (!requested || !*requested) {
+        if (catalog_option_for(cfg, path, "parse_output", from_catalog, sizeof(from_catalog)) != 0) {
+            return 0;
+        }
+        requested = from_catalog;
+    }
+    if (!strcasecmp(requested, "json")) return 1;
+    if (!strcasecmp(requested, "text")) return 0;
+    return -1;
+}
+
+int exec_timeout_field(JSON_Object *o, const char *key, int *out_ms) {
+    JSON_Value *v = json_object_get_value(o, key);
+    if (!v) return 0;
+    double d = json_value_get_number(v);
+    if (json_value_get_type(v) != JSONNumber || d < 1 || d > 86400000 || d != (int)d) return -1;
+    *out_ms = (int)d;
+    return 0;
+}
+
+int exec_var_name_valid(const char *name) {
+    if (!name || !(isalpha((unsigned char)*name) || *name == '_') || strlen(name) > 63) return 0;
+    for (const char *p = name; *p; p++) {
+        if (!isalnum((unsigned char)*p) && *p != '_') return 0;
+    }
+    return strcmp(name, "PATH") != 0 && strncmp(name, "LD_", 3) != 0 && strncmp(name, "AUTOD_", 6) != 0;
+}
+
+#define EXEC_CONTEXT_MAX_VARS 32
+
+/* An "env" or "params" object: valid names, string values. */
+static int exec_vars_valid(JSON_Value *v) {
+    JSON_Object *o = json_object(v);
+    if (!v) return 1;
+    if (!o || json_object_get_count(o) > EXEC_CONTEXT_MAX_VARS) return 0;
+    for (size_t i = 0; i < json_object_get_count(o); i++) {
+        const char *name = json_object_get_name(o, i);
+        const char *value = json_string(json_object_get_value_at(o, i));
+        if (!exec_var_name_valid(name) || !value || strlen(value) > 4096) return 0;
+    }
+    return 1;
+}
+
+/* arg with each {NAME} that params defines replaced; NULL when none is. */
+static char *exec_fill_params(const char *arg, JSON_Object *params) {
+    size_t cap = strlen(arg) + 1, n = 0;
+    char *out = NULL;
+    for (const char *p = arg; *p; ) {
+        const char *end = *p == '{' ? strchr(p + 1, '}') : NULL;
+        const char *with = NULL;
+        if (end && end - p - 1 < 64) {
+            char name[64];
+            snprintf(name, sizeof(name), "%.*s", (int)(end - p - 1), p + 1);
+            with = json_object_get_string(params, name);
+        }
+        if (!with && !out) {
+            p++;
+            continue;
+        }
+        if (!out) {
+            /* First hit: copy what came before it. */
+            n = (size_t)(p - arg);
+            out = malloc(cap);
+            if (!out) return NULL;
+            memcpy(out, arg, n);
+        }
+        size_t len = with ? strlen(with) : 1;
+        if (n + len + 1 > cap) {
+            cap = (n + len + 1) * 2;
+            char *grown = realloc(out, cap);
+            if (!grown) { free(out); return NULL; }
+            out = grown;
+        }
+        memcpy(out + n, with ? with : p, len);
+        n += len;
+        p = with ? end + 1 : p + 1;
+    }
+    if (out) out[n] = '\0';
+    return out;
+}
+
+const char *exec_context_check(JSON_Object *o, JSON_Array *args, JSON_Value **args_out) {
+    JSON_Value *env_v = json_object_get_value(o, "env");
+    JSON_Value *params_v = json_object_get_value(o, "params");
+    *args_out = NULL;
+    if (!exec_vars_valid(env_v)) return "invalid_env";
+    if (!exec_vars_valid(params_v)) return "invalid_params";
+    JSON_Object *params = json_object(params_v);
+    for (size_t i = 0; params && json_object_get_count(params) && i < json_array_get_count(args); i++) {
+        const char *arg = json_array_get_string(args, i);
+        char *filled = arg ? exec_fill_params(arg, params) : NULL;
+        if (!filled) continue;
+        if (!*args_out) *args_out = json_value_deep_copy(json_array_get_wrapping_value(args));
+        json_array_replace_string(json_array(*args_out), i, filled);
+        free(filled);
+    }
+    return NULL;
+}
+
+void exec_context_set(JSON_Object *o) {
+    g_exec_env = json_object_get_object(o, "env");
+}
+
+const char *exec_plan_deadlines(const config_t *cfg, JSON_Object *o, int total_default_ms,
+                                exec_deadlines_t *d) {
+    int headroom = cfg->exec_deadline_headroom_ms;
+    d->connect_ms = cfg->exec_connect_timeout_ms;
+    d->exec_ms = cfg->exec_timeout_ms;
+    d->total_ms = 0;
+    if (exec_timeout_field(o, "connect_timeout_ms", &d->connect_ms) != 0 ||
+        exec_timeout_field(o, "exec_timeout_ms", &d->exec_ms) != 0 ||
+        exec_timeout_field(o, "total_deadline_ms", &d->total_ms) != 0) {
+        return "invalid_timeout";
+    }
+    if (!d->total_ms) d->total_ms = total_default_ms > 0 ? total_default_ms : d->exec_ms + headroom;
+    if (d->exec_ms > d->total_ms - headroom) d->exec_ms = d->total_ms - headroom;
+    if (d->exec_ms < 1) return "deadline_too_short";
+    if (d->connect_ms > d->total_ms) d->connect_ms = d->total_ms;
+    return NULL;
+}
+
+int exec_set_result(JSON_Object *o, const char *buf, size_t len) {
+    JSON_Value *v = (buf && len > 0 && strlen(buf) == len) ? json_parse_string(buf) : NULL;
+    if (!v) {
+        json_object_set_string(o, "parse_error", "invalid_json");
+        return -1;
+    }
+    if (json_object_set_value(o, "result", v) != JSONSuccess) {
+        json_value_free(v);
+        json_object_set_string(o, "parse_error", "invalid_json");
+        return -1;
+    }
+    return 0;
+}
+
+/*
+ * Claim the request's idempotency key (Idempotency-Key header or
+ * "idempotency_key" field) for a run under request_id. Returns 1 when a
+ * response was already sent (replay or error), 0 to run the command; key_out
+ * stays empty when the request carries no key or keys are disabled. A repeat
+ * of a run still in progress is answered at once with that run's request id,
+ * which /jobs?request_id= and POST /jobs/cancel accept.
+ */
+static int exec_idempotency_begin(struct mg_connection *c, const config_t *cfg, JSON_Value *root,
+                                  const char *request_id, char *key_out, size_t key_sz) {
+    key_out[0] = '\0';
+    const char *key = mg_get_header(c, "Idempotency-Key");
+    if (!key || !*key) key = json_object_get_string(json_object(root), "idempotency_key");
+    if (!key || !*key || cfg->idempotency_window_s <= 0) return 0;
+    if (!idem_valid_key(key)) {
+        JSON_Value *v=json_value_init_object();
+        json_object_set_string(json_object(v),"error","bad_idempotency_key");
+        send_json(c, v, 400, 1); json_value_free(v);
+        return 1;
+    }
+
+    char *fp = json_serialize_to_string(root);
+    idem_response_t prev;
+    int r = idem_begin(key, fp, fp ? strlen(fp) : 0, (long long)cfg->idempotency_window_s * 1000LL,
+                       request_id, &prev);
+    if (fp) json_free_serialized_string(fp);
+    if (r == IDEM_NEW) {
+        strncpy(key_out, key, key_sz - 1);
+        key_out[key_sz - 1] = '\0';
+        return 0;
+    }
+    if (r == IDEM_REPLAY) {
+        char extra[sizeof(prev.extra_headers) + 32];
+        snprintf(extra, sizeof(extra), "%sIdempotent-Replayed: true\r\n", prev.extra_headers);
+        add_common_headers_extra(c, prev.status, prev.content_type, prev.body_len, 1, extra);
+        if (prev.body_len) mg_write(c, prev.body, prev.body_len);
+        idem_response_free(&prev);
+        return 1;
+    }
+    const char *err = r == IDEM_MISMATCH ? "idempotency_key_reused"
+                    : r == IDEM_FULL ? "idempotency_cache_full" : "idempotency_key_in_progress";
+    int status = r == IDEM_MISMATCH ? 422 : r == IDEM_FULL ? 503 : 409;
+    JSON_Value *v=json_value_init_object();
+    json_object_set_string(json_object(v),"error",err);
+    if (r == IDEM_IN_PROGRESS && prev.request_id[0]) {
+        json_object_set_string(json_object(v),"request_id",prev.request_id);
+        json_object_set_number(json_object(v),"running_ms",(double)prev.running_ms);
+        json_object_set_number(json_object(v),"retry_after_s",1);
+    }
+    send_json(c, v, status, 1); json_value_free(v);
     return 1;
 }
 
+/* Send an exec response and remember it for the idempotency key (if any). */
+static void exec_send_response(struct mg_connection *c, const char *idem_key, int status,
+                               const char *ctype, const char *extra,
+                               const char *body, size_t len) {
+    add_common_headers_extra(c, status, ctype, len, 1, extra);
+    if (len) mg_write(c, body, len);
+    if (idem_key && *idem_key) idem_complete(idem_key, status, ctype, extra, body, len);
+}
+
 static int h_exec(struct mg_connection *c, void *ud){
     app_t *app=(app_t*)ud;
-    config_t cfg; app_config_snapshot(app, &cfg);
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    long long t_req = now_ms();
     upload_t u={0};
     int rb = read_body(c, &u);
     if (rb != 0) {
@@ -1155,14 +2888,17 @@ static int h_exec(struct mg_connection *c, void *ud){
         json_object_set_string(o,"error",err);
         send_json(c, v, status, 1);
         json_value_free(v);
+        free(cfg);
         return 1;
     }
+    const char *refused = caller_identify(c, cfg, u.body, u.len);
+    if (refused) fprintf(stderr, "exec: X-Autod-Caller refused (%s), running as anonymous\n", refused);
     JSON_Value *root=json_parse_string(u.body?u.body:"{}");
     free(u.body);
     if(!root){
         JSON_Value *v=json_value_init_object(); JSON_Object *o=json_object(v);
         json_object_set_string(o,"error","bad_json");
-        send_json(c, v, 400, 1); json_value_free(v); return 1;
+        send_json(c, v, 400, 1); json_value_free(v); free(cfg); return 1;
     }
     JSON_Object *o=json_object(root);
     const char *path=json_object_get_string(o,"path");
@@ -1170,23 +2906,208 @@ static int h_exec(struct mg_connection *c, void *ud){
     if(!path){
         JSON_Value *v=json_value_init_object(); JSON_Object *oo=json_object(v);
         json_object_set_string(oo,"error","missing_path");
-        send_json(c, v, 400, 1); json_value_free(v); json_value_free(root); return 1;
+        send_json(c, v, 400, 1); json_value_free(v); json_value_free(root); free(cfg); return 1;
+    }
+    /* {NAME} in args is filled from "params"; the filled copy lives in root. */
+    JSON_Value *filled_args = NULL;
+    const char *context_err = exec_context_check(o, args, &filled_args);
+    if (context_err) {
+        JSON_Value *v=json_value_init_object(); JSON_Object *oo=json_object(v);
+        json_object_set_string(oo,"error",context_err);
+        send_json(c, v, 400, 1); json_value_free(v); json_value_free(root); free(cfg); return 1;
+    }
+    if (filled_args) {
+        json_object_set_value(o, "args", filled_args);
+        args = json_object_get_array(o, "args");
+    }
+    int force_b64 = 0;
+    const char *encoding = json_object_get_string(o, "output_encoding");
+    if (encoding && *encoding) {
+        if (!strcasecmp(encoding, "base64")) {
+            force_b64 = 1;
+        } else if (strcasecmp(encoding, "utf8") && strcasecmp(encoding, "utf-8")) {
+            JSON_Value *v=json_value_init_object(); JSON_Object *oo=json_object(v);
+            json_object_set_string(oo,"error","bad_output_encoding");
+            send_json(c, v, 400, 1); json_value_free(v); json_value_free(root); free(cfg); return 1;
+        }
+    }
+    int parse_json = exec_parse_output_mode(cfg, path, json_object_get_string(o, "parse_output"));
+    if (parse_json < 0) {
+        JSON_Value *v=json_value_init_object(); JSON_Object *oo=json_object(v);
+        json_object_set_string(oo,"error","bad_parse_output");
+        send_json(c, v, 400, 1); json_value_free(v); json_value_free(root); free(cfg); return 1;
+    }
+    /* Callers can only shorten the run: exec_timeout_ms caps the handler's
+     * runtime, total_deadline_ms the whole request including the wait for
+     * an exec slot. */
+    int exec_limit_ms = 0, deadline_ms = 0;
+    if (exec_timeout_field(o, "exec_timeout_ms", &exec_limit_ms) != 0 ||
+        exec_timeout_field(o, "total_deadline_ms", &deadline_ms) != 0) {
+        JSON_Value *v=json_value_init_object(); JSON_Object *oo=json_object(v);
+        json_object_set_string(oo,"error","invalid_timeout");
+        send_json(c, v, 400, 1); json_value_free(v); json_value_free(root); free(cfg); return 1;
+    }
+    int raw = json_object_get_boolean(o, "raw") == 1;
+    /* A content_type the caller sends overrides the one read from the output. */
+    const char *ctype = json_object_get_string(o, "content_type");
+    if (ctype && !*ctype) ctype = NULL;
+    if (ctype && strpbrk(ctype, "\r\n")) {
+        JSON_Value *v=json_value_init_object(); JSON_Object *oo=json_object(v);
+        json_object_set_string(oo,"error","bad_content_type");
+        send_json(c, v, 400, 1); json_value_free(v); json_value_free(root); free(cfg); return 1;
+    }
+    if (!catalog_allows(cfg, path)) {
+        JSON_Value *v=json_value_init_object(); JSON_Object *oo=json_object(v);
+        json_object_set_string(oo,"error","command_not_allowed");
+        json_object_set_string(oo,"path",path);
+        send_json(c, v, 403, 1); json_value_free(v); json_value_free(root); free(cfg); return 1;
+    }
+    if (!catalog_role_allows(cfg, path, caller_role())) {
+        JSON_Value *v=json_value_init_object(); JSON_Object *oo=json_object(v);
+        json_object_set_string(oo,"error","role_not_allowed");
+        json_object_set_string(oo,"path",path);
+        json_object_set_string(oo,"role",caller_role());
+        send_json(c, v, 403, 1); json_value_free(v); json_value_free(root); free(cfg); return 1;
+    }
+    const char *profile_name = json_object_get_string(o, "profile");
+    int unknown_profile = 0;
+    const exec_profile_t *profile = profile_select(cfg, path, profile_name, &unknown_profile);
+    if (unknown_profile) {
+        JSON_Value *v=json_value_init_object(); JSON_Object *oo=json_object(v);
+        json_object_set_string(oo,"error","unknown_profile");
+        json_object_set_string(oo,"profile",profile_name);
+        send_json(c, v, 400, 1); json_value_free(v); json_value_free(root); free(cfg); return 1;
+    }
+    if (confirm_required(cfg, path)) {
+        JSON_Value *req = json_value_init_object();
+        json_object_set_string(json_object(req), "path", path);
+        if (profile_name) json_object_set_string(json_object(req), "profile", profile_name);
+        if (args) json_object_set_value(json_object(req), "args",
+                                        json_value_deep_copy(json_array_get_wrapping_value(args)));
+        JSON_Value *preview = json_value_deep_copy(req);
+        JSON_Object *po = json_object(preview);
+        json_object_set_string(po, "node", cfg->sync_id);
+        json_object_set_string(po, "mode", cfg->exec_mode);
+        const sandbox_profile_t *sandbox = sandbox_select(cfg, path);
+        if (sandbox) json_object_set_string(po, "sandbox", sandbox->name);
+        if (profile) json_object_set_string(po, "profile", profile->name);
+        int sent = confirm_gate(c, cfg, o, req, preview);
+        json_value_free(req);
+        if (sent) { json_value_free(root); free(cfg); return 1; }
+    }
+    if (blackout_gate_exec(c, app, cfg, path, o)) {
+        json_value_free(root); free(cfg); return 1;
+    }
+    /* A body request_id (what a broadcast cancels by) wins over the header's. */
+    const char *request_id = json_object_get_string(o, "request_id");
+    if (!request_id || !*request_id) request_id = api_request_id();
+    char idem_key[IDEM_KEY_MAX + 1];
+    if (exec_idempotency_begin(c, cfg, root, request_id, idem_key, sizeof(idem_key))) {
+        json_value_free(root); free(cfg); return 1;
     }
     int rc=0; long long elapsed=0; char *out=NULL,*err=NULL;
-    int exec_r=run_exec(&cfg, path, args, cfg.exec_timeout_ms, cfg.max_output_bytes, &rc,&elapsed,&out,&err);
+    size_t out_len=0, err_len=0;
+    exec_usage_t usage;
+    int quota_slot = quota_exec_acquire(c, cfg);
+    if (quota_slot < 0) {
+        if (idem_key[0]) idem_abort(idem_key);
+        json_value_free(root); free(cfg); return 1;
+    }
+    int timeout_ms = profile && profile->timeout_ms > 0 ? profile->timeout_ms : cfg->exec_timeout_ms;
+    if (exec_limit_ms > 0 && exec_limit_ms < timeout_ms) timeout_ms = exec_limit_ms;
+    if (deadline_ms > 0) {
+        long long left = deadline_ms - (now_ms() - t_req);
+        if (left < 1) {
+            quota_exec_release(quota_slot);
+            if (idem_key[0]) idem_abort(idem_key);
+            JSON_Value *v=json_value_init_object(); JSON_Object *oo=json_object(v);
+            json_object_set_string(oo,"error","timeout");
+            json_object_set_string(oo,"phase","queue");
+            json_object_set_number(oo,"total_deadline_ms",deadline_ms);
+            send_json(c, v, 504, 1); json_value_free(v); json_value_free(root); free(cfg); return 1;
+        }
+        if (left < timeout_ms) timeout_ms = (int)left;
+    }
+    /* A profile's timeout would replace the one passed in, so it is capped too. */
+    exec_profile_t capped;
+    if (profile && profile->timeout_ms > 0 && profile->timeout_ms != timeout_ms) {
+        capped = *profile;
+        capped.timeout_ms = timeout_ms;
+        profile = &capped;
+    }
+    exec_context_set(o);
+    int exec_r=run_exec(cfg, path, args, timeout_ms, cfg->max_output_bytes, profile,
+                        request_id, &rc,&elapsed,&out,&err,&out_len,&err_len,&usage);
+    exec_context_set(NULL);
+    quota_exec_release(quota_slot);
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    jobs_record_t jr = {
+        .node = cfg->sync_id, .source = "exec", .requester = ri ? ri->remote_addr : NULL,
+        .caller = caller_name(), .caller_role = caller_role(),
+        .request_id = request_id, .path = path, .args = args, .job_id = usage.job_id,
+        .spawned = exec_r == 0, .canceled = exec_r == 0 && usage.canceled,
+        .rc = rc, .elapsed_ms = elapsed,
+        .out = out, .out_len = out_len, .err = err, .err_len = err_len
+    };
+    jobs_store_record(&jr);
+    if (exec_r==0 && raw) {
+        char extra[256];
+        snprintf(extra, sizeof(extra),
+                 "X-Exec-Rc: %d\r\nX-Exec-Elapsed-Ms: %lld\r\n"
+                 "X-Exec-Job-Id: %lu\r\nX-Exec-Max-Rss-Kb: %ld\r\n%s",
+                 rc, elapsed, usage.job_id, usage.max_rss_kb,
+                 usage.timed_out ? "X-Exec-Timed-Out: 1\r\n" : "");
+        exec_send_response(c, idem_key, 200, ctype ? ctype : exec_sniff_content_type(out, out_len),
+                           extra, out, out_len);
+        free(out); free(err);
+        json_value_free(root); free(cfg); return 1;
+    }
     JSON_Value *resp=json_value_init_object(); JSON_Object *or=json_object(resp);
     if(exec_r==0){
         json_object_set_number(or,"rc",rc);
         json_object_set_number(or,"elapsed_ms",(double)elapsed);
-        json_object_set_string(or,"stdout", out?out:"");
-        json_object_set_string(or,"stderr", err?err:"");
+        exec_set_usage(or, &usage);
+        const sandbox_profile_t *sandbox = sandbox_select(cfg, path);
+        if (sandbox) json_object_set_string(or,"sandbox",sandbox->name);
+        if (profile) json_object_set_string(or,"profile",profile->name);
+        /* Parsed output replaces stdout; unparsable output is kept as is. */
+        int parsed = parse_json && exec_set_result(or, out, out_len) == 0;
+        int enc_ok = (parsed || exec_set_output(or, "stdout", out, out_len, force_b64) == 0) &&
+                     exec_set_output(or, "stderr", err, err_len, force_b64) == 0;
         free(out); free(err);
-        send_json(c, resp, 200, 1);
+        char *s = enc_ok ? json_serialize_to_string(resp) : NULL;
+        if (s) {
+            exec_send_response(c, idem_key, 200, "application/json; charset=utf-8", NULL, s, strlen(s));
+            json_free_serialized_string(s);
+        } else {
+            if (idem_key[0]) idem_abort(idem_key);
+            json_value_free(resp);
+            resp=json_value_init_object(); or=json_object(resp);
+            json_object_set_string(or,"error","encode_failed");
+            send_json(c, resp, 500, 1);
+        }
+    } else if (exec_r==EXEC_ERR_NOT_FOUND) {
+        if (idem_key[0]) idem_abort(idem_key);
+        json_object_set_string(or,"error","binary_not_found");
+        json_object_set_string(or,"binary",!strcmp(cfg->exec_mode,"argv") ? path : cfg->interpreter);
+        send_json(c, resp, 404, 1);
+    } else if (exec_r==EXEC_ERR_INTEGRITY) {
+        if (idem_key[0]) idem_abort(idem_key);
+        json_object_set_string(or,"error","integrity_mismatch");
+        json_object_set_string(or,"path",path);
+        send_json(c, resp, 403, 1);
+    } else if (exec_r==EXEC_ERR_CAPACITY) {
+        if (idem_key[0]) idem_abort(idem_key);
+        json_object_set_string(or,"error","jobs_full");
+        json_object_set_number(or,"max_jobs_in_memory",capacity_limit(cfg, CAPACITY_JOBS));
+        send_json(c, resp, 503, 1);
     } else {
+        /* Spawn failures are not remembered so a retry can run the command. */
+        if (idem_key[0]) idem_abort(idem_key);
         json_object_set_string(or,"error","exec_failed");
         send_json(c, resp, 500, 1);
     }
-    json_value_free(resp); json_value_free(root); return 1;
+    json_value_free(resp); json_value_free(root); free(cfg); return 1;
 }
 
 static int resolve_target(app_t *app, const config_t *cfg,
@@ -1267,6 +3188,26 @@ static int h_udp(struct mg_connection *c, void *ud) {
         slot_index = (int)slot_d - 1;
         if ((double)(slot_index + 1) != slot_d) slot_index = -2;
     }
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        json_value_free(root);
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot((app_t *)ud, cfg);
+    if (slot_v && json_value_get_type(slot_v) == JSONString) {
+        const char *ref = json_value_get_string(slot_v);
+        int rc = sync_slot_lookup(cfg, ref, &slot_index);
+        if (rc != 0) {
+            int status = 404;
+            JSON_Value *v = sync_slot_lookup_error(cfg, ref, rc, &status);
+            send_json(c, v, status, 1);
+            json_value_free(v);
+            json_value_free(root);
+            free(cfg);
+            return 1;
+        }
+    }
     const char *device = (device_v && json_value_get_type(device_v) == JSONString)
                          ? json_value_get_string(device_v)
                          : NULL;
@@ -1289,13 +3230,12 @@ static int h_udp(struct mg_connection *c, void *ud) {
         send_json(c, v, 400, 1);
         json_value_free(v);
         json_value_free(root);
+        free(cfg);
         return 1;
     }
 
-    char target_host[64];
+    char target_host[128];
     target_host[0] = '\0';
-    config_t cfg;
-    app_config_snapshot((app_t *)ud, &cfg);
 
     if (host_in && *host_in) {
         strncpy(target_host, host_in, sizeof(target_host) - 1);
@@ -1304,7 +3244,7 @@ static int h_udp(struct mg_connection *c, void *ud) {
         char err_code[32];
         int resolved_port = 0; // ignored
         char resolved_sync_id[64]; // ignored
-        if (resolve_target((app_t *)ud, &cfg, sync_id, slot_index, node_ip, device,
+        if (resolve_target((app_t *)ud, cfg, sync_id, slot_index, node_ip, device,
                            0, target_host, sizeof(target_host), &resolved_port,
                            resolved_sync_id, sizeof(resolved_sync_id),
                            err_code, sizeof(err_code)) != 0) {
@@ -1314,6 +3254,7 @@ static int h_udp(struct mg_connection *c, void *ud) {
             send_json(c, v, 502, 1);
             json_value_free(v);
             json_value_free(root);
+            free(cfg);
             return 1;
         }
     }
@@ -1337,6 +3278,7 @@ static int h_udp(struct mg_connection *c, void *ud) {
             send_json(c, v, 500, 1);
             json_value_free(v);
             json_value_free(root);
+            free(cfg);
             return 1;
         }
         size_t out_len = dst_cap;
@@ -1351,6 +3293,7 @@ static int h_udp(struct mg_connection *c, void *ud) {
                 send_json(c, v, 400, 1);
                 json_value_free(v);
                 json_value_free(root);
+                free(cfg);
                 return 1;
             }
         }
@@ -1370,6 +3313,9 @@ static int h_udp(struct mg_connection *c, void *ud) {
     hints.ai_family = AF_UNSPEC;
     hints.ai_flags = AI_NUMERICSERV;
 
+    char host_ip[16];
+    if (dnscache_resolve(host, cfg->sync_dns_ttl_s, host_ip, sizeof(host_ip)) == 0) host = host_ip;
+
     struct addrinfo *res = NULL;
     int gai = getaddrinfo(host, portbuf, &hints, &res);
     if (gai != 0) {
@@ -1382,6 +3328,7 @@ static int h_udp(struct mg_connection *c, void *ud) {
         send_json(c, v, 502, 1);
         json_value_free(v);
         json_value_free(root);
+        free(cfg);
         return 1;
     }
 
@@ -1415,6 +3362,7 @@ static int h_udp(struct mg_connection *c, void *ud) {
         json_value_free(v);
         json_value_free(root);
         errno = saved_errno;
+        free(cfg);
         return 1;
     }
 
@@ -1423,13 +3371,14 @@ static int h_udp(struct mg_connection *c, void *ud) {
     json_object_set_string(or, "status", "sent");
     json_object_set_number(or, "bytes_sent", (double)(sent_bytes >= 0 ? sent_bytes : 0));
     json_object_set_number(or, "payload_length", (double)data_len);
-    json_object_set_string(or, "host", host);
+    json_object_set_string(or, "host", target_host);
     json_object_set_number(or, "port", (double)port);
     send_json(c, resp, 200, 1);
     json_value_free(resp);
 
     if (tmp) free(tmp);
     json_value_free(root);
+    free(cfg);
     return 1;
 }
 
@@ -1450,7 +3399,7 @@ static int resolve_target(app_t *app, const config_t *cfg,
     target_sync_id[0] = '\0';
 
     if (slot_index >= 0) {
-        if (slot_index >= SYNC_MAX_SLOTS) {
+        if (slot_index >= sync_slot_count(cfg)) {
             snprintf(err_code, err_sz, "%s", "invalid_slot");
             return -1;
         }
@@ -1490,6 +3439,28 @@ static int resolve_target(app_t *app, const config_t *cfg,
     }
 
     if (target_sync_id[0]) {
+        /* Nodes behind a gateway are not on our LAN scan; their registered
+         * address is what the gateway connects to. */
+        sync_node_addr_t routed;
+        if (gateway_for(cfg, target_sync_id) &&
+            sync_master_node_addr(app, cfg, target_sync_id, &routed) == 0) {
+            snprintf(host_out, host_sz, "%s", routed.host);
+            *port_out = (port_hint > 0) ? port_hint : routed.port;
+            if (resolved_sync_id) snprintf(resolved_sync_id, resolved_sz, "%s", routed.id);
+            return 0;
+        }
+        /* Slaves that announce a DNS name are addressed by it, so callers
+         * resolve it at send time instead of using the probed IP. */
+        int named_port = 0;
+        if (sync_master_node_hostname(app, target_sync_id, host_out, host_sz, &named_port) == 0) {
+            *port_out = (port_hint > 0) ? port_hint
+                      : (named_port > 0 ? named_port : (cfg->port > 0 ? cfg->port : 8080));
+            if (resolved_sync_id) {
+                strncpy(resolved_sync_id, target_sync_id, resolved_sz - 1);
+                resolved_sync_id[resolved_sz - 1] = '\0';
+            }
+            return 0;
+        }
         for (int i = 0; i < node_count; i++) {
             if (!nodes[i].sync_id[0]) continue;
             if (strcasecmp(nodes[i].sync_id, target_sync_id) != 0) continue;
@@ -1507,13 +3478,31 @@ static int resolve_target(app_t *app, const config_t *cfg,
     }
 
     if (device_name && *device_name) {
+        /* Several nodes can share a device name; route to the one with the
+         * best health score (then dispatch record), passing over quarantined
+         * (or decommissioning) nodes and open circuits while another one is
+         * available. */
+        int best = -1, best_quarantined = 0;
         for (int i = 0; i < node_count; i++) {
             if (strcasecmp(nodes[i].device, device_name) != 0) continue;
-            strncpy(host_out, nodes[i].ip, host_sz - 1);
+            const char *a = nodes[i].sync_id[0] ? nodes[i].sync_id : nodes[i].ip;
+            int quarantined = sync_master_node_quarantined(app, nodes[i].sync_id) ||
+                              sync_master_node_decommissioning(app, nodes[i].sync_id) ||
+                              breaker_is_open(&cfg->breaker, a);
+            if (best >= 0) {
+                const char *b = nodes[best].sync_id[0] ? nodes[best].sync_id : nodes[best].ip;
+                if (quarantined > best_quarantined) continue;
+                if (quarantined == best_quarantined && sync_master_health_compare(app, cfg, a, b) >= 0) continue;
+            }
+            best = i;
+            best_quarantined = quarantined;
+        }
+        if (best >= 0) {
+            strncpy(host_out, nodes[best].ip, host_sz - 1);
             host_out[host_sz - 1] = '\0';
-            *port_out = (port_hint > 0) ? port_hint : nodes[i].port;
-            if (resolved_sync_id && nodes[i].sync_id[0]) {
-                strncpy(resolved_sync_id, nodes[i].sync_id, resolved_sz - 1);
+            *port_out = (port_hint > 0) ? port_hint : nodes[best].port;
+            if (resolved_sync_id && nodes[best].sync_id[0]) {
+                strncpy(resolved_sync_id, nodes[best].sync_id, resolved_sz - 1);
                 resolved_sync_id[resolved_sz - 1] = '\0';
             }
             return 0;
@@ -1526,12 +3515,267 @@ static int resolve_target(app_t *app, const config_t *cfg,
     return -1;
 }
 
+/* Write a relayed request: the caller's headers, then the identity headers
+ * it did not set itself and our own lines (the signed X-Autod-Caller and a
+ * gateway's X-Relay-*; may be empty). Returns 0 or an errno value. */
+static int relay_write_request(int fd, const char *method, const char *path, const char *host,
+                               const JSON_Value *headers_v, const char *own_hdrs,
+                               const unsigned char *body, size_t body_len,
+                               int has_content_length) {
+    const JSON_Object *headers = json_value_get_type(headers_v) == JSONObject
+                                     ? json_object(headers_v) : NULL;
+    int failed = dprintf(fd, "%s %s HTTP/1.0\r\nHost: %s\r\n", method, path, host) < 0;
+    size_t hc = headers ? json_object_get_count(headers) : 0;
+    for (size_t i = 0; i < hc; i++) {
+        const char *hn = json_object_get_name(headers, i);
+        const char *hv = json_object_get_string(headers, hn);
+        if (!hn || !hv) continue;
+        /* Only this node vouches for who is asking and where a gateway
+         * relays to. */
+        if (!strcasecmp(hn, "X-Autod-Caller") || !strncasecmp(hn, "X-Relay-", 8)) continue;
+        failed |= dprintf(fd, "%s: %s\r\n", hn, hv) < 0;
+    }
+    if (own_hdrs && *own_hdrs) failed |= dprintf(fd, "%s", own_hdrs) < 0;
+    /* Configured User-Agent and [http] headers, unless the caller set them. */
+    char identity[HTTPC_IDENTITY_MAX];
+    if (httpc_identity(identity, sizeof(identity)) > 0) {
+        char *save = NULL;
+        for (char *line = strtok_r(identity, "\r\n", &save); line;
+             line = strtok_r(NULL, "\r\n", &save)) {
+            char *colon = strchr(line, ':');
+            if (!colon) continue;
+            *colon = '\0';
+            int overridden = 0;
+            for (size_t i = 0; i < hc && !overridden; i++) {
+                const char *hn = json_object_get_name(headers, i);
+                overridden = hn && strcasecmp(hn, line) == 0;
+            }
+            if (!overridden) failed |= dprintf(fd, "%s:%s\r\n", line, colon + 1) < 0;
+        }
+    }
+    if (body_len > 0 && !has_content_length) {
+        failed |= dprintf(fd, "Content-Length: %zu\r\n", body_len) < 0;
+    }
+    /* HTTP/1.0 keeps the reply unchunked; keep-alive is asked for explicitly. */
+    failed |= dprintf(fd, "Connection: %s\r\n\r\n", httpc_keepalive() ? "keep-alive" : "close") < 0;
+    if (failed) return errno ? errno : EIO;
+    if (body_len > 0 && httpc_send_all(fd, body, body_len) != 0) return errno ? errno : EPIPE;
+    return 0;
+}
+
+/* A relayed /exec whose catalog entry is marked cacheable=TTL. */
+typedef struct {
+    char target[80];           /* "slot:N" or "id:ID"; empty = not cached */
+    const char *body;
+    int ttl_s;
+    int stale_s;               /* how long past ttl_s a reply stands in for an unreachable node */
+} relay_cache_t;
+
+/* Send the cached reply when it is at most max_age_ms old, marked with its
+ * age and why it was used. Returns 1 when sent. */
+static int relay_send_cached(struct mg_connection *c, const relay_cache_t *rc,
+                             long long max_age_ms, const char *reason, const char *live_error) {
+    if (!rc->target[0]) return 0;
+    long long age_ms = 0;
+    char *reply = execcache_get(rc->target, rc->body, strlen(rc->body), max_age_ms, &age_ms);
+    JSON_Value *v = reply ? json_parse_string(reply) : NULL;
+    free(reply);
+    if (!json_object(v)) {
+        if (v) json_value_free(v);
+        return 0;
+    }
+    JSON_Object *o = json_object(v);
+    json_object_set_boolean(o, "cached", 1);
+    json_object_set_number(o, "cached_age_ms", (double)age_ms);
+    json_object_set_string(o, "cache_reason", reason);
+    if (live_error) json_object_set_string(o, "live_error", live_error);
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+    return 1;
+}
+
+/* Error reply for a relay that did not reach its node, unless a cached reply
+ * within ttl + stale can stand in for it. */
+static void relay_send_failure(struct mg_connection *c, JSON_Value *err, int status,
+                               const relay_cache_t *rc) {
+    long long max_age_ms = ((long long)rc->ttl_s + rc->stale_s) * 1000LL;
+    if (relay_send_cached(c, rc, max_age_ms, "unreachable",
+                          json_object_get_string(json_object(err), "error"))) {
+        return;
+    }
+    send_json(c, err, status, 1);
+}
+
+/* Who served a /http relay, for the reply's upstream object. */
+typedef struct {
+    int slot_index;            /* -1 unless the caller named a slot */
+    const char *node;          /* resolved sync id, "" when the target has none */
+    char host[128];            /* the node's own address, not the gateway's */
+    int port;
+    const char *gateway;       /* NULL unless relayed through one */
+    const char *transport;     /* "http" or "ssh" */
+    long long t0_ms;
+    int retries;               /* sends repeated after a stale connection or a moved name */
+    int reused;                /* went out on a pooled keep-alive connection */
+} relay_upstream_t;
+
+/* Add the upstream object: the node and address the relay reached, how long
+ * it took, how often it was retried and, for a slot, whether the node holds
+ * it because health failover moved the slot there. */
+static void relay_set_upstream(JSON_Object *o, app_t *app, const relay_upstream_t *u) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *uo = json_object(v);
+    if (u->slot_index >= 0) json_object_set_number(uo, "slot", u->slot_index + 1);
+    if (u->node && *u->node) json_object_set_string(uo, "node", u->node);
+    else json_object_set_null(uo, "node");
+    char address[160];
+    snprintf(address, sizeof(address), "%s:%d", u->host, u->port);
+    json_object_set_string(uo, "address", address);
+    if (u->gateway && *u->gateway) json_object_set_string(uo, "gateway", u->gateway);
+    json_object_set_string(uo, "transport", u->transport);
+    if (!strcmp(u->transport, "http")) json_object_set_string(uo, "connection", u->reused ? "reused" : "new");
+    json_object_set_number(uo, "latency_ms", (double)(now_ms() - u->t0_ms));
+    json_object_set_number(uo, "retries", u->retries);
+    if (u->slot_index >= 0) {
+        char reason[16] = "", from[64] = "";
+        int known = u->node && *u->node &&
+                    sync_master_slot_binding(app, u->slot_index, u->node, reason, sizeof(reason),
+                                             from, sizeof(from)) == 0;
+        int failover = known && !strcmp(reason, "failover");
+        json_object_set_boolean(uo, "failover", failover);
+        if (failover && from[0]) json_object_set_string(uo, "failover_from", from);
+        if (known) json_object_set_string(uo, "binding", reason);
+    }
+    json_object_set_value(o, "upstream", v);
+}
+
+/* Record an /exec relayed to node in the jobs store. reply is the node's
+ * /exec answer (NULL when the dispatch got none); its rc and output are kept,
+ * and a reply without rc counts as a run that never started. */
+static void relay_record_job(struct mg_connection *c, const char *node,
+                             const unsigned char *exec_body, size_t exec_len,
+                             const unsigned char *reply, size_t reply_len, long long elapsed_ms) {
+    char *text = exec_body ? strndup((const char *)exec_body, exec_len) : NULL;
+    JSON_Value *req = text ? json_parse_string(text) : NULL;
+    JSON_Object *ro = json_object(req);
+    free(text);
+    text = reply ? strndup((const char *)reply, reply_len) : NULL;
+    JSON_Value *res = text ? json_parse_string(text) : NULL;
+    free(text);
+    JSON_Object *eo = json_object(res);
+    const char *request_id = json_object_get_string(ro, "request_id");
+    if (!request_id || !*request_id) request_id = api_request_id();
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    const char *out = json_object_get_string(eo, "stdout");
+    const char *err = json_object_get_string(eo, "stderr");
+    jobs_record_t jr = {
+        .node = node, .source = "relay", .requester = ri ? ri->remote_addr : NULL,
+        .caller = caller_name(), .caller_role = caller_role(), .request_id = request_id,
+        .path = json_object_get_string(ro, "path"), .args = json_object_get_array(ro, "args"),
+        .spawned = json_object_has_value_of_type(eo, "rc", JSONNumber),
+        .canceled = json_object_get_boolean(eo, "canceled") == 1,
+        .rc = (int)json_object_get_number(eo, "rc"), .elapsed_ms = elapsed_ms,
+        .out = out, .out_len = out ? strlen(out) : 0,
+        .err = err, .err_len = err ? strlen(err) : 0
+    };
+    jobs_store_record(&jr);
+    if (res) json_value_free(res);
+    if (req) json_value_free(req);
+}
+
+/* /http to a slot with ssh: only POST /exec, answered in the /http envelope
+ * as if the node had replied itself. */
+static void relay_ssh_slot(struct mg_connection *c, app_t *app, const config_t *cfg,
+                           int slot_index, const char *method, const char *exec_body, int exec_ms, JSON_Object *obj,
+                           relay_cache_t *cache) {
+    const char *target = cfg->sync_slots[slot_index].ssh;
+    if (strcasecmp(method, "POST") != 0 || !exec_body) {
+        JSON_Value *v = json_value_init_object();
+        JSON_Object *o = json_object(v);
+        json_object_set_string(o, "error", "ssh_exec_only");
+        json_object_set_string(o, "ssh", target);
+        send_json(c, v, 400, 1);
+        json_value_free(v);
+        return;
+    }
+    const char *lease_id = mg_get_header(c, "X-Lease-Id");
+    if (!lease_id) lease_id = json_object_get_string(obj, "lease_id");
+    JSON_Value *conflict = sync_master_lease_conflict(app, NULL, slot_index, lease_id);
+    if (conflict) {
+        send_json(c, conflict, 409, 1);
+        json_value_free(conflict);
+        return;
+    }
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    long long t0 = now_ms();
+    int status = 500;
+    JSON_Value *reply = sshexec_run(cfg, slot_index, exec_body, exec_ms,
+                                    ri ? ri->remote_addr : NULL, &status);
+    char *ser = json_serialize_to_string(reply);
+    json_value_free(reply);
+    size_t len = ser ? strlen(ser) : 0;
+    size_t b64_len = ((len + 2) / 3) * 4 + 1;
+    char *b64 = malloc(b64_len);
+    if (!ser || !b64 || (len && mg_base64_encode((const unsigned char *)ser, len, b64, &b64_len) != -1)) {
+        if (ser) json_free_serialized_string(ser);
+        free(b64);
+        send_json_error(c, 500, "encode_failed");
+        return;
+    }
+    if (!len) b64[0] = '\0';
+    char user[64], host[128];
+    int port = 0;
+    if (sshexec_parse_target(target, user, sizeof(user), host, sizeof(host), &port) != 0) {
+        snprintf(host, sizeof(host), "%s", target);
+    }
+
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *or = json_object(resp);
+    json_object_set_string(or, "status", "ok");
+    json_object_set_number(or, "status_code", (double)status);
+    json_object_set_string(or, "reason", mg_get_response_code_text(c, status));
+    json_object_set_number(or, "body_length", (double)len);
+    json_object_set_string(or, "body_base64", b64);
+    JSON_Value *hv = json_value_init_object();
+    json_object_set_string(json_object(hv), "Content-Type", "application/json; charset=utf-8");
+    json_object_set_value(or, "headers", hv);
+    json_object_set_string(or, "target_ip", host);
+    json_object_set_number(or, "target_port", (double)port);
+    json_object_set_string(or, "ssh", target);
+    relay_upstream_t up = { .slot_index = slot_index, .node = "", .port = port, .transport = "ssh",
+                            .t0_ms = t0 };
+    snprintf(up.host, sizeof(up.host), "%s", host);
+    relay_set_upstream(or, app, &up);
+
+    cluster_note_dispatch("relay", status != 502);
+    cluster_note_node_dispatch(target, status != 502, now_ms() - t0, strlen(exec_body), len);
+    if (cache->target[0] && status == 200) {
+        JSON_Value *ev = json_parse_string(ser);
+        if (json_object_get_number(json_object(ev), "rc") == 0) {
+            char *cached = json_serialize_to_string(resp);
+            if (cached) execcache_put(cache->target, cache->body, strlen(cache->body), cached);
+            if (cached) json_free_serialized_string(cached);
+        }
+        if (ev) json_value_free(ev);
+    }
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+    json_free_serialized_string(ser);
+    free(b64);
+}
+
 static int h_http(struct mg_connection *c, void *ud) {
     app_t *app = (app_t *)ud;
-    config_t cfg; app_config_snapshot(app, &cfg);
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
     const struct mg_request_info *ri = mg_get_request_info(c);
     if (!ri || strcmp(ri->request_method, "POST") != 0) {
         send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
         return 1;
     }
 
@@ -1554,9 +3798,11 @@ static int h_http(struct mg_connection *c, void *ud) {
         json_object_set_string(o, "error", err);
         send_json(c, v, status, 1);
         json_value_free(v);
+        free(cfg);
         return 1;
     }
 
+    (void)caller_identify(c, cfg, u.body, u.len);
     JSON_Value *root = json_parse_string(u.body ? u.body : "{}");
     free(u.body);
     if (!root) {
@@ -1565,6 +3811,7 @@ static int h_http(struct mg_connection *c, void *ud) {
         json_object_set_string(o, "error", "bad_json");
         send_json(c, v, 400, 1);
         json_value_free(v);
+        free(cfg);
         return 1;
     }
 
@@ -1598,6 +3845,18 @@ static int h_http(struct mg_connection *c, void *ud) {
     if (slot_d >= 0.0) {
         slot_index = (int)slot_d - 1;
         if ((double)(slot_index + 1) != slot_d) slot_index = -2; // invalid sentinel
+    } else if (slot_v && json_value_get_type(slot_v) == JSONString) {
+        const char *ref = json_value_get_string(slot_v);
+        int rc = sync_slot_lookup(cfg, ref, &slot_index);
+        if (rc != 0) {
+            int status = 404;
+            JSON_Value *v = sync_slot_lookup_error(cfg, ref, rc, &status);
+            send_json(c, v, status, 1);
+            json_value_free(v);
+            json_value_free(root);
+            free(cfg);
+            return 1;
+        }
     }
     double port_d = (port_v && json_value_get_type(port_v) == JSONNumber)
                     ? json_value_get_number(port_v)
@@ -1619,6 +3878,37 @@ static int h_http(struct mg_connection *c, void *ud) {
     int timeout_ms = (int)timeout_d;
 
     int has_body = (body_v && json_value_get_type(body_v) == JSONString) ? 1 : 0;
+
+    /* timeout_ms is the older name of total_deadline_ms. /exec relays also
+     * get an exec timeout that leaves [exec] deadline_headroom_ms, so a
+     * handler running out of time comes back as the node's own reply. */
+    const char *node_path = api_unversioned(path);
+    int relay_exec = node_path && !strncmp(node_path, "/exec", 5) &&
+                     (node_path[5] == '\0' || node_path[5] == '?');
+    exec_deadlines_t deadlines = { 0, 0, 0 };
+    const char *deadline_err = NULL;
+    if (relay_exec && has_body) {
+        deadline_err = exec_plan_deadlines(cfg, obj, timeout_ms, &deadlines);
+    } else if (exec_timeout_field(obj, "connect_timeout_ms", &deadlines.connect_ms) != 0 ||
+               exec_timeout_field(obj, "total_deadline_ms", &deadlines.total_ms) != 0) {
+        deadline_err = "invalid_timeout";
+    } else {
+        if (!deadlines.total_ms) deadlines.total_ms = timeout_ms > 0 ? timeout_ms : 1;
+        if (!deadlines.connect_ms || deadlines.connect_ms > deadlines.total_ms) {
+            deadlines.connect_ms = deadlines.total_ms;
+        }
+    }
+    if (deadline_err) {
+        JSON_Value *v = json_value_init_object();
+        JSON_Object *o = json_object(v);
+        json_object_set_string(o, "error", deadline_err);
+        send_json(c, v, 400, 1);
+        json_value_free(v);
+        json_value_free(root);
+        free(cfg);
+        return 1;
+    }
+    timeout_ms = deadlines.total_ms;
     int has_body_b64 = (body_b64_v && json_value_get_type(body_b64_v) == JSONString) ? 1 : 0;
     int headers_obj = (headers_v && json_value_get_type(headers_v) == JSONObject) ? 1 : 0;
 
@@ -1637,6 +3927,7 @@ static int h_http(struct mg_connection *c, void *ud) {
         send_json(c, v, 400, 1);
         json_value_free(v);
         json_value_free(root);
+        free(cfg);
         return 1;
     }
 
@@ -1648,6 +3939,7 @@ static int h_http(struct mg_connection *c, void *ud) {
         send_json(c, v, 400, 1);
         json_value_free(v);
         json_value_free(root);
+        free(cfg);
         return 1;
     }
 #else
@@ -1658,28 +3950,129 @@ static int h_http(struct mg_connection *c, void *ud) {
         send_json(c, v, 400, 1);
         json_value_free(v);
         json_value_free(root);
+        free(cfg);
         return 1;
     }
 #endif
 
-    char target_host[64];
+    /* Catalog entries marked cacheable=TTL: a reply younger than the TTL is
+     * served without asking the node (unless the caller sends Cache-Control:
+     * no-cache), and an older one stands in while the node is unreachable. */
+    relay_cache_t cache;
+    memset(&cache, 0, sizeof(cache));
+    if (!strcasecmp(cfg->sync_role, "master") && !strcasecmp(method, "POST") && has_body &&
+        relay_exec) {
+        cache.body = json_value_get_string(body_v);
+        cache.ttl_s = execcache_ttl_s(cfg, cache.body, strlen(cache.body));
+        cache.stale_s = cfg->sync_exec_cache_stale_s;
+        if (cache.ttl_s > 0 && slot_index >= 0) {
+            snprintf(cache.target, sizeof(cache.target), "slot:%d", slot_index + 1);
+        } else if (cache.ttl_s > 0 && sync_id && *sync_id) {
+            snprintf(cache.target, sizeof(cache.target), "id:%s", sync_id);
+        }
+        const char *cc = mg_get_header(c, "Cache-Control");
+        if ((!cc || !strstr(cc, "no-cache")) &&
+            relay_send_cached(c, &cache, (long long)cache.ttl_s * 1000LL, "ttl", NULL)) {
+            json_value_free(root);
+            free(cfg);
+            return 1;
+        }
+    }
+
+    /* Agentless slots are run over ssh by the master itself. */
+    if (!strcasecmp(cfg->sync_role, "master") && slot_index >= 0 && slot_index < SYNC_MAX_SLOTS &&
+        cfg->sync_slots[slot_index].ssh[0]) {
+        relay_ssh_slot(c, app, cfg, slot_index, method, relay_exec && has_body ?
+                       json_value_get_string(body_v) : NULL, deadlines.exec_ms, obj, &cache);
+        json_value_free(root);
+        free(cfg);
+        return 1;
+    }
+
+    char target_host[128];
     int target_port = 0;
     char resolved_sync_id[64];
     char target_err[32];
 
-    if (resolve_target(app, &cfg, sync_id, slot_index, node_ip, device, port_hint,
+    if (resolve_target(app, cfg, sync_id, slot_index, node_ip, device, port_hint,
                        target_host, sizeof(target_host), &target_port,
                        resolved_sync_id, sizeof(resolved_sync_id),
                        target_err, sizeof(target_err)) != 0) {
         JSON_Value *v = json_value_init_object();
         JSON_Object *o = json_object(v);
         json_object_set_string(o, "error", target_err[0] ? target_err : "resolve_failed");
-        send_json(c, v, 400, 1);
+        relay_send_failure(c, v, 400, &cache);
+        json_value_free(v);
+        json_value_free(root);
+        free(cfg);
+        return 1;
+    }
+    relay_upstream_t up = { .slot_index = slot_index, .node = resolved_sync_id, .port = target_port,
+                            .transport = "http", .t0_ms = now_ms() };
+    snprintf(up.host, sizeof(up.host), "%s", target_host);
+
+    /* Exec relayed to a leased slot needs the lease holder's id, and is
+     * refused for nodes of an incompatible version under version_policy and
+     * for quarantined nodes. */
+    if (!strcasecmp(cfg->sync_role, "master") && !strncmp(node_path, "/exec", 5) &&
+        (node_path[5] == '\0' || node_path[5] == '?' || node_path[5] == '/')) {
+        const char *lease_id = mg_get_header(c, "X-Lease-Id");
+        if (!lease_id) lease_id = json_object_get_string(obj, "lease_id");
+        JSON_Value *conflict = sync_master_lease_conflict(app, resolved_sync_id, slot_index, lease_id);
+        if (!conflict) conflict = sync_master_version_conflict(app, resolved_sync_id);
+        if (!conflict) conflict = sync_master_quarantine_conflict(app, resolved_sync_id);
+        if (conflict) {
+            send_json(c, conflict, 409, 1);
+            json_value_free(conflict);
+            json_value_free(root);
+            free(cfg);
+            return 1;
+        }
+    }
+
+    /* A node whose circuit is open gets nothing until its cool-down ends. */
+    char breaker_node[128];
+    snprintf(breaker_node, sizeof(breaker_node), "%s", resolved_sync_id[0] ? resolved_sync_id : target_host);
+    int retry_after_s = 0;
+    if (breaker_allow(&cfg->breaker, breaker_node, &retry_after_s) != 0) {
+        JSON_Value *v = json_value_init_object();
+        JSON_Object *o = json_object(v);
+        json_object_set_string(o, "error", "circuit_open");
+        json_object_set_string(o, "node", breaker_node);
+        json_object_set_number(o, "retry_after_s", retry_after_s);
+        relay_send_failure(c, v, 503, &cache);
         json_value_free(v);
         json_value_free(root);
+        free(cfg);
         return 1;
     }
 
+    /* A node behind a [gateway.ID] is reached through the gateway's /relay. */
+    char relay_path[256];
+    char relay_hdr[GATEWAY_HEADER_MAX] = "";
+    sync_node_addr_t via_node;
+    if (resolved_sync_id[0] && gateway_for(cfg, resolved_sync_id) &&
+        sync_master_node_addr(app, cfg, resolved_sync_id, &via_node) == 0) {
+        http_url_t via_url;
+        via_node.port = target_port;
+        if (gateway_route(&via_node, path, timeout_ms, &via_url, relay_hdr, sizeof(relay_hdr)) != 0) {
+            JSON_Value *v = json_value_init_object();
+            JSON_Object *o = json_object(v);
+            json_object_set_string(o, "error", "gateway_unavailable");
+            json_object_set_string(o, "gateway", via_node.via);
+            relay_send_failure(c, v, 502, &cache);
+            json_value_free(v);
+            json_value_free(root);
+            free(cfg);
+            return 1;
+        }
+        snprintf(target_host, sizeof(target_host), "%s", via_url.host);
+        target_port = via_url.port;
+        up.gateway = via_node.via;
+        snprintf(relay_path, sizeof(relay_path), "%s", via_url.path);
+        path = relay_path;
+    }
+
     unsigned char *body_buf = NULL;
     const unsigned char *body_data = NULL;
     size_t body_len = 0;
@@ -1697,6 +4090,7 @@ static int h_http(struct mg_connection *c, void *ud) {
             send_json(c, v, 500, 1);
             json_value_free(v);
             json_value_free(root);
+            free(cfg);
             return 1;
         }
         size_t out_len = dst_cap;
@@ -1711,6 +4105,7 @@ static int h_http(struct mg_connection *c, void *ud) {
                 send_json(c, v, 400, 1);
                 json_value_free(v);
                 json_value_free(root);
+                free(cfg);
                 return 1;
             }
         }
@@ -1720,6 +4115,38 @@ static int h_http(struct mg_connection *c, void *ud) {
         const char *body = json_value_get_string(body_v);
         body_data = (const unsigned char *)(body ? body : "");
         body_len = strlen((const char *)body_data);
+        JSON_Value *exec_v = relay_exec ? json_parse_string(body) : NULL;
+        JSON_Object *eo = json_object(exec_v);
+        if (eo && !strcasecmp(cfg->sync_role, "master")) {
+            /* The env and params of the slot the node holds ride along. */
+            sync_node_addr_t held;
+            int ctx_slot = slot_index;
+            if (ctx_slot < 0 && resolved_sync_id[0] &&
+                sync_master_node_addr(app, cfg, resolved_sync_id, &held) == 0) {
+                ctx_slot = held.slot - 1;
+            }
+            (void)sync_slot_exec_context(cfg, ctx_slot, eo);
+        }
+        if (eo) {
+            /* A shorter limit the body asks for itself is kept. */
+            int own_ms = 0;
+            if (exec_timeout_field(eo, "exec_timeout_ms", &own_ms) != 0 || !own_ms ||
+                own_ms > deadlines.exec_ms) {
+                json_object_set_number(eo, "exec_timeout_ms", deadlines.exec_ms);
+            }
+            json_object_set_number(eo, "total_deadline_ms",
+                                   deadlines.total_ms - cfg->exec_deadline_headroom_ms);
+            char *s = json_serialize_to_string(exec_v);
+            if (s) {
+                body_buf = (unsigned char *)strdup(s);
+                json_free_serialized_string(s);
+            }
+            if (body_buf) {
+                body_data = body_buf;
+                body_len = strlen((const char *)body_buf);
+            }
+        }
+        if (exec_v) json_value_free(exec_v);
     }
 
     char portbuf[16];
@@ -1730,54 +4157,9 @@ static int h_http(struct mg_connection *c, void *ud) {
     hints.ai_family = AF_UNSPEC;
     hints.ai_flags = AI_NUMERICSERV;
 
-    struct addrinfo *res = NULL;
-    int gai = getaddrinfo(target_host, portbuf, &hints, &res);
-    if (gai != 0) {
-        if (body_buf) free(body_buf);
-        JSON_Value *v = json_value_init_object();
-        JSON_Object *o = json_object(v);
-        json_object_set_string(o, "error", "resolve_failed");
-        const char *detail = gai_strerror(gai);
-        if (detail && *detail) json_object_set_string(o, "detail", detail);
-        send_json(c, v, 502, 1);
-        json_value_free(v);
-        json_value_free(root);
-        return 1;
-    }
-
-    int fd = -1;
-    for (struct addrinfo *ai = res; ai; ai = ai->ai_next) {
-        fd = socket(ai->ai_family, ai->ai_socktype, ai->ai_protocol);
-        if (fd < 0) continue;
-        struct timeval tv;
-        if (timeout_ms < 1) timeout_ms = 1;
-        tv.tv_sec = timeout_ms / 1000;
-        tv.tv_usec = (timeout_ms % 1000) * 1000;
-        (void)setsockopt(fd, SOL_SOCKET, SO_RCVTIMEO, &tv, sizeof(tv));
-        (void)setsockopt(fd, SOL_SOCKET, SO_SNDTIMEO, &tv, sizeof(tv));
-        if (connect(fd, ai->ai_addr, ai->ai_addrlen) == 0) {
-            break;
-        }
-        int saved_errno = errno;
-        close(fd);
-        fd = -1;
-        errno = saved_errno;
-    }
-    freeaddrinfo(res);
-
-    if (fd < 0) {
-        int saved_errno = errno;
-        if (body_buf) free(body_buf);
-        JSON_Value *v = json_value_init_object();
-        JSON_Object *o = json_object(v);
-        json_object_set_string(o, "error", "connect_failed");
-        if (saved_errno) json_object_set_string(o, "detail", strerror(saved_errno));
-        send_json(c, v, 502, 1);
-        json_value_free(v);
-        json_value_free(root);
-        errno = saved_errno;
-        return 1;
-    }
+    const char *stats_node = resolved_sync_id[0] ? resolved_sync_id : target_host;
+    long long relay_t0 = now_ms();
+    up.t0_ms = relay_t0;
 
     char method_buf[16];
     snprintf(method_buf, sizeof(method_buf), "%s", method);
@@ -1796,90 +4178,186 @@ static int h_http(struct mg_connection *c, void *ud) {
         }
     }
 
-    dprintf(fd, "%s %s HTTP/1.0\r\nHost: %s\r\n", method_buf, path, target_host);
-    if (headers_obj) {
-        size_t hc = json_object_get_count(json_object(headers_v));
-        for (size_t i = 0; i < hc; i++) {
-            const char *hn = json_object_get_name(json_object(headers_v), i);
-            const char *hv = json_object_get_string(json_object(headers_v), hn);
-            if (!hn || !hv) continue;
-            dprintf(fd, "%s: %s\r\n", hn, hv);
+    int is_head = !strcmp(method_buf, "HEAD");
+
+    /* An enrolled node learns who asked for this, signed over the body. */
+    char caller_hdr[CALLER_HEADER_MAX + GATEWAY_HEADER_MAX];
+    caller_sign_header(resolved_sync_id, (const char *)body_data, body_len,
+                       caller_hdr, sizeof(caller_hdr));
+    strncat(caller_hdr, relay_hdr, sizeof(caller_hdr) - strlen(caller_hdr) - 1);
+
+    /* An idle keep-alive connection to the target is used first. When the
+     * target closed it in the meantime (nothing came back), the request goes
+     * out again on a new connection. */
+    char *resp_buf = NULL;
+    size_t buflen = 0;
+    int keep = 0;
+    int recv_err = 0;
+    int reused = 0;
+    int fd = httpc_pool_take(target_host, target_port, timeout_ms);
+    if (fd >= 0) {
+        int rc = HTTPC_CLOSED;
+        if (relay_write_request(fd, method_buf, path, target_host, headers_v, caller_hdr,
+                                body_data, body_len, has_content_length) == 0) {
+            rc = httpc_read_response(fd, is_head, 0, &resp_buf, &buflen, NULL, &keep);
+        }
+        if (rc == HTTPC_CLOSED) {
+            close(fd);
+            fd = -1;
+            up.retries++;
+        } else {
+            if (rc != 0) recv_err = errno ? errno : EIO;
+            reused = 1;
         }
     }
-    if (body_len > 0 && !has_content_length) {
-        dprintf(fd, "Content-Length: %zu\r\n", body_len);
-    }
-    dprintf(fd, "Connection: close\r\n\r\n");
-    if (body_len > 0) {
-        size_t sent = 0;
-        int send_err = 0;
-        while (sent < body_len) {
-            ssize_t w = send(fd, body_data + sent, body_len - sent, 0);
-            if (w < 0) { send_err = errno ? errno : EIO; break; }
-            if (w == 0) { send_err = EPIPE; break; }
-            sent += (size_t)w;
+
+    /* Named targets come from the DNS cache; when the cached address refuses
+     * the connection the name is resolved once more and retried if it moved. */
+    char target_ip[16] = "";
+    int connect_errno = 0;
+    for (int attempt = 0; attempt < 2 && fd < 0; attempt++) {
+        char fresh_ip[16];
+        const char *connect_host = target_host;
+        if (dnscache_resolve(target_host, cfg->sync_dns_ttl_s, fresh_ip, sizeof(fresh_ip)) == 0) {
+            if (attempt > 0 && strcmp(fresh_ip, target_ip) == 0) break;
+            strncpy(target_ip, fresh_ip, sizeof(target_ip) - 1);
+            target_ip[sizeof(target_ip) - 1] = '\0';
+            connect_host = target_ip;
+        } else if (attempt > 0) {
+            break;
         }
-        if (send_err) {
+        if (attempt > 0) up.retries++;
+
+        struct addrinfo *res = NULL;
+        int gai = getaddrinfo(connect_host, portbuf, &hints, &res);
+        if (gai != 0) {
             if (body_buf) free(body_buf);
-            close(fd);
             JSON_Value *v = json_value_init_object();
             JSON_Object *o = json_object(v);
-            json_object_set_string(o, "error", "send_failed");
-            json_object_set_string(o, "detail", strerror(send_err));
-            send_json(c, v, 502, 1);
+            json_object_set_string(o, "error", "resolve_failed");
+            const char *detail = gai_strerror(gai);
+            if (detail && *detail) json_object_set_string(o, "detail", detail);
+            relay_set_upstream(o, app, &up);
+            cluster_note_dispatch("relay", 0);
+            cluster_note_node_dispatch(stats_node, 0, -1, 0, 0);
+            breaker_note(&cfg->breaker, breaker_node, 0);
+            relay_send_failure(c, v, 502, &cache);
             json_value_free(v);
             json_value_free(root);
+            free(cfg);
             return 1;
         }
+
+        for (struct addrinfo *ai = res; ai; ai = ai->ai_next) {
+            fd = socket(ai->ai_family, ai->ai_socktype, ai->ai_protocol);
+            if (fd < 0) continue;
+            struct timeval tv;
+            tv.tv_sec = deadlines.connect_ms / 1000;
+            tv.tv_usec = (deadlines.connect_ms % 1000) * 1000;
+            (void)setsockopt(fd, SOL_SOCKET, SO_RCVTIMEO, &tv, sizeof(tv));
+            (void)setsockopt(fd, SOL_SOCKET, SO_SNDTIMEO, &tv, sizeof(tv));
+            int one = 1;
+            (void)setsockopt(fd, IPPROTO_TCP, TCP_NODELAY, &one, sizeof(one));
+            if (connect(fd, ai->ai_addr, ai->ai_addrlen) == 0) {
+                /* The reply gets what is left of the total deadline. */
+                long long left = timeout_ms - (now_ms() - relay_t0);
+                if (left < 1) left = 1;
+                tv.tv_sec = (time_t)(left / 1000);
+                tv.tv_usec = (long)(left % 1000) * 1000;
+                (void)setsockopt(fd, SOL_SOCKET, SO_RCVTIMEO, &tv, sizeof(tv));
+                (void)setsockopt(fd, SOL_SOCKET, SO_SNDTIMEO, &tv, sizeof(tv));
+                break;
+            }
+            connect_errno = errno;
+            close(fd);
+            fd = -1;
+        }
+        freeaddrinfo(res);
+        if (fd < 0 && dnscache_is_hostname(target_host)) dnscache_forget(target_host);
     }
 
-    size_t bufcap = 4096;
-    size_t buflen = 0;
-    char *resp_buf = (char *)malloc(bufcap + 1);
-    if (!resp_buf) {
+    if (fd < 0) {
+        int saved_errno = connect_errno;
+        if (relay_exec) relay_record_job(c, stats_node, body_data, body_len, NULL, 0, now_ms() - relay_t0);
         if (body_buf) free(body_buf);
-        close(fd);
         JSON_Value *v = json_value_init_object();
         JSON_Object *o = json_object(v);
-        json_object_set_string(o, "error", "oom");
-        send_json(c, v, 500, 1);
+        int timed_out = httpc_timed_out(saved_errno);
+        if (timed_out) {
+            json_object_set_string(o, "error", "timeout");
+            json_object_set_string(o, "phase", "connect");
+            json_object_set_number(o, "timeout_ms", deadlines.connect_ms);
+        } else {
+            json_object_set_string(o, "error", "connect_failed");
+            if (saved_errno) json_object_set_string(o, "detail", strerror(saved_errno));
+        }
+        relay_set_upstream(o, app, &up);
+        cluster_note_dispatch("relay", 0);
+        cluster_note_node_dispatch(stats_node, 0, now_ms() - relay_t0, 0, 0);
+        breaker_note(&cfg->breaker, breaker_node, 0);
+        relay_send_failure(c, v, timed_out ? 504 : 502, &cache);
         json_value_free(v);
         json_value_free(root);
+        errno = saved_errno;
+        free(cfg);
         return 1;
     }
 
-    int recv_err = 0;
-    while (1) {
-        char chunk[2048];
-        ssize_t r = recv(fd, chunk, sizeof(chunk), 0);
-        if (r == 0) break;
-        if (r < 0) { recv_err = errno ? errno : EIO; break; }
-        if (buflen + (size_t)r + 1 > bufcap) {
-            size_t ncap = bufcap * 2;
-            while (buflen + (size_t)r + 1 > ncap) ncap *= 2;
-            char *nb = (char *)realloc(resp_buf, ncap + 1);
-            if (!nb) { recv_err = ENOMEM; break; }
-            resp_buf = nb;
-            bufcap = ncap;
-        }
-        memcpy(resp_buf + buflen, chunk, (size_t)r);
-        buflen += (size_t)r;
+    if (!reused) {
+        int send_err = relay_write_request(fd, method_buf, path, target_host, headers_v,
+                                           caller_hdr, body_data, body_len, has_content_length);
+        if (send_err) {
+            if (relay_exec) relay_record_job(c, stats_node, body_data, body_len, NULL, 0, now_ms() - relay_t0);
+            if (body_buf) free(body_buf);
+            close(fd);
+            JSON_Value *v = json_value_init_object();
+            JSON_Object *o = json_object(v);
+            json_object_set_string(o, "error", "send_failed");
+            json_object_set_string(o, "detail", strerror(send_err));
+            relay_set_upstream(o, app, &up);
+            cluster_note_dispatch("relay", 0);
+            cluster_note_node_dispatch(stats_node, 0, now_ms() - relay_t0, 0, 0);
+            breaker_note(&cfg->breaker, breaker_node, 0);
+            relay_send_failure(c, v, 502, &cache);
+            json_value_free(v);
+            json_value_free(root);
+            free(cfg);
+            return 1;
+        }
+        if (httpc_read_response(fd, is_head, 0, &resp_buf, &buflen, NULL, &keep) != 0) {
+            recv_err = errno ? errno : EIO;
+        }
     }
-    close(fd);
+    if (!recv_err && keep) httpc_pool_put(target_host, target_port, fd);
+    else close(fd);
+    long long relay_elapsed_ms = now_ms() - relay_t0;
 
     if (recv_err) {
+        if (relay_exec) relay_record_job(c, stats_node, body_data, body_len, NULL, 0, now_ms() - relay_t0);
         if (body_buf) free(body_buf);
         free(resp_buf);
         JSON_Value *v = json_value_init_object();
         JSON_Object *o = json_object(v);
-        json_object_set_string(o, "error", "recv_failed");
-        json_object_set_string(o, "detail", strerror(recv_err));
-        send_json(c, v, 502, 1);
+        int timed_out = httpc_timed_out(recv_err);
+        if (timed_out) {
+            /* The node took the request but did not answer in time. */
+            json_object_set_string(o, "error", "timeout");
+            json_object_set_string(o, "phase", "response");
+            json_object_set_number(o, "timeout_ms", timeout_ms);
+        } else {
+            json_object_set_string(o, "error", "recv_failed");
+            json_object_set_string(o, "detail", strerror(recv_err));
+        }
+        relay_set_upstream(o, app, &up);
+        cluster_note_dispatch("relay", 0);
+        cluster_note_node_dispatch(stats_node, 0, now_ms() - relay_t0, body_len, buflen);
+        breaker_note(&cfg->breaker, breaker_node, 0);
+        relay_send_failure(c, v, timed_out ? 504 : 502, &cache);
         json_value_free(v);
         json_value_free(root);
+        free(cfg);
         return 1;
     }
-    resp_buf[buflen] = '\0';
 
     size_t header_len = 0;
     size_t body_off = 0;
@@ -1904,6 +4382,7 @@ static int h_http(struct mg_connection *c, void *ud) {
         send_json(c, v, 500, 1);
         json_value_free(v);
         json_value_free(root);
+        free(cfg);
         return 1;
     }
     memcpy(header_copy, resp_buf, header_len);
@@ -1950,6 +4429,7 @@ static int h_http(struct mg_connection *c, void *ud) {
         send_json(c, v, 500, 1);
         json_value_free(v);
         json_value_free(root);
+        free(cfg);
         return 1;
     }
     size_t b64_len = b64_cap;
@@ -1968,6 +4448,7 @@ static int h_http(struct mg_connection *c, void *ud) {
         send_json(c, v, 500, 1);
         json_value_free(v);
         json_value_free(root);
+        free(cfg);
         return 1;
     }
 
@@ -1984,7 +4465,25 @@ static int h_http(struct mg_connection *c, void *ud) {
     if (resolved_sync_id[0]) {
         json_object_set_string(or, "sync_id", resolved_sync_id);
     }
-
+    up.reused = reused;
+    relay_set_upstream(or, app, &up);
+
+    cluster_note_dispatch("relay", 1);
+    cluster_note_node_dispatch(stats_node, 1, relay_elapsed_ms, body_len, resp_body_len);
+    breaker_note(&cfg->breaker, breaker_node, 1);
+    if (relay_exec) {
+        relay_record_job(c, stats_node, body_data, body_len, body_ptr, resp_body_len, relay_elapsed_ms);
+    }
+    if (cache.target[0] && status_code == 200) {
+        JSON_Value *ev = json_parse_string(resp_body_len ? (const char *)body_ptr : "");
+        if (json_object(ev) && json_object_has_value_of_type(json_object(ev), "rc", JSONNumber) &&
+            json_object_get_number(json_object(ev), "rc") == 0) {
+            char *ser = json_serialize_to_string(resp);
+            if (ser) execcache_put(cache.target, cache.body, strlen(cache.body), ser);
+            if (ser) json_free_serialized_string(ser);
+        }
+        if (ev) json_value_free(ev);
+    }
     send_json(c, resp, 200, 1);
 
     free(b64);
@@ -1993,6 +4492,7 @@ static int h_http(struct mg_connection *c, void *ud) {
     free(header_copy);
     json_value_free(resp);
     json_value_free(root);
+    free(cfg);
     return 1;
 }
 
@@ -2005,16 +4505,69 @@ static int h_http(struct mg_connection *c, void *ud) {
 
 
 /* ----------------------- /nodes endpoint (via scan.*) ----------------------- */
+typedef struct {
+    unsigned long nodes_version;
+    int           enable_scan;
+    int           scanning;
+    unsigned      targets;
+    unsigned      done;
+    double        last_started;
+    double        last_finished;
+    unsigned long dispatch_version;
+    unsigned long breaker_version;
+    unsigned long long registry_version;
+    unsigned long meta_version;
+    unsigned long health_digest;
+    unsigned long port_version;
+} nodes_cache_key_t;
+
+static struct {
+    pthread_mutex_t    lock;
+    nodes_cache_key_t  key;
+    char              *body;
+    size_t             len;
+    unsigned long long version;
+    long long          modified_unix;
+} g_nodes_cache = { .lock = PTHREAD_MUTEX_INITIALIZER };
+
 static int h_nodes(struct mg_connection *c, void *ud){
     app_t *app=(app_t*)ud;
-    config_t cfg; app_config_snapshot(app, &cfg);
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    if (replica_handle(c, cfg)) {
+        free(cfg);
+        return 1;
+    }
     const struct mg_request_info *ri = mg_get_request_info(c);
+    const char *uri = api_local_uri(c);
+    if (!strncmp(uri, "/nodes/", 7)) {
+        const char *rest = uri + 7;
+        const char *sub = strchr(rest, '/');
+        if (sub && (!strcmp(sub, "/decommission") || !strcmp(sub, "/simulate-down"))) {
+            char id[64];
+            size_t n = (size_t)(sub - rest);
+            if (n >= sizeof(id)) n = sizeof(id) - 1;
+            memcpy(id, rest, n);
+            id[n] = '\0';
+            int rc = !strcmp(sub, "/simulate-down") ? drill_handle(c, app, cfg, id)
+                                                     : decommission_handle(c, app, cfg, id);
+            free(cfg);
+            return rc;
+        }
+        int rc = nodemeta_handle(c, cfg, rest);
+        free(cfg);
+        return rc;
+    }
 
     if (!strcmp(ri->request_method, "POST")) {
-        if (!cfg.enable_scan) {
+        if (!cfg->enable_scan) {
             JSON_Value *v=json_value_init_object(); JSON_Object *o=json_object(v);
             json_object_set_string(o,"error","scan_disabled");
-            send_json(c, v, 400, 1); json_value_free(v); return 1;
+            send_json(c, v, 400, 1); json_value_free(v); free(cfg); return 1;
         }
 
         if (scan_is_running()) {
@@ -2027,10 +4580,10 @@ static int h_nodes(struct mg_connection *c, void *ud){
             json_object_set_number(o,"progress_pct", st.progress_pct);
             json_object_set_number(o,"last_started",  st.last_started);
             json_object_set_number(o,"last_finished", st.last_finished);
-            send_json(c, v, 202, 1); json_value_free(v); return 1;
+            send_json(c, v, 202, 1); json_value_free(v); free(cfg); return 1;
         }
 
-        scan_config_t scfg; fill_scan_config(&cfg, &scfg);
+        scan_config_t scfg; fill_scan_config(cfg, &scfg);
         (void)scan_start_async(&scfg);
 
         scan_status_t st; scan_get_status(&st);
@@ -2044,13 +4597,43 @@ static int h_nodes(struct mg_connection *c, void *ud){
         json_object_set_number(o,"last_finished", st.last_finished);
         send_json(c, v, 202, 1);
         json_value_free(v);
+        free(cfg);
+        return 1;
+    }
+
+    // GET — reuse the last payload while neither the node cache nor the scan
+    // progress changed; dashboards poll this every second.
+    scan_status_t st; scan_get_status(&st);
+    nodes_cache_key_t key;
+    memset(&key, 0, sizeof(key));
+    key.nodes_version = scan_nodes_version();
+    key.enable_scan   = cfg->enable_scan ? 1 : 0;
+    key.scanning      = st.scanning;
+    key.targets       = st.targets;
+    key.done          = st.done;
+    key.last_started  = st.last_started;
+    key.last_finished = st.last_finished;
+    key.dispatch_version = cluster_node_stats_version();
+    key.breaker_version = breaker_version();
+    pthread_mutex_lock(&app->master.lock);
+    key.registry_version = app->master.version;
+    pthread_mutex_unlock(&app->master.lock);
+    key.meta_version = nodemeta_version();
+    key.health_digest = sync_master_health_digest(app, cfg);
+    key.port_version = portcheck_version();
+
+    pthread_mutex_lock(&g_nodes_cache.lock);
+    if (g_nodes_cache.body && !memcmp(&g_nodes_cache.key, &key, sizeof(key))) {
+        send_json_cached(c, g_nodes_cache.body, g_nodes_cache.len, "nodes",
+                         g_nodes_cache.version, g_nodes_cache.modified_unix, 1);
+        pthread_mutex_unlock(&g_nodes_cache.lock);
+        free(cfg);
         return 1;
     }
+    pthread_mutex_unlock(&g_nodes_cache.lock);
 
-    // GET
     scan_node_t nodes[SCAN_MAX_NODES];
     int n = scan_get_nodes(nodes, SCAN_MAX_NODES);
-    scan_status_t st; scan_get_status(&st);
 
     JSON_Value *v=json_value_init_object(); JSON_Object *o=json_object(v);
     JSON_Value *arrv=json_value_init_array(); JSON_Array *arr=json_array(arrv);
@@ -2063,20 +4646,61 @@ static int h_nodes(struct mg_connection *c, void *ud){
         if (nodes[i].device[0])  json_object_set_string(no,"device", nodes[i].device);
         if (nodes[i].version[0]) json_object_set_string(no,"version", nodes[i].version);
         json_object_set_number(no,"last_seen", nodes[i].last_seen);
+        if (nodes[i].probe_ms > 0) {
+            long long ms = (long long)(nodes[i].probe_ms + 0.5);
+            json_object_set_number(no,"probe_ms", (double)(ms > 0 ? ms : 1));
+        }
+        cluster_node_stats_t ds;
+        if ((nodes[i].sync_id[0] && cluster_node_stats(nodes[i].sync_id, &ds) == 0) ||
+            cluster_node_stats(nodes[i].ip, &ds) == 0) {
+            json_object_set_value(no,"dispatch", cluster_node_stats_json(&ds));
+        }
+        JSON_Value *circuit = breaker_state_json(nodes[i].sync_id[0] ? nodes[i].sync_id : nodes[i].ip);
+        if (circuit) json_object_set_value(no,"circuit", circuit);
+        sync_health_t health;
+        if (nodes[i].sync_id[0] && sync_master_node_health(app, cfg, nodes[i].sync_id, &health) == 0) {
+            json_object_set_value(no,"health", sync_health_json(&health));
+        }
+        long long reg_generation = nodes[i].sync_id[0] ?
+                                   sync_master_reg_generation(app, nodes[i].sync_id) : 0;
+        if (reg_generation > 0) json_object_set_number(no,"reg_generation", (double)reg_generation);
+        nodemeta_merge_json(nodes[i].sync_id, no);
+        portcheck_merge_json(nodes[i].sync_id, no);
         json_array_append_value(arr, nv);
     }
 
     json_object_set_value(o,"nodes", arrv);
-    json_object_set_number(o,"scan_feature_enabled", cfg.enable_scan ? 1 : 0);
+    json_object_set_number(o,"scan_feature_enabled", cfg->enable_scan ? 1 : 0);
     json_object_set_number(o,"scanning", st.scanning);
     json_object_set_number(o,"targets",  st.targets);
     json_object_set_number(o,"done",     st.done);
     json_object_set_number(o,"progress_pct", st.progress_pct);
     json_object_set_number(o,"last_started",  st.last_started);
     json_object_set_number(o,"last_finished", st.last_finished);
+    if (cfg->scan_adaptive) {
+        json_object_set_number(o,"skipped",  st.skipped);
+        json_object_set_number(o,"deferred", st.deferred);
+    }
 
-    send_json(c, v, 200, 1);
+    char *body = json_serialize_to_string(v);
     json_value_free(v);
+    if (!body) { send_plain(c, 500, "oom", 1); free(cfg); return 1; }
+
+    pthread_mutex_lock(&g_nodes_cache.lock);
+    if (!g_nodes_cache.body || strcmp(g_nodes_cache.body, body) != 0) {
+        if (g_nodes_cache.body) json_free_serialized_string(g_nodes_cache.body);
+        g_nodes_cache.body = body;
+        g_nodes_cache.len = strlen(body);
+        g_nodes_cache.version++;
+        g_nodes_cache.modified_unix = (long long)time(NULL);
+        body = NULL;
+    }
+    g_nodes_cache.key = key;
+    send_json_cached(c, g_nodes_cache.body, g_nodes_cache.len, "nodes",
+                     g_nodes_cache.version, g_nodes_cache.modified_unix, 1);
+    pthread_mutex_unlock(&g_nodes_cache.lock);
+    if (body) json_free_serialized_string(body);
+    free(cfg);
     return 1;
 }
 
@@ -2084,26 +4708,124 @@ static int h_nodes(struct mg_connection *c, void *ud){
 
 int main(int argc, char **argv){
     const char *cfgpath = "./autod.conf";
+    int no_config = 0;
+    int preflight = 0;   /* 1 = report as text, 2 = as JSON */
+    if (argc >= 2 && cli_is_command(argv[1])) {
+        return cli_main(argc - 1, argv + 1);
+    }
     for (int i=1; i<argc; i++) {
+        if (!strcmp(argv[i], "-h") || !strcmp(argv[i], "--help")) { print_usage(argv[0]); return 0; }
+        if (!strcmp(argv[i], "--version")) { version_print(stdout); return 0; }
+        if (!strcmp(argv[i], "--no-config")) { no_config = 1; continue; }
+        if (!strcmp(argv[i], "--preflight")) { preflight = 1; continue; }
+        if (!strcmp(argv[i], "--preflight=json")) { preflight = 2; continue; }
+        if (!strncmp(argv[i], "--", 2)) {
+            /* --section.key value: skip the value as well. */
+            if (!strchr(argv[i], '=') && i + 1 < argc) i++;
+            continue;
+        }
         if (argv[i][0] != '-') { cfgpath = argv[i]; }
     }
 
+    /* Before the config is read so its warnings reach /logs/tail too, or
+     * the preflight report. */
+    if (preflight) {
+        if (preflight_capture_start() != 0) {
+            fprintf(stderr, "WARN: preflight: config warnings are not captured\n");
+        }
+    } else if (logs_capture_start() != 0) {
+        fprintf(stderr, "WARN: log capture unavailable, /logs/tail will stay empty\n");
+    }
+
     app_t app; memset(&app, 0, sizeof(app));
     pthread_mutex_init(&app.cfg_lock, NULL);
+    pthread_mutex_init(&app.inflight_lock, NULL);
     sync_master_state_init(&app.master);
     sync_slave_state_init(&app.slave);
     app.active_overrides = NULL;
     app.active_override_generation = 0;
 
     cfg_defaults(&app.base_cfg);
-    if (parse_ini(cfgpath, &app.base_cfg) < 0) {
+    int cfg_rc = no_config ? 0 : parse_ini(cfgpath, &app.base_cfg);
+    if (preflight) {
+        /* Reported by preflight_main() instead. */
+    } else if (cfg_rc == -1) {
         fprintf(stderr, "WARN: could not read %s, using defaults\n", cfgpath);
+    } else if (cfg_rc < 0) {
+        fprintf(stderr, "ERROR: %s has errors, not starting\n", cfgpath);
+        return 2;
+    }
+    int env_settings = apply_env_settings(&app.base_cfg);
+    if (env_settings > 0) {
+        fprintf(stderr, "config: %d setting%s from " ENV_SETTING_PREFIX "* environment variables\n",
+                env_settings, env_settings == 1 ? "" : "s");
+    }
+    for (int i=1; i<argc; i++) {
+        if (strncmp(argv[i], "--", 2) != 0 || !strcmp(argv[i], "--no-config") ||
+            !strncmp(argv[i], "--preflight", 11)) continue;
+        const char *name = argv[i] + 2;
+        const char *eq = strchr(name, '=');
+        char flag[128];
+        const char *value;
+        if (eq) {
+            size_t n = (size_t)(eq - name);
+            if (n >= sizeof(flag)) n = sizeof(flag) - 1;
+            memcpy(flag, name, n);
+            flag[n] = '\0';
+            value = eq + 1;
+        } else if (i + 1 < argc) {
+            strncpy(flag, name, sizeof(flag) - 1);
+            flag[sizeof(flag) - 1] = '\0';
+            value = argv[++i];
+        } else {
+            fprintf(stderr, "WARN: missing value for --%s\n", name);
+            continue;
+        }
+        if (apply_cli_setting(&app.base_cfg, flag, value) != 0) {
+            fprintf(stderr, "ERROR: unknown option --%s\n\n", flag);
+            print_usage(argv[0]);
+            return 2;
+        }
+    }
+    sync_cfg_expand_templates(&app.base_cfg);
+    sync_cfg_check_slots(&app.base_cfg);
+    if (preflight) {
+        return preflight_main(&app.base_cfg, no_config ? NULL : cfgpath, cfg_rc, preflight == 2);
     }
 
     pthread_mutex_lock(&app.cfg_lock);
     app.cfg = app.base_cfg;
     sync_ensure_id(&app.cfg);
     pthread_mutex_unlock(&app.cfg_lock);
+    if (app.cfg.sync_role[0] && !strcmp(app.cfg.sync_id_source, "default")) {
+        fprintf(stderr, "WARN: sync: none of id_sources '%s' yielded an id, using %s\n",
+                app.cfg.sync_id_sources, app.cfg.sync_id);
+    } else if (app.cfg.sync_role[0] && strcmp(app.cfg.sync_id_source, "config") != 0) {
+        fprintf(stderr, "sync: node id %s (from %s)\n", app.cfg.sync_id, app.cfg.sync_id_source);
+    }
+    if (app.cfg.sync_role[0] && app.cfg.sync_previous_id[0]) {
+        fprintf(stderr, "sync: registering as %s, formerly %s (id_migrate_from)\n",
+                app.cfg.sync_id, app.cfg.sync_previous_id);
+    }
+    events_store_configure(&app.cfg);
+    (void)preflight_startup(&app.cfg);
+    (void)cgroup_init(&app.cfg);
+    jobs_store_configure(&app.cfg);
+    sync_results_configure(&app.cfg);
+    catalog_load(&app.cfg);
+    enroll_load(&app.cfg);
+    fleetcfg_load(&app.cfg);
+    nodemeta_load(&app.cfg);
+    sync_master_load_desired(&app, &app.cfg);
+    sync_master_load_registry(&app, &app.cfg);
+    dnscache_book_open(app.cfg.sync_address_book_path);
+    sync_master_recall_nodes(&app.cfg);
+    httpc_set_identity(app.cfg.http_user_agent, app.cfg.http_headers, app.cfg.http_header_count);
+    httpc_set_pool(app.cfg.http_max_conns_per_host, app.cfg.http_idle_timeout_ms);
+    char proxy_desc[256];
+    if (httpc_set_proxy(&app.cfg.http_proxy, proxy_desc, sizeof(proxy_desc))) {
+        fprintf(stderr, "http: outbound requests via proxy %s\n", proxy_desc);
+    }
 
     signal(SIGINT, on_signal);
     signal(SIGTERM, on_signal);
@@ -2112,20 +4834,34 @@ int main(int argc, char **argv){
     config_t cfg_snapshot; app_config_snapshot(&app, &cfg_snapshot);
 
     /* CivetWeb options */
-    char portbuf[16]; snprintf(portbuf, sizeof(portbuf), "%d", cfg_snapshot.port);
-    char lp[96];
-    if (strcmp(cfg_snapshot.bind_addr,"0.0.0.0")==0) snprintf(lp, sizeof(lp), "%s", portbuf);
-    else snprintf(lp, sizeof(lp), "%s:%s", cfg_snapshot.bind_addr, portbuf);
+    char lp[512];
+    if (strcmp(cfg_snapshot.bind_addr,"0.0.0.0")==0) snprintf(lp, sizeof(lp), "%d", cfg_snapshot.port);
+    else snprintf(lp, sizeof(lp), "%s:%d", cfg_snapshot.bind_addr, cfg_snapshot.port);
+    for (int i = 0; i < cfg_snapshot.listener_count; i++) {
+        const server_listen_t *l = &cfg_snapshot.listeners[i];
+        size_t used = strlen(lp);
+        if (strchr(l->addr, ':')) snprintf(lp + used, sizeof(lp) - used, ",[%s]:%d", l->addr, l->port);
+        else snprintf(lp + used, sizeof(lp) - used, ",%s:%d", l->addr, l->port);
+    }
+
+    char keepalive_ms[16];
+    snprintf(keepalive_ms, sizeof(keepalive_ms), "%d", cfg_snapshot.keep_alive_timeout_ms);
+    char num_threads[16];
+    snprintf(num_threads, sizeof(num_threads), "%d", quota_server_threads(&cfg_snapshot, 2));
 
     const char *options[] = {
         "listening_ports", lp,
         "enable_keep_alive", "yes",
-        "num_threads", "2",
+        "keep_alive_timeout_ms", keepalive_ms,
+        "num_threads", num_threads,
+        "listen_reuse_port", cfg_snapshot.reuse_port ? "yes" : "no",
         NULL
     };
 
     struct mg_callbacks cbs; memset(&cbs, 0, sizeof(cbs));
     cbs.log_message = log_civet_message;
+    cbs.begin_request = on_begin_request;
+    cbs.end_request = on_end_request;
     struct mg_init_data init = {0};
     init.callbacks = &cbs;
     init.user_data = &app;
@@ -2137,6 +4873,7 @@ int main(int argc, char **argv){
     err.text_buffer_size = sizeof(errbuf);
     errbuf[0] = '\0';
 
+    g_http_boot_unix = (long long)time(NULL);
     app.ctx = mg_start2(&init, &err);
     if(!app.ctx){
         if (err.code != MG_ERROR_DATA_CODE_OK) {
@@ -2149,37 +4886,99 @@ int main(int argc, char **argv){
     }
 
     /* Install handlers */
-    mg_set_request_handler(app.ctx, "/health",  h_health,        &app);
-    mg_set_request_handler(app.ctx, "/caps",    h_caps,          &app);
-    mg_set_request_handler(app.ctx, "/exec",    h_exec,          &app);
-    mg_set_request_handler(app.ctx, "/udp",     h_udp,           &app);
-    mg_set_request_handler(app.ctx, "/http",    h_http,          &app);
-    mg_set_request_handler(app.ctx, "/nodes",   h_nodes,         &app);
-    mg_set_request_handler(app.ctx, "/media",   h_media,         &app);
-    mg_set_request_handler(app.ctx, "/firmware", h_firmware,     &app);
+    api_set_handler(app.ctx, "/health",  h_health,        &app);
+    api_set_handler(app.ctx, "/version", h_version,       &app);
+    api_set_handler(app.ctx, "/caps",    h_caps,          &app);
+    api_set_handler(app.ctx, "/exec",    h_exec,          &app);
+    api_set_handler(app.ctx, "/udp",     h_udp,           &app);
+    api_set_handler(app.ctx, "/http",    h_http,          &app);
+    api_set_handler(app.ctx, "/nodes",   h_nodes,         &app);
+    api_set_handler(app.ctx, "/media",   h_media,         &app);
+    api_set_handler(app.ctx, "/firmware", h_firmware,     &app);
     sync_register_http_handlers(app.ctx, &app);
-    mg_set_request_handler(app.ctx, "/",        h_root,    &app);
+    events_register_http_handlers(app.ctx, &app);
+    jobs_register_http_handlers(app.ctx, &app);
+    notify_register_http_handlers(app.ctx, &app);
+    cluster_register_http_handlers(app.ctx, &app);
+    fedmetrics_register_http_handlers(app.ctx, &app);
+    broadcast_register_http_handlers(app.ctx, &app);
+    nodecheck_register_http_handlers(app.ctx, &app);
+    gateway_register_http_handlers(app.ctx, &app);
+    bench_register_http_handlers(app.ctx, &app);
+    discovery_register_http_handlers(app.ctx, &app);
+    capacity_register_http_handlers(app.ctx, &app);
+    catalog_register_http_handlers(app.ctx, &app);
+    admin_register_http_handlers(app.ctx, &app);
+    enroll_register_http_handlers(app.ctx, &app);
+    logs_register_http_handlers(app.ctx, &app);
+    system_register_http_handlers(app.ctx, &app);
+    blackout_register_http_handlers(app.ctx, &app);
+    quota_register_http_handlers(app.ctx, &app);
+    process_register_http_handlers(app.ctx, &app);
+    deadman_register_http_handlers(app.ctx, &app);
+    fleetcfg_register_http_handlers(app.ctx, &app);
+    workflow_register_http_handlers(app.ctx, &app);
+    debug_register_http_handlers(app.ctx, &app);
+    api_set_handler(app.ctx, "/",        h_root,    &app);
 
     /* CORS preflight */
     mg_set_request_handler(app.ctx, "**", h_options_all, &app);
 
-    fprintf(stderr,"autod listening on %s:%d (scan %s)\n",
-            cfg_snapshot.bind_addr, cfg_snapshot.port, cfg_snapshot.enable_scan?"ENABLED":"disabled");
+    fprintf(stderr,"autod listening on %s (scan %s)\n",
+            lp, cfg_snapshot.enable_scan?"ENABLED":"disabled");
 
     // ---- Scanner: seed + optional autostart
     scan_init();
+    scan_set_filter(discovery_scan_filter, &app);
     scan_config_t scfg; fill_scan_config(&cfg_snapshot, &scfg);
     scan_seed_self_nodes(&scfg);
-    if (cfg_snapshot.enable_scan) (void)scan_start_async(&scfg);
+    if (cfg_snapshot.enable_scan) {
+        (void)scan_start_async(&scfg);
+        if (scan_schedule_start(&scfg) != 0) {
+            fprintf(stderr, "WARN: cannot start the per-subnet scan schedule\n");
+        }
+    }
 
     if (strcasecmp(cfg_snapshot.sync_role, "slave") == 0) {
         (void)sync_slave_start_thread(&app);
+    } else if (strcasecmp(cfg_snapshot.sync_role, "master") == 0) {
+        (void)sync_master_start_thread(&app);
+        if (strcmp(cfg_snapshot.sync_transport, "mqtt") == 0) {
+            (void)sync_mqtt_master_start(&app);
+        }
+    } else if (replica_is_active(&cfg_snapshot)) {
+        (void)replica_start_thread(&app);
     }
+    if (cfg_snapshot.notify.sink_count > 0) {
+        (void)notify_start_thread(&app);
+    }
+    if (cfg_snapshot.publish.backend_count > 0) {
+        (void)svcpub_start_thread(&app);
+    }
+    if (cfg_snapshot.portcheck.check_count > 0) {
+        (void)portcheck_start_thread(&app);
+    }
+    (void)blackout_start_thread(&app);
+    (void)deadman_start_thread(&app);
 
     run_startup_exec_sequence(&app);
 
     while(!g_stop) sleep(1);
     sync_slave_stop_thread(&app.slave);
+    sync_master_stop_thread(&app.master);
+    sync_mqtt_master_stop();
+    replica_stop_thread();
+    svcpub_stop_thread();
+    portcheck_stop_thread();
+    blackout_stop_thread();
+    deadman_stop_thread();
+    notify_stop_thread();
+    drain_http_server(&app, cfg_snapshot.drain_timeout_ms);
     mg_stop(app.ctx);
+    /* Registrations up to the last one are kept, whatever write-behind held back. */
+    app_config_snapshot(&app, &cfg_snapshot);
+    if (strcasecmp(cfg_snapshot.sync_role, "master") == 0) {
+        (void)sync_master_flush_registry(&app, &cfg_snapshot, 0, NULL);
+    }
     return 0;
 }
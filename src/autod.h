@@ -7,6 +7,33 @@
 #include "parson.h"
 #include "scan.h"
 #include "sync.h"
+#include "notify.h"
+#include "jobs.h"
+#include "sandbox.h"
+#include "catalog.h"
+#include "admin.h"
+#include "profile.h"
+#include "nodemeta.h"
+#include "httpc.h"
+#include "redact.h"
+#include "system.h"
+#include "svcpub.h"
+#include "fedmetrics.h"
+#include "blackout.h"
+#include "enroll.h"
+#include "quota.h"
+#include "portcheck.h"
+#include "process.h"
+#include "bandwidth.h"
+#include "deadman.h"
+#include "fleetcfg.h"
+#include "gateway.h"
+#include "sshexec.h"
+#include "bench.h"
+#include "discovery.h"
+#include "capacity.h"
+#include "events.h"
+#include "breaker.h"
 
 struct mg_context;
 struct mg_connection;
@@ -17,26 +44,134 @@ typedef struct {
 } upload_t;
 
 #define STARTUP_MAX_EXEC 16
+#define EXEC_CONFIRM_MAX 8
+#define SERVER_MAX_LISTEN 4
+
+/* [server] listen = ADDR:PORT [options] — an extra listener beside bind:port
+ * that serves the same handlers. */
+typedef struct {
+    char addr[64];
+    int  port;
+    int  admin_exempt;                    /* admin calls need no token (loopback only) */
+} server_listen_t;
 
 typedef struct config {
     int  port;
     char bind_addr[64];
     int  enable_scan;
+    int  reuse_port;
+    int  drain_timeout_ms;
+    int  keep_alive_timeout_ms;
+    server_listen_t listeners[SERVER_MAX_LISTEN];
+    int  listener_count;
 
     char sync_role[16];
     char sync_master_url[256];
     char sync_id[64];
+    char sync_id_sources[64];             /* [sync] id_sources, tried in order when id is unset */
+    char sync_id_prefix[32];
+    char sync_id_migrate_from[64];        /* sources of the id used before; sent as previous_id */
+    char sync_id_source[16];              /* derived: where sync_id came from (config, machine-id, ...) */
+    char sync_previous_id[64];            /* derived from id_migrate_from; "" = none or unchanged */
     int  sync_register_interval_s;
     int  sync_allow_bind;
     int  sync_slot_retention_s;
+    char sync_advertise[128];
+    char sync_advertise_iface[32];
+    char sync_transport[8];
+    char sync_mqtt_broker[128];
+    char sync_mqtt_prefix[64];
+    int  sync_node_down_after_s;
+    char sync_claim_policy[16];
+    char sync_id_conflict_policy[20];
+    char sync_version_policy[8];          /* warn | refuse */
+    int  sync_claim_slot;
+    int  sync_claim_priority;
+    int  sync_dns_ttl_s;
+    int  sync_lease_max_s;
+    int  sync_compact_register;
+    int  sync_gzip;
+    int  sync_replica_interval_s;
+    char sync_desired_path[256];
+    char sync_outbox_path[256];           /* slave: keep the results outbox here */
+    char sync_address_book_path[256];     /* last known master and node addresses */
+    char sync_registry_path[256];         /* master: keep the node registry here */
+    int  sync_registry_flush_s;           /* longest a registry change waits to be written */
+    int  sync_registry_flush_changes;     /* ... or write once this many changes are pending */
+    int  sync_outbox_max_kb;
+    int  sync_offline_heartbeat_s;        /* queue a heartbeat this often while offline */
+    int  sync_quarantine_failures;        /* failed dispatches in a row before quarantine; 0 = off */
+    int  sync_quarantine_probation_s;
+    int  sync_exec_cache_stale_s;         /* cached exec replies stand in this long past their TTL */
+    int  sync_slot_count;                 /* slots in use (see sync_slot_count) */
     sync_slot_config_t sync_slots[SYNC_MAX_SLOTS];
+    /* Pools slots share, allocated on first use and kept for the life of the
+     * process: copies of the config point at the same ones and only read the
+     * first *_count entries they saw. */
+    struct { char json[512]; } *sync_slot_commands;   /* SYNC_SLOT_COMMAND_POOL entries */
+    int  sync_slot_command_count;
+    struct { char text[128]; } *sync_slot_vars;       /* SYNC_SLOT_VAR_POOL env/param entries */
+    int  sync_slot_var_count;
+    sync_slot_template_t sync_slot_templates[SYNC_MAX_SLOT_TEMPLATES];
+    int  sync_slot_template_count;
+
+    notify_config_t notify;
+    jobs_config_t jobs;
+    sandbox_config_t sandbox;
+    catalog_config_t catalog;
+    admin_config_t admin;
+    profile_config_t profiles;
+    nodemeta_config_t nodemeta;
+    redact_config_t redact;
+    system_config_t system;
+    svcpub_config_t publish;
+    fedmetrics_config_t metrics;
+    blackout_config_t blackout;
+    enroll_config_t enroll;
+    quota_config_t quota;
+    portcheck_config_t portcheck;
+    process_config_t process;
+    bandwidth_config_t bandwidth;
+    deadman_config_t deadman;
+    fleetcfg_config_t fleetcfg;
+    gateway_config_t gateway;
+    sshexec_config_t ssh;
+    bench_config_t bench;
+    discovery_config_t discovery;
+    capacity_config_t capacity;
+    events_config_t events;
+    breaker_config_t breaker;
+
+    char http_user_agent[128];             /* empty = autod/<version> */
+    char http_headers[HTTPC_MAX_HEADERS][256];
+    int  http_header_count;
+    int  http_max_conns_per_host;          /* idle keep-alive connections kept per peer */
+    int  http_idle_timeout_ms;
+    httpc_proxy_t http_proxy;               /* [http] proxy, no_proxy, proxy_route, proxy_env, proxy_tunnel */
 
     scan_extra_subnet_t extra_subnets[SCAN_MAX_EXTRA_SUBNETS];
     unsigned            extra_subnet_count;
+    scan_extra_subnet_t probe_excludes[SCAN_MAX_EXCLUDES];
+    unsigned            probe_exclude_count;
+    int  scan_adaptive;                 /* order and thin sweeps by probe history */
+    int  scan_probe_budget;             /* adaptive: most probes per sweep (0 = no cap) */
+    int  scan_stable_every;             /* adaptive: probe steady hosts every Nth sweep */
+    unsigned            cidr_invalid;       /* extra_subnet, probe_exclude, allow_cidr values dropped */
 
     char interpreter[128];
+    char exec_interpreter_sha256[65];  /* pinned digest of the interpreter; "" = none */
+    char exec_mode[16];
+    char exec_path[256];
+    int  exec_shell_fallback;
+    char exec_cgroup_root[256];        /* delegated cgroup v2 directory for profile quotas */
     int  exec_timeout_ms;
+    int  exec_connect_timeout_ms;      /* dispatch: reaching the node */
+    int  exec_deadline_headroom_ms;    /* dispatch: total deadline minus the node's exec timeout */
     int  max_output_bytes;
+    int  idempotency_window_s;
+    char exec_confirm[EXEC_CONFIRM_MAX][128];  /* paths needing a confirm token */
+    int  exec_confirm_count;
+    int  exec_confirm_ttl_s;
 
     int  startup_exec_count;
     struct { char json[512]; } startup_exec[STARTUP_MAX_EXEC];
@@ -67,17 +202,123 @@ typedef struct app {
     int active_override_generation;
     sync_master_state_t master;
     sync_slave_state_t slave;
+    pthread_mutex_t inflight_lock;
+    int inflight;
 } app_t;
 
 long long now_ms(void);
+/* Fill out with (out_sz - 1) / 2 random bytes as hex, for credentials and
+ * other secrets. Returns -1 (out empty) when /dev/urandom cannot deliver;
+ * the caller must then fail rather than make up a value. */
+int random_token(char *out, size_t out_sz);
+/* Like random_token for ids that only need to be unique; falls back to a
+ * time-seeded value instead of failing. */
+void random_id(char *out, size_t out_sz);
+enum { MAX_BODY_BYTES = 262144 }; /* 256 KiB guard */
 int read_body(struct mg_connection *c, upload_t *u);
 void send_json(struct mg_connection *c, JSON_Value *v, int code, int cors_public);
 void send_plain(struct mg_connection *c, int code, const char *msg, int cors_public);
+/* {"error": error} with the given status; the _field form adds key: value
+ * when value is set (the offending field, step, client, ...). */
+void send_json_error(struct mg_connection *c, int code, const char *error);
+void send_json_error_field(struct mg_connection *c, int code, const char *error,
+                           const char *key, const char *value);
+/* Wire-format revision negotiated for the request being handled (from its
+ * /v<N>/ prefix or Accept-Version header); handlers branch on it when a
+ * response shape changes between revisions. */
+int api_request_version(void);
+/* API-Version / Deprecation / X-Request-ID header lines for responses
+ * written by hand (streams); send_json and send_plain add them already. */
+void api_print_headers(struct mg_connection *c, int cors_public);
+/* The path handlers route on: the request's local_uri without its /v<N>
+ * prefix, so /v1/sync/slots/2 and /sync/slots/2 read the same. */
+const char *api_local_uri(const struct mg_connection *c);
+/* path without a leading /v<N> segment (path itself when it has none). */
+const char *api_unversioned(const char *path);
+/* mg_set_request_handler for uri and its /v<N> aliases. */
+void api_set_handler(struct mg_context *ctx, const char *uri,
+                     int (*handler)(struct mg_connection *, void *), void *cbdata);
+#define AUTOD_REQUEST_ID_MAX 65
+/* The X-Request-ID of the request this thread is handling: the client's, or
+ * one made up for it. "" outside a request. Outbound requests from the same
+ * thread carry it, and events emitted meanwhile record it. */
+const char *api_request_id(void);
+/* Adopt id for the work a thread does on a request's behalf (NULL clears). */
+void api_set_request_id(const char *id);
+void send_json_cached(struct mg_connection *c, const char *body, size_t len,
+                      const char *scope, unsigned long long version,
+                      long long modified_unix, int cors_public);
 void app_config_snapshot(app_t *app, config_t *out);
+/* Defaults overlaid with the INI file at path (for CLI commands). Returns -1
+ * when the file cannot be read (cfg then holds the defaults) and -2 after
+ * printing include or variable errors. */
+int config_load(const char *path, config_t *cfg);
 void app_rebuild_config_locked(app_t *app);
 void fill_scan_config(const config_t *cfg, scan_config_t *scfg);
+/* The [server] listen entry the request came in on, or NULL for bind:port. */
+const server_listen_t *server_listener(const config_t *cfg, struct mg_connection *c);
+/* Where this node reaches its own API: a loopback listener when there is one,
+ * else bind:port (127.0.0.1 for a wildcard bind). */
+void server_local_address(const config_t *cfg, char *host, size_t host_sz, int *port);
+/* run_exec() result when the handler binary (or interpreter) cannot be found. */
+#define EXEC_ERR_NOT_FOUND (-2)
+/* run_exec() result when [capacity] max_jobs_in_memory runs are under way. */
+#define EXEC_ERR_CAPACITY (-3)
+/* run_exec() result when a pinned binary no longer has its SHA-256. */
+#define EXEC_ERR_INTEGRITY (-4)
+/* Whether file is a regular executable inside root (NULL/"" = the host). */
+int exec_is_runnable(const char *root, const char *file);
+/* Resolve name the way execvp() would, against search_path ($PATH when
+ * empty) inside root; names containing '/' are used as they are. Returns 0
+ * with the full path in out. */
+int exec_resolve_binary(const char *root, const char *name, const char *search_path,
+                        char *out, size_t out_sz);
+
+/* profile (may be NULL) overrides timeout_ms/max_bytes where it sets them and
+ * applies its limits, environment and run_as to the child. request_id (may be
+ * NULL) tags the job so POST /jobs/cancel can stop it. */
 int run_exec(const config_t *cfg, const char *path, JSON_Array *args,
-             int timeout_ms, int max_bytes, int *rc_out, long long *elapsed_ms,
-             char **out_stdout, char **out_stderr);
+             int timeout_ms, int max_bytes, const exec_profile_t *profile,
+             const char *request_id, int *rc_out, long long *elapsed_ms,
+             char **out_stdout, char **out_stderr,
+             size_t *out_len, size_t *err_len, exec_usage_t *usage);
+/* Store exec output under key, base64-encoding it (and setting <key>_encoding)
+ * when it is not valid UTF-8 or force_b64 is set. Returns 0 on success. */
+int exec_set_output(JSON_Object *o, const char *key, const char *buf, size_t len, int force_b64);
+/* Whether stdout should be parsed as JSON: the request's "parse_output"
+ * ("json" or "text") or else the catalog entry's parse_output option.
+ * Returns 1 for json, 0 for text, -1 for an unknown value. */
+int exec_parse_output_mode(const config_t *cfg, const char *path, const char *requested);
+/* Read an optional millisecond field. Returns -1 when it is present but not a
+ * positive whole number; *out_ms is left alone when it is absent. */
+int exec_timeout_field(JSON_Object *o, const char *key, int *out_ms);
+/* Timeouts of an exec this node dispatches to another one. */
+typedef struct {
+    int connect_ms;      /* reaching the node */
+    int exec_ms;         /* the handler's runtime there, sent as exec_timeout_ms */
+    int total_ms;        /* the whole request, connect to reply */
+} exec_deadlines_t;
+/* Fill d from the request's connect_timeout_ms, exec_timeout_ms and
+ * total_deadline_ms (total_default_ms when absent; 0 = the exec timeout plus
+ * headroom). The node's exec timeout is cut to leave [exec]
+ * deadline_headroom_ms before the total deadline, so a handler that runs out
+ * of time is reported by the node instead of the reply never arriving.
+ * Returns NULL or the error to send. */
+const char *exec_plan_deadlines(const config_t *cfg, JSON_Object *o, int total_default_ms,
+                                exec_deadlines_t *d);
+/* Whether name may be set in a handler's environment or used as a param:
+ * [A-Za-z_][A-Za-z0-9_]*, and not PATH, LD_* or AUTOD_*. */
+int exec_var_name_valid(const char *name);
+/* Check the optional "env" (variables for the handler) and "params" (values
+ * for {NAME} in args) of an /exec body. Returns NULL or the error to send
+ * (invalid_env, invalid_params); on success *args_out is args with the
+ * params filled in (NULL when nothing changed; the caller frees it). */
+const char *exec_context_check(JSON_Object *o, JSON_Array *args, JSON_Value **args_out);
+/* Export the checked body's "env" in the children of run_exec calls on this
+ * thread; NULL stops it. */
+void exec_context_set(JSON_Object *o);
+/* Store stdout parsed as JSON under "result". Returns -1 and sets
+ * "parse_error" when it is not a JSON document. */
+int exec_set_result(JSON_Object *o, const char *buf, size_t len);
 
 #endif
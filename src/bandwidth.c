@@ -0,0 +1,183 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <signal.h>
+#include <time.h>
+#include <pthread.h>
+#include <arpa/inet.h>
+
+#include "civetweb.h"
+#include "autod.h"
+#include "bandwidth.h"
+
+extern volatile sig_atomic_t g_stop;
+
+/* Pieces are small enough that pacing stays smooth at a few Mbit/s. */
+#define BANDWIDTH_PIECE_MIN 1024
+#define BANDWIDTH_SLEEP_MAX_MS 200
+
+static pthread_mutex_t g_bandwidth_lock = PTHREAD_MUTEX_INITIALIZER;
+static long long g_total_rate;        /* bytes per second, from the latest config */
+static long long g_total_next_us;
+
+/* ---------- Config ---------- */
+
+void bandwidth_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->bandwidth, 0, sizeof(cfg->bandwidth));
+    cfg->bandwidth.burst_ms = 250;
+}
+
+/* "10.0.0.0/8" or a single address. */
+static int bandwidth_parse_net(const char *s, unsigned *net, unsigned *mask) {
+    char ip[32];
+    int bits = 32;
+    const char *slash = strchr(s, '/');
+    size_t len = slash ? (size_t)(slash - s) : strlen(s);
+    if (len == 0 || len >= sizeof(ip)) return -1;
+    memcpy(ip, s, len);
+    ip[len] = '\0';
+    if (slash) {
+        char *end = NULL;
+        long v = strtol(slash + 1, &end, 10);
+        if (!slash[1] || *end || v < 0 || v > 32) return -1;
+        bits = (int)v;
+    }
+    struct in_addr a;
+    if (inet_pton(AF_INET, ip, &a) != 1) return -1;
+    *mask = bits ? 0xffffffffu << (32 - bits) : 0;
+    *net = ntohl(a.s_addr) & *mask;
+    return 0;
+}
+
+int bandwidth_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (strcmp(section, "bandwidth") != 0) return 0;
+    bandwidth_config_t *bw = &cfg->bandwidth;
+    int v = atoi(value);
+    if (!strcmp(key, "client_kbps")) {
+        if (v >= 0) bw->client_kbps = v;
+        else fprintf(stderr, "WARN: ignoring negative bandwidth client_kbps %s\n", value);
+    } else if (!strcmp(key, "total_kbps")) {
+        if (v >= 0) bw->total_kbps = v;
+        else fprintf(stderr, "WARN: ignoring negative bandwidth total_kbps %s\n", value);
+    } else if (!strcmp(key, "burst_ms")) {
+        if (v >= 0) bw->burst_ms = v;
+        else fprintf(stderr, "WARN: ignoring negative bandwidth burst_ms %s\n", value);
+    } else if (!strcmp(key, "exempt")) {
+        char buf[512];
+        snprintf(buf, sizeof(buf), "%s", value);
+        char *save = NULL;
+        for (char *tok = strtok_r(buf, ", \t", &save); tok; tok = strtok_r(NULL, ", \t", &save)) {
+            unsigned net, mask;
+            if (bandwidth_parse_net(tok, &net, &mask) != 0) {
+                fprintf(stderr, "WARN: ignoring bandwidth exempt '%s' (expected a.b.c.d[/n])\n", tok);
+            } else if (bw->exempt_count >= BANDWIDTH_MAX_EXEMPT) {
+                fprintf(stderr, "WARN: bandwidth exempt capacity reached (%d)\n", BANDWIDTH_MAX_EXEMPT);
+                break;
+            } else {
+                bw->exempt_net[bw->exempt_count] = net;
+                bw->exempt_mask[bw->exempt_count] = mask;
+                bw->exempt_count++;
+            }
+        }
+    } else {
+        fprintf(stderr, "WARN: ignoring unknown bandwidth key '%s'\n", key);
+    }
+    return 1;
+}
+
+/* ---------- Pacing ---------- */
+
+static long long bandwidth_now_us(void) {
+    struct timespec ts;
+    clock_gettime(CLOCK_MONOTONIC, &ts);
+    return (long long)ts.tv_sec * 1000000LL + ts.tv_nsec / 1000;
+}
+
+static int bandwidth_exempt(const config_t *cfg, const char *addr) {
+    struct in_addr a;
+    if (!addr || inet_pton(AF_INET, addr, &a) != 1) return 0;
+    unsigned ip = ntohl(a.s_addr);
+    for (int i = 0; i < cfg->bandwidth.exempt_count; i++) {
+        if ((ip & cfg->bandwidth.exempt_mask[i]) == cfg->bandwidth.exempt_net[i]) return 1;
+    }
+    return 0;
+}
+
+void bandwidth_stream_begin(bandwidth_stream_t *s, struct mg_connection *c, const config_t *cfg) {
+    memset(s, 0, sizeof(*s));
+    s->c = c;
+    if (!cfg) return;
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    pthread_mutex_lock(&g_bandwidth_lock);
+    g_total_rate = (long long)cfg->bandwidth.total_kbps * 1000 / 8;
+    pthread_mutex_unlock(&g_bandwidth_lock);
+    if (bandwidth_exempt(cfg, ri ? ri->remote_addr : NULL)) return;
+    s->rate = (long long)cfg->bandwidth.client_kbps * 1000 / 8;
+    s->shared = cfg->bandwidth.total_kbps > 0;
+    s->burst_ms = cfg->bandwidth.burst_ms;
+}
+
+/* Book n bytes on a schedule running at rate bytes/s. Allowance left unused
+ * for longer than burst_ms is forfeited. Returns when the bytes may go. */
+static long long bandwidth_reserve(long long *next_us, long long rate, size_t n,
+                                   long long now, int burst_ms) {
+    long long start = *next_us;
+    if (start < now - (long long)burst_ms * 1000) start = now - (long long)burst_ms * 1000;
+    *next_us = start + (long long)n * 1000000LL / rate;
+    return start;
+}
+
+int bandwidth_write(bandwidth_stream_t *s, const void *buf, size_t len) {
+    const char *p = (const char *)buf;
+    size_t left = len;
+    int written = 0;
+    while (left > 0) {
+        long long total = 0;
+        if (s->shared) {
+            pthread_mutex_lock(&g_bandwidth_lock);
+            total = g_total_rate;
+            pthread_mutex_unlock(&g_bandwidth_lock);
+        }
+        if (s->rate <= 0 && total <= 0) {
+            int r = mg_write(s->c, p, left);
+            if (r <= 0) return r;
+            s->bytes += (unsigned long long)r;
+            return written + r;
+        }
+
+        long long rate = s->rate > 0 && (total <= 0 || s->rate < total) ? s->rate : total;
+        size_t piece = (size_t)(rate / 20);
+        if (piece < BANDWIDTH_PIECE_MIN) piece = BANDWIDTH_PIECE_MIN;
+        if (piece > left) piece = left;
+
+        long long now = bandwidth_now_us();
+        long long when = now;
+        if (s->rate > 0) {
+            long long t = bandwidth_reserve(&s->next_us, s->rate, piece, now, s->burst_ms);
+            if (t > when) when = t;
+        }
+        if (total > 0) {
+            pthread_mutex_lock(&g_bandwidth_lock);
+            long long t = bandwidth_reserve(&g_total_next_us, total, piece, now, s->burst_ms);
+            pthread_mutex_unlock(&g_bandwidth_lock);
+            if (t > when) when = t;
+        }
+        while (!g_stop && (now = bandwidth_now_us()) < when) {
+            long long wait_us = when - now;
+            if (wait_us > BANDWIDTH_SLEEP_MAX_MS * 1000LL) wait_us = BANDWIDTH_SLEEP_MAX_MS * 1000LL;
+            struct timespec ts = { (time_t)(wait_us / 1000000), (long)(wait_us % 1000000) * 1000 };
+            nanosleep(&ts, NULL);
+        }
+        if (g_stop) return -1;
+
+        int r = mg_write(s->c, p, piece);
+        if (r <= 0) return r;
+        s->bytes += (unsigned long long)r;
+        written += r;
+        p += r;
+        left -= (size_t)r;
+    }
+    return written;
+}
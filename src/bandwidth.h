@@ -0,0 +1,43 @@
+#ifndef AUTOD_BANDWIDTH_H
+#define AUTOD_BANDWIDTH_H
+
+#include <stddef.h>
+
+#define BANDWIDTH_MAX_EXEMPT 8
+
+/* [bandwidth] — pace the long responses (file downloads, /logs/tail,
+ * /sync/exec result streams) so one client on a fast link cannot take the
+ * whole uplink. Rates are in kilobits per second; 0 leaves them unpaced. */
+typedef struct {
+    int  client_kbps;             /* per response */
+    int  total_kbps;              /* shared by every paced response */
+    int  burst_ms;                /* unused allowance a response may catch up on (250) */
+    unsigned exempt_net[BANDWIDTH_MAX_EXEMPT];    /* host order */
+    unsigned exempt_mask[BANDWIDTH_MAX_EXEMPT];
+    int  exempt_count;
+} bandwidth_config_t;
+
+typedef struct config config_t;
+struct mg_connection;
+
+/* One paced response. Writes block until the data fits both this response's
+ * rate and the shared one, so a stream reads its source no faster than the
+ * client takes it. */
+typedef struct {
+    struct mg_connection *c;
+    long long rate;               /* bytes per second, 0 = unpaced */
+    int  shared;                  /* counts against total_kbps */
+    int  burst_ms;
+    long long next_us;            /* when this response's allowance resumes */
+    unsigned long long bytes;
+} bandwidth_stream_t;
+
+void bandwidth_cfg_defaults(config_t *cfg);
+int bandwidth_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+void bandwidth_stream_begin(bandwidth_stream_t *s, struct mg_connection *c, const config_t *cfg);
+/* mg_write() at the paced rate: the bytes written, or <= 0 once the client
+ * is gone (or the daemon is stopping). */
+int bandwidth_write(bandwidth_stream_t *s, const void *buf, size_t len);
+
+#endif
@@ -0,0 +1,487 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <time.h>
+#include <unistd.h>
+#include <pthread.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "httpc.h"
+#include "sync.h"
+#include "version.h"
+#include "bench.h"
+
+#define BENCH_DEFAULT_MAX_NODES 16
+#define BENCH_MAX_THREADS 256
+#define BENCH_MAX_SAMPLES 2000000
+#define BENCH_ECHO_MAX_SLEEP_MS 10000
+#define BENCH_ECHO_MAX_REPLY 1048576
+
+/* ---------- Config ---------- */
+
+void bench_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->bench, 0, sizeof(cfg->bench));
+    cfg->bench.max_nodes = BENCH_DEFAULT_MAX_NODES;
+}
+
+int bench_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (strcmp(section, "bench") != 0) return 0;
+    if (!strcmp(key, "enable")) {
+        cfg->bench.enable = atoi(value) ? 1 : 0;
+    } else if (!strcmp(key, "max_nodes")) {
+        int v = atoi(value);
+        if (v >= 1 && v <= BENCH_MAX_NODES) cfg->bench.max_nodes = v;
+        else fprintf(stderr, "WARN: ignoring bench max_nodes %s (1-%d)\n", value, BENCH_MAX_NODES);
+    } else {
+        fprintf(stderr, "WARN: ignoring unknown bench key '%s'\n", key);
+    }
+    return 1;
+}
+
+/* ---------- Load generator ---------- */
+
+typedef struct {
+    const bench_plan_t *plan;
+    char *body;                   /* the same for every request (exec, echo) */
+    char id_prefix[48];           /* register */
+    long long t0_us;
+    long long stop_us;            /* duration runs */
+    pthread_mutex_t lock;
+    int issued;
+    double *samples;
+    int sample_count;
+    int sample_cap;
+    bench_result_t *r;
+} bench_run_t;
+
+static long long bench_now_us(void) {
+    struct timespec ts;
+    clock_gettime(CLOCK_MONOTONIC, &ts);
+    return (long long)ts.tv_sec * 1000000LL + ts.tv_nsec / 1000;
+}
+
+static void bench_sleep_us(long long us) {
+    struct timespec ts = { (time_t)(us / 1000000), (long)(us % 1000000) * 1000 };
+    nanosleep(&ts, NULL);
+}
+
+static void bench_note_error(bench_result_t *r, const char *what) {
+    for (int i = 0; i < r->error_kinds; i++) {
+        if (!strcmp(r->errors[i].what, what)) {
+            r->errors[i].count++;
+            return;
+        }
+    }
+    /* The last kind collects whatever does not fit. */
+    if (r->error_kinds == BENCH_MAX_ERROR_KINDS) {
+        r->errors[BENCH_MAX_ERROR_KINDS - 1].count++;
+        return;
+    }
+    int i = r->error_kinds++;
+    snprintf(r->errors[i].what, sizeof(r->errors[i].what), "%s",
+             i == BENCH_MAX_ERROR_KINDS - 1 ? "other" : what);
+    r->errors[i].count = 1;
+}
+
+/* The next request number, paced to plan->rate; -1 once the run is over. */
+static int bench_next(bench_run_t *run) {
+    const bench_plan_t *plan = run->plan;
+    pthread_mutex_lock(&run->lock);
+    int seq = run->issued;
+    if ((plan->duration_s <= 0 && seq >= plan->requests) ||
+        (plan->duration_s > 0 && bench_now_us() >= run->stop_us)) {
+        pthread_mutex_unlock(&run->lock);
+        return -1;
+    }
+    run->issued++;
+    pthread_mutex_unlock(&run->lock);
+    if (plan->rate > 0) {
+        long long due = run->t0_us + (long long)((double)seq * 1000000.0 / plan->rate);
+        long long wait = due - bench_now_us();
+        if (run->stop_us && due > run->stop_us) return -1;
+        if (wait > 0) bench_sleep_us(wait);
+    }
+    return seq;
+}
+
+/* Whether an exec reply reports a run that exited 0; *what gets the reason
+ * when not. */
+static int bench_exec_ok(const char *resp, char *what, size_t what_sz) {
+    JSON_Value *doc = resp ? json_parse_string(resp) : NULL;
+    JSON_Object *o = json_object(doc);
+    int ok = o && json_object_has_value_of_type(o, "rc", JSONNumber) &&
+             json_object_get_number(o, "rc") == 0;
+    if (!ok) {
+        const char *err = json_object_get_string(o, "error");
+        if (err) snprintf(what, what_sz, "%s", err);
+        else if (json_object_has_value_of_type(o, "rc", JSONNumber)) snprintf(what, what_sz, "rc_nonzero");
+        else snprintf(what, what_sz, "bad_reply");
+    }
+    if (doc) json_value_free(doc);
+    return ok;
+}
+
+/* The node's reply inside a /http envelope. */
+static int bench_relay_ok(const char *resp, char *what, size_t what_sz) {
+    JSON_Value *doc = resp ? json_parse_string(resp) : NULL;
+    JSON_Object *o = json_object(doc);
+    const char *b64 = json_object_get_string(o, "body_base64");
+    int code = (int)json_object_get_number(o, "status_code");
+    int ok = 0;
+    if (!b64) {
+        snprintf(what, what_sz, "bad_reply");
+    } else {
+        size_t len = strlen(b64), out_len = len;
+        char *body = malloc(len + 1);
+        if (body && (len == 0 || mg_base64_decode(b64, len, (unsigned char *)body, &out_len) == -1)) {
+            body[len ? out_len : 0] = '\0';
+            ok = bench_exec_ok(body, what, what_sz);
+            if (!ok && code != 200 && !strcmp(what, "bad_reply")) {
+                snprintf(what, what_sz, "node_http_%d", code);
+            }
+        } else {
+            snprintf(what, what_sz, "bad_reply");
+        }
+        free(body);
+    }
+    if (doc) json_value_free(doc);
+    return ok;
+}
+
+static char *bench_register_body(const bench_run_t *run, int seq) {
+    char id[64];
+    snprintf(id, sizeof(id), "%s%d", run->id_prefix, seq % run->plan->nodes);
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "id", id);
+    json_object_set_boolean(o, "bench", 1);
+    json_object_set_string(o, "role", "bench");
+    json_object_set_string(o, "device", "bench");
+    json_object_set_string(o, "address", "127.0.0.1");
+    json_object_set_number(o, "port", 1);
+    json_object_set_string(o, "autod_version", AUTOD_VERSION);
+    json_object_set_number(o, "api_version", AUTOD_API_VERSION);
+    json_object_set_number(o, "api_min_version", AUTOD_API_VERSION_MIN);
+    json_object_set_number(o, "ack_generation", 0);
+    char *s = json_serialize_to_string(v);
+    json_value_free(v);
+    return s;
+}
+
+static void *bench_worker(void *arg) {
+    bench_run_t *run = (bench_run_t *)arg;
+    const bench_plan_t *plan = run->plan;
+    http_url_t url = plan->target;
+    int reg = !strcmp(plan->mode, "register");
+    int relay = !strcmp(plan->mode, "exec") && plan->slot;
+    if (reg) snprintf(url.path, sizeof(url.path), AUTOD_PEER_PREFIX "/sync/register");
+    else if (relay) snprintf(url.path, sizeof(url.path), AUTOD_PEER_PREFIX "/http");
+    else if (!strcmp(plan->mode, "exec")) snprintf(url.path, sizeof(url.path), AUTOD_PEER_PREFIX "/exec");
+    else snprintf(url.path, sizeof(url.path), AUTOD_PEER_PREFIX "/bench/echo");
+
+    int seq;
+    while ((seq = bench_next(run)) >= 0) {
+        char *reg_body = reg ? bench_register_body(run, seq) : NULL;
+        const char *body = reg ? reg_body : run->body;
+        char *resp = NULL;
+        size_t resp_len = 0;
+        long long t = bench_now_us();
+        int status = body ? httpc_post_json(&url, body, &resp, &resp_len, plan->timeout_ms) : -1;
+        double ms = (double)(bench_now_us() - t) / 1000.0;
+        if (reg_body) json_free_serialized_string(reg_body);
+
+        char what[32] = "";
+        int ok = 0;
+        if (status < 0) {
+            const char *e = httpc_last_error();
+            snprintf(what, sizeof(what), "%s", e && *e ? e : "transport");
+        } else if (status != 200) {
+            JSON_Value *doc = resp ? json_parse_string(resp) : NULL;
+            const char *err = json_object_get_string(json_object(doc), "error");
+            if (err) snprintf(what, sizeof(what), "%s", err);
+            else snprintf(what, sizeof(what), "http_%d", status);
+            if (doc) json_value_free(doc);
+        } else if (reg) {
+            JSON_Value *doc = resp ? json_parse_string(resp) : NULL;
+            const char *st = json_object_get_string(json_object(doc), "status");
+            ok = st && (!strcmp(st, "registered") || !strcmp(st, "waiting"));
+            if (!ok) snprintf(what, sizeof(what), "%s", st ? st : "bad_reply");
+            if (doc) json_value_free(doc);
+        } else if (relay) {
+            ok = bench_relay_ok(resp, what, sizeof(what));
+        } else if (!strcmp(plan->mode, "exec")) {
+            ok = bench_exec_ok(resp, what, sizeof(what));
+        } else {
+            ok = 1;
+        }
+        free(resp);
+
+        pthread_mutex_lock(&run->lock);
+        run->r->requests++;
+        if (ok) run->r->ok++;
+        else {
+            run->r->failed++;
+            bench_note_error(run->r, what);
+        }
+        if (status >= 0 && run->sample_count < BENCH_MAX_SAMPLES) {
+            if (run->sample_count == run->sample_cap) {
+                int cap = run->sample_cap ? run->sample_cap * 2 : 4096;
+                double *ns = realloc(run->samples, (size_t)cap * sizeof(double));
+                if (ns) {
+                    run->samples = ns;
+                    run->sample_cap = cap;
+                }
+            }
+            if (run->sample_count < run->sample_cap) run->samples[run->sample_count++] = ms;
+        }
+        pthread_mutex_unlock(&run->lock);
+    }
+    return NULL;
+}
+
+static int bench_cmp_double(const void *a, const void *b) {
+    double x = *(const double *)a, y = *(const double *)b;
+    return x < y ? -1 : x > y;
+}
+
+/* Nearest-rank percentile of n sorted samples. */
+static double bench_percentile(const double *sorted, int n, int p) {
+    int i = (int)(((long long)p * n + 99) / 100) - 1;
+    if (i < 0) i = 0;
+    if (i >= n) i = n - 1;
+    return sorted[i];
+}
+
+static char *bench_fixed_body(const bench_plan_t *plan) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    if (!strcmp(plan->mode, "echo")) {
+        json_object_set_number(o, "sleep_ms", plan->sleep_ms);
+        json_object_set_number(o, "reply_bytes", plan->reply_bytes);
+    } else {
+        json_object_set_string(o, "path", plan->exec_path);
+        JSON_Value *av = json_value_init_array();
+        for (int i = 0; i < plan->arg_count; i++) json_array_append_string(json_array(av), plan->args[i]);
+        json_object_set_value(o, "args", av);
+    }
+    char *s = json_serialize_to_string(v);
+    json_value_free(v);
+    if (!s || strcmp(plan->mode, "exec") != 0 || !plan->slot) return s;
+
+    /* Through the master: the same body wrapped for POST /http. */
+    JSON_Value *w = json_value_init_object();
+    JSON_Object *wo = json_object(w);
+    if (strspn(plan->slot, "0123456789") == strlen(plan->slot)) {
+        json_object_set_number(wo, "slot", atoi(plan->slot));
+    } else {
+        json_object_set_string(wo, "slot", plan->slot);
+    }
+    json_object_set_string(wo, "method", "POST");
+    json_object_set_string(wo, "path", AUTOD_PEER_PREFIX "/exec");
+    json_object_set_string(wo, "body", s);
+    json_object_set_number(wo, "timeout_ms", plan->timeout_ms);
+    json_free_serialized_string(s);
+    s = json_serialize_to_string(w);
+    json_value_free(w);
+    return s;
+}
+
+int bench_run(const bench_plan_t *plan, bench_result_t *out) {
+    if (!plan || !out) return -1;
+    memset(out, 0, sizeof(*out));
+    int reg = !strcmp(plan->mode, "register");
+    if (strcmp(plan->mode, "exec") && strcmp(plan->mode, "echo") && !reg) return -1;
+    if (!strcmp(plan->mode, "exec") && (!plan->exec_path || !*plan->exec_path)) return -1;
+    if (plan->concurrency < 1 || (plan->duration_s <= 0 && plan->requests < 1)) return -1;
+    if (reg && (plan->nodes < 1 || plan->nodes > BENCH_MAX_NODES)) return -1;
+
+    bench_run_t run;
+    memset(&run, 0, sizeof(run));
+    run.plan = plan;
+    run.r = out;
+    pthread_mutex_init(&run.lock, NULL);
+    if (!reg && !(run.body = bench_fixed_body(plan))) return -1;
+    snprintf(run.id_prefix, sizeof(run.id_prefix), "bench-%ld-", (long)getpid());
+
+    /* Keep-alive like a busy client; at most HTTPC_MAX_CONNS_PER_HOST stay open. */
+    int pooled = plan->concurrency < HTTPC_MAX_CONNS_PER_HOST ? plan->concurrency
+                                                              : HTTPC_MAX_CONNS_PER_HOST;
+    httpc_set_pool(pooled, HTTPC_DEFAULT_IDLE_TIMEOUT_MS);
+
+    int workers = plan->concurrency < BENCH_MAX_THREADS ? plan->concurrency : BENCH_MAX_THREADS;
+    pthread_t threads[BENCH_MAX_THREADS];
+    run.t0_us = bench_now_us();
+    if (plan->duration_s > 0) run.stop_us = run.t0_us + (long long)plan->duration_s * 1000000LL;
+    int started = 0;
+    for (int i = 0; i < workers; i++) {
+        if (pthread_create(&threads[i], NULL, bench_worker, &run) != 0) break;
+        started++;
+    }
+    for (int i = 0; i < started; i++) pthread_join(threads[i], NULL);
+    out->elapsed_ms = (bench_now_us() - run.t0_us) / 1000;
+
+    out->samples = run.sample_count;
+    if (run.sample_count > 0) {
+        qsort(run.samples, (size_t)run.sample_count, sizeof(double), bench_cmp_double);
+        double sum = 0;
+        for (int i = 0; i < run.sample_count; i++) sum += run.samples[i];
+        out->min_ms = run.samples[0];
+        out->max_ms = run.samples[run.sample_count - 1];
+        out->mean_ms = sum / run.sample_count;
+        out->p50_ms = bench_percentile(run.samples, run.sample_count, 50);
+        out->p90_ms = bench_percentile(run.samples, run.sample_count, 90);
+        out->p99_ms = bench_percentile(run.samples, run.sample_count, 99);
+    }
+    free(run.samples);
+    if (run.body) json_free_serialized_string(run.body);
+    pthread_mutex_destroy(&run.lock);
+
+    if (reg) {
+        http_url_t url = plan->target;
+        snprintf(url.path, sizeof(url.path), AUTOD_PEER_PREFIX "/bench/nodes");
+        char *resp = NULL;
+        int status = httpc_send_json("DELETE", &url, NULL, NULL, &resp, NULL, plan->timeout_ms);
+        JSON_Value *doc = status == 200 && resp ? json_parse_string(resp) : NULL;
+        out->dropped = doc ? (int)json_object_get_number(json_object(doc), "dropped") : -1;
+        if (doc) json_value_free(doc);
+        free(resp);
+    }
+    return started > 0 ? 0 : -1;
+}
+
+JSON_Value *bench_result_json(const bench_plan_t *plan, const bench_result_t *r) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    char target[160];
+    snprintf(target, sizeof(target), "%s:%d", plan->target.host, plan->target.port);
+    json_object_set_string(o, "target", target);
+    json_object_set_string(o, "mode", plan->mode);
+    if (!strcmp(plan->mode, "exec")) {
+        json_object_set_string(o, "path", plan->exec_path);
+        if (plan->slot) json_object_set_string(o, "slot", plan->slot);
+    }
+    if (!strcmp(plan->mode, "register")) json_object_set_number(o, "nodes", plan->nodes);
+    json_object_set_number(o, "concurrency", plan->concurrency);
+    if (plan->rate > 0) json_object_set_number(o, "rate", plan->rate);
+    json_object_set_number(o, "requests", r->requests);
+    json_object_set_number(o, "ok", r->ok);
+    json_object_set_number(o, "failed", r->failed);
+    json_object_set_number(o, "error_rate", r->requests ? (double)r->failed / r->requests : 0);
+    JSON_Value *ev = json_value_init_object();
+    for (int i = 0; i < r->error_kinds; i++) {
+        json_object_set_number(json_object(ev), r->errors[i].what, r->errors[i].count);
+    }
+    json_object_set_value(o, "errors", ev);
+    json_object_set_number(o, "elapsed_ms", (double)r->elapsed_ms);
+    json_object_set_number(o, "throughput_rps",
+                           r->elapsed_ms > 0 ? r->requests * 1000.0 / (double)r->elapsed_ms : 0);
+    if (r->samples > 0) {
+        JSON_Value *lv = json_value_init_object();
+        JSON_Object *lo = json_object(lv);
+        json_object_set_number(lo, "min", r->min_ms);
+        json_object_set_number(lo, "p50", r->p50_ms);
+        json_object_set_number(lo, "p90", r->p90_ms);
+        json_object_set_number(lo, "p99", r->p99_ms);
+        json_object_set_number(lo, "max", r->max_ms);
+        json_object_set_number(lo, "mean", r->mean_ms);
+        json_object_set_value(o, "latency_ms", lv);
+    }
+    if (!strcmp(plan->mode, "register")) json_object_set_number(o, "dropped", r->dropped);
+    return v;
+}
+
+/* ---------- Daemon side ---------- */
+
+/* POST /bench/echo {"sleep_ms":N,"reply_bytes":N}: a reply that never forks. */
+static void bench_echo(struct mg_connection *c) {
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        free(u.body);
+        send_json_error(c, 400, "body_read_failed");
+        return;
+    }
+    JSON_Value *root = json_parse_string(u.body ? u.body : "{}");
+    free(u.body);
+    if (!root) {
+        send_json_error(c, 400, "bad_json");
+        return;
+    }
+    int sleep_ms = (int)json_object_get_number(json_object(root), "sleep_ms");
+    int reply_bytes = (int)json_object_get_number(json_object(root), "reply_bytes");
+    json_value_free(root);
+    if (sleep_ms < 0 || sleep_ms > BENCH_ECHO_MAX_SLEEP_MS ||
+        reply_bytes < 0 || reply_bytes > BENCH_ECHO_MAX_REPLY) {
+        send_json_error(c, 400, "out_of_range");
+        return;
+    }
+    if (sleep_ms > 0) bench_sleep_us((long long)sleep_ms * 1000);
+    char *pad = malloc((size_t)reply_bytes + 1);
+    if (!pad) {
+        send_json_error(c, 500, "oom");
+        return;
+    }
+    memset(pad, 'x', (size_t)reply_bytes);
+    pad[reply_bytes] = '\0';
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_boolean(o, "ok", 1);
+    json_object_set_number(o, "slept_ms", sleep_ms);
+    json_object_set_string(o, "pad", pad);
+    free(pad);
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+}
+
+static int h_bench(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    const char *uri = api_local_uri(c);
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    if (!cfg->bench.enable) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    if (!strcmp(uri, "/bench/echo")) {
+        if (strcmp(ri->request_method, "POST") != 0) {
+            send_plain(c, 405, "method_not_allowed", 1);
+            free(cfg);
+            return 1;
+        }
+        bench_echo(c);
+        free(cfg);
+        return 1;
+    }
+    if (!strcmp(uri, "/bench/nodes") && !strcasecmp(cfg->sync_role, "master")) {
+        if (strcmp(ri->request_method, "DELETE") != 0) {
+            send_plain(c, 405, "method_not_allowed", 1);
+            free(cfg);
+            return 1;
+        }
+        int dropped = sync_master_drop_bench(app);
+        if (dropped) fprintf(stderr, "bench: dropped %d synthetic node%s\n", dropped, dropped == 1 ? "" : "s");
+        JSON_Value *v = json_value_init_object();
+        json_object_set_number(json_object(v), "dropped", dropped);
+        send_json(c, v, 200, 1);
+        json_value_free(v);
+        free(cfg);
+        return 1;
+    }
+    send_plain(c, 404, "not_found", 1);
+    free(cfg);
+    return 1;
+}
+
+void bench_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    api_set_handler(ctx, "/bench/", h_bench, app);
+}
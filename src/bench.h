@@ -0,0 +1,66 @@
+#ifndef AUTOD_BENCH_H
+#define AUTOD_BENCH_H
+
+#include "parson.h"
+#include "httpc.h"
+
+#define BENCH_MAX_ARGS 16
+#define BENCH_MAX_ERROR_KINDS 8
+#define BENCH_MAX_NODES 32         /* at most half the registry */
+
+/* Load generator behind `autod bench`, and the daemon side it cooperates
+ * with. With [bench] enable=1 a daemon answers POST /bench/echo (a request
+ * that never forks, to size the HTTP path alone), a master accepts
+ * registrations flagged "bench": true from up to max_nodes synthetic ids
+ * (never given a slot, probed or dispatched to), and DELETE /bench/nodes
+ * forgets them again. Off by default: nothing bench-related is served. */
+typedef struct {
+    int enable;
+    int max_nodes;                 /* synthetic registrations held at once (default 16) */
+} bench_config_t;
+
+typedef struct {
+    char mode[16];                 /* exec, register, echo */
+    http_url_t target;             /* daemon under test */
+    const char *exec_path;         /* exec: handler to run */
+    const char *args[BENCH_MAX_ARGS];
+    int arg_count;
+    const char *slot;              /* exec: relay through POST /http to this slot */
+    int requests;                  /* total, when duration_s is 0 */
+    int duration_s;
+    int concurrency;
+    int rate;                      /* requests per second over all workers; 0 = unpaced */
+    int nodes;                     /* register: synthetic node ids */
+    int timeout_ms;                /* per request */
+    int sleep_ms;                  /* echo: server-side delay */
+    int reply_bytes;               /* echo: reply padding */
+} bench_plan_t;
+
+typedef struct {
+    int requests;
+    int ok;
+    int failed;
+    struct { char what[32]; int count; } errors[BENCH_MAX_ERROR_KINDS];
+    int error_kinds;
+    long long elapsed_ms;
+    int samples;                   /* requests that got an HTTP reply */
+    double min_ms, p50_ms, p90_ms, p99_ms, max_ms, mean_ms;
+    int dropped;                   /* register: synthetic nodes removed afterwards, -1 = failed */
+} bench_result_t;
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_context;
+
+void bench_cfg_defaults(config_t *cfg);
+int bench_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* Run plan against its target and fill out. Returns 0, or -1 when the plan
+ * is unusable or no worker could be started. */
+int bench_run(const bench_plan_t *plan, bench_result_t *out);
+/* The result as reported by autod bench -o json. */
+JSON_Value *bench_result_json(const bench_plan_t *plan, const bench_result_t *r);
+
+void bench_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
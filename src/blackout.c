@@ -0,0 +1,593 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <ctype.h>
+#include <time.h>
+#include <signal.h>
+#include <unistd.h>
+#include <pthread.h>
+#include <fnmatch.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "events.h"
+#include "catalog.h"
+#include "profile.h"
+#include "jobs.h"
+#include "blackout.h"
+#include "caller.h"
+
+extern volatile sig_atomic_t g_stop;
+
+typedef struct {
+    unsigned long id;             /* 0 = free */
+    char path[256];
+    char *body;                   /* the /exec body, serialised */
+    char window[32];
+    char requester[64];
+    long long queued_unix;
+} blackout_queued_t;
+
+static pthread_mutex_t g_blackout_lock = PTHREAD_MUTEX_INITIALIZER;
+static blackout_queued_t g_queue[BLACKOUT_MAX_QUEUED];
+static unsigned long g_queue_next_id = 1;
+static pthread_t g_blackout_thread;
+static int g_blackout_running;
+static volatile int g_blackout_stop;
+
+static const char *k_days[7] = { "sun", "mon", "tue", "wed", "thu", "fri", "sat" };
+
+/* ---------- Config ---------- */
+
+void blackout_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->blackout, 0, sizeof(cfg->blackout));
+}
+
+static blackout_window_t *blackout_find_or_add(config_t *cfg, const char *name) {
+    for (int i = 0; i < cfg->blackout.window_count; i++) {
+        if (!strcmp(cfg->blackout.windows[i].name, name)) return &cfg->blackout.windows[i];
+    }
+    if (cfg->blackout.window_count >= BLACKOUT_MAX_WINDOWS) return NULL;
+    blackout_window_t *w = &cfg->blackout.windows[cfg->blackout.window_count++];
+    memset(w, 0, sizeof(*w));
+    snprintf(w->name, sizeof(w->name), "%s", name);
+    w->start_min = -1;
+    w->end_min = -1;
+    w->days = 0x7f;
+    w->action = BLACKOUT_REJECT;
+    return w;
+}
+
+/* "HH:MM" as minutes after midnight, or -1. */
+static int blackout_parse_hhmm(const char *s) {
+    int h = 0, m = 0;
+    char tail;
+    if (sscanf(s, "%d:%d%c", &h, &m, &tail) != 2 || h < 0 || h > 24 || m < 0 || m > 59 ||
+        (h == 24 && m != 0)) {
+        return -1;
+    }
+    return h * 60 + m;
+}
+
+static int blackout_day_index(const char *s, size_t n) {
+    for (int i = 0; i < 7; i++) {
+        if (n == 3 && !strncasecmp(s, k_days[i], 3)) return i;
+    }
+    return -1;
+}
+
+/* "mon-fri", "sat,sun", "daily" as a Sunday-first bit mask, or -1. */
+static int blackout_parse_days(const char *s) {
+    if (!strcasecmp(s, "daily") || !strcmp(s, "*")) return 0x7f;
+    char tmp[128];
+    snprintf(tmp, sizeof(tmp), "%s", s);
+    int mask = 0;
+    char *save = NULL;
+    for (char *tok = strtok_r(tmp, ", ", &save); tok; tok = strtok_r(NULL, ", ", &save)) {
+        char *dash = strchr(tok, '-');
+        int a = blackout_day_index(tok, dash ? (size_t)(dash - tok) : strlen(tok));
+        int b = dash ? blackout_day_index(dash + 1, strlen(dash + 1)) : a;
+        if (a < 0 || b < 0) return -1;
+        for (int d = a;; d = (d + 1) % 7) {
+            mask |= 1 << d;
+            if (d == b) break;
+        }
+    }
+    return mask ? mask : -1;
+}
+
+/* "YYYY-MM-DD HH:MM" (or with a T) in local time, or -1. */
+static long long blackout_parse_date(const char *s) {
+    struct tm tm;
+    memset(&tm, 0, sizeof(tm));
+    char sep, tail;
+    int n = sscanf(s, "%d-%d-%d%c%d:%d%c", &tm.tm_year, &tm.tm_mon, &tm.tm_mday, &sep,
+                   &tm.tm_hour, &tm.tm_min, &tail);
+    if (n == 3) {
+        tm.tm_hour = tm.tm_min = 0;
+    } else if (n != 6 || (sep != ' ' && sep != 'T')) {
+        return -1;
+    }
+    if (tm.tm_mon < 1 || tm.tm_mon > 12 || tm.tm_mday < 1 || tm.tm_mday > 31) return -1;
+    tm.tm_year -= 1900;
+    tm.tm_mon -= 1;
+    tm.tm_isdst = -1;
+    time_t t = mktime(&tm);
+    return t == (time_t)-1 ? -1 : (long long)t;
+}
+
+int blackout_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (strncmp(section, "blackout.", 9) != 0 || !section[9]) return 0;
+    blackout_window_t *w = blackout_find_or_add(cfg, section + 9);
+    if (!w) {
+        fprintf(stderr, "WARN: blackout window capacity reached (%d)\n", BLACKOUT_MAX_WINDOWS);
+        return 1;
+    }
+    if (!strcmp(key, "start") || !strcmp(key, "end")) {
+        int m = blackout_parse_hhmm(value);
+        if (m < 0) fprintf(stderr, "WARN: blackout %s: ignoring %s '%s' (expected HH:MM)\n", w->name, key, value);
+        else if (key[0] == 's') w->start_min = m;
+        else w->end_min = m;
+    } else if (!strcmp(key, "days")) {
+        int mask = blackout_parse_days(value);
+        if (mask < 0) fprintf(stderr, "WARN: blackout %s: ignoring days '%s' (e.g. mon-fri,sun)\n", w->name, value);
+        else w->days = mask;
+    } else if (!strcmp(key, "from") || !strcmp(key, "until")) {
+        long long t = blackout_parse_date(value);
+        if (t < 0) fprintf(stderr, "WARN: blackout %s: ignoring %s '%s' (expected YYYY-MM-DD HH:MM)\n", w->name, key, value);
+        else if (key[0] == 'f') w->from_unix = t;
+        else w->until_unix = t;
+    } else if (!strcmp(key, "nodes")) {
+        snprintf(w->nodes, sizeof(w->nodes), "%s", value);
+    } else if (!strcmp(key, "slots")) {
+        snprintf(w->slots, sizeof(w->slots), "%s", value);
+    } else if (!strcmp(key, "paths")) {
+        snprintf(w->paths, sizeof(w->paths), "%s", value);
+    } else if (!strcmp(key, "action")) {
+        if (!strcasecmp(value, "reject")) w->action = BLACKOUT_REJECT;
+        else if (!strcasecmp(value, "queue")) w->action = BLACKOUT_QUEUE;
+        else fprintf(stderr, "WARN: blackout %s: ignoring action '%s' (reject or queue)\n", w->name, value);
+    } else {
+        fprintf(stderr, "WARN: blackout %s: ignoring unknown key '%s'\n", w->name, key);
+    }
+    return 1;
+}
+
+/* ---------- Windows ---------- */
+
+static int blackout_glob_list(const char *list, const char *value, int flags) {
+    char tmp[256];
+    snprintf(tmp, sizeof(tmp), "%s", list);
+    char *save = NULL;
+    for (char *tok = strtok_r(tmp, ", ", &save); tok; tok = strtok_r(NULL, ", ", &save)) {
+        if (fnmatch(tok, value, flags) == 0) return 1;
+    }
+    return 0;
+}
+
+/* Whether the window covers now; *ends receives when it lifts. A window with
+ * neither a daily time nor a date range is never active. */
+static int blackout_window_active(const blackout_window_t *w, time_t now, long long *ends) {
+    int has_daily = w->start_min >= 0 && w->end_min >= 0;
+    int has_range = w->from_unix > 0 || w->until_unix > 0;
+    if (!has_daily && !has_range) return 0;
+    long long end = 0;
+    if (has_range) {
+        if (w->from_unix > 0 && now < w->from_unix) return 0;
+        if (w->until_unix > 0 && now >= w->until_unix) return 0;
+        end = w->until_unix;
+    }
+    if (has_daily) {
+        struct tm tm;
+        localtime_r(&now, &tm);
+        int min = tm.tm_hour * 60 + tm.tm_min;
+        int today = tm.tm_wday, yesterday = (tm.tm_wday + 6) % 7;
+        int day_offset = -1;      /* day the window ends, relative to today */
+        if (w->start_min < w->end_min) {
+            if ((w->days & (1 << today)) && min >= w->start_min && min < w->end_min) day_offset = 0;
+        } else {
+            /* Wraps past midnight (equal times: a full day). */
+            if ((w->days & (1 << today)) && min >= w->start_min) day_offset = 1;
+            else if ((w->days & (1 << yesterday)) && min < w->end_min) day_offset = 0;
+        }
+        if (day_offset < 0) return 0;
+        tm.tm_mday += day_offset;
+        tm.tm_hour = w->end_min / 60;
+        tm.tm_min = w->end_min % 60;
+        tm.tm_sec = 0;
+        tm.tm_isdst = -1;
+        long long daily_end = (long long)mktime(&tm);
+        if (!end || daily_end < end) end = daily_end;
+    }
+    if (ends) *ends = end;
+    return 1;
+}
+
+const blackout_window_t *blackout_check(app_t *app, const config_t *cfg, const char *path,
+                                        long long *ends_unix) {
+    if (!cfg || !path || cfg->blackout.window_count == 0) return NULL;
+    char opt[16];
+    if (catalog_option_for(cfg, path, "blackout", opt, sizeof(opt)) == 0 && !strcmp(opt, "exempt")) {
+        return NULL;
+    }
+    int slot = app ? sync_slave_get_current_slot(&app->slave) : 0;
+    char slot_num[16], slot_label[64] = "";
+    snprintf(slot_num, sizeof(slot_num), "%d", slot);
+    if (app && slot > 0) sync_slave_get_current_slot_label(&app->slave, slot_label, sizeof(slot_label));
+    time_t now = time(NULL);
+    for (int i = 0; i < cfg->blackout.window_count; i++) {
+        const blackout_window_t *w = &cfg->blackout.windows[i];
+        if (w->nodes[0] && !blackout_glob_list(w->nodes, cfg->sync_id, 0)) continue;
+        if (w->slots[0] && (slot <= 0 || (!blackout_glob_list(w->slots, slot_num, 0) &&
+                                          !(slot_label[0] && blackout_glob_list(w->slots, slot_label, 0))))) {
+            continue;
+        }
+        if (w->paths[0] && !blackout_glob_list(w->paths, path, FNM_PATHNAME)) continue;
+        if (blackout_window_active(w, now, ends_unix)) return w;
+    }
+    return NULL;
+}
+
+/* ---------- Gate ---------- */
+
+void blackout_emit(const char *path, const char *window, const char *outcome,
+                   const char *requester, unsigned long queue_id) {
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_string(eo, "path", path);
+    json_object_set_string(eo, "window", window);
+    json_object_set_string(eo, "outcome", outcome);
+    if (requester) json_object_set_string(eo, "requester", requester);
+    if (queue_id) json_object_set_number(eo, "queue_id", (double)queue_id);
+    (void)events_emit("exec_blackout", ev);
+}
+
+static unsigned long blackout_enqueue(const char *path, JSON_Object *body, const char *window,
+                                      const char *requester) {
+    char *s = json_serialize_to_string(json_object_get_wrapping_value(body));
+    if (!s) return 0;
+    unsigned long id = 0;
+    pthread_mutex_lock(&g_blackout_lock);
+    for (int i = 0; i < BLACKOUT_MAX_QUEUED; i++) {
+        blackout_queued_t *q = &g_queue[i];
+        if (q->id) continue;
+        id = q->id = g_queue_next_id++;
+        snprintf(q->path, sizeof(q->path), "%s", path);
+        q->body = strdup(s);
+        snprintf(q->window, sizeof(q->window), "%s", window);
+        snprintf(q->requester, sizeof(q->requester), "%s", requester ? requester : "");
+        q->queued_unix = (long long)time(NULL);
+        break;
+    }
+    pthread_mutex_unlock(&g_blackout_lock);
+    json_free_serialized_string(s);
+    return id;
+}
+
+int blackout_override(struct mg_connection *c, const config_t *cfg, JSON_Object *body,
+                      const char *path, const blackout_window_t *w) {
+    if (json_object_get_boolean(body, "override_blackout") != 1) return 0;
+    if (!admin_authorize(c, cfg)) return -1;
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    const char *requester = ri ? ri->remote_addr : NULL;
+    fprintf(stderr, "blackout %s: %s overridden by %s (request %s)\n", w->name, path,
+            requester ? requester : "?", api_request_id());
+    blackout_emit(path, w->name, "overridden", requester, 0);
+    return 1;
+}
+
+static void blackout_set_window(JSON_Object *o, const blackout_window_t *w, const char *path,
+                                long long ends) {
+    json_object_set_string(o, "window", w->name);
+    json_object_set_string(o, "path", path);
+    if (ends > 0) {
+        json_object_set_number(o, "ends_unix", (double)ends);
+        long long left = ends - (long long)time(NULL);
+        json_object_set_number(o, "retry_after_s", (double)(left > 0 ? left : 0));
+    }
+}
+
+void blackout_send_blocked(struct mg_connection *c, const blackout_window_t *w, const char *path,
+                           long long ends) {
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    blackout_emit(path, w->name, "rejected", ri ? ri->remote_addr : NULL, 0);
+    JSON_Value *v = json_value_init_object();
+    json_object_set_string(json_object(v), "error", "blackout");
+    blackout_set_window(json_object(v), w, path, ends);
+    send_json(c, v, 423, 1);
+    json_value_free(v);
+}
+
+int blackout_gate_exec(struct mg_connection *c, app_t *app, const config_t *cfg,
+                       const char *path, JSON_Object *body) {
+    long long ends = 0;
+    const blackout_window_t *w = blackout_check(app, cfg, path, &ends);
+    if (!w) return 0;
+    int ov = blackout_override(c, cfg, body, path, w);
+    if (ov) return ov < 0;
+    if (w->action != BLACKOUT_QUEUE) {
+        blackout_send_blocked(c, w, path, ends);
+        return 1;
+    }
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    const char *requester = ri ? ri->remote_addr : NULL;
+    /* Held requests do not carry the override or confirmation again. */
+    json_object_remove(body, "override_blackout");
+    json_object_remove(body, "confirm_token");
+    if (!json_object_get_string(body, "request_id")) {
+        json_object_set_string(body, "request_id", api_request_id());
+    }
+    /* The identity is the one this request proved, never one the body names. */
+    json_object_set_string(body, "caller", caller_name());
+    json_object_set_string(body, "caller_role", caller_role());
+    unsigned long id = blackout_enqueue(path, body, w->name, requester);
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    int status = 423;
+    if (id) {
+        json_object_set_string(o, "status", "queued");
+        json_object_set_number(o, "queue_id", (double)id);
+        status = 202;
+        blackout_emit(path, w->name, "queued", requester, id);
+    } else {
+        json_object_set_string(o, "error", "blackout_queue_full");
+    }
+    blackout_set_window(o, w, path, ends);
+    send_json(c, v, status, 1);
+    json_value_free(v);
+    return 1;
+}
+
+/* ---------- Held requests ---------- */
+
+static void blackout_run_queued(const config_t *cfg, blackout_queued_t *q) {
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_number(eo, "queue_id", (double)q->id);
+    json_object_set_string(eo, "path", q->path);
+    json_object_set_string(eo, "window", q->window);
+
+    JSON_Value *root = json_parse_string(q->body ? q->body : "");
+    JSON_Object *o = json_object(root);
+    api_set_request_id(json_object_get_string(o, "request_id"));
+    const char *role = json_object_get_string(o, "caller_role");
+    caller_set(json_object_get_string(o, "caller"), role ? role : "anonymous");
+    const char *profile_name = json_object_get_string(o, "profile");
+    const exec_profile_t *profile = profile_select(cfg, q->path, profile_name, NULL);
+    if (!root) {
+        json_object_set_string(eo, "error", "bad_json");
+    } else if (!catalog_allows(cfg, q->path)) {
+        json_object_set_string(eo, "error", "command_not_allowed");
+    } else {
+        JSON_Array *args = json_object_get_array(o, "args");
+        int rc = 0;
+        long long elapsed = 0;
+        char *out = NULL, *err = NULL;
+        size_t out_len = 0, err_len = 0;
+        exec_usage_t usage;
+        int r = run_exec(cfg, q->path, args, cfg->exec_timeout_ms, cfg->max_output_bytes, profile,
+                         json_object_get_string(o, "request_id"), &rc, &elapsed, &out, &err,
+                         &out_len, &err_len, &usage);
+        jobs_record_t jr = {
+            .node = cfg->sync_id, .source = "deferred", .requester = q->requester,
+            .caller = caller_name(), .caller_role = caller_role(),
+            .request_id = api_request_id(), .path = q->path, .args = args, .job_id = usage.job_id,
+            .spawned = r == 0, .canceled = r == 0 && usage.canceled,
+            .rc = rc, .elapsed_ms = elapsed,
+            .out = out, .out_len = out_len, .err = err, .err_len = err_len
+        };
+        jobs_store_record(&jr);
+        if (r != 0) {
+            json_object_set_string(eo, "error", r == EXEC_ERR_NOT_FOUND ? "binary_not_found" :
+                                                r == EXEC_ERR_CAPACITY ? "jobs_full" :
+                                                r == EXEC_ERR_INTEGRITY ? "integrity_mismatch" : "spawn_failed");
+        } else {
+            json_object_set_number(eo, "rc", rc);
+            json_object_set_number(eo, "elapsed_ms", (double)elapsed);
+            if (usage.job_id) json_object_set_number(eo, "job_id", (double)usage.job_id);
+        }
+        fprintf(stderr, "blackout %s: ran held command %s (queue id %lu, request %s)\n",
+                q->window, q->path, q->id, api_request_id());
+        free(out);
+        free(err);
+    }
+    if (root) json_value_free(root);
+    (void)events_emit("exec_deferred", ev);
+    api_set_request_id(NULL);
+    caller_set(NULL, NULL);
+}
+
+static void *blackout_thread_main(void *arg) {
+    app_t *app = (app_t *)arg;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) return NULL;
+    while (!g_blackout_stop && !g_stop) {
+        sleep(1);
+        app_config_snapshot(app, cfg);
+        /* Take one lifted request at a time so the lock is not held while it runs. */
+        for (;;) {
+            blackout_queued_t item;
+            int found = 0;
+            pthread_mutex_lock(&g_blackout_lock);
+            for (int i = 0; i < BLACKOUT_MAX_QUEUED && !found; i++) {
+                if (!g_queue[i].id || blackout_check(app, cfg, g_queue[i].path, NULL)) continue;
+                item = g_queue[i];
+                memset(&g_queue[i], 0, sizeof(g_queue[i]));
+                found = 1;
+            }
+            pthread_mutex_unlock(&g_blackout_lock);
+            if (!found || g_blackout_stop || g_stop) {
+                if (found) free(item.body);
+                break;
+            }
+            blackout_run_queued(cfg, &item);
+            free(item.body);
+        }
+    }
+    free(cfg);
+    return NULL;
+}
+
+int blackout_start_thread(app_t *app) {
+    if (!app) return -1;
+    pthread_mutex_lock(&g_blackout_lock);
+    g_blackout_stop = 0;
+    if (g_blackout_running) {
+        pthread_mutex_unlock(&g_blackout_lock);
+        return 0;
+    }
+    if (pthread_create(&g_blackout_thread, NULL, blackout_thread_main, app) == 0) {
+        g_blackout_running = 1;
+        pthread_mutex_unlock(&g_blackout_lock);
+        return 0;
+    }
+    pthread_mutex_unlock(&g_blackout_lock);
+    fprintf(stderr, "WARN: failed to start blackout queue thread\n");
+    return -1;
+}
+
+void blackout_stop_thread(void) {
+    pthread_mutex_lock(&g_blackout_lock);
+    g_blackout_stop = 1;
+    int running = g_blackout_running;
+    pthread_mutex_unlock(&g_blackout_lock);
+    if (running) {
+        pthread_join(g_blackout_thread, NULL);
+        pthread_mutex_lock(&g_blackout_lock);
+        g_blackout_running = 0;
+        pthread_mutex_unlock(&g_blackout_lock);
+    }
+}
+
+/* ---------- HTTP ---------- */
+
+static void blackout_send_status(struct mg_connection *c, const config_t *cfg) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    JSON_Value *wv = json_value_init_array();
+    time_t now = time(NULL);
+    for (int i = 0; i < cfg->blackout.window_count; i++) {
+        const blackout_window_t *w = &cfg->blackout.windows[i];
+        JSON_Value *item = json_value_init_object();
+        JSON_Object *io = json_object(item);
+        json_object_set_string(io, "name", w->name);
+        json_object_set_string(io, "action", w->action == BLACKOUT_QUEUE ? "queue" : "reject");
+        if (w->start_min >= 0 && w->end_min >= 0) {
+            char buf[16];
+            snprintf(buf, sizeof(buf), "%02d:%02d", w->start_min / 60, w->start_min % 60);
+            json_object_set_string(io, "start", buf);
+            snprintf(buf, sizeof(buf), "%02d:%02d", w->end_min / 60, w->end_min % 60);
+            json_object_set_string(io, "end", buf);
+            JSON_Value *dv = json_value_init_array();
+            for (int d = 0; d < 7; d++) {
+                if (w->days & (1 << d)) json_array_append_string(json_array(dv), k_days[d]);
+            }
+            json_object_set_value(io, "days", dv);
+        }
+        if (w->from_unix > 0) json_object_set_number(io, "from_unix", (double)w->from_unix);
+        if (w->until_unix > 0) json_object_set_number(io, "until_unix", (double)w->until_unix);
+        if (w->nodes[0]) json_object_set_string(io, "nodes", w->nodes);
+        if (w->slots[0]) json_object_set_string(io, "slots", w->slots);
+        if (w->paths[0]) json_object_set_string(io, "paths", w->paths);
+        long long ends = 0;
+        int active = blackout_window_active(w, now, &ends);
+        json_object_set_boolean(io, "active", active);
+        if (active && ends > 0) json_object_set_number(io, "ends_unix", (double)ends);
+        json_array_append_value(json_array(wv), item);
+    }
+    json_object_set_value(o, "windows", wv);
+
+    JSON_Value *qv = json_value_init_array();
+    pthread_mutex_lock(&g_blackout_lock);
+    for (int i = 0; i < BLACKOUT_MAX_QUEUED; i++) {
+        const blackout_queued_t *q = &g_queue[i];
+        if (!q->id) continue;
+        JSON_Value *item = json_value_init_object();
+        JSON_Object *io = json_object(item);
+        json_object_set_number(io, "id", (double)q->id);
+        json_object_set_string(io, "path", q->path);
+        json_object_set_string(io, "window", q->window);
+        json_object_set_string(io, "requester", q->requester);
+        json_object_set_number(io, "queued_unix", (double)q->queued_unix);
+        json_array_append_value(json_array(qv), item);
+    }
+    pthread_mutex_unlock(&g_blackout_lock);
+    json_object_set_value(o, "queued", qv);
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+}
+
+/*
+ * GET    /blackout             — configured windows and held requests
+ * DELETE /blackout/queue/{id}  — drop a held request
+ */
+static int h_blackout(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri) {
+        free(cfg);
+        return 0;
+    }
+    const char *uri = api_local_uri(c);
+    if (!strcmp(uri, "/blackout") || !strcmp(uri, "/blackout/")) {
+        if (strcmp(ri->request_method, "GET") != 0) {
+            send_plain(c, 405, "method_not_allowed", 1);
+            free(cfg);
+            return 1;
+        }
+        blackout_send_status(c, cfg);
+        free(cfg);
+        return 1;
+    }
+    if (strncmp(uri, "/blackout/queue/", 16) != 0 || !isdigit((unsigned char)uri[16])) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    if (strcmp(ri->request_method, "DELETE") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+    unsigned long id = strtoul(uri + 16, NULL, 10);
+    blackout_queued_t dropped;
+    int found = 0;
+    pthread_mutex_lock(&g_blackout_lock);
+    for (int i = 0; i < BLACKOUT_MAX_QUEUED; i++) {
+        if (g_queue[i].id != id) continue;
+        dropped = g_queue[i];
+        memset(&g_queue[i], 0, sizeof(g_queue[i]));
+        found = 1;
+        break;
+    }
+    pthread_mutex_unlock(&g_blackout_lock);
+    if (!found) {
+        send_json_error(c, 404, "unknown_queue_id");
+        free(cfg);
+        return 1;
+    }
+    free(dropped.body);
+    blackout_emit(dropped.path, dropped.window, "dropped", ri->remote_addr, id);
+    JSON_Value *v = json_value_init_object();
+    json_object_set_string(json_object(v), "status", "dropped");
+    json_object_set_number(json_object(v), "queue_id", (double)id);
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+    free(cfg);
+    return 1;
+}
+
+void blackout_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    api_set_handler(ctx, "/blackout", h_blackout, app);
+}
@@ -0,0 +1,74 @@
+#ifndef AUTOD_BLACKOUT_H
+#define AUTOD_BLACKOUT_H
+
+#include "parson.h"
+
+#define BLACKOUT_MAX_WINDOWS 8
+#define BLACKOUT_MAX_QUEUED 16
+
+enum { BLACKOUT_REJECT, BLACKOUT_QUEUE };
+
+/* [blackout.NAME] — periods during which exec requests and reboot/shutdown
+ * on this node are refused (or held until the period ends). A window is a
+ * daily start-end time (optionally on some days), a from-until date range,
+ * or both; nodes/slots/paths narrow it to some nodes and commands. */
+typedef struct {
+    char name[32];
+    int  start_min;               /* minutes after local midnight; -1 = no daily window */
+    int  end_min;                 /* end <= start wraps past midnight */
+    int  days;                    /* bit 0 = Sunday .. bit 6 = Saturday */
+    long long from_unix;          /* 0 = no date range */
+    long long until_unix;
+    char nodes[128];              /* sync id globs (empty = every node) */
+    char slots[128];              /* slot numbers or name globs (empty = any) */
+    char paths[256];              /* exec path globs (empty = every command) */
+    int  action;                  /* BLACKOUT_REJECT | BLACKOUT_QUEUE */
+} blackout_window_t;
+
+typedef struct {
+    blackout_window_t windows[BLACKOUT_MAX_WINDOWS];
+    int window_count;
+} blackout_config_t;
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_context;
+struct mg_connection;
+
+void blackout_cfg_defaults(config_t *cfg);
+int blackout_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* The window that blocks path on this node right now (NULL when none) and,
+ * in *ends_unix, when it lifts. Catalog entries marked " blackout=exempt"
+ * are never blocked. */
+const blackout_window_t *blackout_check(app_t *app, const config_t *cfg, const char *path,
+                                        long long *ends_unix);
+
+/* Gate an exec request for path: with no window active returns 0. An active
+ * window is bypassed by "override_blackout": true from an admin (the token
+ * check may answer the request), otherwise the request is refused with 423
+ * or, for a queue window, body is held and run once the window lifts (202).
+ * Returns 1 whenever a response was sent. */
+int blackout_gate_exec(struct mg_connection *c, app_t *app, const config_t *cfg,
+                       const char *path, JSON_Object *body);
+
+/* "override_blackout": true in body: 1 when an admin sent it, -1 when the
+ * token check refused it (a response was sent), 0 when it is absent. Logs
+ * and emits the override. */
+int blackout_override(struct mg_connection *c, const config_t *cfg, JSON_Object *body,
+                      const char *path, const blackout_window_t *w);
+
+/* 423 {"error":"blackout", window, ends_unix, retry_after_s}. */
+void blackout_send_blocked(struct mg_connection *c, const blackout_window_t *w, const char *path,
+                           long long ends_unix);
+
+/* exec_blackout event; outcome is rejected, queued, overridden or dropped. */
+void blackout_emit(const char *path, const char *window, const char *outcome,
+                   const char *requester, unsigned long queue_id);
+
+int blackout_start_thread(app_t *app);
+void blackout_stop_thread(void);
+
+void blackout_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
@@ -0,0 +1,240 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <pthread.h>
+
+#include "parson.h"
+#include "autod.h"
+#include "events.h"
+#include "breaker.h"
+
+#define BREAKER_MAX_NODES 128
+#define BREAKER_PROBE_TIMEOUT_MS 60000   /* a probe place not given back is free again */
+
+typedef struct {
+    char node[64];
+    int failures;             /* unanswered dispatches in a row */
+    int open;                 /* open, or half-open once retry_ms has passed */
+    int cooldown_s;           /* the current open period */
+    long long opened_ms;      /* start of this outage */
+    long long retry_ms;       /* half-open from here on */
+    int probes;               /* probes out while half-open */
+    long long probe_ms;       /* last probe place taken */
+    long long used_ms;        /* last dispatch, to pick a record to reuse */
+} breaker_entry_t;
+
+static pthread_mutex_t g_breaker_lock = PTHREAD_MUTEX_INITIALIZER;
+static breaker_entry_t g_breakers[BREAKER_MAX_NODES];
+static unsigned long g_breaker_version;
+static int g_breaker_open;    /* circuits open or half-open */
+
+void breaker_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    cfg->breaker.failures = 3;
+    cfg->breaker.cooldown_s = 10;
+    cfg->breaker.max_cooldown_s = 120;
+    cfg->breaker.half_open_probes = 1;
+}
+
+int breaker_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (strcmp(section, "breaker") != 0) return 0;
+    breaker_config_t *b = &cfg->breaker;
+    char *end = NULL;
+    long v = strtol(value, &end, 10);
+    int valid = end && end != value && !*end;
+    int *field = NULL;
+    long lo = 0, hi = 0;
+    if (!strcmp(key, "failures")) {
+        field = &b->failures; lo = 0; hi = 100;
+    } else if (!strcmp(key, "cooldown_s")) {
+        field = &b->cooldown_s; lo = 1; hi = 3600;
+    } else if (!strcmp(key, "max_cooldown_s")) {
+        field = &b->max_cooldown_s; lo = 1; hi = 86400;
+    } else if (!strcmp(key, "half_open_probes")) {
+        field = &b->half_open_probes; lo = 1; hi = 16;
+    } else {
+        fprintf(stderr, "WARN: ignoring unknown breaker key '%s'\n", key);
+        return 1;
+    }
+    if (!valid || v < lo || v > hi) {
+        fprintf(stderr, "WARN: breaker: ignoring %s '%s' (%ld-%ld)\n", key, value, lo, hi);
+    } else {
+        *field = (int)v;
+    }
+    return 1;
+}
+
+/* Caller holds g_breaker_lock. With create, a missing node takes a free
+ * record, or the closed one used longest ago. */
+static breaker_entry_t *breaker_find_locked(const char *node, int create) {
+    breaker_entry_t *spare = NULL;
+    for (int i = 0; i < BREAKER_MAX_NODES; i++) {
+        breaker_entry_t *e = &g_breakers[i];
+        if (e->node[0] && !strcmp(e->node, node)) return e;
+        if (!create) continue;
+        if (!e->node[0]) {
+            if (!spare || spare->node[0]) spare = e;
+        } else if (!e->open && (!spare || (spare->node[0] && e->used_ms < spare->used_ms))) {
+            spare = e;
+        }
+    }
+    if (!spare) return NULL;
+    memset(spare, 0, sizeof(*spare));
+    snprintf(spare->node, sizeof(spare->node), "%s", node);
+    return spare;
+}
+
+static int breaker_enabled(const breaker_config_t *bc, const char *node) {
+    return bc && bc->failures > 0 && node && *node;
+}
+
+int breaker_allow(const breaker_config_t *bc, const char *node, int *retry_after_s) {
+    if (retry_after_s) *retry_after_s = 0;
+    if (!breaker_enabled(bc, node)) return 0;
+    long long now = now_ms();
+    pthread_mutex_lock(&g_breaker_lock);
+    breaker_entry_t *e = breaker_find_locked(node, 0);
+    if (!e || !e->open) {
+        pthread_mutex_unlock(&g_breaker_lock);
+        return 0;
+    }
+    int allowed = 0;
+    if (now >= e->retry_ms) {
+        int places = bc->half_open_probes > 0 ? bc->half_open_probes : 1;
+        if (e->probes > 0 && now - e->probe_ms >= BREAKER_PROBE_TIMEOUT_MS) e->probes = 0;
+        if (e->probes < places) {
+            e->probes++;
+            e->probe_ms = now;
+            g_breaker_version++;
+            allowed = 1;
+        } else if (retry_after_s) {
+            *retry_after_s = 1;
+        }
+    } else if (retry_after_s) {
+        *retry_after_s = (int)((e->retry_ms - now + 999) / 1000);
+    }
+    pthread_mutex_unlock(&g_breaker_lock);
+    return allowed ? 0 : -1;
+}
+
+int breaker_is_open(const breaker_config_t *bc, const char *node) {
+    if (!breaker_enabled(bc, node)) return 0;
+    long long now = now_ms();
+    pthread_mutex_lock(&g_breaker_lock);
+    breaker_entry_t *e = breaker_find_locked(node, 0);
+    int open = e && e->open && now < e->retry_ms;
+    pthread_mutex_unlock(&g_breaker_lock);
+    return open;
+}
+
+static void breaker_event(const char *type, const char *node, int failures, int cooldown_s,
+                          long long open_ms) {
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_string(eo, "id", node);
+    json_object_set_number(eo, "failures", failures);
+    if (!strcmp(type, "circuit_opened")) {
+        json_object_set_number(eo, "cooldown_s", cooldown_s);
+        if (open_ms > 0) json_object_set_number(eo, "open_s", (double)(open_ms / 1000));
+    } else {
+        json_object_set_number(eo, "open_s", (double)(open_ms / 1000));
+    }
+    (void)events_emit(type, ev);
+}
+
+void breaker_note(const breaker_config_t *bc, const char *node, int answered) {
+    if (!breaker_enabled(bc, node)) return;
+    long long now = now_ms();
+    char name[64];
+    snprintf(name, sizeof(name), "%s", node);
+    pthread_mutex_lock(&g_breaker_lock);
+    /* Answers only matter to nodes that have a record. */
+    breaker_entry_t *e = breaker_find_locked(name, !answered);
+    if (!e) {
+        pthread_mutex_unlock(&g_breaker_lock);
+        return;
+    }
+    e->used_ms = now;
+    if (answered) {
+        int was_open = e->open;
+        int failures = e->failures;
+        long long open_ms = now - e->opened_ms;
+        if (failures || was_open) g_breaker_version++;
+        if (was_open) g_breaker_open--;
+        e->failures = 0;
+        e->open = 0;
+        e->probes = 0;
+        e->cooldown_s = 0;
+        pthread_mutex_unlock(&g_breaker_lock);
+        if (was_open) {
+            fprintf(stderr, "breaker: %s answered, circuit closed after %llds\n", name, open_ms / 1000);
+            breaker_event("circuit_closed", name, failures, 0, open_ms);
+        }
+        return;
+    }
+
+    e->failures++;
+    g_breaker_version++;
+    int opened = 0;
+    long long open_ms = 0;
+    if (!e->open && e->failures >= bc->failures) {
+        e->open = 1;
+        e->cooldown_s = bc->cooldown_s > 0 ? bc->cooldown_s : 1;
+        e->opened_ms = now;
+        e->retry_ms = now + (long long)e->cooldown_s * 1000;
+        e->probes = 0;
+        g_breaker_open++;
+        opened = 1;
+    } else if (e->open && now >= e->retry_ms) {
+        /* A half-open probe failed: back off for longer. */
+        int longest = bc->max_cooldown_s > 0 ? bc->max_cooldown_s : e->cooldown_s;
+        e->cooldown_s = e->cooldown_s * 2 > longest ? longest : e->cooldown_s * 2;
+        if (e->cooldown_s < 1) e->cooldown_s = 1;
+        e->retry_ms = now + (long long)e->cooldown_s * 1000;
+        if (e->probes > 0) e->probes--;
+        open_ms = now - e->opened_ms;
+        opened = 1;
+    }
+    int failures = e->failures;
+    int cooldown_s = e->cooldown_s;
+    pthread_mutex_unlock(&g_breaker_lock);
+    if (opened) {
+        fprintf(stderr, "WARN: breaker: %s failed %d dispatches in a row, circuit open for %ds\n",
+                name, failures, cooldown_s);
+        breaker_event("circuit_opened", name, failures, cooldown_s, open_ms);
+    }
+}
+
+JSON_Value *breaker_state_json(const char *node) {
+    if (!node || !*node) return NULL;
+    long long now = now_ms();
+    pthread_mutex_lock(&g_breaker_lock);
+    breaker_entry_t *e = breaker_find_locked(node, 0);
+    if (!e || (!e->open && !e->failures)) {
+        pthread_mutex_unlock(&g_breaker_lock);
+        return NULL;
+    }
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    const char *state = !e->open ? "closed" : now < e->retry_ms ? "open" : "half_open";
+    json_object_set_string(o, "state", state);
+    json_object_set_number(o, "failures", e->failures);
+    if (e->open) {
+        json_object_set_number(o, "cooldown_s", e->cooldown_s);
+        json_object_set_number(o, "open_s", (double)((now - e->opened_ms) / 1000));
+        if (now < e->retry_ms) {
+            json_object_set_number(o, "retry_after_s", (double)((e->retry_ms - now + 999) / 1000));
+        }
+    }
+    pthread_mutex_unlock(&g_breaker_lock);
+    return v;
+}
+
+unsigned long breaker_version(void) {
+    pthread_mutex_lock(&g_breaker_lock);
+    unsigned long v = g_breaker_version;
+    if (g_breaker_open > 0) v += (unsigned long)(now_ms() / 1000) << 16;
+    pthread_mutex_unlock(&g_breaker_lock);
+    return v;
+}
@@ -0,0 +1,45 @@
+#ifndef AUTOD_BREAKER_H
+#define AUTOD_BREAKER_H
+
+#include "parson.h"
+
+/* [breaker] — per-node circuit breaker on the dispatch path (/http relays
+ * and broadcasts). Once `failures` dispatches in a row to a node got no
+ * answer, its circuit opens: requests for it fail fast, or go to another
+ * node when the target leaves a choice, for cooldown_s. The circuit is then
+ * half-open and lets half_open_probes requests through; an answer closes
+ * it, a failure opens it again for twice as long (up to max_cooldown_s).
+ * Continually hammering a dead node adds its connect timeout to every
+ * caller, long before quarantine takes it out of routing. */
+typedef struct {
+    int failures;             /* unanswered dispatches in a row that open it (0 = off) */
+    int cooldown_s;           /* first open period */
+    int max_cooldown_s;       /* longest open period after failed probes */
+    int half_open_probes;     /* requests let through at once while half-open */
+} breaker_config_t;
+
+typedef struct config config_t;
+
+void breaker_cfg_defaults(config_t *cfg);
+int breaker_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* Whether a dispatch to node (its sync id, or address without one) may go
+ * out. Returns 0 when it may, taking a probe place while the circuit is
+ * half-open, or -1 with *retry_after_s set while it is open. */
+int breaker_allow(const breaker_config_t *bc, const char *node, int *retry_after_s);
+
+/* Whether node's circuit turns requests away now, for routing choices
+ * (takes no probe place). */
+int breaker_is_open(const breaker_config_t *bc, const char *node);
+
+/* Report whether a dispatch to node got an answer (any HTTP response). */
+void breaker_note(const breaker_config_t *bc, const char *node, int answered);
+
+/* node's circuit for /nodes, or NULL while it is closed without failures. */
+JSON_Value *breaker_state_json(const char *node);
+
+/* Changes whenever a circuit changes, and every second while one is open
+ * (for response caches). */
+unsigned long breaker_version(void);
+
+#endif
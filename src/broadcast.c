@@ -0,0 +1,1279 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <errno.h>
+#include <time.h>
+#include <pthread.h>
+#include <regex.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "version.h"
+#include "cluster.h"
+#include "httpc.h"
+#include "dnscache.h"
+#include "confirm.h"
+#include "caller.h"
+#include "jsonq.h"
+#include "broadcast.h"
+
+#define BROADCAST_GRACE_MS 2000
+#define BROADCAST_KEEPALIVE_MS 1000
+#define BROADCAST_CANCEL_TIMEOUT_MS 2000
+#define BROADCAST_DIFF_LINES 400
+#define BROADCAST_DIFF_MAX 4096
+#define BROADCAST_SAMPLE_MAX 2048
+
+typedef struct broadcast_run broadcast_run_t;
+
+typedef struct {
+    sync_node_addr_t node;
+    const char *skip;          /* reason the node was not contacted */
+    char lease_holder[64];     /* with skip = "slot_leased" */
+    int http_status;           /* -1 transport error, -2 name did not resolve */
+    const char *failure;       /* with -1: httpc_last_error() */
+    char address[16];          /* IPv4 address actually contacted */
+    char *resp;
+    long long elapsed_ms;
+    int canary;                /* run in the first wave */
+    int launched;
+    int reported;              /* result line written */
+    int passed;                /* canary: met the success predicate */
+    char *body;                /* run body with the node's slot env and params, or NULL */
+    char *compared;            /* compare: normalized stdout of a 200 reply, or NULL */
+    int compared_rc;
+    broadcast_run_t *run;
+} broadcast_item_t;
+
+/* Shared between the streaming handler and the per-node workers. Workers
+ * that outlive the handler's deadline still hold a reference, so the last
+ * one out frees it. */
+struct broadcast_run {
+    pthread_mutex_t lock;
+    pthread_cond_t cond;
+    int refs;
+    char *body;
+    char request_id[AUTOD_REQUEST_ID_MAX];  /* the broadcast's X-Request-ID, also for POST /jobs/cancel */
+    char caller[CALLER_NAME_MAX];           /* who asked, vouched for to each enrolled node */
+    char caller_role[16];
+    int timeout_ms;            /* total deadline per node */
+    int connect_timeout_ms;
+    int dns_ttl_s;
+    breaker_config_t breaker;  /* circuit breaker settings at the start of the run */
+    int confirmed;             /* answer the nodes' own confirmation prompts */
+    broadcast_item_t *items;
+    int count;
+    int *done;                 /* item indexes in completion order */
+    int done_count;
+};
+
+static void broadcast_run_release_locked(broadcast_run_t *run) {
+    if (--run->refs > 0) {
+        pthread_mutex_unlock(&run->lock);
+        return;
+    }
+    pthread_mutex_unlock(&run->lock);
+    for (int i = 0; i < run->count; i++) {
+        free(run->items[i].resp);
+        free(run->items[i].compared);
+        if (run->items[i].body) json_free_serialized_string(run->items[i].body);
+    }
+    free(run->items);
+    free(run->done);
+    json_free_serialized_string(run->body);
+    pthread_cond_destroy(&run->cond);
+    pthread_mutex_destroy(&run->lock);
+    free(run);
+}
+
+/* What is sent to the item's node. */
+static const char *broadcast_item_body(const broadcast_item_t *item) {
+    return item->body ? item->body : item->run->body;
+}
+
+static int broadcast_confirm_node(const http_url_t *url, const broadcast_item_t *item,
+                                  const char *relay_hdr, char **resp) {
+    broadcast_run_t *run = item->run;
+    const char *node_id = item->node.id;
+    JSON_Value *prompt = *resp ? json_parse_string(*resp) : NULL;
+    const char *token = json_object_get_string(json_object(prompt), "confirm_token");
+    JSON_Value *body = token ? json_parse_string(broadcast_item_body(item)) : NULL;
+    char *s = NULL;
+    if (body) {
+        json_object_set_string(json_object(body), "confirm_token", token);
+        s = json_serialize_to_string(body);
+        json_value_free(body);
+    }
+    json_value_free(prompt);
+    if (!s) return 428;
+    free(*resp);
+    *resp = NULL;
+    char caller_hdr[CALLER_HEADER_MAX + GATEWAY_HEADER_MAX];
+    caller_sign_header(node_id, s, strlen(s), caller_hdr, sizeof(caller_hdr));
+    strncat(caller_hdr, relay_hdr, sizeof(caller_hdr) - strlen(caller_hdr) - 1);
+    int status = httpc_send_json("POST", url, caller_hdr, s, resp, NULL, run->timeout_ms);
+    json_free_serialized_string(s);
+    return status;
+}
+
+static void *broadcast_worker(void *arg) {
+    broadcast_item_t *item = (broadcast_item_t *)arg;
+    broadcast_run_t *run = item->run;
+    api_set_request_id(run->request_id);
+    caller_set(run->caller, run->caller_role);
+    httpc_set_connect_timeout(run->connect_timeout_ms);
+    char caller_hdr[CALLER_HEADER_MAX + GATEWAY_HEADER_MAX];
+    const char *body = broadcast_item_body(item);
+    caller_sign_header(item->node.id, body, strlen(body), caller_hdr, sizeof(caller_hdr));
+    char relay_hdr[GATEWAY_HEADER_MAX];
+    http_url_t url;
+    (void)gateway_route(&item->node, AUTOD_PEER_PREFIX "/exec", run->timeout_ms, &url, relay_hdr, sizeof(relay_hdr));
+    strncat(caller_hdr, relay_hdr, sizeof(caller_hdr) - strlen(caller_hdr) - 1);
+    char host[128];
+    snprintf(host, sizeof(host), "%s", url.host);
+
+    long long t0 = now_ms();
+    char *resp = NULL;
+    char address[16] = "";
+    int status = -2;
+    const char *failure = NULL;
+    /* A node known by name gets one more try when its cached address stopped
+     * answering and the name now points somewhere else. */
+    for (int attempt = 0; attempt < 2; attempt++) {
+        char fresh[16];
+        if (dnscache_resolve(host, run->dns_ttl_s, fresh, sizeof(fresh)) != 0) break;
+        if (attempt > 0 && strcmp(fresh, address) == 0) break;
+        strncpy(address, fresh, sizeof(address) - 1);
+        strncpy(url.host, address, sizeof(url.host) - 1);
+        status = httpc_send_json("POST", &url, caller_hdr, body, &resp, NULL, run->timeout_ms);
+        if (status == 428 && run->confirmed) {
+            /* The operator confirmed on the master; redeem the node's token. */
+            status = broadcast_confirm_node(&url, item, relay_hdr, &resp);
+        }
+        failure = status < 0 ? httpc_last_error() : NULL;
+        if (status >= 0 || !dnscache_is_hostname(host) ||
+            now_ms() - t0 >= run->timeout_ms) {
+            break;
+        }
+        dnscache_forget(host);
+    }
+
+    pthread_mutex_lock(&run->lock);
+    strncpy(item->address, address, sizeof(item->address) - 1);
+    item->http_status = status;
+    item->failure = failure;
+    item->resp = resp;
+    item->elapsed_ms = now_ms() - t0;
+    run->done[run->done_count++] = (int)(item - run->items);
+    pthread_cond_broadcast(&run->cond);
+    broadcast_run_release_locked(run);
+    return NULL;
+}
+
+/* The client went away: ask a node still running the command to kill it. */
+static void *broadcast_cancel_worker(void *arg) {
+    broadcast_item_t *item = (broadcast_item_t *)arg;
+    broadcast_run_t *run = item->run;
+    api_set_request_id(run->request_id);
+    http_url_t url;
+    char relay_hdr[GATEWAY_HEADER_MAX];
+    (void)gateway_route(&item->node, AUTOD_PEER_PREFIX "/jobs/cancel", BROADCAST_CANCEL_TIMEOUT_MS, &url,
+                        relay_hdr, sizeof(relay_hdr));
+    int status = -2;
+    char host[128];
+    snprintf(host, sizeof(host), "%s", url.host);
+    if (dnscache_resolve(host, run->dns_ttl_s, url.host, sizeof(url.host)) == 0) {
+        char body[32 + AUTOD_REQUEST_ID_MAX];
+        snprintf(body, sizeof(body), "{\"request_id\":\"%s\"}", run->request_id);
+        char *resp = NULL;
+        status = httpc_send_json("POST", &url, relay_hdr, body, &resp, NULL, BROADCAST_CANCEL_TIMEOUT_MS);
+        free(resp);
+    }
+    if (status != 200) {
+        fprintf(stderr, "broadcast: cancel of %s on %s failed (%d)\n",
+                run->request_id, item->node.id, status);
+    }
+    pthread_mutex_lock(&run->lock);
+    broadcast_run_release_locked(run);
+    return NULL;
+}
+
+/* Mark the slots a "slots" list names: numbers, or names, aliases and
+ * patterns. Returns NULL, or the first entry that matches no slot. */
+static const char *broadcast_slot_filter(const config_t *cfg, JSON_Array *arr,
+                                         unsigned char want[SYNC_MAX_SLOTS]) {
+    memset(want, 0, SYNC_MAX_SLOTS);
+    size_t cnt = json_array_get_count(arr);
+    for (size_t i = 0; i < cnt; i++) {
+        JSON_Value *v = json_array_get_value(arr, i);
+        if (json_value_get_type(v) == JSONNumber) {
+            double n = json_value_get_number(v);
+            if (n >= 1 && n <= sync_slot_count(cfg) && n == (int)n) want[(int)n - 1] = 1;
+        } else if (json_value_get_type(v) == JSONString) {
+            unsigned char hits[SYNC_MAX_SLOTS];
+            if (sync_slot_match(cfg, json_value_get_string(v), hits) == 0) {
+                return json_value_get_string(v);
+            }
+            for (int slot = 0; slot < SYNC_MAX_SLOTS; slot++) want[slot] |= hits[slot];
+        }
+    }
+    return NULL;
+}
+
+static int broadcast_json_has_string(JSON_Array *arr, const char *s) {
+    size_t cnt = json_array_get_count(arr);
+    for (size_t i = 0; i < cnt; i++) {
+        const char *v = json_array_get_string(arr, i);
+        if (v && !strcmp(v, s)) return 1;
+    }
+    return 0;
+}
+
+/* "compare": group the nodes that answered by rc and normalized stdout
+ * (trailing whitespace and trailing blank lines dropped; optionally lines
+ * matching ignore dropped, and with sort every blank line dropped and the
+ * rest sorted) and diff every other group against the largest one. */
+typedef struct {
+    int enabled;
+    int sort;
+    int has_ignore;
+    regex_t ignore;
+} broadcast_compare_t;
+
+typedef struct {
+    struct mg_connection *c;
+    const char *requester;
+    int sse;
+    int broken;
+    long long last_write_ms;
+    bandwidth_stream_t bw;
+    const broadcast_compare_t *compare;
+    int aggregate;             /* one JSON document instead of a line per node */
+    const jsonq_t *reduce;     /* aggregate: run on the results, or NULL */
+    JSON_Value *results;       /* aggregate: the result lines so far */
+    JSON_Value *sections;      /* aggregate: the canary and compare lines */
+} broadcast_stream_t;
+
+/* A copy of a stream line without its "type", keeping the field order. */
+static JSON_Value *broadcast_untyped(const JSON_Value *v) {
+    JSON_Value *copy = json_value_init_object();
+    JSON_Object *src = json_object(v);
+    for (size_t i = 0; i < json_object_get_count(src); i++) {
+        const char *k = json_object_get_name(src, i);
+        if (strcmp(k, "type") != 0) {
+            json_object_set_value(json_object(copy), k,
+                                  json_value_deep_copy(json_object_get_value_at(src, i)));
+        }
+    }
+    return copy;
+}
+
+static int broadcast_result_cmp(const void *a, const void *b) {
+    JSON_Object *x = json_object(*(JSON_Value *const *)a), *y = json_object(*(JSON_Value *const *)b);
+    int sx = (int)json_object_get_number(x, "slot"), sy = (int)json_object_get_number(y, "slot");
+    if (sx != sy) return sx && sy ? sx - sy : sx ? -1 : 1;
+    const char *ix = json_object_get_string(x, "id"), *iy = json_object_get_string(y, "id");
+    return strcmp(ix ? ix : "", iy ? iy : "");
+}
+
+/* The aggregate document: the summary fields, the canary and compare
+ * sections, what reduce made of the results, then the result of every node
+ * by slot and id. */
+static JSON_Value *broadcast_aggregate(broadcast_stream_t *st, JSON_Value *summary) {
+    JSON_Value *doc = broadcast_untyped(summary);
+    JSON_Object *o = json_object(doc);
+    JSON_Array *res = json_array(st->results);
+    size_t n = json_array_get_count(res);
+    JSON_Value **items = calloc(n ? n : 1, sizeof(*items));
+    JSON_Value *sorted = json_value_init_array();
+    for (size_t i = 0; items && i < n; i++) items[i] = json_array_get_value(res, i);
+    if (items) qsort(items, n, sizeof(*items), broadcast_result_cmp);
+    for (size_t i = 0; items && i < n; i++) {
+        json_array_append_value(json_array(sorted), json_value_deep_copy(items[i]));
+    }
+    free(items);
+    JSON_Object *sec = json_object(st->sections);
+    for (size_t i = 0; i < json_object_get_count(sec); i++) {
+        json_object_set_value(o, json_object_get_name(sec, i),
+                              json_value_deep_copy(json_object_get_value_at(sec, i)));
+    }
+    if (st->reduce) {
+        const char *why = NULL;
+        JSON_Value *reduced = jsonq_eval(st->reduce, sorted, &why);
+        if (reduced) json_object_set_value(o, "reduced", reduced);
+        else json_object_set_string(o, "reduce_error", why ? why : "failed");
+    }
+    json_object_set_value(o, "results", sorted);
+    return doc;
+}
+
+static void broadcast_emit(broadcast_stream_t *st, const char *event, JSON_Value *v) {
+    JSON_Value *doc = NULL;
+    if (st->aggregate) {
+        if (strcmp(event, "summary") != 0) {
+            JSON_Value *copy = broadcast_untyped(v);
+            if (!strcmp(event, "result")) {
+                /* Output that is JSON is merged as a value too, for reduce. */
+                const char *out = json_object_get_string(json_object(copy), "stdout");
+                JSON_Value *parsed = out ? json_parse_string(out) : NULL;
+                if (parsed) json_object_set_value(json_object(copy), "result", parsed);
+                json_array_append_value(json_array(st->results), copy);
+            } else {
+                json_object_set_value(json_object(st->sections), event, copy);
+            }
+            return;
+        }
+        v = doc = broadcast_aggregate(st, v);
+    }
+    char *s = json_serialize_to_string(v);
+    if (doc) json_value_free(doc);
+    if (!s) return;
+    size_t cap = strlen(s) + strlen(event) + 32;
+    char *line = (char *)malloc(cap);
+    if (line && !st->broken) {
+        int n = st->sse ? snprintf(line, cap, "event: %s\ndata: %s\n\n", event, s)
+                        : snprintf(line, cap, "%s\n", s);
+        if (bandwidth_write(&st->bw, line, (size_t)n) <= 0) st->broken = 1;
+        st->last_write_ms = now_ms();
+    }
+    free(line);
+    json_free_serialized_string(s);
+}
+
+/* Writing is the only way to notice a client that went away, so an idle
+ * stream gets a blank line (an SSE comment) every BROADCAST_KEEPALIVE_MS. */
+static void broadcast_keepalive(broadcast_stream_t *st) {
+    if (st->broken || now_ms() - st->last_write_ms < BROADCAST_KEEPALIVE_MS) return;
+    int r = st->sse ? bandwidth_write(&st->bw, ":\n\n", 3) : bandwidth_write(&st->bw, "\n", 1);
+    if (r <= 0) st->broken = 1;
+    st->last_write_ms = now_ms();
+}
+
+typedef struct {
+    int ok;
+    int failed;
+    int timed_out;
+    int skipped;
+    int canceled;
+} broadcast_tally_t;
+
+static int broadcast_line_cmp(const void *a, const void *b) {
+    return strcmp(*(char *const *)a, *(char *const *)b);
+}
+
+/* Split s in place into at most max lines; returns how many there were in
+ * all, which may be more than max. */
+static int broadcast_split_lines(char *s, char **lines, int max) {
+    int n = 0;
+    while (*s || n == 0) {
+        char *nl = strchr(s, '\n');
+        if (nl) *nl = '\0';
+        if (n < max) lines[n] = s;
+        n++;
+        if (!nl) break;
+        s = nl + 1;
+    }
+    return n;
+}
+
+static char *broadcast_normalize(const broadcast_compare_t *cmp, const char *out) {
+    char *copy = strdup(out);
+    size_t len = strlen(out);
+    int max = 1;
+    for (const char *p = out; *p; p++) max += *p == '\n';
+    char **lines = calloc((size_t)max, sizeof(*lines));
+    char *norm = malloc(len + 1);
+    if (!copy || !lines || !norm) {
+        free(copy);
+        free(lines);
+        free(norm);
+        return NULL;
+    }
+    int n = broadcast_split_lines(copy, lines, max);
+    int kept = 0;
+    for (int i = 0; i < n; i++) {
+        char *l = lines[i];
+        size_t ll = strlen(l);
+        while (ll > 0 && (l[ll - 1] == ' ' || l[ll - 1] == '\t' || l[ll - 1] == '\r')) l[--ll] = '\0';
+        if (cmp->has_ignore && regexec(&cmp->ignore, l, 0, NULL, 0) == 0) continue;
+        if (cmp->sort && !l[0]) continue;
+        lines[kept++] = l;
+    }
+    if (cmp->sort) qsort(lines, (size_t)kept, sizeof(*lines), broadcast_line_cmp);
+    while (kept > 0 && !lines[kept - 1][0]) kept--;
+    size_t pos = 0;
+    for (int i = 0; i < kept; i++) {
+        size_t ll = strlen(lines[i]);
+        memcpy(norm + pos, lines[i], ll);
+        pos += ll;
+        if (i + 1 < kept) norm[pos++] = '\n';
+    }
+    norm[pos] = '\0';
+    free(lines);
+    free(copy);
+    return norm;
+}
+
+static void broadcast_diff_append(char *out, size_t *pos, char mark, const char *line, int *truncated) {
+    size_t ll = strlen(line);
+    if (*pos + ll + 3 > BROADCAST_DIFF_MAX) {
+        *truncated = 1;
+        return;
+    }
+    out[(*pos)++] = mark;
+    memcpy(out + *pos, line, ll);
+    *pos += ll;
+    out[(*pos)++] = '\n';
+    out[*pos] = '\0';
+}
+
+/* Line diff of b against a: "-" lines only a has, "+" lines only b has,
+ * from a longest common subsequence of the first BROADCAST_DIFF_LINES lines
+ * of each. Returns NULL when out of memory. */
+static char *broadcast_diff(const char *a, const char *b, int *truncated) {
+    char *ac = strdup(a), *bc = strdup(b);
+    char **al = calloc(BROADCAST_DIFF_LINES, sizeof(*al));
+    char **bl = calloc(BROADCAST_DIFF_LINES, sizeof(*bl));
+    char *out = malloc(BROADCAST_DIFF_MAX);
+    unsigned short *lcs = NULL;
+    int n = 0, m = 0;
+    if (ac && bc && al && bl) {
+        n = *a ? broadcast_split_lines(ac, al, BROADCAST_DIFF_LINES) : 0;
+        m = *b ? broadcast_split_lines(bc, bl, BROADCAST_DIFF_LINES) : 0;
+        if (n > BROADCAST_DIFF_LINES || m > BROADCAST_DIFF_LINES) *truncated = 1;
+        if (n > BROADCAST_DIFF_LINES) n = BROADCAST_DIFF_LINES;
+        if (m > BROADCAST_DIFF_LINES) m = BROADCAST_DIFF_LINES;
+        lcs = calloc((size_t)(n + 1) * (size_t)(m + 1), sizeof(*lcs));
+    }
+    if (!lcs || !out) {
+        free(ac); free(bc); free(al); free(bl); free(out); free(lcs);
+        return NULL;
+    }
+#define LCS(i, j) lcs[(size_t)(i) * (size_t)(m + 1) + (size_t)(j)]
+    for (int i = n - 1; i >= 0; i--) {
+        for (int j = m - 1; j >= 0; j--) {
+            LCS(i, j) = !strcmp(al[i], bl[j]) ? LCS(i + 1, j + 1) + 1
+                      : LCS(i + 1, j) >= LCS(i, j + 1) ? LCS(i + 1, j) : LCS(i, j + 1);
+        }
+    }
+    size_t pos = 0;
+    out[0] = '\0';
+    int i = 0, j = 0;
+    while (i < n || j < m) {
+        if (i < n && j < m && !strcmp(al[i], bl[j])) {
+            i++;
+            j++;
+        } else if (j >= m || (i < n && LCS(i + 1, j) >= LCS(i, j + 1))) {
+            broadcast_diff_append(out, &pos, '-', al[i++], truncated);
+        } else {
+            broadcast_diff_append(out, &pos, '+', bl[j++], truncated);
+        }
+    }
+#undef LCS
+    free(ac); free(bc); free(al); free(bl); free(lcs);
+    return out;
+}
+
+/* The "compare" line: groups of nodes with the same rc and normalized
+ * output, largest first (the reference, with its output), then each other
+ * group with the diff against it, and the nodes without a reply to compare.
+ * Returns the number of groups. */
+static int broadcast_emit_compare(broadcast_stream_t *st, broadcast_run_t *run) {
+    int group_of[SYNC_MAX_SLAVES];
+    int first[SYNC_MAX_SLAVES], size[SYNC_MAX_SLAVES];
+    int groups = 0;
+    JSON_Value *missing_v = json_value_init_array();
+    for (int i = 0; i < run->count; i++) {
+        const broadcast_item_t *item = &run->items[i];
+        group_of[i] = -1;
+        if (!item->compared) {
+            json_array_append_string(json_array(missing_v), item->node.id);
+            continue;
+        }
+        int g = 0;
+        while (g < groups && (run->items[first[g]].compared_rc != item->compared_rc ||
+                              strcmp(run->items[first[g]].compared, item->compared) != 0)) {
+            g++;
+        }
+        if (g == groups) {
+            first[g] = i;
+            size[g] = 0;
+            groups++;
+        }
+        group_of[i] = g;
+        size[g]++;
+    }
+    /* Largest first; equal sizes keep the order they were met in. */
+    int order[SYNC_MAX_SLAVES];
+    for (int g = 0; g < groups; g++) order[g] = g;
+    for (int a = 1; a < groups; a++) {
+        int g = order[a], b = a;
+        while (b > 0 && size[order[b - 1]] < size[g]) {
+            order[b] = order[b - 1];
+            b--;
+        }
+        order[b] = g;
+    }
+
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "type", "compare");
+    JSON_Value *groups_v = json_value_init_array();
+    const char *reference = groups ? run->items[first[order[0]]].compared : NULL;
+    for (int k = 0; k < groups; k++) {
+        int g = order[k];
+        const broadcast_item_t *rep = &run->items[first[g]];
+        JSON_Value *gv = json_value_init_object();
+        JSON_Object *go = json_object(gv);
+        JSON_Value *ids_v = json_value_init_array();
+        for (int i = 0; i < run->count; i++) {
+            if (group_of[i] == g) json_array_append_string(json_array(ids_v), run->items[i].node.id);
+        }
+        json_object_set_value(go, "nodes", ids_v);
+        json_object_set_number(go, "count", size[g]);
+        json_object_set_number(go, "rc", rep->compared_rc);
+        if (k == 0) {
+            size_t len = strlen(rep->compared);
+            if (len > BROADCAST_SAMPLE_MAX) {
+                char *cut = strndup(rep->compared, BROADCAST_SAMPLE_MAX);
+                if (cut) json_object_set_string(go, "output", cut);
+                free(cut);
+                json_object_set_boolean(go, "output_truncated", 1);
+            } else {
+                json_object_set_string(go, "output", rep->compared);
+            }
+        } else {
+            int truncated = 0;
+            char *diff = broadcast_diff(reference, rep->compared, &truncated);
+            if (diff) json_object_set_string(go, "diff", diff);
+            if (truncated) json_object_set_boolean(go, "diff_truncated", 1);
+            free(diff);
+        }
+        json_array_append_value(json_array(groups_v), gv);
+    }
+    json_object_set_number(o, "groups", groups);
+    json_object_set_boolean(o, "identical", groups == 1);
+    json_object_set_value(o, "group", groups_v);
+    json_object_set_value(o, "not_compared", missing_v);
+    broadcast_emit(st, "compare", v);
+    json_value_free(v);
+    return groups;
+}
+
+/* Parse the request's "compare": true, or an object with "ignore" (an
+ * extended regex for lines to leave out) and "sort". Returns NULL or the
+ * error to send. */
+static const char *broadcast_compare_parse(JSON_Object *o, broadcast_compare_t *cmp) {
+    memset(cmp, 0, sizeof(*cmp));
+    JSON_Value *v = json_object_get_value(o, "compare");
+    if (!v) return NULL;
+    if (json_value_get_type(v) == JSONBoolean) {
+        cmp->enabled = json_value_get_boolean(v) == 1;
+        return NULL;
+    }
+    JSON_Object *co = json_object(v);
+    if (!co) return "invalid_compare";
+    cmp->enabled = 1;
+    JSON_Value *sort_v = json_object_get_value(co, "sort");
+    if (sort_v && json_value_get_type(sort_v) != JSONBoolean) return "invalid_compare";
+    cmp->sort = json_value_get_boolean(sort_v) == 1;
+    JSON_Value *ignore_v = json_object_get_value(co, "ignore");
+    if (ignore_v) {
+        const char *ignore = json_value_get_string(ignore_v);
+        if (!ignore) return "invalid_compare";
+        if (regcomp(&cmp->ignore, ignore, REG_EXTENDED | REG_NOSUB) != 0) return "bad_compare_ignore";
+        cmp->has_ignore = 1;
+    }
+    return NULL;
+}
+
+/* One result line. Fields of the node's /exec reply (rc, stdout, usage, ...)
+ * are copied next to the node identity. With timed_out_ms set the node never
+ * answered: it timed out, or was canceled when the stream broke first.
+ * Timeouts name the phase that ran out: "connect", "response" (the node took
+ * the request but never answered) or "exec" (the node killed the handler). */
+static void broadcast_emit_item(broadcast_stream_t *st, const char *path,
+                                broadcast_item_t *item, long long timed_out_ms,
+                                broadcast_tally_t *tally) {
+    item->reported = 1;
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "type", "result");
+    json_object_set_string(o, "id", item->node.id);
+    if (item->node.slot > 0) json_object_set_number(o, "slot", item->node.slot);
+    if (item->canary) json_object_set_boolean(o, "canary", 1);
+    if (item->node.via[0]) json_object_set_string(o, "via", item->node.via);
+
+    int ok = 0;
+    int exec_timed_out = 0;
+    int rc = -1;
+    const char *out = NULL, *err = NULL;
+    JSON_Value *reply = NULL;
+    if (item->skip) {
+        json_object_set_string(o, "error", item->skip);
+        if (item->lease_holder[0]) json_object_set_string(o, "holder", item->lease_holder);
+        tally->skipped++;
+    } else if (timed_out_ms > 0) {
+        json_object_set_string(o, "error", st->broken ? "canceled" : "timeout");
+        if (!st->broken) json_object_set_string(o, "phase", "response");
+        json_object_set_number(o, "elapsed_ms", (double)timed_out_ms);
+        if (st->broken) tally->canceled++;
+        else tally->timed_out++;
+        cluster_note_dispatch("broadcast", 0);
+        cluster_note_node_dispatch(item->node.id, 0, timed_out_ms, strlen(broadcast_item_body(item)), 0);
+        if (!st->broken) breaker_note(&item->run->breaker, item->node.id, 0);
+    } else {
+        json_object_set_number(o, "elapsed_ms", (double)item->elapsed_ms);
+        if (dnscache_is_hostname(item->node.host)) {
+            json_object_set_string(o, "host", item->node.host);
+            if (item->address[0]) json_object_set_string(o, "address", item->address);
+        }
+        if (item->http_status == -2) {
+            json_object_set_string(o, "error", "resolve_failed");
+        } else if (item->http_status < 0 && item->failure && !strcmp(item->failure, "connect_timeout")) {
+            json_object_set_string(o, "error", "timeout");
+            json_object_set_string(o, "phase", "connect");
+            timed_out_ms = item->elapsed_ms;
+        } else if (item->http_status < 0 &&
+                   ((item->failure && !strcmp(item->failure, "timeout")) ||
+                    item->elapsed_ms >= item->run->timeout_ms)) {
+            /* httpc gave up waiting on a node that accepted the request. */
+            json_object_set_string(o, "error", "timeout");
+            json_object_set_string(o, "phase", "response");
+            timed_out_ms = item->elapsed_ms;
+        } else if (item->http_status < 0) {
+            json_object_set_string(o, "error", "unreachable");
+        } else {
+            json_object_set_number(o, "http_status", item->http_status);
+            reply = item->resp ? json_parse_string(item->resp) : NULL;
+            JSON_Object *ro = json_object(reply);
+            if (ro) {
+                for (size_t i = 0; i < json_object_get_count(ro); i++) {
+                    const char *k = json_object_get_name(ro, i);
+                    if (!strcmp(k, "elapsed_ms")) {
+                        json_object_set_number(o, "exec_elapsed_ms", json_object_get_number(ro, k));
+                        continue;
+                    }
+                    json_object_set_value(o, k, json_value_deep_copy(json_object_get_value(ro, k)));
+                }
+                if (json_object_has_value_of_type(ro, "rc", JSONNumber)) {
+                    rc = (int)json_object_get_number(ro, "rc");
+                }
+                out = json_object_get_string(ro, "stdout");
+                err = json_object_get_string(ro, "stderr");
+                if (json_object_get_boolean(ro, "timed_out") == 1) {
+                    json_object_set_string(o, "error", "timeout");
+                    json_object_set_string(o, "phase", "exec");
+                    exec_timed_out = 1;
+                }
+            } else {
+                json_object_set_string(o, "error", "bad_response");
+            }
+            if (st->compare && st->compare->enabled && ro && item->http_status == 200 &&
+                !exec_timed_out) {
+                item->compared = broadcast_normalize(st->compare, out ? out : "");
+                item->compared_rc = rc;
+            }
+            ok = item->http_status == 200 && rc == 0;
+        }
+        if (ok) tally->ok++;
+        else if (timed_out_ms > 0 || exec_timed_out) tally->timed_out++;
+        else tally->failed++;
+        cluster_note_dispatch("broadcast", item->http_status == 200);
+        cluster_note_node_dispatch(item->node.id, item->http_status == 200, item->elapsed_ms,
+                                   item->http_status >= 0 ? strlen(broadcast_item_body(item)) : 0,
+                                   item->resp ? strlen(item->resp) : 0);
+        breaker_note(&item->run->breaker, item->node.id, item->http_status >= 0);
+    }
+
+    if (!item->skip) {
+        jobs_record_t jr = {
+            .node = item->node.id, .source = "broadcast", .requester = st->requester,
+            .caller = item->run->caller, .caller_role = item->run->caller_role,
+            .request_id = item->run->request_id, .path = path,
+            .spawned = !timed_out_ms && item->http_status == 200, .rc = rc,
+            .canceled = timed_out_ms > 0 && st->broken,
+            .elapsed_ms = timed_out_ms > 0 ? timed_out_ms : item->elapsed_ms,
+            .out = out, .out_len = out ? strlen(out) : 0,
+            .err = err, .err_len = err ? strlen(err) : 0
+        };
+        jobs_store_record(&jr);
+    }
+    broadcast_emit(st, "result", v);
+    if (reply) json_value_free(reply);
+    json_value_free(v);
+}
+
+/* "canary": run on a few nodes first and go on to the rest only when every
+ * one of them answered 200 with rc expect_rc and, with match set, stdout
+ * matching that extended regex. */
+typedef struct {
+    int enabled;
+    int count;                 /* first N contactable nodes (default 1) */
+    JSON_Array *ids;           /* or these nodes */
+    int expect_rc;
+    int has_match;
+    regex_t match;
+} broadcast_canary_t;
+
+static int broadcast_canary_passed(const broadcast_canary_t *cn, const broadcast_item_t *item) {
+    if (item->skip || item->http_status != 200 || !item->resp) return 0;
+    JSON_Value *reply = json_parse_string(item->resp);
+    JSON_Object *ro = json_object(reply);
+    int ok = ro && json_object_has_value_of_type(ro, "rc", JSONNumber) &&
+             (int)json_object_get_number(ro, "rc") == cn->expect_rc;
+    if (ok && cn->has_match) {
+        const char *out = json_object_get_string(ro, "stdout");
+        ok = out && regexec(&cn->match, out, 0, NULL, 0) == 0;
+    }
+    if (reply) json_value_free(reply);
+    return ok;
+}
+
+/* Parse the request's "canary" object. Returns NULL or the error to send. */
+static const char *broadcast_canary_parse(JSON_Object *o, broadcast_canary_t *cn) {
+    memset(cn, 0, sizeof(*cn));
+    JSON_Value *v = json_object_get_value(o, "canary");
+    if (!v) return NULL;
+    JSON_Object *co = json_object(v);
+    if (!co) return "invalid_canary";
+    cn->enabled = 1;
+    cn->count = 1;
+    JSON_Value *count_v = json_object_get_value(co, "count");
+    if (count_v) {
+        double d = json_value_get_number(count_v);
+        if (json_value_get_type(count_v) != JSONNumber || d < 1 || d > SYNC_MAX_SLAVES || d != (int)d) {
+            return "invalid_canary";
+        }
+        cn->count = (int)d;
+    }
+    if (json_object_has_value(co, "ids")) {
+        cn->ids = json_object_get_array(co, "ids");
+        if (!cn->ids || json_array_get_count(cn->ids) == 0) return "invalid_canary";
+    }
+    JSON_Value *rc_v = json_object_get_value(co, "expect_rc");
+    if (rc_v) {
+        double d = json_value_get_number(rc_v);
+        if (json_value_get_type(rc_v) != JSONNumber || d != (int)d) return "invalid_canary";
+        cn->expect_rc = (int)d;
+    }
+    const char *match = json_object_get_string(co, "match");
+    if (match) {
+        if (regcomp(&cn->match, match, REG_EXTENDED | REG_NOSUB) != 0) return "bad_canary_match";
+        cn->has_match = 1;
+    }
+    return NULL;
+}
+
+/* Start the node's worker. A node that cannot get a thread is reported
+ * straight away; returns 1 when the worker runs. */
+static int broadcast_launch(broadcast_stream_t *st, const char *path, broadcast_item_t *item,
+                            broadcast_tally_t *tally) {
+    broadcast_run_t *run = item->run;
+    pthread_t th;
+    pthread_mutex_lock(&run->lock);
+    run->refs++;
+    pthread_mutex_unlock(&run->lock);
+    if (pthread_create(&th, NULL, broadcast_worker, item) != 0) {
+        pthread_mutex_lock(&run->lock);
+        run->refs--;
+        pthread_mutex_unlock(&run->lock);
+        item->skip = "spawn_failed";
+        broadcast_emit_item(st, path, item, 0, tally);
+        return 0;
+    }
+    pthread_detach(th);
+    item->launched = 1;
+    return 1;
+}
+
+/* Stream results in completion order until the outstanding nodes of a wave
+ * have answered; nodes still running at the deadline are reported as timed
+ * out and left to finish on their own. When the client goes away first
+ * they are told to cancel instead. *cursor walks run->done across waves. */
+static void broadcast_collect(broadcast_stream_t *st, broadcast_run_t *run, const char *path,
+                              int outstanding, long long t0, int *cursor,
+                              const broadcast_canary_t *cn, broadcast_tally_t *tally) {
+    long long deadline = t0 + run->timeout_ms + BROADCAST_GRACE_MS;
+    pthread_mutex_lock(&run->lock);
+    while (outstanding > 0 && !st->broken) {
+        if (*cursor < run->done_count) {
+            broadcast_item_t *item = &run->items[run->done[(*cursor)++]];
+            if (item->reported) continue;   /* reported as timed out in an earlier wave */
+            pthread_mutex_unlock(&run->lock);
+            if (item->canary) item->passed = broadcast_canary_passed(cn, item);
+            broadcast_emit_item(st, path, item, 0, tally);
+            outstanding--;
+            pthread_mutex_lock(&run->lock);
+            continue;
+        }
+        pthread_mutex_unlock(&run->lock);
+        broadcast_keepalive(st);
+        pthread_mutex_lock(&run->lock);
+        if (st->broken) break;
+        long long left = deadline - now_ms();
+        if (left <= 0) break;
+        if (left > BROADCAST_KEEPALIVE_MS) left = BROADCAST_KEEPALIVE_MS;
+        struct timespec ts;
+        clock_gettime(CLOCK_REALTIME, &ts);
+        ts.tv_sec += left / 1000;
+        ts.tv_nsec += (left % 1000) * 1000000L;
+        if (ts.tv_nsec >= 1000000000L) { ts.tv_sec++; ts.tv_nsec -= 1000000000L; }
+        (void)pthread_cond_timedwait(&run->cond, &run->lock, &ts);
+    }
+    if (outstanding <= 0) {
+        pthread_mutex_unlock(&run->lock);
+        return;
+    }
+    char finished[SYNC_MAX_SLAVES];
+    memset(finished, 0, sizeof(finished));
+    for (int i = 0; i < run->done_count; i++) finished[run->done[i]] = 1;
+    int done_count = run->done_count;
+    pthread_mutex_unlock(&run->lock);
+    /* Finished but not streamed yet: still goes to the job history. */
+    for (int k = *cursor; k < done_count; k++) {
+        broadcast_item_t *item = &run->items[run->done[k]];
+        if (item->reported) continue;
+        if (item->canary) item->passed = broadcast_canary_passed(cn, item);
+        broadcast_emit_item(st, path, item, 0, tally);
+    }
+    *cursor = done_count;
+    int canceling = 0;
+    for (int i = 0; i < run->count; i++) {
+        broadcast_item_t *item = &run->items[i];
+        if (!item->launched || item->reported || finished[i]) continue;
+        if (st->broken) {
+            pthread_t th;
+            pthread_mutex_lock(&run->lock);
+            run->refs++;
+            pthread_mutex_unlock(&run->lock);
+            if (pthread_create(&th, NULL, broadcast_cancel_worker, item) == 0) {
+                pthread_detach(th);
+                canceling++;
+            } else {
+                pthread_mutex_lock(&run->lock);
+                run->refs--;
+                pthread_mutex_unlock(&run->lock);
+            }
+        }
+        broadcast_emit_item(st, path, item, now_ms() - t0, tally);
+    }
+    if (canceling) {
+        fprintf(stderr, "broadcast: client %s went away, canceling %s on %d node(s) (request %s)\n",
+                st->requester, path, canceling, api_request_id());
+    }
+}
+
+static int h_sync_exec(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    if (strcasecmp(cfg->sync_role, "master") != 0) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri || strcmp(ri->request_method, "POST") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        free(u.body);
+        send_json_error(c, 400, "body_read_failed");
+        free(cfg);
+        return 1;
+    }
+    (void)caller_identify(c, cfg, u.body, u.len);
+    JSON_Value *root = json_parse_string(u.body ? u.body : "");
+    free(u.body);
+    if (!root || json_value_get_type(root) != JSONObject) {
+        if (root) json_value_free(root);
+        send_json_error(c, 400, "bad_json");
+        free(cfg);
+        return 1;
+    }
+    JSON_Object *o = json_object(root);
+    const char *path = json_object_get_string(o, "path");
+    if (!path || !*path) {
+        json_value_free(root);
+        send_json_error(c, 400, "missing_path");
+        free(cfg);
+        return 1;
+    }
+    const char *lease_id = mg_get_header(c, "X-Lease-Id");
+    if (!lease_id) lease_id = json_object_get_string(o, "lease_id");
+    JSON_Array *want_ids = json_object_get_array(o, "ids");
+    JSON_Array *want_slots = json_object_get_array(o, "slots");
+    unsigned char want_slot[SYNC_MAX_SLOTS];
+    const char *bad_slot = want_slots ? broadcast_slot_filter(cfg, want_slots, want_slot) : NULL;
+    if (bad_slot) {
+        int status = 404;
+        JSON_Value *v = sync_slot_lookup_error(cfg, bad_slot, -1, &status);
+        send_json(c, v, status, 1);
+        json_value_free(v);
+        json_value_free(root);
+        free(cfg);
+        return 1;
+    }
+    const char *want_group = json_object_get_string(o, "group");
+    unsigned char group_slot[SYNC_MAX_SLOTS];
+    if (json_object_has_value(o, "group") && (!want_group || !*want_group)) {
+        json_value_free(root);
+        send_json_error(c, 400, "invalid_group");
+        free(cfg);
+        return 1;
+    }
+    if (want_group && sync_master_group_slots(app, want_group, group_slot) != 0) {
+        JSON_Value *v = json_value_init_object();
+        json_object_set_string(json_object(v), "error", "unknown_group");
+        json_object_set_string(json_object(v), "group", want_group);
+        send_json(c, v, 404, 1);
+        json_value_free(v);
+        json_value_free(root);
+        free(cfg);
+        return 1;
+    }
+    JSON_Value *aggregate_v = json_object_get_value(o, "aggregate");
+    JSON_Value *reduce_v = json_object_get_value(o, "reduce");
+    if ((aggregate_v && json_value_get_type(aggregate_v) != JSONBoolean) ||
+        (reduce_v && (!json_value_get_string(reduce_v) || !*json_value_get_string(reduce_v)))) {
+        json_value_free(root);
+        send_json_error(c, 400, aggregate_v && json_value_get_type(aggregate_v) != JSONBoolean
+                                    ? "invalid_aggregate" : "invalid_reduce");
+        free(cfg);
+        return 1;
+    }
+    int aggregate = json_value_get_boolean(aggregate_v) == 1 || reduce_v;
+    jsonq_t *reduce = NULL;
+    if (reduce_v) {
+        const char *why = NULL;
+        int at = 0;
+        reduce = jsonq_compile(json_value_get_string(reduce_v), &why, &at);
+        if (!reduce) {
+            JSON_Value *v = json_value_init_object();
+            json_object_set_string(json_object(v), "error", "invalid_reduce");
+            json_object_set_string(json_object(v), "reason", why);
+            json_object_set_number(json_object(v), "at", at);
+            send_json(c, v, 400, 1);
+            json_value_free(v);
+            json_value_free(root);
+            free(cfg);
+            return 1;
+        }
+    }
+    broadcast_canary_t canary;
+    const char *canary_error = broadcast_canary_parse(o, &canary);
+    if (canary_error) {
+        if (canary.has_match) regfree(&canary.match);
+        jsonq_free(reduce);
+        json_value_free(root);
+        send_json_error(c, 400, canary_error);
+        free(cfg);
+        return 1;
+    }
+    broadcast_compare_t compare;
+    const char *compare_error = broadcast_compare_parse(o, &compare);
+    if (compare_error) {
+        if (compare.has_ignore) regfree(&compare.ignore);
+        if (canary.has_match) regfree(&canary.match);
+        jsonq_free(reduce);
+        json_value_free(root);
+        send_json_error(c, 400, compare_error);
+        free(cfg);
+        return 1;
+    }
+    exec_deadlines_t deadlines;
+    const char *deadline_error = exec_plan_deadlines(cfg, o, 0, &deadlines);
+    if (deadline_error) {
+        if (canary.has_match) regfree(&canary.match);
+        if (compare.has_ignore) regfree(&compare.ignore);
+        jsonq_free(reduce);
+        json_value_free(root);
+        send_json_error(c, 400, deadline_error);
+        free(cfg);
+        return 1;
+    }
+
+    int sse = 0;
+    const char *accept = mg_get_header(c, "Accept");
+    /* An aggregate is one document; while it is pending, keepalives are
+     * blank lines, which JSON allows before it. */
+    char fmt[16];
+    if (!aggregate &&
+        ((accept && strstr(accept, "text/event-stream")) ||
+         (ri->query_string && mg_get_var(ri->query_string, strlen(ri->query_string), "format",
+                                         fmt, sizeof(fmt)) > 0 && !strcmp(fmt, "sse")))) {
+        sse = 1;
+    }
+
+    /* Forward only what /exec understands; raw output cannot be merged. */
+    JSON_Value *fwd = json_value_init_object();
+    JSON_Object *fo = json_object(fwd);
+    json_object_set_string(fo, "path", path);
+    JSON_Value *args_v = json_object_get_value(o, "args");
+    if (args_v) json_object_set_value(fo, "args", json_value_deep_copy(args_v));
+    const char *enc = json_object_get_string(o, "output_encoding");
+    if (enc) json_object_set_string(fo, "output_encoding", enc);
+    const char *parse_output = json_object_get_string(o, "parse_output");
+    if (parse_output) json_object_set_string(fo, "parse_output", parse_output);
+    const char *profile = json_object_get_string(o, "profile");
+    if (profile) json_object_set_string(fo, "profile", profile);
+    JSON_Value *env_v = json_object_get_value(o, "env");
+    if (env_v) json_object_set_value(fo, "env", json_value_deep_copy(env_v));
+    JSON_Value *params_v = json_object_get_value(o, "params");
+    if (params_v) json_object_set_value(fo, "params", json_value_deep_copy(params_v));
+    char request_id[AUTOD_REQUEST_ID_MAX];
+    snprintf(request_id, sizeof(request_id), "%s", api_request_id());
+    json_object_set_string(fo, "request_id", request_id);
+    /* The node kills the handler with headroom to spare, so its reply still
+     * arrives before the total deadline. */
+    json_object_set_number(fo, "exec_timeout_ms", deadlines.exec_ms);
+    json_object_set_number(fo, "total_deadline_ms", deadlines.total_ms - cfg->exec_deadline_headroom_ms);
+
+    broadcast_run_t *run = calloc(1, sizeof(*run));
+    sync_node_addr_t *nodes = calloc(SYNC_MAX_SLAVES, sizeof(*nodes));
+    int node_count = nodes ? sync_master_list_nodes(app, cfg, nodes, SYNC_MAX_SLAVES) : 0;
+    if (run) {
+        run->items = calloc(node_count > 0 ? (size_t)node_count : 1, sizeof(*run->items));
+        run->done = calloc(node_count > 0 ? (size_t)node_count : 1, sizeof(*run->done));
+        run->body = json_serialize_to_string(fwd);
+    }
+    json_value_free(fwd);
+    if (!run || !nodes || !run->items || !run->done || !run->body) {
+        if (run) {
+            free(run->items);
+            free(run->done);
+            if (run->body) json_free_serialized_string(run->body);
+            free(run);
+        }
+        free(nodes);
+        if (canary.has_match) regfree(&canary.match);
+        if (compare.has_ignore) regfree(&compare.ignore);
+        jsonq_free(reduce);
+        json_value_free(root);
+        send_plain(c, 500, "oom", 1);
+        free(cfg);
+        return 1;
+    }
+    pthread_mutex_init(&run->lock, NULL);
+    pthread_cond_init(&run->cond, NULL);
+    run->refs = 1;
+    run->timeout_ms = deadlines.total_ms;
+    run->connect_timeout_ms = deadlines.connect_ms;
+    run->dns_ttl_s = cfg->sync_dns_ttl_s;
+    run->breaker = cfg->breaker;
+    memcpy(run->request_id, request_id, sizeof(run->request_id));
+    snprintf(run->caller, sizeof(run->caller), "%s", caller_name());
+    snprintf(run->caller_role, sizeof(run->caller_role), "%s", caller_role());
+
+    for (int i = 0; i < node_count; i++) {
+        if (want_ids && !broadcast_json_has_string(want_ids, nodes[i].id)) continue;
+        if (want_slots && (nodes[i].slot < 1 || !want_slot[nodes[i].slot - 1])) continue;
+        if (want_group && (nodes[i].slot < 1 || !group_slot[nodes[i].slot - 1])) continue;
+        broadcast_item_t *item = &run->items[run->count++];
+        item->node = nodes[i];
+        item->run = run;
+        if (nodes[i].down) item->skip = "node_down";
+        else if (strcmp(nodes[i].transport, "http") != 0) item->skip = "unsupported_transport";
+        else if (!nodes[i].host[0]) item->skip = "no_address";
+        else if (nodes[i].via[0] && !nodes[i].via_host[0]) item->skip = "gateway_unavailable";
+        if (!item->skip) {
+            JSON_Value *conflict = sync_master_lease_conflict(app, nodes[i].id, -1, lease_id);
+            if (conflict) {
+                const char *holder = json_object_get_string(json_object(conflict), "holder");
+                strncpy(item->lease_holder, holder ? holder : "", sizeof(item->lease_holder) - 1);
+                item->skip = "slot_leased";
+                json_value_free(conflict);
+            }
+        }
+        if (!item->skip) {
+            JSON_Value *refused = sync_master_version_conflict(app, nodes[i].id);
+            if (refused) {
+                item->skip = "incompatible_version";
+                json_value_free(refused);
+            }
+        }
+        if (!item->skip && nodes[i].slot > 0) {
+            /* The env and params of the node's slot come under the request's. */
+            JSON_Value *own = json_parse_string(run->body);
+            if (sync_slot_exec_context(cfg, nodes[i].slot - 1, json_object(own))) {
+                item->body = json_serialize_to_string(own);
+            }
+            if (own) json_value_free(own);
+        }
+        if (!item->skip && sync_master_node_quarantined(app, nodes[i].id)) {
+            item->skip = "node_quarantined";
+        }
+        if (!item->skip && sync_master_node_decommissioning(app, nodes[i].id)) {
+            item->skip = "node_decommissioning";
+        }
+        if (!item->skip && breaker_allow(&cfg->breaker, nodes[i].id, NULL) != 0) {
+            item->skip = "circuit_open";
+        }
+    }
+    free(nodes);
+
+    int canary_nodes = 0;
+    if (canary.enabled) {
+        for (int i = 0; i < run->count; i++) {
+            broadcast_item_t *item = &run->items[i];
+            if (item->skip) continue;
+            if (canary.ids ? broadcast_json_has_string(canary.ids, item->node.id)
+                           : canary_nodes < canary.count) {
+                item->canary = 1;
+                canary_nodes++;
+            }
+        }
+        if (!canary_nodes) {
+            pthread_mutex_lock(&run->lock);
+            broadcast_run_release_locked(run);
+            if (canary.has_match) regfree(&canary.match);
+            if (compare.has_ignore) regfree(&compare.ignore);
+            jsonq_free(reduce);
+            json_value_free(root);
+            send_json_error(c, 409, "no_canary_nodes");
+            free(cfg);
+            return 1;
+        }
+    }
+
+    if (confirm_required(cfg, path)) {
+        JSON_Value *req = json_value_init_object();
+        JSON_Object *qo = json_object(req);
+        json_object_set_string(qo, "path", path);
+        if (args_v) json_object_set_value(qo, "args", json_value_deep_copy(args_v));
+        JSON_Value *ids_v = json_value_init_array();
+        for (int i = 0; i < run->count; i++) {
+            json_array_append_string(json_array(ids_v), run->items[i].node.id);
+        }
+        json_object_set_value(qo, "targets", ids_v);
+        JSON_Value *preview = json_value_deep_copy(req);
+        json_object_set_number(json_object(preview), "nodes", run->count);
+        if (canary_nodes) json_object_set_number(json_object(preview), "canary", canary_nodes);
+        int sent = confirm_gate(c, cfg, o, req, preview);
+        json_value_free(req);
+        if (sent) {
+            pthread_mutex_lock(&run->lock);
+            broadcast_run_release_locked(run);
+            if (canary.has_match) regfree(&canary.match);
+            if (compare.has_ignore) regfree(&compare.ignore);
+            jsonq_free(reduce);
+            json_value_free(root);
+            free(cfg);
+            return 1;
+        }
+        run->confirmed = 1;
+    }
+
+    mg_printf(c, "HTTP/1.1 200 OK\r\n"
+                 "Content-Type: %s\r\n"
+                 "Cache-Control: no-store\r\n"
+                 "Access-Control-Allow-Origin: *\r\n",
+              aggregate ? "application/json" : sse ? "text/event-stream" : "application/x-ndjson");
+    api_print_headers(c, 1);
+    mg_printf(c, "Connection: close\r\n\r\n");
+
+    long long t0 = now_ms();
+    broadcast_stream_t st = { .c = c, .requester = ri->remote_addr, .sse = sse, .broken = 0,
+                              .last_write_ms = t0, .compare = &compare, .aggregate = aggregate,
+                              .reduce = reduce };
+    if (aggregate) {
+        st.results = json_value_init_array();
+        st.sections = json_value_init_object();
+    }
+    bandwidth_stream_begin(&st.bw, c, cfg);
+    broadcast_tally_t tally = {0, 0, 0, 0, 0};
+    int cursor = 0;
+    int wave = 0;
+    for (int i = 0; i < run->count; i++) {
+        broadcast_item_t *item = &run->items[i];
+        if (item->skip) broadcast_emit_item(&st, path, item, 0, &tally);
+        else if (!canary.enabled || item->canary) wave += broadcast_launch(&st, path, item, &tally);
+    }
+    broadcast_collect(&st, run, path, wave, t0, &cursor, &canary, &tally);
+
+    /* The rest of the fleet only runs when every canary passed. */
+    const char *canary_verdict = NULL;
+    if (canary.enabled && !st.broken) {
+        int passed = 0;
+        JSON_Value *failed_v = json_value_init_array();
+        for (int i = 0; i < run->count; i++) {
+            const broadcast_item_t *item = &run->items[i];
+            if (!item->canary) continue;
+            if (item->passed) passed++;
+            else json_array_append_string(json_array(failed_v), item->node.id);
+        }
+        canary_verdict = passed == canary_nodes ? "passed" : "failed";
+        JSON_Value *cv = json_value_init_object();
+        JSON_Object *co = json_object(cv);
+        json_object_set_string(co, "type", "canary");
+        json_object_set_string(co, "status", canary_verdict);
+        json_object_set_number(co, "nodes", canary_nodes);
+        json_object_set_number(co, "ok", passed);
+        json_object_set_value(co, "failed", failed_v);
+        broadcast_emit(&st, "canary", cv);
+        json_value_free(cv);
+        if (passed != canary_nodes) {
+            fprintf(stderr, "broadcast: %s failed on %d of %d canary node(s), not rolled out (request %s)\n",
+                    path, canary_nodes - passed, canary_nodes, api_request_id());
+        }
+
+        long long t1 = now_ms();
+        wave = 0;
+        for (int i = 0; i < run->count; i++) {
+            broadcast_item_t *item = &run->items[i];
+            if (item->canary || item->reported) continue;
+            if (passed != canary_nodes) {
+                item->skip = "canary_failed";
+                broadcast_emit_item(&st, path, item, 0, &tally);
+                continue;
+            }
+            wave += broadcast_launch(&st, path, item, &tally);
+        }
+        broadcast_collect(&st, run, path, wave, t1, &cursor, &canary, &tally);
+    }
+    if (canary.has_match) regfree(&canary.match);
+    int groups = -1;
+    if (compare.enabled && !st.broken) groups = broadcast_emit_compare(&st, run);
+    if (compare.has_ignore) regfree(&compare.ignore);
+
+    pthread_mutex_lock(&run->lock);
+    JSON_Value *sum = json_value_init_object();
+    JSON_Object *so = json_object(sum);
+    json_object_set_string(so, "type", "summary");
+    json_object_set_string(so, "path", path);
+    json_object_set_number(so, "nodes", run->count);
+    json_object_set_number(so, "ok", tally.ok);
+    json_object_set_number(so, "failed", tally.failed);
+    json_object_set_number(so, "timed_out", tally.timed_out);
+    json_object_set_number(so, "skipped", tally.skipped);
+    if (tally.canceled) json_object_set_number(so, "canceled", tally.canceled);
+    if (canary_verdict) json_object_set_string(so, "canary", canary_verdict);
+    if (groups >= 0) json_object_set_number(so, "groups", groups);
+    if (want_group) json_object_set_string(so, "group", want_group);
+    json_object_set_number(so, "elapsed_ms", (double)(now_ms() - t0));
+    broadcast_run_release_locked(run);
+    broadcast_emit(&st, "summary", sum);
+    json_value_free(sum);
+    if (st.results) json_value_free(st.results);
+    if (st.sections) json_value_free(st.sections);
+    jsonq_free(reduce);
+    json_value_free(root);
+    free(cfg);
+    return 1;
+}
+
+void broadcast_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    api_set_handler(ctx, "/sync/exec", h_sync_exec, app);
+}
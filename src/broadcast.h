@@ -0,0 +1,11 @@
+#ifndef AUTOD_BROADCAST_H
+#define AUTOD_BROADCAST_H
+
+typedef struct app app_t;
+struct mg_context;
+
+/* POST /sync/exec on a master: run one /exec body on many slaves and stream
+ * each node's result (NDJSON or SSE) as it completes, then a summary. */
+void broadcast_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
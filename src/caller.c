@@ -0,0 +1,278 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <stdint.h>
+#include <time.h>
+
+#include "civetweb.h"
+#include "autod.h"
+#include "admin.h"
+#include "enroll.h"
+#include "caller.h"
+
+/* Signed identities older or newer than this are refused, which bounds
+ * replays of a captured header. */
+#define CALLER_MAX_SKEW_S 300
+
+static _Thread_local char g_caller[CALLER_NAME_MAX];
+static _Thread_local char g_role[16];
+
+const char *caller_name(void) {
+    return g_caller;
+}
+
+const char *caller_role(void) {
+    return g_role[0] ? g_role : "local";
+}
+
+void caller_set(const char *name, const char *role) {
+    snprintf(g_caller, sizeof(g_caller), "%s", role && name ? name : "");
+    snprintf(g_role, sizeof(g_role), "%s", role ? role : "");
+}
+
+/* ---------- HMAC-SHA256 ---------- */
+
+typedef struct {
+    uint32_t h[8];
+    unsigned char buf[64];
+    size_t buf_len;
+    uint64_t total;
+} caller_sha256_t;
+
+static const uint32_t caller_k[64] = {
+    0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+    0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+    0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+    0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+    0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+    0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+    0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+    0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+};
+
+#define CALLER_ROR(x, n) (((x) >> (n)) | ((x) << (32 - (n))))
+
+static void caller_sha256_block(caller_sha256_t *s, const unsigned char *p) {
+    uint32_t w[64];
+    for (int i = 0; i < 16; i++) {
+        w[i] = (uint32_t)p[i * 4] << 24 | (uint32_t)p[i * 4 + 1] << 16 |
+               (uint32_t)p[i * 4 + 2] << 8 | (uint32_t)p[i * 4 + 3];
+    }
+    for (int i = 16; i < 64; i++) {
+        uint32_t s0 = CALLER_ROR(w[i - 15], 7) ^ CALLER_ROR(w[i - 15], 18) ^ (w[i - 15] >> 3);
+        uint32_t s1 = CALLER_ROR(w[i - 2], 17) ^ CALLER_ROR(w[i - 2], 19) ^ (w[i - 2] >> 10);
+        w[i] = w[i - 16] + s0 + w[i - 7] + s1;
+    }
+    uint32_t a = s->h[0], b = s->h[1], c = s->h[2], d = s->h[3];
+    uint32_t e = s->h[4], f = s->h[5], g = s->h[6], h = s->h[7];
+    for (int i = 0; i < 64; i++) {
+        uint32_t t1 = h + (CALLER_ROR(e, 6) ^ CALLER_ROR(e, 11) ^ CALLER_ROR(e, 25)) +
+                      ((e & f) ^ (~e & g)) + caller_k[i] + w[i];
+        uint32_t t2 = (CALLER_ROR(a, 2) ^ CALLER_ROR(a, 13) ^ CALLER_ROR(a, 22)) +
+                      ((a & b) ^ (a & c) ^ (b & c));
+        h = g; g = f; f = e; e = d + t1;
+        d = c; c = b; b = a; a = t1 + t2;
+    }
+    s->h[0] += a; s->h[1] += b; s->h[2] += c; s->h[3] += d;
+    s->h[4] += e; s->h[5] += f; s->h[6] += g; s->h[7] += h;
+}
+
+static void caller_sha256_init(caller_sha256_t *s) {
+    static const uint32_t iv[8] = {
+        0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19
+    };
+    memcpy(s->h, iv, sizeof(iv));
+    s->buf_len = 0;
+    s->total = 0;
+}
+
+static void caller_sha256_update(caller_sha256_t *s, const void *data, size_t len) {
+    const unsigned char *p = (const unsigned char *)data;
+    s->total += len;
+    while (len > 0) {
+        size_t n = 64 - s->buf_len;
+        if (n > len) n = len;
+        memcpy(s->buf + s->buf_len, p, n);
+        s->buf_len += n;
+        p += n;
+        len -= n;
+        if (s->buf_len == 64) {
+            caller_sha256_block(s, s->buf);
+            s->buf_len = 0;
+        }
+    }
+}
+
+static void caller_sha256_final(caller_sha256_t *s, unsigned char out[32]) {
+    uint64_t bits = s->total * 8;
+    unsigned char pad = 0x80;
+    caller_sha256_update(s, &pad, 1);
+    pad = 0;
+    while (s->buf_len != 56) caller_sha256_update(s, &pad, 1);
+    unsigned char len_be[8];
+    for (int i = 0; i < 8; i++) len_be[i] = (unsigned char)(bits >> (56 - 8 * i));
+    caller_sha256_update(s, len_be, 8);
+    for (int i = 0; i < 8; i++) {
+        out[i * 4] = (unsigned char)(s->h[i] >> 24);
+        out[i * 4 + 1] = (unsigned char)(s->h[i] >> 16);
+        out[i * 4 + 2] = (unsigned char)(s->h[i] >> 8);
+        out[i * 4 + 3] = (unsigned char)s->h[i];
+    }
+}
+
+static void caller_hex(const unsigned char *in, size_t len, char *out) {
+    static const char digits[] = "0123456789abcdef";
+    for (size_t i = 0; i < len; i++) {
+        out[i * 2] = digits[in[i] >> 4];
+        out[i * 2 + 1] = digits[in[i] & 15];
+    }
+    out[len * 2] = '\0';
+}
+
+/* HMAC-SHA256(key, "v1;role;name;ts;node;sha256(body)") as hex. */
+static void caller_signature(const char *key, const char *role, const char *name, long long ts,
+                             const char *node_id, const char *body, size_t len, char out[65]) {
+    unsigned char digest[32];
+    char body_hex[65];
+    caller_sha256_t s;
+    caller_sha256_init(&s);
+    if (body && len) caller_sha256_update(&s, body, len);
+    caller_sha256_final(&s, digest);
+    caller_hex(digest, 32, body_hex);
+
+    char msg[CALLER_NAME_MAX + 256];
+    int n = snprintf(msg, sizeof(msg), "v1;%s;%s;%lld;%s;%s", role, name, ts, node_id, body_hex);
+    if (n < 0 || (size_t)n >= sizeof(msg)) n = (int)strlen(msg);
+
+    unsigned char k[64];
+    memset(k, 0, sizeof(k));
+    memcpy(k, key, strlen(key) < sizeof(k) ? strlen(key) : sizeof(k));
+    unsigned char pad[64];
+    for (int i = 0; i < 64; i++) pad[i] = k[i] ^ 0x36;
+    caller_sha256_init(&s);
+    caller_sha256_update(&s, pad, 64);
+    caller_sha256_update(&s, msg, (size_t)n);
+    caller_sha256_final(&s, digest);
+    for (int i = 0; i < 64; i++) pad[i] = k[i] ^ 0x5c;
+    caller_sha256_init(&s);
+    caller_sha256_update(&s, pad, 64);
+    caller_sha256_update(&s, digest, 32);
+    caller_sha256_final(&s, digest);
+    caller_hex(digest, 32, out);
+}
+
+int caller_sha256_file(const char *file, char out[65]) {
+    FILE *f = fopen(file, "rb");
+    if (!f) return -1;
+    caller_sha256_t s;
+    caller_sha256_init(&s);
+    unsigned char buf[8192];
+    size_t n;
+    while ((n = fread(buf, 1, sizeof(buf), f)) > 0) caller_sha256_update(&s, buf, n);
+    int failed = ferror(f);
+    fclose(f);
+    if (failed) return -1;
+    unsigned char digest[32];
+    caller_sha256_final(&s, digest);
+    caller_hex(digest, 32, out);
+    return 0;
+}
+
+/* ---------- Identification ---------- */
+
+/* Names travel in a header field separated by ';'. */
+static int caller_name_valid(const char *s) {
+    size_t len = strlen(s);
+    return len > 0 && len < CALLER_NAME_MAX &&
+           strspn(s, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789._:@-") == len;
+}
+
+static int caller_role_signable(const char *role) {
+    return !strcmp(role, "admin") || !strcmp(role, "client") || !strcmp(role, "master");
+}
+
+/* "v1;ROLE;NAME;TS;SIG", signed for this node. */
+static const char *caller_verify(const config_t *cfg, const char *header,
+                                 const char *body, size_t len) {
+    char buf[CALLER_HEADER_MAX];
+    if (strlen(header) >= sizeof(buf)) return "malformed";
+    snprintf(buf, sizeof(buf), "%s", header);
+    char *f[5];
+    int nf = 0;
+    char *save = NULL;
+    for (char *tok = strtok_r(buf, ";", &save); tok && nf < 5; tok = strtok_r(NULL, ";", &save)) {
+        f[nf++] = tok;
+    }
+    if (nf != 5 || strcmp(f[0], "v1") || !caller_role_signable(f[1]) || !caller_name_valid(f[2])) {
+        return "malformed";
+    }
+    char *end = NULL;
+    long long ts = strtoll(f[3], &end, 10);
+    if (!*f[3] || *end) return "malformed";
+    char key[80];
+    if (enroll_credential(NULL, key, sizeof(key)) != 0) return "no_credential";
+    long long now = (long long)time(NULL);
+    if (ts < now - CALLER_MAX_SKEW_S || ts > now + CALLER_MAX_SKEW_S) return "stale_signature";
+    char want[65];
+    caller_signature(key, f[1], f[2], ts, cfg->sync_id, body, len, want);
+    if (!admin_token_equal(f[4], want)) return "bad_signature";
+    caller_set(f[2], f[1]);
+    return NULL;
+}
+
+const char *caller_identify(struct mg_connection *c, const config_t *cfg,
+                            const char *body, size_t len) {
+    caller_set("", "anonymous");
+    if (!c || !cfg) return NULL;
+    const char *signed_hdr = mg_get_header(c, "X-Autod-Caller");
+    if (signed_hdr) return caller_verify(cfg, signed_hdr, body, len);
+
+    const server_listen_t *l = server_listener(cfg, c);
+    if (l && l->admin_exempt) {
+        caller_set("admin", "admin");
+        return NULL;
+    }
+    const char *presented = mg_get_header(c, "X-Admin-Token");
+    if (!presented) presented = mg_get_header(c, "X-Client-Token");
+    const char *auth = mg_get_header(c, "Authorization");
+    if (!presented && auth && !strncasecmp(auth, "Bearer ", 7)) {
+        presented = auth + 7;
+        while (*presented == ' ') presented++;
+    }
+    if (!presented || !*presented) return NULL;
+    if (cfg->admin.token[0] && admin_token_equal(presented, cfg->admin.token)) {
+        caller_set("admin", "admin");
+        return NULL;
+    }
+    for (int i = 0; i < cfg->quota.client_count; i++) {
+        const quota_client_t *q = &cfg->quota.clients[i];
+        if (q->token[0] && admin_token_equal(presented, q->token)) {
+            caller_set(q->name, "client");
+            return NULL;
+        }
+    }
+    return NULL;
+}
+
+void caller_sign_header(const char *node_id, const char *body, size_t len,
+                        char *out, size_t out_sz) {
+    if (!out || out_sz == 0) return;
+    out[0] = '\0';
+    if (!node_id || !*node_id || !caller_role_signable(caller_role()) ||
+        !caller_name_valid(g_caller)) {
+        return;
+    }
+    char key[80];
+    if (enroll_credential(node_id, key, sizeof(key)) != 0) return;
+    long long ts = (long long)time(NULL);
+    char sig[65];
+    caller_signature(key, g_role, g_caller, ts, node_id, body, len, sig);
+    int n = snprintf(out, out_sz, "X-Autod-Caller: v1;%s;%s;%lld;%s\r\n", g_role, g_caller, ts, sig);
+    if (n < 0 || (size_t)n >= out_sz) out[0] = '\0';
+}
+
+void caller_export_env(void) {
+    setenv("AUTOD_CALLER", g_caller, 1);
+    setenv("AUTOD_CALLER_ROLE", caller_role(), 1);
+}
@@ -0,0 +1,48 @@
+#ifndef AUTOD_CALLER_H
+#define AUTOD_CALLER_H
+
+#include <stddef.h>
+
+#define CALLER_NAME_MAX 64
+#define CALLER_HEADER_MAX 192
+
+/* Who asked for a command. A request proves it with the admin token (role
+ * "admin"), a [quota.NAME] token (the client's name, role "client"),
+ * or an X-Autod-Caller header that the node's master signed with the node's
+ * enroll credential, carrying the identity the master verified. Slot
+ * commands come from the master ("master"); the daemon's own runs (startup,
+ * dead-man, ...) are "local"; anything else is "anonymous". Handlers get it
+ * as AUTOD_CALLER and AUTOD_CALLER_ROLE, and the job history records it.
+ * Like the request id it is kept per thread. */
+
+typedef struct config config_t;
+struct mg_connection;
+
+/* The identity of the work this thread is doing. Role "local" (and an empty
+ * name) until something sets it. */
+const char *caller_name(void);
+const char *caller_role(void);
+/* Adopt an identity (NULL role = back to "local"). */
+void caller_set(const char *name, const char *role);
+
+/* Establish the identity of the request on c, whose body is body/len (the
+ * signed header covers it). Returns NULL, or why an X-Autod-Caller header
+ * was not accepted ("bad_signature", "stale_signature", "no_credential",
+ * "malformed"); the request is then anonymous. */
+const char *caller_identify(struct mg_connection *c, const config_t *cfg,
+                            const char *body, size_t len);
+
+/* Master: the X-Autod-Caller header line (CRLF-terminated) vouching for this
+ * thread's identity to node_id for a request carrying body, or "" when the
+ * identity is not verified or the node holds no enroll credential. */
+void caller_sign_header(const char *node_id, const char *body, size_t len,
+                        char *out, size_t out_sz);
+
+/* Export AUTOD_CALLER / AUTOD_CALLER_ROLE (in a forked child). */
+void caller_export_env(void);
+
+/* SHA-256 of a file's contents as lowercase hex (the digest the signatures
+ * use, shared with exec integrity checks). Returns -1 when it cannot be read. */
+int caller_sha256_file(const char *file, char out[65]);
+
+#endif
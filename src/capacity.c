@@ -0,0 +1,188 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <pthread.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "events.h"
+#include "capacity.h"
+
+static const char *const g_names[CAPACITY_RESOURCES] = {"nodes", "slots", "jobs"};
+static const char *const g_keys[CAPACITY_RESOURCES] = {"max_nodes", "max_slots", "max_jobs_in_memory"};
+static const int g_max[CAPACITY_RESOURCES] = {SYNC_MAX_SLAVES, SYNC_MAX_SLOTS, JOBS_MAX_RUNNING};
+
+static pthread_mutex_t g_capacity_lock = PTHREAD_MUTEX_INITIALIZER;
+static int g_used[CAPACITY_RESOURCES];
+static int g_warned[CAPACITY_RESOURCES];      /* capacity_warning sent, not yet below warn_pct */
+static int g_full_logged[CAPACITY_RESOURCES]; /* refusal logged, not yet below the cap */
+static unsigned long g_rejected[CAPACITY_RESOURCES];
+static int g_jobs;
+
+void capacity_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    cfg->capacity.max_nodes = SYNC_MAX_SLAVES;
+    cfg->capacity.max_slots = SYNC_MAX_SLOTS;
+    cfg->capacity.max_jobs_in_memory = JOBS_MAX_RUNNING;
+    cfg->capacity.warn_pct = 80;
+}
+
+int capacity_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (strcmp(section, "capacity") != 0) return 0;
+    capacity_config_t *c = &cfg->capacity;
+    int *fields[CAPACITY_RESOURCES] = {&c->max_nodes, &c->max_slots, &c->max_jobs_in_memory};
+    char *end = NULL;
+    long v = strtol(value, &end, 10);
+    int valid = end && end != value && !*end;
+    for (int r = 0; r < CAPACITY_RESOURCES; r++) {
+        if (strcmp(key, g_keys[r]) != 0) continue;
+        if (!valid || v < 1 || v > g_max[r]) {
+            fprintf(stderr, "WARN: capacity: ignoring %s '%s' (1-%d)\n", key, value, g_max[r]);
+        } else {
+            *fields[r] = (int)v;
+        }
+        return 1;
+    }
+    if (!strcmp(key, "warn_pct")) {
+        if (!valid || v < 1 || v > 100) {
+            fprintf(stderr, "WARN: capacity: ignoring warn_pct '%s' (1-100)\n", value);
+        } else {
+            c->warn_pct = (int)v;
+        }
+    } else {
+        fprintf(stderr, "WARN: ignoring unknown capacity key '%s'\n", key);
+    }
+    return 1;
+}
+
+int capacity_limit(const config_t *cfg, capacity_resource_t r) {
+    const capacity_config_t *c = &cfg->capacity;
+    int v = r == CAPACITY_NODES ? c->max_nodes : r == CAPACITY_SLOTS ? c->max_slots
+                                                                     : c->max_jobs_in_memory;
+    return v >= 1 && v <= g_max[r] ? v : g_max[r];
+}
+
+static int capacity_warn_level(const config_t *cfg, int limit) {
+    int pct = cfg->capacity.warn_pct >= 1 && cfg->capacity.warn_pct <= 100 ? cfg->capacity.warn_pct : 80;
+    int level = (limit * pct + 99) / 100;
+    return level < 1 ? 1 : level;
+}
+
+void capacity_note(const config_t *cfg, capacity_resource_t r, int used) {
+    if (!cfg || r < 0 || r >= CAPACITY_RESOURCES) return;
+    int limit = capacity_limit(cfg, r);
+    int level = capacity_warn_level(cfg, limit);
+    pthread_mutex_lock(&g_capacity_lock);
+    g_used[r] = used;
+    if (used < limit) g_full_logged[r] = 0;
+    int fire = used >= level && !g_warned[r];
+    g_warned[r] = used >= level;
+    pthread_mutex_unlock(&g_capacity_lock);
+    if (!fire) return;
+    fprintf(stderr, "WARN: capacity: %s at %d of %d (%s)\n", g_names[r], used, limit, g_keys[r]);
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_string(eo, "resource", g_names[r]);
+    json_object_set_number(eo, "used", used);
+    json_object_set_number(eo, "limit", limit);
+    json_object_set_number(eo, "pct", used * 100 / limit);
+    (void)events_emit("capacity_warning", ev);
+}
+
+void capacity_reject(const config_t *cfg, capacity_resource_t r, int requested) {
+    if (!cfg || r < 0 || r >= CAPACITY_RESOURCES) return;
+    pthread_mutex_lock(&g_capacity_lock);
+    g_rejected[r]++;
+    int log = !g_full_logged[r];
+    g_full_logged[r] = 1;
+    unsigned long total = g_rejected[r];
+    pthread_mutex_unlock(&g_capacity_lock);
+    if (log) {
+        fprintf(stderr, "WARN: capacity: %s: requested %d > %s %d, refusing (%lu so far)\n",
+                g_names[r], requested, g_keys[r], capacity_limit(cfg, r), total);
+    }
+}
+
+int capacity_job_acquire(const config_t *cfg) {
+    int limit = capacity_limit(cfg, CAPACITY_JOBS);
+    pthread_mutex_lock(&g_capacity_lock);
+    int used = g_jobs;
+    int ok = used < limit;
+    if (ok) used = ++g_jobs;
+    pthread_mutex_unlock(&g_capacity_lock);
+    if (ok) capacity_note(cfg, CAPACITY_JOBS, used);
+    else capacity_reject(cfg, CAPACITY_JOBS, used + 1);
+    return ok ? 0 : -1;
+}
+
+void capacity_job_release(void) {
+    pthread_mutex_lock(&g_capacity_lock);
+    if (g_jobs > 0) g_jobs--;
+    g_used[CAPACITY_JOBS] = g_jobs;
+    g_full_logged[CAPACITY_JOBS] = 0;
+    pthread_mutex_unlock(&g_capacity_lock);
+}
+
+void capacity_snapshot(app_t *app, const config_t *cfg, capacity_usage_t out[CAPACITY_RESOURCES],
+                       int *stale_nodes) {
+    long long stale_ms = (long long)(cfg->sync_node_down_after_s > 0 ? cfg->sync_node_down_after_s : 90) * 1000;
+    int used[CAPACITY_RESOURCES];
+    used[CAPACITY_NODES] = sync_master_registry_count(app, stale_ms, stale_nodes);
+    used[CAPACITY_SLOTS] = sync_slot_count(cfg);
+    pthread_mutex_lock(&g_capacity_lock);
+    used[CAPACITY_JOBS] = g_jobs;
+    for (int r = 0; r < CAPACITY_RESOURCES; r++) {
+        out[r].name = g_names[r];
+        out[r].used = used[r];
+        out[r].limit = capacity_limit(cfg, r);
+        out[r].rejected = g_rejected[r];
+        out[r].warning = used[r] >= capacity_warn_level(cfg, out[r].limit);
+    }
+    pthread_mutex_unlock(&g_capacity_lock);
+}
+
+/* GET /capacity — usage against each cap and the refusals since startup. */
+static int h_capacity(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri || strcmp(ri->request_method, "GET") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        return 1;
+    }
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    capacity_usage_t u[CAPACITY_RESOURCES];
+    int stale = 0;
+    capacity_snapshot(app, cfg, u, &stale);
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_number(o, "warn_pct", cfg->capacity.warn_pct);
+    JSON_Value *rv = json_value_init_object();
+    for (int r = 0; r < CAPACITY_RESOURCES; r++) {
+        JSON_Value *ev = json_value_init_object();
+        JSON_Object *eo = json_object(ev);
+        json_object_set_number(eo, "used", u[r].used);
+        json_object_set_number(eo, "limit", u[r].limit);
+        json_object_set_number(eo, "pct", u[r].used * 100 / u[r].limit);
+        json_object_set_number(eo, "rejected", (double)u[r].rejected);
+        json_object_set_boolean(eo, "warning", u[r].warning);
+        if (r == CAPACITY_NODES) json_object_set_number(eo, "stale", stale);
+        json_object_set_value(json_object(rv), u[r].name, ev);
+    }
+    json_object_set_value(o, "resources", rv);
+    free(cfg);
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+    return 1;
+}
+
+void capacity_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    api_set_handler(ctx, "/capacity", h_capacity, app);
+}
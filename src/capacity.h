@@ -0,0 +1,64 @@
+#ifndef AUTOD_CAPACITY_H
+#define AUTOD_CAPACITY_H
+
+/* [capacity] — how much of its fixed tables the daemon lets fill: registry
+ * records, slots and tracked exec runs. A misconfigured scan or a burst of
+ * bogus registrations otherwise runs the registry up to its compiled-in size
+ * with nothing to show for it until registrations start failing. Usage
+ * reaching warn_pct emits capacity_warning; admissions past a cap are
+ * refused and counted. */
+typedef struct {
+    int max_nodes;            /* registry records, bench nodes excluded (1-64) */
+    int max_slots;            /* slots the master hands out (1-32) */
+    int max_jobs_in_memory;   /* exec runs tracked at once (1-32) */
+    int warn_pct;             /* capacity_warning at this share of a cap (1-100) */
+} capacity_config_t;
+
+typedef enum {
+    CAPACITY_NODES,
+    CAPACITY_SLOTS,
+    CAPACITY_JOBS,
+    CAPACITY_RESOURCES
+} capacity_resource_t;
+
+typedef struct {
+    const char *name;         /* nodes, slots, jobs */
+    int used;
+    int limit;
+    unsigned long rejected;   /* admissions refused at the cap since startup */
+    int warning;              /* used has reached warn_pct of limit */
+} capacity_usage_t;
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_context;
+
+void capacity_cfg_defaults(config_t *cfg);
+int capacity_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* The cap on r. */
+int capacity_limit(const config_t *cfg, capacity_resource_t r);
+
+/* Report the usage of r after it grew. Emits capacity_warning (and logs it)
+ * when used reaches warn_pct of the cap, once until it drops back below. */
+void capacity_note(const config_t *cfg, capacity_resource_t r, int used);
+
+/* Count an admission refused because it would take r to requested, past its
+ * cap. The first refusal after usage last dropped below the cap is logged. */
+void capacity_reject(const config_t *cfg, capacity_resource_t r, int requested);
+
+/* Before forking an exec child: take one of max_jobs_in_memory places.
+ * Returns -1 (counted as a refusal) when all are taken; a 0 return is paired
+ * with capacity_job_release() once the run was reaped. */
+int capacity_job_acquire(const config_t *cfg);
+void capacity_job_release(void);
+
+/* Current usage of every resource, indexed by capacity_resource_t, and the
+ * registry records that hold no slot and were not heard from for
+ * [sync] node_down_after_s (left until slot_retention_s prunes them). */
+void capacity_snapshot(app_t *app, const config_t *cfg, capacity_usage_t out[CAPACITY_RESOURCES],
+                       int *stale_nodes);
+
+void capacity_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
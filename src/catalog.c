@@ -0,0 +1,537 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <fnmatch.h>
+#include <time.h>
+#include <unistd.h>
+#include <pthread.h>
+#include <stdint.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "catalog.h"
+#include "integrity.h"
+
+/* The catalog in force: on a slave the one received from the master, on a
+ * master one set through the API (which overrides [catalog] allow). */
+static pthread_mutex_t g_catalog_lock = PTHREAD_MUTEX_INITIALIZER;
+static struct {
+    int active;
+    int count;
+    char allow[CATALOG_MAX_ENTRIES][128];
+    char version[17];
+    char source[8];            /* master, api, file */
+    long long updated_unix;
+} g_catalog;
+
+void catalog_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->catalog, 0, sizeof(cfg->catalog));
+}
+
+static void catalog_add_glob(char list[][128], int *count, const char *value, const char *key) {
+    if (*count >= CATALOG_MAX_ENTRIES) {
+        fprintf(stderr, "WARN: catalog %s capacity reached (%d)\n", key, CATALOG_MAX_ENTRIES);
+        return;
+    }
+    strncpy(list[*count], value, sizeof(list[0]) - 1);
+    list[*count][sizeof(list[0]) - 1] = '\0';
+    (*count)++;
+}
+
+static catalog_command_t *catalog_command_find_or_add(config_t *cfg, const char *name) {
+    catalog_config_t *c = &cfg->catalog;
+    for (int i = 0; i < c->command_count; i++) {
+        if (strcmp(c->commands[i].name, name) == 0) return &c->commands[i];
+    }
+    if (c->command_count >= CATALOG_MAX_COMMANDS) return NULL;
+    /* Config is only parsed at startup, so the table lives as long as the
+     * process; snapshots just point at it. */
+    if (!c->commands) c->commands = calloc(CATALOG_MAX_COMMANDS, sizeof(*c->commands));
+    if (!c->commands) return NULL;
+    catalog_command_t *cmd = &c->commands[c->command_count++];
+    memset(cmd, 0, sizeof(*cmd));
+    strncpy(cmd->name, name, sizeof(cmd->name) - 1);
+    return cmd;
+}
+
+static int catalog_command_parse(config_t *cfg, const char *name, const char *key, const char *value) {
+    catalog_command_t *cmd = catalog_command_find_or_add(cfg, name);
+    if (!cmd) {
+        fprintf(stderr, "WARN: command capacity reached (%d)\n", CATALOG_MAX_COMMANDS);
+        return 1;
+    }
+    if (!strcmp(key, "path")) {
+        if (value[0] != '/' || strlen(value) >= sizeof(cmd->path)) {
+            fprintf(stderr, "WARN: command %s: ignoring path '%s'\n", cmd->name, value);
+        } else {
+            strcpy(cmd->path, value);
+        }
+    } else if (!strcmp(key, "description")) {
+        strncpy(cmd->description, value, sizeof(cmd->description) - 1);
+        cmd->description[sizeof(cmd->description) - 1] = '\0';
+    } else if (!strcmp(key, "roles")) {
+        strncpy(cmd->roles, value, sizeof(cmd->roles) - 1);
+        cmd->roles[sizeof(cmd->roles) - 1] = '\0';
+    } else if (!strcmp(key, "sha256")) {
+        if (integrity_parse_digest(value, cmd->sha256) != 0) {
+            fprintf(stderr, "WARN: command %s: ignoring sha256 '%s' (expected 64 hex digits)\n",
+                    cmd->name, value);
+        }
+    } else if (!strcmp(key, "param")) {
+        char pname[32], ptype[16];
+        if (sscanf(value, "%31s %15s", pname, ptype) != 2 || strlen(value) >= sizeof(cmd->params[0])) {
+            fprintf(stderr, "WARN: command %s: ignoring param '%s' (expected NAME TYPE [required] "
+                            "description)\n", cmd->name, value);
+        } else if (cmd->param_count >= CATALOG_MAX_PARAMS) {
+            fprintf(stderr, "WARN: command %s: param capacity reached (%d)\n",
+                    cmd->name, CATALOG_MAX_PARAMS);
+        } else {
+            strcpy(cmd->params[cmd->param_count++], value);
+        }
+    } else if (!strcmp(key, "example")) {
+        JSON_Value *v = json_parse_string(value);
+        if (json_value_get_type(v) != JSONObject || strlen(value) >= sizeof(cmd->examples[0])) {
+            fprintf(stderr, "WARN: command %s: ignoring example (expected an /exec body up to %d "
+                            "bytes)\n", cmd->name, (int)sizeof(cmd->examples[0]) - 1);
+        } else if (cmd->example_count >= CATALOG_MAX_EXAMPLES) {
+            fprintf(stderr, "WARN: command %s: example capacity reached (%d)\n",
+                    cmd->name, CATALOG_MAX_EXAMPLES);
+        } else {
+            strcpy(cmd->examples[cmd->example_count++], value);
+        }
+        if (v) json_value_free(v);
+    } else {
+        fprintf(stderr, "WARN: command %s: ignoring unknown key '%s'\n", cmd->name, key);
+    }
+    return 1;
+}
+
+int catalog_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (!strncmp(section, "command.", 8) && section[8]) {
+        return catalog_command_parse(cfg, section + 8, key, value);
+    }
+    if (strcmp(section, "catalog") != 0) return 0;
+    catalog_config_t *c = &cfg->catalog;
+    if (!strcmp(key, "allow")) {
+        catalog_add_glob(c->allow, &c->allow_count, value, key);
+    } else if (!strcmp(key, "limit")) {
+        catalog_add_glob(c->limit, &c->limit_count, value, key);
+    } else if (!strcmp(key, "path")) {
+        strncpy(c->path, value, sizeof(c->path) - 1);
+        c->path[sizeof(c->path) - 1] = '\0';
+    } else if (!strcmp(key, "require")) {
+        c->require = atoi(value);
+    } else {
+        fprintf(stderr, "WARN: ignoring unknown catalog key '%s'\n", key);
+    }
+    return 1;
+}
+
+static void catalog_version_of(const char list[][128], int count, char *out, size_t out_sz) {
+    uint64_t h = 1469598103934665603ULL;
+    for (int i = 0; i < count; i++) {
+        for (const char *p = list[i]; *p; p++) {
+            h ^= (unsigned char)*p;
+            h *= 1099511628211ULL;
+        }
+        h ^= '\n';
+        h *= 1099511628211ULL;
+    }
+    snprintf(out, out_sz, "%016llx", (unsigned long long)h);
+}
+
+/* An entry is a glob, optionally followed by " key=value" options
+ * (profile=NAME, parse_output=json, redact=NAME, cacheable=TTL, blackout=exempt). */
+static int catalog_entry_matches(const char *entry, const char *path) {
+    char glob[128];
+    snprintf(glob, sizeof(glob), "%s", entry);
+    char *sp = strchr(glob, ' ');
+    if (sp) *sp = '\0';
+    return fnmatch(glob, path, 0) == 0;
+}
+
+static int catalog_entry_option(const char *entry, const char *key, char *out, size_t out_sz) {
+    char needle[40];
+    int nl = snprintf(needle, sizeof(needle), " %s=", key);
+    if (nl <= 0 || nl >= (int)sizeof(needle)) return -1;
+    const char *p = strstr(entry, needle);
+    if (!p || !p[nl]) return -1;
+    p += nl;
+    size_t n = strcspn(p, " ");
+    if (n == 0 || n >= out_sz) return -1;
+    memcpy(out, p, n);
+    out[n] = '\0';
+    return 0;
+}
+
+static int catalog_match(const char list[][128], int count, const char *path) {
+    for (int i = 0; i < count; i++) {
+        if (catalog_entry_matches(list[i], path)) return 1;
+    }
+    return 0;
+}
+
+/* Replace the catalog in force from a JSON array of globs. */
+static int catalog_set_locked(JSON_Array *allow, const char *source) {
+    if (!allow || json_array_get_count(allow) > CATALOG_MAX_ENTRIES) return -1;
+    size_t n = json_array_get_count(allow);
+    for (size_t i = 0; i < n; i++) {
+        const char *g = json_array_get_string(allow, i);
+        if (!g || !*g || strlen(g) >= sizeof(g_catalog.allow[0])) return -1;
+    }
+    memset(&g_catalog, 0, sizeof(g_catalog));
+    for (size_t i = 0; i < n; i++) {
+        strncpy(g_catalog.allow[i], json_array_get_string(allow, i), sizeof(g_catalog.allow[0]) - 1);
+    }
+    g_catalog.count = (int)n;
+    g_catalog.active = 1;
+    strncpy(g_catalog.source, source, sizeof(g_catalog.source) - 1);
+    g_catalog.updated_unix = (long long)time(NULL);
+    catalog_version_of(g_catalog.allow, g_catalog.count, g_catalog.version, sizeof(g_catalog.version));
+    return 0;
+}
+
+static JSON_Value *catalog_to_json(const char list[][128], int count, const char *version) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "version", version);
+    JSON_Value *arr = json_value_init_array();
+    for (int i = 0; i < count; i++) json_array_append_string(json_array(arr), list[i]);
+    json_object_set_value(o, "allow", arr);
+    return v;
+}
+
+/* Write the catalog in force to [catalog] path (or remove the file when
+ * none is in force). The file is replaced atomically. */
+static void catalog_persist_locked(const config_t *cfg) {
+    if (!cfg->catalog.path[0]) return;
+    if (!g_catalog.active) {
+        (void)unlink(cfg->catalog.path);
+        return;
+    }
+    JSON_Value *v = catalog_to_json(g_catalog.allow, g_catalog.count, g_catalog.version);
+    json_object_set_number(json_object(v), "updated", (double)g_catalog.updated_unix);
+    char tmp[sizeof(cfg->catalog.path) + 8];
+    snprintf(tmp, sizeof(tmp), "%s.tmp", cfg->catalog.path);
+    if (json_serialize_to_file_pretty(v, tmp) != JSONSuccess ||
+        rename(tmp, cfg->catalog.path) != 0) {
+        fprintf(stderr, "WARN: cannot write catalog to %s\n", cfg->catalog.path);
+        (void)unlink(tmp);
+    }
+    json_value_free(v);
+}
+
+void catalog_load(const config_t *cfg) {
+    if (!cfg || !cfg->catalog.path[0] || access(cfg->catalog.path, F_OK) != 0) return;
+    JSON_Value *v = json_parse_file(cfg->catalog.path);
+    pthread_mutex_lock(&g_catalog_lock);
+    int r = catalog_set_locked(json_object_get_array(json_object(v), "allow"), "file");
+    if (r == 0) {
+        double updated = json_object_get_number(json_object(v), "updated");
+        if (updated > 0) g_catalog.updated_unix = (long long)updated;
+        fprintf(stderr, "catalog: loaded %d entries (version %s) from %s\n",
+                g_catalog.count, g_catalog.version, cfg->catalog.path);
+    }
+    pthread_mutex_unlock(&g_catalog_lock);
+    if (r != 0) fprintf(stderr, "WARN: ignoring malformed catalog %s\n", cfg->catalog.path);
+    if (v) json_value_free(v);
+}
+
+JSON_Value *catalog_published_json(const config_t *cfg) {
+    if (!cfg) return NULL;
+    JSON_Value *v = NULL;
+    pthread_mutex_lock(&g_catalog_lock);
+    if (g_catalog.active) {
+        v = catalog_to_json(g_catalog.allow, g_catalog.count, g_catalog.version);
+    }
+    pthread_mutex_unlock(&g_catalog_lock);
+    if (!v && cfg->catalog.allow_count > 0) {
+        char version[17];
+        catalog_version_of(cfg->catalog.allow, cfg->catalog.allow_count, version, sizeof(version));
+        v = catalog_to_json(cfg->catalog.allow, cfg->catalog.allow_count, version);
+    }
+    return v;
+}
+
+void catalog_current_version(char *out, size_t out_sz) {
+    if (!out || out_sz == 0) return;
+    pthread_mutex_lock(&g_catalog_lock);
+    strncpy(out, g_catalog.active ? g_catalog.version : "", out_sz - 1);
+    out[out_sz - 1] = '\0';
+    pthread_mutex_unlock(&g_catalog_lock);
+}
+
+int catalog_apply(const config_t *cfg, JSON_Object *catalog) {
+    JSON_Array *allow = json_object_get_array(catalog, "allow");
+    if (!allow) return -1;
+    pthread_mutex_lock(&g_catalog_lock);
+    char before[sizeof(g_catalog.version)] = "";
+    long long before_updated = g_catalog.updated_unix;
+    if (g_catalog.active) memcpy(before, g_catalog.version, sizeof(before));
+    int r = catalog_set_locked(allow, "master");
+    if (r == 0 && strcmp(before, g_catalog.version) == 0) {
+        g_catalog.updated_unix = before_updated;
+        pthread_mutex_unlock(&g_catalog_lock);
+        return 0;
+    }
+    if (r == 0) {
+        fprintf(stderr, "sync slave: command catalog %s applied (%d entries)\n",
+                g_catalog.version, g_catalog.count);
+        catalog_persist_locked(cfg);
+    }
+    pthread_mutex_unlock(&g_catalog_lock);
+    return r == 0 ? 1 : -1;
+}
+
+int catalog_allows(const config_t *cfg, const char *path) {
+    if (!cfg || !path) return 0;
+    if (cfg->catalog.limit_count > 0 &&
+        !catalog_match(cfg->catalog.limit, cfg->catalog.limit_count, path)) {
+        return 0;
+    }
+    if (strcasecmp(cfg->sync_role, "slave") != 0) return 1;
+    pthread_mutex_lock(&g_catalog_lock);
+    int ok = g_catalog.active ? catalog_match(g_catalog.allow, g_catalog.count, path)
+                              : !cfg->catalog.require;
+    pthread_mutex_unlock(&g_catalog_lock);
+    return ok;
+}
+
+static int catalog_option_in(const char list[][128], int count, const char *path,
+                             const char *key, char *out, size_t out_sz) {
+    for (int i = 0; i < count; i++) {
+        if (catalog_entry_matches(list[i], path)) {
+            return catalog_entry_option(list[i], key, out, out_sz);
+        }
+    }
+    return -1;
+}
+
+int catalog_option_for(const config_t *cfg, const char *path, const char *key,
+                       char *out, size_t out_sz) {
+    if (!cfg || !path || !key || !out || out_sz == 0) return -1;
+    pthread_mutex_lock(&g_catalog_lock);
+    int r = g_catalog.active
+        ? catalog_option_in(g_catalog.allow, g_catalog.count, path, key, out, out_sz)
+        : catalog_option_in(cfg->catalog.allow, cfg->catalog.allow_count, path, key, out, out_sz);
+    pthread_mutex_unlock(&g_catalog_lock);
+    if (r != 0) {
+        r = catalog_option_in(cfg->catalog.limit, cfg->catalog.limit_count, path, key, out, out_sz);
+    }
+    return r;
+}
+
+/* GET shows the catalog this node publishes (master) or enforces (slave).
+ * A master also accepts PUT {"allow":[...]} to replace it at runtime and
+ * DELETE to fall back to its [catalog] allow lines. */
+static int h_sync_catalog(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri) {
+        free(cfg);
+        return 0;
+    }
+    int master = strcasecmp(cfg->sync_role, "master") == 0;
+    const char *m = ri->request_method;
+
+    if (master && (!strcmp(m, "PUT") || !strcmp(m, "POST"))) {
+        upload_t u = {0};
+        if (read_body(c, &u) != 0) {
+            free(u.body);
+            send_json_error(c, 400, "body_read_failed");
+            free(cfg);
+            return 1;
+        }
+        JSON_Value *root = json_parse_string(u.body ? u.body : "");
+        free(u.body);
+        pthread_mutex_lock(&g_catalog_lock);
+        int r = root ? catalog_set_locked(json_object_get_array(json_object(root), "allow"), "api") : -1;
+        if (r == 0) {
+            catalog_persist_locked(cfg);
+            fprintf(stderr, "sync master: command catalog %s published (%d entries)\n",
+                    g_catalog.version, g_catalog.count);
+        }
+        pthread_mutex_unlock(&g_catalog_lock);
+        if (root) json_value_free(root);
+        if (r != 0) {
+            send_json_error(c, 400, root ? "invalid_catalog" : "bad_json");
+            free(cfg);
+            return 1;
+        }
+    } else if (master && !strcmp(m, "DELETE")) {
+        pthread_mutex_lock(&g_catalog_lock);
+        memset(&g_catalog, 0, sizeof(g_catalog));
+        catalog_persist_locked(cfg);
+        pthread_mutex_unlock(&g_catalog_lock);
+    } else if (strcmp(m, "GET") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+
+    JSON_Value *resp = NULL;
+    const char *source = "config";
+    pthread_mutex_lock(&g_catalog_lock);
+    if (g_catalog.active) {
+        resp = catalog_to_json(g_catalog.allow, g_catalog.count, g_catalog.version);
+        source = g_catalog.source;
+        json_object_set_string(json_object(resp), "source", source);
+        json_object_set_number(json_object(resp), "updated", (double)g_catalog.updated_unix);
+    }
+    pthread_mutex_unlock(&g_catalog_lock);
+    if (!resp && master) resp = catalog_published_json(cfg);
+    if (resp && !json_object_has_value(json_object(resp), "source")) {
+        json_object_set_string(json_object(resp), "source", source);
+    }
+    if (!resp) {
+        resp = json_value_init_object();
+        json_object_set_null(json_object(resp), "version");
+    }
+    JSON_Object *ro = json_object(resp);
+    json_object_set_string(ro, "role", master ? "master" : cfg->sync_role);
+    if (cfg->catalog.limit_count > 0) {
+        JSON_Value *arr = json_value_init_array();
+        for (int i = 0; i < cfg->catalog.limit_count; i++) {
+            json_array_append_string(json_array(arr), cfg->catalog.limit[i]);
+        }
+        json_object_set_value(ro, "limit", arr);
+    }
+    if (!master) json_object_set_boolean(ro, "require", cfg->catalog.require != 0);
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+    free(cfg);
+    return 1;
+}
+
+static const catalog_command_t *catalog_command_for(const config_t *cfg, const char *path) {
+    for (int i = 0; i < cfg->catalog.command_count; i++) {
+        const catalog_command_t *cmd = &cfg->catalog.commands[i];
+        if (cmd->path[0] && fnmatch(cmd->path, path, 0) == 0) return cmd;
+    }
+    return NULL;
+}
+
+static int catalog_command_has_role(const catalog_command_t *cmd, const char *role) {
+    char buf[sizeof(cmd->roles)];
+    memcpy(buf, cmd->roles, sizeof(buf));
+    char *save = NULL;
+    for (char *tok = strtok_r(buf, ", \t", &save); tok; tok = strtok_r(NULL, ", \t", &save)) {
+        if (!strcasecmp(tok, role)) return 1;
+    }
+    return 0;
+}
+
+int catalog_role_allows(const config_t *cfg, const char *path, const char *role) {
+    if (!cfg || !path) return 0;
+    const catalog_command_t *cmd = catalog_command_for(cfg, path);
+    if (!cmd || !cmd->roles[0]) return 1;
+    return catalog_command_has_role(cmd, role ? role : "");
+}
+
+const char *catalog_sha256_for(const config_t *cfg, const char *path, const char *binary,
+                               const char **name) {
+    if (!cfg || !path) return NULL;
+    const catalog_command_t *cmd = catalog_command_for(cfg, path);
+    if ((!cmd || !cmd->sha256[0]) && binary) cmd = catalog_command_for(cfg, binary);
+    if (!cmd || !cmd->sha256[0]) return NULL;
+    if (name) *name = cmd->name;
+    return cmd->sha256;
+}
+
+/* One "NAME TYPE [required] description" line as {name, type, required,
+ * description}. */
+static JSON_Value *catalog_param_json(const char *line) {
+    char name[32] = "", type[16] = "";
+    int used = 0;
+    if (sscanf(line, "%31s %15s%n", name, type, &used) != 2) return NULL;
+    const char *rest = line + used;
+    while (*rest == ' ' || *rest == '\t') rest++;
+    int required = 0;
+    if (!strncmp(rest, "required", 8) && (rest[8] == '\0' || rest[8] == ' ' || rest[8] == '\t')) {
+        required = 1;
+        rest += 8;
+        while (*rest == ' ' || *rest == '\t') rest++;
+    }
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "name", name);
+    json_object_set_string(o, "type", type);
+    json_object_set_boolean(o, "required", required);
+    if (*rest) json_object_set_string(o, "description", rest);
+    return v;
+}
+
+/* GET /exec/catalog: the commands documented in [command.NAME] sections,
+ * with whether this node's catalog and limit currently let them run. */
+static int h_exec_catalog(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri) return 0;
+    if (strcmp(ri->request_method, "GET") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        return 1;
+    }
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "out_of_memory", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    JSON_Value *list = json_value_init_array();
+    for (int i = 0; i < cfg->catalog.command_count; i++) {
+        const catalog_command_t *cmd = &cfg->catalog.commands[i];
+        if (!cmd->path[0]) continue;
+        JSON_Value *item = json_value_init_object();
+        JSON_Object *io = json_object(item);
+        json_object_set_string(io, "name", cmd->name);
+        json_object_set_string(io, "path", cmd->path);
+        if (cmd->description[0]) json_object_set_string(io, "description", cmd->description);
+        JSON_Value *roles = json_value_init_array();
+        char buf[sizeof(cmd->roles)];
+        memcpy(buf, cmd->roles, sizeof(buf));
+        char *save = NULL;
+        for (char *tok = strtok_r(buf, ", \t", &save); tok; tok = strtok_r(NULL, ", \t", &save)) {
+            json_array_append_string(json_array(roles), tok);
+        }
+        json_object_set_value(io, "roles", roles);
+        JSON_Value *params = json_value_init_array();
+        for (int p = 0; p < cmd->param_count; p++) {
+            JSON_Value *pv = catalog_param_json(cmd->params[p]);
+            if (pv) json_array_append_value(json_array(params), pv);
+        }
+        json_object_set_value(io, "params", params);
+        JSON_Value *examples = json_value_init_array();
+        for (int e = 0; e < cmd->example_count; e++) {
+            JSON_Value *ev = json_parse_string(cmd->examples[e]);
+            if (ev) json_array_append_value(json_array(examples), ev);
+        }
+        json_object_set_value(io, "examples", examples);
+        if (cmd->sha256[0]) json_object_set_string(io, "sha256", cmd->sha256);
+        json_object_set_boolean(io, "allowed", catalog_allows(cfg, cmd->path));
+        json_array_append_value(json_array(list), item);
+    }
+    json_object_set_number(ro, "count", (double)json_array_get_count(json_array(list)));
+    json_object_set_value(ro, "commands", list);
+    free(cfg);
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+    return 1;
+}
+
+void catalog_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    api_set_handler(ctx, "/sync/catalog", h_sync_catalog, app);
+    api_set_handler(ctx, "/exec/catalog", h_exec_catalog, app);
+}
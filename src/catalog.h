@@ -0,0 +1,84 @@
+#ifndef AUTOD_CATALOG_H
+#define AUTOD_CATALOG_H
+
+#include <stddef.h>
+
+#include "parson.h"
+
+#define CATALOG_MAX_ENTRIES 32
+#define CATALOG_MAX_COMMANDS 24
+#define CATALOG_MAX_PARAMS 8
+#define CATALOG_MAX_EXAMPLES 3
+
+/* [command.NAME] — what a command does, for GET /exec/catalog. A command
+ * with roles is refused on /exec to callers of any other role. */
+typedef struct {
+    char name[32];
+    char path[128];                        /* exec path, or a glob for a family */
+    char description[256];
+    char roles[64];                        /* comma list of caller roles; empty = anyone */
+    char params[CATALOG_MAX_PARAMS][128];  /* "NAME TYPE [required] description" */
+    int  param_count;
+    char examples[CATALOG_MAX_EXAMPLES][192];  /* /exec bodies (JSON objects) */
+    int  example_count;
+    char sha256[65];                       /* pinned digest of the file path names; "" = none */
+} catalog_command_t;
+
+/* [catalog] — the command whitelist a master publishes to its slaves, and
+ * the local side of it on a slave. */
+typedef struct {
+    char allow[CATALOG_MAX_ENTRIES][128];  /* master: globs published to slaves */
+    int  allow_count;
+    char limit[CATALOG_MAX_ENTRIES][128];  /* local ceiling, enforced on every node */
+    int  limit_count;
+    char path[256];                        /* persisted catalog; empty = memory only */
+    int  require;                          /* slave: refuse exec until a catalog arrives */
+    catalog_command_t *commands;           /* [command.NAME] table, allocated on the first
+                                              one and shared by copies of the config */
+    int  command_count;
+} catalog_config_t;
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_context;
+
+void catalog_cfg_defaults(config_t *cfg);
+int catalog_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* Restore the catalog persisted at [catalog] path, if any. */
+void catalog_load(const config_t *cfg);
+
+/* Master: {"version","allow"} to hand to slaves, or NULL when none is set. */
+JSON_Value *catalog_published_json(const config_t *cfg);
+
+/* Slave: version of the catalog in force ("" when none). */
+void catalog_current_version(char *out, size_t out_sz);
+
+/* Slave: adopt a catalog received from the master and persist it.
+ * Returns 1 when it replaced the one in force, 0 when unchanged, -1 when
+ * malformed. */
+int catalog_apply(const config_t *cfg, JSON_Object *catalog);
+
+/* Whether this node may run path. The local limit always applies; slaves
+ * also need a catalog match once one is in force (or [catalog] require). */
+int catalog_allows(const config_t *cfg, const char *path);
+
+/* Value of a " key=value" option (profile, parse_output, redact, cacheable,
+ * blackout) on the first catalog entry matching path. Returns -1 when that
+ * entry does not set it. */
+int catalog_option_for(const config_t *cfg, const char *path, const char *key,
+                       char *out, size_t out_sz);
+
+/* Whether a caller of role may run path: refused only when the first
+ * [command.NAME] matching path lists roles and role is not among them. */
+int catalog_role_allows(const config_t *cfg, const char *path, const char *role);
+
+/* The SHA-256 pinned for path by the first [command.NAME] matching it (or,
+ * in argv mode, the binary it resolved to), with that command's name in
+ * *name. NULL when nothing pins it. */
+const char *catalog_sha256_for(const config_t *cfg, const char *path, const char *binary,
+                               const char **name);
+
+void catalog_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
@@ -0,0 +1,257 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <errno.h>
+#include <fcntl.h>
+#include <limits.h>
+#include <pthread.h>
+#include <unistd.h>
+#include <sys/stat.h>
+#include <sys/types.h>
+
+#include "autod.h"
+#include "cgroup.h"
+
+#define CGROUP_MAX_LEFTOVER 32
+#define CGROUP_DAEMON_LEAF "autod"
+
+static pthread_mutex_t g_cg_mx = PTHREAD_MUTEX_INITIALIZER;
+static unsigned long g_cg_seq;
+/* Groups whose run left processes behind; retried by cgroup_finish(). */
+static char g_leftover[CGROUP_MAX_LEFTOVER][PATH_MAX];
+static int g_leftover_count;
+
+int cgroup_limited(const exec_profile_t *p) {
+    return p && (p->cpu_pct > 0 || p->memory_max_mb > 0 || p->io_weight > 0 || p->io_max[0]);
+}
+
+static int cgroup_write(const char *dir, const char *file, const char *value) {
+    char path[PATH_MAX];
+    int n = snprintf(path, sizeof(path), "%s/%s", dir, file);
+    if (n < 0 || (size_t)n >= sizeof(path)) {
+        errno = ENAMETOOLONG;
+        return -1;
+    }
+    int fd = open(path, O_WRONLY | O_CLOEXEC);
+    if (fd < 0) return -1;
+    size_t len = strlen(value);
+    ssize_t w = write(fd, value, len);
+    int saved = errno;
+    close(fd);
+    if (w != (ssize_t)len) {
+        errno = w < 0 ? saved : EIO;
+        return -1;
+    }
+    return 0;
+}
+
+static int cgroup_read(const char *dir, const char *file, char *buf, size_t buf_sz) {
+    char path[PATH_MAX];
+    int n = snprintf(path, sizeof(path), "%s/%s", dir, file);
+    if (n < 0 || (size_t)n >= sizeof(path)) return -1;
+    FILE *f = fopen(path, "r");
+    if (!f) return -1;
+    size_t r = fread(buf, 1, buf_sz - 1, f);
+    fclose(f);
+    buf[r] = '\0';
+    return 0;
+}
+
+/* Whether the space-separated list has word. */
+static int cgroup_has_word(const char *list, const char *word) {
+    size_t len = strlen(word);
+    for (const char *p = list; (p = strstr(p, word)) != NULL; p += len) {
+        if ((p == list || p[-1] == ' ') && (p[len] == '\0' || p[len] == ' ' || p[len] == '\n')) {
+            return 1;
+        }
+    }
+    return 0;
+}
+
+const char *cgroup_check(const config_t *cfg, const exec_profile_t *p) {
+    const char *root = cfg->exec_cgroup_root;
+    if (!root[0]) return "[exec] cgroup_root is not set";
+    char controllers[256];
+    if (cgroup_read(root, "cgroup.controllers", controllers, sizeof(controllers)) != 0) {
+        return "cgroup_root is not a cgroup v2 directory";
+    }
+    if (access(root, W_OK) != 0) return "cgroup_root is not writable";
+    if (!p) return NULL;
+    if (p->cpu_pct > 0 && !cgroup_has_word(controllers, "cpu")) return "cpu controller unavailable";
+    if (p->memory_max_mb > 0 && !cgroup_has_word(controllers, "memory")) {
+        return "memory controller unavailable";
+    }
+    if ((p->io_weight > 0 || p->io_max[0]) && !cgroup_has_word(controllers, "io")) {
+        return "io controller unavailable";
+    }
+    return NULL;
+}
+
+/* Whether pid is listed in dir/cgroup.procs. */
+static int cgroup_holds(const char *dir, pid_t pid) {
+    char path[PATH_MAX];
+    snprintf(path, sizeof(path), "%s/cgroup.procs", dir);
+    FILE *f = fopen(path, "r");
+    if (!f) return 0;
+    long v;
+    int found = 0;
+    while (!found && fscanf(f, "%ld", &v) == 1) found = (pid_t)v == pid;
+    fclose(f);
+    return found;
+}
+
+int cgroup_init(const config_t *cfg) {
+    const char *root = cfg->exec_cgroup_root;
+    if (!root[0]) return 0;
+    const char *why = cgroup_check(cfg, NULL);
+    if (why) {
+        fprintf(stderr, "WARN: exec: %s (%s); profiles with cgroup limits will fail\n", why, root);
+        return -1;
+    }
+    if (cgroup_holds(root, getpid())) {
+        char leaf[PATH_MAX];
+        snprintf(leaf, sizeof(leaf), "%s/%s", root, CGROUP_DAEMON_LEAF);
+        char pid[16];
+        snprintf(pid, sizeof(pid), "%d", (int)getpid());
+        if ((mkdir(leaf, 0755) != 0 && errno != EEXIST) || cgroup_write(leaf, "cgroup.procs", pid) != 0) {
+            fprintf(stderr, "WARN: exec: cannot move the daemon into %s: %s\n", leaf, strerror(errno));
+            return -1;
+        }
+    }
+    char controllers[256];
+    if (cgroup_read(root, "cgroup.controllers", controllers, sizeof(controllers)) != 0) return -1;
+    static const char *const wanted[] = {"cpu", "memory", "io"};
+    char enabled[32] = "";
+    for (size_t i = 0; i < sizeof(wanted) / sizeof(wanted[0]); i++) {
+        if (!cgroup_has_word(controllers, wanted[i])) continue;
+        char op[16];
+        snprintf(op, sizeof(op), "+%s", wanted[i]);
+        if (cgroup_write(root, "cgroup.subtree_control", op) != 0) {
+            fprintf(stderr, "WARN: exec: cannot enable the %s controller under %s: %s\n",
+                    wanted[i], root, strerror(errno));
+            continue;
+        }
+        size_t used = strlen(enabled);
+        snprintf(enabled + used, sizeof(enabled) - used, "%s%s", used ? "," : "", wanted[i]);
+    }
+    if (!enabled[0]) {
+        fprintf(stderr, "WARN: exec: no cpu, memory or io controller under %s\n", root);
+        return -1;
+    }
+    fprintf(stderr, "exec: cgroup quotas under %s (%s)\n", root, enabled);
+    return 0;
+}
+
+static void cgroup_sweep_locked(void) {
+    int kept = 0;
+    for (int i = 0; i < g_leftover_count; i++) {
+        if (rmdir(g_leftover[i]) == 0 || errno == ENOENT) continue;
+        if (kept != i) memcpy(g_leftover[kept], g_leftover[i], sizeof(g_leftover[0]));
+        kept++;
+    }
+    g_leftover_count = kept;
+}
+
+int cgroup_create(const config_t *cfg, const exec_profile_t *p, char *dir, size_t dir_sz) {
+    const char *why = cgroup_check(cfg, p);
+    if (why) {
+        fprintf(stderr, "exec: profile %s needs cgroup limits: %s\n", p->name, why);
+        return -1;
+    }
+    pthread_mutex_lock(&g_cg_mx);
+    cgroup_sweep_locked();
+    unsigned long seq = ++g_cg_seq;
+    pthread_mutex_unlock(&g_cg_mx);
+    int n = snprintf(dir, dir_sz, "%s/exec-%d-%lu", cfg->exec_cgroup_root, (int)getpid(), seq);
+    if (n < 0 || (size_t)n >= dir_sz) {
+        fprintf(stderr, "exec: cgroup path under %s is too long\n", cfg->exec_cgroup_root);
+        dir[0] = '\0';
+        return -1;
+    }
+    if (mkdir(dir, 0755) != 0) {
+        fprintf(stderr, "exec: cannot create cgroup %s: %s\n", dir, strerror(errno));
+        dir[0] = '\0';
+        return -1;
+    }
+    char value[160];
+    const char *file = NULL;
+    if (p->cpu_pct > 0) {
+        /* Percent of one CPU per 100 ms period; above 100 spans several. */
+        snprintf(value, sizeof(value), "%ld 100000", (long)p->cpu_pct * 1000);
+        if (cgroup_write(dir, "cpu.max", value) != 0) file = "cpu.max";
+    }
+    if (!file && p->memory_max_mb > 0) {
+        snprintf(value, sizeof(value), "%lld", (long long)p->memory_max_mb * 1024 * 1024);
+        if (cgroup_write(dir, "memory.max", value) != 0) file = "memory.max";
+    }
+    if (!file && p->io_weight > 0) {
+        snprintf(value, sizeof(value), "default %d", p->io_weight);
+        if (cgroup_write(dir, "io.weight", value) != 0) file = "io.weight";
+    }
+    if (!file && p->io_max[0] && cgroup_write(dir, "io.max", p->io_max) != 0) file = "io.max";
+    if (file) {
+        fprintf(stderr, "exec: cgroup %s: cannot set %s: %s\n", dir, file, strerror(errno));
+        rmdir(dir);
+        dir[0] = '\0';
+        return -1;
+    }
+    return 0;
+}
+
+int cgroup_enter(const char *dir) {
+    if (cgroup_write(dir, "cgroup.procs", "0") != 0) {
+        dprintf(STDERR_FILENO, "cannot enter cgroup %s: %s\n", dir, strerror(errno));
+        return -1;
+    }
+    return 0;
+}
+
+/* Value of "key N" in a flat-keyed file such as cpu.stat; 0 when absent. */
+static long long cgroup_stat(const char *buf, const char *key) {
+    size_t len = strlen(key);
+    const char *p = buf;
+    while (p && *p) {
+        if (!strncmp(p, key, len) && p[len] == ' ') return strtoll(p + len + 1, NULL, 10);
+        p = strchr(p, '\n');
+        if (p) p++;
+    }
+    return 0;
+}
+
+void cgroup_finish(const char *dir, exec_usage_t *usage) {
+    char buf[2048];
+    if (usage) {
+        usage->cgroup = 1;
+        if (cgroup_read(dir, "cpu.stat", buf, sizeof(buf)) == 0) {
+            usage->cg_cpu_ms = cgroup_stat(buf, "usage_usec") / 1000;
+            usage->cg_nr_throttled = cgroup_stat(buf, "nr_throttled");
+            usage->cg_throttled_ms = cgroup_stat(buf, "throttled_usec") / 1000;
+        }
+        usage->cg_memory_peak_kb = -1;
+        if (cgroup_read(dir, "memory.peak", buf, sizeof(buf)) == 0) {
+            usage->cg_memory_peak_kb = (long)(strtoll(buf, NULL, 10) / 1024);
+        }
+        if (cgroup_read(dir, "memory.events", buf, sizeof(buf)) == 0) {
+            usage->cg_oom_kills = (long)cgroup_stat(buf, "oom_kill");
+        }
+        /* io.stat: one "MAJ:MIN rbytes=N wbytes=N ..." line per device. */
+        if (cgroup_read(dir, "io.stat", buf, sizeof(buf)) == 0) {
+            for (const char *p = buf; (p = strstr(p, "bytes=")) != NULL; p += 6) {
+                if (p - buf >= 1 && p[-1] == 'r') usage->cg_io_read_bytes += strtoll(p + 6, NULL, 10);
+                if (p - buf >= 1 && p[-1] == 'w') usage->cg_io_write_bytes += strtoll(p + 6, NULL, 10);
+            }
+        }
+    }
+    if (rmdir(dir) == 0 || errno == ENOENT) return;
+    if (errno != EBUSY) {
+        fprintf(stderr, "exec: cannot remove cgroup %s: %s\n", dir, strerror(errno));
+        return;
+    }
+    pthread_mutex_lock(&g_cg_mx);
+    if (g_leftover_count < CGROUP_MAX_LEFTOVER) {
+        snprintf(g_leftover[g_leftover_count++], sizeof(g_leftover[0]), "%s", dir);
+    } else {
+        fprintf(stderr, "exec: cgroup %s still has processes; not tracked for removal\n", dir);
+    }
+    pthread_mutex_unlock(&g_cg_mx);
+}
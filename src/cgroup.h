@@ -0,0 +1,45 @@
+#ifndef AUTOD_CGROUP_H
+#define AUTOD_CGROUP_H
+
+#include <stddef.h>
+
+#include "jobs.h"
+#include "profile.h"
+
+/* Transient cgroup v2 groups for exec children. With [exec] cgroup_root
+ * pointing at a directory delegated to the daemon (systemd Delegate=yes, or
+ * one made for it), a run whose profile sets cpu_pct, memory_max_mb,
+ * io_weight or io_max gets its own exec-* group under it, with those limits,
+ * and reports what the group used. rlimits only bound each process alone;
+ * a group holds the whole process tree to the quota. */
+
+typedef struct config config_t;
+
+/* Whether p asks for any cgroup limit. */
+int cgroup_limited(const exec_profile_t *p);
+
+/* Startup: move the daemon out of cgroup_root into a leaf of its own when it
+ * runs there (a group with children cannot hold processes) and enable the
+ * cpu, memory and io controllers for its children. Warns and returns -1 when
+ * the root is not a usable cgroup v2 directory. */
+int cgroup_init(const config_t *cfg);
+
+/* Why cgroup_root cannot host limited runs, or NULL when it can: not set,
+ * not cgroup v2, not writable, or a controller p needs is unavailable (p may
+ * be NULL for the root alone). Makes no changes, for preflight. */
+const char *cgroup_check(const config_t *cfg, const exec_profile_t *p);
+
+/* Before fork(): create a group with p's limits and store its directory in
+ * dir. Returns -1 after writing the reason to stderr. */
+int cgroup_create(const config_t *cfg, const exec_profile_t *p, char *dir, size_t dir_sz);
+
+/* In the forked child, first thing: move into dir. Returns -1 after writing
+ * the reason to stderr. */
+int cgroup_enter(const char *dir);
+
+/* After the child was reaped: add what the group used to usage (may be
+ * NULL) and remove it. A group that processes the run left behind still
+ * occupy is kept, under its limits, and removed on a later call once empty. */
+void cgroup_finish(const char *dir, exec_usage_t *usage);
+
+#endif
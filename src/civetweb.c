@@ -1974,6 +1974,7 @@ enum {
 	LINGER_TIMEOUT,
 	CONNECTION_QUEUE_SIZE,
 	LISTEN_BACKLOG_SIZE,
+	LISTEN_REUSE_PORT,
 #if defined(__linux__)
 	ALLOW_SENDFILE_CALL,
 #endif
@@ -2123,6 +2124,7 @@ static const struct mg_option config_options[] = {
     {"linger_timeout_ms", MG_CONFIG_TYPE_NUMBER, NULL},
     {"connection_queue", MG_CONFIG_TYPE_NUMBER, "20"},
     {"listen_backlog", MG_CONFIG_TYPE_NUMBER, "200"},
+    {"listen_reuse_port", MG_CONFIG_TYPE_BOOLEAN, "no"},
 #if defined(__linux__)
     {"allow_sendfile_call", MG_CONFIG_TYPE_BOOLEAN, "yes"},
 #endif
@@ -2416,6 +2418,7 @@ struct mg_context {
 	struct socket *listening_sockets;
 	struct mg_pollfd *listening_socket_fds;
 	unsigned int num_listening_sockets;
+	volatile int stop_listening; /* set by mg_stop_listening() */
 
 	struct mg_connection *worker_connections; /* The connection struct, pre-
 	                                           * allocated for each worker */
@@ -16259,6 +16262,20 @@ set_ports_option(struct mg_context *phys_ctx)
 			    "cannot set socket option SO_REUSEADDR (entry %i)",
 			    portsTotal);
 		}
+#if defined(SO_REUSEPORT)
+		if (!mg_strcasecmp(phys_ctx->dd.config[LISTEN_REUSE_PORT], "yes")
+		    && (setsockopt(so.sock,
+		                   SOL_SOCKET,
+		                   SO_REUSEPORT,
+		                   (SOCK_OPT_TYPE)&on,
+		                   sizeof(on))
+		        != 0)) {
+			mg_cry_ctx_internal(
+			    phys_ctx,
+			    "cannot set socket option SO_REUSEPORT (entry %i)",
+			    portsTotal);
+		}
+#endif
 #endif
 
 #if defined(USE_X_DOM_SOCKET)
@@ -20702,6 +20719,15 @@ master_thread_run(struct mg_context *ctx)
 	/* Server accept loop */
 	pfd = ctx->listening_socket_fds;
 	while (STOP_FLAG_IS_ZERO(&ctx->stop_flag)) {
+		if (ctx->stop_listening && (ctx->num_listening_sockets > 0)) {
+			/* Hand the port over: close the listeners but keep serving
+			 * the connections that were already accepted. */
+			for (i = 0; i < ctx->num_listening_sockets; i++) {
+				closesocket(ctx->listening_sockets[i].sock);
+				ctx->listening_sockets[i].sock = INVALID_SOCKET;
+			}
+			ctx->num_listening_sockets = 0;
+		}
 		for (i = 0; i < ctx->num_listening_sockets; i++) {
 			pfd[i].fd = ctx->listening_sockets[i].sock;
 			pfd[i].events = POLLIN;
@@ -20946,6 +20972,15 @@ free_context(struct mg_context *ctx)
 }
 
 
+CIVETWEB_API void
+mg_stop_listening(struct mg_context *ctx)
+{
+	if (ctx) {
+		ctx->stop_listening = 1;
+	}
+}
+
+
 CIVETWEB_API void
 mg_stop(struct mg_context *ctx)
 {
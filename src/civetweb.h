@@ -456,6 +456,15 @@ CIVETWEB_API struct mg_context *mg_start(const struct mg_callbacks *callbacks,
 CIVETWEB_API void mg_stop(struct mg_context *);
 
 
+/* Stop accepting new connections.
+
+   Closes the listening sockets (within one SOCKET_TIMEOUT_QUANTUM) while
+   requests on already accepted connections keep being served. Use before
+   mg_stop to drain in-flight requests when another process (bound with
+   "listen_reuse_port") takes over the port. */
+CIVETWEB_API void mg_stop_listening(struct mg_context *);
+
+
 /* Add an additional domain to an already running web server.
  *
  * Parameters:
@@ -0,0 +1,900 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <ctype.h>
+#include <time.h>
+#include <unistd.h>
+
+#include "parson.h"
+#include "autod.h"
+#include "httpc.h"
+#include "sync.h"
+#include "version.h"
+#include "bench.h"
+#include "cli.h"
+
+#define CLI_MAX_COLUMNS 24
+#define CLI_CELL_MAX 48
+#define CLI_TIMEOUT_MS 10000
+#define CLI_VERSION_TIMEOUT_MS 2000
+
+/* A listing: which registry array to show and the columns it gets by
+ * default and with -o wide. Dotted names reach into nested objects. */
+typedef struct {
+    const char *name;
+    const char *path;
+    const char *rows;
+    const char *columns;
+    const char *wide;
+    const char *missing;       /* why a 404 happens */
+} cli_view_t;
+
+static const cli_view_t g_cli_views[] = {
+    { "nodes", "/sync/slaves", "slaves",
+      "id,address,port,slot,status,autod_version",
+      "id,name,address,port,slot,status,transport,device,role,version,autod_version,compat,"
+      "remote_ip,last_ack_generation",
+      "has no node registry (not a sync master?)" },
+    { "slots", "/sync/slaves", "slots",
+      "slot,label,assigned_id,prefer_id,health.state,lease.holder",
+      "slot,label,aliases,assigned_id,prefer_id,desired_group,health.state,health.failures,"
+      "health.last_error,lease.holder,lease.expires_ms",
+      "has no node registry (not a sync master?)" },
+    { "commands", "/exec/catalog", "commands",
+      "name,path,roles,allowed,description",
+      "name,path,roles,allowed,params,description,examples",
+      "has no command catalog (older autod?)" },
+};
+
+typedef struct {
+    const cli_view_t *view;
+    const char *output;        /* table, wide, json, yaml */
+    char columns[CLI_MAX_COLUMNS][48];
+    int column_count;
+    int explicit_columns;
+    int watch_s;               /* 0 = print once */
+    http_url_t target;
+} cli_list_t;
+
+/* Where the command talks to: --url, or this host's own listener from the
+ * config file. */
+static int cli_target(const char *url, const char *cfgpath, const char *path, http_url_t *out) {
+    if (url) {
+        if (httpc_parse_url(url, out, path) != 0) {
+            fprintf(stderr, "ERROR: bad URL %s\n", url);
+            return -1;
+        }
+        return 0;
+    }
+    config_t cfg;
+    int rc = config_load(cfgpath, &cfg);
+    if (rc == -1) {
+        fprintf(stderr, "WARN: could not read %s, using defaults\n", cfgpath);
+    } else if (rc < 0) {
+        return -1;
+    }
+    memset(out, 0, sizeof(*out));
+    server_local_address(&cfg, out->host, sizeof(out->host), &out->port);
+    snprintf(out->path, sizeof(out->path), "%s", path);
+    return 0;
+}
+
+/* Warn on stderr when the daemon at target runs another build than this
+ * binary, louder when their node API ranges do not overlap and the reply may
+ * be misread. A daemon that does not answer is left to the command itself. */
+static void cli_check_server(const http_url_t *target) {
+    http_url_t health = *target;
+    snprintf(health.path, sizeof(health.path), "/health");
+    char *resp = NULL;
+    int status = httpc_get(&health, &resp, NULL, CLI_VERSION_TIMEOUT_MS);
+    JSON_Value *doc = status == 200 && resp ? json_parse_string(resp) : NULL;
+    free(resp);
+    JSON_Object *o = json_object(doc);
+    const char *version = json_object_get_string(o, "autod_version");
+    if (!version) {
+        if (doc) json_value_free(doc);
+        return;
+    }
+    int api = (int)json_object_get_number(o, "api_version");
+    int api_min = (int)json_object_get_number(o, "api_min_version");
+    if (!strcmp(sync_api_compat(api, api_min), "incompatible")) {
+        fprintf(stderr, "WARN: %s:%d runs autod %s (node API %d-%d), incompatible with this "
+                        "autod %s (%d-%d); its replies may be misread\n",
+                target->host, target->port, version, api_min > 0 ? api_min : api, api,
+                AUTOD_VERSION, AUTOD_API_VERSION_MIN, AUTOD_API_VERSION);
+    } else if (strcmp(version, AUTOD_VERSION) != 0) {
+        fprintf(stderr, "WARN: %s:%d runs autod %s, this is autod %s\n",
+                target->host, target->port, version, AUTOD_VERSION);
+    }
+    json_value_free(doc);
+}
+
+static int cli_nodes_import(int argc, char **argv) {
+    const char *file = NULL, *url = NULL, *cfgpath = "./autod.conf";
+    for (int i = 0; i < argc; i++) {
+        if (!strcmp(argv[i], "-f") && i + 1 < argc) file = argv[++i];
+        else if (!strcmp(argv[i], "--url") && i + 1 < argc) url = argv[++i];
+        else if (!strncmp(argv[i], "--url=", 6)) url = argv[i] + 6;
+        else if (argv[i][0] != '-') cfgpath = argv[i];
+        else {
+            fprintf(stderr, "ERROR: unknown option %s\n", argv[i]);
+            return 2;
+        }
+    }
+    if (!file) {
+        fprintf(stderr, "ERROR: nodes import needs -f FILE\n");
+        return 2;
+    }
+
+    JSON_Value *doc = json_parse_file_with_comments(file);
+    if (!doc) {
+        fprintf(stderr, "ERROR: %s is not valid JSON\n", file);
+        return 1;
+    }
+    char *body = json_serialize_to_string(doc);
+    json_value_free(doc);
+    if (!body) return 1;
+
+    http_url_t target;
+    if (cli_target(url, cfgpath, "/nodes/import", &target) != 0) {
+        json_free_serialized_string(body);
+        return 2;
+    }
+    cli_check_server(&target);
+
+    char *resp = NULL;
+    size_t resp_len = 0;
+    int status = httpc_post_json(&target, body, &resp, &resp_len, CLI_TIMEOUT_MS);
+    json_free_serialized_string(body);
+    if (status < 0) {
+        fprintf(stderr, "ERROR: cannot reach %s:%d\n", target.host, target.port);
+        return 1;
+    }
+    if (resp) {
+        fwrite(resp, 1, resp_len, stdout);
+        if (resp_len == 0 || resp[resp_len - 1] != '\n') fputc('\n', stdout);
+        free(resp);
+    }
+    return status == 200 ? 0 : 1;
+}
+
+/* autod token create|list: join tokens for new slaves. The admin token is
+ * read from the config file ([admin] token) or --token. */
+static int cli_token(int argc, char **argv) {
+    const char *sub = argc > 0 ? argv[0] : "";
+    int create = !strcmp(sub, "create");
+    if (!create && strcmp(sub, "list") != 0) {
+        fprintf(stderr, "usage: autod token create|list [--ttl S] [--uses N] [--note TEXT] "
+                        "[--token T] [--url URL] [config.ini]\n");
+        return 2;
+    }
+    const char *url = NULL, *cfgpath = "./autod.conf", *note = NULL, *admin_token = NULL;
+    int ttl_s = 0, uses = 0;
+    for (int i = 1; i < argc; i++) {
+        const char *a = argv[i];
+        if (create && !strcmp(a, "--ttl") && i + 1 < argc) ttl_s = atoi(argv[++i]);
+        else if (create && !strncmp(a, "--ttl=", 6)) ttl_s = atoi(a + 6);
+        else if (create && !strcmp(a, "--uses") && i + 1 < argc) uses = atoi(argv[++i]);
+        else if (create && !strncmp(a, "--uses=", 7)) uses = atoi(a + 7);
+        else if (create && !strcmp(a, "--note") && i + 1 < argc) note = argv[++i];
+        else if (create && !strncmp(a, "--note=", 7)) note = a + 7;
+        else if (!strcmp(a, "--token") && i + 1 < argc) admin_token = argv[++i];
+        else if (!strncmp(a, "--token=", 8)) admin_token = a + 8;
+        else if (!strcmp(a, "--url") && i + 1 < argc) url = argv[++i];
+        else if (!strncmp(a, "--url=", 6)) url = a + 6;
+        else if (a[0] != '-') cfgpath = a;
+        else {
+            fprintf(stderr, "ERROR: unknown option %s\n", a);
+            return 2;
+        }
+    }
+    if (create && (ttl_s < 0 || uses < 0)) {
+        fprintf(stderr, "ERROR: --ttl and --uses need positive numbers\n");
+        return 2;
+    }
+
+    http_url_t target;
+    if (cli_target(url, cfgpath, "/admin/join-tokens", &target) != 0) return 2;
+    snprintf(target.path, sizeof(target.path), "/admin/join-tokens");
+    cli_check_server(&target);
+    char headers[256] = "";
+    if (!admin_token) {
+        config_t cfg;
+        if (config_load(cfgpath, &cfg) >= 0 && cfg.admin.token[0]) {
+            snprintf(headers, sizeof(headers), "Authorization: Bearer %s\r\n", cfg.admin.token);
+        }
+    } else {
+        snprintf(headers, sizeof(headers), "Authorization: Bearer %s\r\n", admin_token);
+    }
+
+    char *body = NULL;
+    if (create) {
+        JSON_Value *req = json_value_init_object();
+        if (ttl_s > 0) json_object_set_number(json_object(req), "ttl_s", ttl_s);
+        if (uses > 0) json_object_set_number(json_object(req), "uses", uses);
+        if (note) json_object_set_string(json_object(req), "note", note);
+        body = json_serialize_to_string(req);
+        json_value_free(req);
+    }
+    char *resp = NULL;
+    size_t resp_len = 0;
+    int status = httpc_send_json(create ? "POST" : "GET", &target, headers[0] ? headers : NULL,
+                                 body, &resp, &resp_len, CLI_TIMEOUT_MS);
+    if (body) json_free_serialized_string(body);
+    if (status < 0) {
+        fprintf(stderr, "ERROR: cannot reach %s:%d\n", target.host, target.port);
+        return 1;
+    }
+    JSON_Value *doc = resp ? json_parse_string(resp) : NULL;
+    const char *token = json_object_get_string(json_object(doc), "token");
+    if (create && status == 201 && token) {
+        /* Only the token on stdout, so it can be captured by a script. */
+        time_t expires = (time_t)json_object_get_number(json_object(doc), "expires_unix");
+        char when[32];
+        strftime(when, sizeof(when), "%Y-%m-%d %H:%M:%S", localtime(&expires));
+        printf("%s\n", token);
+        fprintf(stderr, "expires %s, %d use%s\n", when,
+                (int)json_object_get_number(json_object(doc), "uses"),
+                json_object_get_number(json_object(doc), "uses") == 1 ? "" : "s");
+    } else if (resp) {
+        fwrite(resp, 1, resp_len, status == 200 ? stdout : stderr);
+        if (resp_len == 0 || resp[resp_len - 1] != '\n') fputc('\n', status == 200 ? stdout : stderr);
+    }
+    if (doc) json_value_free(doc);
+    free(resp);
+    return status == 200 || status == 201 ? 0 : 1;
+}
+
+/* autod bench exec|register|echo: load against a daemon, then latency
+ * percentiles and error rates. Exits 1 when --max-error-pct or --max-p99-ms
+ * is exceeded (or nothing succeeded), so a rollout check can gate on it. */
+static int cli_bench(int argc, char **argv) {
+    const char *mode = argc > 0 ? argv[0] : "";
+    if (strcmp(mode, "exec") && strcmp(mode, "register") && strcmp(mode, "echo")) {
+        fprintf(stderr, "usage: autod bench exec|register|echo [-n N | -d S] [-c N] [--rate R] "
+                        "[--path P] [--arg A]... [--slot S] [--nodes N] [--sleep-ms MS] "
+                        "[--reply-bytes N] [--timeout-ms MS] [--max-error-pct P] [--max-p99-ms MS] "
+                        "[-o table|json] [--url URL] [config.ini]\n");
+        return 2;
+    }
+    bench_plan_t plan;
+    memset(&plan, 0, sizeof(plan));
+    snprintf(plan.mode, sizeof(plan.mode), "%s", mode);
+    plan.requests = 1000;
+    plan.concurrency = 8;
+    plan.nodes = 8;
+    plan.timeout_ms = CLI_TIMEOUT_MS;
+    const char *url = NULL, *cfgpath = "./autod.conf", *output = "table";
+    double max_error_pct = -1, max_p99_ms = -1;
+    for (int i = 1; i < argc; i++) {
+        const char *a = argv[i];
+        const char *v = i + 1 < argc ? argv[i + 1] : NULL;
+        if (!strcmp(a, "-n") && v) { plan.requests = atoi(v); i++; }
+        else if (!strcmp(a, "-c") && v) { plan.concurrency = atoi(v); i++; }
+        else if (!strcmp(a, "-d") && v) { plan.duration_s = atoi(v); i++; }
+        else if (!strcmp(a, "--rate") && v) { plan.rate = atoi(v); i++; }
+        else if (!strcmp(a, "--path") && v) { plan.exec_path = v; i++; }
+        else if (!strcmp(a, "--arg") && v) {
+            if (plan.arg_count >= BENCH_MAX_ARGS) {
+                fprintf(stderr, "ERROR: at most %d --arg\n", BENCH_MAX_ARGS);
+                return 2;
+            }
+            plan.args[plan.arg_count++] = v;
+            i++;
+        }
+        else if (!strcmp(a, "--slot") && v) { plan.slot = v; i++; }
+        else if (!strcmp(a, "--nodes") && v) { plan.nodes = atoi(v); i++; }
+        else if (!strcmp(a, "--sleep-ms") && v) { plan.sleep_ms = atoi(v); i++; }
+        else if (!strcmp(a, "--reply-bytes") && v) { plan.reply_bytes = atoi(v); i++; }
+        else if (!strcmp(a, "--timeout-ms") && v) { plan.timeout_ms = atoi(v); i++; }
+        else if (!strcmp(a, "--max-error-pct") && v) { max_error_pct = atof(v); i++; }
+        else if (!strcmp(a, "--max-p99-ms") && v) { max_p99_ms = atof(v); i++; }
+        else if ((!strcmp(a, "-o") || !strcmp(a, "--output")) && v) { output = v; i++; }
+        else if (!strcmp(a, "--url") && v) { url = v; i++; }
+        else if (!strncmp(a, "--url=", 6)) url = a + 6;
+        else if (a[0] != '-') cfgpath = a;
+        else {
+            fprintf(stderr, "ERROR: unknown option %s\n", a);
+            return 2;
+        }
+    }
+    if (strcmp(output, "table") && strcmp(output, "json")) {
+        fprintf(stderr, "ERROR: -o takes table or json\n");
+        return 2;
+    }
+    if (!strcmp(mode, "exec") && (!plan.exec_path || !*plan.exec_path)) {
+        fprintf(stderr, "ERROR: bench exec needs --path\n");
+        return 2;
+    }
+    if (plan.concurrency < 1 || plan.timeout_ms < 1 || plan.rate < 0 ||
+        (plan.duration_s <= 0 && plan.requests < 1)) {
+        fprintf(stderr, "ERROR: -n, -c, -d, --rate and --timeout-ms need positive numbers\n");
+        return 2;
+    }
+    if (!strcmp(mode, "register") && (plan.nodes < 1 || plan.nodes > BENCH_MAX_NODES)) {
+        fprintf(stderr, "ERROR: --nodes takes 1-%d\n", BENCH_MAX_NODES);
+        return 2;
+    }
+
+    if (cli_target(url, cfgpath, "/", &plan.target) != 0) return 2;
+    cli_check_server(&plan.target);
+    bench_result_t r;
+    if (bench_run(&plan, &r) != 0) {
+        fprintf(stderr, "ERROR: could not start the benchmark\n");
+        return 1;
+    }
+
+    double error_pct = r.requests ? 100.0 * r.failed / r.requests : 0;
+    if (!strcmp(output, "json")) {
+        JSON_Value *doc = bench_result_json(&plan, &r);
+        char *s = json_serialize_to_string_pretty(doc);
+        if (s) {
+            printf("%s\n", s);
+            json_free_serialized_string(s);
+        }
+        json_value_free(doc);
+    } else {
+        printf("target      %s:%d (%s%s%s, %d worker%s%s)\n", plan.target.host, plan.target.port,
+               mode, plan.exec_path ? " " : "", plan.exec_path ? plan.exec_path : "",
+               plan.concurrency, plan.concurrency == 1 ? "" : "s", plan.slot ? ", via /http" : "");
+        printf("requests    %d in %.2f s (%.1f/s)\n", r.requests, r.elapsed_ms / 1000.0,
+               r.elapsed_ms > 0 ? r.requests * 1000.0 / (double)r.elapsed_ms : 0.0);
+        printf("ok          %d (%.1f%%)\n", r.ok, r.requests ? 100.0 * r.ok / r.requests : 0.0);
+        printf("errors      %d", r.failed);
+        for (int i = 0; i < r.error_kinds; i++) {
+            printf("%s %s %d", i ? "," : ":", r.errors[i].what, r.errors[i].count);
+        }
+        printf("\n");
+        if (r.samples > 0) {
+            printf("latency ms  min %.1f  p50 %.1f  p90 %.1f  p99 %.1f  max %.1f  mean %.1f\n",
+                   r.min_ms, r.p50_ms, r.p90_ms, r.p99_ms, r.max_ms, r.mean_ms);
+        }
+        if (!strcmp(mode, "register")) {
+            if (r.dropped >= 0) printf("cleanup     %d synthetic node%s removed\n", r.dropped,
+                                       r.dropped == 1 ? "" : "s");
+            else printf("cleanup     failed; DELETE /bench/nodes removes them\n");
+        }
+    }
+    int failed = r.ok == 0;
+    if (max_error_pct >= 0 && error_pct > max_error_pct) {
+        fprintf(stderr, "FAIL: error rate %.1f%% above %.1f%%\n", error_pct, max_error_pct);
+        failed = 1;
+    }
+    if (max_p99_ms >= 0 && (r.samples == 0 || r.p99_ms > max_p99_ms)) {
+        fprintf(stderr, "FAIL: p99 latency %.1f ms above %.1f ms\n", r.p99_ms, max_p99_ms);
+        failed = 1;
+    }
+    return failed ? 1 : 0;
+}
+
+/* ---------- Cells ---------- */
+
+static const char *cli_node_status(const JSON_Object *row) {
+    if (json_object_get_boolean(row, "down") == 1) return "down";
+    if (json_object_get_boolean(row, "quarantined") == 1) return "quarantined";
+    if (json_object_get_boolean(row, "dispatch_refused") == 1) return "refused";
+    if (json_object_get_boolean(row, "bench") == 1) return "bench";
+    if (json_object_get_value(row, "conflict")) return "conflict";
+    return "up";
+}
+
+/* Value of a column for one row, or NULL when the row has none. "status" on
+ * a node is derived from its flags; "address" falls back to the source IP. */
+static const JSON_Value *cli_lookup(const cli_view_t *view, const JSON_Object *row, const char *col,
+                                    JSON_Value **derived) {
+    *derived = NULL;
+    const JSON_Value *v = json_object_dotget_value(row, col);
+    if (v) return v;
+    if (!strcmp(view->name, "nodes")) {
+        if (!strcmp(col, "status")) {
+            *derived = json_value_init_string(cli_node_status(row));
+            return *derived;
+        }
+        if (!strcmp(col, "address")) return json_object_get_value(row, "remote_ip");
+    }
+    return NULL;
+}
+
+/* Table cells for a command's roles ("admin,client", "any" when unset) and
+ * params (names, "?" marking optional ones); json and yaml keep the arrays. */
+static JSON_Value *cli_command_cell(const char *col, const JSON_Value *v) {
+    JSON_Array *a = json_value_get_array(v);
+    int roles = !strcmp(col, "roles");
+    if (!a || (!roles && strcmp(col, "params") != 0)) return NULL;
+    char buf[CLI_CELL_MAX * 2] = "";
+    size_t len = 0;
+    for (size_t i = 0; i < json_array_get_count(a) && len < sizeof(buf); i++) {
+        const char *item = roles ? json_array_get_string(a, i)
+                                 : json_object_get_string(json_array_get_object(a, i), "name");
+        if (!item) continue;
+        int optional = !roles && json_object_get_boolean(json_array_get_object(a, i), "required") != 1;
+        len += (size_t)snprintf(buf + len, sizeof(buf) - len, "%s%s%s", len ? "," : "", item,
+                                optional ? "?" : "");
+    }
+    return json_value_init_string(buf[0] ? buf : roles ? "any" : "-");
+}
+
+static void cli_format_cell(const JSON_Value *v, char *out, size_t out_sz) {
+    int n = 0;
+    switch (v ? json_value_get_type(v) : JSONNull) {
+    case JSONString:
+        n = snprintf(out, out_sz, "%s", json_value_get_string(v));
+        break;
+    case JSONNumber: {
+        double d = json_value_get_number(v);
+        if (d == (double)(long long)d) snprintf(out, out_sz, "%lld", (long long)d);
+        else snprintf(out, out_sz, "%g", d);
+        break;
+    }
+    case JSONBoolean:
+        snprintf(out, out_sz, "%s", json_value_get_boolean(v) ? "true" : "false");
+        break;
+    case JSONObject:
+    case JSONArray: {
+        char *s = json_serialize_to_string(v);
+        n = snprintf(out, out_sz, "%s", s ? s : "?");
+        if (s) json_free_serialized_string(s);
+        break;
+    }
+    default:
+        snprintf(out, out_sz, "-");
+        break;
+    }
+    if (!out[0]) snprintf(out, out_sz, "-");
+    for (char *p = out; *p; p++) {
+        if (*p == '\n' || *p == '\t') *p = ' ';
+    }
+    if (n >= (int)out_sz && out_sz > 4) memcpy(out + out_sz - 4, "...", 4);
+}
+
+/* ---------- Renderers ---------- */
+
+static void cli_print_table(FILE *f, const cli_list_t *ls, JSON_Array *rows) {
+    size_t n = json_array_get_count(rows);
+    int cols = ls->column_count;
+    char (*cells)[CLI_CELL_MAX] = calloc((n + 1) * (size_t)cols, CLI_CELL_MAX);
+    if (!cells) return;
+    size_t width[CLI_MAX_COLUMNS];
+    for (int c = 0; c < cols; c++) {
+        char *h = cells[c];
+        snprintf(h, CLI_CELL_MAX, "%s", ls->columns[c]);
+        for (char *p = h; *p; p++) *p = (char)toupper((unsigned char)*p);
+        width[c] = strlen(h);
+    }
+    for (size_t r = 0; r < n; r++) {
+        JSON_Object *row = json_array_get_object(rows, r);
+        for (int c = 0; c < cols; c++) {
+            char *cell = cells[(r + 1) * (size_t)cols + (size_t)c];
+            JSON_Value *derived = NULL;
+            const JSON_Value *v = row ? cli_lookup(ls->view, row, ls->columns[c], &derived) : NULL;
+            JSON_Value *shown = !strcmp(ls->view->name, "commands") ? cli_command_cell(ls->columns[c], v) : NULL;
+            cli_format_cell(shown ? shown : v, cell, CLI_CELL_MAX);
+            if (shown) json_value_free(shown);
+            if (derived) json_value_free(derived);
+            if (strlen(cell) > width[c]) width[c] = strlen(cell);
+        }
+    }
+    for (size_t r = 0; r <= n; r++) {
+        for (int c = 0; c < cols; c++) {
+            const char *cell = cells[r * (size_t)cols + (size_t)c];
+            if (c == cols - 1) fprintf(f, "%s\n", cell);
+            else fprintf(f, "%-*s   ", (int)width[c], cell);
+        }
+    }
+    if (n == 0) fprintf(f, "(no %s)\n", ls->view->name);
+    free(cells);
+}
+
+/* Rows reduced to the selected columns, for json/yaml with -c. */
+static JSON_Value *cli_project(const cli_list_t *ls, JSON_Array *rows) {
+    JSON_Value *out = json_value_init_array();
+    for (size_t r = 0; r < json_array_get_count(rows); r++) {
+        JSON_Object *row = json_array_get_object(rows, r);
+        if (!row) continue;
+        JSON_Value *item = json_value_init_object();
+        for (int c = 0; c < ls->column_count; c++) {
+            JSON_Value *derived = NULL;
+            const JSON_Value *v = cli_lookup(ls->view, row, ls->columns[c], &derived);
+            json_object_set_value(json_object(item), ls->columns[c],
+                                  derived ? derived : v ? json_value_deep_copy(v) : json_value_init_null());
+        }
+        json_array_append_value(json_array(out), item);
+    }
+    return out;
+}
+
+/* Plain YAML scalars are limited to characters that can never be read as
+ * anything but a string; everything else is written JSON-quoted, which YAML
+ * accepts as a double-quoted scalar. */
+static int cli_yaml_plain(const char *s) {
+    static const char *reserved[] = { "true", "false", "null", "yes", "no", "on", "off", "y", "n", "~" };
+    if (!*s || !(isalpha((unsigned char)*s) || *s == '/')) return 0;
+    for (size_t i = 0; i < sizeof(reserved) / sizeof(reserved[0]); i++) {
+        if (!strcasecmp(s, reserved[i])) return 0;
+    }
+    for (const char *p = s; *p; p++) {
+        if (!isalnum((unsigned char)*p) && !strchr("_-./@", *p)) return 0;
+    }
+    return 1;
+}
+
+static void cli_yaml_string(FILE *f, const char *s) {
+    if (cli_yaml_plain(s)) {
+        fputs(s, f);
+        return;
+    }
+    JSON_Value *tmp = json_value_init_string(s);
+    char *q = tmp ? json_serialize_to_string(tmp) : NULL;
+    fputs(q ? q : "\"\"", f);
+    if (q) json_free_serialized_string(q);
+    if (tmp) json_value_free(tmp);
+}
+
+static int cli_yaml_is_block(const JSON_Value *v) {
+    JSON_Value_Type t = json_value_get_type(v);
+    return (t == JSONObject && json_object_get_count(json_object(v)) > 0) ||
+           (t == JSONArray && json_array_get_count(json_array(v)) > 0);
+}
+
+static void cli_yaml_scalar(FILE *f, const JSON_Value *v) {
+    switch (json_value_get_type(v)) {
+    case JSONString: cli_yaml_string(f, json_value_get_string(v)); break;
+    case JSONBoolean: fputs(json_value_get_boolean(v) ? "true" : "false", f); break;
+    case JSONObject: fputs("{}", f); break;
+    case JSONArray: fputs("[]", f); break;
+    case JSONNumber: {
+        char *s = json_serialize_to_string(v);
+        fputs(s ? s : "0", f);
+        if (s) json_free_serialized_string(s);
+        break;
+    }
+    default: fputs("null", f); break;
+    }
+}
+
+/* Write a block value at indent. With inline_first the cursor already sits
+ * after "- ", so the first line is not indented again. */
+static void cli_yaml(FILE *f, const JSON_Value *v, int indent, int inline_first) {
+    if (json_value_get_type(v) == JSONObject) {
+        JSON_Object *o = json_object(v);
+        for (size_t i = 0; i < json_object_get_count(o); i++) {
+            if (i > 0 || !inline_first) fprintf(f, "%*s", indent, "");
+            cli_yaml_string(f, json_object_get_name(o, i));
+            const JSON_Value *item = json_object_get_value_at(o, i);
+            if (cli_yaml_is_block(item)) {
+                fputs(":\n", f);
+                cli_yaml(f, item, indent + 2, 0);
+            } else {
+                fputs(": ", f);
+                cli_yaml_scalar(f, item);
+                fputc('\n', f);
+            }
+        }
+        return;
+    }
+    JSON_Array *a = json_array(v);
+    for (size_t i = 0; i < json_array_get_count(a); i++) {
+        if (i > 0 || !inline_first) fprintf(f, "%*s", indent, "");
+        fputs("- ", f);
+        const JSON_Value *item = json_array_get_value(a, i);
+        if (cli_yaml_is_block(item)) {
+            cli_yaml(f, item, indent + 2, 1);
+        } else {
+            cli_yaml_scalar(f, item);
+            fputc('\n', f);
+        }
+    }
+}
+
+static void cli_print_yaml(FILE *f, const JSON_Value *v) {
+    if (cli_yaml_is_block(v)) cli_yaml(f, v, 0, 0);
+    else {
+        cli_yaml_scalar(f, v);
+        fputc('\n', f);
+    }
+}
+
+/* ---------- nodes / slots ---------- */
+
+static int cli_set_columns(cli_list_t *ls, const char *list) {
+    char buf[512];
+    snprintf(buf, sizeof(buf), "%s", list);
+    ls->column_count = 0;
+    char *save = NULL;
+    for (char *tok = strtok_r(buf, ", ", &save); tok; tok = strtok_r(NULL, ", ", &save)) {
+        if (ls->column_count >= CLI_MAX_COLUMNS || strlen(tok) >= sizeof(ls->columns[0])) {
+            fprintf(stderr, "ERROR: too many or too long columns in '%s'\n", list);
+            return -1;
+        }
+        snprintf(ls->columns[ls->column_count++], sizeof(ls->columns[0]), "%s", tok);
+    }
+    if (ls->column_count == 0) {
+        fprintf(stderr, "ERROR: no columns in '%s'\n", list);
+        return -1;
+    }
+    return 0;
+}
+
+/* Fetch the listing once and write it to f. Returns the exit code. */
+static int cli_list_once(const cli_list_t *ls, FILE *f) {
+    char *resp = NULL;
+    int status = httpc_get(&ls->target, &resp, NULL, CLI_TIMEOUT_MS);
+    if (status < 0) {
+        free(resp);
+        fprintf(stderr, "ERROR: cannot reach %s:%d\n", ls->target.host, ls->target.port);
+        return 1;
+    }
+    JSON_Value *doc = resp ? json_parse_string(resp) : NULL;
+    if (status != 200) {
+        const char *err = json_object_get_string(json_object(doc), "error");
+        if (status == 404) {
+            fprintf(stderr, "ERROR: %s:%d %s\n", ls->target.host, ls->target.port, ls->view->missing);
+        } else {
+            fprintf(stderr, "ERROR: HTTP %d%s%s\n", status, err ? " " : "", err ? err : "");
+        }
+        if (doc) json_value_free(doc);
+        free(resp);
+        return 1;
+    }
+    free(resp);
+    JSON_Array *rows = json_object_get_array(json_object(doc), ls->view->rows);
+    if (!rows) {
+        fprintf(stderr, "ERROR: response has no \"%s\"\n", ls->view->rows);
+        if (doc) json_value_free(doc);
+        return 1;
+    }
+    if (!strcmp(ls->output, "table") || !strcmp(ls->output, "wide")) {
+        cli_print_table(f, ls, rows);
+    } else {
+        JSON_Value *out = ls->explicit_columns ? cli_project(ls, rows)
+                                               : json_value_deep_copy(json_array_get_wrapping_value(rows));
+        if (!strcmp(ls->output, "json")) {
+            char *s = json_serialize_to_string_pretty(out);
+            if (s) {
+                fprintf(f, "%s\n", s);
+                json_free_serialized_string(s);
+            }
+        } else {
+            cli_print_yaml(f, out);
+        }
+        json_value_free(out);
+    }
+    json_value_free(doc);
+    return 0;
+}
+
+/* --watch: redraw the listing every watch_s seconds until interrupted. On a
+ * terminal the screen is cleared; otherwise snapshots are separated (a blank
+ * line, or "---" between YAML documents). */
+static int cli_list_watch(const cli_list_t *ls) {
+    int tty = isatty(STDOUT_FILENO);
+    for (int first = 1;; first = 0) {
+        char *buf = NULL;
+        size_t len = 0;
+        FILE *mem = open_memstream(&buf, &len);
+        if (!mem) return 1;
+        int rc = cli_list_once(ls, mem);
+        fclose(mem);
+        if (tty) {
+            time_t now = time(NULL);
+            struct tm tm;
+            char stamp[32];
+            strftime(stamp, sizeof(stamp), "%H:%M:%S", localtime_r(&now, &tm));
+            printf("\033[H\033[2J" "Every %ds: autod %s (%s:%d)   %s\n\n", ls->watch_s, ls->view->name,
+                   ls->target.host, ls->target.port, stamp);
+        } else if (!first) {
+            fputs(!strcmp(ls->output, "yaml") ? "---\n" : "\n", stdout);
+        }
+        if (rc == 0) fwrite(buf, 1, len, stdout);
+        fflush(stdout);
+        free(buf);
+        sleep((unsigned)ls->watch_s);
+    }
+    return 0;
+}
+
+static int cli_list(const cli_view_t *view, int argc, char **argv) {
+    cli_list_t ls;
+    memset(&ls, 0, sizeof(ls));
+    ls.view = view;
+    ls.output = "table";
+    const char *url = NULL, *cfgpath = "./autod.conf", *columns = NULL;
+    for (int i = 0; i < argc; i++) {
+        const char *a = argv[i];
+        if ((!strcmp(a, "-o") || !strcmp(a, "--output")) && i + 1 < argc) ls.output = argv[++i];
+        else if (!strncmp(a, "--output=", 9)) ls.output = a + 9;
+        else if ((!strcmp(a, "-c") || !strcmp(a, "--columns")) && i + 1 < argc) columns = argv[++i];
+        else if (!strncmp(a, "--columns=", 10)) columns = a + 10;
+        else if (!strcmp(a, "-w") || !strcmp(a, "--watch")) ls.watch_s = 2;
+        else if (!strncmp(a, "--watch=", 8)) {
+            ls.watch_s = atoi(a + 8);
+            if (ls.watch_s < 1) {
+                fprintf(stderr, "ERROR: --watch needs a positive number of seconds\n");
+                return 2;
+            }
+        }
+        else if (!strcmp(a, "--url") && i + 1 < argc) url = argv[++i];
+        else if (!strncmp(a, "--url=", 6)) url = a + 6;
+        else if (a[0] != '-') cfgpath = a;
+        else {
+            fprintf(stderr, "ERROR: unknown option %s\n", a);
+            return 2;
+        }
+    }
+    if (strcmp(ls.output, "table") && strcmp(ls.output, "wide") &&
+        strcmp(ls.output, "json") && strcmp(ls.output, "yaml")) {
+        fprintf(stderr, "ERROR: unknown output '%s' (table, wide, json or yaml)\n", ls.output);
+        return 2;
+    }
+    ls.explicit_columns = columns != NULL;
+    if (cli_set_columns(&ls, columns ? columns : !strcmp(ls.output, "wide") ? view->wide : view->columns) != 0) {
+        return 2;
+    }
+    if (cli_target(url, cfgpath, view->path, &ls.target) != 0) return 2;
+    /* The URL names the node; the listing always comes from the view's path. */
+    snprintf(ls.target.path, sizeof(ls.target.path), "%s", view->path);
+    cli_check_server(&ls.target);
+    return ls.watch_s > 0 ? cli_list_watch(&ls) : cli_list_once(&ls, stdout);
+}
+
+/* ---------- completion ---------- */
+
+static const char g_cli_bash[] =
+    "# bash completion for autod; load with: source <(autod completion bash)\n"
+    "_autod() {\n"
+    "    local cur prev\n"
+    "    cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n"
+    "    case \"$prev\" in\n"
+    "        -o|--output) COMPREPLY=($(compgen -W 'table wide json yaml' -- \"$cur\")); return ;;\n"
+    "        -f) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n"
+    "        -c|--columns|--url) return ;;\n"
+    "    esac\n"
+    "    if [ \"$COMP_CWORD\" -eq 1 ]; then\n"
+    "        COMPREPLY=($(compgen -W 'nodes slots commands token bench completion --no-config --version --help' -- \"$cur\")); return\n"
+    "    fi\n"
+    "    case \"${COMP_WORDS[1]}\" in\n"
+    "        completion) COMPREPLY=($(compgen -W 'bash zsh fish' -- \"$cur\")) ;;\n"
+    "        token)\n"
+    "            if [ \"$COMP_CWORD\" -eq 2 ]; then COMPREPLY=($(compgen -W 'create list' -- \"$cur\")); return; fi\n"
+    "            COMPREPLY=($(compgen -W '--ttl --uses --note --token --url' -- \"$cur\")) ;;\n"
+    "        bench)\n"
+    "            if [ \"$COMP_CWORD\" -eq 2 ]; then COMPREPLY=($(compgen -W 'exec register echo' -- \"$cur\")); return; fi\n"
+    "            COMPREPLY=($(compgen -W '-n -c -d --rate --path --arg --slot --nodes --sleep-ms --reply-bytes"
+    " --timeout-ms --max-error-pct --max-p99-ms -o --output --url' -- \"$cur\")) ;;\n"
+    "        nodes|slots|commands)\n"
+    "            if [ \"$COMP_CWORD\" -eq 2 ] && [ \"${COMP_WORDS[1]}\" = nodes ] && [[ \"$cur\" != -* ]]; then\n"
+    "                COMPREPLY=($(compgen -W 'import' -- \"$cur\"))\n"
+    "            fi\n"
+    "            COMPREPLY+=($(compgen -W '-o --output -c --columns -w --watch --url' -- \"$cur\"))\n"
+    "            [[ \"$cur\" != -* ]] && COMPREPLY+=($(compgen -f -X '!*.conf' -- \"$cur\")) ;;\n"
+    "        *) COMPREPLY=($(compgen -f -- \"$cur\")) ;;\n"
+    "    esac\n"
+    "}\n"
+    "complete -F _autod autod\n";
+
+static const char g_cli_zsh[] =
+    "#compdef autod\n"
+    "# zsh completion for autod; load with: source <(autod completion zsh)\n"
+    "_autod() {\n"
+    "    local -a list_opts\n"
+    "    list_opts=(\n"
+    "        '(-o --output)'{-o,--output}'[output format]:format:(table wide json yaml)'\n"
+    "        '(-c --columns)'{-c,--columns}'[comma separated columns]:columns:'\n"
+    "        '(-w --watch)'{-w,--watch}'[redraw every 2 seconds]'\n"
+    "        '--url[daemon to query]:url:'\n"
+    "        '*:config file:_files -g \"*.conf\"'\n"
+    "    )\n"
+    "    if (( CURRENT == 2 )); then\n"
+    "        _values 'command' nodes slots commands token bench completion --no-config --version --help\n"
+    "        return\n"
+    "    fi\n"
+    "    case $words[2] in\n"
+    "        completion) _values 'shell' bash zsh fish ;;\n"
+    "        token)\n"
+    "            if (( CURRENT == 3 )); then\n"
+    "                _values 'subcommand' create list\n"
+    "            else\n"
+    "                _arguments '--ttl[lifetime in seconds]:seconds:' '--uses[registrations it admits]:uses:'"
+    " '--note[label]:note:' '--token[admin token]:token:' '--url[master]:url:' '*:config file:_files'\n"
+    "            fi ;;\n"
+    "        nodes)\n"
+    "            if [[ $words[3] == import ]]; then\n"
+    "                _arguments '-f[inventory file]:file:_files' '--url[master to post to]:url:' '*:config file:_files'\n"
+    "            elif (( CURRENT == 3 )) && [[ $PREFIX != -* ]]; then\n"
+    "                _values 'subcommand' import\n"
+    "            else\n"
+    "                _arguments $list_opts\n"
+    "            fi ;;\n"
+    "        slots|commands) _arguments $list_opts ;;\n"
+    "        bench)\n"
+    "            if (( CURRENT == 3 )); then\n"
+    "                _values 'mode' exec register echo\n"
+    "            else\n"
+    "                _arguments '-n[requests]:count:' '-c[concurrent workers]:count:' '-d[duration in seconds]:seconds:'"
+    " '--rate[requests per second]:rate:' '--path[handler to run]:path:' '*--arg[handler argument]:arg:'"
+    " '--slot[run through /http on this slot]:slot:' '--nodes[synthetic node ids]:count:'"
+    " '--sleep-ms[echo delay]:ms:' '--reply-bytes[echo reply size]:bytes:' '--timeout-ms[per request]:ms:'"
+    " '--max-error-pct[fail above this error rate]:percent:' '--max-p99-ms[fail above this p99]:ms:'"
+    " '(-o --output)'{-o,--output}'[output format]:format:(table json)' '--url[daemon to load]:url:'"
+    " '*:config file:_files'\n"
+    "            fi ;;\n"
+    "        *) _files ;;\n"
+    "    esac\n"
+    "}\n"
+    "compdef _autod autod\n";
+
+static const char g_cli_fish[] =
+    "# fish completion for autod; load with: autod completion fish | source\n"
+    "complete -c autod -f\n"
+    "complete -c autod -n '__fish_use_subcommand' -a 'nodes' -d 'List registered nodes'\n"
+    "complete -c autod -n '__fish_use_subcommand' -a 'slots' -d 'List sync slots'\n"
+    "complete -c autod -n '__fish_use_subcommand' -a 'commands' -d 'List documented commands'\n"
+    "complete -c autod -n '__fish_use_subcommand' -a 'token' -d 'Create or list join tokens'\n"
+    "complete -c autod -n '__fish_use_subcommand' -a 'bench' -d 'Load a daemon and report latency'\n"
+    "complete -c autod -n '__fish_use_subcommand' -a 'completion' -d 'Print a shell completion script'\n"
+    "complete -c autod -n '__fish_use_subcommand' -l no-config -d 'Do not read the config file'\n"
+    "complete -c autod -n '__fish_use_subcommand' -l version -d 'Print the build and exit'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from completion' -a 'bash zsh fish'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from token; and not __fish_seen_subcommand_from create list'"
+    " -a 'create list'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from token' -l ttl -x -d 'Lifetime in seconds'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from token' -l uses -x -d 'Registrations it admits'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from token' -l note -x -d 'Label'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from token' -l token -x -d 'Admin token'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from token' -l url -x -d 'Master to ask'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from bench; and not __fish_seen_subcommand_from exec register echo'"
+    " -a 'exec register echo'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from bench' -s n -x -d 'Requests'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from bench' -s c -x -d 'Concurrent workers'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from bench' -s d -x -d 'Duration in seconds'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from bench' -l rate -x -d 'Requests per second'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from bench' -l path -x -d 'Handler to run'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from bench' -l arg -x -d 'Handler argument'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from bench' -l slot -x -d 'Run through /http on this slot'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from bench' -l nodes -x -d 'Synthetic node ids'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from bench' -l max-error-pct -x -d 'Fail above this error rate'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from bench' -l max-p99-ms -x -d 'Fail above this p99'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from bench' -s o -l output -x -a 'table json' -d 'Output format'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from bench' -l url -x -d 'Daemon to load'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from nodes; and not __fish_seen_subcommand_from import'"
+    " -a 'import' -d 'Post an expected-node inventory'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from import' -s f -r -F -d 'Inventory file'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from nodes slots commands' -s o -l output -x"
+    " -a 'table wide json yaml' -d 'Output format'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from nodes slots commands' -s c -l columns -x"
+    " -d 'Comma separated columns'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from nodes slots commands' -s w -l watch -d 'Redraw every 2 seconds'\n"
+    "complete -c autod -n '__fish_seen_subcommand_from nodes slots commands' -l url -x -d 'Daemon to query'\n";
+
+static int cli_completion(int argc, char **argv) {
+    const char *shell = argc > 0 ? argv[0] : "";
+    if (!strcmp(shell, "bash")) fputs(g_cli_bash, stdout);
+    else if (!strcmp(shell, "zsh")) fputs(g_cli_zsh, stdout);
+    else if (!strcmp(shell, "fish")) fputs(g_cli_fish, stdout);
+    else {
+        fprintf(stderr, "usage: autod completion bash|zsh|fish\n");
+        return 2;
+    }
+    return 0;
+}
+
+int cli_is_command(const char *arg) {
+    return arg && (!strcmp(arg, "nodes") || !strcmp(arg, "slots") || !strcmp(arg, "commands") ||
+                   !strcmp(arg, "token") || !strcmp(arg, "bench") || !strcmp(arg, "completion"));
+}
+
+int cli_main(int argc, char **argv) {
+    if (argc < 1) return 2;
+    if (!strcmp(argv[0], "completion")) return cli_completion(argc - 1, argv + 1);
+    if (!strcmp(argv[0], "token")) return cli_token(argc - 1, argv + 1);
+    if (!strcmp(argv[0], "bench")) return cli_bench(argc - 1, argv + 1);
+    if (!strcmp(argv[0], "nodes") && argc >= 2 && !strcmp(argv[1], "import")) {
+        return cli_nodes_import(argc - 2, argv + 2);
+    }
+    for (size_t i = 0; i < sizeof(g_cli_views) / sizeof(g_cli_views[0]); i++) {
+        if (!strcmp(argv[0], g_cli_views[i].name)) return cli_list(&g_cli_views[i], argc - 1, argv + 1);
+    }
+    fprintf(stderr, "ERROR: unknown command %s\n", argv[0]);
+    return 2;
+}
@@ -0,0 +1,24 @@
+#ifndef AUTOD_CLI_H
+#define AUTOD_CLI_H
+
+/*
+ * Operator commands run by the autod binary against a running daemon:
+ *   autod nodes [-o table|wide|json|yaml] [-c COLS] [-w|--watch[=S]] [--url URL] [config.ini]
+ *   autod slots (same options)
+ *   autod commands (same options)
+ *   autod nodes import -f nodes.json [--url URL] [config.ini]
+ *   autod token create [--ttl S] [--uses N] [--note TEXT] [--token T] [--url URL] [config.ini]
+ *   autod token list [--token T] [--url URL] [config.ini]
+ *   autod bench exec|register|echo [-n N | -d S] [-c N] [--rate R] [--path P] [--arg A]...
+ *               [--slot S] [--nodes N] [--max-error-pct P] [--max-p99-ms MS] [-o table|json]
+ *               [--url URL] [config.ini]
+ *   autod completion bash|zsh|fish
+ */
+
+/* Whether argv[1] names a CLI command rather than a daemon option. */
+int cli_is_command(const char *arg);
+
+/* Run the command in argv[0]. Returns the process exit code. */
+int cli_main(int argc, char **argv);
+
+#endif
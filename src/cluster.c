@@ -0,0 +1,512 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <stdarg.h>
+#include <pthread.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "cluster.h"
+#include "replica.h"
+
+#define CLUSTER_BUCKETS 15
+#define CLUSTER_ERROR_RATE_MIN_ATTEMPTS 5
+#define CLUSTER_ERROR_RATE_DEGRADED 0.2
+
+typedef struct {
+    long long minute;
+    unsigned ok;
+    unsigned failed;
+} cluster_bucket_t;
+
+static pthread_mutex_t g_cluster_lock = PTHREAD_MUTEX_INITIALIZER;
+static cluster_bucket_t g_buckets[CLUSTER_BUCKETS];
+
+void cluster_note_dispatch(const char *kind, int ok) {
+    (void)kind;
+    long long minute = now_ms() / 60000LL;
+    pthread_mutex_lock(&g_cluster_lock);
+    cluster_bucket_t *b = &g_buckets[minute % CLUSTER_BUCKETS];
+    if (b->minute != minute) {
+        b->minute = minute;
+        b->ok = 0;
+        b->failed = 0;
+    }
+    if (ok) b->ok++;
+    else b->failed++;
+    pthread_mutex_unlock(&g_cluster_lock);
+}
+
+#define CLUSTER_NODE_SLOTS 64
+#define CLUSTER_LATENCY_SAMPLES 64
+
+typedef struct {
+    char node[128];
+    unsigned long ok;
+    unsigned long failed;
+    unsigned long long bytes_sent;
+    unsigned long long bytes_received;
+    long long latency[CLUSTER_LATENCY_SAMPLES];
+    unsigned latency_count;    /* total samples; the ring holds the newest */
+    unsigned streak;           /* failures since the last success */
+    long long last_ms;
+} cluster_node_entry_t;
+
+static cluster_node_entry_t g_node_stats[CLUSTER_NODE_SLOTS];
+static unsigned long g_node_stats_version;
+
+void cluster_note_node_dispatch(const char *node, int ok, long long latency_ms,
+                                size_t bytes_sent, size_t bytes_received) {
+    if (!node || !*node) return;
+    pthread_mutex_lock(&g_cluster_lock);
+    cluster_node_entry_t *e = NULL, *victim = NULL;
+    for (int i = 0; i < CLUSTER_NODE_SLOTS; i++) {
+        cluster_node_entry_t *cur = &g_node_stats[i];
+        if (cur->node[0] && !strcmp(cur->node, node)) {
+            e = cur;
+            break;
+        }
+        /* Prefer a free entry, else the node dispatched to longest ago. */
+        if (!victim || (victim->node[0] && (!cur->node[0] || cur->last_ms < victim->last_ms))) {
+            victim = cur;
+        }
+    }
+    if (!e) {
+        e = victim;
+        memset(e, 0, sizeof(*e));
+        strncpy(e->node, node, sizeof(e->node) - 1);
+    }
+    if (ok) {
+        e->ok++;
+        e->streak = 0;
+    } else {
+        e->failed++;
+        e->streak++;
+    }
+    e->bytes_sent += bytes_sent;
+    e->bytes_received += bytes_received;
+    if (latency_ms >= 0) {
+        e->latency[e->latency_count % CLUSTER_LATENCY_SAMPLES] = latency_ms;
+        e->latency_count++;
+    }
+    e->last_ms = now_ms();
+    g_node_stats_version++;
+    pthread_mutex_unlock(&g_cluster_lock);
+}
+
+static int cluster_cmp_ll(const void *a, const void *b) {
+    long long x = *(const long long *)a, y = *(const long long *)b;
+    return (x > y) - (x < y);
+}
+
+int cluster_node_stats(const char *node, cluster_node_stats_t *out) {
+    if (!node || !*node || !out) return -1;
+    memset(out, 0, sizeof(*out));
+    long long samples[CLUSTER_LATENCY_SAMPLES];
+    unsigned n = 0;
+    int found = -1;
+    pthread_mutex_lock(&g_cluster_lock);
+    for (int i = 0; i < CLUSTER_NODE_SLOTS; i++) {
+        const cluster_node_entry_t *e = &g_node_stats[i];
+        if (!e->node[0] || strcmp(e->node, node) != 0) continue;
+        out->ok = e->ok;
+        out->failed = e->failed;
+        out->bytes_sent = e->bytes_sent;
+        out->bytes_received = e->bytes_received;
+        out->consecutive_failures = e->streak;
+        n = e->latency_count < CLUSTER_LATENCY_SAMPLES ? e->latency_count : CLUSTER_LATENCY_SAMPLES;
+        memcpy(samples, e->latency, n * sizeof(samples[0]));
+        found = 0;
+        break;
+    }
+    pthread_mutex_unlock(&g_cluster_lock);
+    if (found != 0) return -1;
+    out->attempts = out->ok + out->failed;
+    out->success_rate = out->attempts ? (double)out->ok / (double)out->attempts : 0.0;
+    if (n > 0) {
+        qsort(samples, n, sizeof(samples[0]), cluster_cmp_ll);
+        out->p50_ms = samples[(n - 1) * 50 / 100];
+        out->p95_ms = samples[(n - 1) * 95 / 100];
+    } else {
+        out->p50_ms = -1;
+        out->p95_ms = -1;
+    }
+    return 0;
+}
+
+JSON_Value *cluster_node_stats_json(const cluster_node_stats_t *st) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_number(o, "attempts", (double)st->attempts);
+    json_object_set_number(o, "ok", (double)st->ok);
+    json_object_set_number(o, "failed", (double)st->failed);
+    json_object_set_number(o, "success_rate", st->success_rate);
+    if (st->p50_ms >= 0) json_object_set_number(o, "p50_ms", (double)st->p50_ms);
+    if (st->p95_ms >= 0) json_object_set_number(o, "p95_ms", (double)st->p95_ms);
+    json_object_set_number(o, "bytes_sent", (double)st->bytes_sent);
+    json_object_set_number(o, "bytes_received", (double)st->bytes_received);
+    if (st->consecutive_failures) {
+        json_object_set_number(o, "consecutive_failures", st->consecutive_failures);
+    }
+    return v;
+}
+
+void cluster_node_reset_streak(const char *node) {
+    if (!node || !*node) return;
+    pthread_mutex_lock(&g_cluster_lock);
+    for (int i = 0; i < CLUSTER_NODE_SLOTS; i++) {
+        cluster_node_entry_t *e = &g_node_stats[i];
+        if (!e->node[0] || strcmp(e->node, node) != 0) continue;
+        if (e->streak) {
+            e->streak = 0;
+            g_node_stats_version++;
+        }
+        break;
+    }
+    pthread_mutex_unlock(&g_cluster_lock);
+}
+
+unsigned long cluster_node_stats_version(void) {
+    pthread_mutex_lock(&g_cluster_lock);
+    unsigned long v = g_node_stats_version;
+    pthread_mutex_unlock(&g_cluster_lock);
+    return v;
+}
+
+int cluster_node_compare(const char *a, const char *b) {
+    cluster_node_stats_t sa, sb;
+    int ha = cluster_node_stats(a, &sa) == 0 && sa.attempts > 0;
+    int hb = cluster_node_stats(b, &sb) == 0 && sb.attempts > 0;
+    if (ha != hb) return ha ? -1 : 1;
+    if (!ha) return 0;
+    if (sa.success_rate != sb.success_rate) return sa.success_rate > sb.success_rate ? -1 : 1;
+    if (sa.p50_ms != sb.p50_ms) {
+        if (sa.p50_ms < 0) return 1;
+        if (sb.p50_ms < 0) return -1;
+        return sa.p50_ms < sb.p50_ms ? -1 : 1;
+    }
+    return 0;
+}
+
+static void cluster_dispatch_window(int minutes, unsigned *ok, unsigned *failed) {
+    long long now_minute = now_ms() / 60000LL;
+    *ok = 0;
+    *failed = 0;
+    pthread_mutex_lock(&g_cluster_lock);
+    for (int i = 0; i < CLUSTER_BUCKETS; i++) {
+        const cluster_bucket_t *b = &g_buckets[i];
+        if (b->minute > now_minute - minutes && b->minute <= now_minute) {
+            *ok += b->ok;
+            *failed += b->failed;
+        }
+    }
+    pthread_mutex_unlock(&g_cluster_lock);
+}
+
+static JSON_Value *cluster_dispatch_json(int minutes, double *rate_out, unsigned *attempts_out) {
+    unsigned ok = 0, failed = 0;
+    cluster_dispatch_window(minutes, &ok, &failed);
+    unsigned attempts = ok + failed;
+    double rate = attempts ? (double)failed / (double)attempts : 0.0;
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_number(o, "window_s", minutes * 60);
+    json_object_set_number(o, "attempts", attempts);
+    json_object_set_number(o, "errors", failed);
+    json_object_set_number(o, "error_rate", rate);
+    if (rate_out) *rate_out = rate;
+    if (attempts_out) *attempts_out = attempts;
+    return v;
+}
+
+static int h_cluster_health(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    if (replica_handle(c, cfg)) {
+        free(cfg);
+        return 1;
+    }
+    if (strcasecmp(cfg->sync_role, "master") != 0) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri || strcmp(ri->request_method, "GET") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+    int strict = 0;
+    if (ri->query_string) {
+        char buf[8];
+        if (mg_get_var(ri->query_string, strlen(ri->query_string), "strict", buf, sizeof(buf)) > 0) {
+            strict = atoi(buf) != 0 || !strcasecmp(buf, "true");
+        }
+    }
+
+    int total = 0, online = 0, down = 0, waiting = 0, via_mqtt = 0, expected = 0, quarantined = 0;
+    int assigned = 0, unassigned = 0, stale = 0, pending_ack = 0;
+    JSON_Value *stale_v = json_value_init_array();
+    JSON_Array *stale_arr = json_array(stale_v);
+
+    pthread_mutex_lock(&app->master.lock);
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        const sync_slave_record_t *rec = &app->master.records[i];
+        if (!rec->in_use) continue;
+        total++;
+        if (rec->down) down++;
+        else online++;
+        if (!rec->down && rec->slot_index < 0) waiting++;
+        if (!strcmp(rec->transport, "mqtt")) via_mqtt++;
+        if (rec->quarantined_ms > 0) quarantined++;
+    }
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        const sync_expected_node_t *e = &app->master.expected[i];
+        if (e->in_use && e->first_seen_ms <= 0) expected++;
+    }
+    int slot_count = sync_slot_count(cfg);
+    for (int slot = 0; slot < slot_count; slot++) {
+        const char *id = app->master.slot_assignees[slot];
+        if (!id[0]) {
+            unassigned++;
+            continue;
+        }
+        assigned++;
+        const sync_slave_record_t *rec = NULL;
+        for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+            if (app->master.records[i].in_use && !strcmp(app->master.records[i].id, id)) {
+                rec = &app->master.records[i];
+                break;
+            }
+        }
+        const sync_slot_health_t *h = &app->master.slot_health[slot];
+        const char *why = !rec ? "missing" : rec->down ? "node_down"
+                        : (!strcmp(h->state, "degraded") && !strcmp(h->id, id)) ? "health_degraded"
+                        : NULL;
+        if (why) {
+            stale++;
+            JSON_Value *item = json_value_init_object();
+            JSON_Object *io = json_object(item);
+            json_object_set_number(io, "slot", slot + 1);
+            json_object_set_string(io, "assigned_id", id);
+            json_object_set_string(io, "reason", why);
+            if (rec) json_object_set_number(io, "last_seen_ms", (double)rec->last_seen_ms);
+            json_array_append_value(stale_arr, item);
+        } else if (rec->last_ack_generation < app->master.slot_generation[slot]) {
+            pending_ack++;
+        }
+    }
+    pthread_mutex_unlock(&app->master.lock);
+
+    double rate5 = 0.0;
+    unsigned attempts5 = 0;
+    JSON_Value *d5 = cluster_dispatch_json(5, &rate5, &attempts5);
+    JSON_Value *d15 = cluster_dispatch_json(CLUSTER_BUCKETS, NULL, NULL);
+
+    JSON_Value *reasons_v = json_value_init_array();
+    JSON_Array *reasons = json_array(reasons_v);
+    const char *status = "ok";
+    if (total > 0 && online == 0) {
+        json_array_append_string(reasons, "no_nodes_online");
+        status = "critical";
+    }
+    if (assigned > 0 && stale == assigned) {
+        json_array_append_string(reasons, "all_bindings_stale");
+        status = "critical";
+    }
+    int degraded = 0;
+    if (down > 0) { json_array_append_string(reasons, "nodes_down"); degraded = 1; }
+    if (stale > 0 && stale < assigned) { json_array_append_string(reasons, "stale_bindings"); degraded = 1; }
+    if (waiting > 0) { json_array_append_string(reasons, "nodes_waiting"); degraded = 1; }
+    if (quarantined > 0) { json_array_append_string(reasons, "nodes_quarantined"); degraded = 1; }
+    if (attempts5 >= CLUSTER_ERROR_RATE_MIN_ATTEMPTS && rate5 >= CLUSTER_ERROR_RATE_DEGRADED) {
+        json_array_append_string(reasons, "dispatch_errors");
+        degraded = 1;
+    }
+    if (degraded && !strcmp(status, "ok")) status = "degraded";
+
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    json_object_set_string(ro, "status", status);
+    json_object_set_value(ro, "reasons", reasons_v);
+
+    JSON_Value *nodes_v = json_value_init_object();
+    JSON_Object *no = json_object(nodes_v);
+    json_object_set_number(no, "total", total);
+    json_object_set_number(no, "online", online);
+    json_object_set_number(no, "down", down);
+    json_object_set_number(no, "waiting", waiting);
+    json_object_set_number(no, "mqtt", via_mqtt);
+    json_object_set_number(no, "expected", expected);
+    json_object_set_number(no, "quarantined", quarantined);
+    json_object_set_value(ro, "nodes", nodes_v);
+
+    JSON_Value *slots_v = json_value_init_object();
+    JSON_Object *so = json_object(slots_v);
+    json_object_set_number(so, "total", slot_count);
+    json_object_set_number(so, "assigned", assigned);
+    json_object_set_number(so, "unassigned", unassigned);
+    json_object_set_number(so, "pending_ack", pending_ack);
+    json_object_set_value(so, "stale", stale_v);
+    json_object_set_value(ro, "slots", slots_v);
+
+    JSON_Value *disp_v = json_value_init_object();
+    json_object_set_value(json_object(disp_v), "last_5m", d5);
+    json_object_set_value(json_object(disp_v), "last_15m", d15);
+    unsigned long reused = 0;
+    int idle = 0;
+    httpc_pool_stats(&reused, &idle);
+    JSON_Value *conn_v = json_value_init_object();
+    json_object_set_number(json_object(conn_v), "reused", (double)reused);
+    json_object_set_number(json_object(conn_v), "idle", idle);
+    json_object_set_value(json_object(disp_v), "connections", conn_v);
+    json_object_set_value(ro, "dispatch", disp_v);
+
+    int code = 200;
+    if (!strcmp(status, "critical") || (strict && degraded)) code = 503;
+    send_json(c, resp, code, 1);
+    json_value_free(resp);
+    free(cfg);
+    return 1;
+}
+
+typedef struct {
+    char *buf;
+    size_t len;
+    size_t cap;
+} cluster_text_t;
+
+static void cluster_text_printf(cluster_text_t *t, const char *fmt, ...) {
+    if (!t->buf) return;
+    for (;;) {
+        va_list ap;
+        va_start(ap, fmt);
+        int n = vsnprintf(t->buf + t->len, t->cap - t->len, fmt, ap);
+        va_end(ap);
+        if (n < 0) return;
+        if ((size_t)n < t->cap - t->len) {
+            t->len += (size_t)n;
+            return;
+        }
+        size_t ncap = t->cap * 2 + (size_t)n;
+        char *nb = realloc(t->buf, ncap);
+        if (!nb) {
+            free(t->buf);
+            t->buf = NULL;
+            return;
+        }
+        t->buf = nb;
+        t->cap = ncap;
+    }
+}
+
+/* Escape a Prometheus label value in place (names are at most 127 bytes). */
+static void cluster_escape_label(char *s, size_t sz) {
+    char tmp[256];
+    size_t o = 0;
+    for (const char *p = s; *p && o + 2 < sizeof(tmp); p++) {
+        if (*p == '"' || *p == '\\') tmp[o++] = '\\';
+        tmp[o++] = *p == '\n' ? ' ' : *p;
+    }
+    tmp[o] = '\0';
+    snprintf(s, sz, "%s", tmp);
+}
+
+/* GET /metrics: per-node dispatch statistics and [capacity] usage in the
+ * Prometheus text format. */
+static int h_metrics(struct mg_connection *c, void *ud) {
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri || strcmp(ri->request_method, "GET") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        return 1;
+    }
+    char names[CLUSTER_NODE_SLOTS][256];
+    int count = 0;
+    pthread_mutex_lock(&g_cluster_lock);
+    for (int i = 0; i < CLUSTER_NODE_SLOTS; i++) {
+        if (!g_node_stats[i].node[0]) continue;
+        memcpy(names[count++], g_node_stats[i].node, sizeof(g_node_stats[i].node));
+    }
+    pthread_mutex_unlock(&g_cluster_lock);
+
+    cluster_node_stats_t st[CLUSTER_NODE_SLOTS];
+    for (int i = 0; i < count; i++) {
+        if (cluster_node_stats(names[i], &st[i]) != 0) memset(&st[i], 0, sizeof(st[i]));
+        cluster_escape_label(names[i], sizeof(names[i]));
+    }
+
+    cluster_text_t t = { malloc(4096), 0, 4096 };
+    cluster_text_printf(&t, "# HELP autod_node_dispatch_total Requests sent to a node, by result.\n"
+                            "# TYPE autod_node_dispatch_total counter\n");
+    for (int i = 0; i < count; i++) {
+        cluster_text_printf(&t, "autod_node_dispatch_total{node=\"%s\",result=\"ok\"} %lu\n",
+                            names[i], st[i].ok);
+        cluster_text_printf(&t, "autod_node_dispatch_total{node=\"%s\",result=\"failed\"} %lu\n",
+                            names[i], st[i].failed);
+    }
+    cluster_text_printf(&t, "# HELP autod_node_dispatch_latency_ms Latency of the last 64 requests to a node.\n"
+                            "# TYPE autod_node_dispatch_latency_ms summary\n");
+    for (int i = 0; i < count; i++) {
+        if (st[i].p50_ms < 0) continue;
+        cluster_text_printf(&t, "autod_node_dispatch_latency_ms{node=\"%s\",quantile=\"0.5\"} %lld\n",
+                            names[i], st[i].p50_ms);
+        cluster_text_printf(&t, "autod_node_dispatch_latency_ms{node=\"%s\",quantile=\"0.95\"} %lld\n",
+                            names[i], st[i].p95_ms);
+    }
+    cluster_text_printf(&t, "# HELP autod_node_bytes_total Request and response body bytes exchanged with a node.\n"
+                            "# TYPE autod_node_bytes_total counter\n");
+    for (int i = 0; i < count; i++) {
+        cluster_text_printf(&t, "autod_node_bytes_total{node=\"%s\",direction=\"sent\"} %llu\n",
+                            names[i], st[i].bytes_sent);
+        cluster_text_printf(&t, "autod_node_bytes_total{node=\"%s\",direction=\"received\"} %llu\n",
+                            names[i], st[i].bytes_received);
+    }
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (cfg) {
+        app_config_snapshot((app_t *)ud, cfg);
+        capacity_usage_t u[CAPACITY_RESOURCES];
+        int stale = 0;
+        capacity_snapshot((app_t *)ud, cfg, u, &stale);
+        free(cfg);
+        cluster_text_printf(&t, "# HELP autod_capacity_used Entries held against a [capacity] cap.\n"
+                                "# TYPE autod_capacity_used gauge\n");
+        for (int r = 0; r < CAPACITY_RESOURCES; r++) {
+            cluster_text_printf(&t, "autod_capacity_used{resource=\"%s\"} %d\n", u[r].name, u[r].used);
+        }
+        cluster_text_printf(&t, "# HELP autod_capacity_limit The [capacity] cap.\n"
+                                "# TYPE autod_capacity_limit gauge\n");
+        for (int r = 0; r < CAPACITY_RESOURCES; r++) {
+            cluster_text_printf(&t, "autod_capacity_limit{resource=\"%s\"} %d\n", u[r].name, u[r].limit);
+        }
+        cluster_text_printf(&t, "# HELP autod_capacity_rejected_total Admissions refused at a [capacity] cap.\n"
+                                "# TYPE autod_capacity_rejected_total counter\n");
+        for (int r = 0; r < CAPACITY_RESOURCES; r++) {
+            cluster_text_printf(&t, "autod_capacity_rejected_total{resource=\"%s\"} %lu\n", u[r].name,
+                                u[r].rejected);
+        }
+        cluster_text_printf(&t, "# HELP autod_registry_stale_nodes Registry records with no slot, silent for node_down_after_s.\n"
+                                "# TYPE autod_registry_stale_nodes gauge\n"
+                                "autod_registry_stale_nodes %d\n", stale);
+    }
+    if (!t.buf) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    send_plain(c, 200, t.buf, 1);
+    free(t.buf);
+    return 1;
+}
+
+void cluster_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    api_set_handler(ctx, "/cluster/health", h_cluster_health, app);
+    api_set_handler(ctx, "/metrics", h_metrics, app);
+}
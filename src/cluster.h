@@ -0,0 +1,44 @@
+#ifndef AUTOD_CLUSTER_H
+#define AUTOD_CLUSTER_H
+
+#include <stddef.h>
+
+#include "parson.h"
+
+typedef struct app app_t;
+struct mg_context;
+
+/* Record the outcome of a request the master sent to a node (HTTP relay,
+ * MQTT exec, ...). Kept in one-minute buckets for /cluster/health. */
+void cluster_note_dispatch(const char *kind, int ok);
+
+/* Per-node view of the same dispatches, keyed by sync id (or address when
+ * the node has none). Latency percentiles cover the last 64 requests. */
+typedef struct {
+    unsigned long attempts;
+    unsigned long ok;
+    unsigned long failed;
+    double success_rate;
+    long long p50_ms;
+    long long p95_ms;
+    unsigned long long bytes_sent;
+    unsigned long long bytes_received;
+    unsigned consecutive_failures; /* since the last successful request */
+} cluster_node_stats_t;
+
+void cluster_note_node_dispatch(const char *node, int ok, long long latency_ms,
+                                size_t bytes_sent, size_t bytes_received);
+/* Returns 0 and fills out when the node has dispatch history. */
+int cluster_node_stats(const char *node, cluster_node_stats_t *out);
+JSON_Value *cluster_node_stats_json(const cluster_node_stats_t *st);
+/* Start the node's consecutive failure count over (after re-admission). */
+void cluster_node_reset_streak(const char *node);
+/* Changes whenever any node's stats change (for response caches). */
+unsigned long cluster_node_stats_version(void);
+/* Order two nodes for routing ties: negative when a looks healthier than b
+ * (higher success rate, then lower p50). Nodes without history rank last. */
+int cluster_node_compare(const char *a, const char *b);
+
+void cluster_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
@@ -0,0 +1,109 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <fnmatch.h>
+#include <pthread.h>
+#include <stdint.h>
+
+#include "civetweb.h"
+#include "autod.h"
+#include "confirm.h"
+
+typedef struct {
+    int in_use;
+    char token[CONFIRM_TOKEN_LEN + 1];
+    uint64_t fingerprint;
+    long long expires_ms;
+} confirm_entry_t;
+
+static pthread_mutex_t g_confirm_lock = PTHREAD_MUTEX_INITIALIZER;
+static confirm_entry_t g_confirm[CONFIRM_MAX_PENDING];
+
+static uint64_t confirm_fingerprint(const char *s) {
+    uint64_t h = 1469598103934665603ULL;
+    for (; *s; s++) {
+        h ^= (unsigned char)*s;
+        h *= 1099511628211ULL;
+    }
+    return h;
+}
+
+int confirm_required(const config_t *cfg, const char *path) {
+    if (!cfg || !path) return 0;
+    for (int i = 0; i < cfg->exec_confirm_count; i++) {
+        if (fnmatch(cfg->exec_confirm[i], path, 0) == 0) return 1;
+    }
+    return 0;
+}
+
+/* Expired entries are dropped; a full table evicts the one expiring first. */
+static confirm_entry_t *confirm_alloc_locked(long long now) {
+    confirm_entry_t *victim = NULL;
+    for (int i = 0; i < CONFIRM_MAX_PENDING; i++) {
+        confirm_entry_t *e = &g_confirm[i];
+        if (e->in_use && e->expires_ms <= now) memset(e, 0, sizeof(*e));
+        if (!e->in_use) return e;
+        if (!victim || e->expires_ms < victim->expires_ms) victim = e;
+    }
+    memset(victim, 0, sizeof(*victim));
+    return victim;
+}
+
+int confirm_gate(struct mg_connection *c, const config_t *cfg, JSON_Object *body,
+                 JSON_Value *request, JSON_Value *preview) {
+    char *canon = json_serialize_to_string(request);
+    if (!canon) {
+        json_value_free(preview);
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    uint64_t fp = confirm_fingerprint(canon);
+    json_free_serialized_string(canon);
+
+    const char *token = mg_get_header(c, "X-Confirm-Token");
+    if (!token || !*token) token = json_object_get_string(body, "confirm_token");
+    long long now = now_ms();
+
+    if (token && *token) {
+        json_value_free(preview);
+        const char *err = "invalid_confirm_token";
+        pthread_mutex_lock(&g_confirm_lock);
+        for (int i = 0; i < CONFIRM_MAX_PENDING; i++) {
+            confirm_entry_t *e = &g_confirm[i];
+            if (!e->in_use || strcmp(e->token, token) != 0) continue;
+            /* Tokens are single-use, whatever the outcome. */
+            err = e->expires_ms <= now ? "confirm_token_expired"
+                : e->fingerprint != fp ? "confirm_token_mismatch" : NULL;
+            memset(e, 0, sizeof(*e));
+            break;
+        }
+        pthread_mutex_unlock(&g_confirm_lock);
+        if (!err) return 0;
+        send_json_error(c, 409, err);
+        return 1;
+    }
+
+    int ttl_s = cfg->exec_confirm_ttl_s > 0 ? cfg->exec_confirm_ttl_s : 60;
+    char tok[CONFIRM_TOKEN_LEN + 1];
+    if (random_token(tok, sizeof(tok)) < 0) {
+        send_json_error(c, 500, "entropy_unavailable");
+        return 1;
+    }
+    pthread_mutex_lock(&g_confirm_lock);
+    confirm_entry_t *e = confirm_alloc_locked(now);
+    e->in_use = 1;
+    memcpy(e->token, tok, sizeof(e->token));
+    e->fingerprint = fp;
+    e->expires_ms = now + (long long)ttl_s * 1000LL;
+    pthread_mutex_unlock(&g_confirm_lock);
+
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "error", "confirmation_required");
+    json_object_set_string(o, "confirm_token", tok);
+    json_object_set_number(o, "expires_in_s", ttl_s);
+    if (preview) json_object_set_value(o, "preview", preview);
+    send_json(c, v, 428, 1);
+    json_value_free(v);
+    return 1;
+}
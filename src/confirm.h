@@ -0,0 +1,30 @@
+#ifndef AUTOD_CONFIRM_H
+#define AUTOD_CONFIRM_H
+
+#include <stddef.h>
+
+#include "parson.h"
+
+#define CONFIRM_MAX_PENDING 32
+#define CONFIRM_TOKEN_LEN 32
+
+typedef struct config config_t;
+struct mg_connection;
+
+/* Whether an exec path matches one of the [exec] confirm globs. */
+int confirm_required(const config_t *cfg, const char *path);
+
+/*
+ * Two-phase gate for a command that requires confirmation. request is the
+ * canonical description of what will run (path, args, targets); preview is
+ * shown to the caller alongside the token and is consumed.
+ *
+ * Without a token (body "confirm_token" or X-Confirm-Token header) a single-
+ * use token bound to request is issued and 428 confirmation_required is
+ * sent. A valid token is consumed and 0 is returned so the caller runs the
+ * command; otherwise an error is sent. Returns 1 whenever a response was sent.
+ */
+int confirm_gate(struct mg_connection *c, const config_t *cfg, JSON_Object *body,
+                 JSON_Value *request, JSON_Value *preview);
+
+#endif
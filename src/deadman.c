@@ -0,0 +1,402 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <signal.h>
+#include <unistd.h>
+#include <pthread.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "events.h"
+#include "sync_results.h"
+#include "deadman.h"
+
+extern volatile sig_atomic_t g_stop;
+
+/* What happened to one action during the current outage, by name so a
+ * reload that reorders the sections does not mix them up. */
+typedef struct {
+    char name[32];                /* empty = free */
+    int runs;
+    long long last_run_ms;
+    long long last_run_unix_ms;
+    int rc;
+    char error[24];
+} deadman_state_t;
+
+static pthread_mutex_t g_deadman_lock = PTHREAD_MUTEX_INITIALIZER;
+static long long g_last_ok_ms;
+static long long g_outage_start_ms;   /* last contact before the first action ran */
+static int g_tripped;
+static int g_ok_streak;               /* registrations in a row since tripping */
+static deadman_state_t g_state[DEADMAN_MAX_ACTIONS];
+static pthread_t g_deadman_thread;
+static int g_deadman_running;
+static volatile int g_deadman_stop;
+
+/* ---------- Config ---------- */
+
+void deadman_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->deadman, 0, sizeof(cfg->deadman));
+    cfg->deadman.recover_heartbeats = 3;
+}
+
+static deadman_action_t *deadman_find_or_add(config_t *cfg, const char *name) {
+    for (int i = 0; i < cfg->deadman.action_count; i++) {
+        if (!strcmp(cfg->deadman.actions[i].name, name)) return &cfg->deadman.actions[i];
+    }
+    if (cfg->deadman.action_count >= DEADMAN_MAX_ACTIONS) return NULL;
+    deadman_action_t *a = &cfg->deadman.actions[cfg->deadman.action_count++];
+    memset(a, 0, sizeof(*a));
+    snprintf(a->name, sizeof(a->name), "%s", name);
+    return a;
+}
+
+/* An exec payload as [startup] exec takes it: an object with a path. */
+static int deadman_valid_exec(const char *value) {
+    JSON_Value *v = json_parse_string(value);
+    const char *path = json_object_get_string(json_object(v), "path");
+    int ok = path && *path;
+    if (v) json_value_free(v);
+    return ok;
+}
+
+int deadman_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (!strcmp(section, "deadman")) {
+        int v = atoi(value);
+        if (!strcmp(key, "recover_heartbeats")) {
+            if (v >= 1) cfg->deadman.recover_heartbeats = v;
+            else fprintf(stderr, "WARN: ignoring deadman recover_heartbeats %s (minimum 1)\n", value);
+        } else {
+            fprintf(stderr, "WARN: ignoring unknown deadman key '%s'\n", key);
+        }
+        return 1;
+    }
+    if (strncmp(section, "deadman.", 8) != 0 || !section[8]) return 0;
+    deadman_action_t *a = deadman_find_or_add(cfg, section + 8);
+    if (!a) {
+        fprintf(stderr, "WARN: deadman action capacity reached (%d)\n", DEADMAN_MAX_ACTIONS);
+        return 1;
+    }
+    if (!strcmp(key, "after_min") || !strcmp(key, "repeat_min")) {
+        int v = atoi(value);
+        int min = key[0] == 'a' ? 1 : 0;
+        if (v < min) fprintf(stderr, "WARN: deadman %s: ignoring %s '%s' (minimum %d)\n", a->name, key, value, min);
+        else if (key[0] == 'a') a->after_min = v;
+        else a->repeat_min = v;
+    } else if (!strcmp(key, "exec") || !strcmp(key, "recover_exec")) {
+        char *dst = key[0] == 'e' ? a->exec : a->recover_exec;
+        size_t dst_sz = key[0] == 'e' ? sizeof(a->exec) : sizeof(a->recover_exec);
+        if (strlen(value) >= dst_sz || !deadman_valid_exec(value)) {
+            fprintf(stderr, "WARN: deadman %s: ignoring %s '%s' (expected {\"path\":...})\n", a->name, key, value);
+        } else {
+            snprintf(dst, dst_sz, "%s", value);
+        }
+    } else {
+        fprintf(stderr, "WARN: deadman %s: ignoring unknown key '%s'\n", a->name, key);
+    }
+    return 1;
+}
+
+/* ---------- State ---------- */
+
+void deadman_note_contact(int ok) {
+    pthread_mutex_lock(&g_deadman_lock);
+    if (ok) {
+        g_last_ok_ms = now_ms();
+        if (g_tripped) g_ok_streak++;
+    } else {
+        g_ok_streak = 0;
+    }
+    pthread_mutex_unlock(&g_deadman_lock);
+}
+
+static deadman_state_t *deadman_state_locked(const char *name, int add) {
+    deadman_state_t *free_slot = NULL;
+    for (int i = 0; i < DEADMAN_MAX_ACTIONS; i++) {
+        if (!strcmp(g_state[i].name, name)) return &g_state[i];
+        if (!g_state[i].name[0] && !free_slot) free_slot = &g_state[i];
+    }
+    if (!add || !free_slot) return NULL;
+    memset(free_slot, 0, sizeof(*free_slot));
+    snprintf(free_slot->name, sizeof(free_slot->name), "%s", name);
+    return free_slot;
+}
+
+/* ---------- Actions ---------- */
+
+/* Run one exec payload the way startup commands run. Returns 0 with *rc set
+ * once it ran, otherwise -1 with a short reason in error. */
+static int deadman_run(const config_t *cfg, const char *name, const char *raw,
+                       int *rc, char *error, size_t error_sz) {
+    JSON_Value *cmd = json_parse_string(raw);
+    JSON_Object *obj = json_object(cmd);
+    const char *path = json_object_get_string(obj, "path");
+    int result = -1;
+    if (!path || !*path) {
+        snprintf(error, error_sz, "bad_exec");
+    } else if (!catalog_allows(cfg, path)) {
+        fprintf(stderr, "deadman %s: %s not allowed by the command catalog\n", name, path);
+        sync_results_record(cfg, "deadman", 0, path, "refused", 0, 0);
+        snprintf(error, error_sz, "command_not_allowed");
+    } else {
+        int unknown_profile = 0;
+        const exec_profile_t *profile =
+            profile_select(cfg, path, json_object_get_string(obj, "profile"), &unknown_profile);
+        if (unknown_profile) {
+            fprintf(stderr, "deadman %s: unknown profile '%s' for %s\n", name,
+                    json_object_get_string(obj, "profile"), path);
+            sync_results_record(cfg, "deadman", 0, path, "refused", 0, 0);
+            snprintf(error, error_sz, "unknown_profile");
+        } else {
+            char *out = NULL, *err = NULL;
+            long long elapsed = 0;
+            sync_results_record(cfg, "deadman", 0, path, "started", 0, 0);
+            int r = run_exec(cfg, path, json_object_get_array(obj, "args"), cfg->exec_timeout_ms,
+                             cfg->max_output_bytes, profile, NULL, rc, &elapsed, &out, &err,
+                             NULL, NULL, NULL);
+            sync_results_record(cfg, "deadman", 0, path, r == 0 ? "finished" : "failed",
+                                r == 0 ? *rc : r, elapsed);
+            if (r == 0) {
+                fprintf(stderr, "deadman %s: %s rc=%d elapsed=%lldms\n", name, path, *rc, elapsed);
+                result = 0;
+            } else {
+                fprintf(stderr, "deadman %s: failed to execute %s%s\n", name, path,
+                        r == EXEC_ERR_NOT_FOUND ? " (binary not found)" :
+                        r == EXEC_ERR_INTEGRITY ? " (integrity check failed)" : "");
+                snprintf(error, error_sz, "%s", r == EXEC_ERR_NOT_FOUND ? "binary_not_found" :
+                         r == EXEC_ERR_CAPACITY ? "jobs_full" :
+                         r == EXEC_ERR_INTEGRITY ? "integrity_mismatch" : "spawn_failed");
+            }
+            free(out);
+            free(err);
+        }
+    }
+    if (cmd) json_value_free(cmd);
+    return result;
+}
+
+static void deadman_fire(const config_t *cfg, const deadman_action_t *a, long long outage_ms, int runs) {
+    fprintf(stderr, "deadman %s: no master contact for %llds, running %s\n", a->name,
+            outage_ms / 1000, runs > 1 ? "again" : "its fallback");
+    int rc = 0;
+    char error[24] = "";
+    int r = deadman_run(cfg, a->name, a->exec, &rc, error, sizeof(error));
+
+    pthread_mutex_lock(&g_deadman_lock);
+    deadman_state_t *st = deadman_state_locked(a->name, 0);
+    if (st) {
+        st->rc = r == 0 ? rc : 0;
+        snprintf(st->error, sizeof(st->error), "%s", error);
+    }
+    pthread_mutex_unlock(&g_deadman_lock);
+
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_string(eo, "action", a->name);
+    json_object_set_number(eo, "after_min", a->after_min);
+    json_object_set_number(eo, "outage_s", (double)(outage_ms / 1000));
+    json_object_set_number(eo, "runs", runs);
+    if (r == 0) json_object_set_number(eo, "rc", rc);
+    else json_object_set_string(eo, "error", error);
+    (void)events_emit("deadman_fired", ev);
+}
+
+/* The master has been back for recover_heartbeats registrations: undo what
+ * ran, in reverse order, and record the outage. */
+static void deadman_recover(const config_t *cfg, const deadman_state_t *fired, int fired_count,
+                            long long outage_ms, int heartbeats) {
+    fprintf(stderr, "deadman: master contact restored after %llds (%d action(s) ran)\n",
+            outage_ms / 1000, fired_count);
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_number(eo, "outage_s", (double)(outage_ms / 1000));
+    json_object_set_number(eo, "heartbeats", heartbeats);
+    JSON_Value *actions_v = json_value_init_array();
+    JSON_Array *actions = json_array(actions_v);
+    for (int i = fired_count - 1; i >= 0; i--) {
+        JSON_Value *av = json_value_init_object();
+        JSON_Object *ao = json_object(av);
+        json_object_set_string(ao, "action", fired[i].name);
+        json_object_set_number(ao, "runs", fired[i].runs);
+        const deadman_action_t *a = NULL;
+        for (int j = 0; j < cfg->deadman.action_count; j++) {
+            if (!strcmp(cfg->deadman.actions[j].name, fired[i].name)) a = &cfg->deadman.actions[j];
+        }
+        if (a && a->recover_exec[0]) {
+            int rc = 0;
+            char error[24] = "";
+            if (deadman_run(cfg, a->name, a->recover_exec, &rc, error, sizeof(error)) == 0) {
+                json_object_set_number(ao, "recover_rc", rc);
+            } else {
+                json_object_set_string(ao, "recover_error", error);
+            }
+        }
+        json_array_append_value(actions, av);
+    }
+    json_object_set_value(eo, "actions", actions_v);
+    (void)events_emit("deadman_recovered", ev);
+}
+
+/* One pass: end a confirmed outage, or run the first action that is due. */
+static void deadman_tick(const config_t *cfg) {
+    long long now = now_ms();
+    pthread_mutex_lock(&g_deadman_lock);
+    if (g_tripped && g_ok_streak >= cfg->deadman.recover_heartbeats) {
+        deadman_state_t fired[DEADMAN_MAX_ACTIONS];
+        int fired_count = 0;
+        for (int i = 0; i < cfg->deadman.action_count; i++) {
+            deadman_state_t *st = deadman_state_locked(cfg->deadman.actions[i].name, 0);
+            if (st && st->runs) fired[fired_count++] = *st;
+        }
+        long long outage_ms = g_last_ok_ms - g_outage_start_ms;
+        int heartbeats = g_ok_streak;
+        memset(g_state, 0, sizeof(g_state));
+        g_tripped = 0;
+        g_ok_streak = 0;
+        pthread_mutex_unlock(&g_deadman_lock);
+        deadman_recover(cfg, fired, fired_count, outage_ms, heartbeats);
+        return;
+    }
+    long long outage_ms = now - g_last_ok_ms;
+    for (int i = 0; i < cfg->deadman.action_count; i++) {
+        const deadman_action_t *a = &cfg->deadman.actions[i];
+        if (!a->exec[0] || a->after_min <= 0 || outage_ms < a->after_min * 60000LL) continue;
+        deadman_state_t *st = deadman_state_locked(a->name, 1);
+        if (!st) continue;
+        if (st->runs && (a->repeat_min <= 0 || now - st->last_run_ms < a->repeat_min * 60000LL)) continue;
+        if (!g_tripped) g_outage_start_ms = g_last_ok_ms;
+        g_tripped = 1;
+        g_ok_streak = 0;
+        st->runs++;
+        st->last_run_ms = now;
+        st->last_run_unix_ms = jobs_unix_ms();
+        int runs = st->runs;
+        deadman_action_t action = *a;
+        pthread_mutex_unlock(&g_deadman_lock);
+        deadman_fire(cfg, &action, outage_ms, runs);
+        return;
+    }
+    pthread_mutex_unlock(&g_deadman_lock);
+}
+
+static void *deadman_thread_main(void *arg) {
+    app_t *app = (app_t *)arg;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) return NULL;
+    while (!g_deadman_stop && !g_stop) {
+        app_config_snapshot(app, cfg);
+        if (strcasecmp(cfg->sync_role, "slave") != 0 || cfg->deadman.action_count == 0) {
+            /* Not watching: the clock starts when this node becomes a slave. */
+            pthread_mutex_lock(&g_deadman_lock);
+            g_last_ok_ms = now_ms();
+            pthread_mutex_unlock(&g_deadman_lock);
+        } else {
+            deadman_tick(cfg);
+        }
+        sleep(1);
+    }
+    free(cfg);
+    return NULL;
+}
+
+int deadman_start_thread(app_t *app) {
+    if (!app) return -1;
+    pthread_mutex_lock(&g_deadman_lock);
+    g_deadman_stop = 0;
+    g_last_ok_ms = now_ms();
+    if (g_deadman_running) {
+        pthread_mutex_unlock(&g_deadman_lock);
+        return 0;
+    }
+    if (pthread_create(&g_deadman_thread, NULL, deadman_thread_main, app) == 0) {
+        g_deadman_running = 1;
+        pthread_mutex_unlock(&g_deadman_lock);
+        return 0;
+    }
+    pthread_mutex_unlock(&g_deadman_lock);
+    fprintf(stderr, "WARN: failed to start dead-man thread\n");
+    return -1;
+}
+
+void deadman_stop_thread(void) {
+    pthread_mutex_lock(&g_deadman_lock);
+    g_deadman_stop = 1;
+    int running = g_deadman_running;
+    pthread_mutex_unlock(&g_deadman_lock);
+    if (running) {
+        pthread_join(g_deadman_thread, NULL);
+        pthread_mutex_lock(&g_deadman_lock);
+        g_deadman_running = 0;
+        pthread_mutex_unlock(&g_deadman_lock);
+    }
+}
+
+/* ---------- HTTP ---------- */
+
+/*
+ * GET /deadman — {state, since_contact_s, recover_heartbeats, heartbeats,
+ * actions:[{name, after_min, repeat_min, path, runs, last_run_unix_ms, rc|error}]}.
+ * state is idle (not a slave, or nothing configured), armed, tripped (an
+ * action ran and the master is still away) or recovering.
+ */
+static int h_deadman(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (strcmp(ri->request_method, "GET") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        return 1;
+    }
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    int watching = strcasecmp(cfg->sync_role, "slave") == 0 && cfg->deadman.action_count > 0;
+
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    JSON_Value *actions_v = json_value_init_array();
+    JSON_Array *actions = json_array(actions_v);
+    pthread_mutex_lock(&g_deadman_lock);
+    const char *state = !watching ? "idle" : !g_tripped ? "armed" : g_ok_streak ? "recovering" : "tripped";
+    json_object_set_string(o, "state", state);
+    if (watching) json_object_set_number(o, "since_contact_s", (double)((now_ms() - g_last_ok_ms) / 1000));
+    json_object_set_number(o, "recover_heartbeats", cfg->deadman.recover_heartbeats);
+    if (g_tripped) json_object_set_number(o, "heartbeats", g_ok_streak);
+    for (int i = 0; i < cfg->deadman.action_count; i++) {
+        const deadman_action_t *a = &cfg->deadman.actions[i];
+        JSON_Value *av = json_value_init_object();
+        JSON_Object *ao = json_object(av);
+        json_object_set_string(ao, "name", a->name);
+        json_object_set_number(ao, "after_min", a->after_min);
+        json_object_set_number(ao, "repeat_min", a->repeat_min);
+        JSON_Value *ev = a->exec[0] ? json_parse_string(a->exec) : NULL;
+        const char *path = json_object_get_string(json_object(ev), "path");
+        if (path) json_object_set_string(ao, "path", path);
+        if (ev) json_value_free(ev);
+        const deadman_state_t *st = deadman_state_locked(a->name, 0);
+        json_object_set_number(ao, "runs", st ? st->runs : 0);
+        if (st && st->runs) {
+            json_object_set_number(ao, "last_run_unix_ms", (double)st->last_run_unix_ms);
+            if (st->error[0]) json_object_set_string(ao, "error", st->error);
+            else json_object_set_number(ao, "rc", st->rc);
+        }
+        json_array_append_value(actions, av);
+    }
+    pthread_mutex_unlock(&g_deadman_lock);
+    json_object_set_value(o, "actions", actions_v);
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+    free(cfg);
+    return 1;
+}
+
+void deadman_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    api_set_handler(ctx, "/deadman", h_deadman, app);
+}
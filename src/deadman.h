@@ -0,0 +1,40 @@
+#ifndef AUTOD_DEADMAN_H
+#define AUTOD_DEADMAN_H
+
+#define DEADMAN_MAX_ACTIONS 8
+
+/* [deadman.NAME] — a command a slave runs on its own once it has gone
+ * after_min minutes without a successful registration with its master
+ * (switch to a safe mode, restart networking, ...). Commands must pass the
+ * command catalog like any other exec. */
+typedef struct {
+    char name[32];
+    int  after_min;
+    int  repeat_min;              /* run again this often while still cut off; 0 = once */
+    char exec[512];               /* {"path":..,"args":[..],"profile":..} */
+    char recover_exec[512];       /* run once the master is back (optional) */
+} deadman_action_t;
+
+typedef struct {
+    int  recover_heartbeats;      /* successful registrations in a row before the outage ends (3) */
+    deadman_action_t actions[DEADMAN_MAX_ACTIONS];
+    int  action_count;
+} deadman_config_t;
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_context;
+
+void deadman_cfg_defaults(config_t *cfg);
+int deadman_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* The slave's registration loop reports every attempt: ok = the master
+ * accepted it. */
+void deadman_note_contact(int ok);
+
+int deadman_start_thread(app_t *app);
+void deadman_stop_thread(void);
+
+void deadman_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
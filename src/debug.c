@@ -0,0 +1,433 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <time.h>
+#include <dirent.h>
+#include <unistd.h>
+#include <pthread.h>
+#include <sys/resource.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "debug.h"
+
+#ifdef AUTOD_DEBUG
+
+typedef struct {
+    int in_use;
+    unsigned id;
+    char kind[20];             /* delay, error, node_down, heartbeat_pause */
+    char path[128];            /* URI prefix for delay/error; empty = every request */
+    char node[64];             /* node_down */
+    int status;
+    int delay_ms;
+    long long expires_ms;
+} debug_fault_t;
+
+static pthread_mutex_t g_debug_lock = PTHREAD_MUTEX_INITIALIZER;
+static debug_fault_t g_faults[DEBUG_MAX_FAULTS];
+static unsigned g_next_fault_id = 1;
+
+static void debug_expire_locked(long long now) {
+    for (int i = 0; i < DEBUG_MAX_FAULTS; i++) {
+        if (g_faults[i].in_use && g_faults[i].expires_ms <= now) {
+            fprintf(stderr, "debug: fault %u (%s) expired\n", g_faults[i].id, g_faults[i].kind);
+            memset(&g_faults[i], 0, sizeof(g_faults[i]));
+        }
+    }
+}
+
+int debug_before_request(struct mg_connection *c) {
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    const char *uri = api_local_uri(c);
+    /* Never get in the way of clearing the faults themselves. */
+    if (!strncmp(uri, "/debug", 6)) return 0;
+    int delay_ms = 0, status = 0;
+    pthread_mutex_lock(&g_debug_lock);
+    debug_expire_locked(now_ms());
+    for (int i = 0; i < DEBUG_MAX_FAULTS; i++) {
+        const debug_fault_t *f = &g_faults[i];
+        if (!f->in_use || strncmp(uri, f->path, strlen(f->path)) != 0) continue;
+        if (!strcmp(f->kind, "delay") && f->delay_ms > delay_ms) delay_ms = f->delay_ms;
+        if (!strcmp(f->kind, "error") && !status) status = f->status;
+    }
+    pthread_mutex_unlock(&g_debug_lock);
+    if (delay_ms > 0) {
+        struct timespec ts = { delay_ms / 1000, (long)(delay_ms % 1000) * 1000000L };
+        nanosleep(&ts, NULL);
+    }
+    if (!status) return 0;
+    send_json_error(c, status, "injected_fault");
+    return status;
+}
+
+static int debug_fault_active(const char *kind, const char *node) {
+    int active = 0;
+    pthread_mutex_lock(&g_debug_lock);
+    debug_expire_locked(now_ms());
+    for (int i = 0; i < DEBUG_MAX_FAULTS && !active; i++) {
+        const debug_fault_t *f = &g_faults[i];
+        active = f->in_use && !strcmp(f->kind, kind) && (!node || !strcmp(f->node, node));
+    }
+    pthread_mutex_unlock(&g_debug_lock);
+    return active;
+}
+
+int debug_registration_blocked(const char *id) {
+    return id && debug_fault_active("node_down", id);
+}
+
+int debug_heartbeats_paused(void) {
+    return debug_fault_active("heartbeat_pause", NULL);
+}
+
+static JSON_Value *debug_fault_to_json(const debug_fault_t *f, long long now) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_number(o, "id", f->id);
+    json_object_set_string(o, "fault", f->kind);
+    if (f->path[0]) json_object_set_string(o, "path", f->path);
+    if (f->node[0]) json_object_set_string(o, "node", f->node);
+    if (f->status) json_object_set_number(o, "status", f->status);
+    if (f->delay_ms) json_object_set_number(o, "delay_ms", f->delay_ms);
+    json_object_set_number(o, "expires_in_ms", (double)(f->expires_ms - now));
+    return v;
+}
+
+/*
+ * One-shot registry damage on a master: "ghost_assignee" hands a slot to an
+ * id that has no record, "stale_slot" makes a record claim a slot it does
+ * not hold. Returns NULL or an error code.
+ */
+static const char *debug_corrupt_registry(app_t *app, JSON_Object *o, JSON_Object *out) {
+    const char *mode = json_object_get_string(o, "mode");
+    if (!mode) mode = "ghost_assignee";
+    const char *id = json_object_get_string(o, "id");
+    int slot = (int)json_object_get_number(o, "slot");
+    const char *error = NULL;
+    pthread_mutex_lock(&app->master.lock);
+    if (!strcmp(mode, "ghost_assignee")) {
+        if (slot < 1 || slot > SYNC_MAX_SLOTS) {
+            error = "invalid_slot";
+        } else {
+            char ghost[17];
+            random_id(ghost, sizeof(ghost));
+            snprintf(app->master.slot_assignees[slot - 1], sizeof(app->master.slot_assignees[0]),
+                     "ghost-%s", ghost);
+            json_object_set_string(out, "assignee", app->master.slot_assignees[slot - 1]);
+            json_object_set_number(out, "slot", slot);
+        }
+    } else if (!strcmp(mode, "stale_slot")) {
+        sync_slave_record_t *rec = NULL;
+        for (int i = 0; id && i < SYNC_MAX_SLAVES; i++) {
+            if (app->master.records[i].in_use && !strcmp(app->master.records[i].id, id)) {
+                rec = &app->master.records[i];
+                break;
+            }
+        }
+        if (!rec) {
+            error = "unknown_node";
+        } else {
+            rec->slot_index = (rec->slot_index + 1) % SYNC_MAX_SLOTS;
+            json_object_set_number(out, "slot", rec->slot_index + 1);
+        }
+    } else {
+        error = "invalid_mode";
+    }
+    if (!error) app->master.version++;
+    pthread_mutex_unlock(&app->master.lock);
+    if (!error) json_object_set_string(out, "mode", mode);
+    return error;
+}
+
+static void debug_age_node(app_t *app, const config_t *cfg, const char *id) {
+    int down_after_s = cfg->sync_node_down_after_s > 0 ? cfg->sync_node_down_after_s : 90;
+    long long back = (down_after_s + 1) * 1000LL;
+    pthread_mutex_lock(&app->master.lock);
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        sync_slave_record_t *rec = &app->master.records[i];
+        if (rec->in_use && !strcmp(rec->id, id)) {
+            rec->last_seen_ms = now_ms() - back;
+            break;
+        }
+    }
+    pthread_mutex_unlock(&app->master.lock);
+}
+
+/*
+ * POST /debug/inject {"fault": ...} adds a fault for duration_s (default
+ * 60): "delay" (delay_ms) or "error" (status) for requests under "path",
+ * "node_down" (master, "id") drops that node's registrations,
+ * "heartbeat_pause" (slave) stops registering, and "corrupt_registry"
+ * (master) damages the registry once. GET lists active faults, DELETE
+ * clears them (all, or ?id=N).
+ */
+static int h_debug_inject(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    const char *m = ri ? ri->request_method : "";
+    int master = strcasecmp(cfg->sync_role, "master") == 0;
+
+    if (!strcmp(m, "DELETE")) {
+        unsigned only = 0;
+        char buf[16];
+        if (ri->query_string &&
+            mg_get_var(ri->query_string, strlen(ri->query_string), "id", buf, sizeof(buf)) > 0) {
+            only = (unsigned)strtoul(buf, NULL, 10);
+        }
+        int cleared = 0;
+        pthread_mutex_lock(&g_debug_lock);
+        for (int i = 0; i < DEBUG_MAX_FAULTS; i++) {
+            if (!g_faults[i].in_use || (only && g_faults[i].id != only)) continue;
+            memset(&g_faults[i], 0, sizeof(g_faults[i]));
+            cleared++;
+        }
+        pthread_mutex_unlock(&g_debug_lock);
+        if (cleared) fprintf(stderr, "debug: cleared %d fault(s)\n", cleared);
+        JSON_Value *v = json_value_init_object();
+        json_object_set_number(json_object(v), "cleared", cleared);
+        send_json(c, v, 200, 1);
+        json_value_free(v);
+        free(cfg);
+        return 1;
+    }
+    if (!strcmp(m, "GET")) {
+        JSON_Value *v = json_value_init_object();
+        JSON_Value *arr = json_value_init_array();
+        long long now = now_ms();
+        pthread_mutex_lock(&g_debug_lock);
+        debug_expire_locked(now);
+        for (int i = 0; i < DEBUG_MAX_FAULTS; i++) {
+            if (!g_faults[i].in_use) continue;
+            json_array_append_value(json_array(arr), debug_fault_to_json(&g_faults[i], now));
+        }
+        pthread_mutex_unlock(&g_debug_lock);
+        json_object_set_value(json_object(v), "faults", arr);
+        send_json(c, v, 200, 1);
+        json_value_free(v);
+        free(cfg);
+        return 1;
+    }
+    if (strcmp(m, "POST") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        if (u.body) free(u.body);
+        send_json_error(c, 400, "body_read_failed");
+        free(cfg);
+        return 1;
+    }
+    JSON_Value *root = json_parse_string(u.body ? u.body : "");
+    free(u.body);
+    if (!root || json_value_get_type(root) != JSONObject) {
+        if (root) json_value_free(root);
+        send_json_error(c, 400, "bad_json");
+        free(cfg);
+        return 1;
+    }
+    JSON_Object *o = json_object(root);
+    const char *kind = json_object_get_string(o, "fault");
+    debug_fault_t f;
+    memset(&f, 0, sizeof(f));
+    const char *field = NULL;
+    const char *error = NULL;
+    int code = 400;
+
+    if (kind && !strcmp(kind, "corrupt_registry") && master) {
+        JSON_Value *v = json_value_init_object();
+        error = debug_corrupt_registry(app, o, json_object(v));
+        if (error) {
+            send_json_error(c, 400, error);
+        } else {
+            fprintf(stderr, "debug: corrupted registry (%s)\n",
+                    json_object_get_string(json_object(v), "mode"));
+            send_json(c, v, 200, 1);
+        }
+        json_value_free(v);
+        json_value_free(root);
+        free(cfg);
+        return 1;
+    }
+
+    if (!kind) {
+        error = "invalid_fault";
+        field = "fault";
+    } else if (!strcmp(kind, "corrupt_registry")) {
+        error = "not_a_master";
+        code = 409;
+    } else if (!strcmp(kind, "delay") || !strcmp(kind, "error")) {
+        const char *path = json_object_get_string(o, "path");
+        if (path && (path[0] != '/' || strlen(path) >= sizeof(f.path))) {
+            error = "invalid_fault";
+            field = "path";
+        } else if (!strcmp(kind, "delay")) {
+            f.delay_ms = (int)json_object_get_number(o, "delay_ms");
+            if (f.delay_ms <= 0 || f.delay_ms > 600000) {
+                error = "invalid_fault";
+                field = "delay_ms";
+            }
+        } else {
+            f.status = json_object_has_value(o, "status") ?
+                       (int)json_object_get_number(o, "status") : 503;
+            if (f.status < 400 || f.status > 599) {
+                error = "invalid_fault";
+                field = "status";
+            }
+        }
+        if (path) snprintf(f.path, sizeof(f.path), "%s", path);
+    } else if (!strcmp(kind, "node_down")) {
+        const char *id = json_object_get_string(o, "id");
+        if (!master) {
+            error = "not_a_master";
+            code = 409;
+        } else if (!id || !*id || strlen(id) >= sizeof(f.node)) {
+            error = "invalid_fault";
+            field = "id";
+        } else {
+            snprintf(f.node, sizeof(f.node), "%s", id);
+        }
+    } else if (!strcmp(kind, "heartbeat_pause")) {
+        if (strcasecmp(cfg->sync_role, "slave") != 0) {
+            error = "not_a_slave";
+            code = 409;
+        }
+    } else {
+        error = "unknown_fault";
+    }
+    int duration_s = json_object_has_value(o, "duration_s") ?
+                     (int)json_object_get_number(o, "duration_s") : 60;
+    if (!error && (duration_s <= 0 || duration_s > 86400)) {
+        error = "invalid_fault";
+        field = "duration_s";
+    }
+    if (error) {
+        JSON_Value *v = json_value_init_object();
+        json_object_set_string(json_object(v), "error", error);
+        if (field) json_object_set_string(json_object(v), "field", field);
+        if (code == 409) json_object_set_string(json_object(v), "role", cfg->sync_role);
+        send_json(c, v, code, 1);
+        json_value_free(v);
+        json_value_free(root);
+        free(cfg);
+        return 1;
+    }
+    snprintf(f.kind, sizeof(f.kind), "%s", kind);
+    json_value_free(root);
+
+    long long now = now_ms();
+    f.in_use = 1;
+    f.expires_ms = now + duration_s * 1000LL;
+    pthread_mutex_lock(&g_debug_lock);
+    debug_expire_locked(now);
+    debug_fault_t *slot = NULL;
+    for (int i = 0; i < DEBUG_MAX_FAULTS && !slot; i++) {
+        if (!g_faults[i].in_use) slot = &g_faults[i];
+    }
+    if (slot) {
+        f.id = g_next_fault_id++;
+        *slot = f;
+    }
+    pthread_mutex_unlock(&g_debug_lock);
+    if (!slot) {
+        send_json_error(c, 503, "too_many_faults");
+        free(cfg);
+        return 1;
+    }
+    /* Make the node look gone right away instead of after node_down_after_s. */
+    if (!strcmp(f.kind, "node_down")) debug_age_node(app, cfg, f.node);
+    fprintf(stderr, "debug: injected %s fault %u for %d s\n", f.kind, f.id, duration_s);
+    JSON_Value *v = debug_fault_to_json(&f, now);
+    send_json(c, v, 201, 1);
+    json_value_free(v);
+    free(cfg);
+    return 1;
+}
+
+/* GET /debug/proc — process numbers to watch during load tests. */
+static int h_debug_proc(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri || strcmp(ri->request_method, "GET") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        return 1;
+    }
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_number(o, "pid", (double)getpid());
+    FILE *f = fopen("/proc/self/status", "r");
+    if (f) {
+        char line[128];
+        long n;
+        while (fgets(line, sizeof(line), f)) {
+            if (sscanf(line, "VmRSS: %ld", &n) == 1) json_object_set_number(o, "rss_kb", (double)n);
+            else if (sscanf(line, "VmHWM: %ld", &n) == 1) json_object_set_number(o, "peak_rss_kb", (double)n);
+            else if (sscanf(line, "Threads: %ld", &n) == 1) json_object_set_number(o, "threads", (double)n);
+        }
+        fclose(f);
+    }
+    DIR *d = opendir("/proc/self/fd");
+    if (d) {
+        int fds = 0;
+        struct dirent *de;
+        while ((de = readdir(d)) != NULL) {
+            if (de->d_name[0] != '.') fds++;
+        }
+        closedir(d);
+        json_object_set_number(o, "open_fds", fds - 1); /* minus the one opendir holds */
+    }
+    struct rusage ru;
+    if (getrusage(RUSAGE_SELF, &ru) == 0) {
+        json_object_set_number(o, "cpu_user_ms",
+                               (double)ru.ru_utime.tv_sec * 1000 + ru.ru_utime.tv_usec / 1000);
+        json_object_set_number(o, "cpu_sys_ms",
+                               (double)ru.ru_stime.tv_sec * 1000 + ru.ru_stime.tv_usec / 1000);
+    }
+    pthread_mutex_lock(&app->inflight_lock);
+    json_object_set_number(o, "inflight", app->inflight);
+    pthread_mutex_unlock(&app->inflight_lock);
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+    return 1;
+}
+
+void debug_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    fprintf(stderr, "WARN: debug build, fault injection endpoints under /debug are enabled\n");
+    api_set_handler(ctx, "/debug/inject", h_debug_inject, app);
+    api_set_handler(ctx, "/debug/proc", h_debug_proc, app);
+}
+
+#else
+
+int debug_before_request(struct mg_connection *c) {
+    (void)c;
+    return 0;
+}
+
+int debug_registration_blocked(const char *id) {
+    (void)id;
+    return 0;
+}
+
+int debug_heartbeats_paused(void) {
+    return 0;
+}
+
+void debug_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    (void)ctx;
+    (void)app;
+}
+
+#endif
@@ -0,0 +1,26 @@
+#ifndef AUTOD_DEBUG_H
+#define AUTOD_DEBUG_H
+
+/* Fault injection for integration and load tests. Only compiled in with
+ * -DAUTOD_DEBUG (make DEBUG=1); otherwise the hooks below do nothing and no
+ * /debug endpoints are registered. */
+
+#define DEBUG_MAX_FAULTS 16
+
+typedef struct app app_t;
+struct mg_context;
+struct mg_connection;
+
+/* begin_request hook: applies injected delays and errors. Returns the HTTP
+ * status it answered with, or 0 to let the request through. */
+int debug_before_request(struct mg_connection *c);
+
+/* Master: whether registrations from id are being dropped (node_down). */
+int debug_registration_blocked(const char *id);
+
+/* Slave: whether heartbeats are suspended (heartbeat_pause). */
+int debug_heartbeats_paused(void);
+
+void debug_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
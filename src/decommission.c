@@ -0,0 +1,178 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <time.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "httpc.h"
+#include "dnscache.h"
+#include "events.h"
+#include "decommission.h"
+
+#define DECOMMISSION_DEFAULT_DRAIN_MS 30000
+#define DECOMMISSION_MAX_DRAIN_MS 600000
+#define DECOMMISSION_POLL_MS 500
+#define DECOMMISSION_REQUEST_MS 3000
+
+static void decommission_sleep_ms(int ms) {
+    struct timespec ts = { ms / 1000, (long)(ms % 1000) * 1000000L };
+    nanosleep(&ts, NULL);
+}
+
+/* Jobs running on the node right now (GET /jobs?status=running), or -1 when
+ * it could not be asked. */
+static int decommission_running_jobs(const config_t *cfg, const sync_node_addr_t *node) {
+    http_url_t url;
+    char relay_hdr[GATEWAY_HEADER_MAX];
+    char host[128];
+    if (gateway_route(node, "/jobs?status=running", DECOMMISSION_REQUEST_MS, &url, relay_hdr,
+                      sizeof(relay_hdr)) != 0) {
+        return -1;
+    }
+    snprintf(host, sizeof(host), "%s", url.host);
+    if (dnscache_resolve(host, cfg->sync_dns_ttl_s, url.host, sizeof(url.host)) != 0) return -1;
+    char *resp = NULL;
+    int status = httpc_send_json("GET", &url, relay_hdr, NULL, &resp, NULL, DECOMMISSION_REQUEST_MS);
+    JSON_Value *doc = status == 200 && resp ? json_parse_string(resp) : NULL;
+    free(resp);
+    JSON_Array *jobs = json_object_get_array(json_object(doc), "jobs");
+    int running = jobs ? (int)json_array_get_count(jobs) : -1;
+    if (doc) json_value_free(doc);
+    if (running < 0 && dnscache_is_hostname(host)) dnscache_forget(host);
+    return running;
+}
+
+/* Wait up to timeout_ms for the node's running jobs to finish and describe
+ * the outcome in o. Returns 0 when removal may go ahead, -1 on a timeout. */
+static int decommission_drain(const config_t *cfg, app_t *app, const char *id, int timeout_ms,
+                              JSON_Object *o) {
+    sync_node_addr_t node;
+    const char *skip = NULL;
+    if (sync_master_node_addr(app, cfg, id, &node) != 0) skip = "unknown_node";
+    else if (node.down) skip = "node_down";
+    else if (strcmp(node.transport, "http") != 0) skip = "unsupported_transport";
+    else if (!node.host[0] || node.port <= 0) skip = "no_address";
+    else if (node.via[0] && !node.via_host[0]) skip = "gateway_unavailable";
+    else if (timeout_ms == 0) skip = "no_wait";
+    if (skip) {
+        json_object_set_string(o, "status", "skipped");
+        json_object_set_string(o, "reason", skip);
+        return 0;
+    }
+    long long t0 = now_ms();
+    int running = -1;
+    for (;;) {
+        running = decommission_running_jobs(cfg, &node);
+        if (running <= 0) break;
+        if (now_ms() - t0 + DECOMMISSION_POLL_MS > timeout_ms) break;
+        decommission_sleep_ms(DECOMMISSION_POLL_MS);
+    }
+    json_object_set_number(o, "waited_ms", (double)(now_ms() - t0));
+    if (running < 0) {
+        /* Whatever it still runs can no longer be reported; nothing to wait for. */
+        json_object_set_string(o, "status", "unreachable");
+        return 0;
+    }
+    json_object_set_number(o, "running", running);
+    json_object_set_string(o, "status", running == 0 ? "drained" : "timeout");
+    return running == 0 ? 0 : -1;
+}
+
+int decommission_handle(struct mg_connection *c, app_t *app, const config_t *cfg, const char *id) {
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (strcasecmp(cfg->sync_role, "master") != 0) {
+        send_plain(c, 404, "not_found", 1);
+        return 1;
+    }
+    if (!id || !*id || strlen(id) >= 64 || strchr(id, '/')) {
+        send_json_error(c, 400, "invalid_id");
+        return 1;
+    }
+    const char *m = ri ? ri->request_method : "";
+    const char *actor = ri && ri->remote_addr[0] ? ri->remote_addr : "api";
+
+    if (!strcmp(m, "DELETE")) {
+        if (!sync_master_decommission_cancel(app, id)) {
+            send_json_error(c, 404, "not_decommissioned");
+            return 1;
+        }
+        JSON_Value *v = json_value_init_object();
+        json_object_set_string(json_object(v), "id", id);
+        json_object_set_boolean(json_object(v), "canceled", 1);
+        send_json(c, v, 200, 1);
+        json_value_free(v);
+        return 1;
+    }
+    if (strcmp(m, "POST") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        return 1;
+    }
+
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        free(u.body);
+        send_json_error(c, 400, "body_read_failed");
+        return 1;
+    }
+    JSON_Value *root = json_parse_string(u.body && u.len ? u.body : "{}");
+    free(u.body);
+    if (!root || json_value_get_type(root) != JSONObject) {
+        if (root) json_value_free(root);
+        send_json_error(c, 400, "bad_json");
+        return 1;
+    }
+    JSON_Object *o = json_object(root);
+    int execute = json_object_get_boolean(o, "execute") == 1;
+    int force = json_object_get_boolean(o, "force") == 1;
+    int drain_ms = DECOMMISSION_DEFAULT_DRAIN_MS;
+    JSON_Value *dv = json_object_get_value(o, "drain_timeout_ms");
+    if (dv) {
+        double d = json_value_get_number(dv);
+        if (json_value_get_type(dv) != JSONNumber || d < 0 || d > DECOMMISSION_MAX_DRAIN_MS ||
+            d != (int)d) {
+            json_value_free(root);
+            send_json_error(c, 400, "invalid_timeout");
+            return 1;
+        }
+        drain_ms = (int)d;
+    }
+    json_value_free(root);
+
+    int status = 200;
+    JSON_Value *plan = sync_master_decommission_plan(app, cfg, id, execute, force, actor, &status);
+    JSON_Object *po = json_object(plan);
+    if (status == 200) json_object_set_boolean(po, "executed", execute);
+    if (!execute || status != 200) {
+        send_json(c, plan, status, 1);
+        json_value_free(plan);
+        return 1;
+    }
+
+    JSON_Value *drain_v = json_value_init_object();
+    int drained = decommission_drain(cfg, app, id, drain_ms, json_object(drain_v)) == 0;
+    json_object_set_value(po, "drain", drain_v);
+    if (!drained && !force) {
+        /* The node stays out of routing; repeat to wait again, or DELETE. */
+        json_object_set_string(po, "error", "drain_timeout");
+        json_object_set_boolean(po, "removed", 0);
+        send_json(c, plan, 409, 1);
+        json_value_free(plan);
+        return 1;
+    }
+    int removed = sync_master_decommission_finish(app, cfg, id, actor) == 0;
+    json_object_set_boolean(po, "removed", removed);
+
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_string(eo, "id", id);
+    json_object_set_string(eo, "drain", json_object_get_string(json_object(drain_v), "status"));
+    json_object_set_string(eo, "actor", actor);
+    (void)events_emit("node_decommissioned", ev);
+
+    send_json(c, plan, 200, 1);
+    json_value_free(plan);
+    return 1;
+}
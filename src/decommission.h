@@ -0,0 +1,16 @@
+#ifndef AUTOD_DECOMMISSION_H
+#define AUTOD_DECOMMISSION_H
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_connection;
+
+/* /nodes/{id}/decommission on a master. POST answers with the plan for
+ * retiring the node (the slot it holds and who takes it over, blockers and
+ * leftovers); with "execute": true it also carries it out: the node leaves
+ * routing, its slot is handed over, the jobs still running on it are waited
+ * for, and the node is removed and refused from then on. DELETE undoes a
+ * decommission that is draining or done. */
+int decommission_handle(struct mg_connection *c, app_t *app, const config_t *cfg, const char *id);
+
+#endif
@@ -0,0 +1,306 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <time.h>
+#include <pthread.h>
+#include <arpa/inet.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "discovery.h"
+
+#define DISCOVERY_RECENT 32
+#define DISCOVERY_RELOG_S 300
+
+/* The candidates refused lately; a node refused on every heartbeat is
+ * logged again only after DISCOVERY_RELOG_S. */
+typedef struct {
+    char source[12];
+    char ip[64];
+    char id[64];
+    char reason[16];
+    unsigned count;
+    long long first_unix;
+    long long last_unix;
+    long long logged_unix;
+} discovery_rejection_t;
+
+static const char *const g_reasons[] = {"cidr", "id_prefix", "labels", "max_nodes"};
+#define DISCOVERY_REASONS (sizeof(g_reasons) / sizeof(g_reasons[0]))
+
+static pthread_mutex_t g_discovery_lock = PTHREAD_MUTEX_INITIALIZER;
+static discovery_rejection_t g_recent[DISCOVERY_RECENT];
+static unsigned long g_rejected[DISCOVERY_REASONS];
+static unsigned long g_rejected_scan;
+static unsigned long g_rejected_register;
+
+void discovery_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->discovery, 0, sizeof(cfg->discovery));
+}
+
+/* A CIDR or a single address (taken as /32). */
+static int discovery_parse_cidr(const char *value, scan_extra_subnet_t *out) {
+    char ip[64];
+    snprintf(ip, sizeof(ip), "%s", value);
+    long prefix = 32;
+    char *slash = strchr(ip, '/');
+    if (slash) {
+        char *end = NULL;
+        *slash = '\0';
+        prefix = strtol(slash + 1, &end, 10);
+        if (end == slash + 1 || *end || prefix < 0 || prefix > 32) return -1;
+    }
+    struct in_addr ia;
+    if (inet_pton(AF_INET, ip, &ia) != 1) return -1;
+    out->netmask = prefix ? 0xffffffffu << (32 - prefix) : 0;
+    out->network = ntohl(ia.s_addr) & out->netmask;
+    out->interval_s = 0;
+    return 0;
+}
+
+int discovery_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (strcmp(section, "discovery") != 0) return 0;
+    discovery_config_t *d = &cfg->discovery;
+    if (!strcmp(key, "allow_cidr")) {
+        scan_extra_subnet_t sn;
+        if (d->allow_count >= DISCOVERY_MAX_CIDRS) {
+            fprintf(stderr, "WARN: discovery: ignoring allow_cidr '%s' (at most %d)\n", value,
+                    DISCOVERY_MAX_CIDRS);
+        } else if (discovery_parse_cidr(value, &sn) != 0) {
+            fprintf(stderr, "WARN: discovery: ignoring invalid allow_cidr '%s'\n", value);
+            cfg->cidr_invalid++;
+        } else {
+            d->allow[d->allow_count++] = sn;
+        }
+    } else if (!strcmp(key, "id_prefix")) {
+        if (d->id_prefix_count >= DISCOVERY_MAX_PREFIXES || !*value ||
+            strlen(value) >= sizeof(d->id_prefixes[0])) {
+            fprintf(stderr, "WARN: discovery: ignoring id_prefix '%s'\n", value);
+        } else {
+            snprintf(d->id_prefixes[d->id_prefix_count++], sizeof(d->id_prefixes[0]), "%s", value);
+        }
+    } else if (!strcmp(key, "require_label")) {
+        const char *eq = strchr(value, '=');
+        size_t klen = eq ? (size_t)(eq - value) : 0;
+        if (d->label_count >= DISCOVERY_MAX_LABELS || !eq || !klen ||
+            klen >= sizeof(d->labels[0].key) || strlen(eq + 1) >= sizeof(d->labels[0].value)) {
+            fprintf(stderr, "WARN: discovery: ignoring require_label '%s' (KEY=VALUE, at most %d)\n",
+                    value, DISCOVERY_MAX_LABELS);
+        } else {
+            snprintf(d->labels[d->label_count].key, sizeof(d->labels[0].key), "%.*s", (int)klen, value);
+            snprintf(d->labels[d->label_count].value, sizeof(d->labels[0].value), "%s", eq + 1);
+            d->label_count++;
+        }
+    } else if (!strcmp(key, "max_nodes")) {
+        char *end = NULL;
+        long v = strtol(value, &end, 10);
+        if (!end || *end || v < 0 || v > 100000) {
+            fprintf(stderr, "WARN: discovery: ignoring max_nodes '%s'\n", value);
+        } else {
+            d->max_nodes = (int)v;
+        }
+    } else {
+        fprintf(stderr, "WARN: ignoring unknown discovery key '%s'\n", key);
+    }
+    return 1;
+}
+
+static const char *discovery_filter(const discovery_config_t *d, const char *ip, const char *id,
+                                    int known, int count, discovery_label_fn label, void *ud) {
+    if (d->allow_count && ip && *ip) {
+        struct in_addr ia;
+        int allowed = 0;
+        if (inet_pton(AF_INET, ip, &ia) == 1) {
+            uint32_t a = ntohl(ia.s_addr);
+            for (unsigned i = 0; i < d->allow_count && !allowed; i++) {
+                allowed = (a & d->allow[i].netmask) == d->allow[i].network;
+            }
+        }
+        if (!allowed) return "cidr";
+    }
+    if (d->id_prefix_count) {
+        int allowed = 0;
+        for (int i = 0; i < d->id_prefix_count && !allowed && id; i++) {
+            allowed = !strncmp(id, d->id_prefixes[i], strlen(d->id_prefixes[i]));
+        }
+        if (!allowed) return "id_prefix";
+    }
+    for (int i = 0; i < d->label_count; i++) {
+        char value[64];
+        if (!id || !*id || !label || label(ud, id, d->labels[i].key, value, sizeof(value)) != 0 ||
+            strcmp(value, d->labels[i].value) != 0) {
+            return "labels";
+        }
+    }
+    if (d->max_nodes && !known && count >= d->max_nodes) return "max_nodes";
+    return NULL;
+}
+
+static void discovery_note(const char *source, const char *ip, const char *id, const char *reason) {
+    long long now = (long long)time(NULL);
+    pthread_mutex_lock(&g_discovery_lock);
+    for (size_t i = 0; i < DISCOVERY_REASONS; i++) {
+        if (!strcmp(g_reasons[i], reason)) g_rejected[i]++;
+    }
+    if (!strcmp(source, "scan")) g_rejected_scan++;
+    else g_rejected_register++;
+    discovery_rejection_t *r = NULL, *oldest = &g_recent[0];
+    for (int i = 0; i < DISCOVERY_RECENT && !r; i++) {
+        discovery_rejection_t *e = &g_recent[i];
+        if (e->count && !strcmp(e->source, source) && !strcmp(e->ip, ip) &&
+            !strcmp(e->id, id) && !strcmp(e->reason, reason)) {
+            r = e;
+        } else if (e->last_unix < oldest->last_unix) {
+            oldest = e;
+        }
+    }
+    if (!r) {
+        r = oldest;
+        memset(r, 0, sizeof(*r));
+        snprintf(r->source, sizeof(r->source), "%s", source);
+        snprintf(r->ip, sizeof(r->ip), "%s", ip);
+        snprintf(r->id, sizeof(r->id), "%s", id);
+        snprintf(r->reason, sizeof(r->reason), "%s", reason);
+        r->first_unix = now;
+    }
+    r->count++;
+    r->last_unix = now;
+    int log = !r->logged_unix || now - r->logged_unix >= DISCOVERY_RELOG_S;
+    if (log) r->logged_unix = now;
+    unsigned count = r->count;
+    pthread_mutex_unlock(&g_discovery_lock);
+    if (log) {
+        fprintf(stderr, "discovery: refused %s candidate %s%s%s (%s, %u so far)\n", source,
+                id[0] ? id : "-", ip[0] ? " at " : "", ip, reason, count);
+    }
+}
+
+const char *discovery_check(const config_t *cfg, const char *source, const char *ip,
+                            const char *id, int known, int count,
+                            discovery_label_fn label, void *ud) {
+    if (!cfg) return NULL;
+    const char *reason = discovery_filter(&cfg->discovery, ip, id, known, count, label, ud);
+    if (reason) discovery_note(source, ip ? ip : "", id ? id : "", reason);
+    return reason;
+}
+
+static int discovery_scan_label(void *ud, const char *id, const char *key, char *out,
+                                size_t out_sz) {
+    return sync_master_node_label((app_t *)ud, id, key, out, out_sz);
+}
+
+int discovery_scan_filter(const scan_node_t *n, int known, int cached, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) return 0;
+    app_config_snapshot(app, cfg);
+    const char *reason = discovery_check(cfg, "scan", n->ip, n->sync_id, known, cached,
+                                         discovery_scan_label, app);
+    free(cfg);
+    return reason ? -1 : 0;
+}
+
+static void discovery_format_cidr(const scan_extra_subnet_t *sn, char *out, size_t out_sz) {
+    struct in_addr ia;
+    ia.s_addr = htonl(sn->network);
+    char ip[16];
+    if (!inet_ntop(AF_INET, &ia, ip, sizeof(ip))) ip[0] = '\0';
+    int len = 0;
+    for (uint32_t m = sn->netmask; m; m <<= 1) len++;
+    snprintf(out, out_sz, "%s/%d", ip, len);
+}
+
+/* GET /discovery — the configured filters, refusal counters and the
+ * candidates refused lately (newest first). */
+static int h_discovery(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri || strcmp(ri->request_method, "GET") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+    const discovery_config_t *d = &cfg->discovery;
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+
+    JSON_Value *fv = json_value_init_object();
+    JSON_Object *fo = json_object(fv);
+    JSON_Value *allow_v = json_value_init_array();
+    for (unsigned i = 0; i < d->allow_count; i++) {
+        char cidr[32];
+        discovery_format_cidr(&d->allow[i], cidr, sizeof(cidr));
+        json_array_append_string(json_array(allow_v), cidr);
+    }
+    json_object_set_value(fo, "allow_cidr", allow_v);
+    JSON_Value *prefix_v = json_value_init_array();
+    for (int i = 0; i < d->id_prefix_count; i++) {
+        json_array_append_string(json_array(prefix_v), d->id_prefixes[i]);
+    }
+    json_object_set_value(fo, "id_prefix", prefix_v);
+    JSON_Value *labels_v = json_value_init_object();
+    for (int i = 0; i < d->label_count; i++) {
+        json_object_set_string(json_object(labels_v), d->labels[i].key, d->labels[i].value);
+    }
+    json_object_set_value(fo, "require_label", labels_v);
+    json_object_set_number(fo, "max_nodes", d->max_nodes);
+    json_object_set_value(o, "filters", fv);
+
+    JSON_Value *rv = json_value_init_object();
+    JSON_Object *ro = json_object(rv);
+    JSON_Value *recent_v = json_value_init_array();
+    pthread_mutex_lock(&g_discovery_lock);
+    unsigned long total = 0;
+    for (size_t i = 0; i < DISCOVERY_REASONS; i++) {
+        json_object_set_number(ro, g_reasons[i], (double)g_rejected[i]);
+        total += g_rejected[i];
+    }
+    json_object_set_number(ro, "scan", (double)g_rejected_scan);
+    json_object_set_number(ro, "register", (double)g_rejected_register);
+    json_object_set_number(ro, "total", (double)total);
+    int order[DISCOVERY_RECENT], n = 0;
+    for (int i = 0; i < DISCOVERY_RECENT; i++) {
+        if (!g_recent[i].count) continue;
+        int j = n++;
+        while (j > 0 && g_recent[order[j - 1]].last_unix < g_recent[i].last_unix) {
+            order[j] = order[j - 1];
+            j--;
+        }
+        order[j] = i;
+    }
+    for (int k = 0; k < n; k++) {
+        const discovery_rejection_t *r = &g_recent[order[k]];
+        JSON_Value *ev = json_value_init_object();
+        JSON_Object *eo = json_object(ev);
+        json_object_set_string(eo, "source", r->source);
+        if (r->ip[0]) json_object_set_string(eo, "ip", r->ip);
+        if (r->id[0]) json_object_set_string(eo, "id", r->id);
+        json_object_set_string(eo, "reason", r->reason);
+        json_object_set_number(eo, "count", r->count);
+        json_object_set_number(eo, "first_unix", (double)r->first_unix);
+        json_object_set_number(eo, "last_unix", (double)r->last_unix);
+        json_array_append_value(json_array(recent_v), ev);
+    }
+    pthread_mutex_unlock(&g_discovery_lock);
+    json_object_set_value(o, "rejected", rv);
+    json_object_set_value(o, "recent", recent_v);
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+    free(cfg);
+    return 1;
+}
+
+void discovery_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    api_set_handler(ctx, "/discovery", h_discovery, app);
+}
@@ -0,0 +1,51 @@
+#ifndef AUTOD_DISCOVERY_H
+#define AUTOD_DISCOVERY_H
+
+#include <stddef.h>
+#include "scan.h"
+
+#define DISCOVERY_MAX_CIDRS 16
+#define DISCOVERY_MAX_PREFIXES 8
+#define DISCOVERY_MAX_LABELS 4
+
+/* [discovery] — what a node must look like before a CIDR scan adds it to
+ * the node cache or the master accepts its registration. A CIDR sweep
+ * otherwise admits anything that answers /health, including daemons that
+ * belong to someone else. Nothing configured admits everything. */
+typedef struct {
+    scan_extra_subnet_t allow[DISCOVERY_MAX_CIDRS];   /* any one; empty = any address */
+    unsigned allow_count;
+    char id_prefixes[DISCOVERY_MAX_PREFIXES][32];     /* any one; empty = any id */
+    int  id_prefix_count;
+    struct { char key[32]; char value[64]; } labels[DISCOVERY_MAX_LABELS];   /* every one */
+    int  label_count;
+    int  max_nodes;                                   /* 0 = no limit */
+} discovery_config_t;
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_context;
+
+void discovery_cfg_defaults(config_t *cfg);
+int discovery_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* Looks up label key of node id into out; returns 0 when it is set. */
+typedef int (*discovery_label_fn)(void *ud, const char *id, const char *key, char *out,
+                                  size_t out_sz);
+
+/* Returns NULL when a candidate passes every filter, else the one it failed:
+ * "cidr", "id_prefix", "labels" or "max_nodes". source is "scan" or
+ * "register"; ip may be empty when the transport has no address (MQTT), in
+ * which case allow_cidr does not apply. known means the node is already
+ * listed, so max_nodes (against count listed) does not apply. Refusals are
+ * counted and logged, a repeat at most every few minutes. */
+const char *discovery_check(const config_t *cfg, const char *source, const char *ip,
+                            const char *id, int known, int count,
+                            discovery_label_fn label, void *ud);
+
+/* scan_filter_fn for scan_set_filter(); ud is the app_t. */
+int discovery_scan_filter(const scan_node_t *n, int known, int cached, void *ud);
+
+void discovery_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
@@ -0,0 +1,288 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <ctype.h>
+#include <pthread.h>
+#include <netdb.h>
+#include <arpa/inet.h>
+#include <sys/socket.h>
+#include <netinet/in.h>
+#include <time.h>
+#include <unistd.h>
+
+#include "parson.h"
+#include "autod.h"
+#include "dnscache.h"
+
+#define DNSCACHE_SLOTS 64
+
+typedef struct {
+    char host[128];
+    char ip[16];
+    long long expires_ms;
+} dnscache_entry_t;
+
+static pthread_mutex_t g_dns_lock = PTHREAD_MUTEX_INITIALIZER;
+static dnscache_entry_t g_dns[DNSCACHE_SLOTS];
+
+#define DNSCACHE_BOOK_HOSTS 32
+#define DNSCACHE_BOOK_NODES 64
+
+typedef struct {
+    char name[128];            /* DNS name or node id; empty = free */
+    char ip[16];
+    int port;
+    long long learned_unix;
+} dnscache_book_entry_t;
+
+static pthread_mutex_t g_book_lock = PTHREAD_MUTEX_INITIALIZER;
+static char g_book_path[256];
+static dnscache_book_entry_t g_book_hosts[DNSCACHE_BOOK_HOSTS];
+static dnscache_book_entry_t g_book_nodes[DNSCACHE_BOOK_NODES];
+
+static JSON_Value *dnscache_book_list_json_locked(const dnscache_book_entry_t *book, int n,
+                                                  const char *name_key) {
+    JSON_Value *v = json_value_init_array();
+    for (int i = 0; i < n; i++) {
+        if (!book[i].name[0]) continue;
+        JSON_Value *ev = json_value_init_object();
+        JSON_Object *eo = json_object(ev);
+        json_object_set_string(eo, name_key, book[i].name);
+        json_object_set_string(eo, "address", book[i].ip);
+        if (book[i].port > 0) json_object_set_number(eo, "port", book[i].port);
+        json_object_set_number(eo, "learned_unix", (double)book[i].learned_unix);
+        json_array_append_value(json_array(v), ev);
+    }
+    return v;
+}
+
+/* Replace the book file atomically. */
+static void dnscache_book_save_locked(void) {
+    if (!g_book_path[0]) return;
+    JSON_Value *doc = json_value_init_object();
+    json_object_set_value(json_object(doc), "hosts",
+                          dnscache_book_list_json_locked(g_book_hosts, DNSCACHE_BOOK_HOSTS, "name"));
+    json_object_set_value(json_object(doc), "nodes",
+                          dnscache_book_list_json_locked(g_book_nodes, DNSCACHE_BOOK_NODES, "id"));
+    char tmp[sizeof(g_book_path) + 8];
+    snprintf(tmp, sizeof(tmp), "%s.tmp", g_book_path);
+    if (json_serialize_to_file_pretty(doc, tmp) != JSONSuccess || rename(tmp, g_book_path) != 0) {
+        fprintf(stderr, "WARN: cannot write address book to %s\n", g_book_path);
+        (void)unlink(tmp);
+    }
+    json_value_free(doc);
+}
+
+static dnscache_book_entry_t *dnscache_book_find_locked(dnscache_book_entry_t *book, int n,
+                                                        const char *name) {
+    for (int i = 0; i < n; i++) {
+        if (book[i].name[0] && strcasecmp(book[i].name, name) == 0) return &book[i];
+    }
+    return NULL;
+}
+
+/* Add or update an entry, replacing the one learned longest ago when full. */
+static void dnscache_book_note(dnscache_book_entry_t *book, int n, const char *name,
+                               const char *ip, int port) {
+    if (!name || !*name || !ip || !*ip || strlen(name) >= sizeof(book[0].name)) return;
+    pthread_mutex_lock(&g_book_lock);
+    if (!g_book_path[0]) {
+        pthread_mutex_unlock(&g_book_lock);
+        return;
+    }
+    dnscache_book_entry_t *e = dnscache_book_find_locked(book, n, name);
+    if (e && !strcmp(e->ip, ip) && e->port == port) {
+        pthread_mutex_unlock(&g_book_lock);
+        return;
+    }
+    if (!e) {
+        e = &book[0];
+        for (int i = 1; i < n && e->name[0]; i++) {
+            if (!book[i].name[0] || book[i].learned_unix < e->learned_unix) e = &book[i];
+        }
+        memset(e, 0, sizeof(*e));
+        snprintf(e->name, sizeof(e->name), "%s", name);
+    }
+    snprintf(e->ip, sizeof(e->ip), "%s", ip);
+    e->port = port;
+    e->learned_unix = (long long)time(NULL);
+    dnscache_book_save_locked();
+    pthread_mutex_unlock(&g_book_lock);
+}
+
+static int dnscache_book_get(dnscache_book_entry_t *book, int n, const char *name,
+                             char *out, size_t out_sz, int *port) {
+    if (!name || !*name || !out || out_sz == 0) return -1;
+    pthread_mutex_lock(&g_book_lock);
+    const dnscache_book_entry_t *e = dnscache_book_find_locked(book, n, name);
+    if (e) {
+        snprintf(out, out_sz, "%s", e->ip);
+        if (port) *port = e->port;
+    }
+    pthread_mutex_unlock(&g_book_lock);
+    return e ? 0 : -1;
+}
+
+static void dnscache_book_load_list_locked(JSON_Array *arr, const char *name_key,
+                                           dnscache_book_entry_t *book, int n) {
+    int used = 0;
+    for (size_t i = 0; i < json_array_get_count(arr) && used < n; i++) {
+        JSON_Object *eo = json_array_get_object(arr, i);
+        const char *name = json_object_get_string(eo, name_key);
+        const char *ip = json_object_get_string(eo, "address");
+        struct in_addr a;
+        if (!name || !*name || strlen(name) >= sizeof(book[0].name) ||
+            !ip || inet_pton(AF_INET, ip, &a) != 1) {
+            continue;
+        }
+        dnscache_book_entry_t *e = &book[used++];
+        snprintf(e->name, sizeof(e->name), "%s", name);
+        snprintf(e->ip, sizeof(e->ip), "%s", ip);
+        int port = (int)json_object_get_number(eo, "port");
+        e->port = (port > 0 && port <= 65535) ? port : 0;
+        e->learned_unix = (long long)json_object_get_number(eo, "learned_unix");
+    }
+}
+
+void dnscache_book_open(const char *path) {
+    pthread_mutex_lock(&g_book_lock);
+    memset(g_book_hosts, 0, sizeof(g_book_hosts));
+    memset(g_book_nodes, 0, sizeof(g_book_nodes));
+    snprintf(g_book_path, sizeof(g_book_path), "%s", path ? path : "");
+    if (!g_book_path[0] || access(g_book_path, F_OK) != 0) {
+        pthread_mutex_unlock(&g_book_lock);
+        return;
+    }
+    JSON_Value *v = json_parse_file(g_book_path);
+    JSON_Object *o = json_object(v);
+    if (!o) {
+        fprintf(stderr, "WARN: ignoring unreadable address book %s\n", g_book_path);
+    } else {
+        dnscache_book_load_list_locked(json_object_get_array(o, "hosts"), "name",
+                                       g_book_hosts, DNSCACHE_BOOK_HOSTS);
+        dnscache_book_load_list_locked(json_object_get_array(o, "nodes"), "id",
+                                       g_book_nodes, DNSCACHE_BOOK_NODES);
+    }
+    if (v) json_value_free(v);
+    pthread_mutex_unlock(&g_book_lock);
+}
+
+void dnscache_book_note_node(const char *id, const char *ip, int port) {
+    struct in_addr a;
+    if (!ip || inet_pton(AF_INET, ip, &a) != 1) return;
+    dnscache_book_note(g_book_nodes, DNSCACHE_BOOK_NODES, id, ip, port);
+}
+
+int dnscache_book_host(const char *host, char *out, size_t out_sz) {
+    return dnscache_book_get(g_book_hosts, DNSCACHE_BOOK_HOSTS, host, out, out_sz, NULL);
+}
+
+int dnscache_book_node(const char *id, char *out, size_t out_sz, int *port) {
+    return dnscache_book_get(g_book_nodes, DNSCACHE_BOOK_NODES, id, out, out_sz, port);
+}
+
+int dnscache_book_nodes(dnscache_book_node_t *out, int max) {
+    if (!out || max <= 0) return 0;
+    int n = 0;
+    pthread_mutex_lock(&g_book_lock);
+    for (int i = 0; i < DNSCACHE_BOOK_NODES && n < max; i++) {
+        const dnscache_book_entry_t *e = &g_book_nodes[i];
+        size_t len = strlen(e->name);
+        if (!len || len >= sizeof(out[0].id)) continue;
+        memcpy(out[n].id, e->name, len + 1);
+        snprintf(out[n].ip, sizeof(out[n].ip), "%s", e->ip);
+        out[n].port = e->port;
+        n++;
+    }
+    pthread_mutex_unlock(&g_book_lock);
+    return n;
+}
+
+int dnscache_is_hostname(const char *s) {
+    if (!s || !*s || strlen(s) >= sizeof(g_dns[0].host)) return 0;
+    struct in_addr ip;
+    if (inet_pton(AF_INET, s, &ip) == 1) return 0;
+    int alpha = 0;
+    for (const char *p = s; *p; p++) {
+        if (isalpha((unsigned char)*p)) alpha = 1;
+        else if (!isdigit((unsigned char)*p) && *p != '-' && *p != '.') return 0;
+    }
+    return alpha;
+}
+
+static dnscache_entry_t *dnscache_find_locked(const char *host) {
+    for (int i = 0; i < DNSCACHE_SLOTS; i++) {
+        if (g_dns[i].host[0] && strcasecmp(g_dns[i].host, host) == 0) return &g_dns[i];
+    }
+    return NULL;
+}
+
+int dnscache_peek(const char *host, char *out, size_t out_sz) {
+    if (!host || !out || out_sz == 0) return -1;
+    int rc = -1;
+    pthread_mutex_lock(&g_dns_lock);
+    dnscache_entry_t *e = dnscache_find_locked(host);
+    if (e && e->expires_ms > now_ms()) {
+        snprintf(out, out_sz, "%s", e->ip);
+        rc = 0;
+    }
+    pthread_mutex_unlock(&g_dns_lock);
+    return rc;
+}
+
+int dnscache_resolve(const char *host, int ttl_s, char *out, size_t out_sz) {
+    if (!host || !*host || !out || out_sz == 0) return -1;
+    if (!dnscache_is_hostname(host)) {
+        snprintf(out, out_sz, "%s", host);
+        return 0;
+    }
+    if (ttl_s > 0 && dnscache_peek(host, out, out_sz) == 0) return 0;
+
+    struct addrinfo hints; memset(&hints, 0, sizeof(hints));
+    hints.ai_family = AF_INET;
+    hints.ai_socktype = SOCK_STREAM;
+    struct addrinfo *res = NULL;
+    char ip[16] = "";
+    if (getaddrinfo(host, NULL, &hints, &res) == 0) {
+        for (struct addrinfo *ai = res; ai; ai = ai->ai_next) {
+            if (!ai->ai_addr || ai->ai_addr->sa_family != AF_INET) continue;
+            if (inet_ntop(AF_INET, &((struct sockaddr_in *)ai->ai_addr)->sin_addr, ip, sizeof(ip))) break;
+            ip[0] = '\0';
+        }
+        freeaddrinfo(res);
+    }
+    if (!ip[0]) {
+        dnscache_forget(host);
+        return -1;
+    }
+    snprintf(out, out_sz, "%s", ip);
+    dnscache_book_note(g_book_hosts, DNSCACHE_BOOK_HOSTS, host, ip, 0);
+    if (ttl_s <= 0) return 0;
+
+    long long now = now_ms();
+    pthread_mutex_lock(&g_dns_lock);
+    dnscache_entry_t *e = dnscache_find_locked(host);
+    if (!e) {
+        /* Reuse the slot that expires first. */
+        e = &g_dns[0];
+        for (int i = 1; i < DNSCACHE_SLOTS && e->host[0]; i++) {
+            if (!g_dns[i].host[0] || g_dns[i].expires_ms < e->expires_ms) e = &g_dns[i];
+        }
+        strncpy(e->host, host, sizeof(e->host) - 1);
+        e->host[sizeof(e->host) - 1] = '\0';
+    }
+    strncpy(e->ip, ip, sizeof(e->ip) - 1);
+    e->ip[sizeof(e->ip) - 1] = '\0';
+    e->expires_ms = now + (long long)ttl_s * 1000LL;
+    pthread_mutex_unlock(&g_dns_lock);
+    return 0;
+}
+
+void dnscache_forget(const char *host) {
+    if (!host) return;
+    pthread_mutex_lock(&g_dns_lock);
+    dnscache_entry_t *e = dnscache_find_locked(host);
+    if (e) memset(e, 0, sizeof(*e));
+    pthread_mutex_unlock(&g_dns_lock);
+}
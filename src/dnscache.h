@@ -0,0 +1,45 @@
+#ifndef AUTOD_DNSCACHE_H
+#define AUTOD_DNSCACHE_H
+
+#include <stddef.h>
+
+/* IPv4 lookups of node hostnames, cached for a few seconds so dispatching to
+ * many nodes does not hit the resolver on every request. */
+
+/* 1 when s looks like a DNS name rather than a literal IPv4 address or URL. */
+int dnscache_is_hostname(const char *s);
+
+/* Resolve host to a dotted IPv4 string. Literal addresses are copied as-is;
+ * names are served from the cache while younger than ttl_s (0 always asks the
+ * resolver). Returns 0 on success, -1 when the name does not resolve. */
+int dnscache_resolve(const char *host, int ttl_s, char *out, size_t out_sz);
+
+/* Cached address of host without resolving, or -1 when none is cached. */
+int dnscache_peek(const char *host, char *out, size_t out_sz);
+
+/* Drop host from the cache after a connection to its cached address failed,
+ * so the next dispatch resolves it again. */
+void dnscache_forget(const char *host);
+
+/* Address book ([sync] address_book_path): the last address each DNS name
+ * resolved to and each node id was reached at, persisted so the cluster can
+ * re-form after a power cycle while DNS or discovery is still down. Names
+ * are noted by every successful dnscache_resolve once a book is open. */
+void dnscache_book_open(const char *path);
+
+/* Remember that node id answered at ip:port. Written only on change. */
+void dnscache_book_note_node(const char *id, const char *ip, int port);
+
+/* Last known address of a DNS name or node id. Returns 0 or -1. */
+int dnscache_book_host(const char *host, char *out, size_t out_sz);
+int dnscache_book_node(const char *id, char *out, size_t out_sz, int *port);
+
+/* Copy up to max remembered nodes (ids, addresses, ports). Returns the count. */
+typedef struct {
+    char id[64];
+    char ip[16];
+    int port;
+} dnscache_book_node_t;
+int dnscache_book_nodes(dnscache_book_node_t *out, int max);
+
+#endif
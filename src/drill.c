@@ -0,0 +1,78 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "drill.h"
+
+#define DRILL_DEFAULT_S 300
+#define DRILL_MAX_S 86400
+
+/* Seconds in "300", "90s", "15m" or "2h"; -1 when malformed or out of range. */
+static int drill_parse_duration(const char *s) {
+    char *end = NULL;
+    long v = strtol(s, &end, 10);
+    if (end == s || v <= 0) return -1;
+    long unit = *end == 'h' ? 3600 : *end == 'm' ? 60 : 1;
+    if (*end == 'h' || *end == 'm' || *end == 's') end++;
+    if (*end || v > DRILL_MAX_S / unit) return -1;
+    v *= unit;
+    return (int)v;
+}
+
+int drill_handle(struct mg_connection *c, app_t *app, const config_t *cfg, const char *id) {
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (strcasecmp(cfg->sync_role, "master") != 0) {
+        send_plain(c, 404, "not_found", 1);
+        return 1;
+    }
+    if (!id || !*id || strlen(id) >= 64 || strchr(id, '/')) {
+        send_json_error(c, 400, "invalid_id");
+        return 1;
+    }
+    const char *m = ri ? ri->request_method : "";
+    const char *actor = ri && ri->remote_addr[0] ? ri->remote_addr : "api";
+
+    if (!strcmp(m, "DELETE")) {
+        if (!sync_master_simulate_down_end(app, cfg, id, actor)) {
+            send_json_error(c, 404, "not_simulated");
+            return 1;
+        }
+        JSON_Value *v = json_value_init_object();
+        json_object_set_string(json_object(v), "id", id);
+        json_object_set_boolean(json_object(v), "simulated_down", 0);
+        send_json(c, v, 200, 1);
+        json_value_free(v);
+        return 1;
+    }
+    if (strcmp(m, "POST") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        return 1;
+    }
+
+    int duration_s = DRILL_DEFAULT_S;
+    char buf[32];
+    if (ri->query_string &&
+        mg_get_var(ri->query_string, strlen(ri->query_string), "duration", buf, sizeof(buf)) >= 0) {
+        duration_s = drill_parse_duration(buf);
+        if (duration_s < 0) {
+            send_json_error(c, 400, "invalid_duration");
+            return 1;
+        }
+    }
+    if (sync_master_simulate_down(app, cfg, id, duration_s, actor) != 0) {
+        send_json_error(c, 404, "unknown_node");
+        return 1;
+    }
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "id", id);
+    json_object_set_boolean(o, "simulated_down", 1);
+    json_object_set_number(o, "duration_s", duration_s);
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+    return 1;
+}
@@ -0,0 +1,15 @@
+#ifndef AUTOD_DRILL_H
+#define AUTOD_DRILL_H
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_connection;
+
+/* /nodes/{id}/simulate-down on a master, for failover drills. POST
+ * (?duration=300, or 90s / 15m / 2h) makes the master treat the node as
+ * down for that long without touching it: routing, broadcasts, workflows,
+ * the desired topology and notifications react as to a real outage, and the
+ * node is restored on its own afterwards. DELETE ends the drill early. */
+int drill_handle(struct mg_connection *c, app_t *app, const config_t *cfg, const char *id);
+
+#endif
@@ -0,0 +1,582 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <ctype.h>
+#include <time.h>
+#include <unistd.h>
+#include <pthread.h>
+#include <sys/stat.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "events.h"
+#include "enroll.h"
+
+#define ENROLL_DEFAULT_TTL_S 3600
+#define ENROLL_MAX_TTL_S (7 * 24 * 3600)
+#define ENROLL_MAX_USES 1000
+
+typedef struct {
+    char token[ENROLL_SECRET_LEN + 1];   /* empty = free */
+    long long created_unix;
+    long long expires_unix;
+    int  uses;
+    int  uses_left;
+    char note[64];
+    char redeemed_by[64];                /* last node that used it */
+} enroll_token_t;
+
+typedef struct {
+    char id[64];
+    char credential[ENROLL_SECRET_LEN + 1];
+    long long issued_unix;
+    char token_id[9];
+} enroll_node_t;
+
+static pthread_mutex_t g_enroll_lock = PTHREAD_MUTEX_INITIALIZER;
+static enroll_token_t g_tokens[ENROLL_MAX_TOKENS];
+static enroll_node_t g_nodes[ENROLL_MAX_NODES];
+static int g_node_count;
+/* Slave side: the credential this node presents, and the last refusal
+ * logged so a refused node does not repeat it every heartbeat. */
+static char g_credential[ENROLL_SECRET_LEN + 1];
+static char g_last_refusal[32];
+
+void enroll_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->enroll, 0, sizeof(cfg->enroll));
+    cfg->enroll.token_ttl_s = ENROLL_DEFAULT_TTL_S;
+}
+
+int enroll_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (strcmp(section, "enroll") != 0) return 0;
+    enroll_config_t *e = &cfg->enroll;
+    if (!strcmp(key, "required")) {
+        e->required = atoi(value) ? 1 : 0;
+    } else if (!strcmp(key, "token_ttl_s")) {
+        char *end = NULL;
+        long v = strtol(value, &end, 10);
+        if (!end || *end || v < 1 || v > ENROLL_MAX_TTL_S) {
+            fprintf(stderr, "WARN: enroll: ignoring token_ttl_s '%s' (1-%d)\n", value, ENROLL_MAX_TTL_S);
+        } else {
+            e->token_ttl_s = (int)v;
+        }
+    } else if (!strcmp(key, "store_path")) {
+        snprintf(e->store_path, sizeof(e->store_path), "%s", value);
+    } else if (!strcmp(key, "join_token")) {
+        snprintf(e->join_token, sizeof(e->join_token), "%s", value);
+    } else if (!strcmp(key, "credential_path")) {
+        snprintf(e->credential_path, sizeof(e->credential_path), "%s", value);
+    } else {
+        fprintf(stderr, "WARN: ignoring unknown enroll key '%s'\n", key);
+    }
+    return 1;
+}
+
+static int enroll_secret_valid(const char *s) {
+    if (!s || strlen(s) != ENROLL_SECRET_LEN) return 0;
+    for (const char *p = s; *p; p++) {
+        if (!isxdigit((unsigned char)*p)) return 0;
+    }
+    return 1;
+}
+
+/* Replace path with content through a private temporary file. */
+static int enroll_write_private(const char *path, JSON_Value *doc, const char *text) {
+    char tmp[300];
+    snprintf(tmp, sizeof(tmp), "%s.tmp", path);
+    mode_t old = umask(077);
+    int ok;
+    if (doc) {
+        ok = json_serialize_to_file_pretty(doc, tmp) == JSONSuccess;
+    } else {
+        FILE *f = fopen(tmp, "w");
+        ok = f && fprintf(f, "%s\n", text) > 0;
+        if (f && fclose(f) != 0) ok = 0;
+    }
+    umask(old);
+    if (!ok || rename(tmp, path) != 0) {
+        (void)unlink(tmp);
+        return -1;
+    }
+    return 0;
+}
+
+/* ---------- Master ---------- */
+
+static void enroll_persist_locked(const config_t *cfg) {
+    if (!cfg->enroll.store_path[0]) return;
+    JSON_Value *v = json_value_init_object();
+    JSON_Value *arr = json_value_init_array();
+    for (int i = 0; i < g_node_count; i++) {
+        JSON_Value *item = json_value_init_object();
+        JSON_Object *io = json_object(item);
+        json_object_set_string(io, "id", g_nodes[i].id);
+        json_object_set_string(io, "credential", g_nodes[i].credential);
+        json_object_set_number(io, "issued_unix", (double)g_nodes[i].issued_unix);
+        if (g_nodes[i].token_id[0]) json_object_set_string(io, "token", g_nodes[i].token_id);
+        json_array_append_value(json_array(arr), item);
+    }
+    json_object_set_value(json_object(v), "nodes", arr);
+    if (enroll_write_private(cfg->enroll.store_path, v, NULL) != 0) {
+        fprintf(stderr, "WARN: cannot write credentials to %s\n", cfg->enroll.store_path);
+    }
+    json_value_free(v);
+}
+
+static enroll_node_t *enroll_find_node_locked(const char *id) {
+    for (int i = 0; i < g_node_count; i++) {
+        if (!strcmp(g_nodes[i].id, id)) return &g_nodes[i];
+    }
+    return NULL;
+}
+
+static enroll_token_t *enroll_find_token_locked(const char *token) {
+    enroll_token_t *found = NULL;
+    for (int i = 0; i < ENROLL_MAX_TOKENS; i++) {
+        if (g_tokens[i].token[0] && admin_token_equal(token, g_tokens[i].token)) found = &g_tokens[i];
+    }
+    return found;
+}
+
+static void enroll_prune_tokens_locked(long long now) {
+    for (int i = 0; i < ENROLL_MAX_TOKENS; i++) {
+        if (g_tokens[i].token[0] && g_tokens[i].expires_unix <= now) {
+            memset(&g_tokens[i], 0, sizeof(g_tokens[i]));
+        }
+    }
+}
+
+static void enroll_emit(const char *type, const char *id, const char *reason, const char *token_id,
+                        const char *remote_ip) {
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_string(eo, "id", id);
+    if (reason) json_object_set_string(eo, "reason", reason);
+    if (token_id) json_object_set_string(eo, "token", token_id);
+    json_object_set_string(eo, "remote_ip", remote_ip ? remote_ip : "");
+    (void)events_emit(type, ev);
+}
+
+static const char *enroll_refuse(const char *id, const char *reason, const char *remote_ip) {
+    fprintf(stderr, "enroll: refusing registration from %s (%s)\n", id, reason);
+    enroll_emit("enrollment_refused", id, reason, NULL, remote_ip);
+    return reason;
+}
+
+void enroll_load(const config_t *cfg) {
+    if (!cfg) return;
+    if (cfg->enroll.store_path[0] && access(cfg->enroll.store_path, F_OK) == 0) {
+        JSON_Value *v = json_parse_file(cfg->enroll.store_path);
+        JSON_Array *arr = json_object_get_array(json_object(v), "nodes");
+        if (!arr) fprintf(stderr, "WARN: ignoring malformed credential store %s\n", cfg->enroll.store_path);
+        pthread_mutex_lock(&g_enroll_lock);
+        g_node_count = 0;
+        for (size_t i = 0; arr && i < json_array_get_count(arr) && g_node_count < ENROLL_MAX_NODES; i++) {
+            JSON_Object *io = json_array_get_object(arr, i);
+            const char *id = json_object_get_string(io, "id");
+            const char *cred = json_object_get_string(io, "credential");
+            const char *token = json_object_get_string(io, "token");
+            if (!id || !*id || strlen(id) >= sizeof(g_nodes[0].id) || !enroll_secret_valid(cred)) continue;
+            enroll_node_t *n = &g_nodes[g_node_count++];
+            memset(n, 0, sizeof(*n));
+            snprintf(n->id, sizeof(n->id), "%s", id);
+            snprintf(n->credential, sizeof(n->credential), "%s", cred);
+            n->issued_unix = (long long)json_object_get_number(io, "issued_unix");
+            snprintf(n->token_id, sizeof(n->token_id), "%s", token ? token : "");
+        }
+        if (arr) {
+            fprintf(stderr, "enroll: loaded %d node credentials from %s\n", g_node_count,
+                    cfg->enroll.store_path);
+        }
+        pthread_mutex_unlock(&g_enroll_lock);
+        if (v) json_value_free(v);
+    }
+    if (cfg->enroll.credential_path[0] && access(cfg->enroll.credential_path, F_OK) == 0) {
+        char line[128] = "";
+        FILE *f = fopen(cfg->enroll.credential_path, "r");
+        if (f) {
+            if (!fgets(line, sizeof(line), f)) line[0] = '\0';
+            fclose(f);
+        }
+        line[strcspn(line, "\r\n")] = '\0';
+        if (enroll_secret_valid(line)) {
+            pthread_mutex_lock(&g_enroll_lock);
+            memcpy(g_credential, line, sizeof(g_credential));
+            pthread_mutex_unlock(&g_enroll_lock);
+        } else {
+            fprintf(stderr, "WARN: ignoring malformed credential in %s\n", cfg->enroll.credential_path);
+        }
+    }
+}
+
+const char *enroll_check_registration(const config_t *cfg, const char *id, JSON_Object *reg,
+                                      const char *remote_ip, char *issued, size_t issued_sz) {
+    if (issued && issued_sz) issued[0] = '\0';
+    if (!cfg || !id) return NULL;
+    const char *credential = json_object_get_string(reg, "credential");
+    const char *join_token = json_object_get_string(reg, "join_token");
+    long long now = (long long)time(NULL);
+
+    pthread_mutex_lock(&g_enroll_lock);
+    enroll_node_t *node = enroll_find_node_locked(id);
+    if (credential && *credential) {
+        int ok = node && admin_token_equal(credential, node->credential);
+        pthread_mutex_unlock(&g_enroll_lock);
+        return ok ? NULL : enroll_refuse(id, "bad_credential", remote_ip);
+    }
+    if (join_token && *join_token) {
+        enroll_prune_tokens_locked(now);
+        enroll_token_t *tok = enroll_find_token_locked(join_token);
+        /* A node may present a token it already used again, e.g. when the
+         * reply carrying its credential was lost; it gets the credential that
+         * token issued back rather than a new one. */
+        int repeat = tok && !strcmp(tok->redeemed_by, id);
+        if (!tok || (tok->uses_left <= 0 && !repeat)) {
+            pthread_mutex_unlock(&g_enroll_lock);
+            return enroll_refuse(id, "bad_join_token", remote_ip);
+        }
+        if (repeat) {
+            int same = node && !strncmp(node->token_id, tok->token, 8);
+            if (same && issued && issued_sz) snprintf(issued, issued_sz, "%s", node->credential);
+            pthread_mutex_unlock(&g_enroll_lock);
+            if (!same) return enroll_refuse(id, node ? "already_enrolled" : "bad_join_token", remote_ip);
+            fprintf(stderr, "enroll: re-sent the credential of %s (join token %.8s)\n", id, join_token);
+            return NULL;
+        }
+        /* An enrolled id keeps its credential: a token cannot replace it
+         * until an admin revokes the old one. */
+        if (node) {
+            pthread_mutex_unlock(&g_enroll_lock);
+            return enroll_refuse(id, "already_enrolled", remote_ip);
+        }
+        if (g_node_count >= ENROLL_MAX_NODES) {
+            pthread_mutex_unlock(&g_enroll_lock);
+            return enroll_refuse(id, "enrollment_full", remote_ip);
+        }
+        char secret[ENROLL_SECRET_LEN + 1];
+        if (random_token(secret, sizeof(secret)) < 0) {
+            pthread_mutex_unlock(&g_enroll_lock);
+            return enroll_refuse(id, "entropy_unavailable", remote_ip);
+        }
+        tok->uses_left--;
+        snprintf(tok->redeemed_by, sizeof(tok->redeemed_by), "%s", id);
+        node = &g_nodes[g_node_count++];
+        memset(node, 0, sizeof(*node));
+        snprintf(node->id, sizeof(node->id), "%s", id);
+        memcpy(node->credential, secret, sizeof(node->credential));
+        node->issued_unix = now;
+        snprintf(node->token_id, sizeof(node->token_id), "%.8s", tok->token);
+        char token_id[9];
+        memcpy(token_id, node->token_id, sizeof(token_id));
+        if (issued && issued_sz) snprintf(issued, issued_sz, "%s", node->credential);
+        enroll_persist_locked(cfg);
+        pthread_mutex_unlock(&g_enroll_lock);
+        fprintf(stderr, "enroll: issued a credential to %s (join token %s)\n", id, token_id);
+        enroll_emit("node_enrolled", id, NULL, token_id, remote_ip);
+        return NULL;
+    }
+    int enrolled = node != NULL;
+    pthread_mutex_unlock(&g_enroll_lock);
+    if (enrolled) return enroll_refuse(id, "credential_required", remote_ip);
+    if (cfg->enroll.required) return enroll_refuse(id, "enrollment_required", remote_ip);
+    return NULL;
+}
+
+/* ---------- Slave ---------- */
+
+void enroll_slave_annotate(const config_t *cfg, JSON_Object *reg) {
+    if (!cfg || !reg) return;
+    pthread_mutex_lock(&g_enroll_lock);
+    if (g_credential[0]) json_object_set_string(reg, "credential", g_credential);
+    else if (cfg->enroll.join_token[0]) json_object_set_string(reg, "join_token", cfg->enroll.join_token);
+    pthread_mutex_unlock(&g_enroll_lock);
+}
+
+void enroll_slave_note_reply(const config_t *cfg, JSON_Object *reply) {
+    const char *credential = json_object_get_string(reply, "credential");
+    if (!cfg || !enroll_secret_valid(credential)) return;
+    pthread_mutex_lock(&g_enroll_lock);
+    int changed = strcmp(g_credential, credential) != 0;
+    snprintf(g_credential, sizeof(g_credential), "%s", credential);
+    g_last_refusal[0] = '\0';
+    pthread_mutex_unlock(&g_enroll_lock);
+    if (!changed) return;
+    if (!cfg->enroll.credential_path[0]) {
+        fprintf(stderr, "sync slave: enrolled with the master (credential kept in memory only)\n");
+    } else if (enroll_write_private(cfg->enroll.credential_path, NULL, credential) != 0) {
+        fprintf(stderr, "WARN: enrolled, but cannot write the credential to %s\n",
+                cfg->enroll.credential_path);
+    } else {
+        fprintf(stderr, "sync slave: enrolled with the master, credential stored in %s\n",
+                cfg->enroll.credential_path);
+    }
+}
+
+int enroll_slave_refused(const config_t *cfg, JSON_Object *reply) {
+    const char *error = json_object_get_string(reply, "error");
+    if (!cfg || !error) return 0;
+    if (strcmp(error, "bad_credential") && strcmp(error, "credential_required") &&
+        strcmp(error, "enrollment_required") && strcmp(error, "bad_join_token") &&
+        strcmp(error, "enrollment_full") && strcmp(error, "already_enrolled")) {
+        return 0;
+    }
+    pthread_mutex_lock(&g_enroll_lock);
+    int fresh = strcmp(g_last_refusal, error) != 0;
+    snprintf(g_last_refusal, sizeof(g_last_refusal), "%s", error);
+    /* Fall back to the join token; the stored file is only replaced once a
+     * new credential arrives. */
+    if (!strcmp(error, "bad_credential")) g_credential[0] = '\0';
+    pthread_mutex_unlock(&g_enroll_lock);
+    if (fresh) {
+        fprintf(stderr, "sync slave: master refused registration (%s)%s\n", error,
+                cfg->enroll.join_token[0] ? "" : "; set [enroll] join_token to enroll");
+    }
+    return 1;
+}
+
+int enroll_credential(const char *id, char *out, size_t out_sz) {
+    if (!out || out_sz == 0) return -1;
+    out[0] = '\0';
+    pthread_mutex_lock(&g_enroll_lock);
+    if (!id) {
+        snprintf(out, out_sz, "%s", g_credential);
+    } else {
+        const enroll_node_t *node = enroll_find_node_locked(id);
+        if (node) snprintf(out, out_sz, "%s", node->credential);
+    }
+    pthread_mutex_unlock(&g_enroll_lock);
+    return out[0] ? 0 : -1;
+}
+
+/* ---------- HTTP ---------- */
+
+static void enroll_create_token(struct mg_connection *c, const config_t *cfg) {
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        free(u.body);
+        send_json_error(c, 400, "body_read_failed");
+        return;
+    }
+    JSON_Value *root = u.len ? json_parse_string(u.body) : json_value_init_object();
+    free(u.body);
+    if (!root || json_value_get_type(root) != JSONObject) {
+        if (root) json_value_free(root);
+        send_json_error(c, 400, "bad_json");
+        return;
+    }
+    JSON_Object *o = json_object(root);
+    int ttl_s = cfg->enroll.token_ttl_s, uses = 1;
+    JSON_Value *tv = json_object_get_value(o, "ttl_s");
+    JSON_Value *uv = json_object_get_value(o, "uses");
+    if (tv) {
+        double d = json_value_get_number(tv);
+        if (json_value_get_type(tv) != JSONNumber || d < 1 || d > ENROLL_MAX_TTL_S || d != (int)d) {
+            json_value_free(root);
+            send_json_error(c, 400, "invalid_ttl");
+            return;
+        }
+        ttl_s = (int)d;
+    }
+    if (uv) {
+        double d = json_value_get_number(uv);
+        if (json_value_get_type(uv) != JSONNumber || d < 1 || d > ENROLL_MAX_USES || d != (int)d) {
+            json_value_free(root);
+            send_json_error(c, 400, "invalid_uses");
+            return;
+        }
+        uses = (int)d;
+    }
+    const char *note = json_object_get_string(o, "note");
+
+    long long now = (long long)time(NULL);
+    enroll_token_t tok;
+    memset(&tok, 0, sizeof(tok));
+    if (random_token(tok.token, sizeof(tok.token)) < 0) {
+        json_value_free(root);
+        send_json_error(c, 500, "entropy_unavailable");
+        return;
+    }
+    tok.created_unix = now;
+    tok.expires_unix = now + ttl_s;
+    tok.uses = tok.uses_left = uses;
+    snprintf(tok.note, sizeof(tok.note), "%s", note ? note : "");
+    json_value_free(root);
+
+    int stored = 0;
+    pthread_mutex_lock(&g_enroll_lock);
+    enroll_prune_tokens_locked(now);
+    for (int i = 0; i < ENROLL_MAX_TOKENS && !stored; i++) {
+        if (g_tokens[i].token[0]) continue;
+        g_tokens[i] = tok;
+        stored = 1;
+    }
+    pthread_mutex_unlock(&g_enroll_lock);
+    if (!stored) {
+        send_json_error(c, 503, "too_many_tokens");
+        return;
+    }
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    fprintf(stderr, "enroll: join token %.8s created by %s (%d use%s, %ds)\n", tok.token,
+            ri ? ri->remote_addr : "?", uses, uses == 1 ? "" : "s", ttl_s);
+
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *ro = json_object(v);
+    json_object_set_string(ro, "token", tok.token);
+    char id[9];
+    snprintf(id, sizeof(id), "%.8s", tok.token);
+    json_object_set_string(ro, "id", id);
+    json_object_set_number(ro, "expires_unix", (double)tok.expires_unix);
+    json_object_set_number(ro, "uses", uses);
+    if (tok.note[0]) json_object_set_string(ro, "note", tok.note);
+    send_json(c, v, 201, 1);
+    json_value_free(v);
+}
+
+static void enroll_list_tokens(struct mg_connection *c) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Value *arr = json_value_init_array();
+    pthread_mutex_lock(&g_enroll_lock);
+    enroll_prune_tokens_locked((long long)time(NULL));
+    for (int i = 0; i < ENROLL_MAX_TOKENS; i++) {
+        const enroll_token_t *t = &g_tokens[i];
+        if (!t->token[0]) continue;
+        JSON_Value *item = json_value_init_object();
+        JSON_Object *io = json_object(item);
+        char id[9];
+        snprintf(id, sizeof(id), "%.8s", t->token);
+        json_object_set_string(io, "id", id);
+        json_object_set_number(io, "created_unix", (double)t->created_unix);
+        json_object_set_number(io, "expires_unix", (double)t->expires_unix);
+        json_object_set_number(io, "uses", t->uses);
+        json_object_set_number(io, "uses_left", t->uses_left);
+        if (t->note[0]) json_object_set_string(io, "note", t->note);
+        if (t->redeemed_by[0]) json_object_set_string(io, "redeemed_by", t->redeemed_by);
+        json_array_append_value(json_array(arr), item);
+    }
+    pthread_mutex_unlock(&g_enroll_lock);
+    json_object_set_value(json_object(v), "tokens", arr);
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+}
+
+static void enroll_list_nodes(struct mg_connection *c, const config_t *cfg) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    JSON_Value *arr = json_value_init_array();
+    pthread_mutex_lock(&g_enroll_lock);
+    for (int i = 0; i < g_node_count; i++) {
+        JSON_Value *item = json_value_init_object();
+        JSON_Object *io = json_object(item);
+        json_object_set_string(io, "id", g_nodes[i].id);
+        json_object_set_number(io, "issued_unix", (double)g_nodes[i].issued_unix);
+        if (g_nodes[i].token_id[0]) json_object_set_string(io, "token", g_nodes[i].token_id);
+        json_array_append_value(json_array(arr), item);
+    }
+    pthread_mutex_unlock(&g_enroll_lock);
+    json_object_set_boolean(o, "required", cfg->enroll.required);
+    json_object_set_value(o, "nodes", arr);
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+}
+
+/*
+ * GET    /admin/join-tokens        — unexpired tokens (ids only, never the secret)
+ * POST   /admin/join-tokens        — {ttl_s, uses, note} -> 201 {token, id, expires_unix}
+ * DELETE /admin/join-tokens/{id}   — revoke a token
+ * GET    /admin/credentials        — enrolled nodes
+ * DELETE /admin/credentials/{node} — revoke a node's credential; it must enroll again
+ * Master only; every call needs the [admin] token.
+ */
+static int h_enroll(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri) {
+        free(cfg);
+        return 0;
+    }
+    const char *uri = api_local_uri(c);
+    int tokens = !strncmp(uri, "/admin/join-tokens", 18);
+    const char *prefix = tokens ? "/admin/join-tokens" : "/admin/credentials";
+    const char *rest = uri + strlen(prefix);
+    if (*rest && strcmp(rest, "/") != 0 && (rest[0] != '/' || strchr(rest + 1, '/'))) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    const char *item = (*rest == '/' && rest[1]) ? rest + 1 : NULL;
+    const char *method = ri->request_method;
+    int allowed = item ? !strcmp(method, "DELETE")
+                       : (!strcmp(method, "GET") || (tokens && !strcmp(method, "POST")));
+    if (!allowed) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+    if (!admin_authorize(c, cfg)) {
+        free(cfg);
+        return 1;
+    }
+    if (strcasecmp(cfg->sync_role, "master") != 0) {
+        send_json_error(c, 409, "not_a_master");
+        free(cfg);
+        return 1;
+    }
+
+    if (!item) {
+        if (!strcmp(method, "POST")) enroll_create_token(c, cfg);
+        else if (tokens) enroll_list_tokens(c);
+        else enroll_list_nodes(c, cfg);
+        free(cfg);
+        return 1;
+    }
+    int found = 0;
+    pthread_mutex_lock(&g_enroll_lock);
+    if (tokens) {
+        for (int i = 0; i < ENROLL_MAX_TOKENS; i++) {
+            if (!g_tokens[i].token[0] || strlen(item) != 8 || strncmp(g_tokens[i].token, item, 8)) continue;
+            memset(&g_tokens[i], 0, sizeof(g_tokens[i]));
+            found = 1;
+        }
+    } else {
+        for (int i = 0; i < g_node_count; i++) {
+            if (strcmp(g_nodes[i].id, item) != 0) continue;
+            memmove(&g_nodes[i], &g_nodes[i + 1], (size_t)(g_node_count - i - 1) * sizeof(g_nodes[0]));
+            g_node_count--;
+            found = 1;
+            enroll_persist_locked(cfg);
+            break;
+        }
+    }
+    pthread_mutex_unlock(&g_enroll_lock);
+    if (!found) {
+        send_json_error(c, 404, tokens ? "unknown_token" : "unknown_node");
+        free(cfg);
+        return 1;
+    }
+    fprintf(stderr, "enroll: %s %s revoked by %s\n", tokens ? "join token" : "credential of", item,
+            ri->remote_addr);
+    if (!tokens) enroll_emit("credential_revoked", item, NULL, NULL, ri->remote_addr);
+    JSON_Value *v = json_value_init_object();
+    json_object_set_string(json_object(v), "status", "revoked");
+    json_object_set_string(json_object(v), tokens ? "token" : "id", item);
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+    free(cfg);
+    return 1;
+}
+
+void enroll_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    api_set_handler(ctx, "/admin/join-tokens", h_enroll, app);
+    api_set_handler(ctx, "/admin/credentials", h_enroll, app);
+}
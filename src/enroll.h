@@ -0,0 +1,56 @@
+#ifndef AUTOD_ENROLL_H
+#define AUTOD_ENROLL_H
+
+#include <stddef.h>
+#include "parson.h"
+
+#define ENROLL_MAX_TOKENS 32
+#define ENROLL_MAX_NODES 256
+#define ENROLL_SECRET_LEN 32          /* hex characters in tokens and credentials */
+
+/* [enroll] — bootstrap without baking permanent secrets into images. The
+ * master hands out short-lived join tokens (POST /admin/join-tokens or
+ * `autod token create`); a new slave presents one at its first registration
+ * and gets a per-node credential back, which it keeps and presents from then
+ * on. Once a node id holds a credential, registrations under that id without
+ * it are refused. */
+typedef struct {
+    int  required;                /* master: refuse nodes that hold no credential or token */
+    int  token_ttl_s;             /* master: join token lifetime when none is asked for (3600) */
+    char store_path[256];         /* master: issued credentials; empty = memory only */
+    char join_token[80];          /* slave: presented until a credential is issued */
+    char credential_path[256];    /* slave: where the issued credential is kept; empty = memory */
+} enroll_config_t;
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_context;
+
+void enroll_cfg_defaults(config_t *cfg);
+int enroll_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* Restore issued credentials (master) or this node's credential (slave). */
+void enroll_load(const config_t *cfg);
+
+/* Master: check the credential or join_token in a registration for id.
+ * Returns NULL when it may proceed, with a freshly issued credential in
+ * issued (empty otherwise), or the error to refuse it with (401). */
+const char *enroll_check_registration(const config_t *cfg, const char *id, JSON_Object *reg,
+                                      const char *remote_ip, char *issued, size_t issued_sz);
+
+/* Slave: add the credential, or the join token while there is none, to a
+ * registration body. */
+void enroll_slave_annotate(const config_t *cfg, JSON_Object *reg);
+/* Slave: keep a credential handed out in a registration reply. */
+void enroll_slave_note_reply(const config_t *cfg, JSON_Object *reply);
+/* Slave: whether reply is an enrollment refusal (logged; a rejected
+ * credential is dropped so the join token is tried again). */
+int enroll_slave_refused(const config_t *cfg, JSON_Object *reply);
+
+/* The secret shared with a node: on a master the credential issued to id,
+ * on a slave (id NULL) its own. Returns 0, or -1 when there is none. */
+int enroll_credential(const char *id, char *out, size_t out_sz);
+
+void enroll_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
@@ -0,0 +1,425 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <errno.h>
+#include <pthread.h>
+#include <sys/stat.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "events.h"
+#include "sync_results.h"
+#include "jobs.h"
+
+typedef struct {
+    unsigned long long seq;
+    long long ts_ms;           /* monotonic, meaningful within one boot */
+    long long ts_unix_ms;      /* wall clock; 0 = unknown (older store lines) */
+    char type[32];
+    char *data_json;
+} event_entry_t;
+
+static pthread_mutex_t g_events_lock = PTHREAD_MUTEX_INITIALIZER;
+static event_entry_t g_events[EVENTS_RING_SIZE];
+static unsigned long long g_events_next_seq = 1;
+/* Names this sequence numbering in resume tokens; a new one means the
+ * numbers started over (memory only restart, lost store). */
+static char g_events_stream[EVENTS_STREAM_LEN + 1];
+static int g_events_mirrored;                       /* replica: the ring follows another node */
+
+static events_config_t g_store;                     /* store_path empty = memory only */
+static unsigned long long g_store_first;            /* oldest seq in store_path, 0 = empty */
+static unsigned long long g_store_rotated_first;    /* oldest seq in store_path.1, 0 = none */
+static unsigned long long g_restored_seq;
+
+/* ---------- Config ---------- */
+
+void events_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->events, 0, sizeof(cfg->events));
+    cfg->events.store_max_kb = 256;
+}
+
+int events_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || strcmp(section, "events") != 0) return 0;
+    if (!strcmp(key, "store_path")) {
+        snprintf(cfg->events.store_path, sizeof(cfg->events.store_path), "%s", value);
+    } else if (!strcmp(key, "store_max_kb")) {
+        cfg->events.store_max_kb = atoi(value);
+    } else {
+        fprintf(stderr, "WARN: ignoring unknown events key '%s'\n", key);
+    }
+    return 1;
+}
+
+/* ---------- Ring ---------- */
+
+/* Caller holds g_events_lock. */
+static void stream_ensure_locked(void) {
+    if (!g_events_stream[0]) random_id(g_events_stream, sizeof(g_events_stream));
+}
+
+/* Caller holds g_events_lock; takes ownership of data_json. */
+static event_entry_t *ring_put_locked(unsigned long long seq, long long ts_ms,
+                                      long long ts_unix_ms, const char *type, char *data_json) {
+    event_entry_t *e = &g_events[seq % EVENTS_RING_SIZE];
+    if (e->data_json) json_free_serialized_string(e->data_json);
+    e->seq = seq;
+    e->ts_ms = ts_ms;
+    e->ts_unix_ms = ts_unix_ms;
+    strncpy(e->type, type ? type : "event", sizeof(e->type) - 1);
+    e->type[sizeof(e->type) - 1] = '\0';
+    e->data_json = data_json;
+    return e;
+}
+
+/* ---------- Store ---------- */
+
+static void store_rotated_path(char *out, size_t out_sz) {
+    snprintf(out, out_sz, "%s.1", g_store.store_path);
+}
+
+/* Append e to the store, moving the file to <store_path>.1 once it is larger
+ * than store_max_kb, so the two files together hold the newest events.
+ * Caller holds g_events_lock. */
+static void store_append_locked(const event_entry_t *e) {
+    if (!g_store.store_path[0]) return;
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_number(o, "seq", (double)e->seq);
+    json_object_set_number(o, "ts_ms", (double)e->ts_ms);
+    json_object_set_number(o, "ts_unix_ms", (double)e->ts_unix_ms);
+    json_object_set_string(o, "stream", g_events_stream);
+    json_object_set_string(o, "type", e->type);
+    JSON_Value *data = e->data_json ? json_parse_string(e->data_json) : NULL;
+    if (data) json_object_set_value(o, "data", data);
+    char *line = json_serialize_to_string(v);
+    json_value_free(v);
+    if (!line) return;
+
+    FILE *f = fopen(g_store.store_path, "a");
+    int ok = f && fprintf(f, "%s\n", line) > 0;
+    if (f && fclose(f) != 0) ok = 0;
+    json_free_serialized_string(line);
+    if (!ok) {
+        static int warned;
+        if (!warned) {
+            fprintf(stderr, "events: cannot append to %s: %s\n", g_store.store_path, strerror(errno));
+            warned = 1;
+        }
+        return;
+    }
+    if (!g_store_first) g_store_first = e->seq;
+    struct stat st;
+    if (stat(g_store.store_path, &st) == 0 && st.st_size > (off_t)g_store.store_max_kb * 1024) {
+        char rotated[sizeof(g_store.store_path) + 4];
+        store_rotated_path(rotated, sizeof(rotated));
+        if (rename(g_store.store_path, rotated) != 0) {
+            fprintf(stderr, "events: failed to rotate %s: %s\n", g_store.store_path, strerror(errno));
+            return;
+        }
+        g_store_rotated_first = g_store_first;
+        g_store_first = 0;
+    }
+}
+
+/* Call fn for every event in one store file, oldest first; returns the
+ * first sequence number seen (0 = none). */
+static unsigned long long store_scan_file(const char *path, void (*fn)(JSON_Object *, void *),
+                                          void *ctx) {
+    FILE *f = fopen(path, "r");
+    if (!f) return 0;
+    unsigned long long first = 0;
+    char *line = NULL;
+    size_t cap = 0;
+    while (getline(&line, &cap, f) > 0) {
+        JSON_Value *v = json_parse_string(line);
+        JSON_Object *o = json_object(v);
+        unsigned long long seq = (unsigned long long)json_object_get_number(o, "seq");
+        if (seq > 0) {
+            if (!first) first = seq;
+            fn(o, ctx);
+        }
+        if (v) json_value_free(v);
+    }
+    free(line);
+    fclose(f);
+    return first;
+}
+
+/* Call fn for every stored event, oldest first. Caller holds g_events_lock. */
+static void store_scan(void (*fn)(JSON_Object *, void *), void *ctx) {
+    char rotated[sizeof(g_store.store_path) + 4];
+    store_rotated_path(rotated, sizeof(rotated));
+    g_store_rotated_first = store_scan_file(rotated, fn, ctx);
+    g_store_first = store_scan_file(g_store.store_path, fn, ctx);
+}
+
+typedef struct {
+    unsigned long long last;
+    unsigned long count;
+} store_restore_t;
+
+static void store_restore_one(JSON_Object *o, void *ctx) {
+    store_restore_t *r = (store_restore_t *)ctx;
+    unsigned long long seq = (unsigned long long)json_object_get_number(o, "seq");
+    if (seq <= r->last) return;
+    JSON_Value *data = json_object_get_value(o, "data");
+    ring_put_locked(seq, (long long)json_object_get_number(o, "ts_ms"),
+                    (long long)json_object_get_number(o, "ts_unix_ms"),
+                    json_object_get_string(o, "type"), data ? json_serialize_to_string(data) : NULL);
+    const char *stream = json_object_get_string(o, "stream");
+    if (stream && *stream) snprintf(g_events_stream, sizeof(g_events_stream), "%s", stream);
+    r->last = seq;
+    r->count++;
+}
+
+void events_store_configure(const config_t *cfg) {
+    if (!cfg || !cfg->events.store_path[0]) return;
+    event_entry_t *early = calloc(EVENTS_RING_SIZE, sizeof(*early));
+    if (!early) return;
+
+    pthread_mutex_lock(&g_events_lock);
+    g_store = cfg->events;
+    if (g_store.store_max_kb < 16) g_store.store_max_kb = 16;
+    /* Set aside what was emitted before the store was opened. */
+    size_t early_count = 0;
+    for (unsigned long long seq = 1; seq < g_events_next_seq; seq++) {
+        event_entry_t *e = &g_events[seq % EVENTS_RING_SIZE];
+        if (e->seq != seq) continue;
+        early[early_count++] = *e;
+        memset(e, 0, sizeof(*e));
+    }
+
+    store_restore_t r = { 0, 0 };
+    store_scan(store_restore_one, &r);
+    g_events_next_seq = r.last + 1;
+    g_restored_seq = r.last;
+    stream_ensure_locked();
+    for (size_t i = 0; i < early_count; i++) {
+        event_entry_t *e = ring_put_locked(g_events_next_seq++, early[i].ts_ms, early[i].ts_unix_ms,
+                                           early[i].type, early[i].data_json);
+        store_append_locked(e);
+    }
+    pthread_mutex_unlock(&g_events_lock);
+    free(early);
+
+    if (r.count > 0) {
+        fprintf(stderr, "events: restored %lu event(s) from %s, resuming at seq %llu\n",
+                r.count, cfg->events.store_path, r.last + 1);
+    } else {
+        fprintf(stderr, "events: recording the event stream in %s\n", cfg->events.store_path);
+    }
+}
+
+unsigned long long events_restored_seq(void) {
+    pthread_mutex_lock(&g_events_lock);
+    unsigned long long seq = g_restored_seq;
+    pthread_mutex_unlock(&g_events_lock);
+    return seq;
+}
+
+unsigned long long events_emit(const char *type, JSON_Value *data) {
+    /* Events raised while serving a request (or work it started) say which. */
+    JSON_Object *o = json_object(data);
+    const char *request_id = api_request_id();
+    if (o && request_id[0] && !json_object_has_value(o, "request_id")) {
+        json_object_set_string(o, "request_id", request_id);
+    }
+    char *serialized = data ? json_serialize_to_string(data) : NULL;
+    if (data) json_value_free(data);
+
+    pthread_mutex_lock(&g_events_lock);
+    stream_ensure_locked();
+    unsigned long long seq = g_events_next_seq++;
+    event_entry_t *e = ring_put_locked(seq, now_ms(), jobs_unix_ms(), type, serialized);
+    store_append_locked(e);
+    pthread_mutex_unlock(&g_events_lock);
+    /* On a slave the master gets a copy (queued while it is unreachable). */
+    sync_results_record_event(type, serialized);
+    return seq;
+}
+
+void events_mirror(unsigned long long seq, long long ts_ms, long long ts_unix_ms, const char *type,
+                   JSON_Value *data) {
+    char *serialized = data ? json_serialize_to_string(data) : NULL;
+    if (data) json_value_free(data);
+    if (seq == 0) {
+        if (serialized) json_free_serialized_string(serialized);
+        return;
+    }
+
+    pthread_mutex_lock(&g_events_lock);
+    (void)ring_put_locked(seq, ts_ms, ts_unix_ms, type, serialized);
+    g_events_next_seq = seq + 1;
+    g_events_mirrored = 1;
+    pthread_mutex_unlock(&g_events_lock);
+}
+
+void events_mirror_stream(const char *resume) {
+    const char *dash = resume ? strchr(resume, '-') : NULL;
+    if (!dash || dash == resume || (size_t)(dash - resume) > EVENTS_STREAM_LEN) return;
+    pthread_mutex_lock(&g_events_lock);
+    snprintf(g_events_stream, sizeof(g_events_stream), "%.*s", (int)(dash - resume), resume);
+    pthread_mutex_unlock(&g_events_lock);
+}
+
+/* Events [start, end) read back from the store for events_collect. */
+typedef struct {
+    unsigned long long start;
+    unsigned long long end;
+    const char *type;
+    int limit;
+    int added;
+    JSON_Array *out;
+} store_collect_t;
+
+static void store_collect_one(JSON_Object *o, void *ctx) {
+    store_collect_t *q = (store_collect_t *)ctx;
+    unsigned long long seq = (unsigned long long)json_object_get_number(o, "seq");
+    const char *type = json_object_get_string(o, "type");
+    if (q->added >= q->limit || seq < q->start || seq >= q->end) return;
+    if (q->type && *q->type && (!type || strcmp(q->type, type) != 0)) return;
+    JSON_Value *item = json_value_init_object();
+    JSON_Object *io = json_object(item);
+    json_object_set_number(io, "seq", (double)seq);
+    json_object_set_number(io, "ts_ms", json_object_get_number(o, "ts_ms"));
+    if (json_object_get_number(o, "ts_unix_ms") > 0) {
+        json_object_set_number(io, "ts_unix_ms", json_object_get_number(o, "ts_unix_ms"));
+    }
+    json_object_set_string(io, "type", type ? type : "event");
+    JSON_Value *data = json_object_get_value(o, "data");
+    if (data) json_object_set_value(io, "data", json_value_deep_copy(data));
+    json_array_append_value(q->out, item);
+    q->added++;
+}
+
+unsigned long long events_collect(unsigned long long since, const char *type, int limit,
+                                  JSON_Array *out, int *truncated) {
+    if (truncated) *truncated = 0;
+    if (!out) return 0;
+    if (limit <= 0 || limit > EVENTS_RING_SIZE) limit = EVENTS_RING_SIZE;
+
+    pthread_mutex_lock(&g_events_lock);
+    unsigned long long last = g_events_next_seq - 1;
+    unsigned long long in_memory = last >= EVENTS_RING_SIZE ? last - EVENTS_RING_SIZE + 1 : 1;
+    unsigned long long oldest = in_memory;
+    int use_store = g_store.store_path[0] && !g_events_mirrored;
+    if (use_store) {
+        unsigned long long stored = g_store_rotated_first ? g_store_rotated_first : g_store_first;
+        if (stored && stored < oldest) oldest = stored;
+    }
+    unsigned long long start = since + 1;
+    if (start < oldest) {
+        if (truncated && since > 0) *truncated = 1;
+        start = oldest;
+    }
+    int added = 0;
+    if (use_store && start < in_memory) {
+        /* Older than the ring: read it back from disk. */
+        store_collect_t q = { start, in_memory, type, limit, 0, out };
+        char rotated[sizeof(g_store.store_path) + 4];
+        store_rotated_path(rotated, sizeof(rotated));
+        (void)store_scan_file(rotated, store_collect_one, &q);
+        (void)store_scan_file(g_store.store_path, store_collect_one, &q);
+        added = q.added;
+        start = in_memory;
+    }
+    for (unsigned long long seq = start; seq <= last && added < limit; seq++) {
+        event_entry_t *e = &g_events[seq % EVENTS_RING_SIZE];
+        if (e->seq != seq) continue;
+        if (type && *type && strcmp(type, e->type) != 0) continue;
+        JSON_Value *item = json_value_init_object();
+        JSON_Object *io = json_object(item);
+        json_object_set_number(io, "seq", (double)e->seq);
+        json_object_set_number(io, "ts_ms", (double)e->ts_ms);
+        if (e->ts_unix_ms > 0) json_object_set_number(io, "ts_unix_ms", (double)e->ts_unix_ms);
+        json_object_set_string(io, "type", e->type);
+        JSON_Value *data = e->data_json ? json_parse_string(e->data_json) : NULL;
+        if (data) json_object_set_value(io, "data", data);
+        json_array_append_value(out, item);
+        added++;
+    }
+    pthread_mutex_unlock(&g_events_lock);
+    return last;
+}
+
+/* A resume token is "<stream>-<seq>": the client has every event up to seq
+ * of that stream. Returns 0 and the seq to continue after (0 with *reset set
+ * when the stream is not this one), or -1 when token is malformed. */
+static int events_parse_resume(const char *token, unsigned long long *since, int *reset) {
+    const char *dash = strchr(token, '-');
+    if (!dash || dash == token || (size_t)(dash - token) > EVENTS_STREAM_LEN) return -1;
+    char *end = NULL;
+    errno = 0;
+    unsigned long long seq = strtoull(dash + 1, &end, 10);
+    if (errno || end == dash + 1 || *end) return -1;
+    pthread_mutex_lock(&g_events_lock);
+    stream_ensure_locked();
+    int same = strlen(g_events_stream) == (size_t)(dash - token) &&
+               !strncmp(g_events_stream, token, (size_t)(dash - token));
+    pthread_mutex_unlock(&g_events_lock);
+    *reset = !same;
+    *since = same ? seq : 0;
+    return 0;
+}
+
+static int h_events(struct mg_connection *c, void *ud) {
+    (void)ud;
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri || strcmp(ri->request_method, "GET") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        return 1;
+    }
+
+    unsigned long long since = 0;
+    int limit = 100;
+    int reset = 0;
+    char type[32] = "";
+    const char *qs = ri->query_string;
+    if (qs) {
+        char buf[64];
+        size_t qlen = strlen(qs);
+        if (mg_get_var(qs, qlen, "since", buf, sizeof(buf)) > 0) since = strtoull(buf, NULL, 10);
+        if (mg_get_var(qs, qlen, "limit", buf, sizeof(buf)) > 0) limit = atoi(buf);
+        if (mg_get_var(qs, qlen, "type", type, sizeof(type)) <= 0) type[0] = '\0';
+        if (mg_get_var(qs, qlen, "resume", buf, sizeof(buf)) > 0 &&
+            events_parse_resume(buf, &since, &reset) != 0) {
+            send_json_error(c, 400, "bad_resume");
+            return 1;
+        }
+    }
+    if (limit <= 0 || limit > EVENTS_RING_SIZE) limit = EVENTS_RING_SIZE;
+
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    JSON_Value *arr_v = json_value_init_array();
+    JSON_Array *arr = json_array(arr_v);
+    int truncated = 0;
+    unsigned long long last = events_collect(since, type, limit, arr, &truncated);
+    /* A full page resumes after its last event, anything else at last_seq. */
+    size_t count = json_array_get_count(arr);
+    unsigned long long upto = last;
+    if (count >= (size_t)limit) {
+        upto = (unsigned long long)json_object_get_number(json_array_get_object(arr, count - 1), "seq");
+    }
+    char resume[EVENTS_STREAM_LEN + 24];
+    pthread_mutex_lock(&g_events_lock);
+    stream_ensure_locked();
+    snprintf(resume, sizeof(resume), "%s-%llu", g_events_stream, upto);
+    pthread_mutex_unlock(&g_events_lock);
+    json_object_set_value(ro, "events", arr_v);
+    json_object_set_number(ro, "last_seq", (double)last);
+    json_object_set_string(ro, "resume", resume);
+    if (reset) json_object_set_boolean(ro, "reset", 1);
+    if (truncated) json_object_set_boolean(ro, "truncated", 1);
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+    return 1;
+}
+
+void events_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    api_set_handler(ctx, "/events", h_events, app);
+}
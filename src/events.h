@@ -0,0 +1,54 @@
+#ifndef AUTOD_EVENTS_H
+#define AUTOD_EVENTS_H
+
+#include "parson.h"
+
+#define EVENTS_RING_SIZE 256
+#define EVENTS_STREAM_LEN 16
+
+typedef struct app app_t;
+typedef struct config config_t;
+struct mg_context;
+
+/* [events] — keep the event stream on disk (JSON lines, one event each) so
+ * /events can be resumed across a restart. */
+typedef struct {
+    char store_path[256];     /* empty = memory only */
+    int  store_max_kb;        /* rotate to <store_path>.1 beyond this size */
+} events_config_t;
+
+void events_cfg_defaults(config_t *cfg);
+int  events_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* Open the store and restore the newest events (and their sequence numbers)
+ * from it. Events emitted before this are renumbered after the restored ones. */
+void events_store_configure(const config_t *cfg);
+
+/* Highest sequence number restored from the store (0 = none), so consumers
+ * that already handled those events before the restart can skip them. */
+unsigned long long events_restored_seq(void);
+
+/* Append an event to the in-memory ring. Takes ownership of data (may be NULL)
+ * and returns the assigned sequence number. Thread-safe. */
+unsigned long long events_emit(const char *type, JSON_Value *data);
+
+/* Store an event copied from another node under its original sequence number
+ * and timestamps (read replicas). Takes ownership of data. A sequence number
+ * lower than the current one (the source restarted) rewinds the ring. */
+void events_mirror(unsigned long long seq, long long ts_ms, long long ts_unix_ms, const char *type,
+                   JSON_Value *data);
+
+/* Take over the stream id of a resume token from another node (read
+ * replicas), so tokens stay valid when a client switches between them. */
+void events_mirror_stream(const char *resume);
+
+/* Append events newer than `since` (optionally filtered by type, up to limit)
+ * to out, reading the store for events no longer in memory. Returns the
+ * highest sequence number assigned so far and sets *truncated when older
+ * events than requested were already overwritten. */
+unsigned long long events_collect(unsigned long long since, const char *type, int limit,
+                                  JSON_Array *out, int *truncated);
+
+void events_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
@@ -0,0 +1,116 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <pthread.h>
+#include <stdint.h>
+
+#include "parson.h"
+#include "autod.h"
+#include "catalog.h"
+#include "execcache.h"
+
+typedef struct {
+    int in_use;
+    char target[80];
+    uint64_t fingerprint;
+    long long stored_ms;
+    char *reply;
+} execcache_entry_t;
+
+static pthread_mutex_t g_execcache_lock = PTHREAD_MUTEX_INITIALIZER;
+static execcache_entry_t g_execcache[EXECCACHE_MAX_ENTRIES];
+
+static uint64_t execcache_hash(uint64_t h, const char *buf, size_t len) {
+    for (size_t i = 0; i < len; i++) {
+        h ^= (unsigned char)buf[i];
+        h *= 1099511628211ULL;
+    }
+    return h;
+}
+
+/* Only path and args say what the command does; request ids, lease ids and
+ * the like differ between otherwise equal calls. */
+static uint64_t execcache_fingerprint(const char *body, size_t len) {
+    uint64_t h = 1469598103934665603ULL;
+    JSON_Value *v = json_parse_string(body ? body : "");
+    const char *path = json_object_get_string(json_object(v), "path");
+    if (!path) {
+        if (v) json_value_free(v);
+        return execcache_hash(h, body ? body : "", body ? len : 0);
+    }
+    h = execcache_hash(h, path, strlen(path) + 1);
+    JSON_Value *args = json_object_get_value(json_object(v), "args");
+    char *ser = args ? json_serialize_to_string(args) : NULL;
+    if (ser) {
+        h = execcache_hash(h, ser, strlen(ser));
+        json_free_serialized_string(ser);
+    }
+    json_value_free(v);
+    return h;
+}
+
+int execcache_ttl_s(const config_t *cfg, const char *exec_body, size_t len) {
+    (void)len;
+    JSON_Value *v = json_parse_string(exec_body ? exec_body : "");
+    const char *path = json_object_get_string(json_object(v), "path");
+    char opt[16];
+    int ttl = 0;
+    if (path && catalog_option_for(cfg, path, "cacheable", opt, sizeof(opt)) == 0) {
+        ttl = atoi(opt);
+        if (ttl < 0) ttl = 0;
+    }
+    if (v) json_value_free(v);
+    return ttl;
+}
+
+static execcache_entry_t *execcache_find_locked(const char *target, uint64_t fp) {
+    for (int i = 0; i < EXECCACHE_MAX_ENTRIES; i++) {
+        execcache_entry_t *e = &g_execcache[i];
+        if (e->in_use && e->fingerprint == fp && !strcmp(e->target, target)) return e;
+    }
+    return NULL;
+}
+
+/* Free entry, else the oldest one. */
+static execcache_entry_t *execcache_alloc_locked(void) {
+    execcache_entry_t *oldest = &g_execcache[0];
+    for (int i = 0; i < EXECCACHE_MAX_ENTRIES; i++) {
+        execcache_entry_t *e = &g_execcache[i];
+        if (!e->in_use) return e;
+        if (e->stored_ms < oldest->stored_ms) oldest = e;
+    }
+    return oldest;
+}
+
+char *execcache_get(const char *target, const char *exec_body, size_t len,
+                    long long max_age_ms, long long *age_ms) {
+    if (!target || !*target) return NULL;
+    uint64_t fp = execcache_fingerprint(exec_body, len);
+    char *out = NULL;
+    pthread_mutex_lock(&g_execcache_lock);
+    execcache_entry_t *e = execcache_find_locked(target, fp);
+    long long age = e ? now_ms() - e->stored_ms : 0;
+    if (e && age <= max_age_ms) {
+        out = strdup(e->reply);
+        if (out && age_ms) *age_ms = age;
+    }
+    pthread_mutex_unlock(&g_execcache_lock);
+    return out;
+}
+
+void execcache_put(const char *target, const char *exec_body, size_t len, const char *reply) {
+    if (!target || !*target || !reply) return;
+    uint64_t fp = execcache_fingerprint(exec_body, len);
+    char *copy = strdup(reply);
+    if (!copy) return;
+    pthread_mutex_lock(&g_execcache_lock);
+    execcache_entry_t *e = execcache_find_locked(target, fp);
+    if (!e) e = execcache_alloc_locked();
+    free(e->reply);
+    e->in_use = 1;
+    snprintf(e->target, sizeof(e->target), "%s", target);
+    e->fingerprint = fp;
+    e->stored_ms = now_ms();
+    e->reply = copy;
+    pthread_mutex_unlock(&g_execcache_lock);
+}
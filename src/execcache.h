@@ -0,0 +1,26 @@
+#ifndef AUTOD_EXECCACHE_H
+#define AUTOD_EXECCACHE_H
+
+#include <stddef.h>
+
+#define EXECCACHE_MAX_ENTRIES 64
+
+/* Master-side cache of relayed /exec replies for catalog entries marked
+ * " cacheable=TTL". Entries are keyed by target (a slot or node id) and the
+ * command's path and args, and hold the last successful /http reply. */
+
+typedef struct config config_t;
+
+/* TTL in seconds for an /exec body, from the cacheable= option of the catalog
+ * entry matching its path; 0 when the command is not cacheable. */
+int execcache_ttl_s(const config_t *cfg, const char *exec_body, size_t len);
+
+/* The stored reply for target and body when it is at most max_age_ms old, as
+ * a malloc'd JSON string (age in *age_ms), or NULL. */
+char *execcache_get(const char *target, const char *exec_body, size_t len,
+                    long long max_age_ms, long long *age_ms);
+
+/* Keep reply (the /http response object, serialised) for target and body. */
+void execcache_put(const char *target, const char *exec_body, size_t len, const char *reply);
+
+#endif
@@ -0,0 +1,599 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <stdarg.h>
+#include <pthread.h>
+#include <fnmatch.h>
+#include <time.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "httpc.h"
+#include "sync_mqtt.h"
+#include "fedmetrics.h"
+
+#define FEDMETRICS_SCRAPE_TIMEOUT_MS 5000
+#define FEDMETRICS_SEND_TIMEOUT_MS 5000
+/* A gzip'd relay inflates to at most this much. */
+#define FEDMETRICS_MAX_TEXT (4 * MAX_BODY_BYTES)
+
+typedef struct {
+    char node[64];
+    char *text;               /* NULL when the node's last scrape failed */
+    size_t bytes;
+    long long scraped_unix;
+    long long scrape_ms;
+    long long received_ms;
+    char error[32];
+} fedmetrics_sample_t;
+
+static pthread_mutex_t g_fed_lock = PTHREAD_MUTEX_INITIALIZER;
+static fedmetrics_sample_t g_samples[FEDMETRICS_MAX_NODES];
+
+/* Slave side: what the last scrape and relay did (under g_fed_lock). */
+static long long g_last_scrape_ms;
+static long long g_last_scrape_unix;
+static long long g_last_sent_unix;
+static size_t g_last_bytes;
+static char g_last_error[32];
+static int g_gzip_refused;
+
+/* ---------- Config ---------- */
+
+void fedmetrics_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->metrics, 0, sizeof(cfg->metrics));
+    cfg->metrics.scrape_interval_s = 60;
+    cfg->metrics.stale_s = 600;
+}
+
+int fedmetrics_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || strcmp(section, "metrics") != 0) return 0;
+    fedmetrics_config_t *m = &cfg->metrics;
+    if (!strcmp(key, "scrape_url")) {
+        if (*value && strncmp(value, "http://", 7) != 0) {
+            fprintf(stderr, "WARN: ignoring [metrics] scrape_url '%s' (http:// only)\n", value);
+        } else {
+            snprintf(m->scrape_url, sizeof(m->scrape_url), "%s", value);
+        }
+    } else if (!strcmp(key, "families")) {
+        snprintf(m->families, sizeof(m->families), "%s", value);
+    } else if (!strcmp(key, "scrape_interval_s")) {
+        int n = atoi(value);
+        if (n >= 5) m->scrape_interval_s = n;
+        else fprintf(stderr, "WARN: ignoring [metrics] scrape_interval_s %s (minimum 5)\n", value);
+    } else if (!strcmp(key, "stale_s")) {
+        int n = atoi(value);
+        if (n > 0) m->stale_s = n;
+        else fprintf(stderr, "WARN: ignoring [metrics] stale_s %s (must be positive)\n", value);
+    } else {
+        fprintf(stderr, "WARN: ignoring unknown metrics key '%s'\n", key);
+    }
+    return 1;
+}
+
+/* ---------- Text format ---------- */
+
+typedef struct {
+    char *buf;
+    size_t len;
+    size_t cap;
+} fed_text_t;
+
+static void fed_text_append(fed_text_t *t, const char *s, size_t n) {
+    if (!t->buf && t->cap) return; /* an earlier allocation failed */
+    if (t->len + n + 1 > t->cap) {
+        size_t ncap = t->cap ? t->cap : 4096;
+        while (t->len + n + 1 > ncap) ncap *= 2;
+        char *nb = realloc(t->buf, ncap);
+        if (!nb) {
+            free(t->buf);
+            t->buf = NULL;
+            t->cap = 1;
+            return;
+        }
+        t->buf = nb;
+        t->cap = ncap;
+    }
+    memcpy(t->buf + t->len, s, n);
+    t->len += n;
+    t->buf[t->len] = '\0';
+}
+
+static void fed_text_printf(fed_text_t *t, const char *fmt, ...) {
+    char tmp[512];
+    va_list ap;
+    va_start(ap, fmt);
+    int n = vsnprintf(tmp, sizeof(tmp), fmt, ap);
+    va_end(ap);
+    if (n < 0) return;
+    fed_text_append(t, tmp, (size_t)n < sizeof(tmp) ? (size_t)n : sizeof(tmp) - 1);
+}
+
+static size_t fed_name_len(const char *s, size_t max) {
+    size_t n = 0;
+    while (n < max && (s[n] == '_' || s[n] == ':' || (s[n] >= 'a' && s[n] <= 'z') ||
+                       (s[n] >= 'A' && s[n] <= 'Z') || (n > 0 && s[n] >= '0' && s[n] <= '9'))) {
+        n++;
+    }
+    return n;
+}
+
+/* "# HELP name ..." / "# TYPE name ...": the family the comment describes. */
+static int fed_comment_family(const char *line, size_t len, char *name, size_t name_sz) {
+    if (len < 7 || (strncmp(line, "# HELP ", 7) != 0 && strncmp(line, "# TYPE ", 7) != 0)) return 0;
+    size_t n = fed_name_len(line + 7, len - 7);
+    if (n == 0 || n >= name_sz) return 0;
+    memcpy(name, line + 7, n);
+    name[n] = '\0';
+    return 1;
+}
+
+/* The family a sample belongs to: the one the preceding HELP/TYPE lines named
+ * when the sample is one of its series (_total, _bucket, ...), else its own name. */
+static void fed_sample_family(const char *line, size_t n, const char *current,
+                              char *family, size_t family_sz) {
+    static const char *suffixes[] = { "", "_total", "_bucket", "_sum", "_count", "_created",
+                                      "_info", "_gsum", "_gcount" };
+    size_t clen = strlen(current);
+    if (clen && clen <= n && strncmp(line, current, clen) == 0) {
+        for (size_t i = 0; i < sizeof(suffixes) / sizeof(suffixes[0]); i++) {
+            if (n - clen == strlen(suffixes[i]) && strncmp(line + clen, suffixes[i], n - clen) == 0) {
+                snprintf(family, family_sz, "%s", current);
+                return;
+            }
+        }
+    }
+    if (n >= family_sz) n = family_sz - 1;
+    memcpy(family, line, n);
+    family[n] = '\0';
+}
+
+static int fed_family_included(const char *families, const char *family) {
+    if (!families || !*families) return 1;
+    char tmp[256];
+    snprintf(tmp, sizeof(tmp), "%s", families);
+    char *save = NULL;
+    for (char *tok = strtok_r(tmp, ", ", &save); tok; tok = strtok_r(NULL, ", ", &save)) {
+        if (*tok && fnmatch(tok, family, 0) == 0) return 1;
+    }
+    return 0;
+}
+
+/* Keep only the families matching one of the [metrics] families globs. */
+static char *fed_filter(const char *text, const char *families) {
+    fed_text_t out = {0};
+    char current[128] = "";
+    for (const char *p = text; *p;) {
+        const char *eol = strchr(p, '\n');
+        size_t len = eol ? (size_t)(eol - p) : strlen(p);
+        char family[128];
+        int keep = 0;
+        if (fed_comment_family(p, len, family, sizeof(family))) {
+            snprintf(current, sizeof(current), "%s", family);
+            keep = fed_family_included(families, family);
+        } else if (len && p[0] != '#') {
+            fed_sample_family(p, fed_name_len(p, len), current, family, sizeof(family));
+            keep = fed_family_included(families, family);
+        }
+        if (keep) {
+            fed_text_append(&out, p, len);
+            fed_text_append(&out, "\n", 1);
+        }
+        p = eol ? eol + 1 : p + len;
+    }
+    if (!out.buf) out.buf = strdup("");
+    return out.buf;
+}
+
+/* ---------- Slave ---------- */
+
+static char *fed_build_sample(const config_t *cfg, const char *text, long long took_ms,
+                              const char *error) {
+    JSON_Value *root = json_value_init_object();
+    JSON_Object *o = json_object(root);
+    json_object_set_string(o, "id", cfg->sync_id);
+    json_object_set_number(o, "scraped_unix", (double)time(NULL));
+    json_object_set_number(o, "scrape_ms", (double)took_ms);
+    if (error) json_object_set_string(o, "error", error);
+    else json_object_set_string(o, "text", text ? text : "");
+    char *s = json_serialize_to_string(root);
+    json_value_free(root);
+    return s;
+}
+
+static int fed_send(const config_t *cfg, const http_url_t *target, const char *body) {
+    if (!target) return sync_mqtt_slave_publish(cfg, "metrics", body) == 0 ? 200 : -1;
+    http_url_t url = *target;
+    snprintf(url.path, sizeof(url.path), "%s", "/sync/metrics");
+    size_t body_len = strlen(body);
+    char *gz = NULL;
+    size_t gz_len = 0;
+    int status = -1;
+    if (cfg->sync_gzip && !g_gzip_refused && httpc_gzip(body, body_len, &gz, &gz_len) == 0) {
+        status = httpc_post(&url, "gzip", gz, gz_len, NULL, NULL, FEDMETRICS_SEND_TIMEOUT_MS);
+        if (status == 415) g_gzip_refused = 1;
+    }
+    free(gz);
+    if (status < 0 || status == 415) {
+        status = httpc_post_json(&url, body, NULL, NULL, FEDMETRICS_SEND_TIMEOUT_MS);
+    }
+    return status;
+}
+
+void fedmetrics_slave_tick(const config_t *cfg, const http_url_t *target) {
+    if (!cfg || !cfg->metrics.scrape_url[0] || strcasecmp(cfg->sync_role, "slave") != 0) return;
+    long long now = now_ms();
+    if (g_last_scrape_ms && now - g_last_scrape_ms < cfg->metrics.scrape_interval_s * 1000LL) return;
+    g_last_scrape_ms = now;
+
+    http_url_t src;
+    char *resp = NULL;
+    size_t resp_len = 0;
+    const char *error = NULL;
+    int status = -1;
+    if (httpc_parse_url(cfg->metrics.scrape_url, &src, "/metrics") != 0) {
+        error = "bad_url";
+    } else {
+        status = httpc_get(&src, &resp, &resp_len, FEDMETRICS_SCRAPE_TIMEOUT_MS);
+        if (status < 0) error = "unreachable";
+        else if (status != 200) error = "bad_status";
+    }
+    long long took = now_ms() - now;
+    char *text = NULL;
+    if (!error) {
+        text = fed_filter(resp, cfg->metrics.families);
+        if (!text) error = "oom";
+    }
+    free(resp);
+
+    char *body = fed_build_sample(cfg, text, took, error);
+    int sent = body ? fed_send(cfg, target, body) : -1;
+    if (body) json_free_serialized_string(body);
+
+    pthread_mutex_lock(&g_fed_lock);
+    int changed = strcmp(g_last_error, error ? error : "") != 0;
+    snprintf(g_last_error, sizeof(g_last_error), "%s", error ? error : "");
+    if (!error) {
+        g_last_scrape_unix = (long long)time(NULL);
+        g_last_bytes = strlen(text);
+    }
+    if (sent == 200) g_last_sent_unix = (long long)time(NULL);
+    pthread_mutex_unlock(&g_fed_lock);
+    if (error && changed) {
+        fprintf(stderr, "metrics: scraping %s failed (%s)\n", cfg->metrics.scrape_url, error);
+    }
+    if (sent == 413) fprintf(stderr, "metrics: sample too large for the master, narrow [metrics] families\n");
+    free(text);
+}
+
+/* ---------- Master ---------- */
+
+static fedmetrics_sample_t *fed_slot_for_locked(const char *node) {
+    fedmetrics_sample_t *free_slot = NULL, *oldest = NULL;
+    for (int i = 0; i < FEDMETRICS_MAX_NODES; i++) {
+        fedmetrics_sample_t *s = &g_samples[i];
+        if (s->node[0] && strcmp(s->node, node) == 0) return s;
+        if (!s->node[0] && !free_slot) free_slot = s;
+        if (s->node[0] && (!oldest || s->received_ms < oldest->received_ms)) oldest = s;
+    }
+    fedmetrics_sample_t *s = free_slot ? free_slot : oldest;
+    free(s->text);
+    memset(s, 0, sizeof(*s));
+    snprintf(s->node, sizeof(s->node), "%s", node);
+    return s;
+}
+
+void fedmetrics_ingest(const char *node, JSON_Object *sample) {
+    if (!node || !*node || !sample) return;
+    const char *text = json_object_get_string(sample, "text");
+    const char *error = json_object_get_string(sample, "error");
+    char *copy = (text && !error) ? strdup(text) : NULL;
+    pthread_mutex_lock(&g_fed_lock);
+    fedmetrics_sample_t *s = fed_slot_for_locked(node);
+    free(s->text);
+    s->text = copy;
+    s->bytes = copy ? strlen(copy) : 0;
+    s->scraped_unix = (long long)json_object_get_number(sample, "scraped_unix");
+    s->scrape_ms = (long long)json_object_get_number(sample, "scrape_ms");
+    s->received_ms = now_ms();
+    snprintf(s->error, sizeof(s->error), "%s", error ? error : (copy ? "" : "no_text"));
+    pthread_mutex_unlock(&g_fed_lock);
+}
+
+typedef struct {
+    char name[128];
+    char *help;
+    char *type;
+    fed_text_t samples;
+} fed_family_t;
+
+typedef struct {
+    fed_family_t *items;
+    size_t count;
+    size_t cap;
+} fed_families_t;
+
+static fed_family_t *fed_family_get(fed_families_t *fams, const char *name) {
+    for (size_t i = fams->count; i > 0; i--) {
+        if (!strcmp(fams->items[i - 1].name, name)) return &fams->items[i - 1];
+    }
+    if (fams->count == fams->cap) {
+        size_t ncap = fams->cap ? fams->cap * 2 : 64;
+        fed_family_t *n = realloc(fams->items, ncap * sizeof(*n));
+        if (!n) return NULL;
+        fams->items = n;
+        fams->cap = ncap;
+    }
+    fed_family_t *f = &fams->items[fams->count++];
+    memset(f, 0, sizeof(*f));
+    snprintf(f->name, sizeof(f->name), "%s", name);
+    return f;
+}
+
+/* Escape a label value (node ids are at most 63 bytes). */
+static void fed_escape_label(const char *in, char *out, size_t out_sz) {
+    size_t o = 0;
+    for (const char *p = in; *p && o + 2 < out_sz; p++) {
+        if (*p == '"' || *p == '\\') out[o++] = '\\';
+        out[o++] = *p == '\n' ? ' ' : *p;
+    }
+    out[o] = '\0';
+}
+
+/* Merge one node's exposition into the families, adding autod_node to each
+ * series. HELP/TYPE come from the first node that declares the family. */
+static void fed_merge_node(fed_families_t *fams, const char *node, const char *text) {
+    char label[160];
+    char esc[140];
+    fed_escape_label(node, esc, sizeof(esc));
+    snprintf(label, sizeof(label), "autod_node=\"%s\"", esc);
+    size_t label_len = strlen(label);
+    char current[128] = "";
+    fed_family_t *f = NULL;
+    for (const char *p = text; *p;) {
+        const char *eol = strchr(p, '\n');
+        size_t len = eol ? (size_t)(eol - p) : strlen(p);
+        char family[128];
+        if (fed_comment_family(p, len, family, sizeof(family))) {
+            snprintf(current, sizeof(current), "%s", family);
+            f = fed_family_get(fams, family);
+            char **slot = f ? (p[2] == 'H' ? &f->help : &f->type) : NULL;
+            if (slot && !*slot) *slot = strndup(p, len);
+        } else if (len && p[0] != '#') {
+            size_t n = fed_name_len(p, len);
+            fed_sample_family(p, n, current, family, sizeof(family));
+            if (!f || strcmp(f->name, family) != 0) f = fed_family_get(fams, family);
+            if (f && n > 0) {
+                fed_text_t *t = &f->samples;
+                fed_text_append(t, p, n);
+                if (n < len && p[n] == '{') {
+                    fed_text_append(t, "{", 1);
+                    fed_text_append(t, label, label_len);
+                    if (n + 1 < len && p[n + 1] != '}') fed_text_append(t, ",", 1);
+                    fed_text_append(t, p + n + 1, len - n - 1);
+                } else {
+                    fed_text_append(t, "{", 1);
+                    fed_text_append(t, label, label_len);
+                    fed_text_append(t, "}", 1);
+                    fed_text_append(t, p + n, len - n);
+                }
+                fed_text_append(t, "\n", 1);
+            }
+        }
+        p = eol ? eol + 1 : p + len;
+    }
+}
+
+/* GET /metrics/federated[?node=ID]: every node's latest sample merged into one
+ * exposition, plus autod_federated_up / _age_seconds per node. */
+static int h_metrics_federated(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri || strcmp(ri->request_method, "GET") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+    if (strcasecmp(cfg->sync_role, "master") != 0) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    char only[64] = "";
+    if (ri->query_string &&
+        mg_get_var(ri->query_string, strlen(ri->query_string), "node", only, sizeof(only)) <= 0) {
+        only[0] = '\0';
+    }
+
+    fedmetrics_sample_t snap[FEDMETRICS_MAX_NODES];
+    int count = 0;
+    long long now = now_ms();
+    long long stale_ms = cfg->metrics.stale_s * 1000LL;
+    pthread_mutex_lock(&g_fed_lock);
+    for (int i = 0; i < FEDMETRICS_MAX_NODES; i++) {
+        const fedmetrics_sample_t *s = &g_samples[i];
+        if (!s->node[0] || now - s->received_ms > stale_ms) continue;
+        if (only[0] && strcmp(only, s->node) != 0) continue;
+        snap[count] = *s;
+        snap[count].text = s->text ? strdup(s->text) : NULL;
+        count++;
+    }
+    pthread_mutex_unlock(&g_fed_lock);
+
+    fed_families_t fams = {0};
+    for (int i = 0; i < count; i++) {
+        if (snap[i].text) fed_merge_node(&fams, snap[i].node, snap[i].text);
+    }
+    fed_text_t out = {0};
+    for (size_t i = 0; i < fams.count; i++) {
+        fed_family_t *f = &fams.items[i];
+        if (f->samples.len) {
+            if (f->help) { fed_text_append(&out, f->help, strlen(f->help)); fed_text_append(&out, "\n", 1); }
+            if (f->type) { fed_text_append(&out, f->type, strlen(f->type)); fed_text_append(&out, "\n", 1); }
+            fed_text_append(&out, f->samples.buf, f->samples.len);
+        }
+        free(f->help);
+        free(f->type);
+        free(f->samples.buf);
+    }
+    free(fams.items);
+
+    fed_text_printf(&out, "# HELP autod_federated_up Whether the node's last scrape of its local endpoint succeeded.\n"
+                          "# TYPE autod_federated_up gauge\n");
+    for (int i = 0; i < count; i++) {
+        char esc[140];
+        fed_escape_label(snap[i].node, esc, sizeof(esc));
+        fed_text_printf(&out, "autod_federated_up{autod_node=\"%s\"} %d\n", esc, snap[i].text ? 1 : 0);
+    }
+    fed_text_printf(&out, "# HELP autod_federated_age_seconds Seconds since the master received the node's sample.\n"
+                          "# TYPE autod_federated_age_seconds gauge\n");
+    for (int i = 0; i < count; i++) {
+        char esc[140];
+        fed_escape_label(snap[i].node, esc, sizeof(esc));
+        fed_text_printf(&out, "autod_federated_age_seconds{autod_node=\"%s\"} %.3f\n", esc,
+                        (now - snap[i].received_ms) / 1000.0);
+        free(snap[i].text);
+    }
+    if (!out.buf) {
+        send_plain(c, 500, "oom", 1);
+        free(cfg);
+        return 1;
+    }
+    send_plain(c, 200, out.buf, 1);
+    free(out.buf);
+    free(cfg);
+    return 1;
+}
+
+static int h_sync_metrics_post(struct mg_connection *c) {
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        free(u.body);
+        send_plain(c, 413, "body_too_large", 1);
+        return 1;
+    }
+    const char *encoding = mg_get_header(c, "Content-Encoding");
+    if (encoding && *encoding && strcasecmp(encoding, "identity") != 0) {
+        char *plain = NULL;
+        size_t plain_len = 0;
+        int ok = !strcasecmp(encoding, "gzip") && httpc_gzip_available() && u.body &&
+                 httpc_gunzip(u.body, u.len, FEDMETRICS_MAX_TEXT, &plain, &plain_len) == 0;
+        free(u.body);
+        if (!ok) {
+            send_plain(c, strcasecmp(encoding, "gzip") || !httpc_gzip_available() ? 415 : 400,
+                       "bad_encoding", 1);
+            return 1;
+        }
+        u.body = plain;
+    }
+    JSON_Value *root = json_parse_string(u.body ? u.body : "");
+    free(u.body);
+    JSON_Object *obj = root ? json_object(root) : NULL;
+    const char *id = obj ? json_object_get_string(obj, "id") : NULL;
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    if (!id || !*id) {
+        json_object_set_string(ro, "error", root ? "missing_id" : "bad_json");
+        send_json(c, resp, 400, 1);
+    } else {
+        fedmetrics_ingest(id, obj);
+        json_object_set_string(ro, "status", "ok");
+        send_json(c, resp, 200, 1);
+    }
+    json_value_free(resp);
+    if (root) json_value_free(root);
+    return 1;
+}
+
+static int h_sync_metrics_list(struct mg_connection *c, const config_t *cfg) {
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    JSON_Value *nodes_v = json_value_init_object();
+    long long now = now_ms();
+    pthread_mutex_lock(&g_fed_lock);
+    for (int i = 0; i < FEDMETRICS_MAX_NODES; i++) {
+        const fedmetrics_sample_t *s = &g_samples[i];
+        if (!s->node[0]) continue;
+        JSON_Value *nv = json_value_init_object();
+        JSON_Object *no = json_object(nv);
+        json_object_set_number(no, "scraped_unix", (double)s->scraped_unix);
+        json_object_set_number(no, "scrape_ms", (double)s->scrape_ms);
+        json_object_set_number(no, "age_s", (double)((now - s->received_ms) / 1000));
+        json_object_set_number(no, "bytes", (double)s->bytes);
+        json_object_set_boolean(no, "stale", now - s->received_ms > cfg->metrics.stale_s * 1000LL);
+        if (s->error[0]) json_object_set_string(no, "error", s->error);
+        json_object_set_value(json_object(nodes_v), s->node, nv);
+    }
+    pthread_mutex_unlock(&g_fed_lock);
+    json_object_set_value(ro, "nodes", nodes_v);
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+    return 1;
+}
+
+static int h_sync_metrics_local(struct mg_connection *c, const config_t *cfg) {
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    json_object_set_string(ro, "scrape_url", cfg->metrics.scrape_url);
+    json_object_set_number(ro, "scrape_interval_s", cfg->metrics.scrape_interval_s);
+    pthread_mutex_lock(&g_fed_lock);
+    json_object_set_number(ro, "last_scrape_unix", (double)g_last_scrape_unix);
+    json_object_set_number(ro, "last_sent_unix", (double)g_last_sent_unix);
+    json_object_set_number(ro, "bytes", (double)g_last_bytes);
+    if (g_last_error[0]) json_object_set_string(ro, "last_error", g_last_error);
+    pthread_mutex_unlock(&g_fed_lock);
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+    return 1;
+}
+
+/* POST /sync/metrics (master): a node's sample. GET lists the samples held on
+ * a master, or the local scrape state on a slave. */
+static int h_sync_metrics(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri) {
+        free(cfg);
+        return 0;
+    }
+    int is_master = strcasecmp(cfg->sync_role, "master") == 0;
+    int is_slave = strcasecmp(cfg->sync_role, "slave") == 0;
+    if (!is_master && !is_slave) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    if (strcmp(ri->request_method, "POST") == 0 && is_master) {
+        free(cfg);
+        return h_sync_metrics_post(c);
+    }
+    if (strcmp(ri->request_method, "GET") == 0) {
+        int rc = is_master ? h_sync_metrics_list(c, cfg) : h_sync_metrics_local(c, cfg);
+        free(cfg);
+        return rc;
+    }
+    send_plain(c, 405, "method_not_allowed", 1);
+    free(cfg);
+    return 1;
+}
+
+void fedmetrics_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    api_set_handler(ctx, "/sync/metrics", h_sync_metrics, app);
+    api_set_handler(ctx, "/metrics/federated", h_metrics_federated, app);
+}
@@ -0,0 +1,39 @@
+#ifndef AUTOD_FEDMETRICS_H
+#define AUTOD_FEDMETRICS_H
+
+#include "parson.h"
+#include "httpc.h"
+
+#define FEDMETRICS_MAX_NODES 64
+
+/* [metrics] — slaves scrape a local Prometheus/OpenMetrics endpoint
+ * (node_exporter, application metrics) and relay the latest sample to the
+ * master (POST /sync/metrics, or <prefix>/node/<id>/metrics over MQTT). The
+ * master keeps one sample per node and serves them merged, each series
+ * labelled with autod_node, at GET /metrics/federated. */
+typedef struct {
+    char scrape_url[256];     /* slave: local endpoint; empty disables scraping */
+    char families[256];       /* slave: comma-separated metric family globs (empty = all) */
+    int  scrape_interval_s;   /* slave: seconds between scrapes (default 60) */
+    int  stale_s;             /* master: drop samples older than this (default 600) */
+} fedmetrics_config_t;
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_context;
+
+void fedmetrics_cfg_defaults(config_t *cfg);
+int fedmetrics_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* Slave: scrape and relay when a sample is due. target is the registration
+ * URL (its path is replaced) or NULL to publish over the MQTT transport.
+ * Called from the registration loop. */
+void fedmetrics_slave_tick(const config_t *cfg, const http_url_t *target);
+
+/* Master: keep the sample a node relayed ({scraped_unix, scrape_ms, text} or
+ * {error}). */
+void fedmetrics_ingest(const char *node, JSON_Object *sample);
+
+void fedmetrics_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
@@ -0,0 +1,863 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <errno.h>
+#include <fcntl.h>
+#include <fnmatch.h>
+#include <time.h>
+#include <unistd.h>
+#include <pthread.h>
+#include <stdint.h>
+#include <sys/stat.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "events.h"
+#include "nodemeta.h"
+#include "sync_results.h"
+#include "caller.h"
+#include "fleetcfg.h"
+
+#define FLEETCFG_NAME_MAX 32
+#define FLEETCFG_VERSION_MAX 17
+
+/* Master: one stored fragment. */
+typedef struct {
+    char name[FLEETCFG_NAME_MAX];  /* empty = free */
+    char path[256];
+    int mode;
+    unsigned char *content;
+    size_t len;
+    char reload[512];              /* exec payload, empty = none */
+    char nodes[128];               /* sync id globs (empty = every node) */
+    char device[64];
+    char role[64];
+    struct { char key[32]; char value[64]; } labels[FLEETCFG_MAX_LABELS];
+    int label_count;
+    char version[FLEETCFG_VERSION_MAX];
+    long long updated_unix;
+} fleetcfg_fragment_t;
+
+/* What a node (master side) or this node (slave side) reported per fragment. */
+typedef struct {
+    char name[FLEETCFG_NAME_MAX];
+    char version[FLEETCFG_VERSION_MAX];
+    int failed;
+    char error[32];
+    char path[256];                /* slave only */
+    int reload_rc;                 /* slave only; -1 = no reload ran */
+    long long applied_unix;        /* slave only */
+} fleetcfg_status_t;
+
+typedef struct {
+    char id[64];                   /* empty = free */
+    fleetcfg_status_t items[FLEETCFG_MAX_FRAGMENTS];
+    int count;
+    long long reported_unix;
+} fleetcfg_node_t;
+
+static pthread_mutex_t g_fleetcfg_lock = PTHREAD_MUTEX_INITIALIZER;
+static fleetcfg_fragment_t g_fragments[FLEETCFG_MAX_FRAGMENTS];
+static fleetcfg_node_t g_nodes[SYNC_MAX_SLAVES];
+static fleetcfg_status_t g_applied[FLEETCFG_MAX_FRAGMENTS];   /* slave */
+
+/* ---------- Config ---------- */
+
+void fleetcfg_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->fleetcfg, 0, sizeof(cfg->fleetcfg));
+    cfg->fleetcfg.max_kb = 64;
+}
+
+int fleetcfg_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (strcmp(section, "fleetcfg") != 0) return 0;
+    fleetcfg_config_t *fc = &cfg->fleetcfg;
+    if (!strcmp(key, "store_path")) {
+        snprintf(fc->store_path, sizeof(fc->store_path), "%s", value);
+    } else if (!strcmp(key, "allow")) {
+        if (fc->allow_count >= FLEETCFG_MAX_ALLOW) {
+            fprintf(stderr, "WARN: fleetcfg allow capacity reached (%d)\n", FLEETCFG_MAX_ALLOW);
+        } else if (value[0] != '/') {
+            fprintf(stderr, "WARN: ignoring fleetcfg allow '%s' (expected an absolute path glob)\n", value);
+        } else {
+            snprintf(fc->allow[fc->allow_count++], sizeof(fc->allow[0]), "%s", value);
+        }
+    } else if (!strcmp(key, "max_kb")) {
+        int v = atoi(value);
+        if (v >= 1 && v <= MAX_BODY_BYTES / 2048) fc->max_kb = v;
+        else fprintf(stderr, "WARN: ignoring fleetcfg max_kb %s (1-%d)\n", value, MAX_BODY_BYTES / 2048);
+    } else {
+        fprintf(stderr, "WARN: ignoring unknown fleetcfg key '%s'\n", key);
+    }
+    return 1;
+}
+
+/* ---------- Fragments ---------- */
+
+static int fleetcfg_valid_name(const char *name) {
+    size_t n = name ? strlen(name) : 0;
+    if (n == 0 || n >= FLEETCFG_NAME_MAX) return 0;
+    return strspn(name, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789._-") == n;
+}
+
+/* Everything a slave acts on: path, mode, content and reload. */
+static void fleetcfg_version_of(const fleetcfg_fragment_t *f, char *out, size_t out_sz) {
+    uint64_t h = 1469598103934665603ULL;
+    char head[sizeof(f->path) + sizeof(f->reload) + 16];
+    int n = snprintf(head, sizeof(head), "%s\n%o\n%s\n", f->path, f->mode, f->reload);
+    for (int i = 0; i < n; i++) {
+        h ^= (unsigned char)head[i];
+        h *= 1099511628211ULL;
+    }
+    for (size_t i = 0; i < f->len; i++) {
+        h ^= f->content[i];
+        h *= 1099511628211ULL;
+    }
+    snprintf(out, out_sz, "%016llx", (unsigned long long)h);
+}
+
+static fleetcfg_fragment_t *fleetcfg_find_locked(const char *name) {
+    for (int i = 0; i < FLEETCFG_MAX_FRAGMENTS; i++) {
+        if (g_fragments[i].name[0] && !strcmp(g_fragments[i].name, name)) return &g_fragments[i];
+    }
+    return NULL;
+}
+
+static int fleetcfg_matches(const fleetcfg_fragment_t *f, const char *id, const char *device,
+                            const char *role) {
+    if (f->device[0] && strcmp(f->device, device ? device : "") != 0) return 0;
+    if (f->role[0] && strcmp(f->role, role ? role : "") != 0) return 0;
+    if (f->nodes[0]) {
+        char tmp[sizeof(f->nodes)];
+        snprintf(tmp, sizeof(tmp), "%s", f->nodes);
+        int found = 0;
+        char *save = NULL;
+        for (char *tok = strtok_r(tmp, ", \t", &save); tok && !found; tok = strtok_r(NULL, ", \t", &save)) {
+            found = fnmatch(tok, id, 0) == 0;
+        }
+        if (!found) return 0;
+    }
+    for (int i = 0; i < f->label_count; i++) {
+        char value[64];
+        if (nodemeta_get_label(id, f->labels[i].key, value, sizeof(value)) != 0 ||
+            strcmp(value, f->labels[i].value) != 0) {
+            return 0;
+        }
+    }
+    return 1;
+}
+
+static char *fleetcfg_base64(const unsigned char *data, size_t len) {
+    size_t out_len = 4 * ((len + 2) / 3) + 1;
+    char *out = malloc(out_len);
+    if (!out) return NULL;
+    if (len == 0) {
+        out[0] = '\0';
+        return out;
+    }
+    (void)mg_base64_encode(data, len, out, &out_len);
+    return out;
+}
+
+/* 0 with *out (malloc'd) and *out_len, or -1 when s is not base64. */
+static int fleetcfg_unbase64(const char *s, unsigned char **out, size_t *out_len) {
+    size_t n = strlen(s);
+    *out = malloc(n / 4 * 3 + 4);
+    *out_len = n / 4 * 3 + 4;
+    if (!*out) return -1;
+    if (n == 0) {
+        *out_len = 0;
+        return 0;
+    }
+    if (mg_base64_decode(s, n, *out, out_len) != -1) {
+        free(*out);
+        *out = NULL;
+        return -1;
+    }
+    (*out_len)--;                  /* civetweb counts the terminating NUL */
+    return 0;
+}
+
+static JSON_Value *fleetcfg_match_json(const fleetcfg_fragment_t *f) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    if (f->nodes[0]) json_object_set_string(o, "nodes", f->nodes);
+    if (f->device[0]) json_object_set_string(o, "device", f->device);
+    if (f->role[0]) json_object_set_string(o, "role", f->role);
+    if (f->label_count) {
+        JSON_Value *lv = json_value_init_object();
+        for (int i = 0; i < f->label_count; i++) {
+            json_object_set_string(json_object(lv), f->labels[i].key, f->labels[i].value);
+        }
+        json_object_set_value(o, "labels", lv);
+    }
+    return v;
+}
+
+/* The fragment as a slave gets it (and the store keeps it, with match). */
+static JSON_Value *fleetcfg_fragment_json(const fleetcfg_fragment_t *f, int with_match) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "name", f->name);
+    json_object_set_string(o, "version", f->version);
+    json_object_set_string(o, "path", f->path);
+    char mode[8];
+    snprintf(mode, sizeof(mode), "%04o", f->mode);
+    json_object_set_string(o, "mode", mode);
+    char *b64 = fleetcfg_base64(f->content, f->len);
+    json_object_set_string(o, "content_base64", b64 ? b64 : "");
+    free(b64);
+    if (f->reload[0]) json_object_set_value(o, "reload", json_parse_string(f->reload));
+    if (with_match) {
+        json_object_set_value(o, "match", fleetcfg_match_json(f));
+        json_object_set_number(o, "updated_unix", (double)f->updated_unix);
+    }
+    return v;
+}
+
+/* Fill f from a PUT body (or a stored entry). Returns NULL or the error. */
+static const char *fleetcfg_fragment_from_json(const config_t *cfg, JSON_Object *o,
+                                               fleetcfg_fragment_t *f) {
+    const char *path = json_object_get_string(o, "path");
+    if (!path || path[0] != '/' || strlen(path) >= sizeof(f->path) || strstr(path, "/../")) {
+        return "invalid_path";
+    }
+    snprintf(f->path, sizeof(f->path), "%s", path);
+
+    f->mode = 0644;
+    JSON_Value *mode_v = json_object_get_value(o, "mode");
+    if (json_value_get_type(mode_v) == JSONString) {
+        char *end = NULL;
+        long m = strtol(json_value_get_string(mode_v), &end, 8);
+        if (!*json_value_get_string(mode_v) || *end || m <= 0 || m > 0777) return "invalid_mode";
+        f->mode = (int)m;
+    } else if (mode_v) {
+        return "invalid_mode";
+    }
+
+    const char *text = json_object_get_string(o, "content");
+    const char *b64 = json_object_get_string(o, "content_base64");
+    if (text) {
+        f->len = strlen(text);
+        f->content = malloc(f->len + 1);
+        if (!f->content) return "out_of_memory";
+        memcpy(f->content, text, f->len + 1);
+    } else if (b64) {
+        if (fleetcfg_unbase64(b64, &f->content, &f->len) != 0) return "invalid_base64";
+    } else {
+        return "missing_content";
+    }
+    if (f->len > (size_t)cfg->fleetcfg.max_kb * 1024) return "fragment_too_large";
+
+    JSON_Value *reload_v = json_object_get_value(o, "reload");
+    if (reload_v) {
+        const char *rpath = json_object_get_string(json_object(reload_v), "path");
+        char *s = rpath && *rpath ? json_serialize_to_string(reload_v) : NULL;
+        if (!s || strlen(s) >= sizeof(f->reload)) {
+            if (s) json_free_serialized_string(s);
+            return "invalid_reload";
+        }
+        snprintf(f->reload, sizeof(f->reload), "%s", s);
+        json_free_serialized_string(s);
+    }
+
+    JSON_Value *match_v = json_object_get_value(o, "match");
+    if (match_v) {
+        JSON_Object *m = json_object(match_v);
+        if (!m) return "invalid_match";
+        const char *nodes = json_object_get_string(m, "nodes");
+        const char *device = json_object_get_string(m, "device");
+        const char *role = json_object_get_string(m, "role");
+        if ((nodes && strlen(nodes) >= sizeof(f->nodes)) ||
+            (device && strlen(device) >= sizeof(f->device)) ||
+            (role && strlen(role) >= sizeof(f->role))) {
+            return "invalid_match";
+        }
+        snprintf(f->nodes, sizeof(f->nodes), "%s", nodes ? nodes : "");
+        snprintf(f->device, sizeof(f->device), "%s", device ? device : "");
+        snprintf(f->role, sizeof(f->role), "%s", role ? role : "");
+        JSON_Value *labels_v = json_object_get_value(m, "labels");
+        JSON_Object *labels = json_object(labels_v);
+        if (labels_v && !labels) return "invalid_match";
+        size_t n = json_object_get_count(labels);
+        if (n > FLEETCFG_MAX_LABELS) return "invalid_match";
+        for (size_t i = 0; i < n; i++) {
+            const char *k = json_object_get_name(labels, i);
+            const char *val = json_string(json_object_get_value_at(labels, i));
+            if (!k || !*k || !val || strlen(k) >= sizeof(f->labels[0].key) ||
+                strlen(val) >= sizeof(f->labels[0].value)) {
+                return "invalid_match";
+            }
+            snprintf(f->labels[i].key, sizeof(f->labels[i].key), "%s", k);
+            snprintf(f->labels[i].value, sizeof(f->labels[i].value), "%s", val);
+        }
+        f->label_count = (int)n;
+    }
+    fleetcfg_version_of(f, f->version, sizeof(f->version));
+    return NULL;
+}
+
+/* Write the fragments to [fleetcfg] store_path; the file is replaced atomically. */
+static void fleetcfg_persist_locked(const config_t *cfg) {
+    if (!cfg->fleetcfg.store_path[0]) return;
+    JSON_Value *v = json_value_init_object();
+    JSON_Value *arr = json_value_init_array();
+    for (int i = 0; i < FLEETCFG_MAX_FRAGMENTS; i++) {
+        if (g_fragments[i].name[0]) json_array_append_value(json_array(arr), fleetcfg_fragment_json(&g_fragments[i], 1));
+    }
+    json_object_set_value(json_object(v), "fragments", arr);
+    char tmp[sizeof(cfg->fleetcfg.store_path) + 8];
+    snprintf(tmp, sizeof(tmp), "%s.tmp", cfg->fleetcfg.store_path);
+    if (json_serialize_to_file(v, tmp) != JSONSuccess || rename(tmp, cfg->fleetcfg.store_path) != 0) {
+        fprintf(stderr, "WARN: cannot write config fragments to %s\n", cfg->fleetcfg.store_path);
+        (void)unlink(tmp);
+    }
+    json_value_free(v);
+}
+
+void fleetcfg_load(const config_t *cfg) {
+    if (!cfg || !cfg->fleetcfg.store_path[0] || access(cfg->fleetcfg.store_path, F_OK) != 0) return;
+    JSON_Value *v = json_parse_file(cfg->fleetcfg.store_path);
+    JSON_Array *arr = json_object_get_array(json_object(v), "fragments");
+    int loaded = 0;
+    pthread_mutex_lock(&g_fleetcfg_lock);
+    for (size_t i = 0; i < json_array_get_count(arr) && loaded < FLEETCFG_MAX_FRAGMENTS; i++) {
+        JSON_Object *o = json_array_get_object(arr, i);
+        const char *name = json_object_get_string(o, "name");
+        fleetcfg_fragment_t f;
+        memset(&f, 0, sizeof(f));
+        if (!fleetcfg_valid_name(name) || fleetcfg_find_locked(name) ||
+            fleetcfg_fragment_from_json(cfg, o, &f) != NULL) {
+            fprintf(stderr, "WARN: ignoring stored config fragment %s\n", name ? name : "?");
+            free(f.content);
+            continue;
+        }
+        snprintf(f.name, sizeof(f.name), "%s", name);
+        f.updated_unix = (long long)json_object_get_number(o, "updated_unix");
+        g_fragments[loaded++] = f;
+    }
+    pthread_mutex_unlock(&g_fleetcfg_lock);
+    if (!v) fprintf(stderr, "WARN: ignoring malformed config fragment store %s\n", cfg->fleetcfg.store_path);
+    else fprintf(stderr, "fleetcfg: loaded %d fragment(s) from %s\n", loaded, cfg->fleetcfg.store_path);
+    if (v) json_value_free(v);
+}
+
+/* ---------- Master: registrations ---------- */
+
+static fleetcfg_node_t *fleetcfg_node_locked(const char *id, int add) {
+    fleetcfg_node_t *free_slot = NULL;
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        if (!strcmp(g_nodes[i].id, id)) return &g_nodes[i];
+        if (!g_nodes[i].id[0] && !free_slot) free_slot = &g_nodes[i];
+    }
+    if (!add || !free_slot) return NULL;
+    memset(free_slot, 0, sizeof(*free_slot));
+    snprintf(free_slot->id, sizeof(free_slot->id), "%s", id);
+    return free_slot;
+}
+
+static const fleetcfg_status_t *fleetcfg_node_status(const fleetcfg_node_t *n, const char *name) {
+    for (int i = 0; n && i < n->count; i++) {
+        if (!strcmp(n->items[i].name, name)) return &n->items[i];
+    }
+    return NULL;
+}
+
+JSON_Value *fleetcfg_master_registration(const config_t *cfg, const char *id, const char *device,
+                                         const char *role, JSON_Object *reg) {
+    (void)cfg;
+    JSON_Object *report = json_object_get_object(reg, "config");
+    if (!id || !report) return NULL;
+    JSON_Value *out = NULL;
+    pthread_mutex_lock(&g_fleetcfg_lock);
+    fleetcfg_node_t *n = fleetcfg_node_locked(id, 1);
+    if (n) {
+        n->count = 0;
+        n->reported_unix = (long long)time(NULL);
+        size_t count = json_object_get_count(report);
+        for (size_t i = 0; i < count && n->count < FLEETCFG_MAX_FRAGMENTS; i++) {
+            const char *name = json_object_get_name(report, i);
+            JSON_Object *st = json_object(json_object_get_value_at(report, i));
+            const char *version = json_object_get_string(st, "version");
+            const char *state = json_object_get_string(st, "state");
+            const char *error = json_object_get_string(st, "error");
+            if (!fleetcfg_valid_name(name) || !version) continue;
+            fleetcfg_status_t *s = &n->items[n->count++];
+            memset(s, 0, sizeof(*s));
+            snprintf(s->name, sizeof(s->name), "%s", name);
+            snprintf(s->version, sizeof(s->version), "%s", version);
+            s->failed = state && !strcmp(state, "failed");
+            snprintf(s->error, sizeof(s->error), "%s", error ? error : "");
+        }
+    }
+    for (int i = 0; i < FLEETCFG_MAX_FRAGMENTS; i++) {
+        const fleetcfg_fragment_t *f = &g_fragments[i];
+        if (!f->name[0] || !fleetcfg_matches(f, id, device, role)) continue;
+        const fleetcfg_status_t *s = fleetcfg_node_status(n, f->name);
+        if (s && !strcmp(s->version, f->version)) continue;
+        if (!out) out = json_value_init_array();
+        json_array_append_value(json_array(out), fleetcfg_fragment_json(f, 0));
+    }
+    pthread_mutex_unlock(&g_fleetcfg_lock);
+    return out;
+}
+
+/* ---------- Slave ---------- */
+
+static fleetcfg_status_t *fleetcfg_applied_locked(const char *name, int add) {
+    fleetcfg_status_t *free_slot = NULL;
+    for (int i = 0; i < FLEETCFG_MAX_FRAGMENTS; i++) {
+        if (g_applied[i].name[0] && !strcmp(g_applied[i].name, name)) return &g_applied[i];
+        if (!g_applied[i].name[0] && !free_slot) free_slot = &g_applied[i];
+    }
+    if (!add || !free_slot) return NULL;
+    memset(free_slot, 0, sizeof(*free_slot));
+    snprintf(free_slot->name, sizeof(free_slot->name), "%s", name);
+    return free_slot;
+}
+
+void fleetcfg_slave_annotate(JSON_Object *reg) {
+    if (!reg) return;
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    pthread_mutex_lock(&g_fleetcfg_lock);
+    for (int i = 0; i < FLEETCFG_MAX_FRAGMENTS; i++) {
+        const fleetcfg_status_t *s = &g_applied[i];
+        if (!s->name[0]) continue;
+        JSON_Value *sv = json_value_init_object();
+        JSON_Object *so = json_object(sv);
+        json_object_set_string(so, "version", s->version);
+        json_object_set_string(so, "state", s->failed ? "failed" : "applied");
+        if (s->error[0]) json_object_set_string(so, "error", s->error);
+        json_object_set_value(o, s->name, sv);
+    }
+    pthread_mutex_unlock(&g_fleetcfg_lock);
+    json_object_set_value(reg, "config", v);
+}
+
+static int fleetcfg_path_allowed(const config_t *cfg, const char *path) {
+    for (int i = 0; i < cfg->fleetcfg.allow_count; i++) {
+        if (fnmatch(cfg->fleetcfg.allow[i], path, FNM_PATHNAME) == 0) return 1;
+    }
+    return 0;
+}
+
+/* Whether path already holds exactly data (and mode). */
+static int fleetcfg_file_same(const char *path, const unsigned char *data, size_t len, int mode) {
+    struct stat st;
+    if (stat(path, &st) != 0 || !S_ISREG(st.st_mode) || (size_t)st.st_size != len ||
+        (int)(st.st_mode & 0777) != mode) {
+        return 0;
+    }
+    FILE *f = fopen(path, "rb");
+    if (!f) return 0;
+    unsigned char buf[4096];
+    size_t off = 0;
+    int same = 1;
+    for (;;) {
+        size_t r = fread(buf, 1, sizeof(buf), f);
+        if (r == 0) break;
+        if (off + r > len || memcmp(buf, data + off, r) != 0) {
+            same = 0;
+            break;
+        }
+        off += r;
+    }
+    fclose(f);
+    return same && off == len;
+}
+
+/* Write data to a temporary file next to path and rename it into place. */
+static int fleetcfg_write_atomic(const char *path, const unsigned char *data, size_t len, int mode) {
+    char tmp[300];
+    snprintf(tmp, sizeof(tmp), "%s.autod-new", path);
+    int fd = open(tmp, O_WRONLY | O_CREAT | O_TRUNC | O_CLOEXEC, mode);
+    if (fd < 0) return -1;
+    size_t off = 0;
+    while (off < len) {
+        ssize_t w = write(fd, data + off, len - off);
+        if (w < 0 && errno == EINTR) continue;
+        if (w <= 0) break;
+        off += (size_t)w;
+    }
+    int ok = off == len && fchmod(fd, (mode_t)mode) == 0 && fsync(fd) == 0;
+    int saved = errno;
+    close(fd);
+    if (!ok || rename(tmp, path) != 0) {
+        if (ok) saved = errno;
+        (void)unlink(tmp);
+        errno = saved;
+        return -1;
+    }
+    return 0;
+}
+
+/* Run a reload payload. Returns its exit code, or -1 with error set. */
+static int fleetcfg_reload(const config_t *cfg, const char *name, JSON_Object *reload,
+                           char *error, size_t error_sz) {
+    const char *path = json_object_get_string(reload, "path");
+    if (!path || !*path) {
+        snprintf(error, error_sz, "invalid_reload");
+        return -1;
+    }
+    if (!catalog_allows(cfg, path)) {
+        fprintf(stderr, "fleetcfg %s: reload %s not allowed by the command catalog\n", name, path);
+        snprintf(error, error_sz, "reload_not_allowed");
+        return -1;
+    }
+    int unknown_profile = 0;
+    const exec_profile_t *profile =
+        profile_select(cfg, path, json_object_get_string(reload, "profile"), &unknown_profile);
+    if (unknown_profile) {
+        snprintf(error, error_sz, "unknown_profile");
+        return -1;
+    }
+    int rc = 0;
+    long long elapsed = 0;
+    char *out = NULL, *err = NULL;
+    sync_results_record(cfg, "fleetcfg", 0, path, "started", 0, 0);
+    caller_set("master", "master");
+    int r = run_exec(cfg, path, json_object_get_array(reload, "args"), cfg->exec_timeout_ms,
+                     cfg->max_output_bytes, profile, NULL, &rc, &elapsed, &out, &err,
+                     NULL, NULL, NULL);
+    caller_set(NULL, NULL);
+    sync_results_record(cfg, "fleetcfg", 0, path, r == 0 ? "finished" : "failed",
+                        r == 0 ? rc : r, elapsed);
+    free(out);
+    free(err);
+    if (r != 0) {
+        snprintf(error, error_sz, "%s", r == EXEC_ERR_NOT_FOUND ? "binary_not_found" :
+                 r == EXEC_ERR_CAPACITY ? "jobs_full" :
+                 r == EXEC_ERR_INTEGRITY ? "integrity_mismatch" : "spawn_failed");
+        return -1;
+    }
+    fprintf(stderr, "fleetcfg %s: reload %s rc=%d elapsed=%lldms\n", name, path, rc, elapsed);
+    return rc;
+}
+
+static void fleetcfg_apply_one(const config_t *cfg, JSON_Object *fo) {
+    const char *name = json_object_get_string(fo, "name");
+    const char *version = json_object_get_string(fo, "version");
+    const char *path = json_object_get_string(fo, "path");
+    const char *mode_s = json_object_get_string(fo, "mode");
+    const char *b64 = json_object_get_string(fo, "content_base64");
+    if (!fleetcfg_valid_name(name) || !version || strlen(version) >= FLEETCFG_VERSION_MAX) return;
+
+    char error[32] = "";
+    int reload_rc = -1;
+    int written = 0;
+    unsigned char *data = NULL;
+    size_t len = 0;
+    int mode = mode_s ? (int)strtol(mode_s, NULL, 8) & 0777 : 0644;
+    if (!path || path[0] != '/' || strlen(path) >= 256 || strstr(path, "/../")) {
+        snprintf(error, sizeof(error), "invalid_path");
+    } else if (!fleetcfg_path_allowed(cfg, path)) {
+        fprintf(stderr, "fleetcfg %s: %s is not in [fleetcfg] allow, not written\n", name, path);
+        snprintf(error, sizeof(error), "path_not_allowed");
+    } else if (!b64 || fleetcfg_unbase64(b64, &data, &len) != 0) {
+        snprintf(error, sizeof(error), "invalid_base64");
+    } else if (len > (size_t)cfg->fleetcfg.max_kb * 1024) {
+        snprintf(error, sizeof(error), "fragment_too_large");
+    } else if (!fleetcfg_file_same(path, data, len, mode)) {
+        if (fleetcfg_write_atomic(path, data, len, mode) != 0) {
+            fprintf(stderr, "fleetcfg %s: cannot write %s: %s\n", name, path, strerror(errno));
+            snprintf(error, sizeof(error), "write_failed");
+        } else {
+            written = 1;
+            fprintf(stderr, "fleetcfg %s: wrote %s (%zu bytes, version %s)\n", name, path, len, version);
+            JSON_Object *reload = json_object_get_object(fo, "reload");
+            if (reload) {
+                reload_rc = fleetcfg_reload(cfg, name, reload, error, sizeof(error));
+                if (reload_rc > 0) snprintf(error, sizeof(error), "reload_failed");
+            }
+        }
+    }
+    free(data);
+
+    pthread_mutex_lock(&g_fleetcfg_lock);
+    fleetcfg_status_t *s = fleetcfg_applied_locked(name, 1);
+    if (s) {
+        snprintf(s->version, sizeof(s->version), "%s", version);
+        snprintf(s->path, sizeof(s->path), "%s", path ? path : "");
+        snprintf(s->error, sizeof(s->error), "%s", error);
+        s->failed = error[0] != '\0';
+        s->reload_rc = reload_rc;
+        s->applied_unix = (long long)time(NULL);
+    }
+    pthread_mutex_unlock(&g_fleetcfg_lock);
+
+    if (error[0]) fprintf(stderr, "fleetcfg %s: version %s failed: %s\n", name, version, error);
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_string(eo, "name", name);
+    json_object_set_string(eo, "version", version);
+    if (path) json_object_set_string(eo, "path", path);
+    json_object_set_boolean(eo, "written", written);
+    if (reload_rc >= 0) json_object_set_number(eo, "reload_rc", reload_rc);
+    if (error[0]) json_object_set_string(eo, "error", error);
+    (void)events_emit(error[0] ? "config_failed" : "config_applied", ev);
+}
+
+void fleetcfg_slave_apply(const config_t *cfg, JSON_Array *fragments) {
+    if (!cfg || !fragments) return;
+    for (size_t i = 0; i < json_array_get_count(fragments); i++) {
+        JSON_Object *fo = json_array_get_object(fragments, i);
+        if (fo) fleetcfg_apply_one(cfg, fo);
+    }
+}
+
+/* ---------- HTTP ---------- */
+
+/* Where each matching registered node stands on f: applied, failed or
+ * pending (not reported at this version yet). */
+static JSON_Value *fleetcfg_rollup_locked(const fleetcfg_fragment_t *f, const sync_node_addr_t *nodes,
+                                          int node_count, int detail) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    JSON_Value *list_v = detail ? json_value_init_array() : NULL;
+    int applied = 0, failed = 0, pending = 0;
+    for (int i = 0; i < node_count; i++) {
+        const sync_node_addr_t *n = &nodes[i];
+        if (!fleetcfg_matches(f, n->id, n->device, n->role)) continue;
+        const fleetcfg_status_t *s = fleetcfg_node_status(fleetcfg_node_locked(n->id, 0), f->name);
+        const char *state = "pending";
+        if (s && !strcmp(s->version, f->version)) state = s->failed ? "failed" : "applied";
+        if (!strcmp(state, "applied")) applied++;
+        else if (!strcmp(state, "failed")) failed++;
+        else pending++;
+        if (list_v) {
+            JSON_Value *nv = json_value_init_object();
+            JSON_Object *no = json_object(nv);
+            json_object_set_string(no, "id", n->id);
+            json_object_set_string(no, "state", state);
+            if (s) json_object_set_string(no, "version", s->version);
+            if (s && s->error[0]) json_object_set_string(no, "error", s->error);
+            json_array_append_value(json_array(list_v), nv);
+        }
+    }
+    json_object_set_number(o, "applied", applied);
+    json_object_set_number(o, "failed", failed);
+    json_object_set_number(o, "pending", pending);
+    if (list_v) json_object_set_value(o, "list", list_v);
+    return v;
+}
+
+static JSON_Value *fleetcfg_summary_locked(const fleetcfg_fragment_t *f, const sync_node_addr_t *nodes,
+                                           int node_count, int detail) {
+    JSON_Value *v = detail ? fleetcfg_fragment_json(f, 1) : json_value_init_object();
+    JSON_Object *o = json_object(v);
+    if (!detail) {
+        json_object_set_string(o, "name", f->name);
+        json_object_set_string(o, "version", f->version);
+        json_object_set_string(o, "path", f->path);
+        json_object_set_number(o, "size", (double)f->len);
+        if (f->reload[0]) json_object_set_value(o, "reload", json_parse_string(f->reload));
+        json_object_set_value(o, "match", fleetcfg_match_json(f));
+        json_object_set_number(o, "updated_unix", (double)f->updated_unix);
+    }
+    json_object_set_value(o, "nodes", fleetcfg_rollup_locked(f, nodes, node_count, detail));
+    return v;
+}
+
+static void fleetcfg_send_slave_status(struct mg_connection *c) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Value *arr = json_value_init_array();
+    pthread_mutex_lock(&g_fleetcfg_lock);
+    for (int i = 0; i < FLEETCFG_MAX_FRAGMENTS; i++) {
+        const fleetcfg_status_t *s = &g_applied[i];
+        if (!s->name[0]) continue;
+        JSON_Value *sv = json_value_init_object();
+        JSON_Object *so = json_object(sv);
+        json_object_set_string(so, "name", s->name);
+        json_object_set_string(so, "version", s->version);
+        json_object_set_string(so, "path", s->path);
+        json_object_set_string(so, "state", s->failed ? "failed" : "applied");
+        if (s->error[0]) json_object_set_string(so, "error", s->error);
+        if (s->reload_rc >= 0) json_object_set_number(so, "reload_rc", s->reload_rc);
+        json_object_set_number(so, "applied_unix", (double)s->applied_unix);
+        json_array_append_value(json_array(arr), sv);
+    }
+    pthread_mutex_unlock(&g_fleetcfg_lock);
+    json_object_set_value(json_object(v), "fragments", arr);
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+}
+
+static void fleetcfg_handle_put(struct mg_connection *c, const config_t *cfg, const char *name) {
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        free(u.body);
+        send_json_error(c, 400, "body_read_failed");
+        return;
+    }
+    JSON_Value *root = json_parse_string(u.body ? u.body : "");
+    free(u.body);
+    if (!json_object(root)) {
+        if (root) json_value_free(root);
+        send_json_error(c, 400, "bad_json");
+        return;
+    }
+    fleetcfg_fragment_t f;
+    memset(&f, 0, sizeof(f));
+    const char *err = fleetcfg_fragment_from_json(cfg, json_object(root), &f);
+    json_value_free(root);
+    if (err) {
+        free(f.content);
+        send_json_error_field(c, !strcmp(err, "fragment_too_large") ? 413 : 400, err, "name", name);
+        return;
+    }
+    snprintf(f.name, sizeof(f.name), "%s", name);
+    f.updated_unix = (long long)time(NULL);
+
+    pthread_mutex_lock(&g_fleetcfg_lock);
+    fleetcfg_fragment_t *slot = fleetcfg_find_locked(name);
+    int created = slot == NULL;
+    for (int i = 0; i < FLEETCFG_MAX_FRAGMENTS && !slot; i++) {
+        if (!g_fragments[i].name[0]) slot = &g_fragments[i];
+    }
+    if (!slot) {
+        pthread_mutex_unlock(&g_fleetcfg_lock);
+        free(f.content);
+        send_json_error_field(c, 409, "too_many_fragments", "name", name);
+        return;
+    }
+    int changed = created || strcmp(slot->version, f.version) != 0;
+    if (!created && !changed) f.updated_unix = slot->updated_unix;
+    free(slot->content);
+    *slot = f;
+    fleetcfg_persist_locked(cfg);
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "name", slot->name);
+    json_object_set_string(o, "version", slot->version);
+    json_object_set_boolean(o, "changed", changed);
+    pthread_mutex_unlock(&g_fleetcfg_lock);
+
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (changed) {
+        fprintf(stderr, "fleetcfg: %s %s by %s, version %s (request %s)\n", name,
+                created ? "created" : "updated", ri ? ri->remote_addr : "?",
+                json_object_get_string(o, "version"), api_request_id());
+        JSON_Value *ev = json_value_init_object();
+        json_object_set_string(json_object(ev), "name", name);
+        json_object_set_string(json_object(ev), "version", json_object_get_string(o, "version"));
+        json_object_set_string(json_object(ev), "remote_ip", ri ? ri->remote_addr : "");
+        (void)events_emit("config_published", ev);
+    }
+    send_json(c, v, created ? 201 : 200, 1);
+    json_value_free(v);
+}
+
+/*
+ * GET    /sync/config        — master: every fragment with a node rollup;
+ *                              slave: what it applied
+ * GET    /sync/config/NAME   — one fragment, its content and each node's state
+ * PUT    /sync/config/NAME   — {path, content | content_base64, mode, reload, match}
+ * DELETE /sync/config/NAME   — stop handing it out (files stay on the nodes)
+ */
+static int h_sync_config(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    const char *m = ri->request_method;
+    const char *uri = api_local_uri(c);
+    const char *name = NULL;
+    if (!strncmp(uri, "/sync/config/", 13)) name = uri + 13;
+    else if (strcmp(uri, "/sync/config") != 0) {
+        free(cfg);
+        return 0;
+    }
+    int master = strcasecmp(cfg->sync_role, "master") == 0;
+
+    if (!name) {
+        if (strcmp(m, "GET") != 0) {
+            send_plain(c, 405, "method_not_allowed", 1);
+            free(cfg);
+            return 1;
+        }
+        if (!master) {
+            fleetcfg_send_slave_status(c);
+            free(cfg);
+            return 1;
+        }
+    } else if (!master) {
+        send_json_error(c, 409, "not_a_master");
+        free(cfg);
+        return 1;
+    } else if (!fleetcfg_valid_name(name)) {
+        send_json_error(c, 400, "invalid_name");
+        free(cfg);
+        return 1;
+    } else if (!strcmp(m, "PUT") || !strcmp(m, "POST")) {
+        fleetcfg_handle_put(c, cfg, name);
+        free(cfg);
+        return 1;
+    } else if (!strcmp(m, "DELETE")) {
+        pthread_mutex_lock(&g_fleetcfg_lock);
+        fleetcfg_fragment_t *f = fleetcfg_find_locked(name);
+        if (f) {
+            free(f->content);
+            memset(f, 0, sizeof(*f));
+            fleetcfg_persist_locked(cfg);
+        }
+        pthread_mutex_unlock(&g_fleetcfg_lock);
+        if (!f) {
+            send_json_error_field(c, 404, "unknown_fragment", "name", name);
+            free(cfg);
+            return 1;
+        }
+        fprintf(stderr, "fleetcfg: %s deleted by %s (request %s)\n", name, ri->remote_addr,
+                api_request_id());
+        JSON_Value *v = json_value_init_object();
+        json_object_set_string(json_object(v), "deleted", name);
+        send_json(c, v, 200, 1);
+        json_value_free(v);
+        free(cfg);
+        return 1;
+    } else if (strcmp(m, "GET") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+
+    sync_node_addr_t *nodes = calloc(SYNC_MAX_SLAVES, sizeof(*nodes));
+    int node_count = nodes ? sync_master_list_nodes(app, cfg, nodes, SYNC_MAX_SLAVES) : 0;
+    JSON_Value *v = NULL;
+    pthread_mutex_lock(&g_fleetcfg_lock);
+    if (name) {
+        const fleetcfg_fragment_t *f = fleetcfg_find_locked(name);
+        if (f) v = fleetcfg_summary_locked(f, nodes, node_count, 1);
+    } else {
+        v = json_value_init_object();
+        JSON_Value *arr = json_value_init_array();
+        for (int i = 0; i < FLEETCFG_MAX_FRAGMENTS; i++) {
+            if (!g_fragments[i].name[0]) continue;
+            json_array_append_value(json_array(arr), fleetcfg_summary_locked(&g_fragments[i], nodes, node_count, 0));
+        }
+        json_object_set_value(json_object(v), "fragments", arr);
+    }
+    pthread_mutex_unlock(&g_fleetcfg_lock);
+    free(nodes);
+    if (!v) {
+        send_json_error_field(c, 404, "unknown_fragment", "name", name);
+        free(cfg);
+        return 1;
+    }
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+    free(cfg);
+    return 1;
+}
+
+void fleetcfg_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    api_set_handler(ctx, "/sync/config", h_sync_config, app);
+}
@@ -0,0 +1,45 @@
+#ifndef AUTOD_FLEETCFG_H
+#define AUTOD_FLEETCFG_H
+
+#include "parson.h"
+
+#define FLEETCFG_MAX_FRAGMENTS 16
+#define FLEETCFG_MAX_ALLOW 8
+#define FLEETCFG_MAX_LABELS 4
+
+/* [fleetcfg] — config files the master hands to its slaves. A fragment is
+ * a whole file (path, content, mode) plus an optional reload command, sent
+ * to the slaves its match selects; each slave writes it atomically, runs the
+ * reload and reports the version it applied in its next registration. */
+typedef struct {
+    char store_path[256];         /* master: fragments across restarts; empty = memory only */
+    char allow[FLEETCFG_MAX_ALLOW][128];   /* slave: path globs fragments may write */
+    int  allow_count;
+    int  max_kb;                  /* largest fragment (64) */
+} fleetcfg_config_t;
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_context;
+
+void fleetcfg_cfg_defaults(config_t *cfg);
+int fleetcfg_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* Master: restore the fragments kept at [fleetcfg] store_path. */
+void fleetcfg_load(const config_t *cfg);
+
+/* Master: note the "config" report in a registration from id and return the
+ * fragments that node still needs (NULL when none). Slaves that send no
+ * report are left alone. */
+JSON_Value *fleetcfg_master_registration(const config_t *cfg, const char *id, const char *device,
+                                         const char *role, JSON_Object *reg);
+
+/* Slave: add the "config" report (what was applied or failed, by fragment)
+ * to a registration body. */
+void fleetcfg_slave_annotate(JSON_Object *reg);
+/* Slave: write and reload the fragments a registration reply carried. */
+void fleetcfg_slave_apply(const config_t *cfg, JSON_Array *fragments);
+
+void fleetcfg_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
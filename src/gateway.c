@@ -0,0 +1,314 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <fnmatch.h>
+#include <arpa/inet.h>
+#include <netinet/in.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "version.h"
+#include "httpc.h"
+#include "caller.h"
+#include "dnscache.h"
+#include "gateway.h"
+
+#define GATEWAY_DEFAULT_TIMEOUT_MS 60000
+
+/* ---------- Config ---------- */
+
+void gateway_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->gateway, 0, sizeof(cfg->gateway));
+    cfg->gateway.timeout_ms = GATEWAY_DEFAULT_TIMEOUT_MS;
+}
+
+static gateway_route_t *gateway_find_or_add(config_t *cfg, const char *id) {
+    for (int i = 0; i < cfg->gateway.route_count; i++) {
+        if (!strcmp(cfg->gateway.routes[i].id, id)) return &cfg->gateway.routes[i];
+    }
+    if (cfg->gateway.route_count >= GATEWAY_MAX_ROUTES) return NULL;
+    gateway_route_t *r = &cfg->gateway.routes[cfg->gateway.route_count++];
+    memset(r, 0, sizeof(*r));
+    snprintf(r->id, sizeof(r->id), "%s", id);
+    return r;
+}
+
+/* "a.b.c.d" or "a.b.c.d/len". Returns 0 or -1. */
+static int gateway_parse_allow(const char *s, uint32_t *net, uint32_t *mask) {
+    char ip[32];
+    int len = 32;
+    const char *slash = strchr(s, '/');
+    size_t n = slash ? (size_t)(slash - s) : strlen(s);
+    if (n == 0 || n >= sizeof(ip)) return -1;
+    memcpy(ip, s, n);
+    ip[n] = '\0';
+    if (slash) {
+        char *end = NULL;
+        long v = strtol(slash + 1, &end, 10);
+        if (end == slash + 1 || *end != '\0' || v < 1 || v > 32) return -1;
+        len = (int)v;
+    }
+    struct in_addr a;
+    if (inet_pton(AF_INET, ip, &a) != 1) return -1;
+    *mask = len == 32 ? 0xffffffffu : (uint32_t)(0xffffffffu << (32 - len));
+    *net = ntohl(a.s_addr) & *mask;
+    return 0;
+}
+
+int gateway_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (!strcmp(section, "gateway")) {
+        if (!strcmp(key, "allow")) {
+            cfg->gateway.allow_count = 0;
+            char tmp[512];
+            snprintf(tmp, sizeof(tmp), "%s", value);
+            char *save = NULL;
+            for (char *tok = strtok_r(tmp, ", ", &save); tok; tok = strtok_r(NULL, ", ", &save)) {
+                if (cfg->gateway.allow_count >= GATEWAY_MAX_ALLOW) {
+                    fprintf(stderr, "WARN: gateway allow capacity reached (%d)\n", GATEWAY_MAX_ALLOW);
+                    break;
+                }
+                int i = cfg->gateway.allow_count;
+                if (gateway_parse_allow(tok, &cfg->gateway.allow_net[i], &cfg->gateway.allow_mask[i]) == 0) {
+                    cfg->gateway.allow_count++;
+                } else {
+                    fprintf(stderr, "WARN: ignoring gateway allow entry '%s'\n", tok);
+                }
+            }
+        } else if (!strcmp(key, "timeout_ms")) {
+            int v = atoi(value);
+            if (v >= 100) cfg->gateway.timeout_ms = v;
+            else fprintf(stderr, "WARN: ignoring gateway timeout_ms %s (minimum 100)\n", value);
+        } else {
+            fprintf(stderr, "WARN: ignoring unknown gateway key '%s'\n", key);
+        }
+        return 1;
+    }
+    if (strncmp(section, "gateway.", 8) != 0 || !section[8]) return 0;
+    gateway_route_t *r = gateway_find_or_add(cfg, section + 8);
+    if (!r) {
+        fprintf(stderr, "WARN: gateway capacity reached (%d)\n", GATEWAY_MAX_ROUTES);
+        return 1;
+    }
+    if (!strcmp(key, "nodes")) {
+        snprintf(r->nodes, sizeof(r->nodes), "%s", value);
+    } else {
+        fprintf(stderr, "WARN: gateway %s: ignoring unknown key '%s'\n", r->id, key);
+    }
+    return 1;
+}
+
+/* ---------- Master side ---------- */
+
+static int gateway_node_matches(const gateway_route_t *r, const char *id) {
+    char tmp[256];
+    snprintf(tmp, sizeof(tmp), "%s", r->nodes);
+    char *save = NULL;
+    for (char *tok = strtok_r(tmp, ", ", &save); tok; tok = strtok_r(NULL, ", ", &save)) {
+        if (fnmatch(tok, id, 0) == 0) return 1;
+    }
+    return 0;
+}
+
+const char *gateway_for(const config_t *cfg, const char *id) {
+    if (!cfg || !id || !*id) return NULL;
+    for (int i = 0; i < cfg->gateway.route_count; i++) {
+        const gateway_route_t *r = &cfg->gateway.routes[i];
+        /* A gateway is always reached directly, even when a glob covers it. */
+        if (!strcmp(r->id, id)) return NULL;
+    }
+    for (int i = 0; i < cfg->gateway.route_count; i++) {
+        const gateway_route_t *r = &cfg->gateway.routes[i];
+        if (gateway_node_matches(r, id)) return r->id;
+    }
+    return NULL;
+}
+
+int gateway_relay_path(const char *id, const char *path, char *out, size_t out_sz) {
+    int n = snprintf(out, out_sz, AUTOD_PEER_PREFIX "/relay/%s%s", id, path);
+    return (n < 0 || (size_t)n >= out_sz) ? -1 : 0;
+}
+
+int gateway_route(const sync_node_addr_t *n, const char *path, int timeout_ms,
+                  http_url_t *url, char *hdr, size_t hdr_sz) {
+    memset(url, 0, sizeof(*url));
+    if (hdr && hdr_sz) hdr[0] = '\0';
+    if (!n->via[0]) {
+        snprintf(url->host, sizeof(url->host), "%s", n->host);
+        url->port = n->port;
+        snprintf(url->path, sizeof(url->path), "%s", path);
+        return 0;
+    }
+    if (!n->via_host[0]) return -1;
+    snprintf(url->host, sizeof(url->host), "%s", n->via_host);
+    url->port = n->via_port;
+    if (gateway_relay_path(n->id, path, url->path, sizeof(url->path)) != 0) return -1;
+    if (hdr && hdr_sz) {
+        snprintf(hdr, hdr_sz, "X-Relay-Target: %s:%d\r\nX-Relay-Timeout-Ms: %d\r\n",
+                 n->host, n->port, timeout_ms);
+    }
+    return 0;
+}
+
+/* ---------- Gateway side ---------- */
+
+static int gateway_allowed(const config_t *cfg, const char *ip) {
+    struct in_addr a;
+    if (inet_pton(AF_INET, ip, &a) != 1) return 0;
+    uint32_t h = ntohl(a.s_addr);
+    for (int i = 0; i < cfg->gateway.allow_count; i++) {
+        if ((h & cfg->gateway.allow_mask[i]) == cfg->gateway.allow_net[i]) return 1;
+    }
+    return 0;
+}
+
+/* Copy header name from the request as a CRLF-terminated line onto buf. */
+static void gateway_pass_header(struct mg_connection *c, const char *name, char *buf, size_t buf_sz) {
+    const char *v = mg_get_header(c, name);
+    if (!v || !*v || strpbrk(v, "\r\n")) return;
+    size_t used = strlen(buf);
+    int n = snprintf(buf + used, buf_sz - used, "%s: %s\r\n", name, v);
+    if (n < 0 || (size_t)n >= buf_sz - used) buf[used] = '\0';
+}
+
+static int h_relay(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    const char *uri = api_local_uri(c);
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+
+    /* /relay/{id}/{exec|health|jobs/cancel} */
+    if (strncmp(uri, "/relay/", 7) != 0) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    const char *id = uri + 7;
+    const char *rest = strchr(id, '/');
+    if (!rest || rest == id || rest - id >= 64) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    char node[64];
+    snprintf(node, sizeof(node), "%.*s", (int)(rest - id), id);
+    const char *want = NULL;
+    const char *op = api_unversioned(rest);
+    if (!strcmp(op, "/exec") || !strcmp(op, "/jobs/cancel")) want = "POST";
+    else if (!strcmp(op, "/health")) want = "GET";
+    if (!want) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    if (strcmp(ri->request_method, want) != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+    if (!cfg->gateway.allow_count) {
+        send_json_error(c, 403, "relay_disabled");
+        free(cfg);
+        return 1;
+    }
+
+    const char *target = mg_get_header(c, "X-Relay-Target");
+    if (!target || !*target) {
+        send_json_error(c, 400, "missing_target");
+        free(cfg);
+        return 1;
+    }
+    char host[128];
+    int port = 0;
+    const char *colon = strrchr(target, ':');
+    if (!colon || colon == target || (size_t)(colon - target) >= sizeof(host) ||
+        (port = atoi(colon + 1)) <= 0 || port > 65535) {
+        send_json_error(c, 400, "invalid_target");
+        free(cfg);
+        return 1;
+    }
+    snprintf(host, sizeof(host), "%.*s", (int)(colon - target), target);
+
+    http_url_t url;
+    memset(&url, 0, sizeof(url));
+    if (dnscache_resolve(host, cfg->sync_dns_ttl_s, url.host, sizeof(url.host)) != 0) {
+        send_json_error_field(c, 502, "resolve_failed", "detail", host);
+        free(cfg);
+        return 1;
+    }
+    if (!gateway_allowed(cfg, url.host)) {
+        fprintf(stderr, "gateway: refused relay for %s to %s (not in allow)\n", node, url.host);
+        send_json_error(c, 403, "target_not_allowed");
+        free(cfg);
+        return 1;
+    }
+    url.port = port;
+    snprintf(url.path, sizeof(url.path), "%s", rest);
+
+    /* The master's deadline, when shorter than ours. */
+    int timeout_ms = cfg->gateway.timeout_ms;
+    const char *tv = mg_get_header(c, "X-Relay-Timeout-Ms");
+    if (tv && atoi(tv) > 0 && atoi(tv) < timeout_ms) timeout_ms = atoi(tv);
+
+    upload_t u = {0};
+    if (!strcmp(want, "POST") && read_body(c, &u) != 0) {
+        free(u.body);
+        send_json_error(c, 400, "body_read_failed");
+        free(cfg);
+        return 1;
+    }
+    /* The master signed the caller for the node, so it passes unchanged. */
+    char hdrs[CALLER_HEADER_MAX + 256] = "";
+    gateway_pass_header(c, "X-Autod-Caller", hdrs, sizeof(hdrs));
+    gateway_pass_header(c, "X-Lease-Id", hdrs, sizeof(hdrs));
+
+    char *resp = NULL;
+    long long t0 = now_ms();
+    int status = httpc_send_json(want, &url, hdrs, u.body, &resp, NULL, timeout_ms);
+    free(u.body);
+    JSON_Value *rv = (status > 0 && resp) ? json_parse_string(resp) : NULL;
+    free(resp);
+    fprintf(stderr, "gateway: %s %s for %s via %s:%d -> %d (%lld ms)\n",
+            want, rest, node, url.host, url.port, status, now_ms() - t0);
+    if (status < 0) {
+        const char *why = httpc_last_error();
+        if (why && (!strcmp(why, "timeout") || !strcmp(why, "connect_timeout"))) {
+            JSON_Value *v = json_value_init_object();
+            JSON_Object *o = json_object(v);
+            json_object_set_string(o, "error", "timeout");
+            json_object_set_string(o, "phase", "relay");
+            json_object_set_number(o, "timeout_ms", timeout_ms);
+            send_json(c, v, 504, 1);
+            json_value_free(v);
+        } else {
+            send_json_error_field(c, 502, "node_unreachable", "detail", why);
+        }
+        free(cfg);
+        return 1;
+    }
+    if (!rv) {
+        send_json_error(c, 502, "bad_reply");
+        free(cfg);
+        return 1;
+    }
+    send_json(c, rv, status, 1);
+    json_value_free(rv);
+    free(cfg);
+    return 1;
+}
+
+/*
+ * /relay/{node}/exec, /relay/{node}/health, /relay/{node}/jobs/cancel -
+ * forwarded to the X-Relay-Target address when [gateway] allow admits it.
+ */
+void gateway_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    api_set_handler(ctx, "/relay/", h_relay, app);
+}
@@ -0,0 +1,58 @@
+#ifndef AUTOD_GATEWAY_H
+#define AUTOD_GATEWAY_H
+
+#include <stddef.h>
+#include <stdint.h>
+
+#include "httpc.h"
+#include "sync.h"
+
+#define GATEWAY_MAX_ROUTES 8
+#define GATEWAY_MAX_ALLOW 16
+#define GATEWAY_HEADER_MAX 192
+
+/* Nodes on a subnet the master cannot route to are reached through a node
+ * that can. On the master, [gateway.ID] names the registered slave ID that
+ * relays for the nodes matching its globs; /exec, /health and /jobs/cancel
+ * for them then go to ID's /relay/{node}/... with the node's own address in
+ * an X-Relay-Target header. On the gateway, [gateway] allow lists the
+ * addresses it is willing to relay to (empty = it relays nothing). */
+typedef struct {
+    char id[64];                  /* the gateway's sync id */
+    char nodes[256];              /* sync id globs reached through it */
+} gateway_route_t;
+
+typedef struct {
+    gateway_route_t routes[GATEWAY_MAX_ROUTES];
+    int  route_count;
+    uint32_t allow_net[GATEWAY_MAX_ALLOW];   /* host order */
+    uint32_t allow_mask[GATEWAY_MAX_ALLOW];
+    int  allow_count;
+    int  timeout_ms;              /* longest relayed request (default 60000) */
+} gateway_config_t;
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_context;
+
+void gateway_cfg_defaults(config_t *cfg);
+int gateway_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* Master: the gateway that relays for node id, or NULL when the master
+ * reaches it directly. */
+const char *gateway_for(const config_t *cfg, const char *id);
+
+/* "/relay/{id}{path}" into out. Returns 0, or -1 when it does not fit. */
+int gateway_relay_path(const char *id, const char *path, char *out, size_t out_sz);
+
+/* Point url at path on node n: n's own address (host left unresolved), or
+ * its gateway's /relay/{id}{path}, with the X-Relay-Target and
+ * X-Relay-Timeout-Ms lines written to hdr (otherwise ""). timeout_ms is how
+ * long the caller waits. Returns 0, or -1 when n's gateway is not
+ * registered. */
+int gateway_route(const sync_node_addr_t *n, const char *path, int timeout_ms,
+                  http_url_t *url, char *hdr, size_t hdr_sz);
+
+void gateway_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
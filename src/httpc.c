@@ -0,0 +1,1013 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <ctype.h>
+#include <errno.h>
+#include <pthread.h>
+#include <unistd.h>
+#include <sys/types.h>
+#include <sys/socket.h>
+#include <sys/time.h>
+#include <time.h>
+#include <netdb.h>
+#include <netinet/in.h>
+#include <netinet/tcp.h>
+#include <arpa/inet.h>
+
+#ifdef AUTOD_ZLIB
+#include <zlib.h>
+#endif
+
+#include "httpc.h"
+#include "version.h"
+
+/* Always sent, so the receiving node can tell which build is calling. */
+#define HTTPC_VERSION_HEADERS "X-Autod-Version: " AUTOD_VERSION "\r\n" \
+                              "X-Autod-Api: " AUTOD_STR(AUTOD_API_VERSION) "\r\n"
+
+static pthread_mutex_t g_identity_lock = PTHREAD_MUTEX_INITIALIZER;
+static char g_identity[HTTPC_IDENTITY_MAX] =
+    "User-Agent: autod/" AUTOD_VERSION "\r\n" HTTPC_VERSION_HEADERS;
+
+void httpc_set_identity(const char *user_agent, const char headers[][256], int count) {
+    char block[HTTPC_IDENTITY_MAX];
+    size_t len = (size_t)snprintf(block, sizeof(block), "User-Agent: %s\r\n%s",
+                                  user_agent && *user_agent ? user_agent : "autod/" AUTOD_VERSION,
+                                  HTTPC_VERSION_HEADERS);
+    for (int i = 0; i < count && i < HTTPC_MAX_HEADERS && len < sizeof(block); i++) {
+        len += (size_t)snprintf(block + len, sizeof(block) - len, "%s\r\n", headers[i]);
+    }
+    if (len >= sizeof(block)) return;
+    pthread_mutex_lock(&g_identity_lock);
+    memcpy(g_identity, block, len + 1);
+    pthread_mutex_unlock(&g_identity_lock);
+}
+
+static _Thread_local char g_request_id[80];
+
+void httpc_set_request_id(const char *id) {
+    snprintf(g_request_id, sizeof(g_request_id), "%s", id ? id : "");
+}
+
+static _Thread_local int g_connect_timeout_ms;
+static _Thread_local const char *g_last_error;
+
+void httpc_set_connect_timeout(int timeout_ms) {
+    g_connect_timeout_ms = timeout_ms > 0 ? timeout_ms : 0;
+}
+
+const char *httpc_last_error(void) {
+    return g_last_error;
+}
+
+int httpc_timed_out(int err) {
+    return err == EAGAIN || err == EWOULDBLOCK || err == EINPROGRESS || err == ETIMEDOUT;
+}
+
+int httpc_identity(char *buf, size_t buf_sz) {
+    if (!buf || buf_sz == 0) return -1;
+    pthread_mutex_lock(&g_identity_lock);
+    size_t len = strlen(g_identity);
+    int rc = -1;
+    if (len < buf_sz) {
+        memcpy(buf, g_identity, len + 1);
+        rc = (int)len;
+    }
+    pthread_mutex_unlock(&g_identity_lock);
+    if (rc >= 0 && g_request_id[0]) {
+        int n = snprintf(buf + len, buf_sz - len, "X-Request-ID: %s\r\n", g_request_id);
+        if (n > 0 && (size_t)n < buf_sz - len) rc += n;
+        else buf[len] = '\0';
+    }
+    return rc;
+}
+
+/* Headers httpc and the relay write themselves. */
+static const char *const httpc_reserved_headers[] = {
+    "Host", "Content-Length", "Content-Type", "Content-Encoding", "Transfer-Encoding",
+    "Connection", "User-Agent", "X-Autod-Version", "X-Autod-Api", "X-Request-ID",
+};
+
+const char *httpc_check_header(const char *line, char *out, size_t out_sz) {
+    if (!line || !out || out_sz == 0) return "malformed";
+    const char *colon = strchr(line, ':');
+    if (!colon) return "malformed";
+    const char *name_end = colon;
+    while (name_end > line && isspace((unsigned char)name_end[-1])) name_end--;
+    size_t name_len = (size_t)(name_end - line);
+    if (name_len == 0) return "malformed";
+    for (size_t i = 0; i < name_len; i++) {
+        unsigned char ch = (unsigned char)line[i];
+        if (!isalnum(ch) && ch != '-' && ch != '_') return "malformed";
+    }
+    const char *value = colon + 1;
+    while (isspace((unsigned char)*value)) value++;
+    size_t value_len = strlen(value);
+    while (value_len > 0 && isspace((unsigned char)value[value_len - 1])) value_len--;
+    if (value_len == 0) return "malformed";
+    for (size_t i = 0; i < value_len; i++) {
+        if (value[i] == '\r' || value[i] == '\n') return "malformed";
+    }
+    for (size_t i = 0; i < sizeof(httpc_reserved_headers) / sizeof(httpc_reserved_headers[0]); i++) {
+        if (strlen(httpc_reserved_headers[i]) == name_len &&
+            strncasecmp(httpc_reserved_headers[i], line, name_len) == 0) {
+            return "reserved";
+        }
+    }
+    if (name_len + 2 + value_len >= out_sz) return "malformed";
+    snprintf(out, out_sz, "%.*s: %.*s", (int)name_len, line, (int)value_len, value);
+    return NULL;
+}
+
+int httpc_parse_url(const char *url, http_url_t *out, const char *default_path) {
+    if (!url || !out) return -1;
+    if (!default_path || !*default_path) default_path = "/";
+    memset(out, 0, sizeof(*out));
+    const char *p = NULL;
+    if (strncmp(url, "http://", 7) == 0) {
+        p = url + 7;
+    } else {
+        return -1;
+    }
+
+    const char *slash = strchr(p, '/');
+    size_t host_len = slash ? (size_t)(slash - p) : strlen(p);
+    if (host_len == 0 || host_len >= sizeof(out->host)) return -1;
+
+    const char *colon = memchr(p, ':', host_len);
+    if (colon) {
+        size_t name_len = (size_t)(colon - p);
+        if (name_len == 0 || name_len >= sizeof(out->host)) return -1;
+        memcpy(out->host, p, name_len);
+        out->host[name_len] = '\0';
+        const char *port_str = colon + 1;
+        size_t port_len = host_len - name_len - 1;
+        if (port_len == 0 || port_len >= 16) return -1;
+        char tmp[16];
+        memcpy(tmp, port_str, port_len);
+        tmp[port_len] = '\0';
+        out->port = atoi(tmp);
+        if (out->port <= 0 || out->port > 65535) return -1;
+    } else {
+        memcpy(out->host, p, host_len);
+        out->host[host_len] = '\0';
+        out->port = 80;
+    }
+
+    if (slash && *(slash) != '\0') {
+        strncpy(out->path, slash, sizeof(out->path) - 1);
+        out->path[sizeof(out->path) - 1] = '\0';
+    } else {
+        strncpy(out->path, default_path, sizeof(out->path) - 1);
+        out->path[sizeof(out->path) - 1] = '\0';
+    }
+
+    if (!out->path[0]) {
+        strncpy(out->path, default_path, sizeof(out->path) - 1);
+        out->path[sizeof(out->path) - 1] = '\0';
+    }
+    return 0;
+}
+
+static void httpc_apply_timeouts(int fd, int timeout_ms) {
+    if (timeout_ms <= 0) return;
+    struct timeval tv;
+    tv.tv_sec = timeout_ms / 1000;
+    tv.tv_usec = (timeout_ms % 1000) * 1000;
+    setsockopt(fd, SOL_SOCKET, SO_RCVTIMEO, &tv, sizeof(tv));
+    setsockopt(fd, SOL_SOCKET, SO_SNDTIMEO, &tv, sizeof(tv));
+}
+
+int httpc_connect(const char *host, int port, int timeout_ms) {
+    if (!host || !*host || port <= 0 || port > 65535) return -1;
+    char portbuf[16];
+    snprintf(portbuf, sizeof(portbuf), "%d", port);
+
+    struct addrinfo hints; memset(&hints, 0, sizeof(hints));
+    hints.ai_family = AF_UNSPEC;
+    hints.ai_socktype = SOCK_STREAM;
+    hints.ai_protocol = IPPROTO_TCP;
+
+    struct addrinfo *res = NULL;
+    int gai = getaddrinfo(host, portbuf, &hints, &res);
+    if (gai != 0) return -1;
+
+    int fd = -1;
+    for (struct addrinfo *ai = res; ai; ai = ai->ai_next) {
+        fd = socket(ai->ai_family, ai->ai_socktype, ai->ai_protocol);
+        if (fd < 0) continue;
+        httpc_apply_timeouts(fd, timeout_ms);
+        /* Headers and body go out in separate writes; on a reused connection
+         * Nagle would hold the second one back for the peer's delayed ACK. */
+        int one = 1;
+        setsockopt(fd, IPPROTO_TCP, TCP_NODELAY, &one, sizeof(one));
+        if (connect(fd, ai->ai_addr, ai->ai_addrlen) == 0) {
+            break;
+        }
+        int saved_errno = errno;
+        close(fd);
+        fd = -1;
+        errno = saved_errno;
+    }
+    freeaddrinfo(res);
+    return fd;
+}
+
+/* ---------- Outbound proxy ---------- */
+
+#define HTTPC_PROXY_DEFAULT_PORT 1080   /* as curl */
+
+/* Where one request connects to when it goes through a proxy. */
+typedef struct {
+    char host[128];            /* "" = direct */
+    int port;
+    char auth[256];            /* Proxy-Authorization header line, or "" */
+    int tunnel;
+} httpc_via_t;
+
+static pthread_mutex_t g_proxy_lock = PTHREAD_MUTEX_INITIALIZER;
+static httpc_proxy_t g_proxy;
+static int g_proxy_env_tunnel;    /* url came from $https_proxy */
+
+static void httpc_base64(const unsigned char *in, size_t len, char *out, size_t out_sz) {
+    static const char tbl[] = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+    size_t o = 0;
+    for (size_t i = 0; i < len && o + 5 < out_sz; i += 3) {
+        unsigned v = (unsigned)in[i] << 16;
+        if (i + 1 < len) v |= (unsigned)in[i + 1] << 8;
+        if (i + 2 < len) v |= in[i + 2];
+        out[o++] = tbl[(v >> 18) & 63];
+        out[o++] = tbl[(v >> 12) & 63];
+        out[o++] = i + 1 < len ? tbl[(v >> 6) & 63] : '=';
+        out[o++] = i + 2 < len ? tbl[v & 63] : '=';
+    }
+    out[o] = '\0';
+}
+
+/* "http://[user:pass@]host[:port][/]" or the same without a scheme. */
+static int httpc_parse_proxy(const char *url, httpc_via_t *out) {
+    memset(out, 0, sizeof(*out));
+    const char *p = url;
+    if (!strncasecmp(p, "http://", 7)) p += 7;
+    else if (strstr(p, "://")) return -1;
+    size_t len = strcspn(p, "/");
+    const char *at = NULL;
+    for (const char *q = p; q < p + len; q++) {
+        if (*q == '@') at = q;
+    }
+    if (at) {
+        char user[128];
+        size_t ulen = (size_t)(at - p);
+        if (ulen == 0 || ulen >= sizeof(user)) return -1;
+        memcpy(user, p, ulen);
+        user[ulen] = '\0';
+        char b64[176];
+        httpc_base64((const unsigned char *)user, ulen, b64, sizeof(b64));
+        snprintf(out->auth, sizeof(out->auth), "Proxy-Authorization: Basic %s\r\n", b64);
+        len -= ulen + 1;
+        p = at + 1;
+    }
+    const char *colon = memchr(p, ':', len);
+    size_t host_len = colon ? (size_t)(colon - p) : len;
+    if (host_len == 0 || host_len >= sizeof(out->host)) return -1;
+    memcpy(out->host, p, host_len);
+    out->host[host_len] = '\0';
+    out->port = HTTPC_PROXY_DEFAULT_PORT;
+    if (colon) {
+        char *end = NULL;
+        long port = strtol(colon + 1, &end, 10);
+        if (end != p + len || port <= 0 || port > 65535) return -1;
+        out->port = (int)port;
+    }
+    return 0;
+}
+
+const char *httpc_check_proxy(const char *url) {
+    httpc_via_t via;
+    if (!url || !*url) return "empty";
+    if (strstr(url, "://") && strncasecmp(url, "http://", 7) != 0) return "only http:// proxies";
+    return httpc_parse_proxy(url, &via) == 0 ? NULL : "malformed";
+}
+
+/* Whether host:port matches one no_proxy entry: "*", a name (also matching
+ * its subdomains; a leading "." or "*." is dropped), or an IPv4 address or
+ * CIDR (numeric hosts only), each optionally with ":port". */
+static int httpc_proxy_match(const char *entry, size_t len, const char *host, int port) {
+    char e[128];
+    while (len && (*entry == ' ' || *entry == '\t')) entry++, len--;
+    while (len && (entry[len - 1] == ' ' || entry[len - 1] == '\t')) len--;
+    if (len == 0 || len >= sizeof(e)) return 0;
+    memcpy(e, entry, len);
+    e[len] = '\0';
+    if (!strcmp(e, "*")) return 1;
+    char *colon = strchr(e, ':');
+    if (colon && !strchr(colon + 1, ':')) {
+        *colon = '\0';
+        if (atoi(colon + 1) != port) return 0;
+    }
+    struct in_addr ha, ea;
+    char *slash = strchr(e, '/');
+    if (slash) *slash = '\0';
+    if (inet_pton(AF_INET, e, &ea) == 1) {
+        if (inet_pton(AF_INET, host, &ha) != 1) return 0;
+        int bits = slash ? atoi(slash + 1) : 32;
+        if (bits < 0 || bits > 32) return 0;
+        uint32_t mask = bits ? 0xffffffffu << (32 - bits) : 0;
+        return (ntohl(ha.s_addr) & mask) == (ntohl(ea.s_addr) & mask);
+    }
+    const char *name = e;
+    if (!strncmp(name, "*.", 2)) name += 2;
+    else if (name[0] == '.') name++;
+    size_t nlen = strlen(name), hlen = strlen(host);
+    if (!nlen || hlen < nlen) return 0;
+    if (strcasecmp(host + hlen - nlen, name) != 0) return 0;
+    return hlen == nlen || host[hlen - nlen - 1] == '.';
+}
+
+static int httpc_proxy_list_match(const char *list, const char *host, int port) {
+    for (const char *p = list; p && *p;) {
+        size_t len = strcspn(p, ", ");
+        if (len && httpc_proxy_match(p, len, host, port)) return 1;
+        p += len;
+        while (*p == ',' || *p == ' ') p++;
+    }
+    return 0;
+}
+
+static const char *httpc_env(const char *lower, const char *upper) {
+    const char *v = getenv(lower);
+    if (!v || !*v) v = getenv(upper);
+    return v && *v ? v : NULL;
+}
+
+int httpc_set_proxy(const httpc_proxy_t *p, char *desc, size_t desc_sz) {
+    httpc_proxy_t cfg = *p;
+    int env_tunnel = 0;
+    const char *from = cfg.url[0] ? "[http] proxy" : NULL;
+    if (cfg.use_env && !cfg.url[0]) {
+        const char *v = httpc_env("http_proxy", "HTTP_PROXY");
+        from = v ? "HTTP_PROXY" : NULL;
+        if (!v && (v = httpc_env("https_proxy", "HTTPS_PROXY")) != NULL) {
+            from = "HTTPS_PROXY";
+            env_tunnel = 1;
+        }
+        if (v && httpc_check_proxy(v) != NULL) {
+            fprintf(stderr, "WARN: http: ignoring %s '%s' (%s)\n", from, v, httpc_check_proxy(v));
+            v = NULL;
+            from = NULL;
+            env_tunnel = 0;
+        }
+        if (v) snprintf(cfg.url, sizeof(cfg.url), "%s", v);
+    }
+    if (cfg.use_env && !cfg.no_proxy[0]) {
+        const char *v = httpc_env("no_proxy", "NO_PROXY");
+        if (v) snprintf(cfg.no_proxy, sizeof(cfg.no_proxy), "%s", v);
+    }
+    pthread_mutex_lock(&g_proxy_lock);
+    g_proxy = cfg;
+    g_proxy_env_tunnel = env_tunnel;
+    pthread_mutex_unlock(&g_proxy_lock);
+    if (desc && desc_sz) {
+        desc[0] = '\0';
+        httpc_via_t via;
+        if (from && httpc_parse_proxy(cfg.url, &via) == 0) {
+            snprintf(desc, desc_sz, "%s:%d (%s%s)%s%s", via.host, via.port, from,
+                     cfg.tunnel || env_tunnel ? ", CONNECT" : "",
+                     cfg.no_proxy[0] ? " except " : "", cfg.no_proxy);
+        } else if (cfg.route_count) {
+            snprintf(desc, desc_sz, "per proxy_route only");
+        }
+    }
+    return from || cfg.route_count;
+}
+
+/* The proxy, if any, a request to host:port goes through: the first
+ * proxy_route that matches, else direct when no_proxy matches, else url. */
+static void httpc_route(const char *host, int port, httpc_via_t *out) {
+    char proxy[256] = "";
+    int tunnel = 0;
+    pthread_mutex_lock(&g_proxy_lock);
+    int matched = 0;
+    for (int i = 0; i < g_proxy.route_count && !matched; i++) {
+        const char *pat = g_proxy.routes[i].pattern;
+        if (httpc_proxy_match(pat, strlen(pat), host, port)) {
+            snprintf(proxy, sizeof(proxy), "%s", g_proxy.routes[i].proxy);
+            tunnel = g_proxy.tunnel;
+            matched = 1;
+        }
+    }
+    if (!matched && !httpc_proxy_list_match(g_proxy.no_proxy, host, port)) {
+        snprintf(proxy, sizeof(proxy), "%s", g_proxy.url);
+        tunnel = g_proxy.tunnel || g_proxy_env_tunnel;
+    }
+    pthread_mutex_unlock(&g_proxy_lock);
+    if (!proxy[0] || !strcasecmp(proxy, "direct") || httpc_parse_proxy(proxy, out) != 0) {
+        memset(out, 0, sizeof(*out));
+        return;
+    }
+    out->tunnel = tunnel;
+}
+
+void httpc_describe_route(const char *host, int port, char *out, size_t out_sz) {
+    httpc_via_t via;
+    httpc_route(host, port, &via);
+    if (!via.host[0]) snprintf(out, out_sz, "direct");
+    else snprintf(out, out_sz, "%s:%d%s", via.host, via.port, via.tunnel ? " (CONNECT)" : "");
+}
+
+/* Ask the proxy on fd for a tunnel to host:port. Returns 0 once it answered
+ * 2xx; -1 otherwise, with g_last_error set. */
+static int httpc_open_tunnel(int fd, const char *host, int port, const char *auth) {
+    char req[512];
+    int n = snprintf(req, sizeof(req), "CONNECT %s:%d HTTP/1.1\r\nHost: %s:%d\r\n%s\r\n",
+                     host, port, host, port, auth);
+    if (n <= 0 || n >= (int)sizeof(req) || httpc_send_all(fd, req, (size_t)n) != 0) {
+        g_last_error = "connect_failed";
+        return -1;
+    }
+    char *resp = NULL;
+    int status = 0;
+    if (httpc_read_response(fd, 1, 8192, &resp, NULL, NULL, NULL) != 0) {
+        g_last_error = httpc_timed_out(errno) ? "connect_timeout" : "connect_failed";
+        return -1;
+    }
+    sscanf(resp, "HTTP/%*s %d", &status);
+    free(resp);
+    if (status < 200 || status > 299) {
+        g_last_error = "proxy_refused";
+        errno = ECONNREFUSED;
+        return -1;
+    }
+    return 0;
+}
+
+/* Idle keep-alive connections, keyed by the host string and port callers
+ * connected with. */
+#define HTTPC_POOL_SLOTS 32
+
+typedef struct {
+    int in_use;
+    char host[128];
+    int port;
+    int fd;
+    long long idle_since_ms;
+} httpc_pooled_t;
+
+static pthread_mutex_t g_pool_lock = PTHREAD_MUTEX_INITIALIZER;
+static httpc_pooled_t g_pool[HTTPC_POOL_SLOTS];
+static int g_pool_per_host = HTTPC_DEFAULT_CONNS_PER_HOST;
+static int g_pool_idle_ms = HTTPC_DEFAULT_IDLE_TIMEOUT_MS;
+static unsigned long g_pool_reused;
+
+static long long httpc_now_ms(void) {
+    struct timespec ts;
+    clock_gettime(CLOCK_MONOTONIC, &ts);
+    return (long long)ts.tv_sec * 1000LL + ts.tv_nsec / 1000000LL;
+}
+
+/* Close pooled connections idle for too long (all of them when the pool is
+ * off). Caller holds g_pool_lock. */
+static void httpc_pool_expire_locked(long long now) {
+    for (int i = 0; i < HTTPC_POOL_SLOTS; i++) {
+        httpc_pooled_t *e = &g_pool[i];
+        if (!e->in_use) continue;
+        if (g_pool_per_host > 0 && now - e->idle_since_ms < g_pool_idle_ms) continue;
+        close(e->fd);
+        e->in_use = 0;
+    }
+}
+
+void httpc_set_pool(int max_per_host, int idle_timeout_ms) {
+    pthread_mutex_lock(&g_pool_lock);
+    g_pool_per_host = max_per_host > 0 ? max_per_host : 0;
+    g_pool_idle_ms = idle_timeout_ms > 0 ? idle_timeout_ms : HTTPC_DEFAULT_IDLE_TIMEOUT_MS;
+    httpc_pool_expire_locked(httpc_now_ms());
+    pthread_mutex_unlock(&g_pool_lock);
+}
+
+int httpc_keepalive(void) {
+    pthread_mutex_lock(&g_pool_lock);
+    int on = g_pool_per_host > 0;
+    pthread_mutex_unlock(&g_pool_lock);
+    return on;
+}
+
+int httpc_pool_take(const char *host, int port, int timeout_ms) {
+    if (!host || !*host) return -1;
+    for (;;) {
+        int fd = -1;
+        pthread_mutex_lock(&g_pool_lock);
+        long long now = httpc_now_ms();
+        httpc_pool_expire_locked(now);
+        httpc_pooled_t *best = NULL;
+        for (int i = 0; i < HTTPC_POOL_SLOTS; i++) {
+            httpc_pooled_t *e = &g_pool[i];
+            if (!e->in_use || e->port != port || strcmp(e->host, host) != 0) continue;
+            if (!best || e->idle_since_ms > best->idle_since_ms) best = e;
+        }
+        if (best) {
+            fd = best->fd;
+            best->in_use = 0;
+        }
+        pthread_mutex_unlock(&g_pool_lock);
+        if (fd < 0) return -1;
+
+        /* A peer that timed the connection out has sent its FIN by now. */
+        char probe;
+        ssize_t r = recv(fd, &probe, 1, MSG_PEEK | MSG_DONTWAIT);
+        if (r < 0 && (errno == EAGAIN || errno == EWOULDBLOCK)) {
+            httpc_apply_timeouts(fd, timeout_ms);
+            pthread_mutex_lock(&g_pool_lock);
+            g_pool_reused++;
+            pthread_mutex_unlock(&g_pool_lock);
+            return fd;
+        }
+        close(fd);
+    }
+}
+
+void httpc_pool_put(const char *host, int port, int fd) {
+    if (fd < 0) return;
+    if (!host || !*host || strlen(host) >= sizeof(g_pool[0].host)) {
+        close(fd);
+        return;
+    }
+    pthread_mutex_lock(&g_pool_lock);
+    long long now = httpc_now_ms();
+    httpc_pool_expire_locked(now);
+    int same = 0;
+    httpc_pooled_t *slot = NULL;
+    for (int i = 0; i < HTTPC_POOL_SLOTS; i++) {
+        httpc_pooled_t *e = &g_pool[i];
+        if (!e->in_use) {
+            if (!slot) slot = e;
+        } else if (e->port == port && strcmp(e->host, host) == 0) {
+            same++;
+        }
+    }
+    if (slot && same < g_pool_per_host) {
+        slot->in_use = 1;
+        strcpy(slot->host, host);
+        slot->port = port;
+        slot->fd = fd;
+        slot->idle_since_ms = now;
+        fd = -1;
+    }
+    pthread_mutex_unlock(&g_pool_lock);
+    if (fd >= 0) close(fd);
+}
+
+void httpc_pool_stats(unsigned long *reused, int *idle) {
+    pthread_mutex_lock(&g_pool_lock);
+    httpc_pool_expire_locked(httpc_now_ms());
+    int n = 0;
+    for (int i = 0; i < HTTPC_POOL_SLOTS; i++) n += g_pool[i].in_use;
+    if (reused) *reused = g_pool_reused;
+    if (idle) *idle = n;
+    pthread_mutex_unlock(&g_pool_lock);
+}
+
+int httpc_send_all(int fd, const void *buf, size_t len) {
+    const char *p = (const char *)buf;
+    while (len > 0) {
+        ssize_t w = send(fd, p, len, MSG_NOSIGNAL);
+        if (w < 0 && errno == EINTR) continue;
+        if (w <= 0) {
+            if (w == 0) errno = EPIPE;
+            return -1;
+        }
+        p += w;
+        len -= (size_t)w;
+    }
+    return 0;
+}
+
+typedef struct {
+    int fd;
+    char *buf;
+    size_t len;
+    size_t cap;
+    size_t max;
+} httpc_reader_t;
+
+/* Read more bytes into r->buf. Returns the count, 0 at EOF or -1. */
+static ssize_t httpc_fill(httpc_reader_t *r) {
+    if (r->max && r->len >= r->max) {
+        errno = EMSGSIZE;
+        return -1;
+    }
+    if (r->len + 1024 + 1 > r->cap) {
+        size_t ncap = r->cap ? r->cap * 2 : 4096;
+        while (r->len + 1024 + 1 > ncap) ncap *= 2;
+        char *nb = (char *)realloc(r->buf, ncap);
+        if (!nb) {
+            errno = ENOMEM;
+            return -1;
+        }
+        r->buf = nb;
+        r->cap = ncap;
+    }
+    size_t room = r->cap - r->len - 1;
+    if (r->max && room > r->max - r->len) room = r->max - r->len;
+    for (;;) {
+        ssize_t n = recv(r->fd, r->buf + r->len, room, 0);
+        if (n < 0 && errno == EINTR) continue;
+        if (n > 0) {
+            r->len += (size_t)n;
+            r->buf[r->len] = '\0';
+        }
+        return n;
+    }
+}
+
+/* Make sure at least want bytes are buffered. */
+static int httpc_need(httpc_reader_t *r, size_t want) {
+    while (r->len < want) {
+        ssize_t n = httpc_fill(r);
+        if (n == 0) errno = ECONNRESET;
+        if (n <= 0) return -1;
+    }
+    return 0;
+}
+
+static const char *httpc_find_line_end(const char *p, const char *end) {
+    for (; p + 1 < end; p++) {
+        if (p[0] == '\r' && p[1] == '\n') return p;
+    }
+    return NULL;
+}
+
+/* Decode a chunked body that starts at r->buf + off in place. Returns the
+ * decoded length or -1; *end is where the message ended in the buffer. */
+static ssize_t httpc_dechunk(httpc_reader_t *r, size_t off, size_t *end) {
+    size_t out = off;
+    size_t pos = off;
+    for (;;) {
+        const char *eol;
+        while (!(eol = httpc_find_line_end(r->buf + pos, r->buf + r->len))) {
+            if (httpc_need(r, r->len + 1) != 0) return -1;
+        }
+        char *end = NULL;
+        unsigned long size = strtoul(r->buf + pos, &end, 16);
+        if (end == r->buf + pos) {
+            errno = EPROTO;
+            return -1;
+        }
+        pos = (size_t)(eol - r->buf) + 2;
+        if (size == 0) break;
+        if (r->max && size > r->max) {
+            errno = EMSGSIZE;
+            return -1;
+        }
+        if (httpc_need(r, pos + size + 2) != 0) return -1;
+        memmove(r->buf + out, r->buf + pos, size);
+        out += size;
+        pos += size + 2;
+    }
+    /* Trailer lines, up to the blank line that ends the message. */
+    for (;;) {
+        const char *eol;
+        while (!(eol = httpc_find_line_end(r->buf + pos, r->buf + r->len))) {
+            if (httpc_need(r, r->len + 1) != 0) return -1;
+        }
+        size_t line_len = (size_t)(eol - (r->buf + pos));
+        pos += line_len + 2;
+        if (line_len == 0) break;
+    }
+    *end = pos;
+    return (ssize_t)(out - off);
+}
+
+int httpc_read_response(int fd, int no_body, size_t max,
+                        char **out, size_t *out_len, size_t *body_off, int *reusable) {
+    if (out) *out = NULL;
+    if (out_len) *out_len = 0;
+    if (body_off) *body_off = 0;
+    if (reusable) *reusable = 0;
+    httpc_reader_t r = { fd, NULL, 0, 0, max };
+
+    const char *hdr_end = NULL;
+    size_t off = 0;
+    while (!hdr_end) {
+        ssize_t n = httpc_fill(&r);
+        if (n <= 0) {
+            int closed = r.len == 0 && (n == 0 || errno == ECONNRESET || errno == EPIPE);
+            if (n == 0 && r.len > 0) {
+                /* No blank line: everything received is header. */
+                off = r.len;
+                break;
+            }
+            free(r.buf);
+            if (n == 0) errno = ECONNRESET;
+            return closed ? HTTPC_CLOSED : -1;
+        }
+        if ((hdr_end = strstr(r.buf, "\r\n\r\n")) != NULL) {
+            off = (size_t)(hdr_end - r.buf) + 4;
+        } else if ((hdr_end = strstr(r.buf, "\n\n")) != NULL) {
+            off = (size_t)(hdr_end - r.buf) + 2;
+        }
+    }
+
+    int minor = 0, status = 0;
+    if (sscanf(r.buf, "HTTP/1.%d %d", &minor, &status) != 2) {
+        minor = 0;
+        status = 0;
+    }
+    int keep = minor >= 1;
+    int chunked = 0;
+    long long content_length = -1;
+    for (const char *line = strchr(r.buf, '\n'); line && (size_t)(line - r.buf) < off; line = strchr(line, '\n')) {
+        line++;
+        if (!strncasecmp(line, "Content-Length:", 15)) {
+            content_length = strtoll(line + 15, NULL, 10);
+        } else if (!strncasecmp(line, "Transfer-Encoding:", 18)) {
+            const char *v = line + 18;
+            while (*v == ' ' || *v == '\t') v++;
+            chunked = !strncasecmp(v, "chunked", 7);
+        } else if (!strncasecmp(line, "Connection:", 11)) {
+            const char *v = line + 11;
+            while (*v == ' ' || *v == '\t') v++;
+            if (!strncasecmp(v, "close", 5)) keep = 0;
+            else if (!strncasecmp(v, "keep-alive", 10)) keep = 1;
+        }
+    }
+
+    size_t body_len;
+    if (no_body || (status >= 100 && status < 200) || status == 204 || status == 304) {
+        body_len = 0;
+        keep = keep && r.len == off;
+    } else if (chunked) {
+        size_t end = 0;
+        ssize_t n = httpc_dechunk(&r, off, &end);
+        if (n < 0) {
+            free(r.buf);
+            return -1;
+        }
+        body_len = (size_t)n;
+        keep = keep && end == r.len;
+    } else if (content_length >= 0) {
+        if ((r.max && (unsigned long long)content_length > r.max) ||
+            httpc_need(&r, off + (size_t)content_length) != 0) {
+            if (r.max && (unsigned long long)content_length > r.max) errno = EMSGSIZE;
+            free(r.buf);
+            return -1;
+        }
+        body_len = (size_t)content_length;
+        keep = keep && r.len == off + body_len;
+    } else {
+        /* Unframed: the body runs to the end of the connection. */
+        for (;;) {
+            ssize_t n = httpc_fill(&r);
+            if (n == 0) break;
+            if (n < 0) {
+                free(r.buf);
+                return -1;
+            }
+        }
+        body_len = r.len - off;
+        keep = 0;
+    }
+
+    if (!r.buf) return -1;
+    r.buf[off + body_len] = '\0';
+    if (out) *out = r.buf;
+    else free(r.buf);
+    if (out_len) *out_len = off + body_len;
+    if (body_off) *body_off = off;
+    if (reusable) *reusable = keep;
+    return 0;
+}
+
+static int httpc_request(const char *method, const http_url_t *url,
+                         const char *extra_headers,
+                         const char *body, size_t body_len,
+                         char **resp_body, size_t *resp_len,
+                         int timeout_ms);
+
+int httpc_post_json(const http_url_t *url, const char *body,
+                    char **resp_body, size_t *resp_len,
+                    int timeout_ms) {
+    return httpc_post(url, NULL, body, body ? strlen(body) : 0,
+                      resp_body, resp_len, timeout_ms);
+}
+
+int httpc_post(const http_url_t *url, const char *content_encoding,
+               const char *body, size_t body_len,
+               char **resp_body, size_t *resp_len,
+               int timeout_ms) {
+    char encoding[64] = "";
+    if (content_encoding && *content_encoding) {
+        snprintf(encoding, sizeof(encoding), "Content-Encoding: %s\r\n", content_encoding);
+    }
+    return httpc_request("POST", url, encoding, body, body_len,
+                         resp_body, resp_len, timeout_ms);
+}
+
+int httpc_send_json(const char *method, const http_url_t *url, const char *extra_headers,
+                    const char *body, char **resp_body, size_t *resp_len, int timeout_ms) {
+    return httpc_request(method, url, extra_headers, body, body ? strlen(body) : 0,
+                         resp_body, resp_len, timeout_ms);
+}
+
+int httpc_get(const http_url_t *url, char **resp_body, size_t *resp_len, int timeout_ms) {
+    return httpc_request("GET", url, NULL, NULL, 0, resp_body, resp_len, timeout_ms);
+}
+
+static int httpc_request(const char *method, const http_url_t *url,
+                         const char *extra_headers,
+                         const char *body, size_t body_len,
+                         char **resp_body, size_t *resp_len,
+                         int timeout_ms) {
+    g_last_error = "failed";
+    if (!url) return -1;
+    if (resp_body) *resp_body = NULL;
+    if (resp_len) *resp_len = 0;
+
+    int port = url->port > 0 ? url->port : 80;
+    if (!body) body_len = 0;
+    /* Through a proxy the request names the whole URL and goes to the proxy,
+     * unless it tunnels, when the proxy is only asked for a connection. */
+    httpc_via_t via;
+    httpc_route(url->host, port, &via);
+    int forward = via.host[0] && !via.tunnel;
+    const char *conn_host = forward ? via.host : url->host;
+    int conn_port = forward ? via.port : port;
+    const char *path = url->path[0] ? url->path : "/";
+    char target[sizeof(url->host) + sizeof(url->path) + 24];
+    if (forward) snprintf(target, sizeof(target), "http://%s:%d%s", url->host, port, path);
+    else snprintf(target, sizeof(target), "%s", path);
+    char identity[HTTPC_IDENTITY_MAX];
+    if (httpc_identity(identity, sizeof(identity)) < 0) identity[0] = '\0';
+    char header[1024 + HTTPC_IDENTITY_MAX + sizeof(via.auth)];
+    int header_len = snprintf(header, sizeof(header),
+                              "%s %s HTTP/1.1\r\n"
+                              "Host: %s\r\n"
+                              "%s"
+                              "%s"
+                              "Content-Type: application/json\r\n"
+                              "%s"
+                              "Content-Length: %zu\r\n"
+                              "Connection: %s\r\n\r\n",
+                              method,
+                              target,
+                              url->host,
+                              forward ? via.auth : "",
+                              identity,
+                              extra_headers ? extra_headers : "",
+                              body_len,
+                              httpc_keepalive() ? "keep-alive" : "close");
+    if (header_len <= 0 || header_len >= (int)sizeof(header)) return -1;
+
+    /* Large enough for a full registry snapshot pulled by a read replica. */
+    const size_t max_resp = 262144;
+    char *buffer = NULL;
+    size_t total = 0;
+    size_t body_off = 0;
+    /* A pooled connection the peer closed in the meantime fails before any
+     * response byte arrives; the request is then sent once more on a fresh
+     * connection. */
+    for (int attempt = 0;; attempt++) {
+        int reused = 0;
+        int fd = attempt == 0 ? httpc_pool_take(conn_host, conn_port, timeout_ms) : -1;
+        if (fd >= 0) {
+            reused = 1;
+        } else {
+            int connect_ms = g_connect_timeout_ms && g_connect_timeout_ms < timeout_ms
+                             ? g_connect_timeout_ms : timeout_ms;
+            errno = 0;
+            fd = via.host[0] ? httpc_connect(via.host, via.port, connect_ms)
+                             : httpc_connect(url->host, port, connect_ms);
+            if (fd < 0) {
+                g_last_error = httpc_timed_out(errno) ? "connect_timeout" : "connect_failed";
+                return -1;
+            }
+            if (via.tunnel && httpc_open_tunnel(fd, url->host, port, via.auth) != 0) {
+                close(fd);
+                return -1;
+            }
+            if (connect_ms != timeout_ms) httpc_apply_timeouts(fd, timeout_ms);
+        }
+        int rc = -1;
+        int keep = 0;
+        if (httpc_send_all(fd, header, (size_t)header_len) == 0 &&
+            (body_len == 0 || httpc_send_all(fd, body, body_len) == 0)) {
+            rc = httpc_read_response(fd, 0, max_resp, &buffer, &total, &body_off, &keep);
+        } else if (reused) {
+            rc = HTTPC_CLOSED;
+        }
+        if (rc == 0) {
+            if (keep) httpc_pool_put(conn_host, conn_port, fd);
+            else close(fd);
+            break;
+        }
+        int saved_errno = errno;
+        close(fd);
+        if (rc != HTTPC_CLOSED || !reused) {
+            if (rc == -1 && httpc_timed_out(saved_errno)) g_last_error = "timeout";
+            return -1;
+        }
+    }
+
+    g_last_error = NULL;
+    int status = 0;
+    sscanf(buffer, "HTTP/%*s %d", &status);
+
+    size_t body_size = total - body_off;
+    char *body_copy = (char *)malloc(body_size + 1);
+    if (!body_copy) {
+        free(buffer);
+        return -1;
+    }
+    memcpy(body_copy, buffer + body_off, body_size);
+    body_copy[body_size] = '\0';
+
+    if (resp_body) *resp_body = body_copy;
+    else free(body_copy);
+    if (resp_len) *resp_len = body_size;
+
+    free(buffer);
+    return status;
+}
+
+
+#ifdef AUTOD_ZLIB
+int httpc_gzip_available(void) { return 1; }
+
+int httpc_gzip(const char *in, size_t in_len, char **out, size_t *out_len) {
+    if (!in || !out || !out_len) return -1;
+    *out = NULL;
+    *out_len = 0;
+    z_stream zs; memset(&zs, 0, sizeof(zs));
+    /* windowBits 15 + 16 selects the gzip wrapper instead of raw zlib. */
+    if (deflateInit2(&zs, Z_BEST_COMPRESSION, Z_DEFLATED, 15 + 16, 8,
+                     Z_DEFAULT_STRATEGY) != Z_OK) {
+        return -1;
+    }
+    uLong cap = deflateBound(&zs, (uLong)in_len);
+    char *buf = (char *)malloc(cap);
+    if (!buf) {
+        deflateEnd(&zs);
+        return -1;
+    }
+    zs.next_in = (Bytef *)in;
+    zs.avail_in = (uInt)in_len;
+    zs.next_out = (Bytef *)buf;
+    zs.avail_out = (uInt)cap;
+    int rc = deflate(&zs, Z_FINISH);
+    size_t produced = (size_t)zs.total_out;
+    deflateEnd(&zs);
+    if (rc != Z_STREAM_END) {
+        free(buf);
+        return -1;
+    }
+    *out = buf;
+    *out_len = produced;
+    return 0;
+}
+
+int httpc_gunzip(const char *in, size_t in_len, size_t max_out, char **out, size_t *out_len) {
+    if (!in || !out || !out_len || max_out == 0) return -1;
+    *out = NULL;
+    *out_len = 0;
+    z_stream zs; memset(&zs, 0, sizeof(zs));
+    if (inflateInit2(&zs, 15 + 16) != Z_OK) return -1;
+    char *buf = (char *)malloc(max_out + 1);
+    if (!buf) {
+        inflateEnd(&zs);
+        return -1;
+    }
+    zs.next_in = (Bytef *)in;
+    zs.avail_in = (uInt)in_len;
+    zs.next_out = (Bytef *)buf;
+    zs.avail_out = (uInt)max_out;
+    int rc = inflate(&zs, Z_FINISH);
+    size_t produced = (size_t)zs.total_out;
+    inflateEnd(&zs);
+    /* Z_BUF_ERROR with no room left means the body inflates past max_out. */
+    if (rc != Z_STREAM_END) {
+        free(buf);
+        return -1;
+    }
+    buf[produced] = '\0';
+    *out = buf;
+    *out_len = produced;
+    return 0;
+}
+#else
+int httpc_gzip_available(void) { return 0; }
+
+int httpc_gzip(const char *in, size_t in_len, char **out, size_t *out_len) {
+    (void)in; (void)in_len;
+    if (out) *out = NULL;
+    if (out_len) *out_len = 0;
+    return -1;
+}
+
+int httpc_gunzip(const char *in, size_t in_len, size_t max_out, char **out, size_t *out_len) {
+    (void)in; (void)in_len; (void)max_out;
+    if (out) *out = NULL;
+    if (out_len) *out_len = 0;
+    return -1;
+}
+#endif
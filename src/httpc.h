@@ -0,0 +1,152 @@
+#ifndef AUTOD_HTTPC_H
+#define AUTOD_HTTPC_H
+
+#include <stddef.h>
+
+/* Minimal blocking HTTP/1.1 client used for master registration, relays and
+ * notification webhooks. Plain http:// only (the daemon is built NO_SSL), with
+ * keep-alive connection reuse. */
+
+typedef struct {
+    char host[128];
+    int port;
+    char path[256];
+} http_url_t;
+
+#define HTTPC_MAX_HEADERS 8
+#define HTTPC_IDENTITY_MAX 2560
+
+/* Identification sent with every outbound request: "User-Agent: <ua>" (NULL
+ * or empty = autod/<build version>), X-Autod-Version and X-Autod-Api, then
+ * the extra header lines. */
+void httpc_set_identity(const char *user_agent, const char headers[][256], int count);
+
+/* Copy the identification block (CRLF-terminated header lines) into buf, for
+ * callers that write their own requests. Returns its length, or -1 when it
+ * does not fit. */
+int httpc_identity(char *buf, size_t buf_sz);
+
+/* X-Request-ID for the requests this thread sends from now on (NULL or
+ * empty = none); httpc_identity() includes it. */
+void httpc_set_request_id(const char *id);
+
+/* Connect timeout for the requests this thread sends from now on (0 = the
+ * request's own timeout, which then covers the connect too). */
+void httpc_set_connect_timeout(int timeout_ms);
+/* Why this thread's last request returned -1: "connect_timeout",
+ * "connect_failed", "proxy_refused" (the proxy turned the CONNECT down),
+ * "timeout" (connected, but no reply in time) or "failed".
+ * NULL after a request that got a reply. */
+const char *httpc_last_error(void);
+/* Whether errno value err is a socket timeout (EAGAIN, or EINPROGRESS from a
+ * connect). */
+int httpc_timed_out(int err);
+
+/* Check a configured "Name: value" header and store it normalised in out.
+ * Returns NULL or why it was refused ("malformed", "reserved"). */
+const char *httpc_check_header(const char *line, char *out, size_t out_sz);
+
+/* Parse "http://host[:port][/path]". default_path is used when the URL has no
+ * path component (NULL means "/"). Returns 0 on success. */
+int httpc_parse_url(const char *url, http_url_t *out, const char *default_path);
+
+/* Open a TCP connection with send/receive timeouts applied. Returns the socket
+ * or -1. Shared with the MQTT and SMTP notification transports. */
+int httpc_connect(const char *host, int port, int timeout_ms);
+
+/* Connection reuse ([http] max_conns_per_host, idle_timeout_ms): idle
+ * keep-alive connections are pooled per host:port and handed out again until
+ * they have been idle for idle_timeout_ms. max_per_host 0 turns reuse off
+ * and requests go out with "Connection: close". */
+#define HTTPC_DEFAULT_CONNS_PER_HOST 1
+#define HTTPC_DEFAULT_IDLE_TIMEOUT_MS 400  /* below the 500 ms nodes keep them */
+#define HTTPC_MAX_CONNS_PER_HOST 8
+void httpc_set_pool(int max_per_host, int idle_timeout_ms);
+/* Whether requests should ask for keep-alive. */
+int httpc_keepalive(void);
+
+/* Take an idle pooled connection to host:port with timeouts applied, or -1
+ * when there is none. */
+int httpc_pool_take(const char *host, int port, int timeout_ms);
+/* Park fd for reuse, or close it when the pool is off or full. */
+void httpc_pool_put(const char *host, int port, int fd);
+/* Requests sent over a reused connection so far, and how many are idle now. */
+void httpc_pool_stats(unsigned long *reused, int *idle);
+
+/* Outbound proxy ([http] proxy, no_proxy, proxy_route, proxy_env,
+ * proxy_tunnel). Requests made through httpc_post(), httpc_get() and the
+ * other request helpers go through it; httpc_connect() and the /http relay
+ * always connect directly. */
+#define HTTPC_MAX_PROXY_ROUTES 8
+typedef struct {
+    char url[256];             /* http://[user:pass@]host[:port]; "" = none */
+    char no_proxy[512];        /* comma list of destinations reached directly */
+    struct {
+        char pattern[128];     /* a no_proxy entry */
+        char proxy[256];       /* proxy URL, or "direct" */
+    } routes[HTTPC_MAX_PROXY_ROUTES];
+    int route_count;
+    int use_env;               /* take unset url / no_proxy from the environment */
+    int tunnel;                /* CONNECT through the proxy instead of absolute-form requests */
+} httpc_proxy_t;
+
+/* Check a proxy URL; returns NULL or why it was refused. */
+const char *httpc_check_proxy(const char *url);
+/* Install the proxy settings (once at startup), filling url from
+ * $http_proxy / $HTTP_PROXY (else $https_proxy / $HTTPS_PROXY, always
+ * tunnelled) and no_proxy from $no_proxy / $NO_PROXY when use_env is set.
+ * Returns 1 when some destination goes through a proxy, with the default
+ * one described in desc (may be NULL). */
+int httpc_set_proxy(const httpc_proxy_t *p, char *desc, size_t desc_sz);
+/* The proxy a request to host:port goes through, written to out as
+ * "host:port" (with " (CONNECT)" when tunnelled), or "direct". */
+void httpc_describe_route(const char *host, int port, char *out, size_t out_sz);
+
+/* send() all of buf. Returns 0, or -1 with errno set. */
+int httpc_send_all(int fd, const void *buf, size_t len);
+
+/* httpc_read_response() when the peer closed the connection before sending
+ * anything: a stale pooled connection, so the request can be retried. */
+#define HTTPC_CLOSED (-2)
+
+/* Read one HTTP/1.x response from fd, framed by Content-Length, chunked
+ * encoding or the end of the connection. no_body is set for HEAD requests.
+ * *out receives a malloc'd, NUL-terminated copy of the header block, the blank
+ * line and the (de-chunked) body, which starts at *body_off; *reusable says
+ * whether fd can carry another request. max (0 = no limit) caps the size.
+ * Returns 0, HTTPC_CLOSED or -1 with errno set. */
+int httpc_read_response(int fd, int no_body, size_t max,
+                        char **out, size_t *out_len, size_t *body_off, int *reusable);
+
+/* POST a JSON body and return the HTTP status (or -1 on transport errors).
+ * On success *resp_body receives a malloc'd, NUL-terminated copy of the body. */
+int httpc_post_json(const http_url_t *url, const char *body,
+                    char **resp_body, size_t *resp_len,
+                    int timeout_ms);
+
+/* Like httpc_post_json() but for a body of explicit length, optionally sent
+ * with a Content-Encoding header (NULL for none). */
+int httpc_post(const http_url_t *url, const char *content_encoding,
+               const char *body, size_t body_len,
+               char **resp_body, size_t *resp_len,
+               int timeout_ms);
+
+/* Send a JSON body (NULL for none) with any method, plus extra header lines
+ * (each CRLF-terminated, NULL for none); same return contract as
+ * httpc_post_json(). */
+int httpc_send_json(const char *method, const http_url_t *url, const char *extra_headers,
+                    const char *body, char **resp_body, size_t *resp_len, int timeout_ms);
+
+/* GET url (path may carry a query string); same return contract as
+ * httpc_post_json(). */
+int httpc_get(const http_url_t *url, char **resp_body, size_t *resp_len, int timeout_ms);
+
+/* gzip helpers for compressed registration traffic. Built only with zlib
+ * (make ZLIB=1, the default); otherwise httpc_gzip_available() returns 0 and
+ * both helpers fail. Outputs are malloc'd; httpc_gunzip() NUL-terminates and
+ * fails when the inflated body would exceed max_out bytes. */
+int httpc_gzip_available(void);
+int httpc_gzip(const char *in, size_t in_len, char **out, size_t *out_len);
+int httpc_gunzip(const char *in, size_t in_len, size_t max_out, char **out, size_t *out_len);
+
+#endif
@@ -0,0 +1,159 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <pthread.h>
+#include <stdint.h>
+
+#include "autod.h"
+#include "idempotency.h"
+
+typedef struct {
+    int in_use;
+    int done;
+    char key[IDEM_KEY_MAX + 1];
+    uint64_t fingerprint;
+    char request_id[IDEM_REQUEST_ID_MAX];
+    long long created_ms;
+    long long expires_ms;
+    idem_response_t resp;
+} idem_entry_t;
+
+static pthread_mutex_t g_idem_lock = PTHREAD_MUTEX_INITIALIZER;
+static idem_entry_t g_idem[IDEM_MAX_ENTRIES];
+
+static uint64_t idem_fingerprint(const char *buf, size_t len) {
+    uint64_t h = 1469598103934665603ULL;
+    for (size_t i = 0; i < len; i++) {
+        h ^= (unsigned char)buf[i];
+        h *= 1099511628211ULL;
+    }
+    return h;
+}
+
+int idem_valid_key(const char *key) {
+    if (!key) return 0;
+    size_t len = strlen(key);
+    if (len == 0 || len > IDEM_KEY_MAX) return 0;
+    for (size_t i = 0; i < len; i++) {
+        unsigned char ch = (unsigned char)key[i];
+        if (ch < 0x21 || ch > 0x7e) return 0;
+    }
+    return 1;
+}
+
+static void idem_entry_clear(idem_entry_t *e) {
+    free(e->resp.body);
+    memset(e, 0, sizeof(*e));
+}
+
+static idem_entry_t *idem_find_locked(const char *key) {
+    long long now = now_ms();
+    for (int i = 0; i < IDEM_MAX_ENTRIES; i++) {
+        idem_entry_t *e = &g_idem[i];
+        if (!e->in_use) continue;
+        if (e->done && e->expires_ms <= now) {
+            idem_entry_clear(e);
+            continue;
+        }
+        if (strcmp(e->key, key) == 0) return e;
+    }
+    return NULL;
+}
+
+/* Free slot, else the oldest completed entry; NULL when all are running. */
+static idem_entry_t *idem_alloc_locked(void) {
+    idem_entry_t *victim = NULL;
+    for (int i = 0; i < IDEM_MAX_ENTRIES; i++) {
+        idem_entry_t *e = &g_idem[i];
+        if (!e->in_use) return e;
+        if (e->done && (!victim || e->created_ms < victim->created_ms)) victim = e;
+    }
+    if (victim) idem_entry_clear(victim);
+    return victim;
+}
+
+static int idem_copy_response(const idem_entry_t *e, idem_response_t *out) {
+    if (!out) return 0;
+    *out = e->resp;
+    out->body = NULL;
+    if (e->resp.body_len > 0) {
+        out->body = malloc(e->resp.body_len);
+        if (!out->body) return -1;
+        memcpy(out->body, e->resp.body, e->resp.body_len);
+    }
+    return 0;
+}
+
+int idem_begin(const char *key, const char *request_body, size_t request_len,
+               long long window_ms, const char *request_id, idem_response_t *out) {
+    if (out) memset(out, 0, sizeof(*out));
+    uint64_t fp = idem_fingerprint(request_body ? request_body : "", request_body ? request_len : 0);
+
+    pthread_mutex_lock(&g_idem_lock);
+    idem_entry_t *e = idem_find_locked(key);
+    if (e) {
+        int rc;
+        if (e->fingerprint != fp) {
+            rc = IDEM_MISMATCH;
+        } else if (e->done) {
+            rc = idem_copy_response(e, out) == 0 ? IDEM_REPLAY : IDEM_IN_PROGRESS;
+        } else {
+            rc = IDEM_IN_PROGRESS;
+            if (out) {
+                snprintf(out->request_id, sizeof(out->request_id), "%s", e->request_id);
+                out->running_ms = now_ms() - e->created_ms;
+            }
+        }
+        pthread_mutex_unlock(&g_idem_lock);
+        return rc;
+    }
+
+    e = idem_alloc_locked();
+    if (!e) {
+        pthread_mutex_unlock(&g_idem_lock);
+        return IDEM_FULL;
+    }
+    e->in_use = 1;
+    strncpy(e->key, key, sizeof(e->key) - 1);
+    snprintf(e->request_id, sizeof(e->request_id), "%s", request_id ? request_id : "");
+    e->fingerprint = fp;
+    e->created_ms = now_ms();
+    e->expires_ms = e->created_ms + window_ms;
+    pthread_mutex_unlock(&g_idem_lock);
+    return IDEM_NEW;
+}
+
+void idem_complete(const char *key, int status, const char *content_type,
+                   const char *extra_headers, const char *body, size_t body_len) {
+    pthread_mutex_lock(&g_idem_lock);
+    idem_entry_t *e = idem_find_locked(key);
+    if (e && !e->done) {
+        long long window_ms = e->expires_ms - e->created_ms;
+        e->resp.status = status;
+        strncpy(e->resp.content_type, content_type ? content_type : "application/octet-stream",
+                sizeof(e->resp.content_type) - 1);
+        strncpy(e->resp.extra_headers, extra_headers ? extra_headers : "",
+                sizeof(e->resp.extra_headers) - 1);
+        e->resp.body = body_len ? malloc(body_len) : NULL;
+        if (e->resp.body) memcpy(e->resp.body, body, body_len);
+        e->resp.body_len = e->resp.body ? body_len : 0;
+        e->done = 1;
+        /* The retention window starts when the result is known. */
+        e->expires_ms = now_ms() + window_ms;
+    }
+    pthread_mutex_unlock(&g_idem_lock);
+}
+
+void idem_abort(const char *key) {
+    pthread_mutex_lock(&g_idem_lock);
+    idem_entry_t *e = idem_find_locked(key);
+    if (e && !e->done) idem_entry_clear(e);
+    pthread_mutex_unlock(&g_idem_lock);
+}
+
+void idem_response_free(idem_response_t *r) {
+    if (!r) return;
+    free(r->body);
+    r->body = NULL;
+    r->body_len = 0;
+}
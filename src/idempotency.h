@@ -0,0 +1,40 @@
+#ifndef AUTOD_IDEMPOTENCY_H
+#define AUTOD_IDEMPOTENCY_H
+
+#include <stddef.h>
+
+#define IDEM_MAX_ENTRIES 64
+#define IDEM_KEY_MAX 128
+#define IDEM_REQUEST_ID_MAX 65
+
+enum {
+    IDEM_NEW = 0,        /* caller owns the key: run, then idem_complete/idem_abort */
+    IDEM_REPLAY,         /* stored response copied into the idem_response_t */
+    IDEM_IN_PROGRESS,    /* original request still running (request_id and running_ms set) */
+    IDEM_MISMATCH,       /* key reused with a different request body */
+    IDEM_FULL            /* every slot holds a running request */
+};
+
+typedef struct {
+    int status;
+    char content_type[96];
+    char extra_headers[160];
+    char *body;          /* malloc'd, release with idem_response_free */
+    size_t body_len;
+    char request_id[IDEM_REQUEST_ID_MAX];    /* of the run holding the key */
+    long long running_ms;                     /* how long it has been running */
+} idem_response_t;
+
+int idem_valid_key(const char *key);
+
+/* Claim key for a request with the given body, run under request_id. A
+ * duplicate that arrives while the first request is still running gets
+ * IDEM_IN_PROGRESS straight away instead of holding a worker until it ends. */
+int idem_begin(const char *key, const char *request_body, size_t request_len,
+               long long window_ms, const char *request_id, idem_response_t *out);
+void idem_complete(const char *key, int status, const char *content_type,
+                   const char *extra_headers, const char *body, size_t body_len);
+void idem_abort(const char *key);
+void idem_response_free(idem_response_t *r);
+
+#endif
@@ -0,0 +1,124 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <ctype.h>
+#include <limits.h>
+#include <pthread.h>
+#include <sys/stat.h>
+
+#include "parson.h"
+#include "autod.h"
+#include "caller.h"
+#include "catalog.h"
+#include "events.h"
+#include "integrity.h"
+
+#define INTEGRITY_CACHE_SIZE 32
+
+/* Digests of files already hashed, valid while the file keeps its identity,
+ * size and timestamps, so an unchanged binary is read once rather than on
+ * every run. */
+typedef struct {
+    char file[PATH_MAX];
+    dev_t dev;
+    ino_t ino;
+    off_t size;
+    struct timespec mtime;
+    struct timespec ctime;
+    char digest[INTEGRITY_DIGEST_LEN + 1];
+} integrity_cached_t;
+
+static pthread_mutex_t g_integrity_lock = PTHREAD_MUTEX_INITIALIZER;
+static integrity_cached_t g_cache[INTEGRITY_CACHE_SIZE];
+static int g_cache_next;
+
+int integrity_parse_digest(const char *value, char out[INTEGRITY_DIGEST_LEN + 1]) {
+    if (!value || strlen(value) != INTEGRITY_DIGEST_LEN) return -1;
+    for (int i = 0; i < INTEGRITY_DIGEST_LEN; i++) {
+        if (!isxdigit((unsigned char)value[i])) return -1;
+        out[i] = (char)tolower((unsigned char)value[i]);
+    }
+    out[INTEGRITY_DIGEST_LEN] = '\0';
+    return 0;
+}
+
+static int integrity_same_time(const struct timespec *a, const struct timespec *b) {
+    return a->tv_sec == b->tv_sec && a->tv_nsec == b->tv_nsec;
+}
+
+/* Digest of file as it is now. Returns -1 when it cannot be read. */
+static int integrity_digest(const char *file, char out[INTEGRITY_DIGEST_LEN + 1]) {
+    struct stat st;
+    if (stat(file, &st) != 0 || !S_ISREG(st.st_mode)) return -1;
+    pthread_mutex_lock(&g_integrity_lock);
+    for (int i = 0; i < INTEGRITY_CACHE_SIZE; i++) {
+        const integrity_cached_t *e = &g_cache[i];
+        if (e->file[0] && !strcmp(e->file, file) && e->dev == st.st_dev && e->ino == st.st_ino &&
+            e->size == st.st_size && integrity_same_time(&e->mtime, &st.st_mtim) &&
+            integrity_same_time(&e->ctime, &st.st_ctim)) {
+            memcpy(out, e->digest, sizeof(e->digest));
+            pthread_mutex_unlock(&g_integrity_lock);
+            return 0;
+        }
+    }
+    pthread_mutex_unlock(&g_integrity_lock);
+
+    if (caller_sha256_file(file, out) != 0) return -1;
+    pthread_mutex_lock(&g_integrity_lock);
+    integrity_cached_t *e = &g_cache[g_cache_next];
+    g_cache_next = (g_cache_next + 1) % INTEGRITY_CACHE_SIZE;
+    snprintf(e->file, sizeof(e->file), "%s", file);
+    e->dev = st.st_dev;
+    e->ino = st.st_ino;
+    e->size = st.st_size;
+    e->mtime = st.st_mtim;
+    e->ctime = st.st_ctim;
+    memcpy(e->digest, out, sizeof(e->digest));
+    pthread_mutex_unlock(&g_integrity_lock);
+    return 0;
+}
+
+/* Compare file (inside root) with expected; pinned_by is the command name or
+ * "interpreter". file is NULL when there is nothing to hash (argv mode found
+ * no binary). */
+static int integrity_verify(const char *root, const char *file, const char *expected,
+                            const char *path, const char *pinned_by) {
+    char full[PATH_MAX];
+    char actual[INTEGRITY_DIGEST_LEN + 1] = "";
+    int readable = 0;
+    if (file) {
+        int n = snprintf(full, sizeof(full), "%s%s", root ? root : "", file);
+        readable = n > 0 && (size_t)n < sizeof(full) && integrity_digest(full, actual) == 0;
+        if (readable && !strcmp(actual, expected)) return 0;
+    }
+    const char *outcome = readable ? "mismatch" : "unreadable";
+    fprintf(stderr, "WARN: exec: refusing %s: %s %s (%s, sha256 %s, expected %s)\n", path,
+            file ? file : path, outcome, pinned_by, readable ? actual : "-", expected);
+
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_string(eo, "path", path);
+    json_object_set_string(eo, "file", file ? file : path);
+    json_object_set_string(eo, "pinned_by", pinned_by);
+    json_object_set_string(eo, "outcome", outcome);
+    json_object_set_string(eo, "expected", expected);
+    if (readable) json_object_set_string(eo, "actual", actual);
+    (void)events_emit("exec_integrity_failed", ev);
+    return -1;
+}
+
+int integrity_check_exec(const config_t *cfg, const char *root, const char *path,
+                         const char *binary) {
+    int argv_mode = !strcmp(cfg->exec_mode, "argv");
+    const char *command = NULL;
+    const char *pin = catalog_sha256_for(cfg, path, binary, &command);
+    if (pin && integrity_verify(root, argv_mode ? binary : path, pin, path, command) != 0) {
+        return -1;
+    }
+    if (!argv_mode && cfg->exec_interpreter_sha256[0] &&
+        integrity_verify(root, cfg->interpreter, cfg->exec_interpreter_sha256, path,
+                         "interpreter") != 0) {
+        return -1;
+    }
+    return 0;
+}
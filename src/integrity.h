@@ -0,0 +1,27 @@
+#ifndef AUTOD_INTEGRITY_H
+#define AUTOD_INTEGRITY_H
+
+#include <stddef.h>
+
+/* Exec integrity: a [command.NAME] sha256 pins the file the command's path
+ * names (the binary argv mode resolves it to, or the script handler mode
+ * gives the interpreter), and [exec] interpreter_sha256 pins the handler.
+ * A pinned file that no longer matches is not run; the refusal is logged
+ * and emitted as exec_integrity_failed. Handlers on field devices are
+ * swapped or edited in place more often than their config. */
+
+#define INTEGRITY_DIGEST_LEN 64
+
+typedef struct config config_t;
+
+/* Copy a SHA-256 given as 64 hex digits to out in lower case. Returns -1
+ * when value is not one. */
+int integrity_parse_digest(const char *value, char out[INTEGRITY_DIGEST_LEN + 1]);
+
+/* Whether path may run: every file pinned for it (inside root, NULL = the
+ * host) still has its digest. binary is the file argv mode resolved path to,
+ * NULL when it found none. Returns 0, or -1 after reporting the mismatch. */
+int integrity_check_exec(const config_t *cfg, const char *root, const char *path,
+                         const char *binary);
+
+#endif
@@ -0,0 +1,906 @@
+#define _DEFAULT_SOURCE
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <errno.h>
+#include <dirent.h>
+#include <unistd.h>
+#include <pthread.h>
+#include <time.h>
+#include <sys/types.h>
+#include <sys/stat.h>
+#include <sys/time.h>
+#include <sys/resource.h>
+#include <sys/wait.h>
+#include <signal.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "jobs.h"
+
+#define JOBS_SAMPLE_INTERVAL_MS 250
+#define JOBS_MAX_TREE 64
+#define JOBS_CANCELED_REQUESTS 16
+#define JOBS_REQUEST_ID_MAX AUTOD_REQUEST_ID_MAX
+
+typedef struct {
+    pid_t pid;
+    pid_t ppid;
+    char comm[32];
+    long long cpu_ms;
+    long rss_kb;
+} proc_sample_t;
+
+typedef struct {
+    int in_use;
+    unsigned long id;
+    pid_t pid;
+    char path[256];
+    char request_id[JOBS_REQUEST_ID_MAX];
+    long long started_ms;
+    long long finished_ms;
+    long long finished_unix_ms;
+    long long last_sample_ms;
+    long long cpu_ms;
+    long rss_kb;
+    long peak_rss_kb;
+    long hwm_kb;               /* highest VmHWM in the tree, sampled after exec */
+    int procs;
+    int peak_procs;
+    int reaped;
+    int canceled;
+    struct rusage ru;
+    int rc;
+    exec_usage_t usage;
+} job_entry_t;
+
+static pthread_mutex_t g_jobs_lock = PTHREAD_MUTEX_INITIALIZER;
+static job_entry_t g_running[JOBS_MAX_RUNNING];
+static job_entry_t g_finished[JOBS_MAX_FINISHED];
+static unsigned long g_finished_next = 0;
+static unsigned long g_jobs_next_id = 1;
+/* Request ids canceled recently, for handlers not forked yet at the time. */
+static char g_canceled_requests[JOBS_CANCELED_REQUESTS][JOBS_REQUEST_ID_MAX];
+static unsigned g_canceled_next = 0;
+
+static pthread_mutex_t g_store_lock = PTHREAD_MUTEX_INITIALIZER;
+static jobs_config_t g_store_cfg;
+
+long long jobs_unix_ms(void) {
+    struct timespec ts;
+    clock_gettime(CLOCK_REALTIME, &ts);
+    return (long long)ts.tv_sec * 1000LL + ts.tv_nsec / 1000000LL;
+}
+
+static long long tv_ms(const struct timeval *tv) {
+    return (long long)tv->tv_sec * 1000 + tv->tv_usec / 1000;
+}
+
+/* Parse /proc/<pid>/stat. comm may contain spaces and parentheses, so the
+ * fields are read after the last ')'. */
+static int read_proc_stat(pid_t pid, proc_sample_t *out) {
+    char path[64];
+    snprintf(path, sizeof(path), "/proc/%d/stat", (int)pid);
+    FILE *f = fopen(path, "r");
+    if (!f) return -1;
+    char buf[1024];
+    size_t n = fread(buf, 1, sizeof(buf) - 1, f);
+    fclose(f);
+    buf[n] = '\0';
+
+    char *lp = strchr(buf, '(');
+    char *rp = strrchr(buf, ')');
+    if (!lp || !rp || rp < lp) return -1;
+    size_t clen = (size_t)(rp - lp - 1);
+    if (clen >= sizeof(out->comm)) clen = sizeof(out->comm) - 1;
+    memcpy(out->comm, lp + 1, clen);
+    out->comm[clen] = '\0';
+
+    /* Fields after comm start at field 3 (state). */
+    char *p = rp + 2;
+    int field = 3;
+    long ppid = 0;
+    unsigned long long utime = 0, stime = 0;
+    long rss_pages = 0;
+    char *save = NULL;
+    for (char *tok = strtok_r(p, " ", &save); tok; tok = strtok_r(NULL, " ", &save), field++) {
+        if (field == 4) ppid = strtol(tok, NULL, 10);
+        else if (field == 14) utime = strtoull(tok, NULL, 10);
+        else if (field == 15) stime = strtoull(tok, NULL, 10);
+        else if (field == 24) { rss_pages = strtol(tok, NULL, 10); break; }
+    }
+    if (field != 24) return -1;
+
+    long hz = sysconf(_SC_CLK_TCK);
+    long page_kb = sysconf(_SC_PAGESIZE) / 1024;
+    if (hz <= 0) hz = 100;
+    if (page_kb <= 0) page_kb = 4;
+    out->pid = pid;
+    out->ppid = (pid_t)ppid;
+    out->cpu_ms = (long long)(utime + stime) * 1000 / hz;
+    out->rss_kb = rss_pages * page_kb;
+    return 0;
+}
+
+/* VmHWM from /proc/<pid>/status: the process's peak RSS since its last
+ * exec. -1 when unreadable (gone, or already reaped). */
+static long read_proc_hwm(pid_t pid) {
+    char path[64];
+    snprintf(path, sizeof(path), "/proc/%d/status", (int)pid);
+    FILE *f = fopen(path, "r");
+    if (!f) return -1;
+    char line[128];
+    long kb = -1;
+    while (fgets(line, sizeof(line), f)) {
+        if (sscanf(line, "VmHWM: %ld", &kb) == 1) break;
+    }
+    fclose(f);
+    return kb;
+}
+
+/* A forked handler still runs the daemon's image until its exec; samples
+ * taken then measure the daemon, not the handler. */
+static int proc_before_exec(pid_t pid) {
+    char path[64];
+    struct stat self, st;
+    snprintf(path, sizeof(path), "/proc/%d/exe", (int)pid);
+    if (stat("/proc/self/exe", &self) != 0 || stat(path, &st) != 0) return 0;
+    return st.st_dev == self.st_dev && st.st_ino == self.st_ino;
+}
+
+/* Collect root and all of its live descendants. Returns the number of
+ * entries stored in out (root first) or 0 when root is gone. */
+static int sample_tree(pid_t root, proc_sample_t *out, int max) {
+    if (max <= 0 || read_proc_stat(root, &out[0]) != 0) return 0;
+    int count = 1;
+
+    DIR *d = opendir("/proc");
+    if (!d) return count;
+    proc_sample_t *all = NULL;
+    size_t all_n = 0, all_cap = 0;
+    struct dirent *de;
+    while ((de = readdir(d)) != NULL) {
+        if (de->d_name[0] < '0' || de->d_name[0] > '9') continue;
+        pid_t pid = (pid_t)strtol(de->d_name, NULL, 10);
+        if (pid <= 0 || pid == root) continue;
+        proc_sample_t s;
+        if (read_proc_stat(pid, &s) != 0) continue;
+        if (all_n == all_cap) {
+            size_t ncap = all_cap ? all_cap * 2 : 128;
+            proc_sample_t *tmp = realloc(all, ncap * sizeof(*tmp));
+            if (!tmp) break;
+            all = tmp;
+            all_cap = ncap;
+        }
+        all[all_n++] = s;
+    }
+    closedir(d);
+
+    /* Breadth-first walk: every entry already in out is a parent candidate. */
+    for (int i = 0; i < count && count < max; i++) {
+        for (size_t j = 0; j < all_n && count < max; j++) {
+            if (all[j].ppid == out[i].pid) out[count++] = all[j];
+        }
+    }
+    free(all);
+    return count;
+}
+
+static job_entry_t *find_running_locked(unsigned long id) {
+    if (id == 0) return NULL;
+    for (int i = 0; i < JOBS_MAX_RUNNING; i++) {
+        if (g_running[i].in_use && g_running[i].id == id) return &g_running[i];
+    }
+    return NULL;
+}
+
+static job_entry_t *find_finished_locked(unsigned long id) {
+    if (id == 0) return NULL;
+    for (int i = 0; i < JOBS_MAX_FINISHED; i++) {
+        if (g_finished[i].in_use && g_finished[i].id == id) return &g_finished[i];
+    }
+    return NULL;
+}
+
+static int request_canceled_locked(const char *request_id) {
+    if (!request_id || !*request_id) return 0;
+    for (int i = 0; i < JOBS_CANCELED_REQUESTS; i++) {
+        if (!strcmp(g_canceled_requests[i], request_id)) return 1;
+    }
+    return 0;
+}
+
+/* SIGKILL the handler and everything it spawned, children first so none is
+ * reparented out of reach. */
+static void kill_tree(pid_t root) {
+    proc_sample_t tree[JOBS_MAX_TREE];
+    int n = sample_tree(root, tree, JOBS_MAX_TREE);
+    for (int i = n - 1; i > 0; i--) kill(tree[i].pid, SIGKILL);
+    kill(root, SIGKILL);
+}
+
+/* Caller holds g_jobs_lock; an unreaped pid cannot have been recycled. */
+static void cancel_locked(job_entry_t *j) {
+    j->canceled = 1;
+    if (!j->reaped) kill_tree(j->pid);
+}
+
+unsigned long jobs_start(pid_t pid, const char *path, const char *request_id) {
+    unsigned long id = 0;
+    pthread_mutex_lock(&g_jobs_lock);
+    for (int i = 0; i < JOBS_MAX_RUNNING; i++) {
+        job_entry_t *j = &g_running[i];
+        if (j->in_use) continue;
+        memset(j, 0, sizeof(*j));
+        j->in_use = 1;
+        j->id = g_jobs_next_id++;
+        j->pid = pid;
+        strncpy(j->path, path ? path : "", sizeof(j->path) - 1);
+        j->path[sizeof(j->path) - 1] = '\0';
+        snprintf(j->request_id, sizeof(j->request_id), "%s", request_id ? request_id : "");
+        j->started_ms = now_ms();
+        id = j->id;
+        if (request_canceled_locked(j->request_id)) cancel_locked(j);
+        break;
+    }
+    pthread_mutex_unlock(&g_jobs_lock);
+    return id;
+}
+
+void jobs_sample(unsigned long id) {
+    pid_t pid = 0;
+    long long now = now_ms();
+    pthread_mutex_lock(&g_jobs_lock);
+    job_entry_t *j = find_running_locked(id);
+    if (j && !j->reaped && now - j->last_sample_ms >= JOBS_SAMPLE_INTERVAL_MS) pid = j->pid;
+    pthread_mutex_unlock(&g_jobs_lock);
+    /* Until the exec there is nothing to measure; try again next time. */
+    if (pid <= 0 || proc_before_exec(pid)) return;
+
+    proc_sample_t tree[JOBS_MAX_TREE];
+    int n = sample_tree(pid, tree, JOBS_MAX_TREE);
+    if (n == 0) return;
+    long rss = 0, hwm = 0;
+    long long cpu = 0;
+    for (int i = 0; i < n; i++) {
+        rss += tree[i].rss_kb;
+        cpu += tree[i].cpu_ms;
+        long kb = read_proc_hwm(tree[i].pid);
+        if (kb > hwm) hwm = kb;
+    }
+
+    pthread_mutex_lock(&g_jobs_lock);
+    j = find_running_locked(id);
+    if (j) {
+        j->last_sample_ms = now;
+        j->rss_kb = rss;
+        j->procs = n;
+        /* Children that already exited drop out of the tree; keep the
+         * reported CPU time monotonic. */
+        if (cpu > j->cpu_ms) j->cpu_ms = cpu;
+        if (rss > j->peak_rss_kb) j->peak_rss_kb = rss;
+        if (hwm > j->hwm_kb) j->hwm_kb = hwm;
+        if (n > j->peak_procs) j->peak_procs = n;
+    }
+    pthread_mutex_unlock(&g_jobs_lock);
+}
+
+pid_t jobs_waitpid(unsigned long id, pid_t pid, int *status, int options) {
+    struct rusage ru;
+    memset(&ru, 0, sizeof(ru));
+    pid_t wp = wait4(pid, status, options, &ru);
+    if (wp == pid) {
+        pthread_mutex_lock(&g_jobs_lock);
+        job_entry_t *j = find_running_locked(id);
+        if (j) {
+            j->ru = ru;
+            j->reaped = 1;
+        }
+        pthread_mutex_unlock(&g_jobs_lock);
+    }
+    return wp;
+}
+
+void jobs_finish(unsigned long id, int rc, exec_usage_t *usage_out) {
+    if (usage_out) memset(usage_out, 0, sizeof(*usage_out));
+    pthread_mutex_lock(&g_jobs_lock);
+    job_entry_t *j = find_running_locked(id);
+    if (j) {
+        exec_usage_t *u = &j->usage;
+        u->job_id = j->id;
+        if (j->reaped) {
+            u->cpu_user_ms = tv_ms(&j->ru.ru_utime);
+            u->cpu_sys_ms = tv_ms(&j->ru.ru_stime);
+            long long total = u->cpu_user_ms + u->cpu_sys_ms;
+            if (total > j->cpu_ms) j->cpu_ms = total;
+        }
+        /* Not ru_maxrss: it also counts the daemon's address space the
+         * handler carried from fork until exec. */
+        u->max_rss_kb = j->hwm_kb;
+        u->peak_tree_rss_kb = j->peak_rss_kb;
+        u->peak_procs = j->peak_procs;
+        u->canceled = j->canceled;
+        j->rc = rc;
+        j->finished_ms = now_ms();
+        j->finished_unix_ms = jobs_unix_ms();
+        j->rss_kb = 0;
+        j->procs = 0;
+        if (usage_out) *usage_out = *u;
+
+        g_finished[g_finished_next % JOBS_MAX_FINISHED] = *j;
+        g_finished_next++;
+        j->in_use = 0;
+    }
+    pthread_mutex_unlock(&g_jobs_lock);
+}
+
+int jobs_cancel(unsigned long id) {
+    int r = -1;
+    pthread_mutex_lock(&g_jobs_lock);
+    job_entry_t *j = find_running_locked(id);
+    if (j) {
+        cancel_locked(j);
+        r = 0;
+    } else if (find_finished_locked(id)) {
+        r = 1;
+    }
+    pthread_mutex_unlock(&g_jobs_lock);
+    return r;
+}
+
+int jobs_cancel_request(const char *request_id) {
+    if (!request_id || !*request_id) return 0;
+    int count = 0;
+    pthread_mutex_lock(&g_jobs_lock);
+    if (!request_canceled_locked(request_id)) {
+        char *slot = g_canceled_requests[g_canceled_next++ % JOBS_CANCELED_REQUESTS];
+        snprintf(slot, JOBS_REQUEST_ID_MAX, "%s", request_id);
+    }
+    for (int i = 0; i < JOBS_MAX_RUNNING; i++) {
+        job_entry_t *j = &g_running[i];
+        if (!j->in_use || strcmp(j->request_id, request_id) != 0) continue;
+        cancel_locked(j);
+        count++;
+    }
+    pthread_mutex_unlock(&g_jobs_lock);
+    return count;
+}
+
+static const char *job_status(const job_entry_t *j) {
+    if (j->canceled) return "canceled";
+    return j->rc == 0 ? "succeeded" : "failed";
+}
+
+static void set_usage_json(JSON_Object *o, const exec_usage_t *u) {
+    json_object_set_number(o, "cpu_user_ms", (double)u->cpu_user_ms);
+    json_object_set_number(o, "cpu_sys_ms", (double)u->cpu_sys_ms);
+    json_object_set_number(o, "max_rss_kb", (double)u->max_rss_kb);
+    json_object_set_number(o, "peak_tree_rss_kb", (double)u->peak_tree_rss_kb);
+    json_object_set_number(o, "peak_procs", u->peak_procs);
+    if (!u->cgroup) return;
+    JSON_Value *cv = json_value_init_object();
+    JSON_Object *co = json_object(cv);
+    json_object_set_number(co, "cpu_ms", (double)u->cg_cpu_ms);
+    json_object_set_number(co, "throttled_ms", (double)u->cg_throttled_ms);
+    json_object_set_number(co, "nr_throttled", (double)u->cg_nr_throttled);
+    if (u->cg_memory_peak_kb >= 0) json_object_set_number(co, "memory_peak_kb", (double)u->cg_memory_peak_kb);
+    json_object_set_number(co, "oom_kills", (double)u->cg_oom_kills);
+    json_object_set_number(co, "io_read_bytes", (double)u->cg_io_read_bytes);
+    json_object_set_number(co, "io_write_bytes", (double)u->cg_io_write_bytes);
+    json_object_set_value(o, "cgroup", cv);
+}
+
+static JSON_Value *job_to_json(const job_entry_t *j, int running, long long now) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_number(o, "id", (double)j->id);
+    json_object_set_string(o, "state", running ? "running" : "finished");
+    if (running && j->canceled) json_object_set_boolean(o, "canceled", 1);
+    json_object_set_number(o, "pid", (double)j->pid);
+    json_object_set_string(o, "path", j->path);
+    if (j->request_id[0]) json_object_set_string(o, "request_id", j->request_id);
+    json_object_set_number(o, "started_ms", (double)j->started_ms);
+    long long end = running ? now : j->finished_ms;
+    json_object_set_number(o, "elapsed_ms", (double)(end - j->started_ms));
+    json_object_set_number(o, "cpu_ms", (double)j->cpu_ms);
+    if (running) {
+        json_object_set_number(o, "rss_kb", (double)j->rss_kb);
+        json_object_set_number(o, "procs", j->procs);
+    } else {
+        json_object_set_string(o, "status", job_status(j));
+        json_object_set_number(o, "rc", j->rc);
+        json_object_set_number(o, "ts_unix_ms", (double)j->finished_unix_ms);
+    }
+    json_object_set_number(o, "peak_rss_kb", (double)j->peak_rss_kb);
+    json_object_set_number(o, "peak_procs", j->peak_procs);
+    return v;
+}
+
+void exec_set_usage(JSON_Object *o, const exec_usage_t *u) {
+    if (!o || !u || u->job_id == 0) return;
+    json_object_set_number(o, "job_id", (double)u->job_id);
+    if (u->canceled) json_object_set_boolean(o, "canceled", 1);
+    if (u->timed_out) {
+        json_object_set_boolean(o, "timed_out", 1);
+        json_object_set_number(o, "exec_timeout_ms", u->timeout_ms);
+    }
+    JSON_Value *uv = json_value_init_object();
+    set_usage_json(json_object(uv), u);
+    json_object_set_value(o, "usage", uv);
+}
+
+/* ---------- History store ---------- */
+
+void jobs_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->jobs, 0, sizeof(cfg->jobs));
+    cfg->jobs.store_max_kb = 1024;
+    cfg->jobs.output_bytes = 512;
+}
+
+int jobs_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || strcmp(section, "jobs") != 0) return 0;
+    if (!strcmp(key, "store_path")) {
+        strncpy(cfg->jobs.store_path, value, sizeof(cfg->jobs.store_path) - 1);
+        cfg->jobs.store_path[sizeof(cfg->jobs.store_path) - 1] = '\0';
+    } else if (!strcmp(key, "store_max_kb")) {
+        cfg->jobs.store_max_kb = atoi(value);
+    } else if (!strcmp(key, "output_bytes")) {
+        cfg->jobs.output_bytes = atoi(value);
+    } else {
+        fprintf(stderr, "WARN: ignoring unknown jobs key '%s'\n", key);
+    }
+    return 1;
+}
+
+void jobs_store_configure(const config_t *cfg) {
+    if (!cfg) return;
+    pthread_mutex_lock(&g_store_lock);
+    g_store_cfg = cfg->jobs;
+    if (g_store_cfg.store_max_kb < 16) g_store_cfg.store_max_kb = 16;
+    if (g_store_cfg.output_bytes < 0) g_store_cfg.output_bytes = 0;
+    pthread_mutex_unlock(&g_store_lock);
+    if (cfg->jobs.store_path[0]) {
+        fprintf(stderr, "jobs: recording history in %s\n", cfg->jobs.store_path);
+    }
+}
+
+/* Keep the last max bytes of a stream; *truncated is set when bytes were cut. */
+static void store_output(JSON_Object *o, const char *key, const char *buf, size_t len, int max) {
+    if (!buf) return;
+    int truncated = 0;
+    if (len > (size_t)max) {
+        buf += len - (size_t)max;
+        len = (size_t)max;
+        truncated = 1;
+    }
+    (void)exec_set_output(o, key, buf, len, 0);
+    if (truncated) {
+        char tkey[32];
+        snprintf(tkey, sizeof(tkey), "%s_truncated", key);
+        json_object_set_boolean(o, tkey, 1);
+    }
+}
+
+void jobs_store_record(const jobs_record_t *r) {
+    if (!r) return;
+    pthread_mutex_lock(&g_store_lock);
+    jobs_config_t sc = g_store_cfg;
+    pthread_mutex_unlock(&g_store_lock);
+    if (!sc.store_path[0]) return;
+
+    long long finished = r->finished_unix_ms > 0 ? r->finished_unix_ms : jobs_unix_ms();
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_number(o, "ts_unix_ms", (double)finished);
+    json_object_set_number(o, "started_unix_ms", (double)(finished - r->elapsed_ms));
+    json_object_set_string(o, "node", r->node ? r->node : "");
+    json_object_set_string(o, "source", r->source ? r->source : "");
+    json_object_set_string(o, "requester", r->requester ? r->requester : "local");
+    if (r->caller_role) {
+        json_object_set_string(o, "caller", r->caller ? r->caller : "");
+        json_object_set_string(o, "caller_role", r->caller_role);
+    }
+    if (r->request_id && *r->request_id) json_object_set_string(o, "request_id", r->request_id);
+    json_object_set_string(o, "path", r->path ? r->path : "");
+    if (r->args) json_object_set_value(o, "args", json_value_deep_copy(json_array_get_wrapping_value(r->args)));
+    if (r->job_id) json_object_set_number(o, "job_id", (double)r->job_id);
+    json_object_set_string(o, "status", r->canceled ? "canceled" :
+                                        r->spawned && r->rc == 0 ? "succeeded" : "failed");
+    if (r->spawned) json_object_set_number(o, "rc", r->rc);
+    json_object_set_number(o, "elapsed_ms", (double)r->elapsed_ms);
+    if (sc.output_bytes > 0) {
+        store_output(o, "stdout", r->out, r->out_len, sc.output_bytes);
+        store_output(o, "stderr", r->err, r->err_len, sc.output_bytes);
+    }
+    char *line = json_serialize_to_string(v);
+    json_value_free(v);
+    if (!line) return;
+
+    pthread_mutex_lock(&g_store_lock);
+    FILE *f = fopen(sc.store_path, "a");
+    if (f) {
+        fprintf(f, "%s\n", line);
+        fclose(f);
+        struct stat st;
+        if (stat(sc.store_path, &st) == 0 && st.st_size > (off_t)sc.store_max_kb * 1024) {
+            char rotated[sizeof(sc.store_path) + 4];
+            snprintf(rotated, sizeof(rotated), "%s.1", sc.store_path);
+            if (rename(sc.store_path, rotated) != 0) {
+                fprintf(stderr, "jobs: failed to rotate %s: %s\n", sc.store_path, strerror(errno));
+            }
+        }
+    } else {
+        fprintf(stderr, "jobs: cannot append to %s: %s\n", sc.store_path, strerror(errno));
+    }
+    pthread_mutex_unlock(&g_store_lock);
+    json_free_serialized_string(line);
+}
+
+typedef struct {
+    char node[64];
+    char status[16];
+    char command[128];
+    char request_id[JOBS_REQUEST_ID_MAX];
+    long long since_unix_ms;
+    long long until_unix_ms;   /* 0 = no upper bound */
+    int limit;
+} jobs_query_t;
+
+static int query_matches(const jobs_query_t *q, JSON_Object *o) {
+    const char *node = json_object_get_string(o, "node");
+    const char *status = json_object_get_string(o, "status");
+    const char *path = json_object_get_string(o, "path");
+    const char *request_id = json_object_get_string(o, "request_id");
+    if (q->node[0] && (!node || strcmp(node, q->node) != 0)) return 0;
+    if (q->request_id[0] && (!request_id || strcmp(request_id, q->request_id) != 0)) return 0;
+    if (q->status[0] && (!status || strcmp(status, q->status) != 0)) return 0;
+    if (q->command[0] && (!path || !strstr(path, q->command))) return 0;
+    if (q->since_unix_ms > 0 && json_object_has_value(o, "ts_unix_ms") &&
+        (long long)json_object_get_number(o, "ts_unix_ms") < q->since_unix_ms) return 0;
+    if (q->until_unix_ms > 0 && json_object_has_value(o, "ts_unix_ms") &&
+        (long long)json_object_get_number(o, "ts_unix_ms") > q->until_unix_ms) return 0;
+    return 1;
+}
+
+/* since/until: Unix seconds, or milliseconds for values that look like them.
+ * Anything but a plain non-negative integer is refused. */
+static int parse_query_time(const char *s, long long *out_ms) {
+    char *end = NULL;
+    errno = 0;
+    long long v = strtoll(s, &end, 10);
+    if (errno || end == s || *end || v < 0) return -1;
+    if (v <= 100000000000LL) v *= 1000LL;
+    *out_ms = v;
+    return 0;
+}
+
+/* Ring of the newest q->limit matches. */
+typedef struct {
+    JSON_Value **items;
+    int limit;
+    long total;
+} match_ring_t;
+
+static void ring_push(match_ring_t *r, JSON_Value *v) {
+    JSON_Value **slot = &r->items[r->total % r->limit];
+    if (*slot) json_value_free(*slot);
+    *slot = v;
+    r->total++;
+}
+
+static void query_store_file(const char *path, const jobs_query_t *q, match_ring_t *ring) {
+    FILE *f = fopen(path, "r");
+    if (!f) return;
+    char *line = NULL;
+    size_t cap = 0;
+    while (getline(&line, &cap, f) > 0) {
+        JSON_Value *v = json_parse_string(line);
+        if (!v) continue;
+        if (json_value_get_type(v) == JSONObject && query_matches(q, json_object(v))) {
+            ring_push(ring, v);
+        } else {
+            json_value_free(v);
+        }
+    }
+    free(line);
+    fclose(f);
+}
+
+static int h_jobs_query(struct mg_connection *c, const config_t *cfg, const jobs_query_t *q) {
+    long long now = now_ms();
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    JSON_Value *arr_v = json_value_init_array();
+    JSON_Array *arr = json_array(arr_v);
+    int local_node = !q->node[0] || strcmp(q->node, cfg->sync_id) == 0;
+
+    /* Running jobs have not finished, so an until bound leaves them out. */
+    if (local_node && !q->until_unix_ms && (!q->status[0] || strcmp(q->status, "running") == 0)) {
+        pthread_mutex_lock(&g_jobs_lock);
+        for (int i = 0; i < JOBS_MAX_RUNNING; i++) {
+            if (!g_running[i].in_use) continue;
+            if (q->command[0] && !strstr(g_running[i].path, q->command)) continue;
+            if (q->request_id[0] && strcmp(g_running[i].request_id, q->request_id) != 0) continue;
+            JSON_Value *v = job_to_json(&g_running[i], 1, now);
+            json_object_set_string(json_object(v), "status", "running");
+            json_object_set_string(json_object(v), "node", cfg->sync_id);
+            json_array_append_value(arr, v);
+        }
+        pthread_mutex_unlock(&g_jobs_lock);
+    }
+
+    match_ring_t ring = { calloc((size_t)q->limit, sizeof(JSON_Value *)), q->limit, 0 };
+    if (!ring.items) {
+        json_value_free(arr_v);
+        json_value_free(resp);
+        send_plain(c, 500, "out_of_memory", 1);
+        return 1;
+    }
+    const char *source = "memory";
+    if (strcmp(q->status, "running") != 0) {
+        if (cfg->jobs.store_path[0]) {
+            char rotated[sizeof(cfg->jobs.store_path) + 4];
+            snprintf(rotated, sizeof(rotated), "%s.1", cfg->jobs.store_path);
+            pthread_mutex_lock(&g_store_lock);
+            query_store_file(rotated, q, &ring);
+            query_store_file(cfg->jobs.store_path, q, &ring);
+            pthread_mutex_unlock(&g_store_lock);
+            source = "store";
+        } else if (local_node) {
+            /* No store: answer from the recent in-memory runs. */
+            pthread_mutex_lock(&g_jobs_lock);
+            unsigned long n = g_finished_next < JOBS_MAX_FINISHED ? g_finished_next : JOBS_MAX_FINISHED;
+            for (unsigned long k = n; k >= 1; k--) {
+                const job_entry_t *j = &g_finished[(g_finished_next - k) % JOBS_MAX_FINISHED];
+                if (!j->in_use) continue;
+                JSON_Value *v = job_to_json(j, 0, now);
+                json_object_set_string(json_object(v), "node", cfg->sync_id);
+                if (query_matches(q, json_object(v))) ring_push(&ring, v);
+                else json_value_free(v);
+            }
+            pthread_mutex_unlock(&g_jobs_lock);
+        }
+    }
+    /* Newest first. */
+    long kept = ring.total < ring.limit ? ring.total : ring.limit;
+    for (long k = 1; k <= kept; k++) {
+        JSON_Value **slot = &ring.items[(ring.total - k) % ring.limit];
+        json_array_append_value(arr, *slot);
+        *slot = NULL;
+    }
+    free(ring.items);
+
+    json_object_set_value(ro, "jobs", arr_v);
+    json_object_set_string(ro, "source", source);
+    if (ring.total > kept) json_object_set_boolean(ro, "truncated", 1);
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+    return 1;
+}
+
+static int h_jobs_list(struct mg_connection *c, const config_t *cfg, const char *qs) {
+    if (qs && *qs) {
+        jobs_query_t q;
+        memset(&q, 0, sizeof(q));
+        q.limit = 100;
+        char buf[32];
+        size_t qlen = strlen(qs);
+        int query = 0;
+        if (mg_get_var(qs, qlen, "node", q.node, sizeof(q.node)) > 0) query = 1; else q.node[0] = '\0';
+        if (mg_get_var(qs, qlen, "status", q.status, sizeof(q.status)) > 0) query = 1; else q.status[0] = '\0';
+        if (mg_get_var(qs, qlen, "command", q.command, sizeof(q.command)) > 0) query = 1; else q.command[0] = '\0';
+        if (mg_get_var(qs, qlen, "request_id", q.request_id, sizeof(q.request_id)) > 0) query = 1;
+        else q.request_id[0] = '\0';
+        const char *bad = NULL;
+        int n = mg_get_var(qs, qlen, "since", buf, sizeof(buf));
+        if (n != -1) {
+            if (n < 0 || parse_query_time(buf, &q.since_unix_ms) != 0) bad = "bad_since";
+            query = 1;
+        }
+        n = mg_get_var(qs, qlen, "until", buf, sizeof(buf));
+        if (n != -1) {
+            if (n < 0 || parse_query_time(buf, &q.until_unix_ms) != 0) bad = "bad_until";
+            query = 1;
+        }
+        if (mg_get_var(qs, qlen, "limit", buf, sizeof(buf)) > 0) {
+            q.limit = atoi(buf);
+            query = 1;
+        }
+        if (q.limit <= 0 || q.limit > 1000) q.limit = 1000;
+        if (!bad && q.status[0] && strcmp(q.status, "running") && strcmp(q.status, "succeeded") &&
+            strcmp(q.status, "failed") && strcmp(q.status, "canceled")) {
+            bad = "bad_status";
+        }
+        if (bad) {
+            send_json_error(c, 400, bad);
+            return 1;
+        }
+        if (query) return h_jobs_query(c, cfg, &q);
+    }
+
+    long long now = now_ms();
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    JSON_Value *run_v = json_value_init_array();
+    JSON_Value *fin_v = json_value_init_array();
+
+    pthread_mutex_lock(&g_jobs_lock);
+    for (int i = 0; i < JOBS_MAX_RUNNING; i++) {
+        if (g_running[i].in_use) {
+            json_array_append_value(json_array(run_v), job_to_json(&g_running[i], 1, now));
+        }
+    }
+    /* Newest first. */
+    unsigned long n = g_finished_next < JOBS_MAX_FINISHED ? g_finished_next : JOBS_MAX_FINISHED;
+    for (unsigned long k = 1; k <= n; k++) {
+        const job_entry_t *j = &g_finished[(g_finished_next - k) % JOBS_MAX_FINISHED];
+        if (j->in_use) json_array_append_value(json_array(fin_v), job_to_json(j, 0, now));
+    }
+    pthread_mutex_unlock(&g_jobs_lock);
+
+    json_object_set_value(ro, "running", run_v);
+    json_object_set_value(ro, "finished", fin_v);
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+    return 1;
+}
+
+static int h_job_stats(struct mg_connection *c, unsigned long id) {
+    long long now = now_ms();
+    JSON_Value *resp = NULL;
+    pid_t pid = 0;
+
+    pthread_mutex_lock(&g_jobs_lock);
+    job_entry_t *j = find_running_locked(id);
+    if (j) {
+        resp = job_to_json(j, 1, now);
+        pid = j->reaped ? 0 : j->pid;
+    } else if ((j = find_finished_locked(id)) != NULL) {
+        resp = job_to_json(j, 0, now);
+        JSON_Value *uv = json_value_init_object();
+        set_usage_json(json_object(uv), &j->usage);
+        json_object_set_value(json_object(resp), "usage", uv);
+    }
+    pthread_mutex_unlock(&g_jobs_lock);
+
+    if (!resp) {
+        send_json_error(c, 404, "job_not_found");
+        return 1;
+    }
+
+    if (pid > 0) {
+        /* Fresh per-process view of the tree for the caller. */
+        proc_sample_t tree[JOBS_MAX_TREE];
+        int n = sample_tree(pid, tree, JOBS_MAX_TREE);
+        JSON_Value *arr_v = json_value_init_array();
+        for (int i = 0; i < n; i++) {
+            JSON_Value *pv = json_value_init_object();
+            JSON_Object *po = json_object(pv);
+            json_object_set_number(po, "pid", (double)tree[i].pid);
+            json_object_set_number(po, "ppid", (double)tree[i].ppid);
+            json_object_set_string(po, "comm", tree[i].comm);
+            json_object_set_number(po, "cpu_ms", (double)tree[i].cpu_ms);
+            json_object_set_number(po, "rss_kb", (double)tree[i].rss_kb);
+            json_array_append_value(json_array(arr_v), pv);
+        }
+        json_object_set_value(json_object(resp), "processes", arr_v);
+    }
+
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+    return 1;
+}
+
+/* POST /jobs/{id}/cancel */
+static int h_job_cancel(struct mg_connection *c, unsigned long id) {
+    int r = jobs_cancel(id);
+    if (r < 0) {
+        send_json_error(c, 404, "job_not_found");
+        return 1;
+    }
+    if (r > 0) {
+        send_json_error(c, 409, "job_finished");
+        return 1;
+    }
+    JSON_Value *resp = json_value_init_object();
+    json_object_set_number(json_object(resp), "id", (double)id);
+    json_object_set_boolean(json_object(resp), "canceled", 1);
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+    return 1;
+}
+
+/* POST /jobs/cancel {"request_id":"..."}: what a master sends when the
+ * client of a dispatched /exec went away. */
+static int h_jobs_cancel_request(struct mg_connection *c) {
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        free(u.body);
+        send_json_error(c, 400, "body_read_failed");
+        return 1;
+    }
+    JSON_Value *root = json_parse_string(u.body ? u.body : "");
+    free(u.body);
+    if (!root || json_value_get_type(root) != JSONObject) {
+        if (root) json_value_free(root);
+        send_json_error(c, 400, "bad_json");
+        return 1;
+    }
+    const char *request_id = json_object_get_string(json_object(root), "request_id");
+    if (!request_id || !*request_id) {
+        json_value_free(root);
+        send_json_error(c, 400, "missing_request_id");
+        return 1;
+    }
+    int count = jobs_cancel_request(request_id);
+    if (count > 0) fprintf(stderr, "jobs: canceled %d job(s) of request %s\n", count, request_id);
+    JSON_Value *resp = json_value_init_object();
+    json_object_set_string(json_object(resp), "request_id", request_id);
+    json_object_set_number(json_object(resp), "canceled", count);
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+    json_value_free(root);
+    return 1;
+}
+
+static int h_jobs(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    int post = ri && strcmp(ri->request_method, "POST") == 0;
+    if (!ri || (!post && strcmp(ri->request_method, "GET") != 0)) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+    const char *uri = api_local_uri(c);
+    if (strcmp(uri, "/jobs/cancel") == 0) {
+        if (!post) {
+            send_plain(c, 405, "method_not_allowed", 1);
+            free(cfg);
+            return 1;
+        }
+        free(cfg);
+        return h_jobs_cancel_request(c);
+    }
+    if (strcmp(uri, "/jobs") == 0 || strcmp(uri, "/jobs/") == 0) {
+        if (post) {
+            send_plain(c, 405, "method_not_allowed", 1);
+            free(cfg);
+            return 1;
+        }
+        int rc = h_jobs_list(c, cfg, ri->query_string);
+        free(cfg);
+        return rc;
+    }
+
+    /* /jobs/{id}/stats, /jobs/{id}/cancel */
+    const char *p = uri + strlen("/jobs/");
+    char *end = NULL;
+    errno = 0;
+    unsigned long id = strtoul(p, &end, 10);
+    if (errno != 0 || end == p || (strcmp(end, "/stats") != 0 && strcmp(end, "/cancel") != 0)) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    if (post != (strcmp(end, "/cancel") == 0)) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+    free(cfg);
+    return post ? h_job_cancel(c, id) : h_job_stats(c, id);
+}
+
+void jobs_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    api_set_handler(ctx, "/jobs", h_jobs, app);
+}
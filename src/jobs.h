@@ -0,0 +1,97 @@
+#ifndef AUTOD_JOBS_H
+#define AUTOD_JOBS_H
+
+#include <stddef.h>
+#include <sys/types.h>
+
+#include "parson.h"
+
+#define JOBS_MAX_RUNNING 32
+#define JOBS_MAX_FINISHED 32
+
+/* [jobs] — persistent job history (JSON lines, one record per finished run). */
+typedef struct {
+    char store_path[256];     /* empty disables the store */
+    int  store_max_kb;        /* rotate to <store_path>.1 beyond this size */
+    int  output_bytes;        /* stdout/stderr tail kept per record */
+} jobs_config_t;
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_context;
+
+/* Final resource usage of one exec run. */
+typedef struct {
+    unsigned long job_id;
+    long long cpu_user_ms;
+    long long cpu_sys_ms;
+    long max_rss_kb;          /* highest sampled peak RSS (VmHWM) of one process in the tree */
+    long peak_tree_rss_kb;    /* sampled peak RSS summed across the live process tree */
+    int peak_procs;           /* sampled peak process count of the tree */
+    int canceled;             /* killed by a cancel request */
+    int timed_out;            /* killed at the exec timeout */
+    int timeout_ms;           /* the exec timeout the run had */
+    int cgroup;               /* ran in its own cgroup; the cg_* totals below are set */
+    long long cg_cpu_ms;
+    long long cg_throttled_ms;    /* time held back by cpu_pct */
+    long long cg_nr_throttled;
+    long cg_memory_peak_kb;       /* -1 when the kernel has no memory.peak */
+    long cg_oom_kills;
+    long long cg_io_read_bytes;
+    long long cg_io_write_bytes;
+} exec_usage_t;
+
+/* Track a forked handler, tagged with the caller's request_id (may be NULL).
+ * Returns the job id (0 when the table is full). A handler whose request was
+ * canceled before it started is killed straight away. */
+unsigned long jobs_start(pid_t pid, const char *path, const char *request_id);
+/* Sample /proc for the job's process tree; rate-limited internally. */
+void jobs_sample(unsigned long id);
+/* waitpid() that also records the child's rusage when it is reaped. */
+pid_t jobs_waitpid(unsigned long id, pid_t pid, int *status, int options);
+/* Move the job to the finished list and report its final usage. */
+void jobs_finish(unsigned long id, int rc, exec_usage_t *usage_out);
+/* Kill a running job's process tree. Returns 0 when it was running, 1 when it
+ * already finished and -1 when the id is unknown. */
+int jobs_cancel(unsigned long id);
+/* Kill every running job started for request_id and remember the id for a
+ * while, so a handler that has not been forked yet is killed as it starts.
+ * Returns how many running jobs were signalled. */
+int jobs_cancel_request(const char *request_id);
+
+/* One finished run for the history store. */
+typedef struct {
+    const char *node;         /* where it ran (sync id) */
+    const char *source;       /* exec, relay, startup, slot, mqtt_exec, ssh */
+    const char *requester;    /* client address, node id or "local" */
+    const char *caller;       /* verified identity that asked for it (may be NULL) */
+    const char *caller_role;  /* admin, client, master, local, anonymous (may be NULL) */
+    const char *request_id;   /* X-Request-ID of the request that ran it (may be NULL) */
+    const char *path;
+    JSON_Array *args;
+    unsigned long job_id;     /* local job id, 0 for remote runs */
+    int spawned;              /* 0 when the command never started */
+    int canceled;             /* stopped by a cancel request */
+    int rc;
+    long long elapsed_ms;
+    long long finished_unix_ms;   /* 0 = now */
+    const char *out;
+    size_t out_len;
+    const char *err;
+    size_t err_len;
+} jobs_record_t;
+
+void jobs_cfg_defaults(config_t *cfg);
+int jobs_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+/* Apply the [jobs] settings used by the history store (called once at startup). */
+void jobs_store_configure(const config_t *cfg);
+/* Append a record to the history store. No-op when the store is disabled. */
+void jobs_store_record(const jobs_record_t *r);
+long long jobs_unix_ms(void);
+
+/* Add job_id and a usage object to an exec result. No-op for untracked runs. */
+void exec_set_usage(JSON_Object *o, const exec_usage_t *u);
+
+void jobs_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
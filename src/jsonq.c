@@ -0,0 +1,541 @@
+#include <ctype.h>
+#include <errno.h>
+#include <limits.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include "jsonq.h"
+
+#define JSONQ_MAX_DEPTH 16
+#define JSONQ_MAX_STEPS 16
+#define JSONQ_MAX_PARTS 16
+
+typedef enum { JQ_PATH, JQ_PIPE, JQ_MAP, JQ_SELECT, JQ_BUILTIN } jq_kind_t;
+typedef enum { JQ_NONE, JQ_EQ, JQ_NE, JQ_LT, JQ_LE, JQ_GT, JQ_GE } jq_op_t;
+
+static const char *const g_builtins[] = {
+    "length", "add", "min", "max", "sort", "unique", "first", "last", "keys", "any", "all", "not",
+};
+#define JQ_BUILTIN_COUNT (int)(sizeof(g_builtins) / sizeof(g_builtins[0]))
+
+typedef struct {
+    char *key;                 /* NULL = array index */
+    int index;
+} jq_step_t;
+
+typedef struct jq_node jq_node_t;
+struct jq_node {
+    jq_kind_t kind;
+    jq_step_t steps[JSONQ_MAX_STEPS];    /* JQ_PATH */
+    int step_count;
+    jq_node_t *parts[JSONQ_MAX_PARTS];   /* JQ_PIPE */
+    int part_count;
+    jq_node_t *sub;                      /* JQ_MAP, JQ_SELECT */
+    jq_op_t op;                          /* JQ_SELECT */
+    JSON_Value *literal;
+    int builtin;                         /* JQ_BUILTIN */
+};
+
+struct jsonq {
+    jq_node_t *root;
+};
+
+typedef struct {
+    const char *src;
+    const char *p;
+    const char *why;
+    const char *at;
+    int depth;
+} jq_parser_t;
+
+static void jq_node_free(jq_node_t *n) {
+    if (!n) return;
+    for (int i = 0; i < n->step_count; i++) free(n->steps[i].key);
+    for (int i = 0; i < n->part_count; i++) jq_node_free(n->parts[i]);
+    jq_node_free(n->sub);
+    if (n->literal) json_value_free(n->literal);
+    free(n);
+}
+
+static void jq_skip_space(jq_parser_t *ps) {
+    while (isspace((unsigned char)*ps->p)) ps->p++;
+}
+
+static jq_node_t *jq_fail(jq_parser_t *ps, const char *why, jq_node_t *n) {
+    if (!ps->why) {
+        ps->why = why;
+        ps->at = ps->p;
+    }
+    jq_node_free(n);
+    return NULL;
+}
+
+static jq_node_t *jq_parse_pipe(jq_parser_t *ps);
+
+static jq_node_t *jq_parse_path(jq_parser_t *ps) {
+    jq_node_t *n = calloc(1, sizeof(*n));
+    if (!n) return jq_fail(ps, "out_of_memory", NULL);
+    n->kind = JQ_PATH;
+    ps->p++;                   /* the leading '.' */
+    int first = 1;
+    for (;;) {
+        if (n->step_count >= JSONQ_MAX_STEPS) return jq_fail(ps, "path_too_long", n);
+        jq_step_t *st = &n->steps[n->step_count];
+        if (*ps->p == '[') {
+            char *end = NULL;
+            errno = 0;
+            long idx = strtol(ps->p + 1, &end, 10);
+            if (end == ps->p + 1 || *end != ']') return jq_fail(ps, "expected_index", n);
+            if (errno == ERANGE || idx < INT_MIN || idx > INT_MAX) {
+                return jq_fail(ps, "index_out_of_range", n);
+            }
+            st->index = (int)idx;
+            n->step_count++;
+            ps->p = end + 1;
+        } else if (isalpha((unsigned char)*ps->p) || *ps->p == '_') {
+            if (!first && ps->p[-1] != '.') return jq_fail(ps, "unexpected_name", n);
+            const char *s = ps->p;
+            while (isalnum((unsigned char)*ps->p) || *ps->p == '_') ps->p++;
+            st->key = strndup(s, (size_t)(ps->p - s));
+            if (!st->key) return jq_fail(ps, "out_of_memory", n);
+            n->step_count++;
+        } else if (*ps->p == '"') {
+            const char *s = ++ps->p;
+            while (*ps->p && *ps->p != '"') ps->p++;
+            if (*ps->p != '"') return jq_fail(ps, "unterminated_string", n);
+            st->key = strndup(s, (size_t)(ps->p - s));
+            if (!st->key) return jq_fail(ps, "out_of_memory", n);
+            n->step_count++;
+            ps->p++;
+        } else if (!first) {
+            return jq_fail(ps, "expected_key", n);
+        }
+        first = 0;
+        if (*ps->p == '.' && (isalpha((unsigned char)ps->p[1]) || ps->p[1] == '_' || ps->p[1] == '"' ||
+                              ps->p[1] == '[')) {
+            ps->p++;
+            continue;
+        }
+        if (*ps->p == '[') continue;
+        return n;
+    }
+}
+
+/* A JSON literal after a comparison operator. */
+static JSON_Value *jq_parse_literal(jq_parser_t *ps) {
+    jq_skip_space(ps);
+    const char *s = ps->p;
+    if (*s == '"') {
+        const char *e = s + 1;
+        while (*e && *e != '"') e += *e == '\\' && e[1] ? 2 : 1;
+        if (*e != '"') return NULL;
+        ps->p = e + 1;
+    } else {
+        while (*ps->p && (isalnum((unsigned char)*ps->p) || strchr("+-.", *ps->p))) ps->p++;
+    }
+    char *text = strndup(s, (size_t)(ps->p - s));
+    JSON_Value *v = text ? json_parse_string(text) : NULL;
+    free(text);
+    if (v && (json_value_get_type(v) == JSONObject || json_value_get_type(v) == JSONArray)) {
+        json_value_free(v);
+        v = NULL;
+    }
+    return v;
+}
+
+static jq_op_t jq_parse_op(jq_parser_t *ps) {
+    static const struct { const char *text; jq_op_t op; } ops[] = {
+        {"==", JQ_EQ}, {"!=", JQ_NE}, {"<=", JQ_LE}, {">=", JQ_GE}, {"<", JQ_LT}, {">", JQ_GT},
+    };
+    jq_skip_space(ps);
+    for (size_t i = 0; i < sizeof(ops) / sizeof(ops[0]); i++) {
+        size_t len = strlen(ops[i].text);
+        if (!strncmp(ps->p, ops[i].text, len)) {
+            ps->p += len;
+            return ops[i].op;
+        }
+    }
+    return JQ_NONE;
+}
+
+static jq_node_t *jq_parse_term(jq_parser_t *ps) {
+    jq_skip_space(ps);
+    if (*ps->p == '.') return jq_parse_path(ps);
+    if (*ps->p == '(') {
+        ps->p++;
+        jq_node_t *n = jq_parse_pipe(ps);
+        if (!n) return NULL;
+        jq_skip_space(ps);
+        if (*ps->p != ')') return jq_fail(ps, "expected_close_paren", n);
+        ps->p++;
+        return n;
+    }
+    if (!isalpha((unsigned char)*ps->p)) return jq_fail(ps, "expected_filter", NULL);
+    const char *s = ps->p;
+    while (isalnum((unsigned char)*ps->p) || *ps->p == '_') ps->p++;
+    size_t len = (size_t)(ps->p - s);
+    jq_node_t *n = calloc(1, sizeof(*n));
+    if (!n) return jq_fail(ps, "out_of_memory", NULL);
+    if ((len == 3 && !strncmp(s, "map", 3)) || (len == 6 && !strncmp(s, "select", 6))) {
+        n->kind = len == 3 ? JQ_MAP : JQ_SELECT;
+        jq_skip_space(ps);
+        if (*ps->p != '(') return jq_fail(ps, "expected_open_paren", n);
+        ps->p++;
+        n->sub = jq_parse_pipe(ps);
+        if (!n->sub) return jq_fail(ps, "expected_filter", n);
+        if (n->kind == JQ_SELECT && (n->op = jq_parse_op(ps)) != JQ_NONE) {
+            n->literal = jq_parse_literal(ps);
+            if (!n->literal) return jq_fail(ps, "expected_literal", n);
+        }
+        jq_skip_space(ps);
+        if (*ps->p != ')') return jq_fail(ps, "expected_close_paren", n);
+        ps->p++;
+        return n;
+    }
+    n->kind = JQ_BUILTIN;
+    for (n->builtin = 0; n->builtin < JQ_BUILTIN_COUNT; n->builtin++) {
+        if (strlen(g_builtins[n->builtin]) == len && !strncmp(s, g_builtins[n->builtin], len)) return n;
+    }
+    ps->p = s;
+    return jq_fail(ps, "unknown_function", n);
+}
+
+static jq_node_t *jq_parse_pipe(jq_parser_t *ps) {
+    if (++ps->depth > JSONQ_MAX_DEPTH) return jq_fail(ps, "too_deep", NULL);
+    jq_node_t *n = calloc(1, sizeof(*n));
+    if (!n) return jq_fail(ps, "out_of_memory", NULL);
+    n->kind = JQ_PIPE;
+    for (;;) {
+        if (n->part_count >= JSONQ_MAX_PARTS) return jq_fail(ps, "too_many_pipes", n);
+        jq_node_t *t = jq_parse_term(ps);
+        if (!t) return jq_fail(ps, "expected_filter", n);
+        n->parts[n->part_count++] = t;
+        jq_skip_space(ps);
+        if (*ps->p != '|') break;
+        ps->p++;
+    }
+    ps->depth--;
+    if (n->part_count == 1) {
+        jq_node_t *only = n->parts[0];
+        n->part_count = 0;
+        jq_node_free(n);
+        return only;
+    }
+    return n;
+}
+
+jsonq_t *jsonq_compile(const char *expr, const char **why, int *at) {
+    jq_parser_t ps = { .src = expr ? expr : "", .p = expr ? expr : "" };
+    jq_node_t *root = jq_parse_pipe(&ps);
+    if (root) {
+        jq_skip_space(&ps);
+        if (*ps.p) root = jq_fail(&ps, "trailing_input", root);
+    }
+    jsonq_t *q = root ? malloc(sizeof(*q)) : NULL;
+    if (!q) {
+        jq_node_free(root);
+        if (why) *why = ps.why ? ps.why : "out_of_memory";
+        if (at) *at = ps.at ? (int)(ps.at - ps.src) : 0;
+        return NULL;
+    }
+    q->root = root;
+    return q;
+}
+
+void jsonq_free(jsonq_t *q) {
+    if (!q) return;
+    jq_node_free(q->root);
+    free(q);
+}
+
+/* ---------- evaluation ---------- */
+
+static int jq_rank(const JSON_Value *v) {
+    switch (json_value_get_type(v)) {
+    case JSONBoolean: return json_value_get_boolean(v) ? 2 : 1;
+    case JSONNumber: return 3;
+    case JSONString: return 4;
+    case JSONArray: return 5;
+    case JSONObject: return 6;
+    default: return 0;
+    }
+}
+
+static int jq_cmp(const JSON_Value *a, const JSON_Value *b) {
+    int ra = jq_rank(a), rb = jq_rank(b);
+    if (ra != rb) return ra < rb ? -1 : 1;
+    if (ra == 3) {
+        double x = json_value_get_number(a), y = json_value_get_number(b);
+        return x < y ? -1 : x > y;
+    }
+    if (ra == 4) return strcmp(json_value_get_string(a), json_value_get_string(b));
+    if (ra == 5) {
+        JSON_Array *x = json_value_get_array(a), *y = json_value_get_array(b);
+        size_t nx = json_array_get_count(x), ny = json_array_get_count(y);
+        for (size_t i = 0; i < nx && i < ny; i++) {
+            int c = jq_cmp(json_array_get_value(x, i), json_array_get_value(y, i));
+            if (c) return c;
+        }
+        return nx < ny ? -1 : nx > ny;
+    }
+    if (ra == 6) {
+        if (json_value_equals(a, b)) return 0;
+        char *x = json_serialize_to_string(a), *y = json_serialize_to_string(b);
+        int c = x && y ? strcmp(x, y) : 0;
+        json_free_serialized_string(x);
+        json_free_serialized_string(y);
+        return c;
+    }
+    return 0;
+}
+
+static int jq_truthy(const JSON_Value *v) {
+    int r = jq_rank(v);
+    return r != 0 && r != 1;
+}
+
+static int jq_sort_cmp(const void *a, const void *b) {
+    return jq_cmp(*(JSON_Value *const *)a, *(JSON_Value *const *)b);
+}
+
+/* Copies of arr's elements, sorted; with unique, equal ones once. */
+static JSON_Value *jq_sorted(JSON_Array *arr, int unique) {
+    size_t n = json_array_get_count(arr);
+    JSON_Value **items = calloc(n ? n : 1, sizeof(*items));
+    JSON_Value *out = json_value_init_array();
+    if (!items || !out) {
+        free(items);
+        if (out) json_value_free(out);
+        return NULL;
+    }
+    for (size_t i = 0; i < n; i++) items[i] = json_array_get_value(arr, i);
+    qsort(items, n, sizeof(*items), jq_sort_cmp);
+    for (size_t i = 0; i < n; i++) {
+        if (unique && i > 0 && jq_cmp(items[i - 1], items[i]) == 0) continue;
+        json_array_append_value(json_array(out), json_value_deep_copy(items[i]));
+    }
+    free(items);
+    return out;
+}
+
+static JSON_Value *jq_add(JSON_Array *arr, const char **why) {
+    JSON_Value *acc = NULL;
+    for (size_t i = 0; i < json_array_get_count(arr); i++) {
+        JSON_Value *v = json_array_get_value(arr, i);
+        JSON_Value_Type t = json_value_get_type(v);
+        if (t == JSONNull) continue;
+        if (!acc) {
+            acc = json_value_deep_copy(v);
+            continue;
+        }
+        JSON_Value_Type at = json_value_get_type(acc);
+        if (at != t) {
+            *why = "cannot_add_mixed_types";
+        } else if (t == JSONNumber) {
+            double sum = json_value_get_number(acc) + json_value_get_number(v);
+            json_value_free(acc);
+            acc = json_value_init_number(sum);
+            continue;
+        } else if (t == JSONString) {
+            const char *a = json_value_get_string(acc), *b = json_value_get_string(v);
+            size_t la = strlen(a), lb = strlen(b);
+            char *s = malloc(la + lb + 1);
+            if (!s) {
+                *why = "out_of_memory";
+            } else {
+                memcpy(s, a, la);
+                memcpy(s + la, b, lb + 1);
+                json_value_free(acc);
+                acc = json_value_init_string(s);
+                free(s);
+                continue;
+            }
+        } else if (t == JSONArray) {
+            JSON_Array *src = json_value_get_array(v);
+            for (size_t k = 0; k < json_array_get_count(src); k++) {
+                json_array_append_value(json_array(acc), json_value_deep_copy(json_array_get_value(src, k)));
+            }
+            continue;
+        } else if (t == JSONObject) {
+            JSON_Object *src = json_value_get_object(v);
+            for (size_t k = 0; k < json_object_get_count(src); k++) {
+                json_object_set_value(json_object(acc), json_object_get_name(src, k),
+                                      json_value_deep_copy(json_object_get_value_at(src, k)));
+            }
+            continue;
+        } else {
+            *why = "cannot_add_booleans";
+        }
+        json_value_free(acc);
+        return NULL;
+    }
+    return acc ? acc : json_value_init_null();
+}
+
+static JSON_Value *jq_builtin(int b, const JSON_Value *in, const char **why) {
+    const char *name = g_builtins[b];
+    JSON_Value_Type t = json_value_get_type(in);
+    JSON_Array *arr = t == JSONArray ? json_value_get_array(in) : NULL;
+    size_t n = json_array_get_count(arr);
+    if (!strcmp(name, "length")) {
+        if (t == JSONArray) return json_value_init_number((double)n);
+        if (t == JSONObject) return json_value_init_number((double)json_object_get_count(json_object(in)));
+        if (t == JSONString) return json_value_init_number((double)strlen(json_value_get_string(in)));
+        if (t == JSONNumber) {
+            double d = json_value_get_number(in);
+            return json_value_init_number(d < 0 ? -d : d);
+        }
+        if (t == JSONNull) return json_value_init_number(0);
+        *why = "boolean_has_no_length";
+        return NULL;
+    }
+    if (!strcmp(name, "not")) return json_value_init_boolean(!jq_truthy(in));
+    if (!strcmp(name, "keys")) {
+        if (t == JSONObject) {
+            JSON_Object *o = json_object(in);
+            JSON_Value *names = json_value_init_array();
+            for (size_t i = 0; i < json_object_get_count(o); i++) {
+                json_array_append_string(json_array(names), json_object_get_name(o, i));
+            }
+            JSON_Value *sorted = jq_sorted(json_array(names), 0);
+            json_value_free(names);
+            return sorted;
+        }
+        if (t == JSONArray) {
+            JSON_Value *idx = json_value_init_array();
+            for (size_t i = 0; i < n; i++) json_array_append_number(json_array(idx), (double)i);
+            return idx;
+        }
+        *why = "keys_needs_object_or_array";
+        return NULL;
+    }
+    if (!arr) {
+        *why = "needs_array";
+        return NULL;
+    }
+    if (!strcmp(name, "add")) return jq_add(arr, why);
+    if (!strcmp(name, "sort") || !strcmp(name, "unique")) {
+        JSON_Value *v = jq_sorted(arr, name[0] == 'u');
+        if (!v) *why = "out_of_memory";
+        return v;
+    }
+    if (!strcmp(name, "first") || !strcmp(name, "last")) {
+        if (!n) return json_value_init_null();
+        return json_value_deep_copy(json_array_get_value(arr, name[0] == 'f' ? 0 : n - 1));
+    }
+    if (!strcmp(name, "min") || !strcmp(name, "max")) {
+        const JSON_Value *best = NULL;
+        int sign = name[1] == 'i' ? -1 : 1;
+        for (size_t i = 0; i < n; i++) {
+            const JSON_Value *v = json_array_get_value(arr, i);
+            if (!best || jq_cmp(v, best) * sign > 0) best = v;
+        }
+        return best ? json_value_deep_copy(best) : json_value_init_null();
+    }
+    /* any, all */
+    int want_all = name[1] == 'l';
+    for (size_t i = 0; i < n; i++) {
+        int truth = jq_truthy(json_array_get_value(arr, i));
+        if (want_all && !truth) return json_value_init_boolean(0);
+        if (!want_all && truth) return json_value_init_boolean(1);
+    }
+    return json_value_init_boolean(want_all);
+}
+
+/* Returns a new value, or NULL: *empty set when the input was dropped,
+ * *why otherwise. */
+static JSON_Value *jq_eval(const jq_node_t *n, const JSON_Value *in, int *empty, const char **why) {
+    *empty = 0;
+    switch (n->kind) {
+    case JQ_PATH: {
+        const JSON_Value *cur = in;
+        for (int i = 0; i < n->step_count && cur; i++) {
+            const jq_step_t *st = &n->steps[i];
+            JSON_Value_Type t = json_value_get_type(cur);
+            if (t == JSONNull) break;
+            if (st->key) {
+                if (t != JSONObject) {
+                    *why = "cannot_index_with_key";
+                    return NULL;
+                }
+                cur = json_object_get_value(json_object(cur), st->key);
+            } else {
+                if (t != JSONArray) {
+                    *why = "cannot_index_with_number";
+                    return NULL;
+                }
+                JSON_Array *arr = json_value_get_array(cur);
+                long idx = st->index < 0 ? (long)json_array_get_count(arr) + st->index : st->index;
+                cur = idx < 0 ? NULL : json_array_get_value(arr, (size_t)idx);
+            }
+        }
+        return cur ? json_value_deep_copy(cur) : json_value_init_null();
+    }
+    case JQ_PIPE: {
+        JSON_Value *v = json_value_deep_copy(in);
+        for (int i = 0; i < n->part_count && v; i++) {
+            JSON_Value *next = jq_eval(n->parts[i], v, empty, why);
+            json_value_free(v);
+            v = next;
+        }
+        return v;
+    }
+    case JQ_MAP: {
+        if (json_value_get_type(in) != JSONArray) {
+            *why = "map_needs_array";
+            return NULL;
+        }
+        JSON_Array *arr = json_value_get_array(in);
+        JSON_Value *out = json_value_init_array();
+        for (size_t i = 0; i < json_array_get_count(arr); i++) {
+            int dropped = 0;
+            JSON_Value *r = jq_eval(n->sub, json_array_get_value(arr, i), &dropped, why);
+            if (r) json_array_append_value(json_array(out), r);
+            else if (!dropped) {
+                json_value_free(out);
+                return NULL;
+            }
+        }
+        return out;
+    }
+    case JQ_SELECT: {
+        int dropped = 0;
+        JSON_Value *r = jq_eval(n->sub, in, &dropped, why);
+        if (!r) {
+            *empty = dropped;
+            return NULL;
+        }
+        int keep;
+        if (n->op == JQ_NONE) {
+            keep = jq_truthy(r);
+        } else {
+            int c = jq_cmp(r, n->literal);
+            keep = n->op == JQ_EQ ? c == 0 : n->op == JQ_NE ? c != 0 : n->op == JQ_LT ? c < 0
+                 : n->op == JQ_LE ? c <= 0 : n->op == JQ_GT ? c > 0 : c >= 0;
+        }
+        json_value_free(r);
+        if (keep) return json_value_deep_copy(in);
+        *empty = 1;
+        return NULL;
+    }
+    case JQ_BUILTIN:
+        return jq_builtin(n->builtin, in, why);
+    }
+    *why = "bad_expression";
+    return NULL;
+}
+
+JSON_Value *jsonq_eval(const jsonq_t *q, const JSON_Value *input, const char **why) {
+    const char *dummy = NULL;
+    if (!why) why = &dummy;
+    *why = NULL;
+    if (!q || !input) {
+        *why = "bad_expression";
+        return NULL;
+    }
+    int empty = 0;
+    JSON_Value *v = jq_eval(q->root, input, &empty, why);
+    if (!v && empty) return json_value_init_null();
+    if (!v && !*why) *why = "out_of_memory";
+    return v;
+}
@@ -0,0 +1,30 @@
+#ifndef AUTOD_JSONQ_H
+#define AUTOD_JSONQ_H
+
+#include <stddef.h>
+
+#include "parson.h"
+
+/* A small subset of jq for reducing merged results on the master:
+ *
+ *   .  .a  .a.b  .[0]  .a[1]      paths (missing keys give null)
+ *   A | B                         pipe
+ *   map(F)                        F on every element; elements F drops go
+ *   select(F) select(F OP LIT)    keep the input when F is true, or compares
+ *                                 to a JSON literal with == != < <= > >=
+ *   length add min max sort unique first last keys any all not
+ *
+ * Values order as in jq: null < false < true < numbers < strings < arrays
+ * < objects. No generators, arithmetic or object construction. */
+typedef struct jsonq jsonq_t;
+
+/* Compile expr. Returns NULL with why (and the offset it refers to) set
+ * when it is not valid. */
+jsonq_t *jsonq_compile(const char *expr, const char **why, int *at);
+void jsonq_free(jsonq_t *q);
+
+/* Run q on input. Returns a new value the caller frees, or NULL with why set;
+ * an input the expression drops gives a JSON null. */
+JSON_Value *jsonq_eval(const jsonq_t *q, const JSON_Value *input, const char **why);
+
+#endif
@@ -0,0 +1,406 @@
+#define _GNU_SOURCE
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <errno.h>
+#include <fcntl.h>
+#include <poll.h>
+#include <signal.h>
+#include <time.h>
+#include <unistd.h>
+#include <pthread.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "dnscache.h"
+#include "httpc.h"
+#include "logs.h"
+
+extern volatile sig_atomic_t g_stop;
+
+#define LOGS_DEFAULT_LINES 100
+#define LOGS_KEEPALIVE_MS 15000
+#define LOGS_PROXY_TIMEOUT_MS 5000
+
+typedef struct {
+    unsigned long long seq;
+    long long ts_ms;
+    char *line;
+} logs_entry_t;
+
+static pthread_mutex_t g_logs_lock = PTHREAD_MUTEX_INITIALIZER;
+static pthread_cond_t g_logs_cond = PTHREAD_COND_INITIALIZER;
+static logs_entry_t g_logs[LOGS_RING_LINES];
+static unsigned long long g_logs_next_seq = 1;
+static int g_logs_followers;
+
+static int g_logs_pipe_rd = -1;
+static int g_logs_stderr_fd = -1;   /* the stderr autod was started with */
+
+static void logs_store(const char *line, size_t len) {
+    char *copy = (char *)malloc(len + 1);
+    if (!copy) return;
+    memcpy(copy, line, len);
+    copy[len] = '\0';
+
+    pthread_mutex_lock(&g_logs_lock);
+    unsigned long long seq = g_logs_next_seq++;
+    logs_entry_t *e = &g_logs[seq % LOGS_RING_LINES];
+    free(e->line);
+    e->seq = seq;
+    e->ts_ms = now_ms();
+    e->line = copy;
+    pthread_cond_broadcast(&g_logs_cond);
+    pthread_mutex_unlock(&g_logs_lock);
+}
+
+static void *logs_reader_main(void *arg) {
+    (void)arg;
+    char buf[1024];
+    char line[LOGS_LINE_MAX];
+    size_t len = 0;
+    for (;;) {
+        ssize_t r = read(g_logs_pipe_rd, buf, sizeof(buf));
+        if (r < 0 && errno == EINTR) continue;
+        if (r <= 0) break;
+        /* Pass everything through first so the console never lags behind. */
+        for (ssize_t off = 0; off < r; ) {
+            ssize_t w = write(g_logs_stderr_fd, buf + off, (size_t)(r - off));
+            if (w < 0 && errno == EINTR) continue;
+            if (w <= 0) break;
+            off += w;
+        }
+        for (ssize_t i = 0; i < r; i++) {
+            char ch = buf[i];
+            if (ch == '\n') {
+                while (len > 0 && line[len - 1] == '\r') len--;
+                logs_store(line, len);
+                len = 0;
+            } else if (len < sizeof(line) - 1) {
+                /* Longer lines are cut at LOGS_LINE_MAX. */
+                line[len++] = ch;
+            }
+        }
+    }
+    if (len > 0) logs_store(line, len);
+    return NULL;
+}
+
+int logs_capture_start(void) {
+    if (g_logs_pipe_rd >= 0) return 0;
+    int fds[2];
+    if (pipe2(fds, O_CLOEXEC) != 0) return -1;
+    int saved = fcntl(STDERR_FILENO, F_DUPFD_CLOEXEC, 3);
+    if (saved < 0) {
+        close(fds[0]);
+        close(fds[1]);
+        return -1;
+    }
+    fflush(stderr);
+    if (dup2(fds[1], STDERR_FILENO) < 0) {
+        close(saved);
+        close(fds[0]);
+        close(fds[1]);
+        return -1;
+    }
+    close(fds[1]);
+    g_logs_pipe_rd = fds[0];
+    g_logs_stderr_fd = saved;
+
+    pthread_t th;
+    if (pthread_create(&th, NULL, logs_reader_main, NULL) != 0) {
+        /* Nobody would drain the pipe; put the original stderr back. */
+        dup2(saved, STDERR_FILENO);
+        close(saved);
+        close(fds[0]);
+        g_logs_pipe_rd = g_logs_stderr_fd = -1;
+        return -1;
+    }
+    pthread_detach(th);
+    return 0;
+}
+
+/* Lines after *cursor, oldest first, as NDJSON into a malloc'd buffer.
+ * Advances *cursor; *dropped counts lines after it that already left the
+ * ring. Returns NULL when there is nothing new. */
+static char *logs_render_since(unsigned long long *cursor, const char *node, int max_lines,
+                               unsigned long long *dropped) {
+    JSON_Value *arr_v = json_value_init_array();
+    JSON_Array *arr = json_array(arr_v);
+    pthread_mutex_lock(&g_logs_lock);
+    unsigned long long last = g_logs_next_seq - 1;
+    unsigned long long oldest = last >= LOGS_RING_LINES ? last - LOGS_RING_LINES + 1 : 1;
+    unsigned long long start = *cursor + 1;
+    if (dropped) *dropped = *cursor && start < oldest ? oldest - start : 0;
+    if (start < oldest) start = oldest;
+    if (max_lines > 0 && last >= (unsigned long long)max_lines &&
+        start < last - (unsigned long long)max_lines + 1) {
+        start = last - (unsigned long long)max_lines + 1;
+    }
+    for (unsigned long long seq = start; seq <= last; seq++) {
+        logs_entry_t *e = &g_logs[seq % LOGS_RING_LINES];
+        if (e->seq != seq || !e->line) continue;
+        JSON_Value *item = json_value_init_object();
+        JSON_Object *io = json_object(item);
+        json_object_set_number(io, "seq", (double)e->seq);
+        json_object_set_number(io, "ts_ms", (double)e->ts_ms);
+        if (node && *node) json_object_set_string(io, "node", node);
+        if (json_object_set_string(io, "line", e->line) != JSONSuccess) {
+            /* Not valid UTF-8: keep the ASCII part readable. */
+            char safe[LOGS_LINE_MAX];
+            snprintf(safe, sizeof(safe), "%s", e->line);
+            for (char *p = safe; *p; p++) {
+                if ((unsigned char)*p >= 0x80) *p = '?';
+            }
+            json_object_set_string(io, "line", safe);
+        }
+        json_array_append_value(arr, item);
+    }
+    *cursor = last;
+    pthread_mutex_unlock(&g_logs_lock);
+
+    size_t count = json_array_get_count(arr);
+    size_t cap = 0;
+    char *out = NULL;
+    size_t len = 0;
+    for (size_t i = 0; i < count; i++) {
+        char *s = json_serialize_to_string(json_array_get_value(arr, i));
+        if (!s) continue;
+        size_t n = strlen(s);
+        if (len + n + 2 > cap) {
+            size_t ncap = cap ? cap * 2 : 4096;
+            while (ncap < len + n + 2) ncap *= 2;
+            char *tmp = (char *)realloc(out, ncap);
+            if (!tmp) {
+                json_free_serialized_string(s);
+                break;
+            }
+            out = tmp;
+            cap = ncap;
+        }
+        memcpy(out + len, s, n);
+        len += n;
+        out[len++] = '\n';
+        out[len] = '\0';
+        json_free_serialized_string(s);
+    }
+    json_value_free(arr_v);
+    return out;
+}
+
+static void logs_send_stream_headers(struct mg_connection *c) {
+    mg_printf(c, "HTTP/1.1 200 OK\r\n"
+                 "Content-Type: application/x-ndjson\r\n"
+                 "Cache-Control: no-store\r\n"
+                 "Access-Control-Allow-Origin: *\r\n");
+    api_print_headers(c, 1);
+    mg_printf(c, "Connection: close\r\n\r\n");
+}
+
+static void logs_serve_local(struct mg_connection *c, const config_t *cfg, int lines, int follow) {
+    if (follow) {
+        pthread_mutex_lock(&g_logs_lock);
+        int busy = g_logs_followers >= LOGS_MAX_FOLLOWERS;
+        if (!busy) g_logs_followers++;
+        pthread_mutex_unlock(&g_logs_lock);
+        if (busy) {
+            send_json_error(c, 503, "too_many_followers");
+            return;
+        }
+    }
+
+    logs_send_stream_headers(c);
+    unsigned long long cursor = 0;
+    char *chunk = NULL;
+    if (lines > 0) {
+        chunk = logs_render_since(&cursor, cfg->sync_id, lines, NULL);
+    } else {
+        pthread_mutex_lock(&g_logs_lock);
+        cursor = g_logs_next_seq - 1;
+        pthread_mutex_unlock(&g_logs_lock);
+    }
+    bandwidth_stream_t bw;
+    bandwidth_stream_begin(&bw, c, cfg);
+    int broken = chunk && bandwidth_write(&bw, chunk, strlen(chunk)) <= 0;
+    free(chunk);
+
+    /* Followers wait for new lines. An empty line goes out while idle so a
+     * client that went away is noticed without waiting for the next log.
+     * A follower read slower than the daemon logs is told how many lines
+     * it missed instead of being buffered for. */
+    long long last_write = now_ms();
+    while (follow && !broken && !g_stop) {
+        pthread_mutex_lock(&g_logs_lock);
+        if (g_logs_next_seq - 1 == cursor) {
+            struct timespec ts;
+            clock_gettime(CLOCK_REALTIME, &ts);
+            ts.tv_sec += 1;
+            (void)pthread_cond_timedwait(&g_logs_cond, &g_logs_lock, &ts);
+        }
+        pthread_mutex_unlock(&g_logs_lock);
+
+        unsigned long long dropped = 0;
+        chunk = logs_render_since(&cursor, cfg->sync_id, 0, &dropped);
+        if (dropped) {
+            char note[64];
+            int n = snprintf(note, sizeof(note), "{\"dropped\":%llu}\n", dropped);
+            broken = bandwidth_write(&bw, note, (size_t)n) <= 0;
+        }
+        if (chunk) {
+            if (!broken) broken = bandwidth_write(&bw, chunk, strlen(chunk)) <= 0;
+            free(chunk);
+            last_write = now_ms();
+        } else if (!broken && now_ms() - last_write >= LOGS_KEEPALIVE_MS) {
+            broken = bandwidth_write(&bw, "\n", 1) <= 0;
+            last_write = now_ms();
+        }
+    }
+
+    if (follow) {
+        pthread_mutex_lock(&g_logs_lock);
+        g_logs_followers--;
+        pthread_mutex_unlock(&g_logs_lock);
+    }
+}
+
+/* Master: relay a slave's /logs/tail byte for byte, following included. */
+static void logs_proxy(struct mg_connection *c, app_t *app, const config_t *cfg,
+                       const char *node, int lines, int follow) {
+    sync_node_addr_t *nodes = calloc(SYNC_MAX_SLAVES, sizeof(*nodes));
+    int count = nodes ? sync_master_list_nodes(app, cfg, nodes, SYNC_MAX_SLAVES) : 0;
+    sync_node_addr_t target;
+    int found = 0;
+    for (int i = 0; i < count; i++) {
+        if (!strcmp(nodes[i].id, node)) {
+            target = nodes[i];
+            found = 1;
+            break;
+        }
+    }
+    free(nodes);
+    if (!found) {
+        send_json_error(c, 404, "unknown_node");
+        return;
+    }
+    if (strcmp(target.transport, "http") != 0) {
+        send_json_error(c, 409, "unsupported_transport");
+        return;
+    }
+    char address[16];
+    if (!target.host[0] ||
+        dnscache_resolve(target.host, cfg->sync_dns_ttl_s, address, sizeof(address)) != 0) {
+        send_json_error(c, 502, "node_unreachable");
+        return;
+    }
+
+    /* The slave writes a keepalive line well within this, so a silent socket
+     * means the slave is gone. */
+    int timeout_ms = follow ? LOGS_KEEPALIVE_MS + LOGS_PROXY_TIMEOUT_MS : LOGS_PROXY_TIMEOUT_MS;
+    int fd = httpc_connect(address, target.port, timeout_ms);
+    if (fd < 0) {
+        send_json_error(c, 502, "node_unreachable");
+        return;
+    }
+    char identity[HTTPC_IDENTITY_MAX];
+    if (httpc_identity(identity, sizeof(identity)) < 0) identity[0] = '\0';
+    char req[256 + HTTPC_IDENTITY_MAX];
+    int n = snprintf(req, sizeof(req),
+                     "GET /logs/tail?lines=%d%s HTTP/1.1\r\nHost: %s:%d\r\n%sConnection: close\r\n\r\n",
+                     lines, follow ? "&follow=true" : "", address, target.port, identity);
+    if (n <= 0 || n >= (int)sizeof(req) || write(fd, req, (size_t)n) != n) {
+        close(fd);
+        send_json_error(c, 502, "node_unreachable");
+        return;
+    }
+
+    bandwidth_stream_t bw;
+    bandwidth_stream_begin(&bw, c, cfg);
+    char buf[4096];
+    int relayed = 0;
+    long long last_read = now_ms();
+    while (!g_stop) {
+        /* Wake up every second so shutdown does not wait on a quiet slave. */
+        struct pollfd pfd = { .fd = fd, .events = POLLIN };
+        int pr = poll(&pfd, 1, 1000);
+        if (pr < 0 && errno == EINTR) continue;
+        if (pr < 0) break;
+        if (pr == 0) {
+            if (now_ms() - last_read >= timeout_ms) break;
+            continue;
+        }
+        ssize_t r = read(fd, buf, sizeof(buf));
+        if (r < 0 && errno == EINTR) continue;
+        if (r <= 0) break;
+        last_read = now_ms();
+        if (bandwidth_write(&bw, buf, (size_t)r) <= 0) break;
+        relayed = 1;
+    }
+    close(fd);
+    if (!relayed) send_json_error(c, 502, "node_unreachable");
+}
+
+/*
+ * GET /logs/tail?lines=N[&follow=true][&node=ID] — the last N lines this
+ * daemon logged, one JSON object per line. follow keeps the response open
+ * and streams new lines as they are written. On a master, node selects a
+ * registered slave whose log is relayed instead.
+ */
+static int h_logs_tail(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri || strcmp(ri->request_method, "GET") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+
+    int lines = LOGS_DEFAULT_LINES;
+    int follow = 0;
+    char node[64] = "";
+    const char *qs = ri->query_string;
+    if (qs) {
+        char buf[32];
+        size_t qlen = strlen(qs);
+        if (mg_get_var(qs, qlen, "lines", buf, sizeof(buf)) > 0) {
+            char *end = NULL;
+            long v = strtol(buf, &end, 10);
+            if (!end || *end || v < 0) {
+                send_json_error(c, 400, "invalid_lines");
+                free(cfg);
+                return 1;
+            }
+            lines = v > LOGS_RING_LINES ? LOGS_RING_LINES : (int)v;
+        }
+        if (mg_get_var(qs, qlen, "follow", buf, sizeof(buf)) > 0) {
+            follow = !strcasecmp(buf, "true") || !strcmp(buf, "1") || !strcasecmp(buf, "yes");
+        }
+        if (mg_get_var(qs, qlen, "node", node, sizeof(node)) <= 0) node[0] = '\0';
+    }
+
+    if (node[0] && strcmp(node, cfg->sync_id) != 0) {
+        if (strcasecmp(cfg->sync_role, "master") != 0) {
+            send_json_error(c, 404, "unknown_node");
+            free(cfg);
+            return 1;
+        }
+        logs_proxy(c, app, cfg, node, lines, follow);
+        free(cfg);
+        return 1;
+    }
+    logs_serve_local(c, cfg, lines, follow);
+    free(cfg);
+    return 1;
+}
+
+void logs_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    api_set_handler(ctx, "/logs/tail", h_logs_tail, app);
+}
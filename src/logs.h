@@ -0,0 +1,19 @@
+#ifndef AUTOD_LOGS_H
+#define AUTOD_LOGS_H
+
+#define LOGS_RING_LINES 512
+#define LOGS_LINE_MAX 512
+#define LOGS_MAX_FOLLOWERS 1
+
+typedef struct app app_t;
+struct mg_context;
+
+/* Route the daemon's stderr through a pipe so every line it logs is kept in
+ * an in-memory ring (for GET /logs/tail) and still written to the original
+ * stderr. Call once, early in main(). Returns 0 on success; on failure
+ * logging is left untouched and the endpoint serves an empty ring. */
+int logs_capture_start(void);
+
+void logs_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
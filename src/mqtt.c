@@ -0,0 +1,287 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <errno.h>
+#include <time.h>
+#include <unistd.h>
+#include <poll.h>
+#include <sys/types.h>
+#include <sys/socket.h>
+
+#include "httpc.h"
+#include "mqtt.h"
+
+#define MQTT_KEEPALIVE_S 30
+#define MQTT_MAX_PACKET (256 * 1024)
+
+static long long mqtt_now_ms(void) {
+    struct timespec ts;
+    clock_gettime(CLOCK_MONOTONIC, &ts);
+    return (long long)ts.tv_sec * 1000LL + ts.tv_nsec / 1000000LL;
+}
+
+int mqtt_parse_url(const char *url, char *host, size_t host_sz, int *port) {
+    if (!url || !host || host_sz == 0 || !port) return -1;
+    const char *p = url;
+    if (strncmp(p, "mqtt://", 7) == 0) p += 7;
+    else if (strncmp(p, "tcp://", 6) == 0) p += 6;
+    else if (strstr(p, "://")) return -1;
+
+    size_t len = strcspn(p, "/");
+    const char *colon = memchr(p, ':', len);
+    size_t name_len = colon ? (size_t)(colon - p) : len;
+    if (name_len == 0 || name_len >= host_sz) return -1;
+    memcpy(host, p, name_len);
+    host[name_len] = '\0';
+    *port = 1883;
+    if (colon) {
+        char tmp[16];
+        size_t port_len = len - name_len - 1;
+        if (port_len == 0 || port_len >= sizeof(tmp)) return -1;
+        memcpy(tmp, colon + 1, port_len);
+        tmp[port_len] = '\0';
+        *port = atoi(tmp);
+        if (*port <= 0 || *port > 65535) return -1;
+    }
+    return 0;
+}
+
+static int mqtt_send_all(int fd, const unsigned char *buf, size_t len) {
+    while (len > 0) {
+        ssize_t w = send(fd, buf, len, 0);
+        if (w < 0) {
+            if (errno == EINTR) continue;
+            return -1;
+        }
+        buf += w;
+        len -= (size_t)w;
+    }
+    return 0;
+}
+
+static int mqtt_recv_all(int fd, unsigned char *buf, size_t len) {
+    while (len > 0) {
+        ssize_t r = recv(fd, buf, len, 0);
+        if (r < 0 && errno == EINTR) continue;
+        if (r <= 0) return -1;
+        buf += r;
+        len -= (size_t)r;
+    }
+    return 0;
+}
+
+/* Encode the fixed header (type byte + variable-length remaining length). */
+static size_t mqtt_fixed_header(unsigned char *out, unsigned char type, size_t remaining) {
+    size_t n = 0;
+    out[n++] = type;
+    do {
+        unsigned char b = (unsigned char)(remaining % 128);
+        remaining /= 128;
+        if (remaining > 0) b |= 0x80;
+        out[n++] = b;
+    } while (remaining > 0 && n < 5);
+    return n;
+}
+
+static size_t mqtt_put_string(unsigned char *out, const char *s, size_t len) {
+    out[0] = (unsigned char)((len >> 8) & 0xff);
+    out[1] = (unsigned char)(len & 0xff);
+    memcpy(out + 2, s, len);
+    return len + 2;
+}
+
+static int mqtt_connect(int fd, const char *client_id, int keepalive_s) {
+    size_t id_len = client_id ? strlen(client_id) : 0;
+    if (id_len > 64) id_len = 64;
+    size_t remaining = 10 + 2 + id_len;
+    unsigned char pkt[96];
+    size_t n = mqtt_fixed_header(pkt, 0x10, remaining);
+    n += mqtt_put_string(pkt + n, "MQTT", 4);
+    pkt[n++] = 0x04;                 /* protocol level 3.1.1 */
+    pkt[n++] = 0x02;                 /* clean session */
+    pkt[n++] = (unsigned char)((keepalive_s >> 8) & 0xff);
+    pkt[n++] = (unsigned char)(keepalive_s & 0xff);
+    n += mqtt_put_string(pkt + n, client_id ? client_id : "", id_len);
+    if (mqtt_send_all(fd, pkt, n) != 0) return -1;
+
+    unsigned char ack[4];
+    if (mqtt_recv_all(fd, ack, sizeof(ack)) != 0) return -1;
+    if (ack[0] != 0x20 || ack[1] != 0x02) return -1;
+    return ack[3] == 0 ? 0 : -1;
+}
+
+int mqtt_client_connect(mqtt_client_t *c, const char *host, int port,
+                        const char *client_id, int keepalive_s, int timeout_ms) {
+    if (!c || !host) return -1;
+    memset(c, 0, sizeof(*c));
+    c->fd = httpc_connect(host, port > 0 ? port : 1883, timeout_ms);
+    if (c->fd < 0) return -1;
+    c->keepalive_s = keepalive_s > 0 ? keepalive_s : MQTT_KEEPALIVE_S;
+    c->next_packet_id = 1;
+    if (mqtt_connect(c->fd, client_id, c->keepalive_s) != 0) {
+        close(c->fd);
+        c->fd = -1;
+        return -1;
+    }
+    c->last_tx_ms = mqtt_now_ms();
+    return 0;
+}
+
+void mqtt_client_close(mqtt_client_t *c) {
+    if (!c || c->fd < 0) return;
+    static const unsigned char disconnect[2] = { 0xe0, 0x00 };
+    (void)mqtt_send_all(c->fd, disconnect, sizeof(disconnect));
+    close(c->fd);
+    c->fd = -1;
+}
+
+int mqtt_client_subscribe(mqtt_client_t *c, const char *topic_filter) {
+    if (!c || c->fd < 0 || !topic_filter) return -1;
+    size_t len = strlen(topic_filter);
+    if (len == 0 || len > 512) return -1;
+    unsigned char pkt[5 + 2 + 2 + 512 + 1];
+    size_t n = mqtt_fixed_header(pkt, 0x82, 2 + 2 + len + 1);
+    unsigned short id = c->next_packet_id++;
+    if (c->next_packet_id == 0) c->next_packet_id = 1;
+    pkt[n++] = (unsigned char)(id >> 8);
+    pkt[n++] = (unsigned char)(id & 0xff);
+    n += mqtt_put_string(pkt + n, topic_filter, len);
+    pkt[n++] = 0x00;                 /* requested QoS 0 */
+    if (mqtt_send_all(c->fd, pkt, n) != 0) return -1;
+    c->last_tx_ms = mqtt_now_ms();
+    return 0;
+}
+
+int mqtt_client_publish(mqtt_client_t *c, const char *topic,
+                        const void *payload, size_t payload_len) {
+    if (!c || c->fd < 0 || !topic) return -1;
+    size_t topic_len = strlen(topic);
+    if (topic_len == 0 || topic_len > 0xffff) return -1;
+    size_t remaining = 2 + topic_len + payload_len;
+    if (remaining > MQTT_MAX_PACKET) return -1;
+    unsigned char *pkt = malloc(5 + remaining);
+    if (!pkt) return -1;
+    size_t n = mqtt_fixed_header(pkt, 0x30, remaining);
+    n += mqtt_put_string(pkt + n, topic, topic_len);
+    if (payload_len) memcpy(pkt + n, payload, payload_len);
+    n += payload_len;
+    int rc = mqtt_send_all(c->fd, pkt, n);
+    free(pkt);
+    if (rc == 0) c->last_tx_ms = mqtt_now_ms();
+    return rc;
+}
+
+static int mqtt_read_packet(mqtt_client_t *c, unsigned char *type,
+                            unsigned char **body, size_t *body_len) {
+    unsigned char b;
+    if (mqtt_recv_all(c->fd, type, 1) != 0) return -1;
+    size_t len = 0, mult = 1;
+    for (int i = 0; i < 4; i++) {
+        if (mqtt_recv_all(c->fd, &b, 1) != 0) return -1;
+        len += (size_t)(b & 0x7f) * mult;
+        mult *= 128;
+        if (!(b & 0x80)) break;
+        if (i == 3) return -1;
+    }
+    if (len > MQTT_MAX_PACKET) return -1;
+    unsigned char *buf = malloc(len + 1);
+    if (!buf) return -1;
+    if (len > 0 && mqtt_recv_all(c->fd, buf, len) != 0) {
+        free(buf);
+        return -1;
+    }
+    buf[len] = '\0';
+    *body = buf;
+    *body_len = len;
+    return 0;
+}
+
+int mqtt_client_poll(mqtt_client_t *c, int timeout_ms,
+                     char **topic, char **payload, size_t *payload_len) {
+    if (!c || c->fd < 0 || !topic || !payload) return -1;
+    *topic = NULL;
+    *payload = NULL;
+    if (payload_len) *payload_len = 0;
+    long long deadline = mqtt_now_ms() + (timeout_ms > 0 ? timeout_ms : 0);
+    for (;;) {
+        long long now = mqtt_now_ms();
+        if (now - c->last_tx_ms >= (long long)c->keepalive_s * 500LL) {
+            static const unsigned char ping[2] = { 0xc0, 0x00 };
+            if (mqtt_send_all(c->fd, ping, sizeof(ping)) != 0) return -1;
+            c->last_tx_ms = now;
+        }
+        long long wait = deadline - now;
+        if (wait < 0) wait = 0;
+        if (wait > 1000) wait = 1000;
+        struct pollfd pfd = { .fd = c->fd, .events = POLLIN };
+        int pr = poll(&pfd, 1, (int)wait);
+        if (pr < 0) {
+            if (errno == EINTR) continue;
+            return -1;
+        }
+        if (pr == 0) {
+            if (mqtt_now_ms() >= deadline) return 0;
+            continue;
+        }
+
+        unsigned char type = 0;
+        unsigned char *body = NULL;
+        size_t len = 0;
+        if (mqtt_read_packet(c, &type, &body, &len) != 0) return -1;
+        if ((type >> 4) != 3 || len < 2) {
+            free(body);          /* SUBACK, PINGRESP, ... */
+            continue;
+        }
+        size_t topic_len = ((size_t)body[0] << 8) | body[1];
+        size_t off = 2 + topic_len;
+        if (((type >> 1) & 0x03) != 0) off += 2;   /* packet id for QoS > 0 */
+        if (off > len) {
+            free(body);
+            continue;
+        }
+        char *t = malloc(topic_len + 1);
+        char *p = malloc(len - off + 1);
+        if (!t || !p) {
+            free(t);
+            free(p);
+            free(body);
+            return -1;
+        }
+        memcpy(t, body + 2, topic_len);
+        t[topic_len] = '\0';
+        memcpy(p, body + off, len - off);
+        p[len - off] = '\0';
+        free(body);
+        *topic = t;
+        *payload = p;
+        if (payload_len) *payload_len = len - off;
+        return 1;
+    }
+}
+
+int mqtt_topic_matches(const char *filter, const char *topic) {
+    if (!filter || !topic) return 0;
+    while (*filter) {
+        if (*filter == '#') return 1;
+        if (*filter == '+') {
+            while (*topic && *topic != '/') topic++;
+            filter++;
+            continue;
+        }
+        if (*filter != *topic) return 0;
+        filter++;
+        topic++;
+    }
+    return *topic == '\0';
+}
+
+int mqtt_publish_once(const char *host, int port, const char *client_id,
+                      const char *topic, const void *payload, size_t payload_len,
+                      int timeout_ms) {
+    if (!host || !topic || !*topic) return -1;
+    mqtt_client_t c;
+    if (mqtt_client_connect(&c, host, port, client_id, MQTT_KEEPALIVE_S, timeout_ms) != 0) return -1;
+    int rc = mqtt_client_publish(&c, topic, payload, payload_len);
+    mqtt_client_close(&c);
+    return rc;
+}
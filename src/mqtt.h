@@ -0,0 +1,39 @@
+#ifndef AUTOD_MQTT_H
+#define AUTOD_MQTT_H
+
+#include <stddef.h>
+
+/* Minimal MQTT 3.1.1 client (QoS 0, no TLS). */
+
+/* Parse "mqtt://host[:port]" (port defaults to 1883). Returns 0 on success. */
+int mqtt_parse_url(const char *url, char *host, size_t host_sz, int *port);
+
+typedef struct {
+    int fd;
+    int keepalive_s;
+    unsigned short next_packet_id;
+    long long last_tx_ms;
+} mqtt_client_t;
+
+/* Open a session (clean session, QoS 0). Returns 0 on success. */
+int mqtt_client_connect(mqtt_client_t *c, const char *host, int port,
+                        const char *client_id, int keepalive_s, int timeout_ms);
+int mqtt_client_subscribe(mqtt_client_t *c, const char *topic_filter);
+int mqtt_client_publish(mqtt_client_t *c, const char *topic,
+                        const void *payload, size_t payload_len);
+/* Wait up to timeout_ms for an incoming PUBLISH, sending keepalive pings as
+ * needed. Returns 1 and hands out malloc'd, NUL-terminated topic and payload,
+ * 0 on timeout, -1 when the connection is lost. */
+int mqtt_client_poll(mqtt_client_t *c, int timeout_ms,
+                     char **topic, char **payload, size_t *payload_len);
+void mqtt_client_close(mqtt_client_t *c);
+
+/* Match a topic against a filter with + and # wildcards. */
+int mqtt_topic_matches(const char *filter, const char *topic);
+
+/* Connect, publish a single QoS 0 message and disconnect. Returns 0 on success. */
+int mqtt_publish_once(const char *host, int port, const char *client_id,
+                      const char *topic, const void *payload, size_t payload_len,
+                      int timeout_ms);
+
+#endif
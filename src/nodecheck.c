@@ -0,0 +1,413 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <fnmatch.h>
+#include <pthread.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "version.h"
+#include "httpc.h"
+#include "dnscache.h"
+#include "nodemeta.h"
+#include "nodecheck.h"
+
+#define NODECHECK_DEFAULT_TIMEOUT_MS 3000
+#define NODECHECK_MAX_TIMEOUT_MS 30000
+#define NODECHECK_MAX_LABELS 4
+
+/* Which registered nodes to check; empty fields match any node. */
+typedef struct {
+    JSON_Array *ids;
+    unsigned char slots[SYNC_MAX_SLOTS];
+    int has_slots;
+    const char *nodes;            /* sync id globs, comma separated */
+    const char *device;
+    const char *role;
+    JSON_Object *labels;
+} nodecheck_select_t;
+
+typedef struct {
+    sync_node_addr_t node;
+    const char *skip;
+    int dns_ttl_s;
+    int timeout_ms;
+    const char *health_body;      /* the slot's health command, when asked for */
+    char health_buf[SYNC_HEALTH_BODY_MAX];
+    /* /health */
+    int http_status;              /* -1 transport error, -2 name did not resolve */
+    const char *failure;
+    char address[16];
+    long long latency_ms;
+    char autod_version[64];
+    int api_version;
+    int api_min_version;
+    /* slot health command */
+    int slot_status;
+    const char *slot_failure;
+    int slot_rc;
+    int slot_has_rc;
+    long long slot_elapsed_ms;
+} nodecheck_item_t;
+
+static int nodecheck_has_string(JSON_Array *arr, const char *s) {
+    size_t cnt = json_array_get_count(arr);
+    for (size_t i = 0; i < cnt; i++) {
+        const char *v = json_array_get_string(arr, i);
+        if (v && !strcmp(v, s)) return 1;
+    }
+    return 0;
+}
+
+/* Parse ids, slots and match. Returns NULL or the 400 error; a slot
+ * reference that names nothing is returned through *bad_slot instead. */
+static const char *nodecheck_parse_select(const config_t *cfg, JSON_Object *o, nodecheck_select_t *sel,
+                                          const char **bad_slot) {
+    memset(sel, 0, sizeof(*sel));
+    *bad_slot = NULL;
+    JSON_Value *ids_v = json_object_get_value(o, "ids");
+    if (ids_v) {
+        sel->ids = json_value_get_array(ids_v);
+        if (!sel->ids) return "invalid_ids";
+        for (size_t i = 0; i < json_array_get_count(sel->ids); i++) {
+            if (!json_array_get_string(sel->ids, i)) return "invalid_ids";
+        }
+    }
+    JSON_Value *slots_v = json_object_get_value(o, "slots");
+    if (slots_v) {
+        JSON_Array *arr = json_value_get_array(slots_v);
+        if (!arr) return "invalid_slots";
+        sel->has_slots = 1;
+        for (size_t i = 0; i < json_array_get_count(arr); i++) {
+            JSON_Value *v = json_array_get_value(arr, i);
+            if (json_value_get_type(v) == JSONNumber) {
+                double n = json_value_get_number(v);
+                if (n < 1 || n > sync_slot_count(cfg) || n != (int)n) return "invalid_slots";
+                sel->slots[(int)n - 1] = 1;
+            } else if (json_value_get_type(v) == JSONString) {
+                unsigned char hits[SYNC_MAX_SLOTS];
+                if (sync_slot_match(cfg, json_value_get_string(v), hits) == 0) {
+                    *bad_slot = json_value_get_string(v);
+                    return NULL;
+                }
+                for (int slot = 0; slot < SYNC_MAX_SLOTS; slot++) sel->slots[slot] |= hits[slot];
+            } else {
+                return "invalid_slots";
+            }
+        }
+    }
+    JSON_Value *match_v = json_object_get_value(o, "match");
+    if (match_v) {
+        JSON_Object *m = json_value_get_object(match_v);
+        if (!m) return "invalid_match";
+        const char *keys[] = { "nodes", "device", "role" };
+        const char **dst[] = { &sel->nodes, &sel->device, &sel->role };
+        for (int i = 0; i < 3; i++) {
+            JSON_Value *v = json_object_get_value(m, keys[i]);
+            if (v && json_value_get_type(v) != JSONString) return "invalid_match";
+            *dst[i] = json_value_get_string(v);
+        }
+        JSON_Value *labels_v = json_object_get_value(m, "labels");
+        if (labels_v) {
+            sel->labels = json_value_get_object(labels_v);
+            if (!sel->labels || json_object_get_count(sel->labels) > NODECHECK_MAX_LABELS) {
+                return "invalid_match";
+            }
+            for (size_t i = 0; i < json_object_get_count(sel->labels); i++) {
+                if (!json_object_get_string(sel->labels, json_object_get_name(sel->labels, i))) {
+                    return "invalid_match";
+                }
+            }
+        }
+    }
+    return NULL;
+}
+
+static int nodecheck_selected(const nodecheck_select_t *sel, const sync_node_addr_t *n) {
+    if (sel->ids && !nodecheck_has_string(sel->ids, n->id)) return 0;
+    if (sel->has_slots && (n->slot < 1 || !sel->slots[n->slot - 1])) return 0;
+    if (sel->device && strcmp(sel->device, n->device) != 0) return 0;
+    if (sel->role && strcmp(sel->role, n->role) != 0) return 0;
+    if (sel->nodes && *sel->nodes) {
+        char tmp[512];
+        snprintf(tmp, sizeof(tmp), "%s", sel->nodes);
+        int found = 0;
+        char *save = NULL;
+        for (char *tok = strtok_r(tmp, ", \t", &save); tok && !found; tok = strtok_r(NULL, ", \t", &save)) {
+            found = fnmatch(tok, n->id, 0) == 0;
+        }
+        if (!found) return 0;
+    }
+    for (size_t i = 0; sel->labels && i < json_object_get_count(sel->labels); i++) {
+        const char *key = json_object_get_name(sel->labels, i);
+        char value[64];
+        if (nodemeta_get_label(n->id, key, value, sizeof(value)) != 0 ||
+            strcmp(value, json_object_get_string(sel->labels, key)) != 0) {
+            return 0;
+        }
+    }
+    return 1;
+}
+
+static void *nodecheck_worker(void *arg) {
+    nodecheck_item_t *item = (nodecheck_item_t *)arg;
+    http_url_t url;
+    char relay_hdr[GATEWAY_HEADER_MAX];
+    char host[128];
+    item->http_status = -2;
+    item->slot_status = -2;
+    (void)gateway_route(&item->node, AUTOD_PEER_PREFIX "/health", item->timeout_ms, &url,
+                        relay_hdr, sizeof(relay_hdr));
+    snprintf(host, sizeof(host), "%s", url.host);
+    if (dnscache_resolve(host, item->dns_ttl_s, item->address, sizeof(item->address)) != 0) {
+        return NULL;
+    }
+    snprintf(url.host, sizeof(url.host), "%s", item->address);
+    char *resp = NULL;
+    long long t0 = now_ms();
+    item->http_status = httpc_send_json("GET", &url, relay_hdr, NULL, &resp, NULL, item->timeout_ms);
+    item->latency_ms = now_ms() - t0;
+    if (item->http_status < 0) {
+        item->failure = httpc_last_error();
+        if (dnscache_is_hostname(host)) dnscache_forget(host);
+    } else {
+        JSON_Value *rv = resp ? json_parse_string(resp) : NULL;
+        JSON_Object *ro = json_object(rv);
+        const char *version = json_object_get_string(ro, "autod_version");
+        if (version) snprintf(item->autod_version, sizeof(item->autod_version), "%s", version);
+        item->api_version = (int)json_object_get_number(ro, "api_version");
+        item->api_min_version = (int)json_object_get_number(ro, "api_min_version");
+        if (rv) json_value_free(rv);
+    }
+    free(resp);
+    resp = NULL;
+
+    if (item->health_body && item->http_status >= 0) {
+        if (item->node.via[0]) {
+            gateway_relay_path(item->node.id, AUTOD_PEER_PREFIX "/exec", url.path, sizeof(url.path));
+        } else {
+            snprintf(url.path, sizeof(url.path), AUTOD_PEER_PREFIX "/exec");
+        }
+        t0 = now_ms();
+        item->slot_status = httpc_send_json("POST", &url, relay_hdr, item->health_body, &resp, NULL,
+                                            item->timeout_ms);
+        item->slot_elapsed_ms = now_ms() - t0;
+        if (item->slot_status < 0) {
+            item->slot_failure = httpc_last_error();
+        } else if (item->slot_status == 200) {
+            JSON_Value *rv = resp ? json_parse_string(resp) : NULL;
+            JSON_Object *ro = json_object(rv);
+            if (ro && json_object_has_value_of_type(ro, "rc", JSONNumber)) {
+                item->slot_rc = (int)json_object_get_number(ro, "rc");
+                item->slot_has_rc = 1;
+            }
+            if (rv) json_value_free(rv);
+        }
+        free(resp);
+    }
+    return NULL;
+}
+
+/* The node's entry in the reply. Returns 1 when it is healthy. */
+static int nodecheck_item_json(const nodecheck_item_t *item, JSON_Object *o) {
+    json_object_set_string(o, "id", item->node.id);
+    if (item->node.slot > 0) json_object_set_number(o, "slot", item->node.slot);
+    if (item->node.host[0]) json_object_set_string(o, "host", item->node.host);
+    if (item->node.port > 0) json_object_set_number(o, "port", item->node.port);
+    if (item->node.transport[0]) {
+        json_object_set_string(o, "registry", item->node.quarantined ? "quarantined" :
+                                              item->node.down ? "down" : "up");
+    }
+    if (item->skip) {
+        json_object_set_string(o, "status", "skipped");
+        json_object_set_string(o, "reason", item->skip);
+        return 0;
+    }
+    if (item->node.via[0]) json_object_set_string(o, "via", item->node.via);
+    if (item->address[0]) json_object_set_string(o, "address", item->address);
+    const char *error = NULL;
+    if (item->http_status == -2) {
+        error = "resolve_failed";
+    } else if (item->http_status < 0) {
+        error = item->failure ? item->failure : "failed";
+    } else {
+        json_object_set_number(o, "http_status", item->http_status);
+        json_object_set_number(o, "latency_ms", (double)item->latency_ms);
+        if (item->http_status != 200) error = "http_error";
+        if (item->autod_version[0]) json_object_set_string(o, "autod_version", item->autod_version);
+        if (item->api_version > 0) {
+            json_object_set_number(o, "api_version", item->api_version);
+            json_object_set_string(o, "compat", sync_api_compat(item->api_version, item->api_min_version));
+        }
+    }
+    if (item->health_body && item->http_status >= 0) {
+        JSON_Value *sv = json_value_init_object();
+        JSON_Object *so = json_object(sv);
+        const char *slot_error = NULL;
+        if (item->slot_status < 0) {
+            slot_error = item->slot_failure ? item->slot_failure : "failed";
+        } else {
+            json_object_set_number(so, "http_status", item->slot_status);
+            json_object_set_number(so, "elapsed_ms", (double)item->slot_elapsed_ms);
+            if (item->slot_has_rc) json_object_set_number(so, "rc", item->slot_rc);
+            if (item->slot_status != 200) slot_error = "http_error";
+            else if (!item->slot_has_rc) slot_error = "bad_response";
+            else if (item->slot_rc != 0) slot_error = "nonzero_rc";
+        }
+        if (slot_error) json_object_set_string(so, "error", slot_error);
+        json_object_set_value(o, "slot_health", sv);
+        if (!error && slot_error) error = "slot_health";
+    }
+    json_object_set_string(o, "status", error ? "unhealthy" : "healthy");
+    if (error) json_object_set_string(o, "error", error);
+    return !error;
+}
+
+static int h_nodes_health_check(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    if (strcasecmp(cfg->sync_role, "master") != 0) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri || strcmp(ri->request_method, "POST") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        free(u.body);
+        send_json_error(c, 400, "body_read_failed");
+        free(cfg);
+        return 1;
+    }
+    JSON_Value *root = json_parse_string(u.body && u.len ? u.body : "{}");
+    free(u.body);
+    if (!root || json_value_get_type(root) != JSONObject) {
+        if (root) json_value_free(root);
+        send_json_error(c, 400, "bad_json");
+        free(cfg);
+        return 1;
+    }
+    JSON_Object *o = json_object(root);
+    nodecheck_select_t sel;
+    const char *bad_slot = NULL;
+    const char *error = nodecheck_parse_select(cfg, o, &sel, &bad_slot);
+    int timeout_ms = NODECHECK_DEFAULT_TIMEOUT_MS;
+    if (!error && !bad_slot &&
+        (exec_timeout_field(o, "timeout_ms", &timeout_ms) != 0 || timeout_ms > NODECHECK_MAX_TIMEOUT_MS)) {
+        error = "invalid_timeout";
+    }
+    if (error || bad_slot) {
+        if (bad_slot) {
+            int status = 404;
+            JSON_Value *v = sync_slot_lookup_error(cfg, bad_slot, -1, &status);
+            send_json(c, v, status, 1);
+            json_value_free(v);
+        } else {
+            send_json_error(c, 400, error);
+        }
+        json_value_free(root);
+        free(cfg);
+        return 1;
+    }
+    int slot_health = json_object_get_boolean(o, "slot_health") == 1;
+
+    sync_node_addr_t *nodes = calloc(SYNC_MAX_SLAVES, sizeof(*nodes));
+    nodecheck_item_t *items = calloc(SYNC_MAX_SLAVES * 2, sizeof(*items));
+    pthread_t *threads = calloc(SYNC_MAX_SLAVES * 2, sizeof(*threads));
+    if (!nodes || !items || !threads) {
+        free(nodes);
+        free(items);
+        free(threads);
+        json_value_free(root);
+        send_plain(c, 500, "oom", 1);
+        free(cfg);
+        return 1;
+    }
+    int node_count = sync_master_list_nodes(app, cfg, nodes, SYNC_MAX_SLAVES);
+    int count = 0;
+    for (int i = 0; i < node_count; i++) {
+        if (!nodecheck_selected(&sel, &nodes[i])) continue;
+        nodecheck_item_t *item = &items[count++];
+        item->node = nodes[i];
+        item->dns_ttl_s = cfg->sync_dns_ttl_s;
+        item->timeout_ms = timeout_ms;
+        if (strcmp(nodes[i].transport, "http") != 0) item->skip = "unsupported_transport";
+        else if (!nodes[i].host[0] || nodes[i].port <= 0) item->skip = "no_address";
+        else if (nodes[i].via[0] && !nodes[i].via_host[0]) item->skip = "gateway_unavailable";
+        if (slot_health &&
+            sync_slot_health_body(cfg, nodes[i].slot - 1, item->health_buf, sizeof(item->health_buf)) == 0) {
+            item->health_body = item->health_buf;
+        }
+    }
+    /* Ids asked for by name that are not registered are reported too. */
+    for (size_t i = 0; sel.ids && i < json_array_get_count(sel.ids) && count < SYNC_MAX_SLAVES * 2; i++) {
+        const char *id = json_array_get_string(sel.ids, i);
+        int known = 0;
+        for (int n = 0; n < node_count && !known; n++) known = !strcmp(nodes[n].id, id);
+        for (int k = 0; k < count && !known; k++) known = !strcmp(items[k].node.id, id);
+        if (known) continue;
+        nodecheck_item_t *item = &items[count++];
+        snprintf(item->node.id, sizeof(item->node.id), "%s", id);
+        item->skip = "unknown_node";
+    }
+
+    long long t0 = now_ms();
+    for (int i = 0; i < count; i++) {
+        nodecheck_item_t *item = &items[i];
+        if (item->skip) continue;
+        if (pthread_create(&threads[i], NULL, nodecheck_worker, item) != 0) {
+            item->skip = "spawn_failed";
+        }
+    }
+    for (int i = 0; i < count; i++) {
+        if (!items[i].skip) pthread_join(threads[i], NULL);
+    }
+
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *ro = json_object(v);
+    JSON_Value *list = json_value_init_array();
+    int healthy = 0, unhealthy = 0, skipped = 0;
+    for (int i = 0; i < count; i++) {
+        JSON_Value *nv = json_value_init_object();
+        if (nodecheck_item_json(&items[i], json_object(nv))) healthy++;
+        else if (items[i].skip) skipped++;
+        else unhealthy++;
+        json_array_append_value(json_array(list), nv);
+    }
+    json_object_set_number(ro, "checked", healthy + unhealthy);
+    json_object_set_number(ro, "healthy", healthy);
+    json_object_set_number(ro, "unhealthy", unhealthy);
+    json_object_set_number(ro, "skipped", skipped);
+    json_object_set_number(ro, "elapsed_ms", (double)(now_ms() - t0));
+    json_object_set_value(ro, "nodes", list);
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+    fprintf(stderr, "sync master: health check of %d node(s): %d healthy, %d unhealthy, %d skipped\n",
+            count, healthy, unhealthy, skipped);
+    free(nodes);
+    free(items);
+    free(threads);
+    json_value_free(root);
+    free(cfg);
+    return 1;
+}
+
+/*
+ * POST /nodes/health-check - {"ids":[...], "slots":[...], "match":{nodes, device,
+ *                             role, labels}, "timeout_ms":N, "slot_health":bool}
+ */
+void nodecheck_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    api_set_handler(ctx, "/nodes/health-check", h_nodes_health_check, app);
+}
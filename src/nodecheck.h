@@ -0,0 +1,13 @@
+#ifndef AUTOD_NODECHECK_H
+#define AUTOD_NODECHECK_H
+
+typedef struct app app_t;
+struct mg_context;
+
+/* POST /nodes/health-check on a master: probe the selected slaves' /health
+ * (and optionally their slot's health command) in parallel, now, and answer
+ * with what each one said. The registry and the periodic checks are left
+ * alone. */
+void nodecheck_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
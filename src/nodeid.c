@@ -0,0 +1,168 @@
+#include <ctype.h>
+#include <dirent.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <string.h>
+#include <unistd.h>
+
+#include "nodeid.h"
+
+static const char *const g_sources[] = {"machine-id", "mac", "serial", "hostname"};
+#define NODEID_SOURCE_COUNT (sizeof(g_sources) / sizeof(g_sources[0]))
+
+/* First line of path, trimmed; the device tree pads strings with NULs. */
+static int nodeid_read_line(const char *path, char *out, size_t out_sz) {
+    FILE *f = fopen(path, "r");
+    if (!f) return -1;
+    size_t n = fread(out, 1, out_sz - 1, f);
+    fclose(f);
+    out[n] = '\0';
+    out[strcspn(out, "\r\n")] = '\0';
+    size_t len = strlen(out);
+    while (len && isspace((unsigned char)out[len - 1])) out[--len] = '\0';
+    return len ? 0 : -1;
+}
+
+/* Lower-case alphanumerics and '-' only, so the value is a valid node id. */
+static void nodeid_sanitize(char *s) {
+    char *w = s;
+    for (char *r = s; *r; r++) {
+        if (isalnum((unsigned char)*r)) *w++ = (char)tolower((unsigned char)*r);
+        else if (*r == '-' || *r == '_') *w++ = '-';
+    }
+    *w = '\0';
+}
+
+/* Placeholder serials vendors ship: all zeros, "To be filled by O.E.M." and
+ * the like. */
+static int nodeid_is_placeholder(const char *s) {
+    if (!*s) return 1;
+    if (strspn(s, "0") == strlen(s)) return 1;
+    return strstr(s, "tobefilled") || !strcmp(s, "defaultstring") || !strcmp(s, "none") ||
+           !strcmp(s, "123456789") || !strcmp(s, "systemserialnumber");
+}
+
+static int nodeid_machine_id(char *out, size_t out_sz) {
+    char raw[64];
+    if (nodeid_read_line("/etc/machine-id", raw, sizeof(raw)) != 0 &&
+        nodeid_read_line("/var/lib/dbus/machine-id", raw, sizeof(raw)) != 0) {
+        return -1;
+    }
+    if (strlen(raw) != 32 || strspn(raw, "0123456789abcdef") != 32) return -1;
+    /* machine-id is confidential; derive an application-specific value. */
+    uint64_t h = 1469598103934665603ULL;
+    for (const char *s = "autod:"; *s; s++) h = (h ^ (unsigned char)*s) * 1099511628211ULL;
+    for (const char *s = raw; *s; s++) h = (h ^ (unsigned char)*s) * 1099511628211ULL;
+    snprintf(out, out_sz, "%012llx", (unsigned long long)(h & 0xffffffffffffULL));
+    return 0;
+}
+
+/* The interface with the lowest name that is backed by a device and has a
+ * permanent address: bridges, tunnels and random MACs change. */
+static int nodeid_mac(char *out, size_t out_sz) {
+    DIR *d = opendir("/sys/class/net");
+    if (!d) return -1;
+    char best_name[64] = "";
+    char best[32] = "";
+    struct dirent *e;
+    while ((e = readdir(d)) != NULL) {
+        if (e->d_name[0] == '.' || !strcmp(e->d_name, "lo") || strlen(e->d_name) >= sizeof(best_name)) {
+            continue;
+        }
+        if (best_name[0] && strcmp(e->d_name, best_name) >= 0) continue;
+        char path[320], value[64];
+        snprintf(path, sizeof(path), "/sys/class/net/%s/device", e->d_name);
+        if (access(path, F_OK) != 0) continue;
+        snprintf(path, sizeof(path), "/sys/class/net/%s/addr_assign_type", e->d_name);
+        if (nodeid_read_line(path, value, sizeof(value)) == 0 && strcmp(value, "0") != 0) continue;
+        snprintf(path, sizeof(path), "/sys/class/net/%s/address", e->d_name);
+        if (nodeid_read_line(path, value, sizeof(value)) != 0) continue;
+        nodeid_sanitize(value);
+        if (strlen(value) != 12 || nodeid_is_placeholder(value)) continue;
+        memcpy(best_name, e->d_name, strlen(e->d_name) + 1);
+        memcpy(best, value, 13);
+    }
+    closedir(d);
+    if (!best[0]) return -1;
+    snprintf(out, out_sz, "%s", best);
+    return 0;
+}
+
+static int nodeid_serial(char *out, size_t out_sz) {
+    static const char *const paths[] = {
+        "/proc/device-tree/serial-number",
+        "/sys/firmware/devicetree/base/serial-number",
+        "/sys/class/dmi/id/product_serial",
+        "/sys/class/dmi/id/board_serial",
+    };
+    char value[128];
+    for (size_t i = 0; i < sizeof(paths) / sizeof(paths[0]); i++) {
+        if (nodeid_read_line(paths[i], value, sizeof(value)) != 0) continue;
+        nodeid_sanitize(value);
+        if (nodeid_is_placeholder(value)) continue;
+        snprintf(out, out_sz, "%s", value);
+        return 0;
+    }
+    /* Raspberry Pi and some other ARM boards report it in cpuinfo only. */
+    FILE *f = fopen("/proc/cpuinfo", "r");
+    if (!f) return -1;
+    char line[256];
+    int rc = -1;
+    while (rc != 0 && fgets(line, sizeof(line), f)) {
+        if (strncmp(line, "Serial", 6) != 0) continue;
+        char *colon = strchr(line, ':');
+        if (!colon) continue;
+        snprintf(value, sizeof(value), "%s", colon + 1);
+        nodeid_sanitize(value);
+        if (nodeid_is_placeholder(value)) continue;
+        snprintf(out, out_sz, "%s", value);
+        rc = 0;
+    }
+    fclose(f);
+    return rc;
+}
+
+static int nodeid_hostname(char *out, size_t out_sz) {
+    char host[128];
+    if (gethostname(host, sizeof(host)) != 0) return -1;
+    host[sizeof(host) - 1] = '\0';
+    if (!host[0]) return -1;
+    snprintf(out, out_sz, "%s", host);
+    return 0;
+}
+
+static int nodeid_from(const char *source, char *out, size_t out_sz) {
+    if (!strcmp(source, "machine-id")) return nodeid_machine_id(out, out_sz);
+    if (!strcmp(source, "mac")) return nodeid_mac(out, out_sz);
+    if (!strcmp(source, "serial")) return nodeid_serial(out, out_sz);
+    if (!strcmp(source, "hostname")) return nodeid_hostname(out, out_sz);
+    return -1;
+}
+
+const char *nodeid_check_sources(const char *sources) {
+    if (!sources || !*sources) return "empty";
+    char tmp[128];
+    snprintf(tmp, sizeof(tmp), "%s", sources);
+    char *save = NULL;
+    for (char *tok = strtok_r(tmp, ", ", &save); tok; tok = strtok_r(NULL, ", ", &save)) {
+        size_t i = 0;
+        while (i < NODEID_SOURCE_COUNT && strcmp(tok, g_sources[i]) != 0) i++;
+        if (i == NODEID_SOURCE_COUNT) return "unknown source (machine-id, mac, serial, hostname)";
+    }
+    return NULL;
+}
+
+int nodeid_derive(const char *sources, const char *prefix, char *id, size_t id_sz,
+                  char *source, size_t source_sz) {
+    char tmp[128];
+    snprintf(tmp, sizeof(tmp), "%s", sources && *sources ? sources : NODEID_SOURCES_DEFAULT);
+    char *save = NULL;
+    for (char *tok = strtok_r(tmp, ", ", &save); tok; tok = strtok_r(NULL, ", ", &save)) {
+        char value[128];
+        if (nodeid_from(tok, value, sizeof(value)) != 0) continue;
+        snprintf(id, id_sz, "%s%s", prefix ? prefix : "", value);
+        if (source && source_sz) snprintf(source, source_sz, "%s", tok);
+        return 0;
+    }
+    return -1;
+}
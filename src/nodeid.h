@@ -0,0 +1,24 @@
+#ifndef AUTOD_NODEID_H
+#define AUTOD_NODEID_H
+
+#include <stddef.h>
+
+/* Node id derivation for a node without [sync] id. The first source in the
+ * comma list [sync] id_sources that yields a value makes the id:
+ *   machine-id  hash of /etc/machine-id (the raw value is not exposed)
+ *   mac         permanent MAC of the first physical interface by name
+ *   serial      board or DMI serial number
+ *   hostname    the host name (the default, and what older builds used)
+ * Hardware sources survive hostname changes and reflashed images that all
+ * boot with the same host name. */
+#define NODEID_SOURCES_DEFAULT "hostname"
+
+/* NULL, or why sources is not a usable list. */
+const char *nodeid_check_sources(const char *sources);
+
+/* Derive prefix + value from the first source of the list that yields one.
+ * Returns 0 and names that source, or -1 when none did. */
+int nodeid_derive(const char *sources, const char *prefix, char *id, size_t id_sz,
+                  char *source, size_t source_sz);
+
+#endif
@@ -0,0 +1,372 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <ctype.h>
+#include <time.h>
+#include <unistd.h>
+#include <pthread.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "nodemeta.h"
+
+typedef struct {
+    char key[32];
+    char value[64];
+} nodemeta_label_t;
+
+typedef struct {
+    int in_use;
+    char id[64];
+    char name[64];
+    char notes[256];
+    nodemeta_label_t labels[NODEMETA_MAX_LABELS];
+    int label_count;
+    long long updated_unix;
+} nodemeta_entry_t;
+
+static pthread_mutex_t g_nodemeta_lock = PTHREAD_MUTEX_INITIALIZER;
+static nodemeta_entry_t g_nodemeta[NODEMETA_MAX_NODES];
+static unsigned long g_nodemeta_version;
+
+void nodemeta_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->nodemeta, 0, sizeof(cfg->nodemeta));
+}
+
+int nodemeta_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (strcmp(section, "nodes") != 0) return 0;
+    if (!strcmp(key, "meta_path")) {
+        strncpy(cfg->nodemeta.meta_path, value, sizeof(cfg->nodemeta.meta_path) - 1);
+        cfg->nodemeta.meta_path[sizeof(cfg->nodemeta.meta_path) - 1] = '\0';
+    } else {
+        fprintf(stderr, "WARN: ignoring unknown nodes key '%s'\n", key);
+    }
+    return 1;
+}
+
+static nodemeta_entry_t *nodemeta_find_locked(const char *id) {
+    for (int i = 0; i < NODEMETA_MAX_NODES; i++) {
+        if (g_nodemeta[i].in_use && !strcmp(g_nodemeta[i].id, id)) return &g_nodemeta[i];
+    }
+    return NULL;
+}
+
+static nodemeta_entry_t *nodemeta_free_slot_locked(void) {
+    for (int i = 0; i < NODEMETA_MAX_NODES; i++) {
+        if (!g_nodemeta[i].in_use) return &g_nodemeta[i];
+    }
+    return NULL;
+}
+
+static int nodemeta_valid_label_key(const char *key) {
+    size_t n = strlen(key);
+    if (n == 0 || n >= sizeof(((nodemeta_label_t *)0)->key)) return 0;
+    for (const char *p = key; *p; p++) {
+        if (!isalnum((unsigned char)*p) && *p != '_' && *p != '-' && *p != '.') return 0;
+    }
+    return 1;
+}
+
+static int nodemeta_set_label(nodemeta_entry_t *e, const char *key, const char *value) {
+    int i;
+    for (i = 0; i < e->label_count; i++) {
+        if (!strcmp(e->labels[i].key, key)) break;
+    }
+    if (!value) {
+        if (i == e->label_count) return 0;
+        memmove(&e->labels[i], &e->labels[i + 1],
+                (size_t)(e->label_count - i - 1) * sizeof(e->labels[0]));
+        e->label_count--;
+        return 0;
+    }
+    if (i == e->label_count) {
+        if (e->label_count >= NODEMETA_MAX_LABELS) return -1;
+        snprintf(e->labels[i].key, sizeof(e->labels[i].key), "%s", key);
+        e->label_count++;
+    }
+    snprintf(e->labels[i].value, sizeof(e->labels[i].value), "%s", value);
+    return 0;
+}
+
+/* Copy a string field, or clear it for null. Anything else, or a string
+ * that does not fit, is refused. */
+static int nodemeta_set_text(char *dst, size_t dst_sz, const JSON_Value *v) {
+    if (json_value_get_type(v) == JSONNull) {
+        dst[0] = '\0';
+        return 0;
+    }
+    const char *s = json_value_get_string(v);
+    if (!s || strlen(s) >= dst_sz) return -1;
+    snprintf(dst, dst_sz, "%s", s);
+    return 0;
+}
+
+/*
+ * Merge a patch into e: "name" and "notes" are replaced (null clears them),
+ * "labels" is merged key by key (a null value drops the label, a null
+ * object drops them all). Returns NULL or the error code, with the
+ * offending field in *field.
+ */
+static const char *nodemeta_apply(nodemeta_entry_t *e, JSON_Object *patch, const char **field) {
+    size_t n = json_object_get_count(patch);
+    for (size_t i = 0; i < n; i++) {
+        const char *k = json_object_get_name(patch, i);
+        JSON_Value *v = json_object_get_value_at(patch, i);
+        *field = k;
+        if (!strcmp(k, "name")) {
+            if (nodemeta_set_text(e->name, sizeof(e->name), v) != 0) return "invalid_annotation";
+        } else if (!strcmp(k, "notes")) {
+            if (nodemeta_set_text(e->notes, sizeof(e->notes), v) != 0) return "invalid_annotation";
+        } else if (!strcmp(k, "labels")) {
+            if (json_value_get_type(v) == JSONNull) {
+                e->label_count = 0;
+                continue;
+            }
+            JSON_Object *labels = json_value_get_object(v);
+            if (!labels) return "invalid_annotation";
+            size_t ln = json_object_get_count(labels);
+            for (size_t j = 0; j < ln; j++) {
+                const char *lk = json_object_get_name(labels, j);
+                JSON_Value *lv = json_object_get_value_at(labels, j);
+                *field = lk;
+                const char *value = json_value_get_string(lv);
+                if (!nodemeta_valid_label_key(lk) ||
+                    (!value && json_value_get_type(lv) != JSONNull) ||
+                    (value && strlen(value) >= sizeof(e->labels[0].value))) {
+                    return "invalid_labels";
+                }
+                if (nodemeta_set_label(e, lk, value) != 0) return "too_many_labels";
+            }
+        } else {
+            return "invalid_annotation";
+        }
+    }
+    *field = NULL;
+    return NULL;
+}
+
+static int nodemeta_is_empty(const nodemeta_entry_t *e) {
+    return !e->name[0] && !e->notes[0] && e->label_count == 0;
+}
+
+static void nodemeta_fields_to_json(const nodemeta_entry_t *e, JSON_Object *o) {
+    if (e->name[0]) json_object_set_string(o, "name", e->name);
+    if (e->notes[0]) json_object_set_string(o, "notes", e->notes);
+    if (e->label_count > 0) {
+        JSON_Value *lv = json_value_init_object();
+        for (int i = 0; i < e->label_count; i++) {
+            json_object_set_string(json_object(lv), e->labels[i].key, e->labels[i].value);
+        }
+        json_object_set_value(o, "labels", lv);
+    }
+}
+
+static JSON_Value *nodemeta_to_json(const char *id, const nodemeta_entry_t *e) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "id", id);
+    if (e) {
+        nodemeta_fields_to_json(e, o);
+        json_object_set_number(o, "updated", (double)e->updated_unix);
+    }
+    return v;
+}
+
+/* Write every annotation to [nodes] meta_path, replacing the file
+ * atomically. */
+static void nodemeta_persist_locked(const config_t *cfg) {
+    if (!cfg->nodemeta.meta_path[0]) return;
+    JSON_Value *v = json_value_init_object();
+    JSON_Value *nodes = json_value_init_object();
+    for (int i = 0; i < NODEMETA_MAX_NODES; i++) {
+        const nodemeta_entry_t *e = &g_nodemeta[i];
+        if (!e->in_use) continue;
+        JSON_Value *ev = json_value_init_object();
+        nodemeta_fields_to_json(e, json_object(ev));
+        json_object_set_number(json_object(ev), "updated", (double)e->updated_unix);
+        json_object_set_value(json_object(nodes), e->id, ev);
+    }
+    json_object_set_value(json_object(v), "nodes", nodes);
+    char tmp[sizeof(cfg->nodemeta.meta_path) + 8];
+    snprintf(tmp, sizeof(tmp), "%s.tmp", cfg->nodemeta.meta_path);
+    if (json_serialize_to_file_pretty(v, tmp) != JSONSuccess ||
+        rename(tmp, cfg->nodemeta.meta_path) != 0) {
+        fprintf(stderr, "WARN: cannot write node annotations to %s\n", cfg->nodemeta.meta_path);
+        (void)unlink(tmp);
+    }
+    json_value_free(v);
+}
+
+void nodemeta_load(const config_t *cfg) {
+    if (!cfg || !cfg->nodemeta.meta_path[0] || access(cfg->nodemeta.meta_path, F_OK) != 0) return;
+    JSON_Value *v = json_parse_file(cfg->nodemeta.meta_path);
+    JSON_Object *nodes = json_object_get_object(json_object(v), "nodes");
+    if (!nodes) {
+        fprintf(stderr, "WARN: ignoring malformed node annotations %s\n", cfg->nodemeta.meta_path);
+        if (v) json_value_free(v);
+        return;
+    }
+    int loaded = 0;
+    pthread_mutex_lock(&g_nodemeta_lock);
+    size_t n = json_object_get_count(nodes);
+    for (size_t i = 0; i < n; i++) {
+        const char *id = json_object_get_name(nodes, i);
+        JSON_Object *eo = json_object_get_object(nodes, id);
+        nodemeta_entry_t *e = nodemeta_free_slot_locked();
+        if (!eo || !*id || strlen(id) >= sizeof(e->id) || nodemeta_find_locked(id)) continue;
+        if (!e) {
+            fprintf(stderr, "WARN: node annotations capacity reached (%d)\n", NODEMETA_MAX_NODES);
+            break;
+        }
+        nodemeta_entry_t staged;
+        memset(&staged, 0, sizeof(staged));
+        double updated = json_object_get_number(eo, "updated");
+        json_object_remove(eo, "updated");
+        const char *field = NULL;
+        if (nodemeta_apply(&staged, eo, &field) != NULL || nodemeta_is_empty(&staged)) {
+            fprintf(stderr, "WARN: ignoring node annotations for '%s' in %s\n",
+                    id, cfg->nodemeta.meta_path);
+            continue;
+        }
+        staged.in_use = 1;
+        snprintf(staged.id, sizeof(staged.id), "%s", id);
+        staged.updated_unix = (long long)updated;
+        *e = staged;
+        loaded++;
+    }
+    g_nodemeta_version++;
+    pthread_mutex_unlock(&g_nodemeta_lock);
+    fprintf(stderr, "nodes: loaded annotations for %d nodes from %s\n",
+            loaded, cfg->nodemeta.meta_path);
+    json_value_free(v);
+}
+
+unsigned long nodemeta_version(void) {
+    pthread_mutex_lock(&g_nodemeta_lock);
+    unsigned long version = g_nodemeta_version;
+    pthread_mutex_unlock(&g_nodemeta_lock);
+    return version;
+}
+
+void nodemeta_merge_json(const char *id, JSON_Object *o) {
+    if (!id || !*id || !o) return;
+    pthread_mutex_lock(&g_nodemeta_lock);
+    const nodemeta_entry_t *e = nodemeta_find_locked(id);
+    if (e) nodemeta_fields_to_json(e, o);
+    pthread_mutex_unlock(&g_nodemeta_lock);
+}
+
+int nodemeta_get_label(const char *id, const char *key, char *out, size_t out_sz) {
+    if (!id || !key || !out || out_sz == 0) return -1;
+    int rc = -1;
+    pthread_mutex_lock(&g_nodemeta_lock);
+    const nodemeta_entry_t *e = nodemeta_find_locked(id);
+    for (int i = 0; e && i < e->label_count; i++) {
+        if (strcmp(e->labels[i].key, key) != 0) continue;
+        snprintf(out, out_sz, "%s", e->labels[i].value);
+        rc = 0;
+        break;
+    }
+    pthread_mutex_unlock(&g_nodemeta_lock);
+    return rc;
+}
+
+int nodemeta_handle(struct mg_connection *c, const config_t *cfg, const char *id) {
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (strcasecmp(cfg->sync_role, "master") != 0) {
+        send_plain(c, 404, "not_found", 1);
+        return 1;
+    }
+    if (!id || !*id || strlen(id) >= sizeof(g_nodemeta[0].id) || strchr(id, '/')) {
+        send_json_error(c, 400, "invalid_id");
+        return 1;
+    }
+    const char *m = ri ? ri->request_method : "";
+
+    if (!strcmp(m, "GET")) {
+        pthread_mutex_lock(&g_nodemeta_lock);
+        JSON_Value *v = nodemeta_to_json(id, nodemeta_find_locked(id));
+        pthread_mutex_unlock(&g_nodemeta_lock);
+        send_json(c, v, 200, 1);
+        json_value_free(v);
+        return 1;
+    }
+    if (!strcmp(m, "DELETE")) {
+        pthread_mutex_lock(&g_nodemeta_lock);
+        nodemeta_entry_t *e = nodemeta_find_locked(id);
+        if (e) {
+            memset(e, 0, sizeof(*e));
+            g_nodemeta_version++;
+            nodemeta_persist_locked(cfg);
+        }
+        pthread_mutex_unlock(&g_nodemeta_lock);
+        if (e) fprintf(stderr, "sync master: cleared annotations for %s\n", id);
+        JSON_Value *v = nodemeta_to_json(id, NULL);
+        send_json(c, v, 200, 1);
+        json_value_free(v);
+        return 1;
+    }
+    if (strcmp(m, "PATCH") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        return 1;
+    }
+
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        if (u.body) free(u.body);
+        send_json_error(c, 400, "body_read_failed");
+        return 1;
+    }
+    JSON_Value *root = json_parse_string(u.body ? u.body : "");
+    free(u.body);
+    if (!root || json_value_get_type(root) != JSONObject) {
+        if (root) json_value_free(root);
+        send_json_error(c, 400, "bad_json");
+        return 1;
+    }
+
+    pthread_mutex_lock(&g_nodemeta_lock);
+    nodemeta_entry_t *e = nodemeta_find_locked(id);
+    nodemeta_entry_t staged;
+    if (e) {
+        staged = *e;
+    } else {
+        memset(&staged, 0, sizeof(staged));
+        staged.in_use = 1;
+        snprintf(staged.id, sizeof(staged.id), "%s", id);
+    }
+    const char *field = NULL;
+    const char *error = nodemeta_apply(&staged, json_object(root), &field);
+    if (error) {
+        pthread_mutex_unlock(&g_nodemeta_lock);
+        send_json_error_field(c, 400, error, "field", field);
+        json_value_free(root);
+        return 1;
+    }
+    json_value_free(root);
+    if (nodemeta_is_empty(&staged)) {
+        if (e) memset(e, 0, sizeof(*e));
+        e = NULL;
+    } else {
+        if (!e) e = nodemeta_free_slot_locked();
+        if (!e) {
+            pthread_mutex_unlock(&g_nodemeta_lock);
+            send_json_error(c, 503, "annotations_full");
+            return 1;
+        }
+        staged.updated_unix = (long long)time(NULL);
+        *e = staged;
+    }
+    g_nodemeta_version++;
+    nodemeta_persist_locked(cfg);
+    JSON_Value *v = nodemeta_to_json(id, e);
+    pthread_mutex_unlock(&g_nodemeta_lock);
+    fprintf(stderr, "sync master: updated annotations for %s\n", id);
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+    return 1;
+}
@@ -0,0 +1,38 @@
+#ifndef AUTOD_NODEMETA_H
+#define AUTOD_NODEMETA_H
+
+#include <stddef.h>
+
+#include "parson.h"
+
+#define NODEMETA_MAX_NODES 64
+#define NODEMETA_MAX_LABELS 8
+
+/* [nodes] — operator annotations (display name, notes, labels) the master
+ * keeps per node id, independent of what the node reports. */
+typedef struct {
+    char meta_path[256];       /* persisted annotations; empty = memory only */
+} nodemeta_config_t;
+
+typedef struct config config_t;
+struct mg_connection;
+
+void nodemeta_cfg_defaults(config_t *cfg);
+int nodemeta_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* Restore the annotations persisted at [nodes] meta_path, if any. */
+void nodemeta_load(const config_t *cfg);
+
+/* Bumped on every change, for callers that cache payloads built from it. */
+unsigned long nodemeta_version(void);
+
+/* Add "name", "notes" and "labels" for id to o when it is annotated. */
+void nodemeta_merge_json(const char *id, JSON_Object *o);
+
+/* Copy label key of id into out. Returns 0 when the node has that label. */
+int nodemeta_get_label(const char *id, const char *key, char *out, size_t out_sz);
+
+/* GET, PATCH or DELETE /nodes/{id}. Masters only; others get 404. */
+int nodemeta_handle(struct mg_connection *c, const config_t *cfg, const char *id);
+
+#endif
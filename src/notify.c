@@ -0,0 +1,698 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <errno.h>
+#include <time.h>
+#include <unistd.h>
+#include <pthread.h>
+#include <sys/types.h>
+#include <sys/socket.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "events.h"
+#include "httpc.h"
+#include "mqtt.h"
+#include "notify.h"
+
+#define NOTIFY_POLL_MS 500
+#define NOTIFY_BATCH 32
+#define NOTIFY_SEND_TIMEOUT_MS 3000
+#define NOTIFY_TYPE_SLOTS 16
+
+typedef struct {
+    char type[32];
+    long long last_sent_ms;
+    int pending_suppressed;
+} notify_type_state_t;
+
+typedef struct {
+    unsigned long sent;
+    unsigned long failed;
+    unsigned long suppressed;
+    long long last_sent_ms;
+    char last_error[96];
+    notify_type_state_t types[NOTIFY_TYPE_SLOTS];
+} notify_sink_state_t;
+
+static pthread_mutex_t g_notify_lock = PTHREAD_MUTEX_INITIALIZER;
+static notify_sink_state_t g_sink_state[NOTIFY_MAX_SINKS];
+static unsigned long long g_notify_cursor;
+static pthread_t g_notify_thread;
+static int g_notify_running;
+static int g_notify_stop;
+
+static long long g_exec_window_start_ms;
+static int g_exec_window_failures;
+
+static const char *const k_sink_types[] = { "webhook", "slack", "mattermost", "mqtt", "smtp", NULL };
+
+static void notify_copy(char *dst, size_t dst_sz, const char *src) {
+    strncpy(dst, src ? src : "", dst_sz - 1);
+    dst[dst_sz - 1] = '\0';
+}
+
+void notify_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->notify, 0, sizeof(cfg->notify));
+    cfg->notify.exec_failure_threshold = 0;
+    cfg->notify.exec_failure_window_s = 300;
+}
+
+static notify_sink_config_t *notify_find_sink(config_t *cfg, const char *name) {
+    for (int i = 0; i < cfg->notify.sink_count; i++) {
+        if (strcmp(cfg->notify.sinks[i].name, name) == 0) return &cfg->notify.sinks[i];
+    }
+    if (cfg->notify.sink_count >= NOTIFY_MAX_SINKS) return NULL;
+    notify_sink_config_t *s = &cfg->notify.sinks[cfg->notify.sink_count++];
+    memset(s, 0, sizeof(*s));
+    notify_copy(s->name, sizeof(s->name), name);
+    notify_copy(s->events, sizeof(s->events), "*");
+    return s;
+}
+
+int notify_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (strcmp(section, "notify") == 0) {
+        if (!strcmp(key, "exec_failure_threshold")) {
+            cfg->notify.exec_failure_threshold = atoi(value);
+        } else if (!strcmp(key, "exec_failure_window_s")) {
+            cfg->notify.exec_failure_window_s = atoi(value);
+        } else {
+            fprintf(stderr, "WARN: ignoring unknown notify key '%s'\n", key);
+        }
+        return 1;
+    }
+    if (strncmp(section, "notify.", 7) != 0) return 0;
+
+    const char *name = section + 7;
+    if (!*name) return 1;
+    notify_sink_config_t *s = notify_find_sink(cfg, name);
+    if (!s) {
+        fprintf(stderr, "WARN: notify sink capacity reached (%d), ignoring [%s]\n",
+                NOTIFY_MAX_SINKS, section);
+        return 1;
+    }
+
+    if (!strcmp(key, "type")) {
+        int known = 0;
+        for (int i = 0; k_sink_types[i]; i++) {
+            if (strcasecmp(value, k_sink_types[i]) == 0) {
+                notify_copy(s->type, sizeof(s->type), k_sink_types[i]);
+                known = 1;
+                break;
+            }
+        }
+        if (!known) {
+            fprintf(stderr, "WARN: notify sink '%s' has unknown type '%s'\n", s->name, value);
+            s->type[0] = '\0';
+        }
+    } else if (!strcmp(key, "url")) {
+        notify_copy(s->url, sizeof(s->url), value);
+        if (strncmp(value, "https://", 8) == 0) {
+            fprintf(stderr,
+                    "WARN: notify sink '%s': https:// is not supported (built without TLS), "
+                    "point it at a local relay\n", s->name);
+        }
+    } else if (!strcmp(key, "events")) {
+        notify_copy(s->events, sizeof(s->events), value);
+    } else if (!strcmp(key, "rate_limit_s")) {
+        s->rate_limit_s = atoi(value);
+    } else if (!strcmp(key, "template")) {
+        notify_copy(s->template_text, sizeof(s->template_text), value);
+    } else if (!strcmp(key, "topic")) {
+        notify_copy(s->topic, sizeof(s->topic), value);
+    } else if (!strcmp(key, "from")) {
+        notify_copy(s->from, sizeof(s->from), value);
+    } else if (!strcmp(key, "to")) {
+        notify_copy(s->to, sizeof(s->to), value);
+    } else if (!strcmp(key, "subject")) {
+        notify_copy(s->subject, sizeof(s->subject), value);
+    } else {
+        fprintf(stderr, "WARN: notify sink '%s': ignoring unknown key '%s'\n", s->name, key);
+    }
+    return 1;
+}
+
+void notify_exec_result(const config_t *cfg, const char *path, int rc) {
+    if (!cfg || cfg->notify.exec_failure_threshold <= 0 || rc == 0) return;
+    long long now = now_ms();
+    long long window_ms = (long long)(cfg->notify.exec_failure_window_s > 0
+                                      ? cfg->notify.exec_failure_window_s : 300) * 1000LL;
+    int failures;
+    pthread_mutex_lock(&g_notify_lock);
+    if (g_exec_window_start_ms == 0 || now - g_exec_window_start_ms > window_ms) {
+        g_exec_window_start_ms = now;
+        g_exec_window_failures = 0;
+    }
+    failures = ++g_exec_window_failures;
+    pthread_mutex_unlock(&g_notify_lock);
+
+    /* Fire once per window, when the threshold is crossed. */
+    if (failures != cfg->notify.exec_failure_threshold) return;
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_number(eo, "failures", failures);
+    json_object_set_number(eo, "window_s", (double)(window_ms / 1000));
+    json_object_set_string(eo, "path", path ? path : "");
+    json_object_set_number(eo, "rc", rc);
+    (void)events_emit("exec_failure", ev);
+}
+
+/* ---------- Templating ---------- */
+
+static const char *notify_default_template(const char *type) {
+    if (!strcmp(type, "node_down")) return "[{node}] node {id} is down (last seen {last_seen_s}s ago)";
+    if (!strcmp(type, "node_up")) return "[{node}] node {id} is back up";
+    if (!strcmp(type, "id_conflict")) return "[{node}] id {id} registered from {incoming} while {holder} holds it ({action})";
+    if (!strcmp(type, "node_first_contact")) return "[{node}] expected node {id} made first contact from {remote_ip}";
+    if (!strcmp(type, "node_incompatible")) return "[{node}] {id} runs autod {autod_version} (API {api_version}), incompatible with this master ({policy})";
+    if (!strcmp(type, "slot_binding")) return "[{node}] slot {slot}: {old_id} -> {new_id} ({reason})";
+    if (!strcmp(type, "slot_binding_reverted")) return "[{node}] slot {slot}: temporary binding of {id} ended ({reason}), back to {restored_id}";
+    if (!strcmp(type, "slot_drift")) return "[{node}] desired group {group} drifted ({bound}/{replicas} bound)";
+    if (!strcmp(type, "slot_converged")) return "[{node}] desired group {group} converged after {drift_s}s";
+    if (!strcmp(type, "node_quarantined")) return "[{node}] {id} quarantined after {failures} failed dispatches";
+    if (!strcmp(type, "circuit_opened")) return "[{node}] circuit to {id} open for {cooldown_s}s after {failures} failed dispatches";
+    if (!strcmp(type, "circuit_closed")) return "[{node}] circuit to {id} closed after {open_s}s";
+    if (!strcmp(type, "node_readmitted")) return "[{node}] {id} back in rotation after {quarantined_s}s in quarantine";
+    if (!strcmp(type, "node_decommissioned")) return "[{node}] {id} decommissioned by {actor} (drain {drain})";
+    if (!strcmp(type, "node_renamed")) return "[{node}] {previous_id} now registers as {id}";
+    if (!strcmp(type, "capacity_warning")) return "[{node}] {resource} at {used} of {limit} ({pct}%)";
+    if (!strcmp(type, "slot_degraded")) return "[{node}] slot {slot} degraded on {id} ({error})";
+    if (!strcmp(type, "slot_lease")) return "[{node}] slot {slot} lease {action} ({holder})";
+    if (!strcmp(type, "slot_recovered")) return "[{node}] slot {slot} healthy again on {id}";
+    if (!strcmp(type, "promoted")) return "[{node}] promoted to master as {id} ({seeded} nodes seeded)";
+    if (!strcmp(type, "workflow_finished")) return "[{node}] workflow {id} ({name}) {status}: {succeeded} ok, {failed} failed, {skipped} skipped";
+    if (!strcmp(type, "system_action")) return "[{node}] system {action} {status} (delay {delay_s}s, from {remote_ip})";
+    if (!strcmp(type, "exec_integrity_failed")) return "[{node}] refused {path}: {file} failed its SHA-256 check ({outcome})";
+    if (!strcmp(type, "exec_failure")) return "[{node}] {failures} exec failures in {window_s}s (last {path} rc={rc})";
+    return "[{node}] {type}: {data}";
+}
+
+static void notify_append(char *out, size_t out_sz, size_t *len, const char *s, size_t n) {
+    if (*len >= out_sz - 1) return;
+    if (n > out_sz - 1 - *len) n = out_sz - 1 - *len;
+    memcpy(out + *len, s, n);
+    *len += n;
+    out[*len] = '\0';
+}
+
+static void notify_format_value(const JSON_Value *v, char *buf, size_t sz) {
+    buf[0] = '\0';
+    switch (json_value_get_type(v)) {
+    case JSONString:
+        notify_copy(buf, sz, json_value_get_string(v));
+        break;
+    case JSONNumber:
+        snprintf(buf, sz, "%.15g", json_value_get_number(v));
+        break;
+    case JSONBoolean:
+        notify_copy(buf, sz, json_value_get_boolean(v) ? "true" : "false");
+        break;
+    case JSONNull:
+        notify_copy(buf, sz, "-");
+        break;
+    default: {
+        char *s = json_serialize_to_string(v);
+        if (s) {
+            notify_copy(buf, sz, s);
+            json_free_serialized_string(s);
+        }
+        break;
+    }
+    }
+}
+
+/*
+ * Expand {placeholders}: {node}, {type}, {seq}, {ts_ms}, {ts_unix_ms}, {suppressed}, {data}
+ * (the event payload as JSON) and any top-level key of the event payload.
+ * Unknown placeholders expand to an empty string.
+ */
+static void notify_render(const char *tmpl, const char *node, JSON_Object *event,
+                          int suppressed, char *out, size_t out_sz) {
+    size_t len = 0;
+    out[0] = '\0';
+    JSON_Object *data = json_object_get_object(event, "data");
+    for (const char *p = tmpl; *p; ) {
+        const char *close = *p == '{' ? strchr(p, '}') : NULL;
+        if (!close || close - p > 48) {
+            notify_append(out, out_sz, &len, p, 1);
+            p++;
+            continue;
+        }
+        char key[48];
+        size_t klen = (size_t)(close - p - 1);
+        memcpy(key, p + 1, klen);
+        key[klen] = '\0';
+        p = close + 1;
+
+        char val[256] = "";
+        if (!strcmp(key, "node")) {
+            notify_copy(val, sizeof(val), node);
+        } else if (!strcmp(key, "type")) {
+            notify_copy(val, sizeof(val), json_object_get_string(event, "type"));
+        } else if (!strcmp(key, "seq") || !strcmp(key, "ts_ms") || !strcmp(key, "ts_unix_ms")) {
+            snprintf(val, sizeof(val), "%.0f", json_object_get_number(event, key));
+        } else if (!strcmp(key, "suppressed")) {
+            snprintf(val, sizeof(val), "%d", suppressed);
+        } else if (!strcmp(key, "data")) {
+            JSON_Value *dv = json_object_get_value(event, "data");
+            if (dv) notify_format_value(dv, val, sizeof(val));
+        } else if (data && json_object_has_value(data, key)) {
+            notify_format_value(json_object_get_value(data, key), val, sizeof(val));
+        }
+        notify_append(out, out_sz, &len, val, strlen(val));
+    }
+}
+
+/* ---------- Transports ---------- */
+
+static int notify_http_post(const char *url, JSON_Value *body, char *err, size_t err_sz) {
+    http_url_t target;
+    if (httpc_parse_url(url, &target, "/") != 0) {
+        notify_copy(err, err_sz, "unsupported_url");
+        return -1;
+    }
+    char *serialized = json_serialize_to_string(body);
+    if (!serialized) {
+        notify_copy(err, err_sz, "encode_failed");
+        return -1;
+    }
+    int status = httpc_post_json(&target, serialized, NULL, NULL, NOTIFY_SEND_TIMEOUT_MS);
+    json_free_serialized_string(serialized);
+    if (status < 200 || status >= 300) {
+        if (status < 0) notify_copy(err, err_sz, "connect_failed");
+        else snprintf(err, err_sz, "http_status_%d", status);
+        return -1;
+    }
+    return 0;
+}
+
+static int notify_mqtt_publish(const notify_sink_config_t *sink, const char *topic,
+                               JSON_Value *body, char *err, size_t err_sz) {
+    char host[128];
+    int port = 0;
+    if (mqtt_parse_url(sink->url, host, sizeof(host), &port) != 0) {
+        notify_copy(err, err_sz, "unsupported_url");
+        return -1;
+    }
+    char *serialized = json_serialize_to_string(body);
+    if (!serialized) {
+        notify_copy(err, err_sz, "encode_failed");
+        return -1;
+    }
+    char client_id[24];
+    snprintf(client_id, sizeof(client_id), "autod-%ld", (long)getpid());
+    int rc = mqtt_publish_once(host, port, client_id, topic, serialized, strlen(serialized),
+                               NOTIFY_SEND_TIMEOUT_MS);
+    json_free_serialized_string(serialized);
+    if (rc != 0) notify_copy(err, err_sz, "mqtt_publish_failed");
+    return rc;
+}
+
+/* Read one SMTP reply (possibly multi-line) and return its status code. */
+static int smtp_read_reply(int fd) {
+    char buf[512];
+    size_t len = 0;
+    for (;;) {
+        ssize_t r = recv(fd, buf + len, sizeof(buf) - 1 - len, 0);
+        if (r < 0 && errno == EINTR) continue;
+        if (r <= 0) return -1;
+        len += (size_t)r;
+        buf[len] = '\0';
+        /* Find the last complete line; "NNN " marks the final line of a reply. */
+        char *line = buf;
+        char *eol;
+        while ((eol = strstr(line, "\r\n")) != NULL) {
+            if (eol - line >= 4 && line[3] == ' ') return atoi(line);
+            line = eol + 2;
+        }
+        if (line != buf) {
+            len = strlen(line);
+            memmove(buf, line, len + 1);
+        }
+        if (len >= sizeof(buf) - 1) return -1;
+    }
+}
+
+static int smtp_command(int fd, const char *cmd, int expect_class) {
+    if (cmd) {
+        size_t n = strlen(cmd);
+        if (send(fd, cmd, n, 0) != (ssize_t)n) return -1;
+    }
+    int code = smtp_read_reply(fd);
+    return code / 100 == expect_class ? 0 : -1;
+}
+
+static int notify_smtp_send(const notify_sink_config_t *sink, const char *subject,
+                            const char *text, char *err, size_t err_sz) {
+    char host[128];
+    int port = 25;
+    const char *p = sink->url;
+    if (strncmp(p, "smtp://", 7) == 0) p += 7;
+    size_t hlen = strcspn(p, ":/");
+    if (hlen == 0 || hlen >= sizeof(host) || !sink->to[0]) {
+        notify_copy(err, err_sz, "bad_config");
+        return -1;
+    }
+    memcpy(host, p, hlen);
+    host[hlen] = '\0';
+    if (p[hlen] == ':') port = atoi(p + hlen + 1);
+
+    int fd = httpc_connect(host, port, NOTIFY_SEND_TIMEOUT_MS);
+    if (fd < 0) {
+        notify_copy(err, err_sz, "connect_failed");
+        return -1;
+    }
+
+    const char *from = sink->from[0] ? sink->from : "autod@localhost";
+    char line[512];
+    int rc = smtp_command(fd, NULL, 2);
+    if (rc == 0) rc = smtp_command(fd, "HELO autod\r\n", 2);
+    if (rc == 0) {
+        snprintf(line, sizeof(line), "MAIL FROM:<%s>\r\n", from);
+        rc = smtp_command(fd, line, 2);
+    }
+    char rcpts[sizeof(sink->to)];
+    notify_copy(rcpts, sizeof(rcpts), sink->to);
+    char *save = NULL;
+    for (char *tok = strtok_r(rcpts, ",", &save); rc == 0 && tok; tok = strtok_r(NULL, ",", &save)) {
+        while (*tok == ' ') tok++;
+        size_t tl = strlen(tok);
+        while (tl > 0 && tok[tl - 1] == ' ') tok[--tl] = '\0';
+        if (!*tok) continue;
+        snprintf(line, sizeof(line), "RCPT TO:<%s>\r\n", tok);
+        rc = smtp_command(fd, line, 2);
+    }
+    if (rc == 0) rc = smtp_command(fd, "DATA\r\n", 3);
+    if (rc == 0) {
+        char date[64];
+        time_t t = time(NULL);
+        struct tm tm;
+        gmtime_r(&t, &tm);
+        strftime(date, sizeof(date), "%a, %d %b %Y %H:%M:%S +0000", &tm);
+
+        /* Headers, then the body with CRLF line endings and dot-stuffing. */
+        size_t cap = 1024 + strlen(text) * 2;
+        char *msg = malloc(cap);
+        if (!msg) rc = -1;
+        if (msg) {
+            int n = snprintf(msg, cap,
+                             "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n"
+                             "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n",
+                             from, sink->to, subject, date);
+            size_t len = n > 0 ? (size_t)n : 0;
+            int bol = 1;
+            for (const char *q = text; *q; q++) {
+                if (*q == '\r') continue;
+                if (*q == '\n') {
+                    msg[len++] = '\r';
+                    msg[len++] = '\n';
+                    bol = 1;
+                    continue;
+                }
+                if (bol && *q == '.') msg[len++] = '.';
+                msg[len++] = *q;
+                bol = 0;
+            }
+            if (send(fd, msg, len, 0) != (ssize_t)len) rc = -1;
+            free(msg);
+        }
+    }
+    if (rc == 0) rc = smtp_command(fd, "\r\n.\r\n", 2);
+    if (rc == 0) (void)smtp_command(fd, "QUIT\r\n", 2);
+    close(fd);
+    if (rc != 0) notify_copy(err, err_sz, "smtp_rejected");
+    return rc;
+}
+
+/* ---------- Dispatch ---------- */
+
+static int notify_sink_wants(const notify_sink_config_t *sink, const char *type) {
+    if (!sink->type[0]) return 0;
+    if (!strcmp(type, "notify_test")) return 1;
+    if (!sink->events[0] || !strcmp(sink->events, "*")) return 1;
+    char tmp[sizeof(sink->events)];
+    notify_copy(tmp, sizeof(tmp), sink->events);
+    char *save = NULL;
+    for (char *tok = strtok_r(tmp, ", ", &save); tok; tok = strtok_r(NULL, ", ", &save)) {
+        if (!strcmp(tok, "*") || !strcmp(tok, type)) return 1;
+    }
+    return 0;
+}
+
+static notify_type_state_t *notify_type_state_locked(notify_sink_state_t *st, const char *type) {
+    notify_type_state_t *oldest = &st->types[0];
+    for (int i = 0; i < NOTIFY_TYPE_SLOTS; i++) {
+        notify_type_state_t *t = &st->types[i];
+        if (!strcmp(t->type, type)) return t;
+        if (!t->type[0]) {
+            oldest = t;
+            break;
+        }
+        if (t->last_sent_ms < oldest->last_sent_ms) oldest = t;
+    }
+    memset(oldest, 0, sizeof(*oldest));
+    notify_copy(oldest->type, sizeof(oldest->type), type);
+    return oldest;
+}
+
+static void notify_deliver(const config_t *cfg, int idx, JSON_Object *event) {
+    const notify_sink_config_t *sink = &cfg->notify.sinks[idx];
+    const char *type = json_object_get_string(event, "type");
+    if (!type || !notify_sink_wants(sink, type)) return;
+
+    long long now = now_ms();
+    int suppressed = 0;
+    pthread_mutex_lock(&g_notify_lock);
+    notify_sink_state_t *st = &g_sink_state[idx];
+    notify_type_state_t *ts = notify_type_state_locked(st, type);
+    if (sink->rate_limit_s > 0 && ts->last_sent_ms > 0 && strcmp(type, "notify_test") != 0 &&
+        now - ts->last_sent_ms < (long long)sink->rate_limit_s * 1000LL) {
+        ts->pending_suppressed++;
+        st->suppressed++;
+        pthread_mutex_unlock(&g_notify_lock);
+        return;
+    }
+    suppressed = ts->pending_suppressed;
+    ts->pending_suppressed = 0;
+    ts->last_sent_ms = now;
+    pthread_mutex_unlock(&g_notify_lock);
+
+    const char *node = cfg->sync_id[0] ? cfg->sync_id : (cfg->device[0] ? cfg->device : "autod");
+    char text[1024];
+    notify_render(sink->template_text[0] ? sink->template_text : notify_default_template(type),
+                  node, event, suppressed, text, sizeof(text));
+
+    char err[96] = "";
+    int rc;
+    if (!strcmp(sink->type, "slack") || !strcmp(sink->type, "mattermost")) {
+        JSON_Value *body = json_value_init_object();
+        json_object_set_string(json_object(body), "text", text);
+        rc = notify_http_post(sink->url, body, err, sizeof(err));
+        json_value_free(body);
+    } else if (!strcmp(sink->type, "smtp")) {
+        char subject[256];
+        notify_render(sink->subject[0] ? sink->subject : "[autod] {node}: {type}",
+                      node, event, suppressed, subject, sizeof(subject));
+        char body[1536];
+        JSON_Value *data_v = json_object_get_value(event, "data");
+        char *data = data_v ? json_serialize_to_string_pretty(data_v) : NULL;
+        snprintf(body, sizeof(body), "%s\n\n%s\n", text, data ? data : "");
+        if (data) json_free_serialized_string(data);
+        rc = notify_smtp_send(sink, subject, body, err, sizeof(err));
+    } else {
+        JSON_Value *body = json_value_init_object();
+        JSON_Object *bo = json_object(body);
+        json_object_set_string(bo, "node", node);
+        json_object_set_string(bo, "type", type);
+        json_object_set_number(bo, "seq", json_object_get_number(event, "seq"));
+        json_object_set_number(bo, "ts_ms", json_object_get_number(event, "ts_ms"));
+        json_object_set_number(bo, "ts_unix_ms", json_object_get_number(event, "ts_unix_ms"));
+        json_object_set_string(bo, "text", text);
+        if (suppressed > 0) json_object_set_number(bo, "suppressed", suppressed);
+        JSON_Value *data = json_object_get_value(event, "data");
+        if (data) json_object_set_value(bo, "data", json_value_deep_copy(data));
+        if (!strcmp(sink->type, "mqtt")) {
+            char topic[256];
+            notify_render(sink->topic[0] ? sink->topic : "autod/{node}/events/{type}",
+                          node, event, suppressed, topic, sizeof(topic));
+            rc = notify_mqtt_publish(sink, topic, body, err, sizeof(err));
+        } else {
+            rc = notify_http_post(sink->url, body, err, sizeof(err));
+        }
+        json_value_free(body);
+    }
+
+    pthread_mutex_lock(&g_notify_lock);
+    if (rc == 0) {
+        st->sent++;
+        st->last_sent_ms = now;
+        st->last_error[0] = '\0';
+    } else {
+        st->failed++;
+        notify_copy(st->last_error, sizeof(st->last_error), err);
+    }
+    pthread_mutex_unlock(&g_notify_lock);
+    if (rc != 0) {
+        fprintf(stderr, "notify: sink '%s' failed to deliver %s (%s)\n", sink->name, type, err);
+    }
+}
+
+static int notify_should_stop(void) {
+    pthread_mutex_lock(&g_notify_lock);
+    int stop = g_notify_stop;
+    pthread_mutex_unlock(&g_notify_lock);
+    return stop;
+}
+
+static void *notify_thread_main(void *arg) {
+    app_t *app = (app_t *)arg;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) return NULL;
+
+    while (!notify_should_stop()) {
+        app_config_snapshot(app, cfg);
+        pthread_mutex_lock(&g_notify_lock);
+        unsigned long long cursor = g_notify_cursor;
+        pthread_mutex_unlock(&g_notify_lock);
+
+        JSON_Value *arr_v = json_value_init_array();
+        JSON_Array *arr = json_array(arr_v);
+        (void)events_collect(cursor, NULL, NOTIFY_BATCH, arr, NULL);
+        size_t count = json_array_get_count(arr);
+        for (size_t i = 0; i < count; i++) {
+            JSON_Object *event = json_array_get_object(arr, i);
+            for (int s = 0; s < cfg->notify.sink_count; s++) {
+                notify_deliver(cfg, s, event);
+            }
+            cursor = (unsigned long long)json_object_get_number(event, "seq");
+        }
+        json_value_free(arr_v);
+
+        pthread_mutex_lock(&g_notify_lock);
+        g_notify_cursor = cursor;
+        pthread_mutex_unlock(&g_notify_lock);
+
+        if (count < NOTIFY_BATCH) {
+            struct timespec ts = { 0, NOTIFY_POLL_MS * 1000000L };
+            nanosleep(&ts, NULL);
+        }
+    }
+    free(cfg);
+    return NULL;
+}
+
+int notify_start_thread(app_t *app) {
+    if (!app) return -1;
+    pthread_mutex_lock(&g_notify_lock);
+    g_notify_stop = 0;
+    /* Events restored from the store were delivered before the restart. */
+    if (g_notify_cursor < events_restored_seq()) g_notify_cursor = events_restored_seq();
+    if (g_notify_running) {
+        pthread_mutex_unlock(&g_notify_lock);
+        return 0;
+    }
+    if (pthread_create(&g_notify_thread, NULL, notify_thread_main, app) == 0) {
+        g_notify_running = 1;
+        pthread_mutex_unlock(&g_notify_lock);
+        return 0;
+    }
+    pthread_mutex_unlock(&g_notify_lock);
+    fprintf(stderr, "WARN: failed to start notify thread\n");
+    return -1;
+}
+
+void notify_stop_thread(void) {
+    pthread_mutex_lock(&g_notify_lock);
+    g_notify_stop = 1;
+    int running = g_notify_running;
+    pthread_mutex_unlock(&g_notify_lock);
+    if (running) {
+        pthread_join(g_notify_thread, NULL);
+        pthread_mutex_lock(&g_notify_lock);
+        g_notify_running = 0;
+        pthread_mutex_unlock(&g_notify_lock);
+    }
+}
+
+/* ---------- HTTP ---------- */
+
+static int h_notify(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri) return 0;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+
+    const char *uri = api_local_uri(c);
+    if (strcmp(uri, "/notify/test") == 0) {
+        if (strcmp(ri->request_method, "POST") != 0) {
+            send_plain(c, 405, "method_not_allowed", 1);
+            free(cfg);
+            return 1;
+        }
+        JSON_Value *ev = json_value_init_object();
+        json_object_set_string(json_object(ev), "actor", ri->remote_addr);
+        unsigned long long seq = events_emit("notify_test", ev);
+        JSON_Value *resp = json_value_init_object();
+        json_object_set_number(json_object(resp), "seq", (double)seq);
+        send_json(c, resp, 202, 1);
+        json_value_free(resp);
+        free(cfg);
+        return 1;
+    }
+    if (strcmp(uri, "/notify") != 0) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    if (strcmp(ri->request_method, "GET") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    JSON_Value *arr_v = json_value_init_array();
+    JSON_Array *arr = json_array(arr_v);
+    pthread_mutex_lock(&g_notify_lock);
+    json_object_set_number(ro, "cursor", (double)g_notify_cursor);
+    json_object_set_boolean(ro, "running", g_notify_running);
+    for (int i = 0; i < cfg->notify.sink_count; i++) {
+        const notify_sink_config_t *sink = &cfg->notify.sinks[i];
+        const notify_sink_state_t *st = &g_sink_state[i];
+        JSON_Value *item = json_value_init_object();
+        JSON_Object *io = json_object(item);
+        json_object_set_string(io, "name", sink->name);
+        json_object_set_string(io, "type", sink->type[0] ? sink->type : "invalid");
+        json_object_set_string(io, "events", sink->events);
+        json_object_set_number(io, "rate_limit_s", sink->rate_limit_s);
+        json_object_set_number(io, "sent", (double)st->sent);
+        json_object_set_number(io, "failed", (double)st->failed);
+        json_object_set_number(io, "suppressed", (double)st->suppressed);
+        if (st->last_sent_ms > 0) json_object_set_number(io, "last_sent_ms", (double)st->last_sent_ms);
+        if (st->last_error[0]) json_object_set_string(io, "last_error", st->last_error);
+        json_array_append_value(arr, item);
+    }
+    pthread_mutex_unlock(&g_notify_lock);
+    json_object_set_value(ro, "sinks", arr_v);
+    json_object_set_number(ro, "exec_failure_threshold", cfg->notify.exec_failure_threshold);
+    json_object_set_number(ro, "exec_failure_window_s", cfg->notify.exec_failure_window_s);
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+    free(cfg);
+    return 1;
+}
+
+void notify_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    api_set_handler(ctx, "/notify", h_notify, app);
+}
@@ -0,0 +1,41 @@
+#ifndef AUTOD_NOTIFY_H
+#define AUTOD_NOTIFY_H
+
+#define NOTIFY_MAX_SINKS 8
+
+typedef struct {
+    char name[32];
+    char type[16];
+    char url[256];
+    char events[256];
+    int  rate_limit_s;
+    char template_text[512];
+    char topic[128];
+    char from[128];
+    char to[256];
+    char subject[128];
+} notify_sink_config_t;
+
+typedef struct {
+    int exec_failure_threshold;
+    int exec_failure_window_s;
+    int sink_count;
+    notify_sink_config_t sinks[NOTIFY_MAX_SINKS];
+} notify_config_t;
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_context;
+
+void notify_cfg_defaults(config_t *cfg);
+int notify_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* Count exec results towards [notify] exec_failure_threshold; emits an
+ * exec_failure event when the threshold is reached within the window. */
+void notify_exec_result(const config_t *cfg, const char *path, int rc);
+
+int notify_start_thread(app_t *app);
+void notify_stop_thread(void);
+void notify_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
@@ -0,0 +1,466 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <errno.h>
+#include <time.h>
+#include <signal.h>
+#include <unistd.h>
+#include <pthread.h>
+#include <fnmatch.h>
+#include <poll.h>
+#include <arpa/inet.h>
+#include <netinet/in.h>
+#include <sys/socket.h>
+
+#include "parson.h"
+#include "autod.h"
+#include "events.h"
+#include "dnscache.h"
+#include "portcheck.h"
+
+extern volatile sig_atomic_t g_stop;
+
+#define PORTCHECK_MAX_NODES SYNC_MAX_SLAVES
+#define PORTCHECK_MAX_PROBES (PORTCHECK_MAX_NODES * PORTCHECK_MAX_CHECKS)
+
+typedef struct {
+    char name[32];                /* empty = free */
+    int port;
+    int udp;
+    int state;                    /* -1 unknown, 0 down, 1 up */
+    long long latency_ms;         /* -1 when nothing answered */
+    char error[24];
+    long long checked_unix;
+    long long since_unix;         /* state unchanged since */
+    int seen;
+} portcheck_result_t;
+
+typedef struct {
+    char id[64];                  /* empty = free */
+    portcheck_result_t results[PORTCHECK_MAX_CHECKS];
+    int seen;
+} portcheck_node_t;
+
+typedef struct {
+    int node;
+    int result;
+    int fd;
+    int udp;
+    int done;
+    int up;
+    long long latency_ms;
+    const char *error;
+} portcheck_probe_t;
+
+static pthread_mutex_t g_portcheck_lock = PTHREAD_MUTEX_INITIALIZER;
+static portcheck_node_t g_nodes[PORTCHECK_MAX_NODES];
+static unsigned long g_version;
+static pthread_t g_portcheck_thread;
+static int g_portcheck_running;
+static volatile int g_portcheck_stop;
+
+/* ---------- Config ---------- */
+
+void portcheck_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->portcheck, 0, sizeof(cfg->portcheck));
+    cfg->portcheck.interval_s = 30;
+    cfg->portcheck.timeout_ms = 2000;
+}
+
+static portcheck_check_t *portcheck_find_or_add(config_t *cfg, const char *name) {
+    for (int i = 0; i < cfg->portcheck.check_count; i++) {
+        if (!strcmp(cfg->portcheck.checks[i].name, name)) return &cfg->portcheck.checks[i];
+    }
+    if (cfg->portcheck.check_count >= PORTCHECK_MAX_CHECKS) return NULL;
+    portcheck_check_t *pc = &cfg->portcheck.checks[cfg->portcheck.check_count++];
+    memset(pc, 0, sizeof(*pc));
+    snprintf(pc->name, sizeof(pc->name), "%s", name);
+    return pc;
+}
+
+int portcheck_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (!strcmp(section, "portcheck")) {
+        int v = atoi(value);
+        if (!strcmp(key, "interval_s")) {
+            if (v >= 1) cfg->portcheck.interval_s = v;
+            else fprintf(stderr, "WARN: ignoring portcheck interval_s %s (minimum 1)\n", value);
+        } else if (!strcmp(key, "timeout_ms")) {
+            if (v >= 50) cfg->portcheck.timeout_ms = v;
+            else fprintf(stderr, "WARN: ignoring portcheck timeout_ms %s (minimum 50)\n", value);
+        } else {
+            fprintf(stderr, "WARN: ignoring unknown portcheck key '%s'\n", key);
+        }
+        return 1;
+    }
+    if (strncmp(section, "portcheck.", 10) != 0 || !section[10]) return 0;
+    portcheck_check_t *pc = portcheck_find_or_add(cfg, section + 10);
+    if (!pc) {
+        fprintf(stderr, "WARN: portcheck capacity reached (%d)\n", PORTCHECK_MAX_CHECKS);
+        return 1;
+    }
+    if (!strcmp(key, "port")) {
+        int v = atoi(value);
+        if (v >= 1 && v <= 65535) pc->port = v;
+        else fprintf(stderr, "WARN: portcheck %s: ignoring port '%s'\n", pc->name, value);
+    } else if (!strcmp(key, "proto")) {
+        if (!strcasecmp(value, "tcp")) pc->udp = 0;
+        else if (!strcasecmp(value, "udp")) pc->udp = 1;
+        else fprintf(stderr, "WARN: portcheck %s: ignoring proto '%s' (tcp or udp)\n", pc->name, value);
+    } else if (!strcmp(key, "nodes")) {
+        snprintf(pc->nodes, sizeof(pc->nodes), "%s", value);
+    } else {
+        fprintf(stderr, "WARN: portcheck %s: ignoring unknown key '%s'\n", pc->name, key);
+    }
+    return 1;
+}
+
+/* ---------- Results ---------- */
+
+unsigned long portcheck_version(void) {
+    pthread_mutex_lock(&g_portcheck_lock);
+    unsigned long v = g_version;
+    pthread_mutex_unlock(&g_portcheck_lock);
+    return v;
+}
+
+static int portcheck_node_matches(const portcheck_check_t *pc, const char *id) {
+    if (!pc->nodes[0]) return 1;
+    char tmp[256];
+    snprintf(tmp, sizeof(tmp), "%s", pc->nodes);
+    char *save = NULL;
+    for (char *tok = strtok_r(tmp, ", ", &save); tok; tok = strtok_r(NULL, ", ", &save)) {
+        if (fnmatch(tok, id, 0) == 0) return 1;
+    }
+    return 0;
+}
+
+static portcheck_node_t *portcheck_node_locked(const char *id, int add) {
+    portcheck_node_t *free_slot = NULL;
+    for (int i = 0; i < PORTCHECK_MAX_NODES; i++) {
+        if (!g_nodes[i].id[0]) {
+            if (!free_slot) free_slot = &g_nodes[i];
+        } else if (!strcmp(g_nodes[i].id, id)) {
+            return &g_nodes[i];
+        }
+    }
+    if (!add || !free_slot) return NULL;
+    memset(free_slot, 0, sizeof(*free_slot));
+    snprintf(free_slot->id, sizeof(free_slot->id), "%s", id);
+    return free_slot;
+}
+
+/* The result slot for a check on a node; a check whose port or protocol
+ * changed starts over as unknown. */
+static int portcheck_result_locked(portcheck_node_t *n, const portcheck_check_t *pc) {
+    int free_slot = -1;
+    for (int i = 0; i < PORTCHECK_MAX_CHECKS; i++) {
+        portcheck_result_t *r = &n->results[i];
+        if (!r->name[0]) {
+            if (free_slot < 0) free_slot = i;
+            continue;
+        }
+        if (strcmp(r->name, pc->name) != 0) continue;
+        if (r->port != pc->port || r->udp != pc->udp) {
+            free_slot = i;
+            break;
+        }
+        return i;
+    }
+    if (free_slot < 0) return -1;
+    portcheck_result_t *r = &n->results[free_slot];
+    memset(r, 0, sizeof(*r));
+    snprintf(r->name, sizeof(r->name), "%s", pc->name);
+    r->port = pc->port;
+    r->udp = pc->udp;
+    r->state = -1;
+    r->latency_ms = -1;
+    g_version++;
+    return free_slot;
+}
+
+static void portcheck_event(const char *type, const char *id, const portcheck_result_t *r,
+                            long long now) {
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_string(eo, "id", id);
+    json_object_set_string(eo, "check", r->name);
+    json_object_set_number(eo, "port", r->port);
+    json_object_set_string(eo, "proto", r->udp ? "udp" : "tcp");
+    if (r->error[0]) json_object_set_string(eo, "error", r->error);
+    if (r->latency_ms >= 0) json_object_set_number(eo, "latency_ms", (double)r->latency_ms);
+    if (!strcmp(type, "port_up")) json_object_set_number(eo, "down_s", (double)(now - r->since_unix));
+    (void)events_emit(type, ev);
+}
+
+static void portcheck_record_locked(const portcheck_probe_t *p, long long now) {
+    portcheck_node_t *n = &g_nodes[p->node];
+    portcheck_result_t *r = &n->results[p->result];
+    int was = r->state;
+    snprintf(r->error, sizeof(r->error), "%s", p->error ? p->error : "");
+    if (r->latency_ms != p->latency_ms || was != p->up) g_version++;
+    r->latency_ms = p->latency_ms;
+    r->checked_unix = now;
+    if (was == p->up) return;
+    if (p->up) {
+        if (was == 0) {
+            fprintf(stderr, "portcheck: %s %s (%d/%s) is up again\n", n->id, r->name, r->port,
+                    r->udp ? "udp" : "tcp");
+            portcheck_event("port_up", n->id, r, now);
+        }
+    } else {
+        fprintf(stderr, "portcheck: %s %s (%d/%s) is down (%s)\n", n->id, r->name, r->port,
+                r->udp ? "udp" : "tcp", r->error);
+        portcheck_event("port_down", n->id, r, now);
+    }
+    r->state = p->up;
+    r->since_unix = now;
+}
+
+void portcheck_merge_json(const char *id, JSON_Object *o) {
+    if (!id || !*id || !o) return;
+    pthread_mutex_lock(&g_portcheck_lock);
+    const portcheck_node_t *n = portcheck_node_locked(id, 0);
+    JSON_Value *arr_v = n ? json_value_init_array() : NULL;
+    for (int i = 0; n && i < PORTCHECK_MAX_CHECKS; i++) {
+        const portcheck_result_t *r = &n->results[i];
+        if (!r->name[0] || r->state < 0) continue;
+        JSON_Value *v = json_value_init_object();
+        JSON_Object *ro = json_object(v);
+        json_object_set_string(ro, "check", r->name);
+        json_object_set_number(ro, "port", r->port);
+        json_object_set_string(ro, "proto", r->udp ? "udp" : "tcp");
+        json_object_set_string(ro, "state", r->state ? "up" : "down");
+        if (r->latency_ms >= 0) json_object_set_number(ro, "latency_ms", (double)r->latency_ms);
+        if (r->error[0]) json_object_set_string(ro, "error", r->error);
+        json_object_set_number(ro, "checked_unix", (double)r->checked_unix);
+        json_object_set_number(ro, "since_unix", (double)r->since_unix);
+        json_array_append_value(json_array(arr_v), v);
+    }
+    pthread_mutex_unlock(&g_portcheck_lock);
+    if (arr_v && json_array_get_count(json_array(arr_v)) > 0) json_object_set_value(o, "ports", arr_v);
+    else if (arr_v) json_value_free(arr_v);
+}
+
+/* ---------- Probes ---------- */
+
+static const char *portcheck_errno_name(int err) {
+    if (err == ECONNREFUSED) return "refused";
+    if (err == ETIMEDOUT) return "timeout";
+    return "unreachable";
+}
+
+static void portcheck_finish(portcheck_probe_t *p, int up, const char *error, long long t0) {
+    p->done = 1;
+    p->up = up;
+    p->error = error;
+    p->latency_ms = up && !error ? now_ms() - t0 : -1;
+    if (p->fd >= 0) close(p->fd);
+    p->fd = -1;
+}
+
+/* Start a probe: a non-blocking connect for TCP, an empty datagram for UDP. */
+static void portcheck_open(portcheck_probe_t *p, const char *ip, int port, long long t0) {
+    struct sockaddr_in sa;
+    memset(&sa, 0, sizeof(sa));
+    sa.sin_family = AF_INET;
+    sa.sin_port = htons((unsigned short)port);
+    if (inet_pton(AF_INET, ip, &sa.sin_addr) != 1) {
+        portcheck_finish(p, 0, "resolve_failed", t0);
+        return;
+    }
+    p->fd = socket(AF_INET, (p->udp ? SOCK_DGRAM : SOCK_STREAM) | SOCK_NONBLOCK | SOCK_CLOEXEC, 0);
+    if (p->fd < 0) {
+        portcheck_finish(p, 0, "socket_failed", t0);
+        return;
+    }
+    if (connect(p->fd, (struct sockaddr *)&sa, sizeof(sa)) == 0) {
+        if (!p->udp) portcheck_finish(p, 1, NULL, t0);
+    } else if (p->udp || errno != EINPROGRESS) {
+        portcheck_finish(p, 0, portcheck_errno_name(errno), t0);
+        return;
+    }
+    if (p->udp && send(p->fd, "", 0, 0) < 0) portcheck_finish(p, 0, portcheck_errno_name(errno), t0);
+}
+
+static void portcheck_poll_event(portcheck_probe_t *p, short revents, long long t0) {
+    if (!p->udp) {
+        int err = 0;
+        socklen_t len = sizeof(err);
+        if (getsockopt(p->fd, SOL_SOCKET, SO_ERROR, &err, &len) != 0) err = errno;
+        if (err) portcheck_finish(p, 0, portcheck_errno_name(err), t0);
+        else portcheck_finish(p, 1, NULL, t0);
+        return;
+    }
+    char buf[64];
+    if (recv(p->fd, buf, sizeof(buf), 0) >= 0) {
+        portcheck_finish(p, 1, NULL, t0);
+    } else if (errno == ECONNREFUSED || (revents & POLLERR)) {
+        portcheck_finish(p, 0, portcheck_errno_name(errno), t0);
+    }
+}
+
+/* Run every probe at once and wait up to timeout_ms for them to settle. A TCP
+ * port that does not answer is down; a UDP port that does not answer may be
+ * listening without replying, so only ICMP port unreachable marks it down. */
+static void portcheck_run(portcheck_probe_t *probes, int count, char (*ips)[16], const int *ports,
+                          int timeout_ms) {
+    static struct pollfd pfds[PORTCHECK_MAX_PROBES];
+    long long t0 = now_ms();
+    for (int i = 0; i < count; i++) {
+        if (!ips[i][0]) portcheck_finish(&probes[i], 0, "resolve_failed", t0);
+        else portcheck_open(&probes[i], ips[i], ports[i], t0);
+    }
+    for (;;) {
+        int pending = 0;
+        for (int i = 0; i < count; i++) {
+            pfds[i].fd = probes[i].done ? -1 : probes[i].fd;
+            pfds[i].events = probes[i].udp ? POLLIN : POLLOUT;
+            pfds[i].revents = 0;
+            if (!probes[i].done) pending++;
+        }
+        long long left = t0 + timeout_ms - now_ms();
+        if (!pending || left <= 0 || g_portcheck_stop || g_stop) break;
+        int rc = poll(pfds, (nfds_t)count, (int)left);
+        if (rc < 0 && errno != EINTR) break;
+        for (int i = 0; rc > 0 && i < count; i++) {
+            if (!probes[i].done && pfds[i].revents) portcheck_poll_event(&probes[i], pfds[i].revents, t0);
+        }
+    }
+    for (int i = 0; i < count; i++) {
+        if (probes[i].done) continue;
+        if (probes[i].udp) portcheck_finish(&probes[i], 1, "no_reply", t0);
+        else portcheck_finish(&probes[i], 0, "timeout", t0);
+    }
+}
+
+/* One round over every registered node and the checks that apply to it. */
+static void portcheck_round(app_t *app, const config_t *cfg, sync_node_addr_t *nodes) {
+    static portcheck_probe_t probes[PORTCHECK_MAX_PROBES];
+    static char ips[PORTCHECK_MAX_PROBES][16];
+    static int ports[PORTCHECK_MAX_PROBES];
+    int count = sync_master_list_nodes(app, cfg, nodes, SYNC_MAX_SLAVES);
+    int probe_count = 0;
+
+    pthread_mutex_lock(&g_portcheck_lock);
+    for (int i = 0; i < PORTCHECK_MAX_NODES; i++) {
+        g_nodes[i].seen = 0;
+        for (int j = 0; j < PORTCHECK_MAX_CHECKS; j++) g_nodes[i].results[j].seen = 0;
+    }
+    pthread_mutex_unlock(&g_portcheck_lock);
+
+    for (int i = 0; i < count; i++) {
+        char ip[16] = "";
+        int resolved = -1;
+        for (int c = 0; c < cfg->portcheck.check_count && probe_count < PORTCHECK_MAX_PROBES; c++) {
+            const portcheck_check_t *pc = &cfg->portcheck.checks[c];
+            if (pc->port <= 0 || !portcheck_node_matches(pc, nodes[i].id)) continue;
+            if (resolved < 0) {
+                resolved = nodes[i].host[0] &&
+                           dnscache_resolve(nodes[i].host, cfg->sync_dns_ttl_s, ip, sizeof(ip)) == 0;
+                if (!resolved) ip[0] = '\0';
+            }
+            pthread_mutex_lock(&g_portcheck_lock);
+            portcheck_node_t *n = portcheck_node_locked(nodes[i].id, 1);
+            int r = n ? portcheck_result_locked(n, pc) : -1;
+            if (r >= 0) {
+                n->seen = 1;
+                n->results[r].seen = 1;
+            }
+            pthread_mutex_unlock(&g_portcheck_lock);
+            if (r < 0) continue;
+            portcheck_probe_t *p = &probes[probe_count];
+            memset(p, 0, sizeof(*p));
+            p->node = (int)(n - g_nodes);
+            p->result = r;
+            p->fd = -1;
+            p->udp = pc->udp;
+            memcpy(ips[probe_count], ip, sizeof(ip));
+            ports[probe_count] = pc->port;
+            probe_count++;
+        }
+    }
+
+    /* Forget nodes that left the registry and checks that were removed. */
+    pthread_mutex_lock(&g_portcheck_lock);
+    for (int i = 0; i < PORTCHECK_MAX_NODES; i++) {
+        portcheck_node_t *n = &g_nodes[i];
+        if (!n->id[0]) continue;
+        if (!n->seen) {
+            memset(n, 0, sizeof(*n));
+            g_version++;
+            continue;
+        }
+        for (int j = 0; j < PORTCHECK_MAX_CHECKS; j++) {
+            if (n->results[j].name[0] && !n->results[j].seen) {
+                memset(&n->results[j], 0, sizeof(n->results[j]));
+                g_version++;
+            }
+        }
+    }
+    pthread_mutex_unlock(&g_portcheck_lock);
+
+    if (!probe_count) return;
+    portcheck_run(probes, probe_count, ips, ports, cfg->portcheck.timeout_ms);
+    long long now = (long long)time(NULL);
+    pthread_mutex_lock(&g_portcheck_lock);
+    for (int i = 0; i < probe_count; i++) portcheck_record_locked(&probes[i], now);
+    pthread_mutex_unlock(&g_portcheck_lock);
+}
+
+static void *portcheck_thread_main(void *arg) {
+    app_t *app = (app_t *)arg;
+    sync_node_addr_t *nodes = calloc(SYNC_MAX_SLAVES, sizeof(*nodes));
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!nodes || !cfg) {
+        free(nodes);
+        free(cfg);
+        return NULL;
+    }
+    long long next_ms = 0;
+    while (!g_portcheck_stop && !g_stop) {
+        app_config_snapshot(app, cfg);
+        long long now = now_ms();
+        if (strcasecmp(cfg->sync_role, "master") == 0 && now >= next_ms) {
+            next_ms = now + cfg->portcheck.interval_s * 1000LL;
+            portcheck_round(app, cfg, nodes);
+        }
+        sleep(1);
+    }
+    free(cfg);
+    free(nodes);
+    return NULL;
+}
+
+int portcheck_start_thread(app_t *app) {
+    if (!app) return -1;
+    pthread_mutex_lock(&g_portcheck_lock);
+    g_portcheck_stop = 0;
+    if (g_portcheck_running) {
+        pthread_mutex_unlock(&g_portcheck_lock);
+        return 0;
+    }
+    if (pthread_create(&g_portcheck_thread, NULL, portcheck_thread_main, app) == 0) {
+        g_portcheck_running = 1;
+        pthread_mutex_unlock(&g_portcheck_lock);
+        return 0;
+    }
+    pthread_mutex_unlock(&g_portcheck_lock);
+    fprintf(stderr, "WARN: failed to start port check thread\n");
+    return -1;
+}
+
+void portcheck_stop_thread(void) {
+    pthread_mutex_lock(&g_portcheck_lock);
+    g_portcheck_stop = 1;
+    int running = g_portcheck_running;
+    pthread_mutex_unlock(&g_portcheck_lock);
+    if (running) {
+        pthread_join(g_portcheck_thread, NULL);
+        pthread_mutex_lock(&g_portcheck_lock);
+        g_portcheck_running = 0;
+        pthread_mutex_unlock(&g_portcheck_lock);
+    }
+}
@@ -0,0 +1,43 @@
+#ifndef AUTOD_PORTCHECK_H
+#define AUTOD_PORTCHECK_H
+
+#include "parson.h"
+
+#define PORTCHECK_MAX_CHECKS 8
+
+/* [portcheck.NAME] — a TCP or UDP port the master checks on every matching
+ * node besides the agent itself (RTSP 554, SSH 22, ...). Results show in
+ * /nodes as "ports" and changes are reported as port_down / port_up events.
+ * A TCP port is up when it accepts a connection; a UDP port is up unless the
+ * node answers with ICMP port unreachable. */
+typedef struct {
+    char name[32];
+    int  port;
+    int  udp;                     /* proto=udp */
+    char nodes[256];              /* sync id globs (empty = every node) */
+} portcheck_check_t;
+
+typedef struct {
+    int  interval_s;              /* seconds between rounds (default 30) */
+    int  timeout_ms;              /* per check (default 2000) */
+    portcheck_check_t checks[PORTCHECK_MAX_CHECKS];
+    int  check_count;
+} portcheck_config_t;
+
+typedef struct config config_t;
+typedef struct app app_t;
+
+void portcheck_cfg_defaults(config_t *cfg);
+int portcheck_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* Bumped whenever a result changes, for callers that cache payloads built from it. */
+unsigned long portcheck_version(void);
+
+/* Add "ports": [{check, port, proto, state, latency_ms, error, checked_unix,
+ * since_unix}] for id to o once it has been checked. */
+void portcheck_merge_json(const char *id, JSON_Object *o);
+
+int portcheck_start_thread(app_t *app);
+void portcheck_stop_thread(void);
+
+#endif
@@ -0,0 +1,445 @@
+#define _DEFAULT_SOURCE
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <stdarg.h>
+#include <errno.h>
+#include <limits.h>
+#include <time.h>
+#include <unistd.h>
+#include <netdb.h>
+#include <sys/socket.h>
+#include <sys/stat.h>
+
+#include "parson.h"
+#include "autod.h"
+#include "httpc.h"
+#include "mqtt.h"
+#include "replica.h"
+#include "sandbox.h"
+#include "cgroup.h"
+#include "preflight.h"
+
+#define PREFLIGHT_MAX_RESULTS 96
+#define PREFLIGHT_TIMEOUT_MS 3000
+
+typedef struct {
+    const char *check;
+    const char *status;   /* "ok", "warn", "fail" or "skip" */
+    char detail[256];
+} preflight_result_t;
+
+typedef struct {
+    preflight_result_t results[PREFLIGHT_MAX_RESULTS];
+    int count;
+    int failed;
+    int warned;
+} preflight_report_t;
+
+static FILE *g_capture;
+static int g_saved_stderr = -1;
+
+static void preflight_add(preflight_report_t *rep, const char *check, const char *status,
+                          const char *fmt, ...) {
+    if (!strcmp(status, "fail")) rep->failed++;
+    else if (!strcmp(status, "warn")) rep->warned++;
+    if (rep->count >= PREFLIGHT_MAX_RESULTS) return;
+    preflight_result_t *r = &rep->results[rep->count++];
+    r->check = check;
+    r->status = status;
+    va_list ap;
+    va_start(ap, fmt);
+    vsnprintf(r->detail, sizeof(r->detail), fmt, ap);
+    va_end(ap);
+}
+
+int preflight_capture_start(void) {
+    fflush(stderr);
+    FILE *f = tmpfile();
+    if (!f) return -1;
+    int saved = dup(STDERR_FILENO);
+    if (saved < 0 || dup2(fileno(f), STDERR_FILENO) < 0) {
+        if (saved >= 0) close(saved);
+        fclose(f);
+        return -1;
+    }
+    g_capture = f;
+    g_saved_stderr = saved;
+    return 0;
+}
+
+static void preflight_capture_stop(void) {
+    if (!g_capture) return;
+    fflush(stderr);
+    dup2(g_saved_stderr, STDERR_FILENO);
+    close(g_saved_stderr);
+    g_saved_stderr = -1;
+    rewind(g_capture);
+}
+
+/* Every line the loader printed is a finding: ERROR lines fail, the rest
+ * (unknown keys, dropped values, capacity limits) warn. */
+static void check_config(preflight_report_t *rep, const char *path, int cfg_rc) {
+    int lines = 0;
+    if (g_capture) {
+        char line[512];
+        while (fgets(line, sizeof(line), g_capture)) {
+            line[strcspn(line, "\r\n")] = '\0';
+            if (!line[0]) continue;
+            const char *text = line;
+            const char *status = "warn";
+            if (!strncmp(text, "ERROR: ", 7)) {
+                text += 7;
+                status = "fail";
+            } else if (!strncmp(text, "WARN: ", 6)) {
+                text += 6;
+            }
+            preflight_add(rep, "config", status, "%s", text);
+            lines++;
+        }
+        fclose(g_capture);
+        g_capture = NULL;
+    }
+    if (!path) {
+        preflight_add(rep, "config", "ok", "not read (--no-config), defaults and flags only");
+    } else if (cfg_rc == -1) {
+        preflight_add(rep, "config", "fail", "cannot read %s: %s", path, strerror(ENOENT));
+    } else if (cfg_rc == 0 && lines == 0) {
+        preflight_add(rep, "config", "ok", "%s read without warnings", path);
+    }
+}
+
+static void check_listen_one(preflight_report_t *rep, const char *addr, int port, int reuse_port) {
+    char label[96];
+    snprintf(label, sizeof(label), strchr(addr, ':') ? "[%s]:%d" : "%s:%d", addr, port);
+    char port_s[8];
+    snprintf(port_s, sizeof(port_s), "%d", port);
+    struct addrinfo hints, *ai = NULL;
+    memset(&hints, 0, sizeof(hints));
+    hints.ai_family = AF_UNSPEC;
+    hints.ai_socktype = SOCK_STREAM;
+    hints.ai_flags = AI_PASSIVE | AI_NUMERICHOST | AI_NUMERICSERV;
+    int grc = getaddrinfo(addr, port_s, &hints, &ai);
+    if (grc != 0 || !ai) {
+        preflight_add(rep, "listen", "fail", "%s: %s", label, grc ? gai_strerror(grc) : "no address");
+        return;
+    }
+    int fd = socket(ai->ai_family, SOCK_STREAM, 0);
+    if (fd < 0) {
+        preflight_add(rep, "listen", "fail", "%s: %s", label, strerror(errno));
+        freeaddrinfo(ai);
+        return;
+    }
+    int one = 1;
+    (void)setsockopt(fd, SOL_SOCKET, SO_REUSEADDR, &one, sizeof(one));
+#ifdef SO_REUSEPORT
+    if (reuse_port) (void)setsockopt(fd, SOL_SOCKET, SO_REUSEPORT, &one, sizeof(one));
+#else
+    (void)reuse_port;
+#endif
+    if (bind(fd, ai->ai_addr, ai->ai_addrlen) != 0) {
+        preflight_add(rep, "listen", "fail", "%s: %s", label, strerror(errno));
+    } else {
+        preflight_add(rep, "listen", "ok", "%s is free", label);
+    }
+    close(fd);
+    freeaddrinfo(ai);
+}
+
+static void check_listen(preflight_report_t *rep, const config_t *cfg) {
+    check_listen_one(rep, cfg->bind_addr, cfg->port, cfg->reuse_port);
+    for (int i = 0; i < cfg->listener_count; i++) {
+        check_listen_one(rep, cfg->listeners[i].addr, cfg->listeners[i].port, cfg->reuse_port);
+    }
+}
+
+static void check_cidrs(preflight_report_t *rep, const config_t *cfg) {
+    if (cfg->cidr_invalid > 0) {
+        preflight_add(rep, "cidr", "fail", "%u CIDR value%s ignored as invalid (see config)",
+                      cfg->cidr_invalid, cfg->cidr_invalid == 1 ? "" : "s");
+        return;
+    }
+    preflight_add(rep, "cidr", "ok", "%u extra_subnet, %u probe_exclude, %u allow_cidr",
+                  cfg->extra_subnet_count, cfg->probe_exclude_count, cfg->discovery.allow_count);
+}
+
+/* A slave or read replica needs its master, and MQTT nodes their broker. */
+static void check_master(preflight_report_t *rep, const config_t *cfg) {
+    int slave = strcasecmp(cfg->sync_role, "slave") == 0;
+    int master = strcasecmp(cfg->sync_role, "master") == 0;
+    if ((slave || master) && !strcmp(cfg->sync_transport, "mqtt")) {
+        char host[128];
+        int port = 0;
+        if (!cfg->sync_mqtt_broker[0]) {
+            preflight_add(rep, "master", "fail", "no [sync] mqtt_broker");
+        } else if (mqtt_parse_url(cfg->sync_mqtt_broker, host, sizeof(host), &port) != 0) {
+            preflight_add(rep, "master", "fail", "invalid mqtt_broker '%s'", cfg->sync_mqtt_broker);
+        } else {
+            int fd = httpc_connect(host, port, PREFLIGHT_TIMEOUT_MS);
+            if (fd < 0) {
+                preflight_add(rep, "master", "fail", "broker %s:%d: %s", host, port, strerror(errno));
+            } else {
+                preflight_add(rep, "master", "ok", "broker %s:%d accepts connections", host, port);
+                close(fd);
+            }
+        }
+        return;
+    }
+    if (!slave && !replica_is_active(cfg)) {
+        preflight_add(rep, "master", "skip", "role %s", cfg->sync_role[0] ? cfg->sync_role : "none");
+        return;
+    }
+    if (!cfg->sync_master_url[0]) {
+        preflight_add(rep, "master", "fail", "no [sync] master_url");
+        return;
+    }
+    http_url_t url;
+    if (httpc_parse_url(cfg->sync_master_url, &url, NULL) != 0) {
+        if (!strncasecmp(cfg->sync_master_url, "sync://", 7)) {
+            preflight_add(rep, "master", "skip", "%s is found by discovery once running",
+                          cfg->sync_master_url);
+        } else {
+            preflight_add(rep, "master", "fail", "invalid master_url '%s'", cfg->sync_master_url);
+        }
+        return;
+    }
+    snprintf(url.path, sizeof(url.path), "/health");
+    /* Through the proxy the daemon itself would use. */
+    char via[160] = "";
+    if (httpc_set_proxy(&cfg->http_proxy, NULL, 0)) {
+        char route[140];
+        httpc_describe_route(url.host, url.port, route, sizeof(route));
+        if (strcmp(route, "direct") != 0) snprintf(via, sizeof(via), " via %s", route);
+    }
+    char *body = NULL;
+    size_t len = 0;
+    int status = httpc_get(&url, &body, &len, PREFLIGHT_TIMEOUT_MS);
+    free(body);
+    if (status < 0) {
+        const char *why = httpc_last_error();
+        preflight_add(rep, "master", "fail", "%s:%d%s: %s", url.host, url.port, via,
+                      why ? why : "failed");
+    } else if (status != 200) {
+        preflight_add(rep, "master", "fail", "%s:%d%s answers /health with %d", url.host, url.port,
+                      via, status);
+    } else {
+        preflight_add(rep, "master", "ok", "%s:%d%s answers /health", url.host, url.port, via);
+    }
+}
+
+/* entry is a path or glob, optionally followed by " key=value" options;
+ * globs name families of binaries and are not checked. */
+static void check_binary(preflight_report_t *rep, const config_t *cfg, const char *what,
+                         const char *entry, int *found) {
+    char name[128];
+    snprintf(name, sizeof(name), "%s", entry);
+    name[strcspn(name, " \t")] = '\0';
+    if (!name[0] || strpbrk(name, "*?[")) return;
+    const sandbox_profile_t *sandbox = sandbox_select(cfg, name);
+    char binary[PATH_MAX];
+    if (exec_resolve_binary(sandbox ? sandbox->root : NULL, name, cfg->exec_path,
+                            binary, sizeof(binary)) == 0) {
+        (*found)++;
+        return;
+    }
+    preflight_add(rep, "catalog", cfg->exec_shell_fallback ? "warn" : "fail",
+                  "%s %s: not found%s%s", what, name, sandbox ? " in sandbox " : "",
+                  sandbox ? sandbox->name : "");
+}
+
+static void check_catalog(preflight_report_t *rep, const config_t *cfg) {
+    if (strcmp(cfg->exec_mode, "argv") != 0) {
+        if (exec_is_runnable(NULL, cfg->interpreter)) {
+            preflight_add(rep, "catalog", "ok", "interpreter %s", cfg->interpreter);
+        } else {
+            preflight_add(rep, "catalog", "fail", "interpreter %s is missing or not executable",
+                          cfg->interpreter);
+        }
+        return;
+    }
+    int before = rep->failed + rep->warned;
+    int found = 0;
+    for (int i = 0; i < cfg->catalog.limit_count; i++) {
+        check_binary(rep, cfg, "limit", cfg->catalog.limit[i], &found);
+    }
+    for (int i = 0; i < cfg->catalog.command_count; i++) {
+        char what[48];
+        snprintf(what, sizeof(what), "command.%s", cfg->catalog.commands[i].name);
+        check_binary(rep, cfg, what, cfg->catalog.commands[i].path, &found);
+    }
+    for (int i = 0; i < cfg->startup_exec_count; i++) {
+        JSON_Value *v = json_parse_string(cfg->startup_exec[i].json);
+        const char *path = json_object_get_string(json_object(v), "path");
+        if (path) check_binary(rep, cfg, "startup exec", path, &found);
+        json_value_free(v);
+    }
+    if (rep->failed + rep->warned == before) {
+        preflight_add(rep, "catalog", "ok", "%d binar%s found", found, found == 1 ? "y" : "ies");
+    }
+}
+
+/* Profiles with cgroup limits refuse to run unless cgroup_root can hold them. */
+static void check_cgroup(preflight_report_t *rep, const config_t *cfg) {
+    int limited = 0;
+    for (int i = 0; i < cfg->profiles.count; i++) {
+        const exec_profile_t *p = &cfg->profiles.profiles[i];
+        if (!cgroup_limited(p)) continue;
+        limited++;
+        const char *why = cgroup_check(cfg, p);
+        if (why) preflight_add(rep, "cgroup", "fail", "profile %s: %s", p->name, why);
+        else preflight_add(rep, "cgroup", "ok", "profile %s under %s", p->name, cfg->exec_cgroup_root);
+    }
+    if (limited) return;
+    if (!cfg->exec_cgroup_root[0]) {
+        preflight_add(rep, "cgroup", "skip", "no profile sets cgroup limits");
+        return;
+    }
+    const char *why = cgroup_check(cfg, NULL);
+    if (why) preflight_add(rep, "cgroup", "warn", "%s", why);
+    else preflight_add(rep, "cgroup", "ok", "%s", cfg->exec_cgroup_root);
+}
+
+/* The stores write next to their file, and none creates directories. */
+static void check_state_path(preflight_report_t *rep, const char *key, const char *path,
+                             int *checked) {
+    if (!path[0]) return;
+    (*checked)++;
+    char dir[PATH_MAX];
+    snprintf(dir, sizeof(dir), "%s", path);
+    char *slash = strrchr(dir, '/');
+    if (!slash) snprintf(dir, sizeof(dir), ".");
+    else if (slash == dir) dir[1] = '\0';
+    else *slash = '\0';
+    struct stat st;
+    if (stat(dir, &st) != 0 || !S_ISDIR(st.st_mode)) {
+        preflight_add(rep, "state", "fail", "%s: directory %s does not exist", key, dir);
+    } else if (access(dir, W_OK) != 0) {
+        preflight_add(rep, "state", "fail", "%s: %s is not writable", key, dir);
+    } else if (access(path, F_OK) == 0 && access(path, W_OK) != 0) {
+        preflight_add(rep, "state", "fail", "%s: %s is not writable", key, path);
+    } else {
+        preflight_add(rep, "state", "ok", "%s: %s", key, path);
+    }
+}
+
+static void check_state(preflight_report_t *rep, const config_t *cfg) {
+    int checked = 0;
+    check_state_path(rep, "sync.desired_path", cfg->sync_desired_path, &checked);
+    check_state_path(rep, "sync.outbox_path", cfg->sync_outbox_path, &checked);
+    check_state_path(rep, "sync.address_book_path", cfg->sync_address_book_path, &checked);
+    check_state_path(rep, "sync.registry_path", cfg->sync_registry_path, &checked);
+    check_state_path(rep, "jobs.store_path", cfg->jobs.store_path, &checked);
+    check_state_path(rep, "events.store_path", cfg->events.store_path, &checked);
+    check_state_path(rep, "catalog.path", cfg->catalog.path, &checked);
+    check_state_path(rep, "enroll.store_path", cfg->enroll.store_path, &checked);
+    check_state_path(rep, "enroll.credential_path", cfg->enroll.credential_path, &checked);
+    check_state_path(rep, "fleetcfg.store_path", cfg->fleetcfg.store_path, &checked);
+    check_state_path(rep, "nodemeta.meta_path", cfg->nodemeta.meta_path, &checked);
+    if (!checked) preflight_add(rep, "state", "skip", "nothing is kept on disk");
+}
+
+/* Midnight UTC of the day this file was compiled. */
+static time_t preflight_build_day(void) {
+    static const char months[] = "JanFebMarAprMayJunJulAugSepOctNovDec";
+    char mon[4];
+    int day = 0, year = 0;
+    if (sscanf(__DATE__, "%3s %d %d", mon, &day, &year) != 3) return 0;
+    const char *m = strstr(months, mon);
+    if (!m) return 0;
+    struct tm tm;
+    memset(&tm, 0, sizeof(tm));
+    tm.tm_year = year - 1900;
+    tm.tm_mon = (int)(m - months) / 3;
+    tm.tm_mday = day;
+    return timegm(&tm);
+}
+
+/* A board without an RTC boots in 1970 until NTP catches up, which breaks
+ * leases, TTLs and history timestamps. */
+static void check_clock(preflight_report_t *rep) {
+    time_t now = time(NULL);
+    time_t built = preflight_build_day();
+    struct tm tm;
+    char stamp[32];
+    gmtime_r(&now, &tm);
+    strftime(stamp, sizeof(stamp), "%Y-%m-%dT%H:%M:%SZ", &tm);
+    if (built > 0 && now < built - 86400) {
+        preflight_add(rep, "clock", "fail", "reads %s, before this build (%s)", stamp, __DATE__);
+    } else {
+        preflight_add(rep, "clock", "ok", "%s", stamp);
+    }
+}
+
+static void preflight_print_json(const preflight_report_t *rep, const char *path) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    if (path) json_object_set_string(o, "config", path);
+    else json_object_set_null(o, "config");
+    json_object_set_boolean(o, "ok", rep->failed == 0);
+    json_object_set_number(o, "failed", rep->failed);
+    json_object_set_number(o, "warnings", rep->warned);
+    JSON_Value *arr = json_value_init_array();
+    for (int i = 0; i < rep->count; i++) {
+        JSON_Value *rv = json_value_init_object();
+        JSON_Object *ro = json_object(rv);
+        json_object_set_string(ro, "check", rep->results[i].check);
+        json_object_set_string(ro, "status", rep->results[i].status);
+        json_object_set_string(ro, "detail", rep->results[i].detail);
+        json_array_append_value(json_array(arr), rv);
+    }
+    json_object_set_value(o, "checks", arr);
+    char *s = json_serialize_to_string_pretty(v);
+    if (s) {
+        printf("%s\n", s);
+        json_free_serialized_string(s);
+    }
+    json_value_free(v);
+}
+
+static void preflight_print_text(const preflight_report_t *rep, const char *path) {
+    printf("preflight: %s\n", path ? path : "(no config file)");
+    for (int i = 0; i < rep->count; i++) {
+        const preflight_result_t *r = &rep->results[i];
+        printf("  %-5s %-8s %s\n", r->status, r->check, r->detail);
+    }
+    printf("%d failed, %d warning%s\n", rep->failed, rep->warned, rep->warned == 1 ? "" : "s");
+}
+
+int preflight_main(const config_t *cfg, const char *path, int cfg_rc, int json) {
+    preflight_capture_stop();
+    preflight_report_t *rep = calloc(1, sizeof(*rep));
+    if (!rep) {
+        fprintf(stderr, "ERROR: preflight: out of memory\n");
+        return 1;
+    }
+    check_config(rep, path, cfg_rc);
+    check_listen(rep, cfg);
+    check_cidrs(rep, cfg);
+    check_master(rep, cfg);
+    check_catalog(rep, cfg);
+    check_cgroup(rep, cfg);
+    check_state(rep, cfg);
+    check_clock(rep);
+    if (json) preflight_print_json(rep, path);
+    else preflight_print_text(rep, path);
+    int rc = rep->failed ? 1 : 0;
+    free(rep);
+    return rc;
+}
+
+int preflight_startup(const config_t *cfg) {
+    preflight_report_t *rep = calloc(1, sizeof(*rep));
+    if (!rep) return 0;
+    check_catalog(rep, cfg);
+    check_state(rep, cfg);
+    check_clock(rep);
+    for (int i = 0; i < rep->count; i++) {
+        const preflight_result_t *r = &rep->results[i];
+        if (strcmp(r->status, "fail") != 0 && strcmp(r->status, "warn") != 0) continue;
+        fprintf(stderr, "WARN: preflight: %s: %s\n", r->check, r->detail);
+    }
+    int failed = rep->failed;
+    free(rep);
+    return failed;
+}
@@ -0,0 +1,25 @@
+#ifndef AUTOD_PREFLIGHT_H
+#define AUTOD_PREFLIGHT_H
+
+typedef struct config config_t;
+
+/* `autod --preflight [config.ini]` checks what would otherwise surface only
+ * as log noise once the daemon runs: config warnings, free listen ports,
+ * CIDR values, the master (or MQTT broker), catalog binaries, state
+ * directories and the clock. */
+
+/* Hold back what the config loader writes to stderr, so the report can
+ * list it. Call before reading the config. Returns 0 on success. */
+int preflight_capture_start(void);
+
+/* Run every check against cfg and print the report to stdout, as JSON when
+ * json is set. path is the config file read (NULL with --no-config) and
+ * cfg_rc what reading it returned. Returns the exit status: 1 when a check
+ * failed, else 0. */
+int preflight_main(const config_t *cfg, const char *path, int cfg_rc, int json);
+
+/* The checks that cost nothing at startup (catalog binaries, state
+ * directories, clock), as a WARN line each. Returns how many failed. */
+int preflight_startup(const config_t *cfg);
+
+#endif
@@ -0,0 +1,397 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <ctype.h>
+#include <errno.h>
+#include <signal.h>
+#include <unistd.h>
+#include <dirent.h>
+#include <fnmatch.h>
+#include <sys/types.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "dnscache.h"
+#include "events.h"
+#include "httpc.h"
+#include "sync.h"
+#include "process.h"
+#include "version.h"
+
+#define PROCESS_MAX_PIDS 32
+#define PROCESS_PROXY_TIMEOUT_MS 5000
+#define PROCESS_DEFAULT_SIGNALS ((1u << SIGHUP) | (1u << SIGTERM) | (1u << SIGUSR1))
+
+static const struct {
+    const char *name;
+    int sig;
+} k_signals[] = {
+    { "HUP", SIGHUP }, { "INT", SIGINT }, { "QUIT", SIGQUIT }, { "KILL", SIGKILL },
+    { "USR1", SIGUSR1 }, { "USR2", SIGUSR2 }, { "TERM", SIGTERM }, { "CONT", SIGCONT },
+    { "STOP", SIGSTOP },
+};
+
+/* "HUP" or "SIGHUP" as a signal number, or -1. */
+static int process_signal_number(const char *name) {
+    if (!name) return -1;
+    if (!strncasecmp(name, "SIG", 3)) name += 3;
+    for (size_t i = 0; i < sizeof(k_signals) / sizeof(k_signals[0]); i++) {
+        if (!strcasecmp(name, k_signals[i].name)) return k_signals[i].sig;
+    }
+    return -1;
+}
+
+static const char *process_signal_name(int sig) {
+    for (size_t i = 0; i < sizeof(k_signals) / sizeof(k_signals[0]); i++) {
+        if (k_signals[i].sig == sig) return k_signals[i].name;
+    }
+    return "?";
+}
+
+/* ---------- Config ---------- */
+
+void process_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->process, 0, sizeof(cfg->process));
+}
+
+static const process_entry_t *process_find(const config_t *cfg, const char *name) {
+    for (int i = 0; i < cfg->process.entry_count; i++) {
+        if (!strcmp(cfg->process.entries[i].name, name)) return &cfg->process.entries[i];
+    }
+    return NULL;
+}
+
+static process_entry_t *process_find_or_add(config_t *cfg, const char *name) {
+    for (int i = 0; i < cfg->process.entry_count; i++) {
+        if (!strcmp(cfg->process.entries[i].name, name)) return &cfg->process.entries[i];
+    }
+    if (cfg->process.entry_count >= PROCESS_MAX_ENTRIES) return NULL;
+    process_entry_t *p = &cfg->process.entries[cfg->process.entry_count++];
+    memset(p, 0, sizeof(*p));
+    snprintf(p->name, sizeof(p->name), "%s", name);
+    p->signals = PROCESS_DEFAULT_SIGNALS;
+    return p;
+}
+
+int process_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (strncmp(section, "process.", 8) != 0 || !section[8]) return 0;
+    process_entry_t *p = process_find_or_add(cfg, section + 8);
+    if (!p) {
+        fprintf(stderr, "WARN: process capacity reached (%d)\n", PROCESS_MAX_ENTRIES);
+        return 1;
+    }
+    if (!strcmp(key, "pidfile")) {
+        snprintf(p->pidfile, sizeof(p->pidfile), "%s", value);
+    } else if (!strcmp(key, "match")) {
+        snprintf(p->match, sizeof(p->match), "%s", value);
+    } else if (!strcmp(key, "signals")) {
+        unsigned mask = 0;
+        char buf[128];
+        snprintf(buf, sizeof(buf), "%s", value);
+        char *save = NULL;
+        for (char *tok = strtok_r(buf, ", \t", &save); tok; tok = strtok_r(NULL, ", \t", &save)) {
+            int sig = process_signal_number(tok);
+            if (sig > 0) mask |= 1u << sig;
+            else fprintf(stderr, "WARN: process %s: ignoring unknown signal '%s'\n", p->name, tok);
+        }
+        p->signals = mask;
+    } else {
+        fprintf(stderr, "WARN: process %s: ignoring unknown key '%s'\n", p->name, key);
+    }
+    return 1;
+}
+
+/* ---------- Processes ---------- */
+
+/* Name of a live process (not a zombie) from /proc/PID/stat. Returns 0 when
+ * it is running. */
+static int process_comm(int pid, char *comm, size_t comm_sz) {
+    char path[64], buf[256];
+    snprintf(path, sizeof(path), "/proc/%d/stat", pid);
+    FILE *f = fopen(path, "r");
+    if (!f) return -1;
+    size_t n = fread(buf, 1, sizeof(buf) - 1, f);
+    fclose(f);
+    buf[n] = '\0';
+    char *open = strchr(buf, '(');
+    char *close = strrchr(buf, ')');
+    if (!open || !close || close < open || close[1] != ' ' || close[2] == 'Z') return -1;
+    size_t len = (size_t)(close - open - 1);
+    if (len >= comm_sz) len = comm_sz - 1;
+    memcpy(comm, open + 1, len);
+    comm[len] = '\0';
+    return 0;
+}
+
+static int process_read_pidfile(const char *path) {
+    FILE *f = fopen(path, "r");
+    if (!f) return -1;
+    long pid = -1;
+    if (fscanf(f, "%ld", &pid) != 1) pid = -1;
+    fclose(f);
+    char comm[64];
+    if (pid <= 1 || pid > 0x7fffffffL || process_comm((int)pid, comm, sizeof(comm)) != 0) return -1;
+    return (int)pid;
+}
+
+/* Pids of the entry's process, never autod itself or init. Returns the count. */
+static int process_find_pids(const process_entry_t *p, int *pids, int max) {
+    if (p->pidfile[0]) {
+        int pid = process_read_pidfile(p->pidfile);
+        if (pid <= 1 || pid == (int)getpid()) return 0;
+        pids[0] = pid;
+        return 1;
+    }
+    if (!p->match[0]) return 0;
+    DIR *d = opendir("/proc");
+    if (!d) return 0;
+    int n = 0;
+    struct dirent *de;
+    while (n < max && (de = readdir(d)) != NULL) {
+        if (!isdigit((unsigned char)de->d_name[0])) continue;
+        int pid = atoi(de->d_name);
+        if (pid <= 1 || pid == (int)getpid()) continue;
+        char comm[64];
+        if (process_comm(pid, comm, sizeof(comm)) == 0 && fnmatch(p->match, comm, 0) == 0) {
+            pids[n++] = pid;
+        }
+    }
+    closedir(d);
+    return n;
+}
+
+static JSON_Value *process_signals_json(unsigned mask) {
+    JSON_Value *v = json_value_init_array();
+    for (size_t i = 0; i < sizeof(k_signals) / sizeof(k_signals[0]); i++) {
+        if (mask & (1u << k_signals[i].sig)) json_array_append_string(json_array(v), k_signals[i].name);
+    }
+    return v;
+}
+
+/* ---------- HTTP ---------- */
+
+static void process_send_list(struct mg_connection *c, const config_t *cfg) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Value *arr_v = json_value_init_array();
+    for (int i = 0; i < cfg->process.entry_count; i++) {
+        const process_entry_t *p = &cfg->process.entries[i];
+        JSON_Value *ev = json_value_init_object();
+        JSON_Object *eo = json_object(ev);
+        json_object_set_string(eo, "name", p->name);
+        if (p->pidfile[0]) json_object_set_string(eo, "pidfile", p->pidfile);
+        else json_object_set_string(eo, "match", p->match);
+        json_object_set_value(eo, "signals", process_signals_json(p->signals));
+        int pids[PROCESS_MAX_PIDS];
+        int n = process_find_pids(p, pids, PROCESS_MAX_PIDS);
+        JSON_Value *pv = json_value_init_array();
+        for (int j = 0; j < n; j++) json_array_append_number(json_array(pv), pids[j]);
+        json_object_set_value(eo, "pids", pv);
+        json_array_append_value(json_array(arr_v), ev);
+    }
+    json_object_set_value(json_object(v), "processes", arr_v);
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+}
+
+static void process_handle_signal(struct mg_connection *c, const config_t *cfg, JSON_Object *o) {
+    const char *name = json_object_get_string(o, "process");
+    const char *sig_name = json_object_get_string(o, "signal");
+    if (!name || !*name || !sig_name || !*sig_name) {
+        send_json_error(c, 400, "missing_process_or_signal");
+        return;
+    }
+    const process_entry_t *p = process_find(cfg, name);
+    if (!p) {
+        send_json_error(c, 404, "unknown_process");
+        return;
+    }
+    int sig = process_signal_number(sig_name);
+    if (sig < 0) {
+        send_json_error(c, 400, "bad_signal");
+        return;
+    }
+    if (!(p->signals & (1u << sig))) {
+        send_json_error(c, 403, "signal_not_allowed");
+        return;
+    }
+    int pids[PROCESS_MAX_PIDS];
+    int n = process_find_pids(p, pids, PROCESS_MAX_PIDS);
+    if (n == 0) {
+        send_json_error(c, 404, "not_running");
+        return;
+    }
+
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *ro = json_object(v);
+    JSON_Value *sent_v = json_value_init_array();
+    JSON_Value *failed_v = json_value_init_array();
+    for (int i = 0; i < n; i++) {
+        if (kill((pid_t)pids[i], sig) == 0) {
+            json_array_append_number(json_array(sent_v), pids[i]);
+            continue;
+        }
+        JSON_Value *fv = json_value_init_object();
+        json_object_set_number(json_object(fv), "pid", pids[i]);
+        json_object_set_string(json_object(fv), "error", strerror(errno));
+        json_array_append_value(json_array(failed_v), fv);
+    }
+    size_t sent = json_array_get_count(json_array(sent_v));
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    fprintf(stderr, "process: SIG%s to %s (%zu of %d pid(s)) from %s (request %s)\n",
+            process_signal_name(sig), p->name, sent, n, ri && ri->remote_addr[0] ? ri->remote_addr : "?",
+            api_request_id());
+
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_string(eo, "process", p->name);
+    json_object_set_string(eo, "signal", process_signal_name(sig));
+    json_object_set_value(eo, "pids", json_value_deep_copy(sent_v));
+    json_object_set_string(eo, "remote_ip", ri ? ri->remote_addr : "");
+    (void)events_emit("process_signal", ev);
+
+    json_object_set_string(ro, "process", p->name);
+    json_object_set_string(ro, "signal", process_signal_name(sig));
+    json_object_set_value(ro, "pids", sent_v);
+    if (json_array_get_count(json_array(failed_v)) > 0) json_object_set_value(ro, "failed", failed_v);
+    else json_value_free(failed_v);
+    send_json(c, v, sent ? 200 : 500, 1);
+    json_value_free(v);
+}
+
+/* Relay POST /process/signal to a registered slave and pass its reply back. */
+static void process_proxy(struct mg_connection *c, app_t *app, const config_t *cfg,
+                          const char *node, JSON_Value *body) {
+    sync_node_addr_t *nodes = calloc(SYNC_MAX_SLAVES, sizeof(*nodes));
+    int count = nodes ? sync_master_list_nodes(app, cfg, nodes, SYNC_MAX_SLAVES) : 0;
+    sync_node_addr_t target;
+    int found = 0;
+    for (int i = 0; i < count; i++) {
+        if (!strcmp(nodes[i].id, node)) {
+            target = nodes[i];
+            found = 1;
+            break;
+        }
+    }
+    free(nodes);
+    if (!found) {
+        send_json_error(c, 404, "unknown_node");
+        return;
+    }
+    if (strcmp(target.transport, "http") != 0) {
+        send_json_error(c, 409, "unsupported_transport");
+        return;
+    }
+    http_url_t url;
+    memset(&url, 0, sizeof(url));
+    if (!target.host[0] ||
+        dnscache_resolve(target.host, cfg->sync_dns_ttl_s, url.host, sizeof(url.host)) != 0) {
+        send_json_error(c, 502, "node_unreachable");
+        return;
+    }
+    url.port = target.port;
+    snprintf(url.path, sizeof(url.path), AUTOD_PEER_PREFIX "/process/signal");
+
+    json_object_remove(json_object(body), "node");
+    char *payload = json_serialize_to_string(body);
+    char *resp = NULL;
+    size_t resp_len = 0;
+    int status = payload ? httpc_post_json(&url, payload, &resp, &resp_len,
+                                           PROCESS_PROXY_TIMEOUT_MS) : -1;
+    if (payload) json_free_serialized_string(payload);
+    JSON_Value *rv = (status > 0 && resp) ? json_parse_string(resp) : NULL;
+    free(resp);
+    if (!rv || json_value_get_type(rv) != JSONObject) {
+        if (rv) json_value_free(rv);
+        send_json_error(c, 502, "node_unreachable");
+        return;
+    }
+    json_object_set_string(json_object(rv), "node", node);
+    send_json(c, rv, status, 1);
+    json_value_free(rv);
+}
+
+/*
+ * GET  /process         — the [process.NAME] entries with their running pids
+ * POST /process/signal  — {process, signal, node}
+ * On a master, node selects a registered slave the request is relayed to.
+ */
+static int h_process(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri) {
+        free(cfg);
+        return 0;
+    }
+    const char *uri = api_local_uri(c);
+
+    if (!strcmp(uri, "/process") || !strcmp(uri, "/process/")) {
+        if (strcmp(ri->request_method, "GET") != 0) {
+            send_plain(c, 405, "method_not_allowed", 1);
+            free(cfg);
+            return 1;
+        }
+        process_send_list(c, cfg);
+        free(cfg);
+        return 1;
+    }
+    if (strcmp(uri, "/process/signal") != 0) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    if (strcmp(ri->request_method, "POST") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        free(u.body);
+        send_json_error(c, 400, "body_read_failed");
+        free(cfg);
+        return 1;
+    }
+    JSON_Value *root = u.len ? json_parse_string(u.body) : NULL;
+    free(u.body);
+    if (!root || json_value_get_type(root) != JSONObject) {
+        if (root) json_value_free(root);
+        send_json_error(c, 400, "bad_json");
+        free(cfg);
+        return 1;
+    }
+    JSON_Object *o = json_object(root);
+
+    const char *node = json_object_get_string(o, "node");
+    if (node && *node && strcmp(node, cfg->sync_id) != 0) {
+        if (strcasecmp(cfg->sync_role, "master") != 0) {
+            send_json_error(c, 404, "unknown_node");
+        } else {
+            char id[64];
+            snprintf(id, sizeof(id), "%s", node);
+            process_proxy(c, app, cfg, id, root);
+        }
+        json_value_free(root);
+        free(cfg);
+        return 1;
+    }
+    process_handle_signal(c, cfg, o);
+    json_value_free(root);
+    free(cfg);
+    return 1;
+}
+
+void process_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    api_set_handler(ctx, "/process", h_process, app);
+}
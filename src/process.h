@@ -0,0 +1,30 @@
+#ifndef AUTOD_PROCESS_H
+#define AUTOD_PROCESS_H
+
+#define PROCESS_MAX_ENTRIES 16
+
+/* [process.NAME] — a process POST /process/signal may signal, found by its
+ * pidfile or by a glob over process names (/proc/PID/comm), with the signals
+ * it accepts. Anything not listed cannot be signalled. */
+typedef struct {
+    char name[32];
+    char pidfile[256];
+    char match[64];               /* comm glob when there is no pidfile */
+    unsigned signals;             /* bit per allowed signal number */
+} process_entry_t;
+
+typedef struct {
+    process_entry_t entries[PROCESS_MAX_ENTRIES];
+    int entry_count;
+} process_config_t;
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_context;
+
+void process_cfg_defaults(config_t *cfg);
+int process_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+void process_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
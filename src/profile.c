@@ -0,0 +1,214 @@
+#define _DEFAULT_SOURCE
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <errno.h>
+#include <grp.h>
+#include <pwd.h>
+#include <unistd.h>
+#include <sys/resource.h>
+
+#include "autod.h"
+#include "catalog.h"
+#include "profile.h"
+
+void profile_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->profiles, 0, sizeof(cfg->profiles));
+}
+
+static exec_profile_t *profile_find_or_add(config_t *cfg, const char *name) {
+    for (int i = 0; i < cfg->profiles.count; i++) {
+        if (strcmp(cfg->profiles.profiles[i].name, name) == 0) return &cfg->profiles.profiles[i];
+    }
+    if (cfg->profiles.count >= PROFILE_MAX) return NULL;
+    exec_profile_t *p = &cfg->profiles.profiles[cfg->profiles.count++];
+    memset(p, 0, sizeof(*p));
+    strncpy(p->name, name, sizeof(p->name) - 1);
+    return p;
+}
+
+static int profile_parse_limit(const exec_profile_t *p, const char *key, const char *value,
+                               long *out) {
+    char *end = NULL;
+    long v = strtol(value, &end, 10);
+    if (!end || end == value || *end || v < 0) {
+        fprintf(stderr, "WARN: profile %s: ignoring %s %s (expected a non-negative number)\n",
+                p->name, key, value);
+        return -1;
+    }
+    *out = v;
+    return 0;
+}
+
+int profile_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (strncmp(section, "profile.", 8) != 0 || !section[8]) return 0;
+    exec_profile_t *p = profile_find_or_add(cfg, section + 8);
+    if (!p) {
+        fprintf(stderr, "WARN: exec profile capacity reached (%d)\n", PROFILE_MAX);
+        return 1;
+    }
+    long v = 0;
+    if (!strcmp(key, "timeout_ms")) {
+        if (profile_parse_limit(p, key, value, &v) == 0) p->timeout_ms = (int)v;
+    } else if (!strcmp(key, "max_output_bytes")) {
+        if (profile_parse_limit(p, key, value, &v) == 0) p->max_output_bytes = (int)v;
+    } else if (!strcmp(key, "cpu_s")) {
+        (void)profile_parse_limit(p, key, value, &p->cpu_s);
+    } else if (!strcmp(key, "mem_mb")) {
+        (void)profile_parse_limit(p, key, value, &p->mem_mb);
+    } else if (!strcmp(key, "nofile")) {
+        (void)profile_parse_limit(p, key, value, &p->nofile);
+    } else if (!strcmp(key, "nproc")) {
+        (void)profile_parse_limit(p, key, value, &p->nproc);
+    } else if (!strcmp(key, "cpu_pct")) {
+        (void)profile_parse_limit(p, key, value, &p->cpu_pct);
+    } else if (!strcmp(key, "memory_max_mb")) {
+        (void)profile_parse_limit(p, key, value, &p->memory_max_mb);
+    } else if (!strcmp(key, "io_weight")) {
+        if (profile_parse_limit(p, key, value, &v) != 0) {
+        } else if (v > 10000) {
+            fprintf(stderr, "WARN: profile %s: ignoring io_weight %s (1-10000)\n", p->name, value);
+        } else {
+            p->io_weight = (int)v;
+        }
+    } else if (!strcmp(key, "io_max")) {
+        if (!strchr(value, ':') || strlen(value) >= sizeof(p->io_max)) {
+            fprintf(stderr, "WARN: profile %s: ignoring io_max '%s' (expected MAJ:MIN key=value ...)\n",
+                    p->name, value);
+        } else {
+            strncpy(p->io_max, value, sizeof(p->io_max) - 1);
+            p->io_max[sizeof(p->io_max) - 1] = '\0';
+        }
+    } else if (!strcmp(key, "env")) {
+        const char *eq = strchr(value, '=');
+        if (!eq || eq == value) {
+            fprintf(stderr, "WARN: profile %s: ignoring env '%s' (expected KEY=VALUE)\n",
+                    p->name, value);
+        } else if (p->env_count >= PROFILE_MAX_ENV) {
+            fprintf(stderr, "WARN: profile %s: env capacity reached (%d)\n",
+                    p->name, PROFILE_MAX_ENV);
+        } else {
+            strncpy(p->env[p->env_count], value, sizeof(p->env[0]) - 1);
+            p->env[p->env_count][sizeof(p->env[0]) - 1] = '\0';
+            p->env_count++;
+        }
+    } else if (!strcmp(key, "run_as")) {
+        strncpy(p->run_as, value, sizeof(p->run_as) - 1);
+        p->run_as[sizeof(p->run_as) - 1] = '\0';
+    } else if (!strcmp(key, "default_for")) {
+        strncpy(p->default_for, value, sizeof(p->default_for) - 1);
+        p->default_for[sizeof(p->default_for) - 1] = '\0';
+    } else {
+        fprintf(stderr, "WARN: profile %s: ignoring unknown key '%s'\n", p->name, key);
+    }
+    return 1;
+}
+
+const exec_profile_t *profile_find(const config_t *cfg, const char *name) {
+    if (!cfg || !name || !*name) return NULL;
+    for (int i = 0; i < cfg->profiles.count; i++) {
+        if (strcmp(cfg->profiles.profiles[i].name, name) == 0) return &cfg->profiles.profiles[i];
+    }
+    return NULL;
+}
+
+static int profile_defaults_role(const exec_profile_t *p, const char *role) {
+    char buf[sizeof(p->default_for)];
+    memcpy(buf, p->default_for, sizeof(buf));
+    char *save = NULL;
+    for (char *tok = strtok_r(buf, ", \t", &save); tok; tok = strtok_r(NULL, ", \t", &save)) {
+        if (!strcasecmp(tok, "*") || !strcasecmp(tok, *role ? role : "none")) return 1;
+    }
+    return 0;
+}
+
+const exec_profile_t *profile_select(const config_t *cfg, const char *path,
+                                     const char *requested, int *unknown) {
+    if (unknown) *unknown = 0;
+    if (!cfg) return NULL;
+    if (requested && *requested) {
+        const exec_profile_t *p = profile_find(cfg, requested);
+        if (!p && unknown) *unknown = 1;
+        return p;
+    }
+    char name[32];
+    if (path && catalog_option_for(cfg, path, "profile", name, sizeof(name)) == 0) {
+        const exec_profile_t *p = profile_find(cfg, name);
+        if (p) return p;
+        fprintf(stderr, "exec: catalog profile '%s' for %s is not defined here\n", name, path);
+    }
+    for (int i = 0; i < cfg->profiles.count; i++) {
+        if (profile_defaults_role(&cfg->profiles.profiles[i], cfg->sync_role)) {
+            return &cfg->profiles.profiles[i];
+        }
+    }
+    return NULL;
+}
+
+int profile_resolve_user(const exec_profile_t *p, uid_t *uid, gid_t *gid) {
+    if (!p || !p->run_as[0]) return 0;
+    char user[64];
+    strncpy(user, p->run_as, sizeof(user) - 1);
+    user[sizeof(user) - 1] = '\0';
+    char *group = strchr(user, ':');
+    if (group) *group++ = '\0';
+
+    struct passwd pw, *pwr = NULL;
+    char buf[1024];
+    if (getpwnam_r(user, &pw, buf, sizeof(buf), &pwr) != 0 || !pwr) {
+        fprintf(stderr, "exec: profile %s: unknown run_as user '%s'\n", p->name, user);
+        return -1;
+    }
+    *uid = pwr->pw_uid;
+    *gid = pwr->pw_gid;
+    if (group && *group) {
+        struct group gr, *grr = NULL;
+        if (getgrnam_r(group, &gr, buf, sizeof(buf), &grr) != 0 || !grr) {
+            fprintf(stderr, "exec: profile %s: unknown run_as group '%s'\n", p->name, group);
+            return -1;
+        }
+        *gid = grr->gr_gid;
+    }
+    return 0;
+}
+
+static int profile_fail(const exec_profile_t *p, const char *what) {
+    dprintf(STDERR_FILENO, "profile %s: %s failed: %s\n", p->name, what, strerror(errno));
+    return -1;
+}
+
+static int profile_set_limit(const exec_profile_t *p, int resource, long value,
+                             rlim_t scale, const char *what) {
+    if (value <= 0) return 0;
+    struct rlimit rl;
+    rl.rlim_cur = rl.rlim_max = (rlim_t)value * scale;
+    return setrlimit(resource, &rl) == 0 ? 0 : profile_fail(p, what);
+}
+
+int profile_enter(const exec_profile_t *p) {
+    if (!p) return 0;
+    if (profile_set_limit(p, RLIMIT_CPU, p->cpu_s, 1, "cpu_s") != 0) return -1;
+    if (profile_set_limit(p, RLIMIT_AS, p->mem_mb, 1024 * 1024, "mem_mb") != 0) return -1;
+    if (profile_set_limit(p, RLIMIT_NOFILE, p->nofile, 1, "nofile") != 0) return -1;
+    if (profile_set_limit(p, RLIMIT_NPROC, p->nproc, 1, "nproc") != 0) return -1;
+    for (int i = 0; i < p->env_count; i++) {
+        char kv[sizeof(p->env[0])];
+        memcpy(kv, p->env[i], sizeof(kv));
+        char *eq = strchr(kv, '=');
+        if (!eq) continue;
+        *eq = '\0';
+        if (setenv(kv, eq + 1, 1) != 0) return profile_fail(p, "setenv");
+    }
+    return 0;
+}
+
+int profile_drop_user(const exec_profile_t *p, uid_t uid, gid_t gid) {
+    if (!p || !p->run_as[0]) return 0;
+    if (setgroups(1, &gid) != 0) return profile_fail(p, "setgroups");
+    if (setgid(gid) != 0) return profile_fail(p, "setgid");
+    if (setuid(uid) != 0) return profile_fail(p, "setuid");
+    return 0;
+}
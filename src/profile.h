@@ -0,0 +1,60 @@
+#ifndef AUTOD_PROFILE_H
+#define AUTOD_PROFILE_H
+
+#include <sys/types.h>
+
+#define PROFILE_MAX 8
+#define PROFILE_MAX_ENV 8
+
+/* [profile.NAME] — a named bundle of exec settings. Requests pick one with
+ * "profile", catalog entries with a "profile=NAME" suffix, and default_for
+ * makes it the fallback for nodes in the listed sync roles. Zero values keep
+ * the [exec] setting or leave the limit alone. */
+typedef struct {
+    char name[32];
+    int  timeout_ms;
+    int  max_output_bytes;
+    long cpu_s;                    /* RLIMIT_CPU */
+    long mem_mb;                   /* RLIMIT_AS */
+    long nofile;                   /* RLIMIT_NOFILE */
+    long nproc;                    /* RLIMIT_NPROC */
+    long cpu_pct;                  /* cgroup cpu.max, percent of one CPU */
+    long memory_max_mb;            /* cgroup memory.max */
+    int  io_weight;                /* cgroup io.weight, 1-10000 */
+    char io_max[128];              /* cgroup io.max line: "MAJ:MIN rbps=N wbps=N ..." */
+    char env[PROFILE_MAX_ENV][128];  /* KEY=VALUE */
+    int  env_count;
+    char run_as[64];               /* user[:group]; empty = daemon user */
+    char default_for[64];          /* comma list of sync roles ("none" = no role) */
+} exec_profile_t;
+
+typedef struct {
+    int count;
+    exec_profile_t profiles[PROFILE_MAX];
+} profile_config_t;
+
+typedef struct config config_t;
+
+void profile_cfg_defaults(config_t *cfg);
+int profile_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+const exec_profile_t *profile_find(const config_t *cfg, const char *name);
+
+/* Profile for one exec: the requested name when given (NULL and *unknown set
+ * when it does not exist), else the catalog entry's profile for path, else
+ * the default for this node's sync role. NULL means plain [exec] settings. */
+const exec_profile_t *profile_select(const config_t *cfg, const char *path,
+                                     const char *requested, int *unknown);
+
+/* Resolve run_as before fork(); getpwnam() is not safe in the child.
+ * Returns -1 (with a message on stderr) when the user or group is unknown. */
+int profile_resolve_user(const exec_profile_t *p, uid_t *uid, gid_t *gid);
+
+/* In the forked child: apply limits and environment. Called before the
+ * sandbox is entered. Returns -1 after writing the reason to stderr. */
+int profile_enter(const exec_profile_t *p);
+
+/* In the forked child, last step before execv(): switch to uid/gid. */
+int profile_drop_user(const exec_profile_t *p, uid_t uid, gid_t gid);
+
+#endif
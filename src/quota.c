@@ -0,0 +1,384 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <time.h>
+#include <pthread.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "admin.h"
+#include "quota.h"
+
+/* One client's use of the exec slots. Idle entries are reused for new
+ * clients, oldest first, when the table fills. */
+typedef struct {
+    char name[64];                /* client name or source address; empty = free */
+    int  configured;
+    int  weight;
+    int  max;
+    int  running;
+    int  waiting;
+    unsigned long granted;
+    unsigned long rejected;
+    long long last_ms;
+    unsigned long long vtime;     /* virtual time of its next grant */
+} quota_usage_t;
+
+typedef struct quota_waiter {
+    int usage;
+    unsigned long seq;
+    struct quota_waiter *next;
+} quota_waiter_t;
+
+static pthread_mutex_t g_quota_lock = PTHREAD_MUTEX_INITIALIZER;
+static pthread_cond_t g_quota_cond = PTHREAD_COND_INITIALIZER;
+static quota_usage_t g_usage[QUOTA_MAX_TRACKED];
+static quota_waiter_t *g_waiters;
+static unsigned long g_seq;
+static int g_running;
+static int g_waiting;
+static int g_limit;
+static unsigned long long g_vclock;   /* virtual time of the last grant */
+
+#define QUOTA_VTIME_UNIT 1000000ULL
+
+/* ---------- Config ---------- */
+
+void quota_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->quota, 0, sizeof(cfg->quota));
+    cfg->quota.queue_max = 8;
+    cfg->quota.queue_timeout_ms = 10000;
+    cfg->quota.default_weight = 1;
+}
+
+static quota_client_t *quota_find_or_add(config_t *cfg, const char *name) {
+    for (int i = 0; i < cfg->quota.client_count; i++) {
+        if (!strcmp(cfg->quota.clients[i].name, name)) return &cfg->quota.clients[i];
+    }
+    if (cfg->quota.client_count >= QUOTA_MAX_CLIENTS) return NULL;
+    quota_client_t *q = &cfg->quota.clients[cfg->quota.client_count++];
+    memset(q, 0, sizeof(*q));
+    snprintf(q->name, sizeof(q->name), "%s", name);
+    q->weight = 1;
+    return q;
+}
+
+int quota_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (!strcmp(section, "quota")) {
+        int v = atoi(value);
+        if (!strcmp(key, "exec_concurrency")) {
+            if (v >= 0) cfg->quota.exec_concurrency = v;
+            else fprintf(stderr, "WARN: ignoring negative quota exec_concurrency %s\n", value);
+        } else if (!strcmp(key, "queue_max")) {
+            if (v >= 0) cfg->quota.queue_max = v;
+            else fprintf(stderr, "WARN: ignoring negative quota queue_max %s\n", value);
+        } else if (!strcmp(key, "queue_timeout_ms")) {
+            if (v >= 0) cfg->quota.queue_timeout_ms = v;
+            else fprintf(stderr, "WARN: ignoring negative quota queue_timeout_ms %s\n", value);
+        } else if (!strcmp(key, "default_weight")) {
+            if (v >= 1) cfg->quota.default_weight = v;
+            else fprintf(stderr, "WARN: ignoring quota default_weight %s (minimum 1)\n", value);
+        } else if (!strcmp(key, "default_max")) {
+            if (v >= 0) cfg->quota.default_max = v;
+            else fprintf(stderr, "WARN: ignoring negative quota default_max %s\n", value);
+        } else {
+            fprintf(stderr, "WARN: ignoring unknown quota key '%s'\n", key);
+        }
+        return 1;
+    }
+    if (strncmp(section, "quota.", 6) != 0 || !section[6]) return 0;
+    quota_client_t *q = quota_find_or_add(cfg, section + 6);
+    if (!q) {
+        fprintf(stderr, "WARN: quota client capacity reached (%d)\n", QUOTA_MAX_CLIENTS);
+        return 1;
+    }
+    int v = atoi(value);
+    if (!strcmp(key, "token")) {
+        snprintf(q->token, sizeof(q->token), "%s", value);
+    } else if (!strcmp(key, "weight")) {
+        if (v >= 1) q->weight = v;
+        else fprintf(stderr, "WARN: quota %s: ignoring weight '%s' (minimum 1)\n", q->name, value);
+    } else if (!strcmp(key, "max")) {
+        if (v >= 0) q->max = v;
+        else fprintf(stderr, "WARN: quota %s: ignoring negative max '%s'\n", q->name, value);
+    } else {
+        fprintf(stderr, "WARN: quota %s: ignoring unknown key '%s'\n", q->name, key);
+    }
+    return 1;
+}
+
+int quota_server_threads(const config_t *cfg, int base) {
+    if (!cfg || cfg->quota.exec_concurrency <= 0) return base;
+    return base + cfg->quota.exec_concurrency + cfg->quota.queue_max;
+}
+
+/* ---------- Slots ---------- */
+
+/* The configured client whose token the request presents. *unknown is set
+ * when an X-Client-Token matches none; a bearer token may be meant for
+ * something else (the admin token) and is not an error. */
+static const quota_client_t *quota_client_for(struct mg_connection *c, const config_t *cfg,
+                                              int *unknown) {
+    *unknown = 0;
+    const char *presented = mg_get_header(c, "X-Client-Token");
+    int explicit_token = presented != NULL;
+    const char *auth = mg_get_header(c, "Authorization");
+    if (!presented && auth && !strncasecmp(auth, "Bearer ", 7)) {
+        presented = auth + 7;
+        while (*presented == ' ') presented++;
+    }
+    if (!presented || !*presented) return NULL;
+    for (int i = 0; i < cfg->quota.client_count; i++) {
+        const quota_client_t *q = &cfg->quota.clients[i];
+        if (q->token[0] && admin_token_equal(presented, q->token)) return q;
+    }
+    *unknown = explicit_token;
+    return NULL;
+}
+
+static int quota_usage_locked(const char *name, int configured) {
+    int free_slot = -1, idle = -1;
+    for (int i = 0; i < QUOTA_MAX_TRACKED; i++) {
+        quota_usage_t *u = &g_usage[i];
+        if (!u->name[0]) {
+            if (free_slot < 0) free_slot = i;
+            continue;
+        }
+        if (u->configured == configured && !strcmp(u->name, name)) return i;
+        if (!u->running && !u->waiting &&
+            (idle < 0 || u->last_ms < g_usage[idle].last_ms)) {
+            idle = i;
+        }
+    }
+    int i = free_slot >= 0 ? free_slot : idle;
+    if (i < 0) return -1;
+    memset(&g_usage[i], 0, sizeof(g_usage[i]));
+    snprintf(g_usage[i].name, sizeof(g_usage[i].name), "%s", name);
+    g_usage[i].configured = configured;
+    return i;
+}
+
+/* The waiter to run next, if a slot is free: among clients below their own
+ * cap, the one with the lowest virtual time (each grant advances a client's
+ * by 1/weight, so weights set the ratio of grants while clients compete);
+ * the earliest request on a tie. */
+static quota_waiter_t *quota_next_locked(void) {
+    if (g_limit > 0 && g_running >= g_limit) return NULL;
+    quota_waiter_t *best = NULL;
+    for (quota_waiter_t *w = g_waiters; w; w = w->next) {
+        const quota_usage_t *u = &g_usage[w->usage];
+        if (u->max > 0 && u->running >= u->max) continue;
+        if (best) {
+            const quota_usage_t *b = &g_usage[best->usage];
+            if (u->vtime > b->vtime || (u->vtime == b->vtime && w->seq > best->seq)) continue;
+        }
+        best = w;
+    }
+    return best;
+}
+
+static void quota_unlink_locked(quota_waiter_t *w) {
+    for (quota_waiter_t **p = &g_waiters; *p; p = &(*p)->next) {
+        if (*p == w) {
+            *p = w->next;
+            return;
+        }
+    }
+}
+
+int quota_exec_acquire(struct mg_connection *c, const config_t *cfg) {
+    int unknown = 0;
+    const quota_client_t *client = quota_client_for(c, cfg, &unknown);
+    if (unknown) {
+        send_json_error(c, 401, "unknown_client_token");
+        return -1;
+    }
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    const char *name = client ? client->name : (ri && ri->remote_addr[0] ? ri->remote_addr : "local");
+
+    pthread_mutex_lock(&g_quota_lock);
+    g_limit = cfg->quota.exec_concurrency;
+    int slot = quota_usage_locked(name, client != NULL);
+    if (slot < 0) {
+        pthread_mutex_unlock(&g_quota_lock);
+        send_json_error_field(c, 429, "exec_busy", "client", name);
+        return -1;
+    }
+    quota_usage_t *u = &g_usage[slot];
+    u->weight = client ? client->weight : cfg->quota.default_weight;
+    u->max = client ? client->max : cfg->quota.default_max;
+    u->last_ms = now_ms();
+    /* A client that was idle starts at the current virtual time instead of
+     * cashing in the time it did not use. */
+    if (!u->running && !u->waiting && u->vtime < g_vclock) u->vtime = g_vclock;
+    if (g_limit <= 0) {
+        u->running++;
+        u->granted++;
+        g_running++;
+        pthread_mutex_unlock(&g_quota_lock);
+        return slot;
+    }
+    int can_start = g_running < g_limit && (u->max <= 0 || u->running < u->max);
+    if (g_waiting >= cfg->quota.queue_max && !can_start) {
+        u->rejected++;
+        int waiting = g_waiting;
+        pthread_mutex_unlock(&g_quota_lock);
+        fprintf(stderr, "quota: exec queue full (%d waiting), refusing %s (request %s)\n", waiting, name,
+                api_request_id());
+        send_json_error_field(c, 429, "exec_busy", "client", name);
+        return -1;
+    }
+
+    quota_waiter_t self = { slot, ++g_seq, NULL };
+    quota_waiter_t **tail = &g_waiters;
+    while (*tail) tail = &(*tail)->next;
+    *tail = &self;
+    u->waiting++;
+    g_waiting++;
+
+    long long deadline = now_ms() + cfg->quota.queue_timeout_ms;
+    while (quota_next_locked() != &self) {
+        long long left = deadline - now_ms();
+        if (left <= 0) break;
+        struct timespec ts;
+        clock_gettime(CLOCK_REALTIME, &ts);
+        ts.tv_sec += left / 1000;
+        ts.tv_nsec += (left % 1000) * 1000000L;
+        if (ts.tv_nsec >= 1000000000L) { ts.tv_sec++; ts.tv_nsec -= 1000000000L; }
+        (void)pthread_cond_timedwait(&g_quota_cond, &g_quota_lock, &ts);
+    }
+    int granted = quota_next_locked() == &self;
+    quota_unlink_locked(&self);
+    u->waiting--;
+    g_waiting--;
+    if (granted) {
+        u->running++;
+        u->granted++;
+        g_running++;
+        g_vclock = u->vtime;
+        u->vtime += QUOTA_VTIME_UNIT / (unsigned long long)(u->weight > 0 ? u->weight : 1);
+    } else {
+        u->rejected++;
+        /* Another waiter may have been held back behind this one. */
+        pthread_cond_broadcast(&g_quota_cond);
+    }
+    int running = u->running;
+    pthread_mutex_unlock(&g_quota_lock);
+    if (granted) return slot;
+
+    fprintf(stderr, "quota: %s waited %d ms for an exec slot (%d running), refusing (request %s)\n",
+            name, cfg->quota.queue_timeout_ms, running, api_request_id());
+    send_json_error_field(c, 429, "exec_busy", "client", name);
+    return -1;
+}
+
+void quota_exec_release(int slot) {
+    if (slot < 0 || slot >= QUOTA_MAX_TRACKED) return;
+    pthread_mutex_lock(&g_quota_lock);
+    quota_usage_t *u = &g_usage[slot];
+    if (u->running > 0) u->running--;
+    if (g_running > 0) g_running--;
+    u->last_ms = now_ms();
+    pthread_cond_broadcast(&g_quota_cond);
+    pthread_mutex_unlock(&g_quota_lock);
+}
+
+/* ---------- HTTP ---------- */
+
+static JSON_Value *quota_usage_json(const quota_usage_t *u, int limit, int active_weight) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "client", u->name);
+    json_object_set_boolean(o, "configured", u->configured);
+    json_object_set_number(o, "weight", u->weight);
+    if (u->max > 0) json_object_set_number(o, "max", u->max);
+    json_object_set_number(o, "running", u->running);
+    json_object_set_number(o, "waiting", u->waiting);
+    json_object_set_number(o, "granted", (double)u->granted);
+    json_object_set_number(o, "rejected", (double)u->rejected);
+    if (limit > 0 && active_weight > 0 && (u->running || u->waiting)) {
+        double share = (double)limit * u->weight / active_weight;
+        json_object_set_number(o, "fair_share", (double)(long long)(share * 100.0 + 0.5) / 100.0);
+    }
+    return v;
+}
+
+/*
+ * GET /admin/quotas — exec slot usage per client. fair_share is the number
+ * of slots a busy client is entitled to while the others stay busy too.
+ */
+static int h_admin_quotas(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri || strcmp(ri->request_method, "GET") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+    if (!admin_authorize(c, cfg)) {
+        free(cfg);
+        return 1;
+    }
+
+    quota_usage_t usage[QUOTA_MAX_TRACKED];
+    pthread_mutex_lock(&g_quota_lock);
+    memcpy(usage, g_usage, sizeof(usage));
+    int running = g_running;
+    pthread_mutex_unlock(&g_quota_lock);
+
+    /* Configured clients are listed before their first request too, with
+     * their current weight and cap. */
+    quota_usage_t listed[QUOTA_MAX_CLIENTS + QUOTA_MAX_TRACKED];
+    int n = 0, waiting = 0, active_weight = 0;
+    for (int i = 0; i < cfg->quota.client_count; i++) {
+        const quota_client_t *q = &cfg->quota.clients[i];
+        quota_usage_t *l = &listed[n++];
+        memset(l, 0, sizeof(*l));
+        for (int k = 0; k < QUOTA_MAX_TRACKED; k++) {
+            if (usage[k].configured && !strcmp(usage[k].name, q->name)) *l = usage[k];
+        }
+        snprintf(l->name, sizeof(l->name), "%s", q->name);
+        l->configured = 1;
+        l->weight = q->weight;
+        l->max = q->max;
+    }
+    for (int k = 0; k < QUOTA_MAX_TRACKED; k++) {
+        if (usage[k].name[0] && !usage[k].configured) listed[n++] = usage[k];
+    }
+    for (int i = 0; i < n; i++) {
+        waiting += listed[i].waiting;
+        if (listed[i].running || listed[i].waiting) active_weight += listed[i].weight;
+    }
+
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_number(o, "exec_concurrency", cfg->quota.exec_concurrency);
+    json_object_set_number(o, "queue_timeout_ms", cfg->quota.queue_timeout_ms);
+    json_object_set_number(o, "running", running);
+    json_object_set_number(o, "waiting", waiting);
+    JSON_Value *arr = json_value_init_array();
+    for (int i = 0; i < n; i++) {
+        json_array_append_value(json_array(arr),
+                                quota_usage_json(&listed[i], cfg->quota.exec_concurrency, active_weight));
+    }
+    json_object_set_value(o, "clients", arr);
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+    free(cfg);
+    return 1;
+}
+
+void quota_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    api_set_handler(ctx, "/admin/quotas", h_admin_quotas, app);
+}
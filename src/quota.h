@@ -0,0 +1,50 @@
+#ifndef AUTOD_QUOTA_H
+#define AUTOD_QUOTA_H
+
+#define QUOTA_MAX_CLIENTS 8
+#define QUOTA_MAX_TRACKED 64
+
+/* [quota] exec_concurrency caps the exec commands running at once on this
+ * node; the slots are shared between clients in proportion to their weight,
+ * so one busy client cannot starve the others. [quota.NAME] declares a
+ * client that presents token (X-Client-Token or Authorization: Bearer);
+ * requests without a known token are apportioned by source address. */
+typedef struct {
+    char name[32];
+    char token[80];
+    int  weight;                  /* share relative to other clients (1) */
+    int  max;                     /* concurrent execs at most; 0 = no cap */
+} quota_client_t;
+
+typedef struct {
+    int  exec_concurrency;        /* 0 = no limit (usage is still tracked) */
+    int  queue_max;               /* requests waiting for a slot at most (8) */
+    int  queue_timeout_ms;        /* longest wait for a slot before 429 (10000) */
+    int  default_weight;          /* clients known only by address (1) */
+    int  default_max;
+    quota_client_t clients[QUOTA_MAX_CLIENTS];
+    int  client_count;
+} quota_config_t;
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_context;
+struct mg_connection;
+
+void quota_cfg_defaults(config_t *cfg);
+int quota_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* HTTP worker threads needed so running and waiting execs leave the rest of
+ * the API responsive (a waiting request holds its thread). */
+int quota_server_threads(const config_t *cfg, int base);
+
+/* Wait for an exec slot for the requesting client. Returns the slot (>= 0)
+ * to hand back to quota_exec_release, or -1 after answering the request
+ * (401 unknown_client_token, 429 exec_busy when the queue is full or the
+ * wait timed out). Without exec_concurrency it never waits. */
+int quota_exec_acquire(struct mg_connection *c, const config_t *cfg);
+void quota_exec_release(int slot);
+
+void quota_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
@@ -0,0 +1,180 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <regex.h>
+
+#include "autod.h"
+#include "catalog.h"
+#include "redact.h"
+
+#define REDACT_DEFAULT_MASK "[redacted]"
+
+void redact_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->redact, 0, sizeof(cfg->redact));
+    strncpy(cfg->redact.mask, REDACT_DEFAULT_MASK, sizeof(cfg->redact.mask) - 1);
+}
+
+static int redact_check_pattern(const char *where, const char *value, size_t max) {
+    if (!*value || strlen(value) >= max) {
+        fprintf(stderr, "WARN: %s: ignoring pattern '%s' (empty or longer than %zu)\n",
+                where, value, max - 1);
+        return -1;
+    }
+    regex_t re;
+    int rc = regcomp(&re, value, REG_EXTENDED | REG_NEWLINE);
+    if (rc != 0) {
+        char err[128];
+        regerror(rc, &re, err, sizeof(err));
+        fprintf(stderr, "WARN: %s: ignoring pattern '%s' (%s)\n", where, value, err);
+        return -1;
+    }
+    regfree(&re);
+    return 0;
+}
+
+static redact_set_t *redact_find_or_add(config_t *cfg, const char *name) {
+    for (int i = 0; i < cfg->redact.set_count; i++) {
+        if (strcmp(cfg->redact.sets[i].name, name) == 0) return &cfg->redact.sets[i];
+    }
+    if (cfg->redact.set_count >= REDACT_MAX_SETS) return NULL;
+    redact_set_t *s = &cfg->redact.sets[cfg->redact.set_count++];
+    memset(s, 0, sizeof(*s));
+    strncpy(s->name, name, sizeof(s->name) - 1);
+    return s;
+}
+
+int redact_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    redact_config_t *r = &cfg->redact;
+    if (strcmp(section, "redact") == 0) {
+        if (!strcmp(key, "pattern")) {
+            if (r->pattern_count >= REDACT_MAX_PATTERNS) {
+                fprintf(stderr, "WARN: redact: pattern capacity reached (%d)\n", REDACT_MAX_PATTERNS);
+            } else if (redact_check_pattern("redact", value, sizeof(r->patterns[0])) == 0) {
+                strcpy(r->patterns[r->pattern_count++], value);
+            }
+        } else if (!strcmp(key, "mask")) {
+            if (strlen(value) >= sizeof(r->mask)) {
+                fprintf(stderr, "WARN: redact: ignoring mask '%s' (longer than %zu)\n",
+                        value, sizeof(r->mask) - 1);
+            } else {
+                strcpy(r->mask, value);
+            }
+        } else {
+            fprintf(stderr, "WARN: redact: ignoring unknown key '%s'\n", key);
+        }
+        return 1;
+    }
+    if (strncmp(section, "redact.", 7) != 0 || !section[7]) return 0;
+    redact_set_t *s = redact_find_or_add(cfg, section + 7);
+    if (!s) {
+        fprintf(stderr, "WARN: redact set capacity reached (%d)\n", REDACT_MAX_SETS);
+        return 1;
+    }
+    if (!strcmp(key, "pattern")) {
+        char where[48];
+        snprintf(where, sizeof(where), "redact.%s", s->name);
+        if (s->pattern_count >= REDACT_SET_MAX_PATTERNS) {
+            fprintf(stderr, "WARN: %s: pattern capacity reached (%d)\n", where,
+                    REDACT_SET_MAX_PATTERNS);
+        } else if (redact_check_pattern(where, value, sizeof(s->patterns[0])) == 0) {
+            strcpy(s->patterns[s->pattern_count++], value);
+        }
+    } else {
+        fprintf(stderr, "WARN: redact.%s: ignoring unknown key '%s'\n", s->name, key);
+    }
+    return 1;
+}
+
+/* Append n bytes to a growing buffer. */
+static int redact_append(char **out, size_t *len, size_t *cap, const char *p, size_t n) {
+    if (*len + n + 1 > *cap) {
+        size_t ncap = *cap ? *cap : 256;
+        while (*len + n + 1 > ncap) ncap *= 2;
+        char *tmp = realloc(*out, ncap);
+        if (!tmp) return -1;
+        *out = tmp;
+        *cap = ncap;
+    }
+    memcpy(*out + *len, p, n);
+    *len += n;
+    (*out)[*len] = '\0';
+    return 0;
+}
+
+/* Apply one pattern to *buf. Returns the number of matches masked or -1. */
+static int redact_pattern(const char *pattern, const char *mask, char **buf, size_t *len) {
+    regex_t re;
+    if (regcomp(&re, pattern, REG_EXTENDED | REG_NEWLINE) != 0) return 0;
+    int group = re.re_nsub > 0 ? 1 : 0;
+    size_t mask_len = strlen(mask);
+
+    char *out = NULL;
+    size_t out_len = 0, out_cap = 0;
+    int count = 0;
+    const char *p = *buf;
+    const char *end = *buf + *len;
+    regmatch_t m[2];
+    while (p < end && regexec(&re, p, 2, m, p == *buf ? 0 : REG_NOTBOL) == 0) {
+        regoff_t so = m[group].rm_so, eo = m[group].rm_eo;
+        if (so < 0 || eo <= so) {
+            /* Empty match (or an unmatched group): step past it. */
+            size_t step = m[0].rm_eo > 0 ? (size_t)m[0].rm_eo : 1;
+            if (redact_append(&out, &out_len, &out_cap, p, step) != 0) goto oom;
+            p += step;
+            continue;
+        }
+        if (redact_append(&out, &out_len, &out_cap, p, (size_t)so) != 0 ||
+            redact_append(&out, &out_len, &out_cap, mask, mask_len) != 0 ||
+            redact_append(&out, &out_len, &out_cap, p + eo, (size_t)(m[0].rm_eo - eo)) != 0) {
+            goto oom;
+        }
+        p += m[0].rm_eo;
+        count++;
+    }
+    regfree(&re);
+    if (count == 0) {
+        free(out);
+        return 0;
+    }
+    if (redact_append(&out, &out_len, &out_cap, p, (size_t)(end - p)) != 0) {
+        free(out);
+        return -1;
+    }
+    free(*buf);
+    *buf = out;
+    *len = out_len;
+    return count;
+
+oom:
+    regfree(&re);
+    free(out);
+    return -1;
+}
+
+int redact_output(const config_t *cfg, const char *path, char **buf, size_t *len) {
+    if (!cfg || !buf || !*buf || !len || *len == 0 || strlen(*buf) != *len) return 0;
+    const redact_config_t *r = &cfg->redact;
+    const redact_set_t *set = NULL;
+    char name[32];
+    if (path && r->set_count > 0 &&
+        catalog_option_for(cfg, path, "redact", name, sizeof(name)) == 0) {
+        for (int i = 0; i < r->set_count; i++) {
+            if (strcmp(r->sets[i].name, name) == 0) set = &r->sets[i];
+        }
+    }
+
+    int total = 0;
+    for (int i = 0; i < r->pattern_count; i++) {
+        int n = redact_pattern(r->patterns[i], r->mask, buf, len);
+        if (n < 0) return -1;
+        total += n;
+    }
+    for (int i = 0; set && i < set->pattern_count; i++) {
+        int n = redact_pattern(set->patterns[i], r->mask, buf, len);
+        if (n < 0) return -1;
+        total += n;
+    }
+    return total;
+}
@@ -0,0 +1,40 @@
+#ifndef AUTOD_REDACT_H
+#define AUTOD_REDACT_H
+
+#include <stddef.h>
+
+#define REDACT_MAX_PATTERNS 16
+#define REDACT_MAX_SETS 8
+#define REDACT_SET_MAX_PATTERNS 8
+
+/* [redact] — POSIX extended regexes masked out of exec stdout/stderr before
+ * the output is returned or stored. [redact] patterns apply to every command;
+ * a [redact.NAME] set only to paths whose catalog entry says "redact=NAME".
+ * A pattern with a capture group masks just the first group, so
+ * "password=([^ ]+)" keeps the key and hides the value. */
+typedef struct {
+    char name[32];
+    char patterns[REDACT_SET_MAX_PATTERNS][128];
+    int  pattern_count;
+} redact_set_t;
+
+typedef struct {
+    char patterns[REDACT_MAX_PATTERNS][128];
+    int  pattern_count;
+    char mask[32];                 /* replacement text, default "[redacted]" */
+    redact_set_t sets[REDACT_MAX_SETS];
+    int  set_count;
+} redact_config_t;
+
+typedef struct config config_t;
+
+void redact_cfg_defaults(config_t *cfg);
+int redact_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* Mask every match of the rules that apply to path in *buf (len bytes,
+ * NUL-terminated), replacing the buffer when the result differs. Output with
+ * NUL bytes in it is binary and left alone. Returns the number of matches
+ * masked, or -1 when out of memory. */
+int redact_output(const config_t *cfg, const char *path, char **buf, size_t *len);
+
+#endif
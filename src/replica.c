@@ -0,0 +1,305 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <signal.h>
+#include <time.h>
+#include <unistd.h>
+#include <pthread.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "events.h"
+#include "httpc.h"
+#include "replica.h"
+#include "version.h"
+
+extern volatile sig_atomic_t g_stop;
+
+#define REPLICA_TIMEOUT_MS 5000
+
+/* One mirrored response, keyed by path plus query string. Pinned entries are
+ * refreshed by the replica thread; the rest are fetched when a client asks
+ * and reused for one sync interval. */
+typedef struct {
+    char key[256];
+    int pinned;
+    int status;
+    char *body;
+    size_t len;
+    unsigned long long version;
+    long long modified_unix;
+    long long fetched_ms;
+    long long used_ms;
+} replica_entry_t;
+
+static const char *const k_replica_pinned[] = { "/sync/slaves", "/nodes", "/cluster/health" };
+
+static pthread_mutex_t g_replica_lock = PTHREAD_MUTEX_INITIALIZER;
+static replica_entry_t g_replica[REPLICA_MAX_ENTRIES];
+static unsigned long long g_replica_events_seq;
+static long long g_replica_last_ok_unix;
+static char g_replica_last_error[64];
+
+static pthread_t g_replica_thread;
+static int g_replica_running;
+static int g_replica_stop;
+
+int replica_is_active(const config_t *cfg) {
+    return cfg && strcasecmp(cfg->sync_role, "read_replica") == 0;
+}
+
+/* master_url names the master; only its host and port are used. */
+static int replica_source_url(const config_t *cfg, const char *key, http_url_t *out) {
+    if (httpc_parse_url(cfg->sync_master_url, out, "/") != 0) return -1;
+    int n = snprintf(out->path, sizeof(out->path), AUTOD_PEER_PREFIX "%s", key);
+    return (n < 0 || n >= (int)sizeof(out->path)) ? -1 : 0;
+}
+
+static void replica_note_result(const char *error) {
+    pthread_mutex_lock(&g_replica_lock);
+    if (error) {
+        snprintf(g_replica_last_error, sizeof(g_replica_last_error), "%s", error);
+    } else {
+        g_replica_last_error[0] = '\0';
+        g_replica_last_ok_unix = (long long)time(NULL);
+    }
+    pthread_mutex_unlock(&g_replica_lock);
+}
+
+static replica_entry_t *replica_find_locked(const char *key) {
+    for (int i = 0; i < REPLICA_MAX_ENTRIES; i++) {
+        if (g_replica[i].key[0] && !strcmp(g_replica[i].key, key)) return &g_replica[i];
+    }
+    return NULL;
+}
+
+/* Takes ownership of body. */
+static void replica_store(const char *key, int pinned, int status, char *body, size_t len) {
+    pthread_mutex_lock(&g_replica_lock);
+    replica_entry_t *e = replica_find_locked(key);
+    if (!e) {
+        replica_entry_t *lru = NULL;
+        for (int i = 0; i < REPLICA_MAX_ENTRIES && !e; i++) {
+            replica_entry_t *cand = &g_replica[i];
+            if (!cand->key[0]) e = cand;
+            else if (!cand->pinned && (!lru || cand->used_ms < lru->used_ms)) lru = cand;
+        }
+        if (!e) e = lru;
+        if (!e) {
+            pthread_mutex_unlock(&g_replica_lock);
+            free(body);
+            return;
+        }
+        free(e->body);
+        memset(e, 0, sizeof(*e));
+        snprintf(e->key, sizeof(e->key), "%s", key);
+        e->used_ms = now_ms();
+    }
+    e->pinned = e->pinned || pinned;
+    e->fetched_ms = now_ms();
+    if (e->body && e->status == status && e->len == len && !memcmp(e->body, body, len)) {
+        free(body);
+    } else {
+        free(e->body);
+        e->body = body;
+        e->len = len;
+        e->status = status;
+        e->version++;
+        e->modified_unix = (long long)time(NULL);
+    }
+    pthread_mutex_unlock(&g_replica_lock);
+}
+
+static int replica_fetch(const config_t *cfg, const char *key, int pinned) {
+    http_url_t url;
+    if (replica_source_url(cfg, key, &url) != 0) return -1;
+    char *body = NULL;
+    size_t len = 0;
+    int status = httpc_get(&url, &body, &len, REPLICA_TIMEOUT_MS);
+    if (status <= 0 || !body) {
+        free(body);
+        replica_note_result("master_unreachable");
+        return -1;
+    }
+    replica_store(key, pinned, status, body, len);
+    replica_note_result(NULL);
+    return status;
+}
+
+/* Copy new events under the master's sequence numbers so /events clients can
+ * switch between master and replica with the same since= cursor. */
+static void replica_sync_events(const config_t *cfg) {
+    char key[96];
+    snprintf(key, sizeof(key), "/events?since=%llu&limit=%d",
+             g_replica_events_seq, EVENTS_RING_SIZE);
+    http_url_t url;
+    if (replica_source_url(cfg, key, &url) != 0) return;
+    char *body = NULL;
+    int status = httpc_get(&url, &body, NULL, REPLICA_TIMEOUT_MS);
+    JSON_Value *root = (status == 200 && body) ? json_parse_string(body) : NULL;
+    free(body);
+    if (!root) return;
+
+    JSON_Object *ro = json_object(root);
+    unsigned long long last = (unsigned long long)json_object_get_number(ro, "last_seq");
+    if (last < g_replica_events_seq) {
+        /* The master restarted; start over from its first event. */
+        fprintf(stderr, "read replica: master event sequence reset, resyncing\n");
+        g_replica_events_seq = 0;
+        json_value_free(root);
+        return;
+    }
+    events_mirror_stream(json_object_get_string(ro, "resume"));
+    JSON_Array *events = json_object_get_array(ro, "events");
+    size_t count = json_array_get_count(events);
+    for (size_t i = 0; i < count; i++) {
+        JSON_Object *ev = json_array_get_object(events, i);
+        unsigned long long seq = (unsigned long long)json_object_get_number(ev, "seq");
+        if (seq <= g_replica_events_seq) continue;
+        JSON_Value *data = json_object_get_value(ev, "data");
+        events_mirror(seq, (long long)json_object_get_number(ev, "ts_ms"),
+                      (long long)json_object_get_number(ev, "ts_unix_ms"),
+                      json_object_get_string(ev, "type"),
+                      data ? json_value_deep_copy(data) : NULL);
+        g_replica_events_seq = seq;
+    }
+    json_value_free(root);
+}
+
+static void *replica_thread_main(void *arg) {
+    app_t *app = (app_t *)arg;
+    int reachable = -1;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) return NULL;
+    while (!g_replica_stop && !g_stop) {
+        app_config_snapshot(app, cfg);
+        if (!replica_is_active(cfg) || !cfg->sync_master_url[0]) {
+            sleep(2);
+            continue;
+        }
+        int ok = 1;
+        for (size_t i = 0; i < sizeof(k_replica_pinned) / sizeof(k_replica_pinned[0]); i++) {
+            if (replica_fetch(cfg, k_replica_pinned[i], 1) < 0) ok = 0;
+        }
+        if (ok) replica_sync_events(cfg);
+        if (ok != reachable) {
+            if (ok) fprintf(stderr, "read replica: mirroring %s\n", cfg->sync_master_url);
+            else fprintf(stderr, "read replica: %s unreachable, serving the last copy\n",
+                         cfg->sync_master_url);
+            reachable = ok;
+        }
+        int interval = cfg->sync_replica_interval_s > 0 ? cfg->sync_replica_interval_s : 2;
+        for (int i = 0; i < interval && !g_replica_stop && !g_stop; i++) sleep(1);
+    }
+    free(cfg);
+    return NULL;
+}
+
+int replica_handle(struct mg_connection *c, const config_t *cfg) {
+    if (!replica_is_active(cfg)) return 0;
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri || strcmp(ri->request_method, "GET") != 0) {
+        send_json_error(c, 403, "read_only_replica");
+        return 1;
+    }
+
+    char key[256];
+    int n = snprintf(key, sizeof(key), "%s%s%s", api_local_uri(c),
+                     ri->query_string ? "?" : "", ri->query_string ? ri->query_string : "");
+    if (n < 0 || n >= (int)sizeof(key)) {
+        send_plain(c, 404, "not_found", 1);
+        return 1;
+    }
+
+    long long max_age_ms = (cfg->sync_replica_interval_s > 0 ? cfg->sync_replica_interval_s : 2) * 1000LL;
+    pthread_mutex_lock(&g_replica_lock);
+    replica_entry_t *e = replica_find_locked(key);
+    int fresh = e && (e->pinned || now_ms() - e->fetched_ms < max_age_ms);
+    pthread_mutex_unlock(&g_replica_lock);
+    if (!fresh) (void)replica_fetch(cfg, key, 0);
+
+    char *body = NULL;
+    size_t len = 0;
+    int status = 0;
+    unsigned long long version = 0;
+    long long modified_unix = 0;
+    pthread_mutex_lock(&g_replica_lock);
+    e = replica_find_locked(key);
+    if (e && e->body) {
+        body = (char *)malloc(e->len + 1);
+        if (body) {
+            memcpy(body, e->body, e->len);
+            body[e->len] = '\0';
+            len = e->len;
+            status = e->status;
+            version = e->version;
+            modified_unix = e->modified_unix;
+        }
+        e->used_ms = now_ms();
+    }
+    pthread_mutex_unlock(&g_replica_lock);
+
+    if (!body) {
+        send_json_error(c, 503, "master_unreachable");
+        return 1;
+    }
+    if (status == 200) {
+        send_json_cached(c, body, len, "replica", version, modified_unix, 1);
+    } else {
+        JSON_Value *v = json_parse_string(body);
+        if (v) send_json(c, v, status, 1);
+        else send_plain(c, status, body, 1);
+        if (v) json_value_free(v);
+    }
+    free(body);
+    return 1;
+}
+
+void replica_append_status(JSON_Object *so) {
+    if (!so) return;
+    pthread_mutex_lock(&g_replica_lock);
+    int mirrored = 0;
+    for (int i = 0; i < REPLICA_MAX_ENTRIES; i++) {
+        if (g_replica[i].key[0]) mirrored++;
+    }
+    if (g_replica_last_ok_unix > 0) {
+        json_object_set_number(so, "last_sync_unix", (double)g_replica_last_ok_unix);
+    }
+    if (g_replica_last_error[0]) json_object_set_string(so, "last_error", g_replica_last_error);
+    json_object_set_number(so, "mirrored", mirrored);
+    json_object_set_number(so, "events_seq", (double)g_replica_events_seq);
+    pthread_mutex_unlock(&g_replica_lock);
+}
+
+int replica_start_thread(app_t *app) {
+    if (!app) return -1;
+    pthread_mutex_lock(&g_replica_lock);
+    g_replica_stop = 0;
+    if (g_replica_running) {
+        pthread_mutex_unlock(&g_replica_lock);
+        return 0;
+    }
+    if (pthread_create(&g_replica_thread, NULL, replica_thread_main, app) == 0) {
+        g_replica_running = 1;
+        pthread_mutex_unlock(&g_replica_lock);
+        return 0;
+    }
+    pthread_mutex_unlock(&g_replica_lock);
+    fprintf(stderr, "WARN: failed to start read replica thread\n");
+    return -1;
+}
+
+void replica_stop_thread(void) {
+    pthread_mutex_lock(&g_replica_lock);
+    g_replica_stop = 1;
+    int running = g_replica_running;
+    pthread_mutex_unlock(&g_replica_lock);
+    if (running) {
+        pthread_join(g_replica_thread, NULL);
+        pthread_mutex_lock(&g_replica_lock);
+        g_replica_running = 0;
+        pthread_mutex_unlock(&g_replica_lock);
+    }
+}
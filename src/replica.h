@@ -0,0 +1,30 @@
+#ifndef AUTOD_REPLICA_H
+#define AUTOD_REPLICA_H
+
+#include "parson.h"
+
+/* [sync] role = read_replica: a dashboard-facing copy of a master. A
+ * background thread mirrors the registry views and the event ring from
+ * [sync] master_url; the read endpoints are then answered locally and every
+ * write is refused. */
+
+#define REPLICA_MAX_ENTRIES 24
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_connection;
+
+int replica_is_active(const config_t *cfg);
+
+/* Answer a request on a mirrored endpoint (GET from the mirror, anything else
+ * 403 read_only_replica). Returns 1 when handled, 0 when this node is not a
+ * replica and the caller should serve the request itself. */
+int replica_handle(struct mg_connection *c, const config_t *cfg);
+
+/* Mirror state for /health: source, last successful sync, event position. */
+void replica_append_status(JSON_Object *so);
+
+int replica_start_thread(app_t *app);
+void replica_stop_thread(void);
+
+#endif
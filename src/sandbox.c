@@ -0,0 +1,216 @@
+#define _GNU_SOURCE
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <errno.h>
+#include <fnmatch.h>
+#include <signal.h>
+#include <unistd.h>
+#include <sys/types.h>
+#include <sys/wait.h>
+#if defined(__linux__)
+#include <sched.h>
+#include <sys/mount.h>
+#include <sys/prctl.h>
+#endif
+
+#include "autod.h"
+#include "sandbox.h"
+
+static const struct { const char *name; unsigned bit; } k_caps[] = {
+    { "chown", 0 }, { "dac_override", 1 }, { "dac_read_search", 2 }, { "fowner", 3 },
+    { "fsetid", 4 }, { "kill", 5 }, { "setgid", 6 }, { "setuid", 7 }, { "setpcap", 8 },
+    { "net_bind_service", 10 }, { "net_broadcast", 11 }, { "net_admin", 12 },
+    { "net_raw", 13 }, { "ipc_lock", 14 }, { "sys_chroot", 18 }, { "sys_ptrace", 19 },
+    { "sys_admin", 21 }, { "sys_boot", 22 }, { "sys_nice", 23 }, { "sys_resource", 24 },
+    { "sys_time", 25 }, { "mknod", 27 }, { "syslog", 34 }, { NULL, 0 }
+};
+
+static const struct { const char *name; unsigned flag; } k_namespaces[] = {
+    { "mount", SANDBOX_NS_MOUNT }, { "pid", SANDBOX_NS_PID }, { "net", SANDBOX_NS_NET },
+    { "ipc", SANDBOX_NS_IPC }, { "uts", SANDBOX_NS_UTS }, { NULL, 0 }
+};
+
+void sandbox_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->sandbox, 0, sizeof(cfg->sandbox));
+}
+
+static sandbox_profile_t *sandbox_find_profile(config_t *cfg, const char *name) {
+    for (int i = 0; i < cfg->sandbox.profile_count; i++) {
+        if (strcmp(cfg->sandbox.profiles[i].name, name) == 0) return &cfg->sandbox.profiles[i];
+    }
+    if (cfg->sandbox.profile_count >= SANDBOX_MAX_PROFILES) return NULL;
+    sandbox_profile_t *p = &cfg->sandbox.profiles[cfg->sandbox.profile_count++];
+    memset(p, 0, sizeof(*p));
+    strncpy(p->name, name, sizeof(p->name) - 1);
+    p->namespaces = SANDBOX_NS_MOUNT | SANDBOX_NS_PID | SANDBOX_NS_NET |
+                    SANDBOX_NS_IPC | SANDBOX_NS_UTS;
+    p->drop_caps = 1;
+    return p;
+}
+
+/* Walk a comma/space separated list, calling fn for each token. */
+static int sandbox_each_token(const char *value, const char *name,
+                              int (*fn)(sandbox_profile_t *, const char *),
+                              sandbox_profile_t *p) {
+    char buf[256];
+    strncpy(buf, value, sizeof(buf) - 1);
+    buf[sizeof(buf) - 1] = '\0';
+    char *save = NULL;
+    for (char *tok = strtok_r(buf, ", \t", &save); tok; tok = strtok_r(NULL, ", \t", &save)) {
+        if (fn(p, tok) != 0) {
+            fprintf(stderr, "WARN: sandbox %s: ignoring unknown %s '%s'\n", p->name, name, tok);
+        }
+    }
+    return 0;
+}
+
+static int sandbox_add_namespace(sandbox_profile_t *p, const char *tok) {
+    if (!strcasecmp(tok, "all")) {
+        p->namespaces = SANDBOX_NS_MOUNT | SANDBOX_NS_PID | SANDBOX_NS_NET |
+                        SANDBOX_NS_IPC | SANDBOX_NS_UTS;
+        return 0;
+    }
+    if (!strcasecmp(tok, "none")) return 0;
+    for (int i = 0; k_namespaces[i].name; i++) {
+        if (!strcasecmp(tok, k_namespaces[i].name)) {
+            p->namespaces |= k_namespaces[i].flag;
+            return 0;
+        }
+    }
+    return -1;
+}
+
+static int sandbox_add_cap(sandbox_profile_t *p, const char *tok) {
+    if (!strncasecmp(tok, "cap_", 4)) tok += 4;
+    for (int i = 0; k_caps[i].name; i++) {
+        if (!strcasecmp(tok, k_caps[i].name)) {
+            p->keep_caps |= 1ULL << k_caps[i].bit;
+            return 0;
+        }
+    }
+    return -1;
+}
+
+int sandbox_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (strncmp(section, "sandbox.", 8) != 0 || !section[8]) return 0;
+    sandbox_profile_t *p = sandbox_find_profile(cfg, section + 8);
+    if (!p) {
+        fprintf(stderr, "WARN: sandbox profile capacity reached (%d)\n", SANDBOX_MAX_PROFILES);
+        return 1;
+    }
+    if (!strcmp(key, "match")) {
+        if (p->match_count >= SANDBOX_MAX_MATCH) {
+            fprintf(stderr, "WARN: sandbox %s: match capacity reached (%d)\n",
+                    p->name, SANDBOX_MAX_MATCH);
+        } else {
+            strncpy(p->match[p->match_count], value, sizeof(p->match[0]) - 1);
+            p->match[p->match_count][sizeof(p->match[0]) - 1] = '\0';
+            p->match_count++;
+        }
+    } else if (!strcmp(key, "root")) {
+        strncpy(p->root, value, sizeof(p->root) - 1);
+        p->root[sizeof(p->root) - 1] = '\0';
+    } else if (!strcmp(key, "namespaces")) {
+        p->namespaces = 0;
+        sandbox_each_token(value, "namespace", sandbox_add_namespace, p);
+    } else if (!strcmp(key, "drop_caps")) {
+        p->drop_caps = atoi(value);
+    } else if (!strcmp(key, "keep_caps")) {
+        p->keep_caps = 0;
+        sandbox_each_token(value, "capability", sandbox_add_cap, p);
+    } else {
+        fprintf(stderr, "WARN: sandbox %s: ignoring unknown key '%s'\n", p->name, key);
+    }
+    return 1;
+}
+
+const sandbox_profile_t *sandbox_select(const config_t *cfg, const char *path) {
+    if (!cfg || !path) return NULL;
+    for (int i = 0; i < cfg->sandbox.profile_count; i++) {
+        const sandbox_profile_t *p = &cfg->sandbox.profiles[i];
+        for (int m = 0; m < p->match_count; m++) {
+            if (fnmatch(p->match[m], path, 0) == 0) return p;
+        }
+    }
+    return NULL;
+}
+
+#if defined(__linux__)
+static int sandbox_fail(const sandbox_profile_t *p, const char *what) {
+    dprintf(STDERR_FILENO, "sandbox %s: %s failed: %s\n", p->name, what, strerror(errno));
+    return -1;
+}
+
+static int sandbox_last_cap(void) {
+    int last = 40;
+    FILE *f = fopen("/proc/sys/kernel/cap_last_cap", "r");
+    if (f) {
+        if (fscanf(f, "%d", &last) != 1) last = 40;
+        fclose(f);
+    }
+    return last > 63 ? 63 : last;
+}
+
+int sandbox_enter(const sandbox_profile_t *p) {
+    if (!p) return 0;
+    int flags = 0;
+    /* chroot and the private /proc need their own mount table. */
+    if ((p->namespaces & SANDBOX_NS_MOUNT) || p->root[0]) flags |= CLONE_NEWNS;
+    if (p->namespaces & SANDBOX_NS_PID) flags |= CLONE_NEWPID;
+    if (p->namespaces & SANDBOX_NS_NET) flags |= CLONE_NEWNET;
+    if (p->namespaces & SANDBOX_NS_IPC) flags |= CLONE_NEWIPC;
+    if (p->namespaces & SANDBOX_NS_UTS) flags |= CLONE_NEWUTS;
+
+    if (flags && unshare(flags) != 0) return sandbox_fail(p, "unshare");
+    if ((flags & CLONE_NEWNS) && mount(NULL, "/", NULL, MS_REC | MS_PRIVATE, NULL) != 0) {
+        return sandbox_fail(p, "mount private");
+    }
+    if (p->root[0]) {
+        if (chroot(p->root) != 0) return sandbox_fail(p, "chroot");
+        if (chdir("/") != 0) return sandbox_fail(p, "chdir");
+    }
+
+    if (flags & CLONE_NEWPID) {
+        /* Only children join the new PID namespace: fork the handler as its
+         * PID 1 and stay behind to relay the exit status. PDEATHSIG makes a
+         * timeout kill of this reaper take the whole namespace down. */
+        pid_t child = fork();
+        if (child < 0) return sandbox_fail(p, "fork");
+        if (child > 0) {
+            int status = 0;
+            while (waitpid(child, &status, 0) < 0 && errno == EINTR) {}
+            _exit(WIFEXITED(status) ? WEXITSTATUS(status) : 128 + WTERMSIG(status));
+        }
+        (void)prctl(PR_SET_PDEATHSIG, SIGKILL);
+        if (flags & CLONE_NEWNS) {
+            (void)umount2("/proc", MNT_DETACH);
+            if (access("/proc", F_OK) == 0 &&
+                mount("proc", "/proc", "proc", MS_NOSUID | MS_NODEV | MS_NOEXEC, NULL) != 0) {
+                return sandbox_fail(p, "mount /proc");
+            }
+        }
+    }
+
+    if (p->drop_caps) {
+        int last = sandbox_last_cap();
+        for (int cap = 0; cap <= last; cap++) {
+            if (p->keep_caps & (1ULL << cap)) continue;
+            if (prctl(PR_CAPBSET_DROP, cap, 0, 0, 0) != 0 && errno != EINVAL) {
+                return sandbox_fail(p, "drop capabilities");
+            }
+        }
+        if (prctl(PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0) != 0) return sandbox_fail(p, "no_new_privs");
+    }
+    return 0;
+}
+#else
+int sandbox_enter(const sandbox_profile_t *p) {
+    if (!p) return 0;
+    dprintf(STDERR_FILENO, "sandbox %s: not supported on this platform\n", p->name);
+    return -1;
+}
+#endif
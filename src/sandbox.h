@@ -0,0 +1,44 @@
+#ifndef AUTOD_SANDBOX_H
+#define AUTOD_SANDBOX_H
+
+#define SANDBOX_MAX_PROFILES 8
+#define SANDBOX_MAX_MATCH 8
+
+#define SANDBOX_NS_MOUNT 0x01u
+#define SANDBOX_NS_PID   0x02u
+#define SANDBOX_NS_NET   0x04u
+#define SANDBOX_NS_IPC   0x08u
+#define SANDBOX_NS_UTS   0x10u
+
+/* [sandbox.NAME] — containment applied to exec paths matching one of the
+ * match patterns (fnmatch). The first matching profile wins. */
+typedef struct {
+    char name[32];
+    char match[SANDBOX_MAX_MATCH][128];
+    int  match_count;
+    char root[256];                /* chroot target; empty keeps the host root */
+    unsigned namespaces;           /* SANDBOX_NS_* */
+    int  drop_caps;                /* drop capabilities not in keep_caps (default 1) */
+    unsigned long long keep_caps;  /* bit n = capability n */
+} sandbox_profile_t;
+
+typedef struct {
+    int profile_count;
+    sandbox_profile_t profiles[SANDBOX_MAX_PROFILES];
+} sandbox_config_t;
+
+typedef struct config config_t;
+
+void sandbox_cfg_defaults(config_t *cfg);
+int sandbox_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* Profile for an exec path, or NULL when it runs unconfined. */
+const sandbox_profile_t *sandbox_select(const config_t *cfg, const char *path);
+
+/* Enter the profile from the freshly forked exec child, before execv().
+ * With a PID namespace the calling process stays behind as a reaper and
+ * only the (new) PID 1 returns. Returns -1 after writing the reason to
+ * stderr. */
+int sandbox_enter(const sandbox_profile_t *p);
+
+#endif
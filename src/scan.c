@@ -1,6 +1,7 @@
 #define _POSIX_C_SOURCE 200809L
 #include "scan.h"
 #include "parson.h"
+#include "httpc.h"
 
 #include <stdio.h>
 #include <stdlib.h>
@@ -8,6 +9,7 @@
 #include <errno.h>
 #include <unistd.h>
 #include <time.h>
+#include <limits.h>
 #include <poll.h>
 #include <pthread.h>
 #include <ifaddrs.h>
@@ -45,11 +47,13 @@ static int http_get_simple(const char *ip, int port, const char *path,
     int fd = tcp_connect_nb(ip, port, timeout_ms);
     if (fd < 0) return -1;
 
-    char req[256];
+    char identity[HTTPC_IDENTITY_MAX];
+    if (httpc_identity(identity, sizeof(identity)) < 0) identity[0] = '\0';
+    char req[256 + HTTPC_IDENTITY_MAX];
     int n = snprintf(req, sizeof(req),
-                     "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n",
-                     path, ip);
-    if (n < 0 || write(fd, req, n) != n) { close(fd); return -1; }
+                     "GET %s HTTP/1.1\r\nHost: %s\r\n%sConnection: close\r\n\r\n",
+                     path, ip, identity);
+    if (n < 0 || n >= (int)sizeof(req) || write(fd, req, n) != n) { close(fd); return -1; }
 
     size_t w = 0;
     for (;;) {
@@ -81,6 +85,7 @@ static pthread_mutex_t g_nodes_mx = PTHREAD_MUTEX_INITIALIZER;
 
 static scan_node_t g_nodes[SCAN_MAX_NODES];
 static int         g_nodes_count = 0;
+static unsigned long g_nodes_version = 1; // bumped under g_nodes_mx on every change
 
 static volatile int      g_scan_in_progress = 0;
 static volatile unsigned g_scan_total = 0;
@@ -88,6 +93,8 @@ static volatile unsigned g_scan_done  = 0;
 static volatile double   g_last_started  = 0.0;
 static volatile double   g_last_finished = 0.0;
 static volatile unsigned g_scan_seq = 0;
+static volatile unsigned g_scan_skipped  = 0;
+static volatile unsigned g_scan_deferred = 0;
 
 static scan_config_t g_cfg = {0};
 
@@ -108,6 +115,11 @@ static scan_tun_t g_tun = {
 };
 
 static inline double now_s(void){ return (double)time(NULL); }
+static double mono_ms(void) {
+    struct timespec ts;
+    clock_gettime(CLOCK_MONOTONIC, &ts);
+    return (double)ts.tv_sec * 1000.0 + (double)ts.tv_nsec / 1e6;
+}
 static int is_link_local(const char *ip) { return strncmp(ip, "169.254.", 8) == 0; }
 
 static inline int progress_pct(void) {
@@ -118,6 +130,7 @@ static inline int progress_pct(void) {
 static void nodes_reset(void) {
     pthread_mutex_lock(&g_nodes_mx);
     g_nodes_count = 0;
+    g_nodes_version++;
     pthread_mutex_unlock(&g_nodes_mx);
 }
 
@@ -128,6 +141,25 @@ static int nodes_find_idx(const char *ip, int port) {
     return -1;
 }
 
+static scan_filter_fn g_filter;
+static void *g_filter_ud;
+
+void scan_set_filter(scan_filter_fn fn, void *ud) {
+    g_filter_ud = ud;
+    g_filter = fn;
+}
+
+// Asked outside g_nodes_mx: the hook may take other locks.
+static int nodes_admit(const scan_node_t *ni) {
+    if (!g_filter) return 1;
+    pthread_mutex_lock(&g_nodes_mx);
+    int known = nodes_find_idx(ni->ip, ni->port) >= 0;
+    int cached = 0;
+    for (int i=0;i<g_nodes_count;i++) if (!g_nodes[i].is_self) cached++;
+    pthread_mutex_unlock(&g_nodes_mx);
+    return g_filter(ni, known, cached, g_filter_ud) == 0;
+}
+
 static void nodes_upsert(const scan_node_t *ni) {
     pthread_mutex_lock(&g_nodes_mx);
     int idx = nodes_find_idx(ni->ip, ni->port);
@@ -140,15 +172,24 @@ static void nodes_upsert(const scan_node_t *ni) {
     } else if (g_nodes_count < SCAN_MAX_NODES) {
         g_nodes[g_nodes_count++] = *ni;
     }
+    g_nodes_version++;
     pthread_mutex_unlock(&g_nodes_mx);
 }
 
-static void nodes_prune_after_scan(unsigned scan_seq) {
+static int in_subnet(const char *ip, uint32_t net, uint32_t mask) {
+    struct in_addr ia;
+    if (inet_pton(AF_INET, ip, &ia) != 1) return 0;
+    return (ntohl(ia.s_addr) & mask) == net;
+}
+
+// A partial scan (mask != 0) only ages nodes inside the subnet it covered.
+static void nodes_prune_after_scan(unsigned scan_seq, uint32_t net, uint32_t mask) {
     pthread_mutex_lock(&g_nodes_mx);
     int w = 0;
     for (int i=0;i<g_nodes_count;i++){
         scan_node_t *n = &g_nodes[i];
         if (n->is_self) { g_nodes[w++] = *n; continue; }
+        if (mask && !in_subnet(n->ip, net, mask)) { g_nodes[w++] = *n; continue; }
         if (n->seen_scan == scan_seq) {
             n->misses = 0;
             g_nodes[w++] = *n;
@@ -162,9 +203,104 @@ static void nodes_prune_after_scan(unsigned scan_seq) {
         }
     }
     g_nodes_count = w;
+    g_nodes_version++;
     pthread_mutex_unlock(&g_nodes_mx);
 }
 
+static void nodes_mark_seen(uint32_t a, unsigned scan_seq) {
+    struct in_addr t; t.s_addr = htonl(a);
+    char ip[16];
+    if (!inet_ntop(AF_INET, &t, ip, sizeof(ip))) return;
+    pthread_mutex_lock(&g_nodes_mx);
+    for (int i=0;i<g_nodes_count;i++){
+        if (strcmp(g_nodes[i].ip, ip) == 0) g_nodes[i].seen_scan = scan_seq;
+    }
+    pthread_mutex_unlock(&g_nodes_mx);
+}
+
+// ================ Probe history ================
+//
+// Every probed address keeps its recent record: how long /health took when
+// it answered, and how many probes in a row it answered or ignored. Adaptive
+// scans use it to probe steady hosts less often, back off from silent
+// addresses and spend their budget on address space not tried yet.
+
+#define SCAN_HISTORY_SLOTS  4096 // open addressing, filled to half at most
+#define SCAN_STABLE_ANSWERS 3    // answers in a row before a host counts as steady
+#define SCAN_MAX_BACKOFF    8    // scans between probes of a long-silent address
+
+typedef struct {
+    uint32_t addr;      // host order; 0 = free slot
+    double   ewma_ms;   // smoothed /health round trip of answered probes
+    unsigned answers;   // consecutive answered probes
+    unsigned silent;    // consecutive unanswered probes
+    unsigned last_seq;  // scan it was last probed in (0 = only refreshed)
+} scan_history_t;
+
+static pthread_mutex_t g_hist_mx = PTHREAD_MUTEX_INITIALIZER;
+static scan_history_t  g_hist[SCAN_HISTORY_SLOTS];
+static unsigned        g_hist_used = 0;
+
+// Caller holds g_hist_mx. NULL when a is not tracked (and create is 0 or the
+// table is full).
+static scan_history_t *history_slot(uint32_t a, int create) {
+    if (!a) return NULL;
+    unsigned i = (unsigned)((a * 2654435761u) % SCAN_HISTORY_SLOTS);
+    for (unsigned k = 0; k < SCAN_HISTORY_SLOTS; k++, i = (i + 1) % SCAN_HISTORY_SLOTS) {
+        if (g_hist[i].addr == a) return &g_hist[i];
+        if (g_hist[i].addr) continue;
+        if (!create || g_hist_used >= SCAN_HISTORY_SLOTS / 2) return NULL;
+        g_hist_used++;
+        g_hist[i].addr = a;
+        return &g_hist[i];
+    }
+    return NULL;
+}
+
+// Note one /health probe of a; seq is the scan it belongs to, 0 for a
+// one-off refresh. Returns the smoothed round trip (0 when untracked).
+static double history_record(uint32_t a, int answered, double ms, unsigned seq) {
+    double ewma = 0;
+    pthread_mutex_lock(&g_hist_mx);
+    scan_history_t *h = history_slot(a, 1);
+    if (h) {
+        if (answered) {
+            if (ms < 0.1) ms = 0.1;
+            h->ewma_ms = h->ewma_ms > 0 ? (h->ewma_ms * 3 + ms) / 4 : ms;
+            h->answers++;
+            h->silent = 0;
+        } else {
+            h->answers = 0;
+            h->silent++;
+        }
+        if (seq) h->last_seq = seq;
+        ewma = h->ewma_ms;
+    }
+    pthread_mutex_unlock(&g_hist_mx);
+    return ewma;
+}
+
+// Adaptive scans wait longer for hosts known to answer slowly (up to four
+// times the usual /health timeout) before counting them as silent.
+static int history_timeout_ms(uint32_t a) {
+    int t = g_tun.health_timeout_ms;
+    if (!g_cfg.adaptive) return t;
+    pthread_mutex_lock(&g_hist_mx);
+    scan_history_t *h = history_slot(a, 0);
+    if (h && h->ewma_ms > 0) {
+        int want = (int)(h->ewma_ms * 2) + 50;
+        if (want > 4 * t) want = 4 * t;
+        if (want > t) t = want;
+    }
+    pthread_mutex_unlock(&g_hist_mx);
+    return t;
+}
+
+static uint32_t ip_to_addr(const char *ip) {
+    struct in_addr ia;
+    return inet_pton(AF_INET, ip, &ia) == 1 ? ntohl(ia.s_addr) : 0;
+}
+
 // ================ Public API ================
 
 void scan_init(void) { /* nop */ }
@@ -218,6 +354,8 @@ void scan_get_status(scan_status_t *st) {
     st->progress_pct  = progress_pct();
     st->last_started  = g_last_started;
     st->last_finished = g_last_finished;
+    st->skipped       = g_scan_skipped;
+    st->deferred      = g_scan_deferred;
 }
 
 int scan_get_nodes(scan_node_t *dst, int max) {
@@ -230,12 +368,21 @@ int scan_get_nodes(scan_node_t *dst, int max) {
     return n;
 }
 
-int scan_probe_node(const char *ip, int port) {
+unsigned long scan_nodes_version(void) {
+    pthread_mutex_lock(&g_nodes_mx);
+    unsigned long v = g_nodes_version;
+    pthread_mutex_unlock(&g_nodes_mx);
+    return v;
+}
+
+static int probe_node(const char *ip, int port, int filtered) {
     if (!ip || !*ip || port <= 0 || port > 65535) return -1;
 
     char resp[8192];
-    int health = http_get_simple(ip, port, "/health", resp, sizeof(resp),
-                                 g_tun.health_timeout_ms);
+    uint32_t a = ip_to_addr(ip);
+    double t0 = mono_ms();
+    int health = http_get_simple(ip, port, "/health", resp, sizeof(resp), history_timeout_ms(a));
+    double rtt = history_record(a, health == 0, mono_ms() - t0, 0);
     if (health != 0) return -1;
 
     int caps = http_get_simple(ip, port, "/caps", resp, sizeof(resp),
@@ -266,11 +413,17 @@ int scan_probe_node(const char *ip, int port) {
         if (sync_id)   strncpy(ni.sync_id,   sync_id,   sizeof(ni.sync_id) - 1);
     }
     ni.last_seen = now_s();
-    nodes_upsert(&ni);
+    ni.probe_ms = rtt;
     json_value_free(v);
+    if (filtered && !nodes_admit(&ni)) return -1;
+    nodes_upsert(&ni);
     return 0;
 }
 
+int scan_probe_node(const char *ip, int port) { return probe_node(ip, port, 1); }
+
+int scan_refresh_node(const char *ip, int port) { return probe_node(ip, port, 0); }
+
 // ================ Target planning helpers ================
 
 typedef struct { uint32_t *ips; unsigned n, cap; } ipvec_t;
@@ -376,7 +529,9 @@ static void probe_and_maybe_add(uint32_t a, int port) {
     char resp[8192];
 
     // Quick: /health (allows super short timeout to skip dead hosts fast)
-    int r = http_get_simple(tip, port, "/health", resp, sizeof(resp), g_tun.health_timeout_ms);
+    double t0 = mono_ms();
+    int r = http_get_simple(tip, port, "/health", resp, sizeof(resp), history_timeout_ms(a));
+    double rtt = history_record(a, r == 0, mono_ms() - t0, g_scan_seq);
     if (r != 0) { __sync_add_and_fetch(&g_scan_done, 1); return; }
 
     // Detail: /caps
@@ -404,9 +559,10 @@ static void probe_and_maybe_add(uint32_t a, int port) {
                     if (sync_id)   strncpy(ni.sync_id,   sync_id,   sizeof(ni.sync_id) - 1);
                 }
                 ni.last_seen = now_s();
+                ni.probe_ms = rtt;
                 ni.seen_scan = g_scan_seq;
                 // keep is_self=0 by default
-                nodes_upsert(&ni);
+                if (nodes_admit(&ni)) nodes_upsert(&ni);
                 json_value_free(v);
             }
         }
@@ -426,13 +582,38 @@ static void *worker_fn(void *arg) {
 
 // ================ Scan thread ================
 
-typedef struct { scan_config_t cfg; } scan_ctx_t;
+typedef struct {
+    scan_config_t cfg;
+    int subnet; // index into cfg.extra_subnets for a scheduled probe, -1 = full sweep
+} scan_ctx_t;
+
+static int is_excluded(const scan_config_t *cfg, uint32_t a) {
+    for (unsigned i = 0; i < cfg->exclude_count && i < SCAN_MAX_EXCLUDES; i++) {
+        if ((a & cfg->excludes[i].netmask) == cfg->excludes[i].network) return 1;
+    }
+    return 0;
+}
 
-static void plan_targets(ipvec_t *vec, const scan_config_t *cfg, uint32_t *self_a_out) {
+static void drop_excluded(ipvec_t *vec, const scan_config_t *cfg) {
+    unsigned w = 0;
+    for (unsigned i = 0; i < vec->n; i++) {
+        if (!is_excluded(cfg, vec->ips[i])) vec->ips[w++] = vec->ips[i];
+    }
+    vec->n = w;
+}
+
+static void plan_targets(ipvec_t *vec, const scan_config_t *cfg, int subnet, uint32_t *self_a_out) {
     // capacity: keep a hard cap to avoid runaway time
     // We reuse vec->cap set by caller; aim for <= 2048 targets total.
     *self_a_out = 0;
 
+    if (subnet >= 0) {
+        add_subnet_walk_raw(vec, cfg->extra_subnets[subnet].network,
+                            cfg->extra_subnets[subnet].netmask, 0);
+        drop_excluded(vec, cfg);
+        return;
+    }
+
     struct ifaddrs *ifaddr;
     if (getifaddrs(&ifaddr) != 0) return;
 
@@ -466,6 +647,68 @@ static void plan_targets(ipvec_t *vec, const scan_config_t *cfg, uint32_t *self_
             add_subnet_walk_raw(vec, net, mask, self_a);
         }
     }
+    drop_excluded(vec, cfg);
+}
+
+typedef struct {
+    uint32_t a;
+    int      klass;  // 0 answering, 1 never probed, 2 silent, 3 steady and not due
+    double   key;    // order within the class
+    unsigned idx;    // planned position, to keep ties in planning order
+} scan_pick_t;
+
+static int pick_cmp(const void *x, const void *y) {
+    const scan_pick_t *p = (const scan_pick_t*)x, *q = (const scan_pick_t*)y;
+    if (p->klass != q->klass) return p->klass - q->klass;
+    if (p->key != q->key) return p->key < q->key ? -1 : 1;
+    return p->idx < q->idx ? -1 : p->idx > q->idx;
+}
+
+// Adaptive scans probe hosts that answer first, fastest first, then
+// addresses never probed, then silent ones, longest unprobed first. A steady
+// host is only probed every stable_every scans and stays cached in between;
+// a silent address backs off to every SCAN_MAX_BACKOFF scans; probe_budget
+// cuts the tail.
+static void adapt_targets(ipvec_t *vec, const scan_config_t *cfg, unsigned seq,
+                          unsigned *skipped, unsigned *deferred) {
+    *skipped = 0;
+    *deferred = 0;
+    if (!cfg->adaptive || vec->n == 0) return;
+    scan_pick_t *picks = (scan_pick_t*)malloc(vec->n * sizeof(*picks));
+    if (!picks) return;
+    unsigned every = cfg->stable_every ? cfg->stable_every : 1;
+    unsigned n = 0;
+    pthread_mutex_lock(&g_hist_mx);
+    for (unsigned i = 0; i < vec->n; i++) {
+        scan_history_t *h = history_slot(vec->ips[i], 0);
+        unsigned since = h && h->last_seq ? seq - h->last_seq : UINT_MAX;
+        scan_pick_t p = { .a = vec->ips[i], .klass = 1, .key = 0, .idx = i };
+        if (h && h->answers) {
+            p.klass = h->answers >= SCAN_STABLE_ANSWERS && since < every ? 3 : 0;
+            p.key = h->ewma_ms;
+        } else if (h && h->silent) {
+            unsigned wait = h->silent >= 4 ? SCAN_MAX_BACKOFF : 1u << (h->silent - 1);
+            if (since < wait) { (*deferred)++; continue; }
+            p.klass = 2;
+            p.key = -(double)since;
+        }
+        picks[n++] = p;
+    }
+    pthread_mutex_unlock(&g_hist_mx);
+
+    qsort(picks, n, sizeof(*picks), pick_cmp);
+    unsigned probe = 0;
+    while (probe < n && picks[probe].klass < 3) probe++;
+    *skipped = n - probe;
+    if (cfg->probe_budget && probe > cfg->probe_budget) {
+        *deferred += probe - cfg->probe_budget;
+        probe = cfg->probe_budget;
+    }
+    // Known nodes left out of this scan stay cached until they are probed.
+    for (unsigned i = probe; i < n; i++) nodes_mark_seen(picks[i].a, seq);
+    for (unsigned i = 0; i < probe; i++) vec->ips[i] = picks[i].a;
+    vec->n = probe;
+    free(picks);
 }
 
 static void *scan_thread(void *arg) {
@@ -480,7 +723,11 @@ static void *scan_thread(void *arg) {
     uint32_t targets_buf[2048];
     ipvec_t targets; ipvec_init(&targets, targets_buf, (unsigned)(sizeof(targets_buf)/sizeof(targets_buf[0])));
     uint32_t self_a = 0;
-    plan_targets(&targets, &sc->cfg, &self_a);
+    plan_targets(&targets, &sc->cfg, sc->subnet, &self_a);
+    unsigned skipped = 0, deferred = 0;
+    adapt_targets(&targets, &sc->cfg, seq, &skipped, &deferred);
+    __sync_lock_test_and_set(&g_scan_skipped, skipped);
+    __sync_lock_test_and_set(&g_scan_deferred, deferred);
 
     // publish totals
     __sync_lock_test_and_set(&g_scan_total, targets.n);
@@ -506,7 +753,12 @@ static void *scan_thread(void *arg) {
     }
 
     // Prune stales (nodes not seen in this seq)
-    nodes_prune_after_scan(seq);
+    if (sc->subnet >= 0) {
+        nodes_prune_after_scan(seq, sc->cfg.extra_subnets[sc->subnet].network,
+                               sc->cfg.extra_subnets[sc->subnet].netmask);
+    } else {
+        nodes_prune_after_scan(seq, 0, 0);
+    }
 
     g_last_finished = now_s();
     __sync_lock_release(&g_scan_in_progress);
@@ -514,7 +766,7 @@ static void *scan_thread(void *arg) {
     return NULL;
 }
 
-int scan_start_async(const scan_config_t *cfg) {
+static int start_scan(const scan_config_t *cfg, int subnet) {
     if (!cfg) return -1;
     g_cfg = *cfg;
     if (!__sync_bool_compare_and_swap(&g_scan_in_progress, 0, 1)) {
@@ -528,6 +780,7 @@ int scan_start_async(const scan_config_t *cfg) {
         return -1;
     }
     sc->cfg = *cfg;
+    sc->subnet = subnet;
     if (pthread_create(&th, NULL, scan_thread, sc) == 0) {
         pthread_detach(th);
         return 0;
@@ -536,3 +789,51 @@ int scan_start_async(const scan_config_t *cfg) {
     __sync_lock_release(&g_scan_in_progress);
     return -1;
 }
+
+int scan_start_async(const scan_config_t *cfg) {
+    return start_scan(cfg, -1);
+}
+
+// ================ Per-subnet schedule ================
+
+static void *schedule_thread(void *arg) {
+    scan_config_t *cfg = (scan_config_t*)arg;
+    double due[SCAN_MAX_EXTRA_SUBNETS];
+    double t0 = now_s();
+    // The first full sweep covers every subnet, so start counting from now.
+    for (unsigned i = 0; i < cfg->extra_subnet_count; i++) {
+        due[i] = t0 + cfg->extra_subnets[i].interval_s;
+    }
+    for (;;) {
+        sleep(1);
+        double t = now_s();
+        for (unsigned i = 0; i < cfg->extra_subnet_count; i++) {
+            if (!cfg->extra_subnets[i].interval_s || t < due[i]) continue;
+            // Busy with another scan: try again next tick.
+            if (start_scan(cfg, (int)i) == 1) break;
+            due[i] = t + cfg->extra_subnets[i].interval_s;
+            break;
+        }
+    }
+    return NULL;
+}
+
+int scan_schedule_start(const scan_config_t *cfg) {
+    if (!cfg) return -1;
+    int scheduled = 0;
+    for (unsigned i = 0; i < cfg->extra_subnet_count && i < SCAN_MAX_EXTRA_SUBNETS; i++) {
+        if (cfg->extra_subnets[i].interval_s) scheduled++;
+    }
+    if (!scheduled) return 0;
+    scan_config_t *copy = (scan_config_t*)malloc(sizeof(*copy));
+    if (!copy) return -1;
+    *copy = *cfg;
+    if (copy->extra_subnet_count > SCAN_MAX_EXTRA_SUBNETS) copy->extra_subnet_count = SCAN_MAX_EXTRA_SUBNETS;
+    pthread_t th;
+    if (pthread_create(&th, NULL, schedule_thread, copy) != 0) {
+        free(copy);
+        return -1;
+    }
+    pthread_detach(th);
+    return 0;
+}
@@ -24,6 +24,7 @@ typedef struct {
     unsigned is_self;   // 1 if local interface; never pruned
     char    sync_role[16];
     char    sync_id[64];
+    double  probe_ms;   // smoothed /health round trip (0 = not probed yet)
 } scan_node_t;
 
 typedef struct {
@@ -33,15 +34,22 @@ typedef struct {
     int      progress_pct;    // 0..100
     double   last_started;    // time(NULL) or 0
     double   last_finished;   // time(NULL) or 0
+    unsigned skipped;         // adaptive: steady known hosts not due this scan
+    unsigned deferred;        // adaptive: silent addresses backed off or over the budget
 } scan_status_t;
 
 #ifndef SCAN_MAX_EXTRA_SUBNETS
 #define SCAN_MAX_EXTRA_SUBNETS 16
 #endif
 
+#ifndef SCAN_MAX_EXCLUDES
+#define SCAN_MAX_EXCLUDES 16
+#endif
+
 typedef struct {
-    uint32_t network; // host-order IPv4 network address
-    uint32_t netmask; // host-order IPv4 netmask
+    uint32_t network;    // host-order IPv4 network address
+    uint32_t netmask;    // host-order IPv4 netmask
+    unsigned interval_s; // 0 = full sweeps only; else also probed alone every interval_s
 } scan_extra_subnet_t;
 
 typedef struct {
@@ -53,6 +61,11 @@ typedef struct {
     char sync_id[64];
     scan_extra_subnet_t extra_subnets[SCAN_MAX_EXTRA_SUBNETS];
     unsigned            extra_subnet_count;
+    scan_extra_subnet_t excludes[SCAN_MAX_EXCLUDES]; // never probed by sweeps
+    unsigned            exclude_count;
+    unsigned adaptive;      // order and thin sweeps by each address's probe history
+    unsigned probe_budget;  // adaptive: most probes per scan (0 = no cap)
+    unsigned stable_every;  // adaptive: probe a steadily answering host every Nth scan
 } scan_config_t;
 
 // Optional tuning (call once at startup if you want to override defaults)
@@ -82,6 +95,11 @@ void scan_seed_self_nodes(const scan_config_t *cfg);
 // Returns: 0 = started, 1 = already running, -1 = error.
 int  scan_start_async(const scan_config_t *cfg);
 
+// Start a background thread that probes each extra subnet with an interval_s
+// on its own, between full sweeps. Returns 0 when started (or nothing is
+// scheduled), -1 on error.
+int  scan_schedule_start(const scan_config_t *cfg);
+
 // Is a scan currently running? (1/0)
 int  scan_is_running(void);
 
@@ -91,10 +109,23 @@ void scan_get_status(scan_status_t *st);
 // Copy up to max nodes into dst; returns count copied.
 int  scan_get_nodes(scan_node_t *dst, int max);
 
+// Monotonic counter bumped whenever the node cache changes.
+unsigned long scan_nodes_version(void);
+
+// Optional admission hook asked before a probed node enters or refreshes the
+// cache (self nodes skip it). known = already cached, cached = non-self nodes
+// in the cache. Return 0 to admit; a refused node ages out like a silent one.
+typedef int (*scan_filter_fn)(const scan_node_t *n, int known, int cached, void *ud);
+void scan_set_filter(scan_filter_fn fn, void *ud);
+
 // Probe a specific host:port once and refresh the node cache if it responds.
 // Returns 0 on success, non-zero on failure.
 int  scan_probe_node(const char *ip, int port);
 
+// Same, for a node already admitted elsewhere (a sync registration): the
+// filter hook is not asked, so callers may hold locks the hook takes.
+int  scan_refresh_node(const char *ip, int port);
+
 #ifdef __cplusplus
 }
 #endif
@@ -0,0 +1,345 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+
+#include "parson.h"
+#include "autod.h"
+#include "caller.h"
+#include "catalog.h"
+#include "jobs.h"
+#include "sshexec.h"
+
+#define SSHEXEC_DEFAULT_CONNECT_TIMEOUT_S 5
+#define SSHEXEC_FAILED_RC 255   /* what the OpenSSH client exits with on its own errors */
+
+/* ---------- Config ---------- */
+
+void sshexec_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->ssh, 0, sizeof(cfg->ssh));
+    snprintf(cfg->ssh.binary, sizeof(cfg->ssh.binary), "ssh");
+    cfg->ssh.connect_timeout_s = SSHEXEC_DEFAULT_CONNECT_TIMEOUT_S;
+    cfg->ssh.strict_host_keys = 1;
+}
+
+int sshexec_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (strcmp(section, "ssh") != 0) return 0;
+    if (!strcmp(key, "binary")) {
+        if (*value) snprintf(cfg->ssh.binary, sizeof(cfg->ssh.binary), "%s", value);
+    } else if (!strcmp(key, "identity_file")) {
+        snprintf(cfg->ssh.identity_file, sizeof(cfg->ssh.identity_file), "%s", value);
+    } else if (!strcmp(key, "known_hosts_file")) {
+        snprintf(cfg->ssh.known_hosts_file, sizeof(cfg->ssh.known_hosts_file), "%s", value);
+    } else if (!strcmp(key, "connect_timeout_s")) {
+        int v = atoi(value);
+        if (v >= 1) cfg->ssh.connect_timeout_s = v;
+        else fprintf(stderr, "WARN: ignoring ssh connect_timeout_s %s (minimum 1)\n", value);
+    } else if (!strcmp(key, "strict_host_keys")) {
+        cfg->ssh.strict_host_keys = atoi(value) ? 1 : 0;
+    } else {
+        fprintf(stderr, "WARN: ignoring unknown ssh key '%s'\n", key);
+    }
+    return 1;
+}
+
+/* ---------- Targets ---------- */
+
+int sshexec_parse_target(const char *target, char *user, size_t user_sz,
+                         char *host, size_t host_sz, int *port) {
+    if (!target || strncmp(target, "ssh://", 6) != 0) return -1;
+    const char *p = target + 6;
+    const char *at = strchr(p, '@');
+    if (!at || at == p || (size_t)(at - p) >= user_sz) return -1;
+    const char *h = at + 1;
+    const char *colon = strchr(h, ':');
+    size_t hlen = colon ? (size_t)(colon - h) : strlen(h);
+    if (hlen == 0 || hlen >= host_sz) return -1;
+    *port = 22;
+    if (colon) {
+        char *end = NULL;
+        long v = strtol(colon + 1, &end, 10);
+        if (end == colon + 1 || *end != '\0' || v < 1 || v > 65535) return -1;
+        *port = (int)v;
+    }
+    memcpy(user, p, (size_t)(at - p));
+    user[at - p] = '\0';
+    memcpy(host, h, hlen);
+    host[hlen] = '\0';
+    /* Neither may be taken for an ssh option, nor carry a path or spaces. */
+    if (user[0] == '-' || host[0] == '-') return -1;
+    if (strpbrk(user, " \t/:@") || strpbrk(host, " \t/@")) return -1;
+    return 0;
+}
+
+/* ---------- Running ---------- */
+
+/* Append w to buf single-quoted for the remote shell. */
+static int sshexec_quote(char **buf, size_t *len, size_t *cap, const char *w) {
+    size_t need = *len + 3 + strlen(w) * 4 + 1;
+    if (need > *cap) {
+        size_t ncap = need * 2;
+        char *nb = realloc(*buf, ncap);
+        if (!nb) return -1;
+        *buf = nb;
+        *cap = ncap;
+    }
+    char *o = *buf + *len;
+    *o++ = '\'';
+    for (const char *p = w; *p; p++) {
+        if (*p == '\'') { memcpy(o, "'\\''", 4); o += 4; }
+        else *o++ = *p;
+    }
+    *o++ = '\'';
+    *o = '\0';
+    *len = (size_t)(o - *buf);
+    return 0;
+}
+
+static int sshexec_append(char **buf, size_t *len, size_t *cap, const char *s) {
+    size_t n = strlen(s);
+    if (*len + n + 1 > *cap) {
+        size_t ncap = (*len + n + 1) * 2;
+        char *nb = realloc(*buf, ncap);
+        if (!nb) return -1;
+        *buf = nb;
+        *cap = ncap;
+    }
+    memcpy(*buf + *len, s, n + 1);
+    *len += n;
+    return 0;
+}
+
+/* The command line the remote shell runs: who asked for it, the way
+ * caller_export_env() tells a local handler, the request's env, then the
+ * quoted words. */
+static char *sshexec_remote_command(const char *path, JSON_Array *args, JSON_Object *env) {
+    char *buf = NULL;
+    size_t len = 0, cap = 0;
+    const char *name = caller_name();
+    int bad = sshexec_append(&buf, &len, &cap, "AUTOD_CALLER=") ||
+              sshexec_quote(&buf, &len, &cap, name ? name : "") ||
+              sshexec_append(&buf, &len, &cap, " AUTOD_CALLER_ROLE=") ||
+              sshexec_quote(&buf, &len, &cap, caller_role());
+    for (size_t i = 0; i < json_object_get_count(env) && !bad; i++) {
+        /* Names were checked by exec_context_check; only values need quoting. */
+        bad = sshexec_append(&buf, &len, &cap, " ") ||
+              sshexec_append(&buf, &len, &cap, json_object_get_name(env, i)) ||
+              sshexec_append(&buf, &len, &cap, "=") ||
+              sshexec_quote(&buf, &len, &cap, json_string(json_object_get_value_at(env, i)));
+    }
+    bad = bad || sshexec_append(&buf, &len, &cap, " ") ||
+          sshexec_quote(&buf, &len, &cap, path);
+    size_t narg = json_array_get_count(args);
+    for (size_t i = 0; i < narg && !bad; i++) {
+        bad = sshexec_append(&buf, &len, &cap, " ") ||
+              sshexec_quote(&buf, &len, &cap, json_array_get_string(args, i));
+    }
+    if (bad) {
+        free(buf);
+        return NULL;
+    }
+    return buf;
+}
+
+static JSON_Value *sshexec_error(int code, const char *error, int *status) {
+    JSON_Value *v = json_value_init_object();
+    json_object_set_string(json_object(v), "error", error);
+    *status = code;
+    return v;
+}
+
+/* Drop the trailing newline ssh puts after its own messages. */
+static void sshexec_detail(JSON_Object *o, const char *err, size_t err_len) {
+    while (err_len > 0 && (err[err_len - 1] == '\n' || err[err_len - 1] == '\r')) err_len--;
+    if (err_len == 0) return;
+    char *s = malloc(err_len + 1);
+    if (!s) return;
+    memcpy(s, err, err_len);
+    s[err_len] = '\0';
+    json_object_set_string(o, "detail", s);
+    free(s);
+}
+
+JSON_Value *sshexec_run(const config_t *cfg, int slot_index, const char *body,
+                        int timeout_ms, const char *requester, int *status) {
+    const sync_slot_config_t *sc = &cfg->sync_slots[slot_index];
+    char user[64], host[128];
+    int port = 0;
+    if (sshexec_parse_target(sc->ssh, user, sizeof(user), host, sizeof(host), &port) != 0) {
+        JSON_Value *v = sshexec_error(500, "invalid_ssh_target", status);
+        json_object_set_string(json_object(v), "ssh", sc->ssh);
+        return v;
+    }
+
+    JSON_Value *root = json_parse_string(body ? body : "{}");
+    JSON_Object *o = json_object(root);
+    if (!o) {
+        if (root) json_value_free(root);
+        return sshexec_error(400, "bad_json", status);
+    }
+    const char *path = json_object_get_string(o, "path");
+    if (!path || !*path) {
+        json_value_free(root);
+        return sshexec_error(400, "missing_path", status);
+    }
+    JSON_Value *args_v = json_object_get_value(o, "args");
+    JSON_Array *args = json_array(args_v);
+    if (args_v && !args) {
+        json_value_free(root);
+        return sshexec_error(400, "invalid_args", status);
+    }
+    for (size_t i = 0; i < json_array_get_count(args); i++) {
+        if (!json_array_get_string(args, i)) {
+            json_value_free(root);
+            return sshexec_error(400, "invalid_args", status);
+        }
+    }
+    int force_b64 = 0;
+    const char *encoding = json_object_get_string(o, "output_encoding");
+    if (encoding && *encoding) {
+        if (!strcasecmp(encoding, "base64")) {
+            force_b64 = 1;
+        } else if (strcasecmp(encoding, "utf8") && strcasecmp(encoding, "utf-8")) {
+            json_value_free(root);
+            return sshexec_error(400, "bad_output_encoding", status);
+        }
+    }
+    int own_ms = 0;
+    if (exec_timeout_field(o, "exec_timeout_ms", &own_ms) != 0) {
+        json_value_free(root);
+        return sshexec_error(400, "invalid_timeout", status);
+    }
+    if (!catalog_allows(cfg, path)) {
+        JSON_Value *v = sshexec_error(403, "command_not_allowed", status);
+        json_object_set_string(json_object(v), "path", path);
+        json_value_free(root);
+        return v;
+    }
+    if (timeout_ms <= 0 || timeout_ms > cfg->exec_timeout_ms) timeout_ms = cfg->exec_timeout_ms;
+    if (own_ms > 0 && own_ms < timeout_ms) timeout_ms = own_ms;
+
+    /* The slot's env and params come under the request's own. */
+    (void)sync_slot_exec_context(cfg, slot_index, o);
+    JSON_Value *filled_args = NULL;
+    const char *context_err = exec_context_check(o, args, &filled_args);
+    if (context_err) {
+        json_value_free(root);
+        return sshexec_error(400, context_err, status);
+    }
+    if (filled_args) {
+        json_object_set_value(o, "args", filled_args);
+        args = json_object_get_array(o, "args");
+    }
+    char *remote = sshexec_remote_command(path, args, json_object_get_object(o, "env"));
+    if (!remote) {
+        json_value_free(root);
+        return sshexec_error(500, "oom", status);
+    }
+    const char *identity = sc->ssh_identity[0] ? sc->ssh_identity : cfg->ssh.identity_file;
+    char opt_connect[32], opt_strict[48], opt_known[300], portbuf[8];
+    snprintf(opt_connect, sizeof(opt_connect), "ConnectTimeout=%d", cfg->ssh.connect_timeout_s);
+    snprintf(opt_strict, sizeof(opt_strict), "StrictHostKeyChecking=%s",
+             cfg->ssh.strict_host_keys ? "yes" : "accept-new");
+    snprintf(opt_known, sizeof(opt_known), "UserKnownHostsFile=%s", cfg->ssh.known_hosts_file);
+    snprintf(portbuf, sizeof(portbuf), "%d", port);
+
+    /* Key authentication only: BatchMode never waits for a password. */
+    JSON_Value *argv_v = json_value_init_array();
+    JSON_Array *argv = json_array(argv_v);
+    json_array_append_string(argv, "-o");
+    json_array_append_string(argv, "BatchMode=yes");
+    json_array_append_string(argv, "-o");
+    json_array_append_string(argv, opt_connect);
+    json_array_append_string(argv, "-o");
+    json_array_append_string(argv, opt_strict);
+    if (cfg->ssh.known_hosts_file[0]) {
+        json_array_append_string(argv, "-o");
+        json_array_append_string(argv, opt_known);
+    }
+    if (identity[0]) {
+        json_array_append_string(argv, "-i");
+        json_array_append_string(argv, identity);
+        json_array_append_string(argv, "-o");
+        json_array_append_string(argv, "IdentitiesOnly=yes");
+    }
+    json_array_append_string(argv, "-p");
+    json_array_append_string(argv, portbuf);
+    json_array_append_string(argv, "-l");
+    json_array_append_string(argv, user);
+    json_array_append_string(argv, "--");
+    json_array_append_string(argv, host);
+    json_array_append_string(argv, remote);
+    free(remote);
+
+    /* The client is always run directly, whatever [exec] mode says. */
+    config_t *run_cfg = malloc(sizeof(*run_cfg));
+    if (!run_cfg) {
+        json_value_free(argv_v);
+        json_value_free(root);
+        return sshexec_error(500, "oom", status);
+    }
+    memcpy(run_cfg, cfg, sizeof(*run_cfg));
+    snprintf(run_cfg->exec_mode, sizeof(run_cfg->exec_mode), "argv");
+    run_cfg->exec_shell_fallback = 0;
+
+    const char *request_id = json_object_get_string(o, "request_id");
+    if (!request_id || !*request_id) request_id = api_request_id();
+    int rc = 0;
+    long long elapsed = 0;
+    char *out = NULL, *err = NULL;
+    size_t out_len = 0, err_len = 0;
+    exec_usage_t usage;
+    int exec_r = run_exec(run_cfg, cfg->ssh.binary, argv, timeout_ms, cfg->max_output_bytes,
+                          NULL, request_id, &rc, &elapsed, &out, &err, &out_len, &err_len,
+                          &usage);
+    free(run_cfg);
+
+    jobs_record_t jr = {
+        .node = sc->ssh, .source = "ssh", .requester = requester,
+        .caller = caller_name(), .caller_role = caller_role(),
+        .request_id = request_id, .path = path, .args = args, .job_id = usage.job_id,
+        .spawned = exec_r == 0, .canceled = exec_r == 0 && usage.canceled,
+        .rc = rc, .elapsed_ms = elapsed,
+        .out = out, .out_len = out_len, .err = err, .err_len = err_len
+    };
+    jobs_store_record(&jr);
+    json_value_free(argv_v);
+
+    JSON_Value *resp;
+    if (exec_r == EXEC_ERR_NOT_FOUND) {
+        resp = sshexec_error(500, "ssh_not_found", status);
+        json_object_set_string(json_object(resp), "binary", cfg->ssh.binary);
+    } else if (exec_r == EXEC_ERR_CAPACITY) {
+        resp = sshexec_error(503, "jobs_full", status);
+    } else if (exec_r == EXEC_ERR_INTEGRITY) {
+        resp = sshexec_error(403, "integrity_mismatch", status);
+    } else if (exec_r != 0) {
+        resp = sshexec_error(500, "exec_failed", status);
+    } else if (rc == SSHEXEC_FAILED_RC && !usage.timed_out && !usage.canceled) {
+        resp = sshexec_error(502, "node_unreachable", status);
+        json_object_set_string(json_object(resp), "ssh", sc->ssh);
+        sshexec_detail(json_object(resp), err, err_len);
+    } else {
+        resp = json_value_init_object();
+        JSON_Object *or = json_object(resp);
+        json_object_set_number(or, "rc", rc);
+        json_object_set_number(or, "elapsed_ms", (double)elapsed);
+        exec_set_usage(or, &usage);
+        json_object_set_string(or, "ssh", sc->ssh);
+        if (exec_set_output(or, "stdout", out, out_len, force_b64) != 0 ||
+            exec_set_output(or, "stderr", err, err_len, force_b64) != 0) {
+            json_value_free(resp);
+            resp = sshexec_error(500, "encode_failed", status);
+        } else {
+            *status = 200;
+        }
+    }
+    fprintf(stderr, "ssh: %s %s on slot %d -> rc %d (%lld ms)\n",
+            sc->ssh, path, slot_index + 1, rc, elapsed);
+    free(out);
+    free(err);
+    json_value_free(root);
+    return resp;
+}
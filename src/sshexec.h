@@ -0,0 +1,39 @@
+#ifndef AUTOD_SSHEXEC_H
+#define AUTOD_SSHEXEC_H
+
+#include <stddef.h>
+
+#include "parson.h"
+
+/* Agentless slots: a [sync.slotN] with ssh = ssh://user@host[:port] is held
+ * by a machine that cannot run autod. The master runs /exec bodies for it
+ * through the OpenSSH client (batch mode, key authentication only) and
+ * answers like /exec would; such a slot is never given to a slave. */
+typedef struct {
+    char binary[128];             /* ssh client (default "ssh", looked up on [exec] path) */
+    char identity_file[256];      /* key for slots without ssh_identity (empty = the client's) */
+    char known_hosts_file[256];   /* empty = the client's default */
+    int  connect_timeout_s;       /* default 5 */
+    int  strict_host_keys;        /* 1 = refuse unknown host keys (default), 0 = learn them */
+} sshexec_config_t;
+
+typedef struct config config_t;
+
+void sshexec_cfg_defaults(config_t *cfg);
+int sshexec_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* Split "ssh://user@host[:port]". Returns 0, or -1 when it is not one. */
+int sshexec_parse_target(const char *target, char *user, size_t user_sz,
+                         char *host, size_t host_sz, int *port);
+
+/* Run the /exec body on slot_index's ssh target for at most timeout_ms
+ * (0 = [exec] timeout_ms; the body's exec_timeout_ms may shorten it) and
+ * record it in the job history with requester as who asked. Returns the
+ * reply and sets *status: 200 with rc, elapsed_ms, job_id, usage, stdout and
+ * stderr as /exec gives them; 400 for a bad body; 403 command_not_allowed;
+ * 502 node_unreachable when the client itself failed (rc 255); 500 when the
+ * client could not be run. */
+JSON_Value *sshexec_run(const config_t *cfg, int slot_index, const char *body,
+                        int timeout_ms, const char *requester, int *status);
+
+#endif
@@ -0,0 +1,547 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <signal.h>
+#include <stdint.h>
+#include <time.h>
+#include <unistd.h>
+#include <pthread.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "httpc.h"
+#include "svcpub.h"
+
+extern volatile sig_atomic_t g_stop;
+
+#define SVCPUB_TIMEOUT_MS 5000
+#define SVCPUB_RETRY_MS 10000
+
+/* What was last written for one node, so only changes go out between full
+ * resyncs. */
+typedef struct {
+    char id[64];
+    uint64_t fingerprint;
+    int seen;
+} svcpub_entry_t;
+
+typedef struct {
+    svcpub_entry_t entries[SYNC_MAX_SLAVES];
+    int count;
+    long long last_full_ms;
+    long long retry_ms;
+    int cleaned;                  /* consul: leftovers of an earlier run removed */
+    char lease[32];               /* etcd lease the keys are bound to */
+    int reachable;                /* -1 unknown */
+    int published;
+    long long last_ok_unix;
+    char last_error[64];
+    char url[256];
+    char type[8];
+} svcpub_state_t;
+
+static pthread_mutex_t g_svcpub_lock = PTHREAD_MUTEX_INITIALIZER;
+static svcpub_state_t g_svcpub[SVCPUB_MAX_BACKENDS];
+static pthread_t g_svcpub_thread;
+static int g_svcpub_running;
+static int g_svcpub_stop;
+
+void svcpub_cfg_defaults(config_t *cfg) {
+    memset(&cfg->publish, 0, sizeof(cfg->publish));
+}
+
+int svcpub_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (strncmp(section, "publish.", 8) != 0) return 0;
+    const char *type = section + 8;
+    if (strcmp(type, "consul") != 0 && strcmp(type, "etcd") != 0) {
+        fprintf(stderr, "WARN: ignoring [%s] (publish backends are consul and etcd)\n", section);
+        return 1;
+    }
+    svcpub_config_t *pc = &cfg->publish;
+    svcpub_backend_t *b = NULL;
+    for (int i = 0; i < pc->backend_count; i++) {
+        if (!strcmp(pc->backends[i].type, type)) b = &pc->backends[i];
+    }
+    if (!b) {
+        if (pc->backend_count >= SVCPUB_MAX_BACKENDS) return 1;
+        b = &pc->backends[pc->backend_count++];
+        memset(b, 0, sizeof(*b));
+        snprintf(b->type, sizeof(b->type), "%s", type);
+        snprintf(b->service, sizeof(b->service), "autod");
+        snprintf(b->prefix, sizeof(b->prefix), "/autod/nodes/");
+        b->interval_s = 30;
+    }
+    if (!strcmp(key, "url")) {
+        http_url_t u;
+        if (httpc_parse_url(value, &u, "/") != 0) {
+            fprintf(stderr, "WARN: ignoring [%s] url '%s' (http:// only)\n", section, value);
+        } else {
+            snprintf(b->url, sizeof(b->url), "%s", value);
+        }
+    } else if (!strcmp(key, "token")) {
+        snprintf(b->token, sizeof(b->token), "%s", value);
+    } else if (!strcmp(key, "service")) {
+        snprintf(b->service, sizeof(b->service), "%s", value);
+    } else if (!strcmp(key, "tags")) {
+        snprintf(b->tags, sizeof(b->tags), "%s", value);
+    } else if (!strcmp(key, "prefix")) {
+        snprintf(b->prefix, sizeof(b->prefix), "%s", value);
+    } else if (!strcmp(key, "interval_s")) {
+        int v = atoi(value);
+        if (v > 0) b->interval_s = v;
+        else fprintf(stderr, "WARN: ignoring [%s] interval_s %s (must be positive)\n", section, value);
+    } else if (!strcmp(key, "ttl_s")) {
+        int v = atoi(value);
+        if (v >= 5) b->ttl_s = v;
+        else fprintf(stderr, "WARN: ignoring [%s] ttl_s %s (minimum 5)\n", section, value);
+    } else {
+        fprintf(stderr, "WARN: ignoring unknown [%s] key '%s'\n", section, key);
+    }
+    return 1;
+}
+
+static uint64_t svcpub_hash(const char *s) {
+    uint64_t h = 1469598103934665603ULL;
+    for (; *s; s++) {
+        h ^= (unsigned char)*s;
+        h *= 1099511628211ULL;
+    }
+    return h;
+}
+
+static const char *svcpub_status(const sync_node_addr_t *n) {
+    if (n->down) return "down";
+    if (n->quarantined) return "quarantined";
+    return "up";
+}
+
+/* Configured tags, then slot and role. */
+static JSON_Value *svcpub_tags(const svcpub_backend_t *b, const config_t *cfg,
+                               const sync_node_addr_t *n) {
+    JSON_Value *v = json_value_init_array();
+    JSON_Array *a = json_array(v);
+    char buf[sizeof(b->tags)];
+    snprintf(buf, sizeof(buf), "%s", b->tags);
+    char *save = NULL;
+    for (char *t = strtok_r(buf, ",", &save); t; t = strtok_r(NULL, ",", &save)) {
+        while (*t == ' ') t++;
+        size_t len = strlen(t);
+        while (len > 0 && t[len - 1] == ' ') t[--len] = '\0';
+        if (*t) json_array_append_string(a, t);
+    }
+    char tag[96];
+    if (n->slot > 0) {
+        snprintf(tag, sizeof(tag), "slot=%d", n->slot);
+        json_array_append_string(a, tag);
+        const char *name = cfg->sync_slots[n->slot - 1].name;
+        if (name[0]) {
+            snprintf(tag, sizeof(tag), "slot_name=%s", name);
+            json_array_append_string(a, tag);
+        }
+    }
+    if (n->role[0]) {
+        snprintf(tag, sizeof(tag), "role=%s", n->role);
+        json_array_append_string(a, tag);
+    }
+    return v;
+}
+
+static void svcpub_set_meta(JSON_Object *o, const config_t *cfg, const sync_node_addr_t *n) {
+    json_object_set_string(o, "autod_id", n->id);
+    json_object_set_string(o, "status", svcpub_status(n));
+    json_object_set_string(o, "transport", n->transport);
+    if (n->slot > 0) {
+        char slot[16];
+        snprintf(slot, sizeof(slot), "%d", n->slot);
+        json_object_set_string(o, "slot", slot);
+        if (cfg->sync_slots[n->slot - 1].name[0]) {
+            json_object_set_string(o, "slot_name", cfg->sync_slots[n->slot - 1].name);
+        }
+    }
+    if (n->device[0]) json_object_set_string(o, "device", n->device);
+    if (n->role[0]) json_object_set_string(o, "role", n->role);
+    if (n->version[0]) json_object_set_string(o, "version", n->version);
+}
+
+/* PUT /v1/catalog/register body: the node as an external Consul node with
+ * one service and a check reflecting its registry state. */
+static char *svcpub_consul_doc(const svcpub_backend_t *b, const config_t *cfg,
+                               const sync_node_addr_t *n) {
+    char svc_id[160];
+    snprintf(svc_id, sizeof(svc_id), "%s-%s", b->service, n->id);
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "Node", n->id);
+    json_object_set_string(o, "Address", n->host);
+    json_object_dotset_string(o, "NodeMeta.external-node", "true");
+    json_object_dotset_string(o, "NodeMeta.external-probe", "false");
+    json_object_dotset_string(o, "NodeMeta.autod-master", cfg->sync_id);
+
+    JSON_Value *sv = json_value_init_object();
+    JSON_Object *so = json_object(sv);
+    json_object_set_string(so, "ID", svc_id);
+    json_object_set_string(so, "Service", b->service);
+    json_object_set_value(so, "Tags", svcpub_tags(b, cfg, n));
+    json_object_set_string(so, "Address", n->host);
+    json_object_set_number(so, "Port", n->port);
+    JSON_Value *mv = json_value_init_object();
+    svcpub_set_meta(json_object(mv), cfg, n);
+    json_object_set_value(so, "Meta", mv);
+    json_object_set_value(o, "Service", sv);
+
+    JSON_Value *cv = json_value_init_object();
+    JSON_Object *co = json_object(cv);
+    char check_id[176];
+    snprintf(check_id, sizeof(check_id), "autod:%s", svc_id);
+    json_object_set_string(co, "Node", n->id);
+    json_object_set_string(co, "CheckID", check_id);
+    json_object_set_string(co, "Name", "autod registry");
+    json_object_set_string(co, "ServiceID", svc_id);
+    json_object_set_string(co, "Status", n->down ? "critical" : n->quarantined ? "warning" : "passing");
+    json_object_set_string(co, "Output", svcpub_status(n));
+    json_object_set_value(o, "Check", cv);
+
+    char *ser = json_serialize_to_string(v);
+    json_value_free(v);
+    return ser;
+}
+
+/* The etcd value: the node as plain JSON. */
+static char *svcpub_etcd_doc(const svcpub_backend_t *b, const config_t *cfg,
+                             const sync_node_addr_t *n) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "id", n->id);
+    json_object_set_string(o, "address", n->host);
+    json_object_set_number(o, "port", n->port);
+    if (n->slot > 0) json_object_set_number(o, "slot", n->slot);
+    if (n->slot > 0 && cfg->sync_slots[n->slot - 1].name[0]) {
+        json_object_set_string(o, "slot_name", cfg->sync_slots[n->slot - 1].name);
+    }
+    json_object_set_string(o, "status", svcpub_status(n));
+    json_object_set_string(o, "transport", n->transport);
+    if (n->device[0]) json_object_set_string(o, "device", n->device);
+    if (n->role[0]) json_object_set_string(o, "role", n->role);
+    if (n->version[0]) json_object_set_string(o, "version", n->version);
+    json_object_set_value(o, "tags", svcpub_tags(b, cfg, n));
+    json_object_set_string(o, "master", cfg->sync_id);
+    char *ser = json_serialize_to_string(v);
+    json_value_free(v);
+    return ser;
+}
+
+static void svcpub_auth_header(const svcpub_backend_t *b, char *out, size_t out_sz) {
+    out[0] = '\0';
+    if (!b->token[0]) return;
+    if (!strcmp(b->type, "consul")) snprintf(out, out_sz, "X-Consul-Token: %s\r\n", b->token);
+    else snprintf(out, out_sz, "Authorization: %s\r\n", b->token);
+}
+
+/* method + base URL + path. Returns the HTTP status, -1 on transport errors. */
+static int svcpub_call(const svcpub_backend_t *b, const char *method, const char *path,
+                       const char *body, char **resp) {
+    http_url_t url;
+    if (resp) *resp = NULL;
+    if (httpc_parse_url(b->url, &url, "/") != 0) return -1;
+    char base[sizeof(url.path)];
+    snprintf(base, sizeof(base), "%s", strcmp(url.path, "/") ? url.path : "");
+    size_t bl = strlen(base);
+    if (bl > 0 && base[bl - 1] == '/') base[bl - 1] = '\0';
+    int n = snprintf(url.path, sizeof(url.path), "%s%s", base, path);
+    if (n < 0 || n >= (int)sizeof(url.path)) return -1;
+    char auth[200];
+    svcpub_auth_header(b, auth, sizeof(auth));
+    char *out = NULL;
+    int status = httpc_send_json(method, &url, auth[0] ? auth : NULL, body, &out, NULL,
+                                 SVCPUB_TIMEOUT_MS);
+    if (resp) *resp = out;
+    else free(out);
+    return status;
+}
+
+static char *svcpub_b64(const char *s) {
+    size_t len = strlen(s);
+    size_t cap = ((len + 2) / 3) * 4 + 1;
+    char *out = malloc(cap);
+    if (!out) return NULL;
+    size_t out_len = cap;
+    if (len == 0) out[0] = '\0';
+    else if (mg_base64_encode((const unsigned char *)s, len, out, &out_len) != -1) {
+        free(out);
+        return NULL;
+    }
+    return out;
+}
+
+/* POST /v3/kv/put or /v3/kv/deleterange for prefix + id. */
+static int svcpub_etcd_key(const svcpub_backend_t *b, const svcpub_state_t *st, const char *id,
+                           const char *value) {
+    char key[256];
+    snprintf(key, sizeof(key), "%s%s", b->prefix, id);
+    char *k64 = svcpub_b64(key);
+    char *v64 = value ? svcpub_b64(value) : NULL;
+    if (!k64 || (value && !v64)) {
+        free(k64);
+        free(v64);
+        return -1;
+    }
+    JSON_Value *v = json_value_init_object();
+    json_object_set_string(json_object(v), "key", k64);
+    if (value) {
+        json_object_set_string(json_object(v), "value", v64);
+        if (st->lease[0]) json_object_set_string(json_object(v), "lease", st->lease);
+    }
+    char *body = json_serialize_to_string(v);
+    json_value_free(v);
+    free(k64);
+    free(v64);
+    int status = body ? svcpub_call(b, "POST", value ? "/v3/kv/put" : "/v3/kv/deleterange",
+                                    body, NULL) : -1;
+    if (body) json_free_serialized_string(body);
+    return status;
+}
+
+/* Grant a lease, or keep the current one alive. A lease that expired (the
+ * master was cut off longer than ttl_s) is replaced and everything written
+ * again. Returns 0 when st->lease is usable. */
+static int svcpub_etcd_lease(const svcpub_backend_t *b, svcpub_state_t *st) {
+    char body[96];
+    char *resp = NULL;
+    if (st->lease[0]) {
+        snprintf(body, sizeof(body), "{\"ID\":\"%s\"}", st->lease);
+        int status = svcpub_call(b, "POST", "/v3/lease/keepalive", body, &resp);
+        JSON_Value *rv = (status == 200 && resp) ? json_parse_string(resp) : NULL;
+        free(resp);
+        const char *ttl = json_object_dotget_string(json_object(rv), "result.TTL");
+        int alive = ttl && atoi(ttl) > 0;
+        if (rv) json_value_free(rv);
+        if (status != 200) return -1;
+        if (alive) return 0;
+        st->lease[0] = '\0';
+        st->count = 0;
+    }
+    int ttl = b->ttl_s > 0 ? b->ttl_s : 3 * b->interval_s;
+    snprintf(body, sizeof(body), "{\"TTL\":%d}", ttl);
+    int status = svcpub_call(b, "POST", "/v3/lease/grant", body, &resp);
+    JSON_Value *rv = (status == 200 && resp) ? json_parse_string(resp) : NULL;
+    free(resp);
+    const char *id = json_object_get_string(json_object(rv), "ID");
+    if (id) snprintf(st->lease, sizeof(st->lease), "%s", id);
+    if (rv) json_value_free(rv);
+    return st->lease[0] ? 0 : -1;
+}
+
+/* Nodes an earlier run of this master registered in Consul but that are no
+ * longer in the registry. */
+static int svcpub_consul_cleanup(const svcpub_backend_t *b, const config_t *cfg,
+                                 const sync_node_addr_t *nodes, int count) {
+    char path[256];
+    snprintf(path, sizeof(path), "/v1/catalog/service/%s?node-meta=autod-master:%s",
+             b->service, cfg->sync_id);
+    char *resp = NULL;
+    int status = svcpub_call(b, "GET", path, NULL, &resp);
+    JSON_Value *rv = (status == 200 && resp) ? json_parse_string(resp) : NULL;
+    free(resp);
+    if (status != 200) {
+        if (rv) json_value_free(rv);
+        return -1;
+    }
+    JSON_Array *arr = json_value_get_array(rv);
+    for (size_t i = 0; i < json_array_get_count(arr); i++) {
+        const char *node = json_object_get_string(json_array_get_object(arr, i), "Node");
+        if (!node) continue;
+        int known = 0;
+        for (int j = 0; j < count && !known; j++) known = !strcmp(nodes[j].id, node);
+        if (known) continue;
+        JSON_Value *dv = json_value_init_object();
+        json_object_set_string(json_object(dv), "Node", node);
+        char *body = json_serialize_to_string(dv);
+        json_value_free(dv);
+        if (body) {
+            (void)svcpub_call(b, "PUT", "/v1/catalog/deregister", body, NULL);
+            json_free_serialized_string(body);
+        }
+    }
+    if (rv) json_value_free(rv);
+    return 0;
+}
+
+static int svcpub_remove(const svcpub_backend_t *b, const svcpub_state_t *st, const char *id) {
+    if (!strcmp(b->type, "etcd")) return svcpub_etcd_key(b, st, id, NULL);
+    JSON_Value *dv = json_value_init_object();
+    json_object_set_string(json_object(dv), "Node", id);
+    char *body = json_serialize_to_string(dv);
+    json_value_free(dv);
+    int status = body ? svcpub_call(b, "PUT", "/v1/catalog/deregister", body, NULL) : -1;
+    if (body) json_free_serialized_string(body);
+    return status;
+}
+
+static svcpub_entry_t *svcpub_entry(svcpub_state_t *st, const char *id) {
+    for (int i = 0; i < st->count; i++) {
+        if (!strcmp(st->entries[i].id, id)) return &st->entries[i];
+    }
+    if (st->count >= SYNC_MAX_SLAVES) return NULL;
+    svcpub_entry_t *e = &st->entries[st->count++];
+    memset(e, 0, sizeof(*e));
+    snprintf(e->id, sizeof(e->id), "%s", id);
+    return e;
+}
+
+/* One pass for one backend: write nodes whose document changed (all of them
+ * on a full resync) and remove the ones that left the registry. Returns NULL
+ * or the error that stopped it. */
+static const char *svcpub_sync_backend(const svcpub_backend_t *b, svcpub_state_t *st,
+                                       const config_t *cfg, const sync_node_addr_t *nodes,
+                                       int count, int full) {
+    int etcd = !strcmp(b->type, "etcd");
+    if (etcd && full && svcpub_etcd_lease(b, st) != 0) return "lease_failed";
+    if (!etcd && !st->cleaned) {
+        if (svcpub_consul_cleanup(b, cfg, nodes, count) != 0) return "unreachable";
+        st->cleaned = 1;
+    }
+    for (int i = 0; i < st->count; i++) st->entries[i].seen = 0;
+    for (int i = 0; i < count; i++) {
+        svcpub_entry_t *e = svcpub_entry(st, nodes[i].id);
+        if (!e) break;
+        e->seen = 1;
+        char *doc = etcd ? svcpub_etcd_doc(b, cfg, &nodes[i]) : svcpub_consul_doc(b, cfg, &nodes[i]);
+        if (!doc) continue;
+        uint64_t fp = svcpub_hash(doc);
+        int status = 200;
+        if (full || fp != e->fingerprint) {
+            status = etcd ? svcpub_etcd_key(b, st, nodes[i].id, doc)
+                          : svcpub_call(b, "PUT", "/v1/catalog/register", doc, NULL);
+        }
+        json_free_serialized_string(doc);
+        if (status < 0) return "unreachable";
+        if (status != 200) {
+            e->fingerprint = 0;
+            return "rejected";
+        }
+        e->fingerprint = fp;
+    }
+    for (int i = 0; i < st->count;) {
+        if (st->entries[i].seen) {
+            i++;
+            continue;
+        }
+        int status = svcpub_remove(b, st, st->entries[i].id);
+        if (status < 0) return "unreachable";
+        st->entries[i] = st->entries[--st->count];
+    }
+    return NULL;
+}
+
+static void *svcpub_thread_main(void *arg) {
+    app_t *app = (app_t *)arg;
+    sync_node_addr_t *nodes = calloc(SYNC_MAX_SLAVES, sizeof(*nodes));
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!nodes || !cfg) {
+        free(nodes);
+        free(cfg);
+        return NULL;
+    }
+    while (!g_svcpub_stop && !g_stop) {
+        app_config_snapshot(app, cfg);
+        if (strcasecmp(cfg->sync_role, "master") != 0) {
+            sleep(1);
+            continue;
+        }
+        int count = sync_master_list_nodes(app, cfg, nodes, SYNC_MAX_SLAVES);
+        long long now = now_ms();
+        for (int i = 0; i < cfg->publish.backend_count; i++) {
+            const svcpub_backend_t *b = &cfg->publish.backends[i];
+            svcpub_state_t *st = &g_svcpub[i];
+            if (!b->url[0] || now < st->retry_ms) continue;
+            int full = now - st->last_full_ms >= b->interval_s * 1000LL || !st->last_full_ms;
+            const char *err = svcpub_sync_backend(b, st, cfg, nodes, count, full);
+            pthread_mutex_lock(&g_svcpub_lock);
+            snprintf(st->type, sizeof(st->type), "%s", b->type);
+            snprintf(st->url, sizeof(st->url), "%s", b->url);
+            if (err) {
+                snprintf(st->last_error, sizeof(st->last_error), "%s", err);
+                /* Everything is written again once the backend is back. */
+                st->last_full_ms = 0;
+                long long wait = b->interval_s * 1000LL;
+                st->retry_ms = now + (wait < SVCPUB_RETRY_MS ? wait : SVCPUB_RETRY_MS);
+            } else {
+                st->last_error[0] = '\0';
+                st->last_ok_unix = (long long)time(NULL);
+                if (full) st->last_full_ms = now;
+            }
+            st->published = st->count;
+            int ok = err == NULL;
+            int changed = ok != st->reachable;
+            st->reachable = ok;
+            pthread_mutex_unlock(&g_svcpub_lock);
+            if (changed && ok) {
+                fprintf(stderr, "publish %s: mirroring %d node(s) to %s\n", b->type, count, b->url);
+            } else if (changed) {
+                fprintf(stderr, "publish %s: %s (%s), retrying\n", b->type, b->url, err);
+            }
+        }
+        sleep(1);
+    }
+    free(nodes);
+    free(cfg);
+    return NULL;
+}
+
+void svcpub_append_status(JSON_Object *so) {
+    if (!so) return;
+    JSON_Value *arr_v = json_value_init_array();
+    pthread_mutex_lock(&g_svcpub_lock);
+    for (int i = 0; i < SVCPUB_MAX_BACKENDS; i++) {
+        const svcpub_state_t *st = &g_svcpub[i];
+        if (!st->type[0]) continue;
+        JSON_Value *v = json_value_init_object();
+        JSON_Object *o = json_object(v);
+        json_object_set_string(o, "backend", st->type);
+        json_object_set_string(o, "url", st->url);
+        json_object_set_number(o, "published", st->published);
+        if (st->last_ok_unix > 0) json_object_set_number(o, "last_ok_unix", (double)st->last_ok_unix);
+        if (st->last_error[0]) json_object_set_string(o, "last_error", st->last_error);
+        json_array_append_value(json_array(arr_v), v);
+    }
+    pthread_mutex_unlock(&g_svcpub_lock);
+    if (json_array_get_count(json_array(arr_v)) > 0) json_object_set_value(so, "publish", arr_v);
+    else json_value_free(arr_v);
+}
+
+int svcpub_start_thread(app_t *app) {
+    if (!app) return -1;
+    pthread_mutex_lock(&g_svcpub_lock);
+    g_svcpub_stop = 0;
+    if (g_svcpub_running) {
+        pthread_mutex_unlock(&g_svcpub_lock);
+        return 0;
+    }
+    for (int i = 0; i < SVCPUB_MAX_BACKENDS; i++) {
+        memset(&g_svcpub[i], 0, sizeof(g_svcpub[i]));
+        g_svcpub[i].reachable = -1;
+    }
+    if (pthread_create(&g_svcpub_thread, NULL, svcpub_thread_main, app) == 0) {
+        g_svcpub_running = 1;
+        pthread_mutex_unlock(&g_svcpub_lock);
+        return 0;
+    }
+    pthread_mutex_unlock(&g_svcpub_lock);
+    fprintf(stderr, "WARN: failed to start service catalog publisher thread\n");
+    return -1;
+}
+
+void svcpub_stop_thread(void) {
+    pthread_mutex_lock(&g_svcpub_lock);
+    g_svcpub_stop = 1;
+    int running = g_svcpub_running;
+    pthread_mutex_unlock(&g_svcpub_lock);
+    if (running) {
+        pthread_join(g_svcpub_thread, NULL);
+        pthread_mutex_lock(&g_svcpub_lock);
+        g_svcpub_running = 0;
+        pthread_mutex_unlock(&g_svcpub_lock);
+    }
+}
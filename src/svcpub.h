@@ -0,0 +1,40 @@
+#ifndef AUTOD_SVCPUB_H
+#define AUTOD_SVCPUB_H
+
+#include "parson.h"
+
+#define SVCPUB_MAX_BACKENDS 2
+
+/* [publish.consul] / [publish.etcd] — mirror the master's registry into an
+ * external service catalog so existing discovery consumers see autod nodes.
+ * Consul gets one external node with a service and a check per autod node;
+ * etcd gets one JSON value per node under a key prefix, bound to a lease. */
+typedef struct {
+    char type[8];                 /* consul | etcd (from the section name) */
+    char url[256];                /* agent or gateway base URL */
+    char token[160];              /* X-Consul-Token / etcd Authorization */
+    char service[64];             /* consul: service name (default autod) */
+    char tags[256];               /* extra comma-separated tags */
+    char prefix[128];             /* etcd: key prefix (default /autod/nodes/) */
+    int  interval_s;              /* full resync period (default 30) */
+    int  ttl_s;                   /* etcd: lease TTL (default 3 * interval_s) */
+} svcpub_backend_t;
+
+typedef struct {
+    svcpub_backend_t backends[SVCPUB_MAX_BACKENDS];
+    int backend_count;
+} svcpub_config_t;
+
+typedef struct config config_t;
+typedef struct app app_t;
+
+void svcpub_cfg_defaults(config_t *cfg);
+int svcpub_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+/* "publish": [{backend, url, published, last_ok_unix, last_error}] for /health. */
+void svcpub_append_status(JSON_Object *so);
+
+int svcpub_start_thread(app_t *app);
+void svcpub_stop_thread(void);
+
+#endif
@@ -3,6 +3,7 @@
 #include <string.h>
 #include <strings.h>
 #include <ctype.h>
+#include <stdint.h>
 #include <errno.h>
 #include <unistd.h>
 #include <signal.h>
@@ -11,22 +12,33 @@
 #include <netdb.h>
 #include <netinet/in.h>
 #include <arpa/inet.h>
+#include <ifaddrs.h>
 #include <sys/time.h>
+#include <time.h>
+#include <fnmatch.h>
 
 #include "civetweb.h"
 #include "parson.h"
 #include "scan.h"
 #include "autod.h"
+#include "events.h"
+#include "httpc.h"
+#include "dnscache.h"
+#include "cluster.h"
+#include "mqtt.h"
+#include "sync_mqtt.h"
+#include "sync_results.h"
+#include "catalog.h"
+#include "replica.h"
+#include "debug.h"
+#include "version.h"
+#include "caller.h"
 #include "sync.h"
+#include "nodeid.h"
+#include "jobs.h"
 
 extern volatile sig_atomic_t g_stop;
 
-typedef struct {
-    char host[128];
-    int port;
-    char path[256];
-} http_url_t;
-
 static void sync_trim(char *s) {
     if (!s) return;
     size_t l = strlen(s), i = 0;
@@ -36,15 +48,195 @@ static void sync_trim(char *s) {
     while (l > 0 && isspace((unsigned char)s[l - 1])) s[--l] = '\0';
 }
 
+/* Wall-clock time of a monotonic deadline, for clients; the monotonic value
+ * stays the one TTLs are checked against. */
+static long long sync_unix_ms(long long mono_ms) {
+    return jobs_unix_ms() + (mono_ms - now_ms());
+}
+
 void sync_cfg_defaults(config_t *cfg) {
     if (!cfg) return;
     cfg->sync_role[0] = '\0';
     cfg->sync_master_url[0] = '\0';
     cfg->sync_id[0] = '\0';
+    snprintf(cfg->sync_id_sources, sizeof(cfg->sync_id_sources), "%s", NODEID_SOURCES_DEFAULT);
     cfg->sync_register_interval_s = 30;
     cfg->sync_allow_bind = 1;
     cfg->sync_slot_retention_s = 0;
+    cfg->sync_node_down_after_s = 90;
+    cfg->sync_advertise[0] = '\0';
+    cfg->sync_advertise_iface[0] = '\0';
+    strncpy(cfg->sync_transport, "http", sizeof(cfg->sync_transport) - 1);
+    cfg->sync_mqtt_broker[0] = '\0';
+    strncpy(cfg->sync_mqtt_prefix, "autod", sizeof(cfg->sync_mqtt_prefix) - 1);
+    strncpy(cfg->sync_claim_policy, "first_come", sizeof(cfg->sync_claim_policy) - 1);
+    strncpy(cfg->sync_id_conflict_policy, "last_writer_wins", sizeof(cfg->sync_id_conflict_policy) - 1);
+    strncpy(cfg->sync_version_policy, "warn", sizeof(cfg->sync_version_policy) - 1);
+    cfg->sync_claim_slot = 0;
+    cfg->sync_claim_priority = 0;
+    cfg->sync_dns_ttl_s = 30;
+    cfg->sync_lease_max_s = 600;
+    cfg->sync_compact_register = 1;
+    cfg->sync_gzip = 1;
+    cfg->sync_replica_interval_s = 2;
+    cfg->sync_desired_path[0] = '\0';
+    cfg->sync_outbox_path[0] = '\0';
+    cfg->sync_address_book_path[0] = '\0';
+    cfg->sync_registry_path[0] = '\0';
+    cfg->sync_registry_flush_s = 60;
+    cfg->sync_registry_flush_changes = 20;
+    cfg->sync_outbox_max_kb = 256;
+    cfg->sync_offline_heartbeat_s = 60;
+    cfg->sync_quarantine_failures = 5;
+    cfg->sync_quarantine_probation_s = 60;
+    cfg->sync_exec_cache_stale_s = 60;
+    cfg->sync_slot_count = SYNC_DEFAULT_SLOTS;
     memset(cfg->sync_slots, 0, sizeof(cfg->sync_slots));
+    cfg->sync_slot_command_count = 0;
+    cfg->sync_slot_var_count = 0;
+    cfg->sync_slot_template_count = 0;
+}
+
+/* Index of a command in the pool slots share, added when new; -1 when full. */
+static int sync_slot_command_intern(config_t *cfg, const char *json) {
+    for (int i = 0; i < cfg->sync_slot_command_count; i++) {
+        if (!strcmp(cfg->sync_slot_commands[i].json, json)) return i;
+    }
+    if (cfg->sync_slot_command_count >= SYNC_SLOT_COMMAND_POOL) return -1;
+    if (!cfg->sync_slot_commands) {
+        cfg->sync_slot_commands = calloc(SYNC_SLOT_COMMAND_POOL, sizeof(*cfg->sync_slot_commands));
+        if (!cfg->sync_slot_commands) return -1;
+    }
+    int idx = cfg->sync_slot_command_count++;
+    snprintf(cfg->sync_slot_commands[idx].json, sizeof(cfg->sync_slot_commands[idx].json), "%s", json);
+    return idx;
+}
+
+/* Same for a NAME=VALUE env or param entry. */
+static int sync_slot_var_intern(config_t *cfg, const char *text) {
+    for (int i = 0; i < cfg->sync_slot_var_count; i++) {
+        if (!strcmp(cfg->sync_slot_vars[i].text, text)) return i;
+    }
+    if (cfg->sync_slot_var_count >= SYNC_SLOT_VAR_POOL) return -1;
+    if (!cfg->sync_slot_vars) {
+        cfg->sync_slot_vars = calloc(SYNC_SLOT_VAR_POOL, sizeof(*cfg->sync_slot_vars));
+        if (!cfg->sync_slot_vars) return -1;
+    }
+    int idx = cfg->sync_slot_var_count++;
+    snprintf(cfg->sync_slot_vars[idx].text, sizeof(cfg->sync_slot_vars[idx].text), "%s", text);
+    return idx;
+}
+
+/* One key of a [sync.slotN] or [sync.template.NAME] section. */
+static void sync_slot_cfg_apply(config_t *cfg, sync_slot_config_t *slot, const char *label,
+                                const char *key, const char *value) {
+    if (!strcmp(key, "name")) {
+        strncpy(slot->name, value, sizeof(slot->name) - 1);
+        slot->name[sizeof(slot->name) - 1] = '\0';
+    } else if (!strcmp(key, "alias")) {
+        if (!*value || strspn(value, "0123456789") == strlen(value) ||
+            strpbrk(value, "*?[") || strlen(value) >= sizeof(slot->aliases[0])) {
+            fprintf(stderr, "WARN: ignoring invalid sync %s alias '%s'\n", label, value);
+        } else if (slot->alias_count >= SYNC_SLOT_MAX_ALIASES) {
+            fprintf(stderr, "WARN: sync %s alias capacity reached (%d)\n",
+                    label, SYNC_SLOT_MAX_ALIASES);
+        } else {
+            snprintf(slot->aliases[slot->alias_count++], sizeof(slot->aliases[0]), "%s", value);
+        }
+    } else if (!strcmp(key, "prefer_id")) {
+        strncpy(slot->prefer_id, value, sizeof(slot->prefer_id) - 1);
+        slot->prefer_id[sizeof(slot->prefer_id) - 1] = '\0';
+    } else if ((!strcmp(key, "exec") || !strcmp(key, "command"))) {
+        if (slot->command_count >= SYNC_SLOT_MAX_COMMANDS) {
+            fprintf(stderr, "WARN: sync %s command capacity reached (%d)\n",
+                    label, SYNC_SLOT_MAX_COMMANDS);
+            return;
+        }
+        JSON_Value *tmp = json_parse_string(value);
+        if (!tmp || json_value_get_type(tmp) != JSONObject) {
+            fprintf(stderr, "WARN: ignoring invalid sync %s command '%s'\n", label, value);
+            if (tmp) json_value_free(tmp);
+            return;
+        }
+        json_value_free(tmp);
+        int id = sync_slot_command_intern(cfg, value);
+        if (id < 0) {
+            fprintf(stderr, "WARN: sync slot command pool full (%d distinct commands), "
+                    "ignoring %s command\n", SYNC_SLOT_COMMAND_POOL, label);
+            return;
+        }
+        slot->command_ids[slot->command_count++] = (unsigned char)id;
+    } else if (!strcmp(key, "health")) {
+        JSON_Value *tmp = json_parse_string(value);
+        if (!tmp || json_value_get_type(tmp) != JSONObject ||
+            !json_object_get_string(json_object(tmp), "path")) {
+            fprintf(stderr, "WARN: ignoring invalid sync %s health '%s'\n", label, value);
+        } else {
+            strncpy(slot->health, value, sizeof(slot->health) - 1);
+            slot->health[sizeof(slot->health) - 1] = '\0';
+        }
+        if (tmp) json_value_free(tmp);
+    } else if (!strcmp(key, "health_interval_s")) {
+        slot->health_interval_s = atoi(value);
+    } else if (!strcmp(key, "health_failures")) {
+        slot->health_failures = atoi(value);
+    } else if (!strcmp(key, "health_failover")) {
+        slot->health_failover = atoi(value);
+    } else if (!strcmp(key, "ssh")) {
+        char user[64], host[128];
+        int port = 0;
+        /* Templates may put {name} in the host; it is checked once substituted. */
+        if (strstr(value, "{") == NULL &&
+            sshexec_parse_target(value, user, sizeof(user), host, sizeof(host), &port) != 0) {
+            fprintf(stderr, "WARN: ignoring invalid sync %s ssh '%s'\n", label, value);
+        } else {
+            snprintf(slot->ssh, sizeof(slot->ssh), "%s", value);
+        }
+    } else if (!strcmp(key, "ssh_identity")) {
+        snprintf(slot->ssh_identity, sizeof(slot->ssh_identity), "%s", value);
+    } else if (!strcmp(key, "env") || !strcmp(key, "param")) {
+        int is_env = key[0] == 'e';
+        unsigned char *ids = is_env ? slot->env_ids : slot->param_ids;
+        int *count = is_env ? &slot->env_count : &slot->param_count;
+        const char *eq = strchr(value, '=');
+        char name[64];
+        snprintf(name, sizeof(name), "%.*s", eq ? (int)(eq - value) : 0, value);
+        if (!eq || !exec_var_name_valid(name) || strlen(value) >= sizeof(cfg->sync_slot_vars[0].text)) {
+            fprintf(stderr, "WARN: ignoring invalid sync %s %s '%s'\n", label, key, value);
+            return;
+        }
+        int k = 0;
+        /* A name given again replaces the earlier value. */
+        while (k < *count &&
+               strncmp(cfg->sync_slot_vars[ids[k]].text, value, (size_t)(eq - value + 1)) != 0) {
+            k++;
+        }
+        if (k >= SYNC_SLOT_MAX_VARS) {
+            fprintf(stderr, "WARN: sync %s %s capacity reached (%d)\n", label, key, SYNC_SLOT_MAX_VARS);
+            return;
+        }
+        int id = sync_slot_var_intern(cfg, value);
+        if (id < 0) {
+            fprintf(stderr, "WARN: sync slot env/param pool full (%d distinct entries), "
+                    "ignoring %s %s\n", SYNC_SLOT_VAR_POOL, label, key);
+            return;
+        }
+        ids[k] = (unsigned char)id;
+        if (k == *count) (*count)++;
+    } else {
+        fprintf(stderr, "WARN: sync %s: ignoring unknown key '%s'\n", label, key);
+    }
+}
+
+static sync_slot_template_t *sync_template_find_or_add(config_t *cfg, const char *name) {
+    for (int i = 0; i < cfg->sync_slot_template_count; i++) {
+        if (!strcmp(cfg->sync_slot_templates[i].name, name)) return &cfg->sync_slot_templates[i];
+    }
+    if (cfg->sync_slot_template_count >= SYNC_MAX_SLOT_TEMPLATES) return NULL;
+    sync_slot_template_t *t = &cfg->sync_slot_templates[cfg->sync_slot_template_count++];
+    memset(t, 0, sizeof(*t));
+    snprintf(t->name, sizeof(t->name), "%s", name);
+    return t;
 }
 
 int sync_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
@@ -59,12 +251,170 @@ int sync_cfg_parse(config_t *cfg, const char *section, const char *key, const ch
         } else if (!strcmp(key, "id")) {
             strncpy(cfg->sync_id, value, sizeof(cfg->sync_id) - 1);
             cfg->sync_id[sizeof(cfg->sync_id) - 1] = '\0';
+        } else if (!strcmp(key, "id_sources") || !strcmp(key, "id_migrate_from")) {
+            const char *why = nodeid_check_sources(value);
+            char *dst = !strcmp(key, "id_sources") ? cfg->sync_id_sources : cfg->sync_id_migrate_from;
+            if (why && *value) fprintf(stderr, "WARN: ignoring sync %s '%s' (%s)\n", key, value, why);
+            else snprintf(dst, sizeof(cfg->sync_id_sources), "%s", why ? "" : value);
+            if (!strcmp(key, "id_sources") && !cfg->sync_id_sources[0]) {
+                snprintf(cfg->sync_id_sources, sizeof(cfg->sync_id_sources), "%s", NODEID_SOURCES_DEFAULT);
+            }
+        } else if (!strcmp(key, "id_prefix")) {
+            snprintf(cfg->sync_id_prefix, sizeof(cfg->sync_id_prefix), "%s", value);
         } else if (!strcmp(key, "register_interval_s")) {
             cfg->sync_register_interval_s = atoi(value);
         } else if (!strcmp(key, "allow_bind")) {
             cfg->sync_allow_bind = atoi(value);
         } else if (!strcmp(key, "slot_retention_s")) {
             cfg->sync_slot_retention_s = atoi(value);
+        } else if (!strcmp(key, "node_down_after_s")) {
+            cfg->sync_node_down_after_s = atoi(value);
+        } else if (!strcmp(key, "lease_max_s")) {
+            int v = atoi(value);
+            if (v > 0) cfg->sync_lease_max_s = v;
+            else fprintf(stderr, "WARN: ignoring sync lease_max_s %s (must be positive)\n", value);
+        } else if (!strcmp(key, "compact_register")) {
+            cfg->sync_compact_register = atoi(value) ? 1 : 0;
+        } else if (!strcmp(key, "gzip")) {
+            cfg->sync_gzip = atoi(value) ? 1 : 0;
+        } else if (!strcmp(key, "replica_interval_s")) {
+            int v = atoi(value);
+            if (v > 0) cfg->sync_replica_interval_s = v;
+            else fprintf(stderr, "WARN: ignoring sync replica_interval_s %s (must be positive)\n", value);
+        } else if (!strcmp(key, "desired_path")) {
+            strncpy(cfg->sync_desired_path, value, sizeof(cfg->sync_desired_path) - 1);
+            cfg->sync_desired_path[sizeof(cfg->sync_desired_path) - 1] = '\0';
+        } else if (!strcmp(key, "outbox_path")) {
+            strncpy(cfg->sync_outbox_path, value, sizeof(cfg->sync_outbox_path) - 1);
+            cfg->sync_outbox_path[sizeof(cfg->sync_outbox_path) - 1] = '\0';
+        } else if (!strcmp(key, "address_book_path")) {
+            strncpy(cfg->sync_address_book_path, value, sizeof(cfg->sync_address_book_path) - 1);
+            cfg->sync_address_book_path[sizeof(cfg->sync_address_book_path) - 1] = '\0';
+        } else if (!strcmp(key, "registry_path")) {
+            strncpy(cfg->sync_registry_path, value, sizeof(cfg->sync_registry_path) - 1);
+            cfg->sync_registry_path[sizeof(cfg->sync_registry_path) - 1] = '\0';
+        } else if (!strcmp(key, "registry_flush_s")) {
+            int v = atoi(value);
+            if (v > 0) cfg->sync_registry_flush_s = v;
+            else fprintf(stderr, "WARN: ignoring sync registry_flush_s %s (must be positive)\n", value);
+        } else if (!strcmp(key, "registry_flush_changes")) {
+            int v = atoi(value);
+            if (v > 0) cfg->sync_registry_flush_changes = v;
+            else fprintf(stderr, "WARN: ignoring sync registry_flush_changes %s (must be positive)\n", value);
+        } else if (!strcmp(key, "outbox_max_kb")) {
+            int v = atoi(value);
+            if (v >= 4) cfg->sync_outbox_max_kb = v;
+            else fprintf(stderr, "WARN: ignoring sync outbox_max_kb %s (minimum 4)\n", value);
+        } else if (!strcmp(key, "offline_heartbeat_s")) {
+            int v = atoi(value);
+            if (v >= 0) cfg->sync_offline_heartbeat_s = v;
+            else fprintf(stderr, "WARN: ignoring negative sync offline_heartbeat_s %s\n", value);
+        } else if (!strcmp(key, "quarantine_failures")) {
+            int v = atoi(value);
+            if (v >= 0) cfg->sync_quarantine_failures = v;
+            else fprintf(stderr, "WARN: ignoring negative sync quarantine_failures %s\n", value);
+        } else if (!strcmp(key, "quarantine_probation_s")) {
+            int v = atoi(value);
+            if (v > 0) cfg->sync_quarantine_probation_s = v;
+            else fprintf(stderr, "WARN: ignoring sync quarantine_probation_s %s (must be positive)\n", value);
+        } else if (!strcmp(key, "exec_cache_stale_s")) {
+            int v = atoi(value);
+            if (v >= 0) cfg->sync_exec_cache_stale_s = v;
+            else fprintf(stderr, "WARN: ignoring negative sync exec_cache_stale_s %s\n", value);
+        } else if (!strcmp(key, "advertise")) {
+            strncpy(cfg->sync_advertise, value, sizeof(cfg->sync_advertise) - 1);
+            cfg->sync_advertise[sizeof(cfg->sync_advertise) - 1] = '\0';
+        } else if (!strcmp(key, "advertise_iface")) {
+            strncpy(cfg->sync_advertise_iface, value, sizeof(cfg->sync_advertise_iface) - 1);
+            cfg->sync_advertise_iface[sizeof(cfg->sync_advertise_iface) - 1] = '\0';
+        } else if (!strcmp(key, "transport")) {
+            if (strcasecmp(value, "http") != 0 && strcasecmp(value, "mqtt") != 0) {
+                fprintf(stderr, "WARN: ignoring unknown sync transport '%s'\n", value);
+            } else {
+                strncpy(cfg->sync_transport, strcasecmp(value, "mqtt") == 0 ? "mqtt" : "http",
+                        sizeof(cfg->sync_transport) - 1);
+                cfg->sync_transport[sizeof(cfg->sync_transport) - 1] = '\0';
+            }
+        } else if (!strcmp(key, "mqtt_broker")) {
+            strncpy(cfg->sync_mqtt_broker, value, sizeof(cfg->sync_mqtt_broker) - 1);
+            cfg->sync_mqtt_broker[sizeof(cfg->sync_mqtt_broker) - 1] = '\0';
+        } else if (!strcmp(key, "mqtt_prefix")) {
+            strncpy(cfg->sync_mqtt_prefix, value, sizeof(cfg->sync_mqtt_prefix) - 1);
+            cfg->sync_mqtt_prefix[sizeof(cfg->sync_mqtt_prefix) - 1] = '\0';
+        } else if (!strcmp(key, "claim_policy")) {
+            if (strcasecmp(value, "first_come") != 0 && strcasecmp(value, "priority") != 0 &&
+                strcasecmp(value, "manual") != 0) {
+                fprintf(stderr, "WARN: ignoring unknown sync claim_policy '%s'\n", value);
+            } else {
+                strncpy(cfg->sync_claim_policy, value, sizeof(cfg->sync_claim_policy) - 1);
+                cfg->sync_claim_policy[sizeof(cfg->sync_claim_policy) - 1] = '\0';
+                for (char *p = cfg->sync_claim_policy; *p; p++) *p = (char)tolower((unsigned char)*p);
+            }
+        } else if (!strcmp(key, "id_conflict_policy")) {
+            if (strcasecmp(value, "reject") != 0 && strcasecmp(value, "last_writer_wins") != 0 &&
+                strcasecmp(value, "suffix") != 0) {
+                fprintf(stderr, "WARN: ignoring unknown sync id_conflict_policy '%s'\n", value);
+            } else {
+                strncpy(cfg->sync_id_conflict_policy, value, sizeof(cfg->sync_id_conflict_policy) - 1);
+                cfg->sync_id_conflict_policy[sizeof(cfg->sync_id_conflict_policy) - 1] = '\0';
+                for (char *p = cfg->sync_id_conflict_policy; *p; p++) *p = (char)tolower((unsigned char)*p);
+            }
+        } else if (!strcmp(key, "version_policy")) {
+            if (strcasecmp(value, "warn") != 0 && strcasecmp(value, "refuse") != 0) {
+                fprintf(stderr, "WARN: ignoring unknown sync version_policy '%s'\n", value);
+            } else {
+                strncpy(cfg->sync_version_policy, value, sizeof(cfg->sync_version_policy) - 1);
+                cfg->sync_version_policy[sizeof(cfg->sync_version_policy) - 1] = '\0';
+                for (char *p = cfg->sync_version_policy; *p; p++) *p = (char)tolower((unsigned char)*p);
+            }
+        } else if (!strcmp(key, "claim_slot")) {
+            int slot = atoi(value);
+            if (slot < 0 || slot > SYNC_MAX_SLOTS) {
+                fprintf(stderr, "WARN: ignoring sync claim_slot %s (expected 1..%d)\n",
+                        value, SYNC_MAX_SLOTS);
+            } else {
+                cfg->sync_claim_slot = slot;
+            }
+        } else if (!strcmp(key, "claim_priority")) {
+            cfg->sync_claim_priority = atoi(value);
+        } else if (!strcmp(key, "slots")) {
+            int v = atoi(value);
+            if (v >= 1 && v <= SYNC_MAX_SLOTS) {
+                cfg->sync_slot_count = v;
+            } else {
+                fprintf(stderr, "WARN: ignoring sync slots %s (1-%d)\n", value, SYNC_MAX_SLOTS);
+            }
+        } else if (!strcmp(key, "dns_ttl_s")) {
+            int ttl = atoi(value);
+            if (ttl < 0) {
+                fprintf(stderr, "WARN: ignoring negative sync dns_ttl_s %s\n", value);
+            } else {
+                cfg->sync_dns_ttl_s = ttl;
+            }
+        } else {
+            fprintf(stderr, "WARN: ignoring unknown sync key '%s'\n", key);
+        }
+        return 1;
+    }
+    if (!strncmp(section, "sync.template.", 14) && section[14]) {
+        sync_slot_template_t *t = sync_template_find_or_add(cfg, section + 14);
+        if (!t) {
+            fprintf(stderr, "WARN: sync slot template capacity reached (%d)\n",
+                    SYNC_MAX_SLOT_TEMPLATES);
+            return 1;
+        }
+        char label[48];
+        snprintf(label, sizeof(label), "template %s", t->name);
+        if (!strcmp(key, "names")) {
+            snprintf(t->names, sizeof(t->names), "%s", value);
+        } else if (!strcmp(key, "first")) {
+            int v = atoi(value);
+            if (v >= 1 && v <= SYNC_MAX_SLOTS) t->first = v;
+            else fprintf(stderr, "WARN: ignoring sync %s first '%s' (1-%d)\n", label, value, SYNC_MAX_SLOTS);
+        } else if (!strcmp(key, "alias")) {
+            fprintf(stderr, "WARN: ignoring sync %s alias (a name can belong to one slot only)\n", label);
+        } else {
+            sync_slot_cfg_apply(cfg, &t->slot, label, key, value);
         }
         return 1;
     }
@@ -77,50 +427,36 @@ int sync_cfg_parse(config_t *cfg, const char *section, const char *key, const ch
                 section);
         return 1;
     }
-
-    sync_slot_config_t *slot = &cfg->sync_slots[slot_index - 1];
-    if (!strcmp(key, "name")) {
-        strncpy(slot->name, value, sizeof(slot->name) - 1);
-        slot->name[sizeof(slot->name) - 1] = '\0';
-    } else if (!strcmp(key, "prefer_id")) {
-        strncpy(slot->prefer_id, value, sizeof(slot->prefer_id) - 1);
-        slot->prefer_id[sizeof(slot->prefer_id) - 1] = '\0';
-    } else if ((!strcmp(key, "exec") || !strcmp(key, "command"))) {
-        if (slot->command_count >= SYNC_SLOT_MAX_COMMANDS) {
-            fprintf(stderr,
-                    "WARN: sync slot %d command capacity reached (%d)\n",
-                    slot_index, SYNC_SLOT_MAX_COMMANDS);
-            return 1;
-        }
-        JSON_Value *tmp = json_parse_string(value);
-        if (!tmp || json_value_get_type(tmp) != JSONObject) {
-            fprintf(stderr,
-                    "WARN: ignoring invalid sync slot %d command '%s'\n",
-                    slot_index, value);
-            if (tmp) json_value_free(tmp);
-            return 1;
-        }
-        json_value_free(tmp);
-        int idx = slot->command_count++;
-        strncpy(slot->commands[idx].json, value,
-                sizeof(slot->commands[idx].json) - 1);
-        slot->commands[idx].json[sizeof(slot->commands[idx].json) - 1] = '\0';
-    }
+    char label[32];
+    snprintf(label, sizeof(label), "slot %d", slot_index);
+    sync_slot_cfg_apply(cfg, &cfg->sync_slots[slot_index - 1], label, key, value);
     return 1;
 }
 
 void sync_ensure_id(config_t *cfg) {
     if (!cfg) return;
-    if (cfg->sync_id[0]) return;
-    char hostbuf[sizeof(cfg->sync_id)];
-    if (gethostname(hostbuf, sizeof(hostbuf)) == 0) {
-        hostbuf[sizeof(hostbuf) - 1] = '\0';
-        strncpy(cfg->sync_id, hostbuf, sizeof(cfg->sync_id) - 1);
-        cfg->sync_id[sizeof(cfg->sync_id) - 1] = '\0';
-    } else {
-        strncpy(cfg->sync_id, "autod-node", sizeof(cfg->sync_id) - 1);
-        cfg->sync_id[sizeof(cfg->sync_id) - 1] = '\0';
+    if (cfg->sync_id[0]) {
+        if (!cfg->sync_id_source[0]) snprintf(cfg->sync_id_source, sizeof(cfg->sync_id_source), "config");
+    } else if (nodeid_derive(cfg->sync_id_sources, cfg->sync_id_prefix, cfg->sync_id, sizeof(cfg->sync_id),
+                             cfg->sync_id_source, sizeof(cfg->sync_id_source)) != 0) {
+        snprintf(cfg->sync_id, sizeof(cfg->sync_id), "autod-node");
+        snprintf(cfg->sync_id_source, sizeof(cfg->sync_id_source), "default");
     }
+    /* The id the node registered with before its scheme changed; without
+     * id_prefix, as older builds had none. */
+    cfg->sync_previous_id[0] = '\0';
+    if (cfg->sync_id_migrate_from[0] &&
+        nodeid_derive(cfg->sync_id_migrate_from, NULL, cfg->sync_previous_id,
+                      sizeof(cfg->sync_previous_id), NULL, 0) == 0 &&
+        !strcmp(cfg->sync_previous_id, cfg->sync_id)) {
+        cfg->sync_previous_id[0] = '\0';
+    }
+}
+
+/* 1 when o carries key with an explicit null, which clears the field. */
+static int sync_json_is_null(const JSON_Object *o, const char *key) {
+    JSON_Value *v = json_object_get_value(o, key);
+    return v && json_value_get_type(v) == JSONNull;
 }
 
 void sync_caps_from_json_value(const JSON_Value *value, char *dest, size_t dest_sz) {
@@ -168,6 +504,353 @@ int sync_preferred_slot_for_id(const config_t *cfg, const char *id) {
     return -1;
 }
 
+/* Whether a slot name or alias matches ref. "**" spans levels, "*" does not. */
+static int sync_slot_name_matches(const char *ref, const char *name) {
+    if (!name[0]) return 0;
+    if (!strpbrk(ref, "*?[")) return strcmp(ref, name) == 0;
+    const char *deep = strstr(ref, "**");
+    if (!deep) return fnmatch(ref, name, FNM_PATHNAME) == 0;
+    char pat[128];
+    size_t n = 0;
+    for (const char *p = ref; *p && n + 1 < sizeof(pat); p++) {
+        if (p[0] == '*' && p[1] == '*') p++;
+        pat[n++] = *p;
+    }
+    pat[n] = '\0';
+    return fnmatch(pat, name, 0) == 0;
+}
+
+int sync_slot_match(const config_t *cfg, const char *ref, unsigned char hits[SYNC_MAX_SLOTS]) {
+    memset(hits, 0, SYNC_MAX_SLOTS);
+    if (!cfg || !ref || !*ref) return 0;
+    if (strspn(ref, "0123456789") == strlen(ref)) {
+        int n = atoi(ref);
+        if (n < 1 || n > sync_slot_count(cfg)) return 0;
+        hits[n - 1] = 1;
+        return 1;
+    }
+    int count = 0;
+    for (int i = 0; i < SYNC_MAX_SLOTS; i++) {
+        const sync_slot_config_t *slot = &cfg->sync_slots[i];
+        int hit = sync_slot_name_matches(ref, slot->name);
+        for (int a = 0; !hit && a < slot->alias_count; a++) {
+            hit = sync_slot_name_matches(ref, slot->aliases[a]);
+        }
+        if (hit) {
+            hits[i] = 1;
+            count++;
+        }
+    }
+    return count;
+}
+
+int sync_slot_lookup(const config_t *cfg, const char *ref, int *slot_index) {
+    unsigned char hits[SYNC_MAX_SLOTS];
+    int count = sync_slot_match(cfg, ref, hits);
+    if (count == 0) return -1;
+    if (count > 1) return -2;
+    for (int i = 0; i < SYNC_MAX_SLOTS; i++) {
+        if (hits[i]) *slot_index = i;
+    }
+    return 0;
+}
+
+JSON_Value *sync_slot_lookup_error(const config_t *cfg, const char *ref, int rc, int *status) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "error", rc == -2 ? "ambiguous_slot" : "unknown_slot");
+    json_object_set_string(o, "slot", ref ? ref : "");
+    if (rc == -2) {
+        unsigned char hits[SYNC_MAX_SLOTS];
+        sync_slot_match(cfg, ref, hits);
+        JSON_Value *mv = json_value_init_array();
+        for (int i = 0; i < SYNC_MAX_SLOTS; i++) {
+            if (hits[i]) json_array_append_number(json_array(mv), i + 1);
+        }
+        json_object_set_value(o, "matches", mv);
+    }
+    if (status) *status = rc == -2 ? 409 : 404;
+    return v;
+}
+
+/* Names and aliases of this slot that another slot also answers to. */
+static void sync_slot_conflicts(const config_t *cfg, int slot, JSON_Array *out_arr, int warn) {
+    const sync_slot_config_t *sc = &cfg->sync_slots[slot];
+    for (int a = -1; a < sc->alias_count; a++) {
+        const char *ref = a < 0 ? sc->name : sc->aliases[a];
+        if (!ref[0] || strpbrk(ref, "*?[")) continue;
+        unsigned char hits[SYNC_MAX_SLOTS];
+        if (sync_slot_match(cfg, ref, hits) < 2) continue;
+        if (out_arr) json_array_append_string(out_arr, ref);
+        int first = 0;
+        while (!hits[first]) first++;
+        if (warn && first == slot) {
+            fprintf(stderr, "WARN: sync slot name '%s' is used by slots", ref);
+            for (int i = 0; i < SYNC_MAX_SLOTS; i++) {
+                if (hits[i]) fprintf(stderr, " %d", i + 1);
+            }
+            fprintf(stderr, "; references to it are refused as ambiguous\n");
+        }
+    }
+}
+
+static int sync_slot_highest_defined(const config_t *cfg);
+
+void sync_cfg_check_slots(const config_t *cfg) {
+    if (!cfg) return;
+    for (int slot = 0; slot < SYNC_MAX_SLOTS; slot++) sync_slot_conflicts(cfg, slot, NULL, 1);
+    int wanted = cfg->sync_slot_count;
+    int defined = sync_slot_highest_defined(cfg);
+    if (defined > wanted) wanted = defined;
+    int limit = capacity_limit(cfg, CAPACITY_SLOTS);
+    if (wanted > limit) {
+        fprintf(stderr, "WARN: capacity: %d slots configured, only the first %d (max_slots) are used\n",
+                wanted, limit);
+    }
+    capacity_note(cfg, CAPACITY_SLOTS, sync_slot_count(cfg));
+}
+
+static int sync_slot_defined(const sync_slot_config_t *sc) {
+    return sc->name[0] || sc->alias_count || sc->prefer_id[0] || sc->command_count ||
+           sc->health[0] || sc->template_name[0] || sc->ssh[0];
+}
+
+/* One past the highest slot with any configuration. */
+static int sync_slot_highest_defined(const config_t *cfg) {
+    for (int i = SYNC_MAX_SLOTS - 1; i >= 0; i--) {
+        if (sync_slot_defined(&cfg->sync_slots[i])) return i + 1;
+    }
+    return 0;
+}
+
+int sync_slot_count(const config_t *cfg) {
+    if (!cfg) return SYNC_DEFAULT_SLOTS;
+    int n = cfg->sync_slot_count;
+    int defined = sync_slot_highest_defined(cfg);
+    if (defined > n) n = defined;
+    if (n < 1) n = 1;
+    int limit = capacity_limit(cfg, CAPACITY_SLOTS);
+    return n > limit ? limit : n;
+}
+
+/* Copy src to out with {name} and {slot} replaced by the slot's own. */
+static void sync_slot_substitute(const char *src, const char *name, int slot_number,
+                                 char *out, size_t out_sz) {
+    size_t n = 0;
+    char num[12];
+    snprintf(num, sizeof(num), "%d", slot_number);
+    while (*src && n + 1 < out_sz) {
+        const char *with = NULL;
+        size_t skip = 0;
+        if (!strncmp(src, "{name}", 6)) {
+            with = name;
+            skip = 6;
+        } else if (!strncmp(src, "{slot}", 6)) {
+            with = num;
+            skip = 6;
+        }
+        if (!with) {
+            out[n++] = *src++;
+            continue;
+        }
+        size_t len = strlen(with);
+        if (n + len >= out_sz) break;
+        memcpy(out + n, with, len);
+        n += len;
+        src += skip;
+    }
+    out[n] = '\0';
+}
+
+/* The NAME=VALUE entries of slot slot_index as a JSON object, with {name}
+ * and {slot} in the values standing for the slot's own. */
+static JSON_Value *sync_slot_vars_json(const config_t *cfg, int slot_index, int params) {
+    const sync_slot_config_t *sc = &cfg->sync_slots[slot_index];
+    const unsigned char *ids = params ? sc->param_ids : sc->env_ids;
+    int count = params ? sc->param_count : sc->env_count;
+    JSON_Value *v = json_value_init_object();
+    for (int i = 0; i < count; i++) {
+        const char *var = ids[i] < cfg->sync_slot_var_count ? cfg->sync_slot_vars[ids[i]].text : "";
+        const char *eq = strchr(var, '=');
+        char name[64], value[160];
+        if (!eq) continue;
+        snprintf(name, sizeof(name), "%.*s", (int)(eq - var), var);
+        sync_slot_substitute(eq + 1, sc->name, slot_index + 1, value, sizeof(value));
+        json_object_set_string(json_object(v), name, value);
+    }
+    return v;
+}
+
+/* Add the slot's env (or params) to body[key] (an object, created when
+ * missing) under names it does not set yet. Returns how many were added. */
+static int sync_slot_merge_vars(const config_t *cfg, int slot_index, int params, JSON_Object *body) {
+    const char *key = params ? "params" : "env";
+    if (!(params ? cfg->sync_slots[slot_index].param_count : cfg->sync_slots[slot_index].env_count)) {
+        return 0;
+    }
+    JSON_Value *have = json_object_get_value(body, key);
+    if (have && json_value_get_type(have) != JSONObject) return 0;  /* left for /exec to refuse */
+    if (!have) {
+        have = json_value_init_object();
+        json_object_set_value(body, key, have);
+    }
+    JSON_Value *add = sync_slot_vars_json(cfg, slot_index, params);
+    int added = 0;
+    for (size_t i = 0; i < json_object_get_count(json_object(add)); i++) {
+        const char *name = json_object_get_name(json_object(add), i);
+        if (json_object_has_value(json_object(have), name)) continue;
+        json_object_set_string(json_object(have), name, json_object_get_string(json_object(add), name));
+        added++;
+    }
+    json_value_free(add);
+    return added;
+}
+
+int sync_slot_exec_context(const config_t *cfg, int slot_index, JSON_Object *exec) {
+    if (!cfg || !exec || slot_index < 0 || slot_index >= SYNC_MAX_SLOTS) return 0;
+    int added = sync_slot_merge_vars(cfg, slot_index, 0, exec);
+    added += sync_slot_merge_vars(cfg, slot_index, 1, exec);
+    return added > 0;
+}
+
+int sync_slot_health_body(const config_t *cfg, int slot_index, char *out, size_t out_sz) {
+    if (!cfg || slot_index < 0 || slot_index >= SYNC_MAX_SLOTS || !cfg->sync_slots[slot_index].health[0]) {
+        return -1;
+    }
+    const char *raw = cfg->sync_slots[slot_index].health;
+    JSON_Value *v = json_parse_string(raw);
+    char *s = v && sync_slot_exec_context(cfg, slot_index, json_object(v)) ? json_serialize_to_string(v) : NULL;
+    snprintf(out, out_sz, "%s", s && strlen(s) < out_sz ? s : raw);
+    if (s) json_free_serialized_string(s);
+    if (v) json_value_free(v);
+    return 0;
+}
+
+/* Expand a name pattern with at most one {A..B} range ("cam-{01..24}"),
+ * zero-padded to A's width when A starts with 0. Returns the number of
+ * names, or -1 when the pattern is malformed or yields more than max. */
+static int sync_expand_names(const char *pattern, char (*out)[64], int max) {
+    if (!pattern || !*pattern || strlen(pattern) >= 64) return -1;
+    const char *open = strchr(pattern, '{');
+    if (!open) {
+        if (max < 1) return -1;
+        memcpy(out[0], pattern, strlen(pattern) + 1);
+        return 1;
+    }
+    const char *close = strchr(open, '}');
+    if (!close || strchr(close + 1, '{')) return -1;
+    int a = 0, b = 0, pos = 0;
+    char tail;
+    char range[32];
+    snprintf(range, sizeof(range), "%.*s", (int)(close - open - 1), open + 1);
+    if (sscanf(range, "%d..%d%n%c", &a, &b, &pos, &tail) != 2 || a < 0 || b < a ||
+        b - a + 1 > max || range[0] == '-') {
+        return -1;
+    }
+    int width = range[0] == '0' && range[1] != '.' ? (int)(strchr(range, '.') - range) : 0;
+    int count = 0;
+    for (int v = a; v <= b; v++) {
+        snprintf(out[count++], 64, "%.*s%0*d%s", (int)(open - pattern), pattern, width, v, close + 1);
+    }
+    return count;
+}
+
+/* Whether a name can be a slot name: printable, no quotes, backslashes or
+ * glob characters, not all digits. */
+static int sync_slot_name_valid(const char *name) {
+    if (!*name || strspn(name, "0123456789") == strlen(name) || strpbrk(name, "*?[\"\\")) return 0;
+    for (const char *p = name; *p; p++) {
+        if (!isgraph((unsigned char)*p)) return 0;
+    }
+    return 1;
+}
+
+/* Create the slots of a template from slot index first on. A slot whose own
+ * section already set a field keeps it. Fills created[] with the slot
+ * indexes; returns their count, or -1 with *err (and err_name) set. */
+static int sync_template_apply(config_t *cfg, const sync_slot_template_t *t, int first,
+                               int *created, const char **err, char *err_name, size_t err_name_sz) {
+    char names[SYNC_MAX_SLOTS][64];
+    int n = sync_expand_names(t->names, names, SYNC_MAX_SLOTS);
+    *err = NULL;
+    if (n < 0) {
+        *err = "invalid_names";
+        return -1;
+    }
+    if (first < 0 || first + n > capacity_limit(cfg, CAPACITY_SLOTS)) {
+        *err = "too_many_slots";
+        capacity_reject(cfg, CAPACITY_SLOTS, first + n);
+        return -1;
+    }
+    for (int k = 0; k < n; k++) {
+        unsigned char hits[SYNC_MAX_SLOTS];
+        int used = sync_slot_match(cfg, names[k], hits);
+        if (!sync_slot_name_valid(names[k]) || (used && !(used == 1 && hits[first + k]))) {
+            *err = sync_slot_name_valid(names[k]) ? "slot_name_taken" : "invalid_names";
+            snprintf(err_name, err_name_sz, "%.63s", names[k]);
+            return -1;
+        }
+    }
+    for (int k = 0; k < n; k++) {
+        int index = first + k;
+        sync_slot_config_t *sc = &cfg->sync_slots[index];
+        if (!sc->name[0]) snprintf(sc->name, sizeof(sc->name), "%s", names[k]);
+        snprintf(sc->template_name, sizeof(sc->template_name), "%s", t->name);
+        if (!sc->prefer_id[0] && t->slot.prefer_id[0]) {
+            sync_slot_substitute(t->slot.prefer_id, sc->name, index + 1, sc->prefer_id, sizeof(sc->prefer_id));
+        }
+        if (!sc->command_count) {
+            memcpy(sc->command_ids, t->slot.command_ids, sizeof(sc->command_ids));
+            sc->command_count = t->slot.command_count;
+        }
+        if (!sc->health[0] && t->slot.health[0]) {
+            sync_slot_substitute(t->slot.health, sc->name, index + 1, sc->health, sizeof(sc->health));
+        }
+        if (!sc->health_interval_s) sc->health_interval_s = t->slot.health_interval_s;
+        if (!sc->health_failures) sc->health_failures = t->slot.health_failures;
+        if (!sc->health_failover) sc->health_failover = t->slot.health_failover;
+        if (!sc->ssh[0] && t->slot.ssh[0]) {
+            sync_slot_substitute(t->slot.ssh, sc->name, index + 1, sc->ssh, sizeof(sc->ssh));
+        }
+        if (!sc->ssh_identity[0]) {
+            snprintf(sc->ssh_identity, sizeof(sc->ssh_identity), "%s", t->slot.ssh_identity);
+        }
+        /* {name} and {slot} in env and params are filled in when used. */
+        if (!sc->env_count) {
+            memcpy(sc->env_ids, t->slot.env_ids, sizeof(sc->env_ids));
+            sc->env_count = t->slot.env_count;
+        }
+        if (!sc->param_count) {
+            memcpy(sc->param_ids, t->slot.param_ids, sizeof(sc->param_ids));
+            sc->param_count = t->slot.param_count;
+        }
+        created[k] = index;
+    }
+    return n;
+}
+
+void sync_cfg_expand_templates(config_t *cfg) {
+    if (!cfg) return;
+    for (int i = 0; i < cfg->sync_slot_template_count; i++) {
+        const sync_slot_template_t *t = &cfg->sync_slot_templates[i];
+        if (!t->names[0]) {
+            fprintf(stderr, "WARN: sync template %s has no names, no slots created\n", t->name);
+            continue;
+        }
+        int first = t->first > 0 ? t->first - 1 : sync_slot_highest_defined(cfg);
+        int created[SYNC_MAX_SLOTS];
+        const char *err = NULL;
+        char name[64] = "";
+        int n = sync_template_apply(cfg, t, first, created, &err, name, sizeof(name));
+        if (n < 0) {
+            fprintf(stderr, "WARN: sync template %s: %s%s%s, no slots created\n", t->name, err,
+                    name[0] ? " " : "", name);
+            continue;
+        }
+        fprintf(stderr, "sync: template %s created slots %d-%d\n", t->name, first + 1, first + n);
+    }
+}
+
 void sync_slave_state_init(sync_slave_state_t *state) {
     if (!state) return;
     pthread_mutex_init(&state->lock, NULL);
@@ -178,15 +861,31 @@ void sync_slave_state_init(sync_slave_state_t *state) {
     state->last_received_generation = 0;
     state->current_slot = -1;
     state->current_slot_label[0] = '\0';
+    state->advertised_address[0] = '\0';
 }
 
 void sync_master_state_init(sync_master_state_t *state) {
     if (!state) return;
     pthread_mutex_init(&state->lock, NULL);
     memset(state->records, 0, sizeof(state->records));
+    memset(state->expected, 0, sizeof(state->expected));
     memset(state->slot_generation, 0, sizeof(state->slot_generation));
     memset(state->slot_assignees, 0, sizeof(state->slot_assignees));
     memset(state->slot_manual_overrides, 0, sizeof(state->slot_manual_overrides));
+    memset(state->slot_overrides, 0, sizeof(state->slot_overrides));
+    memset(state->binding_log, 0, sizeof(state->binding_log));
+    state->binding_log_total = 0;
+    memset(state->claims, 0, sizeof(state->claims));
+    memset(state->desired, 0, sizeof(state->desired));
+    state->desired_count = 0;
+    memset(state->retired, 0, sizeof(state->retired));
+    state->version = 1;
+    state->modified_unix = (long long)time(NULL);
+    state->slaves_cache = NULL;
+    state->slaves_cache_len = 0;
+    state->slaves_cache_version = 0;
+    state->running = 0;
+    state->stop = 0;
 }
 
 void sync_slave_reset_tracking(sync_slave_state_t *state) {
@@ -261,6 +960,11 @@ void sync_slave_get_current_slot_label(sync_slave_state_t *state, char *out, siz
     pthread_mutex_unlock(&state->lock);
 }
 
+static void sync_master_touch_locked(sync_master_state_t *state) {
+    state->version++;
+    state->modified_unix = (long long)time(NULL);
+}
+
 static sync_slave_record_t *sync_master_find_record(sync_master_state_t *state, const char *id, int create) {
     if (!state || !id || !*id) return NULL;
     sync_slave_record_t *slot = NULL;
@@ -271,6 +975,7 @@ static sync_slave_record_t *sync_master_find_record(sync_master_state_t *state,
         if (!state->records[i].in_use && !slot) slot = &state->records[i];
     }
     if (!create || !slot) return NULL;
+    sync_master_touch_locked(state);
     memset(slot, 0, sizeof(*slot));
     slot->in_use = 1;
     strncpy(slot->id, id, sizeof(slot->id) - 1);
@@ -278,11 +983,142 @@ static sync_slave_record_t *sync_master_find_record(sync_master_state_t *state,
     slot->slot_index = -1;
     slot->last_reported_slot_index = -1;
     slot->last_ack_generation = 0;
+    slot->load = -1;
+    slot->probe_ms = -2;
     return slot;
 }
 
+static sync_expected_node_t *sync_master_find_expected_locked(sync_master_state_t *state,
+                                                              const char *id) {
+    if (!id || !*id) return NULL;
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        if (state->expected[i].in_use && strcmp(state->expected[i].id, id) == 0) {
+            return &state->expected[i];
+        }
+    }
+    return NULL;
+}
+
+static sync_retired_node_t *sync_master_find_retired_locked(sync_master_state_t *state,
+                                                            const char *id) {
+    if (!id || !*id) return NULL;
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        if (state->retired[i].id[0] && strcmp(state->retired[i].id, id) == 0) {
+            return &state->retired[i];
+        }
+    }
+    return NULL;
+}
+
+/* A slot hinted for an imported node that has not registered yet is kept
+ * for it while other free slots remain. */
+static int sync_master_slot_reserved_locked(const sync_master_state_t *state,
+                                            int slot_index, const char *id) {
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        const sync_expected_node_t *e = &state->expected[i];
+        if (!e->in_use || e->first_seen_ms > 0 || e->slot_hint != slot_index) continue;
+        if (id && strcmp(e->id, id) == 0) continue;
+        return 1;
+    }
+    return 0;
+}
+
+/* Label key of a node: an operator annotation wins over the imported labels. */
+static int sync_master_node_label_locked(sync_master_state_t *state, const char *id,
+                                         const char *key, char *out, size_t out_sz) {
+    if (nodemeta_get_label(id, key, out, out_sz) == 0) return 0;
+    const sync_expected_node_t *exp = sync_master_find_expected_locked(state, id);
+    if (!exp || !exp->labels[0]) return -1;
+    JSON_Value *v = json_parse_string(exp->labels);
+    const char *value = json_object_get_string(json_object(v), key);
+    int rc = -1;
+    if (value) {
+        snprintf(out, out_sz, "%s", value);
+        rc = 0;
+    }
+    if (v) json_value_free(v);
+    return rc;
+}
+
+int sync_master_node_label(app_t *app, const char *id, const char *key, char *out, size_t out_sz) {
+    pthread_mutex_lock(&app->master.lock);
+    int rc = sync_master_node_label_locked(&app->master, id, key, out, out_sz);
+    pthread_mutex_unlock(&app->master.lock);
+    return rc;
+}
+
+static int sync_discovery_label(void *ud, const char *id, const char *key, char *out,
+                                size_t out_sz) {
+    return sync_master_node_label_locked((sync_master_state_t *)ud, id, key, out, out_sz);
+}
+
+static int sync_caps_contains(const char *caps, const char *cap, size_t cap_len) {
+    const char *p = caps;
+    while (p && *p) {
+        const char *end = strchr(p, ',');
+        size_t n = end ? (size_t)(end - p) : strlen(p);
+        if (n == cap_len && strncmp(p, cap, n) == 0) return 1;
+        p = end ? end + 1 : NULL;
+    }
+    return 0;
+}
+
+/* Returns NULL when rec satisfies every constraint of g, else the first
+ * constraint it fails. */
+static const char *sync_desired_mismatch_locked(sync_master_state_t *state,
+                                                const sync_desired_group_t *g,
+                                                const sync_slave_record_t *rec) {
+    if (g->id_count > 0) {
+        int found = 0;
+        for (int i = 0; i < g->id_count && !found; i++) found = !strcmp(g->ids[i], rec->id);
+        if (!found) return "ids";
+    }
+    if (g->device[0] && strcmp(g->device, rec->device) != 0) return "device";
+    if (g->role[0] && strcmp(g->role, rec->role) != 0) return "role";
+    const char *p = g->caps;
+    while (*p) {
+        const char *end = strchr(p, ',');
+        size_t n = end ? (size_t)(end - p) : strlen(p);
+        if (!sync_caps_contains(rec->caps, p, n)) return "caps";
+        if (!end) break;
+        p = end + 1;
+    }
+    for (int i = 0; i < g->label_count; i++) {
+        char value[64];
+        if (sync_master_node_label_locked(state, rec->id, g->labels[i].key, value,
+                                          sizeof(value)) != 0 ||
+            strcmp(value, g->labels[i].value) != 0) {
+            return "labels";
+        }
+    }
+    return NULL;
+}
+
+static sync_desired_group_t *sync_desired_group_for_slot(sync_master_state_t *state,
+                                                         int slot_index) {
+    if (slot_index < 0 || slot_index >= SYNC_MAX_SLOTS) return NULL;
+    for (int i = 0; i < state->desired_count; i++) {
+        if (state->desired[i].slots[slot_index]) return &state->desired[i];
+    }
+    return NULL;
+}
+
+/* Whether rec may hold slot_index: it is not refused for its version, and
+ * the slot is outside the desired topology or rec passes its group's
+ * constraints. */
+static int sync_master_slot_accepts_locked(sync_master_state_t *state, int slot_index,
+                                           const sync_slave_record_t *rec) {
+    if (rec->dispatch_refused || rec->bench || rec->decommission_ms ||
+        state->slot_agentless[slot_index]) {
+        return 0;
+    }
+    const sync_desired_group_t *g = sync_desired_group_for_slot(state, slot_index);
+    return !g || !sync_desired_mismatch_locked(state, g, rec);
+}
+
 static int sync_master_mark_slot_generation(sync_master_state_t *state, int slot_index) {
     if (!state || slot_index < 0 || slot_index >= SYNC_MAX_SLOTS) return 0;
+    sync_master_touch_locked(state);
     int gen = state->slot_generation[slot_index] + 1;
     if (gen < 1) gen = 1;
     state->slot_generation[slot_index] = gen;
@@ -302,6 +1138,22 @@ static int sync_master_slot_matches(const sync_master_state_t *state,
     return memcmp(state->slot_assignees[slot_index], id, slot_len) == 0;
 }
 
+/* Forget pending claims by id (NULL = any) for slot_index (-1 = any). */
+static int sync_master_drop_claims_locked(sync_master_state_t *state, const char *id,
+                                          int slot_index) {
+    int dropped = 0;
+    for (int i = 0; i < SYNC_MAX_CLAIMS; i++) {
+        sync_slot_claim_t *cl = &state->claims[i];
+        if (!cl->in_use) continue;
+        if (id && strcmp(cl->id, id) != 0) continue;
+        if (slot_index >= 0 && cl->slot_index != slot_index) continue;
+        memset(cl, 0, sizeof(*cl));
+        dropped++;
+    }
+    if (dropped) sync_master_touch_locked(state);
+    return dropped;
+}
+
 static void sync_master_release_slot_locked(sync_master_state_t *state,
                                             int slot_index) {
     if (!state || slot_index < 0 || slot_index >= SYNC_MAX_SLOTS) return;
@@ -318,16 +1170,78 @@ static void sync_master_release_slot_locked(sync_master_state_t *state,
     sync_master_mark_slot_generation(state, slot_index);
 }
 
-static int sync_master_delete_record_locked(sync_master_state_t *state,
-                                            const char *id) {
-    if (!state || !id || !*id) return 0;
-    sync_slave_record_t *rec = sync_master_find_record(state, id, 0);
-    if (!rec || !rec->in_use) return 0;
-    if (rec->slot_index >= 0 && rec->slot_index < SYNC_MAX_SLOTS &&
-        sync_master_slot_matches(state, rec->slot_index, rec->id)) {
-        sync_master_release_slot_locked(state, rec->slot_index);
+/* Mirror which slots are agentless (ssh) and take them back from any slave
+ * that holds one, e.g. after ssh was added to the slot's config. */
+static void sync_master_note_agentless_locked(sync_master_state_t *state,
+                                              const config_t *cfg) {
+    if (!state || !cfg) return;
+    for (int i = 0; i < SYNC_MAX_SLOTS; i++) {
+        state->slot_agentless[i] = cfg->sync_slots[i].ssh[0] != '\0';
+        if (state->slot_agentless[i] && state->slot_assignees[i][0]) {
+            fprintf(stderr, "sync master: slot %d is agentless, releasing it from %s\n",
+                    i + 1, state->slot_assignees[i]);
+            sync_master_release_slot_locked(state, i);
+        }
     }
-    memset(rec, 0, sizeof(*rec));
+}
+
+static int sync_master_count_bench_locked(const sync_master_state_t *state) {
+    int n = 0;
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        if (state->records[i].in_use && state->records[i].bench) n++;
+    }
+    return n;
+}
+
+static int sync_master_count_nodes_locked(const sync_master_state_t *state) {
+    int n = 0;
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        if (state->records[i].in_use && !state->records[i].bench) n++;
+    }
+    return n;
+}
+
+int sync_master_group_slots(app_t *app, const char *name, unsigned char want[SYNC_MAX_SLOTS]) {
+    memset(want, 0, SYNC_MAX_SLOTS);
+    if (!app || !name || !*name) return -1;
+    int rc = -1;
+    pthread_mutex_lock(&app->master.lock);
+    for (int i = 0; i < app->master.desired_count && rc != 0; i++) {
+        if (strcmp(app->master.desired[i].name, name) != 0) continue;
+        memcpy(want, app->master.desired[i].slots, SYNC_MAX_SLOTS);
+        rc = 0;
+    }
+    pthread_mutex_unlock(&app->master.lock);
+    return rc;
+}
+
+int sync_master_registry_count(app_t *app, long long stale_ms, int *stale) {
+    long long cutoff = now_ms() - stale_ms;
+    int n = 0, idle = 0;
+    pthread_mutex_lock(&app->master.lock);
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        const sync_slave_record_t *rec = &app->master.records[i];
+        if (!rec->in_use || rec->bench) continue;
+        n++;
+        if (rec->slot_index < 0 && rec->last_seen_ms > 0 && rec->last_seen_ms < cutoff) idle++;
+    }
+    pthread_mutex_unlock(&app->master.lock);
+    if (stale) *stale = idle;
+    return n;
+}
+
+static int sync_master_delete_record_locked(sync_master_state_t *state,
+                                            const char *id) {
+    if (!state || !id || !*id) return 0;
+    sync_slave_record_t *rec = sync_master_find_record(state, id, 0);
+    if (!rec || !rec->in_use) return 0;
+    if (rec->slot_index >= 0 && rec->slot_index < SYNC_MAX_SLOTS &&
+        sync_master_slot_matches(state, rec->slot_index, rec->id)) {
+        sync_master_release_slot_locked(state, rec->slot_index);
+    }
+    sync_master_drop_claims_locked(state, rec->id, -1);
+    memset(rec, 0, sizeof(*rec));
+    sync_master_touch_locked(state);
     return 1;
 }
 
@@ -365,7 +1279,9 @@ static void sync_master_prune_locked(sync_master_state_t *state,
         if (rec->slot_index >= 0) continue;
         if (rec->last_seen_ms <= 0) continue;
         if (rec->last_seen_ms < cutoff) {
+            sync_master_drop_claims_locked(state, rec->id, -1);
             memset(rec, 0, sizeof(*rec));
+            sync_master_touch_locked(state);
         }
     }
 }
@@ -386,10 +1302,12 @@ static int sync_master_assign_slot_locked(sync_master_state_t *state,
                                           sync_slave_record_t *rec,
                                           int slot_index,
                                           int preserve_override) {
-    if (!state || !rec || slot_index < 0 || slot_index >= SYNC_MAX_SLOTS) {
+    if (!state || !rec || slot_index < 0 || slot_index >= SYNC_MAX_SLOTS ||
+        state->slot_agentless[slot_index]) {
         return -1;
     }
 
+    sync_master_touch_locked(state);
     unsigned char had_override = 0;
     if (preserve_override && state->slot_manual_overrides[slot_index]) {
         had_override = state->slot_manual_overrides[slot_index];
@@ -438,9 +1356,23 @@ static int sync_master_auto_assign_slot_locked_impl(sync_master_state_t *state,
                                                     const config_t *cfg,
                                                     int forbid_slot) {
     if (!state || !rec) return -1;
-
-    if (rec->slot_index >= 0 && rec->slot_index < SYNC_MAX_SLOTS) {
-        if (rec->slot_index == forbid_slot) {
+    int slots = sync_slot_count(cfg);
+
+    sync_master_touch_locked(state);
+    sync_master_note_agentless_locked(state, cfg);
+    /* A node refused for its API version is not given (or kept in) a slot,
+     * nor is a bench node or one being decommissioned. */
+    if (rec->dispatch_refused || rec->bench || rec->decommission_ms) {
+        if (rec->slot_index >= 0 && rec->slot_index < SYNC_MAX_SLOTS &&
+            sync_master_slot_matches(state, rec->slot_index, rec->id)) {
+            sync_master_release_slot_locked(state, rec->slot_index);
+        }
+        rec->slot_index = -1;
+        return -1;
+    }
+    if (rec->slot_index >= 0 && rec->slot_index < slots) {
+        if (rec->slot_index == forbid_slot ||
+            !sync_master_slot_accepts_locked(state, rec->slot_index, rec)) {
             rec->slot_index = -1;
         } else if (!sync_master_slot_matches(state, rec->slot_index, rec->id)) {
             (void)sync_master_assign_slot_locked(state, rec, rec->slot_index, 1);
@@ -454,15 +1386,17 @@ static int sync_master_auto_assign_slot_locked_impl(sync_master_state_t *state,
     }
 
     int preferred_slot = sync_preferred_slot_for_id(cfg, rec->id);
-    if (preferred_slot >= 0 && preferred_slot < SYNC_MAX_SLOTS &&
+    if (preferred_slot >= 0 && preferred_slot < slots &&
         preferred_slot != forbid_slot) {
         if (state->slot_manual_overrides[preferred_slot] &&
             state->slot_assignees[preferred_slot][0] &&
             strcmp(state->slot_assignees[preferred_slot], rec->id) != 0) {
             preferred_slot = -1;
+        } else if (!sync_master_slot_accepts_locked(state, preferred_slot, rec)) {
+            preferred_slot = -1;
         }
     }
-    if (preferred_slot >= 0 && preferred_slot < SYNC_MAX_SLOTS &&
+    if (preferred_slot >= 0 && preferred_slot < slots &&
         preferred_slot != forbid_slot) {
         char displaced_id[64];
         displaced_id[0] = '\0';
@@ -485,7 +1419,7 @@ static int sync_master_auto_assign_slot_locked_impl(sync_master_state_t *state,
         return preferred_slot;
     }
 
-    for (int i = 0; i < SYNC_MAX_SLOTS; i++) {
+    for (int i = 0; i < slots; i++) {
         if (i == forbid_slot) continue;
         if (sync_master_slot_matches(state, i, rec->id)) {
             (void)sync_master_assign_slot_locked(state, rec, i, 1);
@@ -493,11 +1427,25 @@ static int sync_master_auto_assign_slot_locked_impl(sync_master_state_t *state,
         }
     }
 
-    for (int i = 0; i < SYNC_MAX_SLOTS; i++) {
-        if (i == forbid_slot) continue;
-        if (state->slot_assignees[i][0]) continue;
-        (void)sync_master_assign_slot_locked(state, rec, i, 1);
-        return i;
+    const sync_expected_node_t *exp = sync_master_find_expected_locked(state, rec->id);
+    if (exp && exp->slot_hint >= 0 && exp->slot_hint < slots &&
+        exp->slot_hint != forbid_slot && !state->slot_assignees[exp->slot_hint][0] &&
+        !state->slot_agentless[exp->slot_hint] &&
+        !sync_desired_group_for_slot(state, exp->slot_hint)) {
+        (void)sync_master_assign_slot_locked(state, rec, exp->slot_hint, 1);
+        return exp->slot_hint;
+    }
+
+    for (int pass = 0; pass < 2; pass++) {
+        for (int i = 0; i < slots; i++) {
+            if (i == forbid_slot || state->slot_agentless[i]) continue;
+            if (state->slot_assignees[i][0]) continue;
+            /* The reconcile pass fills slots of the desired topology. */
+            if (sync_desired_group_for_slot(state, i)) continue;
+            if (pass == 0 && sync_master_slot_reserved_locked(state, i, rec->id)) continue;
+            (void)sync_master_assign_slot_locked(state, rec, i, 1);
+            return i;
+        }
     }
     return -1;
 }
@@ -514,6 +1462,7 @@ static void sync_master_apply_slot_assignment_locked(sync_master_state_t *state,
                                                      const char *new_id) {
     if (!state || slot_index < 0 || slot_index >= SYNC_MAX_SLOTS) return;
 
+    sync_master_touch_locked(state);
     const char *current = state->slot_assignees[slot_index];
     int current_has = current && *current;
     int new_has = new_id && *new_id;
@@ -562,6 +1511,128 @@ static void sync_master_apply_slot_assignment_locked(sync_master_state_t *state,
     sync_master_mark_slot_generation(state, slot_index);
 }
 
+static void sync_master_copy_assignees_locked(const sync_master_state_t *state,
+                                              char out[SYNC_MAX_SLOTS][64]) {
+    for (int i = 0; i < SYNC_MAX_SLOTS; i++) {
+        memcpy(out[i], state->slot_assignees[i], sizeof(out[i]));
+        out[i][sizeof(out[i]) - 1] = '\0';
+    }
+}
+
+/*
+ * Compare the current slot assignees against a copy taken before an operation
+ * and append one binding log entry (plus a slot_binding event) per slot that
+ * changed. Callers pass the reason for the whole operation; an automatic
+ * assignment that hands a slot to its prefer_id is reported as "preferred".
+ */
+static void sync_master_log_binding_changes_locked(sync_master_state_t *state,
+                                                   const config_t *cfg,
+                                                   char before[SYNC_MAX_SLOTS][64],
+                                                   const char *reason,
+                                                   const char *actor) {
+    if (!state || !before) return;
+    long long now = now_ms();
+    for (int slot = 0; slot < SYNC_MAX_SLOTS; slot++) {
+        const char *old_id = before[slot];
+        const char *new_id = state->slot_assignees[slot];
+        if (strcmp(old_id, new_id) == 0) continue;
+
+        const char *why = reason ? reason : "auto";
+        if (!strcmp(why, "auto") && new_id[0] && cfg &&
+            cfg->sync_slots[slot].prefer_id[0] &&
+            strcmp(cfg->sync_slots[slot].prefer_id, new_id) == 0) {
+            why = "preferred";
+        }
+
+        sync_binding_change_t *e =
+            &state->binding_log[state->binding_log_total % SYNC_BINDING_LOG_MAX];
+        memset(e, 0, sizeof(*e));
+        e->ts_ms = now;
+        e->ts_unix_ms = jobs_unix_ms();
+        e->slot_index = slot;
+        strncpy(e->old_id, old_id, sizeof(e->old_id) - 1);
+        strncpy(e->new_id, new_id, sizeof(e->new_id) - 1);
+        strncpy(e->reason, why, sizeof(e->reason) - 1);
+        strncpy(e->actor, actor ? actor : "", sizeof(e->actor) - 1);
+        state->binding_log_total++;
+        sync_master_touch_locked(state);
+
+        fprintf(stderr, "sync master: slot %d binding %s -> %s (%s, by %s)\n",
+                slot + 1, old_id[0] ? old_id : "-", new_id[0] ? new_id : "-",
+                why, e->actor[0] ? e->actor : "-");
+
+        JSON_Value *ev = json_value_init_object();
+        JSON_Object *eo = json_object(ev);
+        json_object_set_number(eo, "slot", slot + 1);
+        if (old_id[0]) json_object_set_string(eo, "old_id", old_id);
+        else json_object_set_null(eo, "old_id");
+        if (new_id[0]) json_object_set_string(eo, "new_id", new_id);
+        else json_object_set_null(eo, "new_id");
+        json_object_set_string(eo, "reason", why);
+        if (e->actor[0]) json_object_set_string(eo, "actor", e->actor);
+        (void)events_emit("slot_binding", ev);
+    }
+}
+
+/* A slave whose id scheme changed registers with the id it used before as
+ * previous_id. Its record, slot and temporary bindings move to the new id
+ * instead of the old record lingering next to a new one. Returns 1 when
+ * previous was renamed. */
+static int sync_master_rename_locked(sync_master_state_t *state, const config_t *cfg,
+                                     const char *previous, const char *id) {
+    sync_slave_record_t *rec = sync_master_find_record(state, previous, 0);
+    if (!rec || rec->bench || rec->decommission_ms > 0 || sync_master_find_record(state, id, 0)) {
+        return 0;
+    }
+    char before[SYNC_MAX_SLOTS][64];
+    sync_master_copy_assignees_locked(state, before);
+    snprintf(rec->id, sizeof(rec->id), "%s", id);
+    for (int i = 0; i < SYNC_MAX_SLOTS; i++) {
+        if (!strcmp(state->slot_assignees[i], previous)) {
+            snprintf(state->slot_assignees[i], sizeof(state->slot_assignees[i]), "%s", id);
+        }
+        sync_slot_override_t *ov = &state->slot_overrides[i];
+        if (!strcmp(ov->id, previous)) snprintf(ov->id, sizeof(ov->id), "%s", id);
+        if (!strcmp(ov->previous_id, previous)) snprintf(ov->previous_id, sizeof(ov->previous_id), "%s", id);
+    }
+    sync_master_log_binding_changes_locked(state, cfg, before, "renamed", id);
+    sync_master_touch_locked(state);
+    fprintf(stderr, "sync master: %s now registers as %s, record moved\n", previous, id);
+    for (int i = 0; i < sync_slot_count(cfg); i++) {
+        if (!strcmp(cfg->sync_slots[i].prefer_id, previous)) {
+            fprintf(stderr, "WARN: sync: slot %d prefer_id still names %s, now %s\n", i + 1, previous, id);
+        }
+    }
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_string(eo, "id", id);
+    json_object_set_string(eo, "previous_id", previous);
+    (void)events_emit("node_renamed", ev);
+    return 1;
+}
+
+int sync_master_slot_binding(app_t *app, int slot_index, const char *id, char *reason,
+                             size_t reason_sz, char *from, size_t from_sz) {
+    if (!app || slot_index < 0 || slot_index >= SYNC_MAX_SLOTS || !id || !*id) return -1;
+    sync_master_state_t *state = &app->master;
+    int rc = -1;
+    pthread_mutex_lock(&state->lock);
+    if (!strcmp(state->slot_assignees[slot_index], id)) {
+        unsigned total = state->binding_log_total;
+        unsigned kept = total < SYNC_BINDING_LOG_MAX ? total : SYNC_BINDING_LOG_MAX;
+        for (unsigned k = 1; k <= kept && rc != 0; k++) {
+            const sync_binding_change_t *e = &state->binding_log[(total - k) % SYNC_BINDING_LOG_MAX];
+            if (e->slot_index != slot_index) continue;
+            if (strcmp(e->new_id, id) != 0) break;
+            snprintf(reason, reason_sz, "%s", e->reason);
+            snprintf(from, from_sz, "%s", e->old_id);
+            rc = 0;
+        }
+    }
+    pthread_mutex_unlock(&state->lock);
+    return rc;
+}
+
 static JSON_Value *sync_master_build_slot_commands(const config_t *cfg,
                                                    int slot_index) {
     if (!cfg || slot_index < 0 || slot_index >= SYNC_MAX_SLOTS) return NULL;
@@ -572,8 +1643,12 @@ static JSON_Value *sync_master_build_slot_commands(const config_t *cfg,
 
     const sync_slot_config_t *slot = &cfg->sync_slots[slot_index];
     for (int i = 0; i < slot->command_count; i++) {
-        const char *raw = slot->commands[i].json;
+        const char *raw = cfg->sync_slot_commands[slot->command_ids[i]].json;
+        char expanded[sizeof(cfg->sync_slot_commands[0].json) + 128];
         if (!raw[0]) continue;
+        /* Commands are shared between slots; {name} and {slot} are this slot's. */
+        sync_slot_substitute(raw, slot->name, slot_index + 1, expanded, sizeof(expanded));
+        raw = expanded;
         JSON_Value *cmd = json_parse_string(raw);
         if (!cmd || json_value_get_type(cmd) != JSONObject) {
             if (cmd) json_value_free(cmd);
@@ -582,6 +1657,7 @@ static JSON_Value *sync_master_build_slot_commands(const config_t *cfg,
                     slot_index + 1, raw);
             continue;
         }
+        (void)sync_slot_exec_context(cfg, slot_index, json_object(cmd));
         json_array_append_value(arr, cmd);
     }
 
@@ -589,52 +1665,7 @@ static JSON_Value *sync_master_build_slot_commands(const config_t *cfg,
 }
 
 static int parse_http_url(const char *url, http_url_t *out) {
-    if (!url || !out) return -1;
-    memset(out, 0, sizeof(*out));
-    const char *p = NULL;
-    if (strncmp(url, "http://", 7) == 0) {
-        p = url + 7;
-    } else {
-        return -1;
-    }
-
-    const char *slash = strchr(p, '/');
-    size_t host_len = slash ? (size_t)(slash - p) : strlen(p);
-    if (host_len == 0 || host_len >= sizeof(out->host)) return -1;
-
-    const char *colon = memchr(p, ':', host_len);
-    if (colon) {
-        size_t name_len = (size_t)(colon - p);
-        if (name_len == 0 || name_len >= sizeof(out->host)) return -1;
-        memcpy(out->host, p, name_len);
-        out->host[name_len] = '\0';
-        const char *port_str = colon + 1;
-        size_t port_len = host_len - name_len - 1;
-        if (port_len == 0 || port_len >= 16) return -1;
-        char tmp[16];
-        memcpy(tmp, port_str, port_len);
-        tmp[port_len] = '\0';
-        out->port = atoi(tmp);
-        if (out->port <= 0 || out->port > 65535) return -1;
-    } else {
-        memcpy(out->host, p, host_len);
-        out->host[host_len] = '\0';
-        out->port = 80;
-    }
-
-    if (slash && *(slash) != '\0') {
-        strncpy(out->path, slash, sizeof(out->path) - 1);
-        out->path[sizeof(out->path) - 1] = '\0';
-    } else {
-        strncpy(out->path, "/sync/register", sizeof(out->path) - 1);
-        out->path[sizeof(out->path) - 1] = '\0';
-    }
-
-    if (!out->path[0]) {
-        strncpy(out->path, "/sync/register", sizeof(out->path) - 1);
-        out->path[sizeof(out->path) - 1] = '\0';
-    }
-    return 0;
+    return httpc_parse_url(url, out, AUTOD_PEER_PREFIX "/sync/register");
 }
 
 static int parse_sync_reference(const char *ref, char *id_out, size_t id_sz,
@@ -661,7 +1692,7 @@ static int parse_sync_reference(const char *ref, char *id_out, size_t id_sz,
             strncpy(path_out, slash, path_sz - 1);
             path_out[path_sz - 1] = '\0';
         } else {
-            strncpy(path_out, "/sync/register", path_sz - 1);
+            strncpy(path_out, AUTOD_PEER_PREFIX "/sync/register", path_sz - 1);
             path_out[path_sz - 1] = '\0';
         }
     }
@@ -734,152 +1765,36 @@ static int sync_normalize_master_reference(const char *value, char *out, size_t
 
     if (!matched_id) return -1;
 
-    const char *path = parsed.path[0] ? parsed.path : "/sync/register";
+    const char *path = parsed.path[0] ? parsed.path : AUTOD_PEER_PREFIX "/sync/register";
     int w = snprintf(out, out_sz, "sync://%s%s", matched_id, path);
     if (w < 0 || (size_t)w >= out_sz) return -1;
     return 0;
 }
 
-static int http_post_json_simple(const http_url_t *url, const char *body,
-                                 char **resp_body, size_t *resp_len,
-                                 int timeout_ms) {
-    if (!url) return -1;
-    if (resp_body) *resp_body = NULL;
-    if (resp_len) *resp_len = 0;
-
-    char portbuf[16];
-    snprintf(portbuf, sizeof(portbuf), "%d", url->port > 0 ? url->port : 80);
-
-    struct addrinfo hints; memset(&hints, 0, sizeof(hints));
-    hints.ai_family = AF_UNSPEC;
-    hints.ai_socktype = SOCK_STREAM;
-    hints.ai_protocol = IPPROTO_TCP;
-
-    struct addrinfo *res = NULL;
-    int gai = getaddrinfo(url->host, portbuf, &hints, &res);
-    if (gai != 0) return -1;
-
-    int fd = -1;
-    for (struct addrinfo *ai = res; ai; ai = ai->ai_next) {
-        fd = socket(ai->ai_family, ai->ai_socktype, ai->ai_protocol);
-        if (fd < 0) continue;
-        if (timeout_ms > 0) {
-            struct timeval tv;
-            tv.tv_sec = timeout_ms / 1000;
-            tv.tv_usec = (timeout_ms % 1000) * 1000;
-            setsockopt(fd, SOL_SOCKET, SO_RCVTIMEO, &tv, sizeof(tv));
-            setsockopt(fd, SOL_SOCKET, SO_SNDTIMEO, &tv, sizeof(tv));
-        }
-        if (connect(fd, ai->ai_addr, ai->ai_addrlen) == 0) {
-            break;
-        }
-        close(fd);
-        fd = -1;
-    }
-    freeaddrinfo(res);
-    if (fd < 0) return -1;
-
-    size_t body_len = body ? strlen(body) : 0;
-    char header[512];
-    int header_len = snprintf(header, sizeof(header),
-                              "POST %s HTTP/1.1\r\n"
-                              "Host: %s\r\n"
-                              "Content-Type: application/json\r\n"
-                              "Content-Length: %zu\r\n"
-                              "Connection: close\r\n\r\n",
-                              url->path[0] ? url->path : "/",
-                              url->host,
-                              body_len);
-    if (header_len <= 0 || header_len >= (int)sizeof(header)) {
-        close(fd);
-        return -1;
-    }
-
-    ssize_t sent = send(fd, header, (size_t)header_len, 0);
-    if (sent != header_len) {
-        close(fd);
-        return -1;
-    }
-    if (body_len > 0) {
-        ssize_t bsent = send(fd, body, body_len, 0);
-        if (bsent != (ssize_t)body_len) {
-            close(fd);
-            return -1;
-        }
-    }
-
-    char *buffer = NULL;
-    size_t total = 0;
-    const size_t max_resp = 65536;
-    char tmpbuf[1024];
-    for (;;) {
-        ssize_t r = recv(fd, tmpbuf, sizeof(tmpbuf), 0);
-        if (r < 0) {
-            if (errno == EINTR) continue;
-            if (errno == EAGAIN || errno == EWOULDBLOCK) break;
-            free(buffer);
-            close(fd);
-            return -1;
-        }
-        if (r == 0) break;
-        if (total + (size_t)r > max_resp) {
-            free(buffer);
-            close(fd);
-            return -1;
-        }
-        char *nbuf = (char *)realloc(buffer, total + (size_t)r + 1);
-        if (!nbuf) {
-            free(buffer);
-            close(fd);
-            return -1;
-        }
-        buffer = nbuf;
-        memcpy(buffer + total, tmpbuf, (size_t)r);
-        total += (size_t)r;
-        buffer[total] = '\0';
-    }
-    close(fd);
-
-    if (!buffer) return -1;
-
-    char *line_end = strstr(buffer, "\r\n");
-    if (!line_end) { free(buffer); return -1; }
-    int status = 0;
-    sscanf(buffer, "HTTP/%*s %d", &status);
-
-    char *body_start = strstr(buffer, "\r\n\r\n");
-    if (!body_start) body_start = line_end;
-    if (body_start) {
-        body_start += 4;
-    } else {
-        body_start = buffer;
-    }
-    size_t body_size = total - (size_t)(body_start - buffer);
-    char *body_copy = (char *)malloc(body_size + 1);
-    if (!body_copy) {
-        free(buffer);
-        return -1;
-    }
-    memcpy(body_copy, body_start, body_size);
-    body_copy[body_size] = '\0';
-
-    if (resp_body) *resp_body = body_copy;
-    else free(body_copy);
-    if (resp_len) *resp_len = body_size;
-
-    free(buffer);
-    return status;
-}
-
 static int sync_slave_resolve_target(app_t *app, const config_t *cfg,
                                      http_url_t *target, char *resolved_id,
                                      size_t resolved_sz) {
     if (!cfg || !target) return -1;
 
+    /* Only the slave thread resolves the master, so one note suffices. */
+    static char fallback_logged[128];
+    char remembered[16];
     if (parse_http_url(cfg->sync_master_url, target) == 0) {
         if (resolved_id && resolved_sz > 0) {
             resolved_id[0] = '\0';
         }
+        if (dnscache_is_hostname(target->host) &&
+            dnscache_resolve(target->host, cfg->sync_dns_ttl_s, remembered, sizeof(remembered)) != 0 &&
+            dnscache_book_host(target->host, remembered, sizeof(remembered)) == 0) {
+            if (strcmp(fallback_logged, target->host) != 0) {
+                fprintf(stderr, "sync slave: cannot resolve %s, using its last known address %s\n",
+                        target->host, remembered);
+                snprintf(fallback_logged, sizeof(fallback_logged), "%s", target->host);
+            }
+            snprintf(target->host, sizeof(target->host), "%s", remembered);
+        } else {
+            fallback_logged[0] = '\0';
+        }
         return 0;
     }
 
@@ -904,13 +1819,35 @@ static int sync_slave_resolve_target(app_t *app, const config_t *cfg,
         strncpy(target->path, path, sizeof(target->path) - 1);
         target->path[sizeof(target->path) - 1] = '\0';
         if (!target->path[0]) {
-            strncpy(target->path, "/sync/register", sizeof(target->path) - 1);
+            strncpy(target->path, AUTOD_PEER_PREFIX "/sync/register", sizeof(target->path) - 1);
             target->path[sizeof(target->path) - 1] = '\0';
         }
         if (resolved_id && resolved_sz > 0) {
             strncpy(resolved_id, sync_id, resolved_sz - 1);
             resolved_id[resolved_sz - 1] = '\0';
         }
+        dnscache_book_note_node(sync_id, target->host, target->port);
+        fallback_logged[0] = '\0';
+        return 0;
+    }
+
+    /* Discovery has not found the master (yet): try where it was last. */
+    int port = 0;
+    if (dnscache_book_node(sync_id, remembered, sizeof(remembered), &port) == 0 && port > 0) {
+        if (strcmp(fallback_logged, sync_id) != 0) {
+            fprintf(stderr, "sync slave: master %s not discovered, using its last known address %s:%d\n",
+                    sync_id, remembered, port);
+            snprintf(fallback_logged, sizeof(fallback_logged), "%s", sync_id);
+        }
+        memset(target, 0, sizeof(*target));
+        snprintf(target->host, sizeof(target->host), "%s", remembered);
+        target->port = port;
+        snprintf(target->path, sizeof(target->path), "%s",
+                 path[0] ? path : AUTOD_PEER_PREFIX "/sync/register");
+        if (resolved_id && resolved_sz > 0) {
+            strncpy(resolved_id, sync_id, resolved_sz - 1);
+            resolved_id[resolved_sz - 1] = '\0';
+        }
         return 0;
     }
 
@@ -918,6 +1855,78 @@ static int sync_slave_resolve_target(app_t *app, const config_t *cfg,
     return -1;
 }
 
+static int sync_iface_ipv4(const char *iface, char *out, size_t out_sz) {
+    struct ifaddrs *ifa = NULL;
+    if (getifaddrs(&ifa) != 0) return -1;
+    int found = -1;
+    for (struct ifaddrs *it = ifa; it; it = it->ifa_next) {
+        if (!it->ifa_addr || it->ifa_addr->sa_family != AF_INET) continue;
+        if (!it->ifa_name || strcmp(it->ifa_name, iface) != 0) continue;
+        const struct sockaddr_in *sin = (const struct sockaddr_in *)it->ifa_addr;
+        if (inet_ntop(AF_INET, &sin->sin_addr, out, (socklen_t)out_sz)) {
+            found = 0;
+            break;
+        }
+    }
+    freeifaddrs(ifa);
+    return found;
+}
+
+/*
+ * Pick the address the master should use to reach us: an explicit advertise
+ * value wins, then the IPv4 address of advertise_iface, and otherwise the local
+ * address of the route towards the master (a connected UDP socket sends no
+ * packets but makes the kernel choose the outbound interface). Called on every
+ * heartbeat so DHCP renewals and interface changes are picked up.
+ */
+static int sync_slave_detect_advertise(const config_t *cfg, const http_url_t *target,
+                                       char *out, size_t out_sz) {
+    if (!cfg || !out || out_sz == 0) return -1;
+    out[0] = '\0';
+    if (cfg->sync_advertise[0]) {
+        strncpy(out, cfg->sync_advertise, out_sz - 1);
+        out[out_sz - 1] = '\0';
+        return 0;
+    }
+    if (cfg->sync_advertise_iface[0]) {
+        return sync_iface_ipv4(cfg->sync_advertise_iface, out, out_sz);
+    }
+    if (!target || !target->host[0]) return -1;
+
+    char portbuf[16];
+    snprintf(portbuf, sizeof(portbuf), "%d", target->port > 0 ? target->port : 80);
+    struct addrinfo hints; memset(&hints, 0, sizeof(hints));
+    hints.ai_family = AF_INET;
+    hints.ai_socktype = SOCK_DGRAM;
+    struct addrinfo *res = NULL;
+    if (getaddrinfo(target->host, portbuf, &hints, &res) != 0 || !res) return -1;
+
+    int rc = -1;
+    int fd = socket(AF_INET, SOCK_DGRAM, 0);
+    if (fd >= 0) {
+        if (connect(fd, res->ai_addr, res->ai_addrlen) == 0) {
+            struct sockaddr_in local; socklen_t len = sizeof(local);
+            if (getsockname(fd, (struct sockaddr *)&local, &len) == 0 &&
+                local.sin_addr.s_addr != htonl(INADDR_ANY) &&
+                inet_ntop(AF_INET, &local.sin_addr, out, (socklen_t)out_sz)) {
+                rc = 0;
+            }
+        }
+        close(fd);
+    }
+    freeaddrinfo(res);
+    return rc;
+}
+
+static void sync_profile_hash(const char *s, char *out, size_t out_sz) {
+    uint64_t h = 1469598103934665603ULL;
+    for (; *s; s++) {
+        h ^= (unsigned char)*s;
+        h *= 1099511628211ULL;
+    }
+    snprintf(out, out_sz, "%016llx", (unsigned long long)h);
+}
+
 static int sync_slave_run_slot_commands(app_t *app, JSON_Array *commands,
                                         int slot_number) {
     if (!app) return -1;
@@ -926,13 +1935,16 @@ static int sync_slave_run_slot_commands(app_t *app, JSON_Array *commands,
     size_t count = json_array_get_count(commands);
     if (count == 0) return 0;
 
-    config_t cfg; app_config_snapshot(app, &cfg);
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) return -1;
+    app_config_snapshot(app, cfg);
     for (size_t i = 0; i < count; i++) {
         JSON_Object *cmd = json_array_get_object(commands, i);
         if (!cmd) {
             fprintf(stderr,
                     "sync slave: slot %d command %zu missing payload\n",
                     slot_number, i + 1);
+            free(cfg);
             return -1;
         }
         const char *path = json_object_get_string(cmd, "path");
@@ -940,21 +1952,61 @@ static int sync_slave_run_slot_commands(app_t *app, JSON_Array *commands,
             fprintf(stderr,
                     "sync slave: slot %d command %zu missing path\n",
                     slot_number, i + 1);
+            free(cfg);
             return -1;
         }
+        if (!catalog_allows(cfg, path)) {
+            /* Skipped rather than failed: a refused command would otherwise
+             * be replayed on every heartbeat. */
+            fprintf(stderr,
+                    "sync slave: slot %d command %zu '%s' not allowed by the command catalog\n",
+                    slot_number, i + 1, path);
+            sync_results_record(cfg, "slot", slot_number, path, "refused", 0, 0);
+            continue;
+        }
+        const char *profile_name = json_object_get_string(cmd, "profile");
+        int unknown_profile = 0;
+        const exec_profile_t *profile = profile_select(cfg, path, profile_name, &unknown_profile);
+        if (unknown_profile) {
+            fprintf(stderr,
+                    "sync slave: slot %d command %zu '%s' names unknown profile '%s'\n",
+                    slot_number, i + 1, path, profile_name);
+            sync_results_record(cfg, "slot", slot_number, path, "refused", 0, 0);
+            continue;
+        }
         JSON_Array *args = json_object_get_array(cmd, "args");
+        JSON_Value *filled_args = NULL;
+        if (exec_context_check(cmd, args, &filled_args) != NULL) {
+            fprintf(stderr,
+                    "sync slave: slot %d command %zu '%s' has invalid env or params\n",
+                    slot_number, i + 1, path);
+            sync_results_record(cfg, "slot", slot_number, path, "refused", 0, 0);
+            continue;
+        }
+        if (filled_args) args = json_array(filled_args);
         int rc = 0;
         long long elapsed = 0;
         char *out = NULL;
         char *err = NULL;
-        int exec_r = run_exec(&cfg, path, args, cfg.exec_timeout_ms,
-                              cfg.max_output_bytes, &rc, &elapsed, &out, &err);
+        sync_results_record(cfg, "slot", slot_number, path, "started", 0, 0);
+        caller_set("master", "master");
+        exec_context_set(cmd);
+        int exec_r = run_exec(cfg, path, args, cfg->exec_timeout_ms, cfg->max_output_bytes,
+                              profile, NULL, &rc, &elapsed, &out, &err, NULL, NULL, NULL);
+        exec_context_set(NULL);
+        caller_set(NULL, NULL);
+        if (filled_args) json_value_free(filled_args);
+        sync_results_record(cfg, "slot", slot_number, path,
+                            exec_r == 0 ? "finished" : "failed", exec_r == 0 ? rc : exec_r, elapsed);
         if (exec_r != 0) {
             fprintf(stderr,
-                    "sync slave: slot %d command %zu failed to execute '%s'\n",
-                    slot_number, i + 1, path);
+                    "sync slave: slot %d command %zu failed to execute '%s'%s\n",
+                    slot_number, i + 1, path,
+                    exec_r == EXEC_ERR_NOT_FOUND ? " (binary not found)" :
+                    exec_r == EXEC_ERR_INTEGRITY ? " (integrity check failed)" : "");
             if (out) free(out);
             if (err) free(err);
+            free(cfg);
             return -1;
         }
         fprintf(stderr,
@@ -963,9 +2015,63 @@ static int sync_slave_run_slot_commands(app_t *app, JSON_Array *commands,
         if (out) free(out);
         if (err) free(err);
     }
+    free(cfg);
     return 0;
 }
 
+/*
+ * Ask the master for [sync] claim_slot. Called after each heartbeat that did
+ * not already land on that slot; the outcome is only logged when it changes.
+ * Returns 1 when the master granted the slot.
+ */
+static int sync_slave_claim_slot(const config_t *cfg, const http_url_t *target,
+                                 char *last_outcome, size_t last_outcome_sz) {
+    http_url_t url = *target;
+    snprintf(url.path, sizeof(url.path), AUTOD_PEER_PREFIX "/sync/slots/%d/claim", cfg->sync_claim_slot);
+
+    JSON_Value *req = json_value_init_object();
+    JSON_Object *obj = json_object(req);
+    json_object_set_string(obj, "id", cfg->sync_id);
+    json_object_set_number(obj, "priority", cfg->sync_claim_priority);
+    char *body = json_serialize_to_string(req);
+    json_value_free(req);
+    if (!body) return 0;
+
+    char *resp_body = NULL;
+    int http_status = httpc_post_json(&url, body, &resp_body, NULL, 5000);
+    json_free_serialized_string(body);
+
+    char outcome[64];
+    JSON_Value *resp = resp_body ? json_parse_string(resp_body) : NULL;
+    const char *status = resp ? json_object_get_string(json_object(resp), "status") : NULL;
+    const char *error = resp ? json_object_get_string(json_object(resp), "error") : NULL;
+    snprintf(outcome, sizeof(outcome), "%s", status ? status : error ? error : "unreachable");
+    if (strcmp(outcome, last_outcome) != 0) {
+        fprintf(stderr, "sync slave: claim for slot %d: %s (HTTP %d)\n",
+                cfg->sync_claim_slot, outcome, http_status);
+        strncpy(last_outcome, outcome, last_outcome_sz - 1);
+        last_outcome[last_outcome_sz - 1] = '\0';
+    }
+    int granted = http_status == 200 && status && !strcmp(status, "granted");
+    if (resp) json_value_free(resp);
+    free(resp_body);
+    return granted;
+}
+
+/* 1-minute load average per online CPU for the master's health score, or
+ * -1. Sent with every heartbeat, outside the profile hash. */
+static double sync_read_load(void) {
+    FILE *f = fopen("/proc/loadavg", "r");
+    if (!f) return -1;
+    double load1 = -1;
+    if (fscanf(f, "%lf", &load1) != 1) load1 = -1;
+    fclose(f);
+    if (load1 < 0) return -1;
+    long cpus = sysconf(_SC_NPROCESSORS_ONLN);
+    if (cpus < 1) cpus = 1;
+    return (double)(long long)(load1 / cpus * 100.0 + 0.5) / 100.0;
+}
+
 static void *sync_slave_thread_main(void *arg) {
     app_t *app = (app_t *)arg;
     int sleep_seconds = 5;
@@ -977,31 +2083,64 @@ static void *sync_slave_thread_main(void *arg) {
     int last_slot_reported = 0;
     char last_slot_label[64] = "";
     int last_waiting_notice = 0;
+    char last_claim_outcome[64] = "";
+    char acked_profile[17] = "";
+    int master_gzip = 0;
+    int last_conflict_notice = 0;
+    char last_master_version[32] = "";
+    /* Lets the master tell this process from another box using the same id. */
+    char instance[17];
+    random_id(instance, sizeof(instance));
+    /* Bumped for every registration sent, so the master can drop ones that
+     * arrive late or twice. */
+    long long reg_generation = 0;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        pthread_mutex_lock(&app->slave.lock);
+        app->slave.running = 0;
+        pthread_mutex_unlock(&app->slave.lock);
+        return NULL;
+    }
     while (!app->slave.stop && !g_stop) {
-        config_t cfg; app_config_snapshot(app, &cfg);
-        if (strcasecmp(cfg.sync_role, "slave") != 0) {
+        app_config_snapshot(app, cfg);
+        if (strcasecmp(cfg->sync_role, "slave") != 0) {
             sleep(2);
             continue;
         }
-        if (!cfg.sync_master_url[0]) {
+        int use_mqtt = strcmp(cfg->sync_transport, "mqtt") == 0;
+        if (use_mqtt ? !cfg->sync_mqtt_broker[0] : !cfg->sync_master_url[0]) {
             sleep(5);
             continue;
         }
+        if (debug_heartbeats_paused()) {
+            sleep(1);
+            continue;
+        }
 
         http_url_t target;
         char resolved_id[64];
-        if (sync_slave_resolve_target(app, &cfg, &target, resolved_id,
-                                      sizeof(resolved_id)) != 0) {
-            if (strcmp(last_resolve_error, cfg.sync_master_url) != 0) {
+        resolved_id[0] = '\0';
+        if (use_mqtt) {
+            /* Only used to pick the advertise address (route towards the broker). */
+            memset(&target, 0, sizeof(target));
+            if (mqtt_parse_url(cfg->sync_mqtt_broker, target.host, sizeof(target.host),
+                               &target.port) != 0) {
+                sleep(5);
+                continue;
+            }
+        } else if (sync_slave_resolve_target(app, cfg, &target, resolved_id,
+                                             sizeof(resolved_id)) != 0) {
+            if (strcmp(last_resolve_error, cfg->sync_master_url) != 0) {
                 fprintf(stderr,
                         "sync slave: unable to resolve master reference '%s'\n",
-                        cfg.sync_master_url);
-                strncpy(last_resolve_error, cfg.sync_master_url,
+                        cfg->sync_master_url);
+                strncpy(last_resolve_error, cfg->sync_master_url,
                         sizeof(last_resolve_error) - 1);
                 last_resolve_error[sizeof(last_resolve_error) - 1] = '\0';
             }
-            if (cfg.enable_scan) {
-                scan_config_t scfg; fill_scan_config(&cfg, &scfg);
+            deadman_note_contact(0);
+            if (cfg->enable_scan) {
+                scan_config_t scfg; fill_scan_config(cfg, &scfg);
                 (void)scan_start_async(&scfg);
             }
             sleep(5);
@@ -1018,7 +2157,7 @@ static void *sync_slave_thread_main(void *arg) {
                 fprintf(stderr,
                         "sync slave: resolved master_id '%s' to %s:%d%s\n",
                         resolved_id, target.host, target.port,
-                        target.path[0] ? target.path : "/sync/register");
+                        target.path[0] ? target.path : AUTOD_PEER_PREFIX "/sync/register");
                 strncpy(last_log_id, resolved_id, sizeof(last_log_id) - 1);
                 last_log_id[sizeof(last_log_id) - 1] = '\0';
                 strncpy(last_log_host, target.host, sizeof(last_log_host) - 1);
@@ -1029,16 +2168,45 @@ static void *sync_slave_thread_main(void *arg) {
             }
         }
 
+        char advertise[128];
+        if (sync_slave_detect_advertise(cfg, &target, advertise, sizeof(advertise)) != 0) {
+            advertise[0] = '\0';
+        }
+        pthread_mutex_lock(&app->slave.lock);
+        if (strcmp(app->slave.advertised_address, advertise) != 0) {
+            if (advertise[0] && app->slave.advertised_address[0]) {
+                fprintf(stderr, "sync slave: advertise address changed %s -> %s\n",
+                        app->slave.advertised_address, advertise);
+            } else if (advertise[0]) {
+                fprintf(stderr, "sync slave: advertising address %s\n", advertise);
+            } else {
+                fprintf(stderr, "sync slave: no advertise address detected, master will use the source IP\n");
+            }
+            strncpy(app->slave.advertised_address, advertise,
+                    sizeof(app->slave.advertised_address) - 1);
+            app->slave.advertised_address[sizeof(app->slave.advertised_address) - 1] = '\0';
+        }
+        pthread_mutex_unlock(&app->slave.lock);
+
+        /* Everything except id, ack_generation and reg_generation is the node
+         * profile; it is only sent again when its hash differs from the one
+         * the master last acknowledged. */
         JSON_Value *req = json_value_init_object();
         JSON_Object *obj = json_object(req);
-        json_object_set_string(obj, "id", cfg.sync_id);
-        if (cfg.device[0]) json_object_set_string(obj, "device", cfg.device);
-        if (cfg.role[0]) json_object_set_string(obj, "role", cfg.role);
-        if (cfg.version[0]) json_object_set_string(obj, "version", cfg.version);
-        if (cfg.caps[0]) {
+        if (advertise[0]) json_object_set_string(obj, "address", advertise);
+        json_object_set_number(obj, "port", cfg->port);
+        if (cfg->device[0]) json_object_set_string(obj, "device", cfg->device);
+        if (cfg->role[0]) json_object_set_string(obj, "role", cfg->role);
+        if (cfg->version[0]) json_object_set_string(obj, "version", cfg->version);
+        json_object_set_string(obj, "autod_version", AUTOD_VERSION);
+        json_object_set_number(obj, "api_version", AUTOD_API_VERSION);
+        json_object_set_number(obj, "api_min_version", AUTOD_API_VERSION_MIN);
+        /* Always sent, empty or not: the master keeps caps a registration
+         * leaves out, so dropping them from the config must say so. */
+        {
             JSON_Value *caps = json_value_init_array();
             JSON_Array *arr = json_array(caps);
-            char tmp[256]; strncpy(tmp, cfg.caps, sizeof(tmp) - 1); tmp[sizeof(tmp) - 1] = '\0';
+            char tmp[256]; strncpy(tmp, cfg->caps, sizeof(tmp) - 1); tmp[sizeof(tmp) - 1] = '\0';
             char *tok, *save = NULL;
             for (tok = strtok_r(tmp, ",", &save); tok; tok = strtok_r(NULL, ",", &save)) {
                 sync_trim(tok);
@@ -1046,7 +2214,30 @@ static void *sync_slave_thread_main(void *arg) {
             }
             json_object_set_value(obj, "caps", caps);
         }
+        char catalog_version[32];
+        catalog_current_version(catalog_version, sizeof(catalog_version));
+        json_object_set_string(obj, "catalog_version", catalog_version);
+        json_object_set_string(obj, "instance", instance);
+        json_object_set_string(obj, "id_source", cfg->sync_id_source);
+        if (cfg->sync_previous_id[0]) json_object_set_string(obj, "previous_id", cfg->sync_previous_id);
+
+        char profile_hash[17];
+        char *profile = json_serialize_to_string(req);
+        sync_profile_hash(profile ? profile : "", profile_hash, sizeof(profile_hash));
+        if (profile) json_free_serialized_string(profile);
+        if (cfg->sync_compact_register && !strcmp(profile_hash, acked_profile)) {
+            json_value_free(req);
+            req = json_value_init_object();
+            obj = json_object(req);
+        }
+        json_object_set_string(obj, "id", cfg->sync_id);
         json_object_set_number(obj, "ack_generation", sync_slave_get_applied_generation(&app->slave));
+        json_object_set_number(obj, "reg_generation", (double)++reg_generation);
+        if (cfg->sync_compact_register) json_object_set_string(obj, "profile_hash", profile_hash);
+        double load = sync_read_load();
+        if (load >= 0) json_object_set_number(obj, "load", load);
+        enroll_slave_annotate(cfg, obj);
+        fleetcfg_slave_annotate(obj);
 
         char *body = json_serialize_to_string(req);
         json_value_free(req);
@@ -1056,12 +2247,70 @@ static void *sync_slave_thread_main(void *arg) {
         }
 
         char *resp_body = NULL;
-        int timeout_ms = cfg.sync_register_interval_s > 0 ? cfg.sync_register_interval_s * 1000 : 5000;
-        int http_status = http_post_json_simple(&target, body, &resp_body, NULL, timeout_ms);
+        int timeout_ms = cfg->sync_register_interval_s > 0 ? cfg->sync_register_interval_s * 1000 : 5000;
+        int http_status;
+        if (use_mqtt) {
+            http_status = sync_mqtt_slave_exchange(app, cfg, body, &resp_body, timeout_ms) == 0 ? 200 : -1;
+        } else {
+            sync_mqtt_slave_close();
+            size_t body_len = strlen(body);
+            char *gz = NULL;
+            size_t gz_len = 0;
+            /* Heartbeats are too small for gzip to pay off; only compress
+             * once the master has said it accepts it and it saves bytes. */
+            if (cfg->sync_gzip && master_gzip &&
+                httpc_gzip(body, body_len, &gz, &gz_len) == 0 && gz_len < body_len) {
+                http_status = httpc_post(&target, "gzip", gz, gz_len, &resp_body, NULL, timeout_ms);
+                if (http_status == 415) {
+                    fprintf(stderr, "sync slave: master refused gzip, sending plain registrations\n");
+                    master_gzip = 0;
+                    free(resp_body);
+                    resp_body = NULL;
+                    http_status = httpc_post_json(&target, body, &resp_body, NULL, timeout_ms);
+                }
+            } else {
+                http_status = httpc_post_json(&target, body, &resp_body, NULL, timeout_ms);
+            }
+            free(gz);
+        }
         json_free_serialized_string(body);
 
+        if (http_status == 409 && resp_body) {
+            JSON_Value *refusal = json_parse_string(resp_body);
+            JSON_Object *rf = json_object(refusal);
+            const char *error = json_object_get_string(rf, "error");
+            if (error && !strcmp(error, "id_conflict")) {
+                if (!last_conflict_notice) {
+                    const char *holder = json_object_get_string(rf, "holder");
+                    fprintf(stderr, "sync slave: master refused id %s, already registered from %s\n",
+                            cfg->sync_id, holder ? holder : "another node");
+                    last_conflict_notice = 1;
+                }
+                json_value_free(refusal);
+                free(resp_body);
+                deadman_note_contact(0);
+                sleep_seconds = cfg->sync_register_interval_s > 0 ? cfg->sync_register_interval_s : 15;
+                for (int i = 0; i < sleep_seconds && !app->slave.stop && !g_stop; i++) sleep(1);
+                continue;
+            }
+            if (refusal) json_value_free(refusal);
+        }
+        if (http_status == 401 && resp_body) {
+            JSON_Value *refusal = json_parse_string(resp_body);
+            if (enroll_slave_refused(cfg, json_object(refusal))) {
+                json_value_free(refusal);
+                free(resp_body);
+                deadman_note_contact(0);
+                sleep_seconds = cfg->sync_register_interval_s > 0 ? cfg->sync_register_interval_s : 15;
+                for (int i = 0; i < sleep_seconds && !app->slave.stop && !g_stop; i++) sleep(1);
+                continue;
+            }
+            if (refusal) json_value_free(refusal);
+        }
         if (http_status != 200 || !resp_body) {
             if (resp_body) free(resp_body);
+            deadman_note_contact(0);
+            if (http_status < 0) sync_results_heartbeat(cfg, sync_slave_get_current_slot(&app->slave));
             sleep(5);
             continue;
         }
@@ -1069,17 +2318,82 @@ static void *sync_slave_thread_main(void *arg) {
         JSON_Value *resp = json_parse_string(resp_body);
         free(resp_body);
         if (!resp) {
+            deadman_note_contact(0);
             sleep(5);
             continue;
         }
 
         JSON_Object *ro = json_object(resp);
+        if (enroll_slave_refused(cfg, ro)) {
+            /* Refusals over MQTT arrive as a reply without an HTTP status. */
+            json_value_free(resp);
+            deadman_note_contact(0);
+            sleep_seconds = cfg->sync_register_interval_s > 0 ? cfg->sync_register_interval_s : 15;
+            for (int i = 0; i < sleep_seconds && !app->slave.stop && !g_stop; i++) sleep(1);
+            continue;
+        }
+        enroll_slave_note_reply(cfg, ro);
+        deadman_note_contact(1);
+        const char *status = json_object_get_string(ro, "status");
+        if (status && !strcmp(status, "resend_profile")) {
+            /* The master lost our profile (restart or expiry); resend now. */
+            acked_profile[0] = '\0';
+            json_value_free(resp);
+            continue;
+        }
+        if (status && !strcmp(status, "stale")) {
+            /* A newer registration from us got there first; nothing to apply. */
+            json_value_free(resp);
+            sleep_seconds = cfg->sync_register_interval_s > 0 ? cfg->sync_register_interval_s : 15;
+            for (int i = 0; i < sleep_seconds && !app->slave.stop && !g_stop; i++) sleep(1);
+            continue;
+        }
+        const char *master_profile = json_object_get_string(ro, "profile_hash");
+        snprintf(acked_profile, sizeof(acked_profile), "%s", master_profile ? master_profile : "");
+        const char *accept_encoding = json_object_get_string(ro, "accept_encoding");
+        master_gzip = accept_encoding && strstr(accept_encoding, "gzip") != NULL;
+        JSON_Object *conflict = json_object_get_object(ro, "id_conflict");
+        const char *assigned_id = json_object_get_string(ro, "assigned_id");
+        if (conflict && !assigned_id && !last_conflict_notice) {
+            const char *with = json_object_get_string(conflict, "with");
+            fprintf(stderr, "sync slave: another node also registers as %s (%s)\n",
+                    cfg->sync_id, with ? with : "unknown");
+        }
+        last_conflict_notice = conflict != NULL;
+        const char *master_version = json_object_get_string(ro, "autod_version");
+        if (master_version && strcmp(master_version, last_master_version) != 0) {
+            int api = (int)json_object_get_number(ro, "api_version");
+            int api_min = (int)json_object_get_number(ro, "api_min_version");
+            if (!strcmp(sync_api_compat(api, api_min), "incompatible")) {
+                fprintf(stderr, "sync slave: master runs autod %s (API %d..%d), this node speaks "
+                        "API %d..%d\n", master_version, api_min, api,
+                        AUTOD_API_VERSION_MIN, AUTOD_API_VERSION);
+            }
+            snprintf(last_master_version, sizeof(last_master_version), "%s", master_version);
+        }
+        if (assigned_id && *assigned_id && strlen(assigned_id) < sizeof(cfg->sync_id) &&
+            strcmp(assigned_id, cfg->sync_id) != 0) {
+            /* suffix policy: keep running under the id the master handed out
+             * until restart. */
+            fprintf(stderr, "sync slave: id %s is taken, master assigned %s\n",
+                    cfg->sync_id, assigned_id);
+            pthread_mutex_lock(&app->cfg_lock);
+            strncpy(app->base_cfg.sync_id, assigned_id, sizeof(app->base_cfg.sync_id) - 1);
+            app->base_cfg.sync_id[sizeof(app->base_cfg.sync_id) - 1] = '\0';
+            app_rebuild_config_locked(app);
+            pthread_mutex_unlock(&app->cfg_lock);
+            if (use_mqtt) sync_mqtt_slave_close();
+        }
+        JSON_Object *catalog = json_object_get_object(ro, "catalog");
+        if (catalog && catalog_apply(cfg, catalog) < 0) {
+            fprintf(stderr, "sync slave: ignoring malformed command catalog from master\n");
+        }
+        fleetcfg_slave_apply(cfg, json_object_get_array(ro, "config"));
         int generation = 0;
         JSON_Value *gen_v = json_object_get_value(ro, "generation");
         if (gen_v && json_value_get_type(gen_v) == JSONNumber) {
             generation = (int)json_value_get_number(gen_v);
         }
-        const char *status = json_object_get_string(ro, "status");
         int waiting_status = (status && strcasecmp(status, "waiting") == 0);
         if (waiting_status) {
             if (!last_waiting_notice) {
@@ -1144,11 +2458,32 @@ static void *sync_slave_thread_main(void *arg) {
         }
         json_value_free(resp);
 
-        sleep_seconds = cfg.sync_register_interval_s > 0 ? cfg.sync_register_interval_s : 15;
+        /* Slot commands above (and startup execs) queue results; hand them
+         * to the master while it is reachable. */
+        (void)sync_results_flush(cfg, use_mqtt ? NULL : &target);
+        fedmetrics_slave_tick(cfg, use_mqtt ? NULL : &target);
+
+        /* A granted claim is picked up by re-registering straight away. */
+        if (cfg->sync_claim_slot > 0 && slot_number != cfg->sync_claim_slot && !use_mqtt) {
+            if (sync_slave_claim_slot(cfg, &target, last_claim_outcome,
+                                      sizeof(last_claim_outcome))) {
+                continue;
+            }
+        } else if (slot_number == cfg->sync_claim_slot) {
+            last_claim_outcome[0] = '\0';
+        }
+
+        sleep_seconds = cfg->sync_register_interval_s > 0 ? cfg->sync_register_interval_s : 15;
+        if (use_mqtt) {
+            sync_mqtt_slave_idle(app, cfg, sleep_seconds);
+            continue;
+        }
         for (int i = 0; i < sleep_seconds && !app->slave.stop && !g_stop; i++) {
             sleep(1);
         }
     }
+    sync_mqtt_slave_close();
+    free(cfg);
 
     pthread_mutex_lock(&app->slave.lock);
     app->slave.running = 0;
@@ -1156,52 +2491,210 @@ static void *sync_slave_thread_main(void *arg) {
     return NULL;
 }
 
-static int h_sync_register(struct mg_connection *c, void *ud) {
-    app_t *app = (app_t *)ud;
-    config_t cfg; app_config_snapshot(app, &cfg);
-    if (strcasecmp(cfg.sync_role, "master") != 0) {
-        send_plain(c, 404, "not_found", 1);
-        return 1;
-    }
+/* Where a record was last registered from, as "host:port". */
+static void sync_record_endpoint(const sync_slave_record_t *rec, char *out, size_t out_sz) {
+    snprintf(out, out_sz, "%s:%d",
+             rec->announced_address[0] ? rec->announced_address : rec->remote_ip, rec->port);
+}
 
-    const struct mg_request_info *ri = mg_get_request_info(c);
-    if (!ri || strcmp(ri->request_method, "POST") != 0) {
-        send_plain(c, 405, "method_not_allowed", 1);
-        return 1;
+static long long sync_id_conflict_window_ms(const config_t *cfg) {
+    return (cfg->sync_node_down_after_s > 0 ? cfg->sync_node_down_after_s : 90) * 1000LL;
+}
+
+/* A full registration for rec's id comes from another box when the record is
+ * still live and both the slave instance and the address differ. A restart
+ * keeps the address and an address change keeps the instance. */
+static int sync_master_is_id_conflict_locked(const sync_slave_record_t *rec, const config_t *cfg,
+                                             const char *instance, const char *endpoint) {
+    if (rec->last_seen_ms <= 0 || rec->down) return 0;
+    if (now_ms() - rec->last_seen_ms >= sync_id_conflict_window_ms(cfg)) return 0;
+    if (instance && *instance && !strcmp(instance, rec->instance)) return 0;
+    char current[272];
+    sync_record_endpoint(rec, current, sizeof(current));
+    return strcmp(current, endpoint) != 0;
+}
+
+/* Flag rec as contested by with. Returns 1 when this starts a new conflict
+ * (none was flagged within the window), which is when it gets reported. */
+static int sync_master_note_conflict_locked(sync_master_state_t *state, sync_slave_record_t *rec,
+                                            const config_t *cfg, const char *with) {
+    long long now = now_ms();
+    int fresh = rec->conflict_last_ms <= 0 ||
+                now - rec->conflict_last_ms >= sync_id_conflict_window_ms(cfg);
+    if (fresh) rec->conflict_since_ms = now;
+    snprintf(rec->conflict_with, sizeof(rec->conflict_with), "%s", with);
+    rec->conflict_last_ms = now;
+    sync_master_touch_locked(state);
+    return fresh;
+}
+
+/* Conflicts stay flagged for one window after the last clash, and for as
+ * long as both records live when the newcomer got a suffixed id. */
+static int sync_record_conflict_active_locked(sync_master_state_t *state,
+                                              const sync_slave_record_t *rec,
+                                              const config_t *cfg) {
+    if (rec->conflict_last_ms <= 0) return 0;
+    if (now_ms() - rec->conflict_last_ms < sync_id_conflict_window_ms(cfg)) return 1;
+    const sync_slave_record_t *other = sync_master_find_record(state, rec->conflict_with, 0);
+    return other && !other->down && !rec->down;
+}
+
+/* suffix policy: the record for "<id>-N" the newcomer registers under. An
+ * existing one is reused when it already belongs to the same box or went
+ * quiet. NULL when the registry is full. */
+/* Before a registration adds a node record to the nodes held: NULL while
+ * [capacity] max_nodes leaves room (noting the new usage), else the 503
+ * registry_full body. */
+static JSON_Value *sync_registry_capacity_check(const config_t *cfg, int nodes,
+                                                int *status_out) {
+    int limit = capacity_limit(cfg, CAPACITY_NODES);
+    if (nodes < limit) {
+        capacity_note(cfg, CAPACITY_NODES, nodes + 1);
+        return NULL;
     }
+    capacity_reject(cfg, CAPACITY_NODES, nodes + 1);
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "error", "registry_full");
+    json_object_set_number(o, "max_nodes", limit);
+    json_object_set_number(o, "nodes", nodes);
+    *status_out = 503;
+    return v;
+}
 
-    upload_t u = {0};
-    if (read_body(c, &u) != 0) {
-        if (u.body) free(u.body);
-        JSON_Value *v = json_value_init_object();
-        JSON_Object *o = json_object(v);
-        json_object_set_string(o, "error", "body_read_failed");
-        send_json(c, v, 400, 1);
-        json_value_free(v);
-        return 1;
+static sync_slave_record_t *sync_master_suffix_record_locked(sync_master_state_t *state,
+                                                             const config_t *cfg, const char *id,
+                                                             const char *instance,
+                                                             const char *endpoint) {
+    for (int n = 2; n <= SYNC_MAX_SLAVES + 1; n++) {
+        char alt[64];
+        char suffix[8];
+        snprintf(suffix, sizeof(suffix), "-%d", n);
+        snprintf(alt, sizeof(alt), "%.*s%s", (int)(sizeof(alt) - 1 - strlen(suffix)), id, suffix);
+        sync_slave_record_t *r = sync_master_find_record(state, alt, 0);
+        if (!r) return sync_master_find_record(state, alt, 1);
+        if (!sync_master_is_id_conflict_locked(r, cfg, instance, endpoint)) return r;
     }
+    return NULL;
+}
 
-    JSON_Value *root = json_parse_string(u.body ? u.body : "{}");
-    free(u.body);
-    if (!root) {
-        JSON_Value *v = json_value_init_object();
-        JSON_Object *o = json_object(v);
-        json_object_set_string(o, "error", "bad_json");
-        send_json(c, v, 400, 1);
-        json_value_free(v);
-        return 1;
-    }
+static void sync_emit_id_conflict(const char *id, const char *policy, const char *action,
+                                  const char *holder, const char *incoming, const char *assigned_id) {
+    fprintf(stderr, "sync master: id %s registered from %s while %s holds it (%s: %s)\n",
+            id, incoming, holder, policy, action);
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_string(eo, "id", id);
+    json_object_set_string(eo, "policy", policy);
+    json_object_set_string(eo, "action", action);
+    json_object_set_string(eo, "holder", holder);
+    json_object_set_string(eo, "incoming", incoming);
+    if (assigned_id && *assigned_id) json_object_set_string(eo, "assigned_id", assigned_id);
+    (void)events_emit("id_conflict", ev);
+}
 
-    JSON_Object *obj = json_object(root);
+/* Tell the slave which profile we hold (so it can switch to compact
+ * heartbeats) and whether gzip request bodies are understood. */
+static void sync_registration_reply_meta(JSON_Object *ro, const char *profile_hash) {
+    if (profile_hash && *profile_hash) json_object_set_string(ro, "profile_hash", profile_hash);
+    if (httpc_gzip_available()) json_object_set_string(ro, "accept_encoding", "gzip");
+    json_object_set_string(ro, "autod_version", AUTOD_VERSION);
+    json_object_set_number(ro, "api_version", AUTOD_API_VERSION);
+    json_object_set_number(ro, "api_min_version", AUTOD_API_VERSION_MIN);
+}
+
+const char *sync_api_compat(int api, int api_min) {
+    if (api <= 0) return "unknown";
+    if (api_min <= 0 || api_min > api) api_min = api;
+    if (api < AUTOD_API_VERSION_MIN || api_min > AUTOD_API_VERSION) return "incompatible";
+    return "compatible";
+}
+
+/* Take the version a full registration reports and flag the node when its
+ * API range stopped overlapping ours. */
+static void sync_master_note_version_locked(sync_slave_record_t *rec, const config_t *cfg,
+                                            const char *autod_version, int api, int api_min) {
+    const char *before = sync_api_compat(rec->api_version, rec->api_min_version);
+    snprintf(rec->autod_version, sizeof(rec->autod_version), "%s", autod_version ? autod_version : "");
+    rec->api_version = api > 0 ? api : 0;
+    rec->api_min_version = api_min > 0 ? api_min : rec->api_version;
+    const char *now = sync_api_compat(rec->api_version, rec->api_min_version);
+    int incompatible = !strcmp(now, "incompatible");
+    rec->dispatch_refused = incompatible && !strcmp(cfg->sync_version_policy, "refuse");
+    if (!incompatible || !strcmp(before, now)) return;
+    fprintf(stderr, "sync master: %s runs autod %s (API %d..%d), incompatible with API %d..%d%s\n",
+            rec->id, rec->autod_version[0] ? rec->autod_version : "?", rec->api_min_version,
+            rec->api_version, AUTOD_API_VERSION_MIN, AUTOD_API_VERSION,
+            rec->dispatch_refused ? "; refusing dispatch" : "");
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_string(eo, "id", rec->id);
+    json_object_set_string(eo, "autod_version", rec->autod_version);
+    json_object_set_number(eo, "api_version", rec->api_version);
+    json_object_set_number(eo, "api_min_version", rec->api_min_version);
+    json_object_set_number(eo, "master_api_version", AUTOD_API_VERSION);
+    json_object_set_string(eo, "policy", cfg->sync_version_policy);
+    (void)events_emit("node_incompatible", ev);
+}
+
+/* Let a slave that registered into an id conflict know about it; under the
+ * suffix policy it is told the id to use from now on. */
+static void sync_registration_reply_conflict(JSON_Object *ro, const config_t *cfg,
+                                             const char *conflict_with, int suffixed,
+                                             const char *id) {
+    if (!conflict_with || !*conflict_with) return;
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "policy", cfg->sync_id_conflict_policy);
+    json_object_set_string(o, "with", conflict_with);
+    json_object_set_value(ro, "id_conflict", v);
+    if (suffixed) json_object_set_string(ro, "assigned_id", id);
+}
+
+/*
+ * Apply one slave registration to the registry and build the reply: the
+ * assigned slot plus the slot commands the slave still has to run. Shared by
+ * POST /sync/register and the MQTT bridge; remote_ip is the transport-level
+ * peer address and may be empty for brokered registrations.
+ */
+JSON_Value *sync_master_handle_registration(app_t *app, const config_t *cfg, JSON_Object *obj,
+                                            const char *remote_ip, const char *transport,
+                                            int *status_out) {
+    int status_dummy = 0;
+    if (!status_out) status_out = &status_dummy;
+    if (!remote_ip) remote_ip = "";
     const char *id = json_object_get_string(obj, "id");
     if (!id || !*id) {
         JSON_Value *v = json_value_init_object();
         JSON_Object *o = json_object(v);
         json_object_set_string(o, "error", "missing_id");
-        send_json(c, v, 400, 1);
-        json_value_free(v);
-        json_value_free(root);
-        return 1;
+        *status_out = 400;
+        return v;
+    }
+    if (debug_registration_blocked(id)) {
+        JSON_Value *v = json_value_init_object();
+        json_object_set_string(json_object(v), "error", "injected_fault");
+        *status_out = 503;
+        return v;
+    }
+    char credential[ENROLL_SECRET_LEN + 1];
+    const char *refused = enroll_check_registration(cfg, id, obj, remote_ip, credential,
+                                                    sizeof(credential));
+    if (refused) {
+        JSON_Value *v = json_value_init_object();
+        json_object_set_string(json_object(v), "error", refused);
+        json_object_set_string(json_object(v), "id", id);
+        *status_out = strcmp(refused, "entropy_unavailable") ? 401 : 500;
+        return v;
+    }
+
+    /* autod bench: synthetic nodes exercise the registration path only. */
+    int bench = json_object_get_boolean(obj, "bench") == 1;
+    if (bench && !cfg->bench.enable) {
+        JSON_Value *v = json_value_init_object();
+        json_object_set_string(json_object(v), "error", "bench_disabled");
+        *status_out = 403;
+        return v;
     }
 
     const char *device = json_object_get_string(obj, "device");
@@ -1210,64 +2703,323 @@ static int h_sync_register(struct mg_connection *c, void *ud) {
     const char *address = json_object_get_string(obj, "address");
     const char *callback = json_object_get_string(obj, "callback_url");
     const JSON_Value *caps_val = json_object_get_value(obj, "caps");
+    int announced_port = (int)json_object_get_number(obj, "port");
+    if (announced_port <= 0 || announced_port > 65535) announced_port = 0;
+    const char *catalog_version = json_object_get_string(obj, "catalog_version");
+    /* A compact heartbeat carries only id, ack_generation and the hash of the
+     * profile the master already holds. */
+    const char *profile_hash = json_object_get_string(obj, "profile_hash");
+    int compact = profile_hash && *profile_hash && !json_object_has_value(obj, "port");
+    char known_address[256] = "";
+    char known_catalog[24] = "";
+    char acked_profile[17] = "";
     int ack_generation = 0;
     JSON_Value *ack_v = json_object_get_value(obj, "ack_generation");
     if (ack_v && json_value_get_type(ack_v) == JSONNumber) {
         ack_generation = (int)json_value_get_number(ack_v);
     }
+    long long reg_generation = 0;
+    JSON_Value *reg_v = json_object_get_value(obj, "reg_generation");
+    if (reg_v && json_value_get_type(reg_v) == JSONNumber) {
+        reg_generation = (long long)json_value_get_number(reg_v);
+    }
 
     int assigned_slot = -1;
     int send_generation = 0;
     int slot_generation = 0;
     char slot_label[64]; slot_label[0] = '\0';
 
+    char before[SYNC_MAX_SLOTS][64];
     pthread_mutex_lock(&app->master.lock);
-    sync_master_prune_locked(&app->master, &cfg);
-    sync_slave_record_t *rec = sync_master_find_record(&app->master, id, 1);
+    sync_master_copy_assignees_locked(&app->master, before);
+    sync_master_prune_locked(&app->master, cfg);
+    sync_master_log_binding_changes_locked(&app->master, cfg, before, "expired", "master");
+    sync_master_copy_assignees_locked(&app->master, before);
+    if (bench && !sync_master_find_record(&app->master, id, 0) &&
+        sync_master_count_bench_locked(&app->master) >= cfg->bench.max_nodes) {
+        pthread_mutex_unlock(&app->master.lock);
+        JSON_Value *v = json_value_init_object();
+        json_object_set_string(json_object(v), "error", "bench_capacity");
+        json_object_set_number(json_object(v), "max_nodes", cfg->bench.max_nodes);
+        *status_out = 503;
+        return v;
+    }
+    if (sync_master_find_retired_locked(&app->master, id)) {
+        pthread_mutex_unlock(&app->master.lock);
+        JSON_Value *v = json_value_init_object();
+        json_object_set_string(json_object(v), "error", "node_decommissioned");
+        json_object_set_string(json_object(v), "id", id);
+        *status_out = 403;
+        return v;
+    }
+    const char *previous_id = compact ? NULL : json_object_get_string(obj, "previous_id");
+    if (!bench && previous_id && *previous_id && strcmp(previous_id, id) != 0 &&
+        sync_master_rename_locked(&app->master, cfg, previous_id, id)) {
+        sync_master_copy_assignees_locked(&app->master, before);
+    }
+    const char *filtered = bench ? NULL
+        : discovery_check(cfg, "register", remote_ip, id,
+                          sync_master_find_record(&app->master, id, 0) != NULL,
+                          sync_master_count_nodes_locked(&app->master),
+                          sync_discovery_label, &app->master);
+    if (filtered) {
+        pthread_mutex_unlock(&app->master.lock);
+        JSON_Value *v = json_value_init_object();
+        json_object_set_string(json_object(v), "error", "discovery_rejected");
+        json_object_set_string(json_object(v), "reason", filtered);
+        json_object_set_string(json_object(v), "id", id);
+        *status_out = 403;
+        return v;
+    }
+    if (!bench && !compact && !sync_master_find_record(&app->master, id, 0)) {
+        int nodes = sync_master_count_nodes_locked(&app->master);
+        JSON_Value *full = sync_registry_capacity_check(cfg, nodes, status_out);
+        if (full) {
+            pthread_mutex_unlock(&app->master.lock);
+            return full;
+        }
+    }
+    sync_slave_record_t *rec = sync_master_find_record(&app->master, id, !compact);
+    if (compact && (!rec || strcmp(rec->profile_hash, profile_hash) != 0)) {
+        pthread_mutex_unlock(&app->master.lock);
+        JSON_Value *v = json_value_init_object();
+        JSON_Object *o = json_object(v);
+        json_object_set_string(o, "status", "resend_profile");
+        json_object_set_string(o, "id", id);
+        *status_out = 200;
+        return v;
+    }
     if (!rec) {
         pthread_mutex_unlock(&app->master.lock);
         JSON_Value *v = json_value_init_object();
         JSON_Object *o = json_object(v);
         json_object_set_string(o, "error", "registry_full");
-        send_json(c, v, 503, 1);
-        json_value_free(v);
-        json_value_free(root);
-        return 1;
+        *status_out = 503;
+        return v;
+    }
+    /* A full registration only replaces what it carries: the port on record
+     * stays when it is left out, and is cleared by "port": null. */
+    if (!compact && !json_object_has_value(obj, "port")) announced_port = rec->port;
+    /* Two boxes registering the same id: handled by [sync] id_conflict_policy
+     * instead of silently flipping the record between them. */
+    const char *instance = json_object_get_string(obj, "instance");
+    char effective_id[64];
+    char conflict_with[272] = "";
+    int suffixed = 0;
+    if (!compact) {
+        char incoming[272];
+        snprintf(incoming, sizeof(incoming), "%s:%d",
+                 (address && *address) ? address : remote_ip, announced_port);
+        if (sync_master_is_id_conflict_locked(rec, cfg, instance, incoming)) {
+            const char *policy = cfg->sync_id_conflict_policy;
+            char holder[272];
+            sync_record_endpoint(rec, holder, sizeof(holder));
+            if (!strcmp(policy, "reject")) {
+                if (sync_master_note_conflict_locked(&app->master, rec, cfg, incoming)) {
+                    sync_emit_id_conflict(id, policy, "rejected", holder, incoming, NULL);
+                }
+                pthread_mutex_unlock(&app->master.lock);
+                JSON_Value *v = json_value_init_object();
+                JSON_Object *o = json_object(v);
+                json_object_set_string(o, "error", "id_conflict");
+                json_object_set_string(o, "id", id);
+                json_object_set_string(o, "holder", holder);
+                *status_out = 409;
+                return v;
+            } else if (!strcmp(policy, "suffix")) {
+                int nodes = sync_master_count_nodes_locked(&app->master);
+                sync_slave_record_t *alt =
+                    sync_master_suffix_record_locked(&app->master, cfg, id, instance, incoming);
+                if (alt && sync_master_count_nodes_locked(&app->master) > nodes) {
+                    JSON_Value *full = sync_registry_capacity_check(cfg, nodes, status_out);
+                    if (full) {
+                        memset(alt, 0, sizeof(*alt));
+                        pthread_mutex_unlock(&app->master.lock);
+                        return full;
+                    }
+                }
+                if (!alt) {
+                    pthread_mutex_unlock(&app->master.lock);
+                    JSON_Value *v = json_value_init_object();
+                    JSON_Object *o = json_object(v);
+                    json_object_set_string(o, "error", "registry_full");
+                    *status_out = 503;
+                    return v;
+                }
+                int fresh = sync_master_note_conflict_locked(&app->master, rec, cfg, alt->id);
+                (void)sync_master_note_conflict_locked(&app->master, alt, cfg, id);
+                if (fresh) sync_emit_id_conflict(id, policy, "suffixed", holder, incoming, alt->id);
+                snprintf(conflict_with, sizeof(conflict_with), "%s", id);
+                memcpy(effective_id, alt->id, sizeof(effective_id));
+                id = effective_id;
+                rec = alt;
+                suffixed = 1;
+            } else {
+                if (sync_master_note_conflict_locked(&app->master, rec, cfg, holder)) {
+                    sync_emit_id_conflict(id, policy, "replaced", holder, incoming, NULL);
+                }
+                snprintf(conflict_with, sizeof(conflict_with), "%s", holder);
+            }
+        }
+    }
+    /* A registration that is not newer than the last one applied from the
+     * same slave process was delayed or delivered twice; applying it would
+     * roll the record back. A compact heartbeat matched the stored profile,
+     * so it comes from the stored instance. */
+    if (reg_generation > 0 && rec->reg_generation > 0 && reg_generation <= rec->reg_generation &&
+        (compact || (instance && !strcmp(instance, rec->instance)))) {
+        rec->stale_registrations++;
+        long long current = rec->reg_generation;
+        pthread_mutex_unlock(&app->master.lock);
+        fprintf(stderr,
+                "sync master: ignoring stale registration from %s (generation %lld, have %lld)\n",
+                id, reg_generation, current);
+        JSON_Value *v = json_value_init_object();
+        JSON_Object *o = json_object(v);
+        json_object_set_string(o, "status", "stale");
+        json_object_set_string(o, "id", id);
+        json_object_set_number(o, "reg_generation", (double)current);
+        *status_out = 200;
+        return v;
+    }
+    rec->reg_generation = reg_generation;
+    if (!compact) rec->bench = bench;
+    JSON_Value *load_v = json_object_get_value(obj, "load");
+    rec->load = (load_v && json_value_get_type(load_v) == JSONNumber && json_value_get_number(load_v) >= 0)
+              ? json_value_get_number(load_v) : -1;
+    if (compact) {
+        memcpy(known_address, rec->announced_address, sizeof(known_address));
+        memcpy(known_catalog, rec->catalog_version, sizeof(known_catalog));
+        if (known_address[0]) address = known_address;
+        announced_port = rec->port;
+        catalog_version = known_catalog;
+        /* The policy may have changed since the profile was sent. */
+        rec->dispatch_refused = !strcmp(sync_api_compat(rec->api_version, rec->api_min_version),
+                                        "incompatible") &&
+                                !strcmp(cfg->sync_version_policy, "refuse");
+    } else {
+        snprintf(rec->profile_hash, sizeof(rec->profile_hash), "%s", profile_hash ? profile_hash : "");
+        snprintf(rec->catalog_version, sizeof(rec->catalog_version), "%s",
+                 catalog_version ? catalog_version : "");
+        snprintf(rec->instance, sizeof(rec->instance), "%s", instance ? instance : "");
+        const char *id_source = json_object_get_string(obj, "id_source");
+        snprintf(rec->id_source, sizeof(rec->id_source), "%s", id_source ? id_source : "");
+        sync_master_note_version_locked(rec, cfg, json_object_get_string(obj, "autod_version"),
+                                        (int)json_object_get_number(obj, "api_version"),
+                                        (int)json_object_get_number(obj, "api_min_version"));
     }
+    memcpy(acked_profile, rec->profile_hash, sizeof(acked_profile));
 
+    long long previous_seen_ms = rec->last_seen_ms;
     rec->last_seen_ms = now_ms();
-    strncpy(rec->remote_ip, ri->remote_addr, sizeof(rec->remote_ip) - 1);
+    sync_master_touch_locked(&app->master);
+    /* Imported inventory fills in what the slave did not announce. */
+    char exp_address[128] = "";
+    char exp_device[64] = "";
+    sync_expected_node_t *exp = sync_master_find_expected_locked(&app->master, id);
+    if (exp) {
+        memcpy(exp_address, exp->address, sizeof(exp_address));
+        memcpy(exp_device, exp->device, sizeof(exp_device));
+        if ((!address || !*address) && (!callback || !*callback) && exp_address[0]) {
+            address = exp_address;
+        }
+        if ((!device || !*device) && exp_device[0]) device = exp_device;
+        if (announced_port <= 0 && exp->port > 0) announced_port = exp->port;
+        if (exp->first_seen_ms <= 0) {
+            exp->first_seen_ms = rec->last_seen_ms;
+            fprintf(stderr, "sync master: expected node %s made first contact\n", id);
+            JSON_Value *ev = json_value_init_object();
+            JSON_Object *eo = json_object(ev);
+            json_object_set_string(eo, "id", id);
+            json_object_set_string(eo, "remote_ip", remote_ip);
+            json_object_set_number(eo, "imported_ms", (double)exp->imported_ms);
+            if (exp->slot_hint >= 0) json_object_set_number(eo, "slot_hint", exp->slot_hint + 1);
+            (void)events_emit("node_first_contact", ev);
+        }
+    }
+    if (rec->down && !rec->simulated_down_ms) {
+        rec->down = 0;
+        fprintf(stderr, "sync master: node %s is back up\n", rec->id);
+        JSON_Value *ev = json_value_init_object();
+        JSON_Object *eo = json_object(ev);
+        json_object_set_string(eo, "id", rec->id);
+        json_object_set_string(eo, "remote_ip", remote_ip);
+        json_object_set_number(eo, "down_s", (double)((rec->last_seen_ms - previous_seen_ms) / 1000));
+        (void)events_emit("node_up", ev);
+    }
+    strncpy(rec->remote_ip, remote_ip, sizeof(rec->remote_ip) - 1);
     rec->remote_ip[sizeof(rec->remote_ip) - 1] = '\0';
+    strncpy(rec->transport, transport ? transport : "http", sizeof(rec->transport) - 1);
+    rec->transport[sizeof(rec->transport) - 1] = '\0';
     if (address && *address) {
         strncpy(rec->announced_address, address, sizeof(rec->announced_address) - 1);
         rec->announced_address[sizeof(rec->announced_address) - 1] = '\0';
     } else if (callback && *callback) {
         strncpy(rec->announced_address, callback, sizeof(rec->announced_address) - 1);
         rec->announced_address[sizeof(rec->announced_address) - 1] = '\0';
+    } else if (sync_json_is_null(obj, "address")) {
+        rec->announced_address[0] = '\0';
     }
     if (device && *device) {
         strncpy(rec->device, device, sizeof(rec->device) - 1);
         rec->device[sizeof(rec->device) - 1] = '\0';
+    } else if (sync_json_is_null(obj, "device")) {
+        rec->device[0] = '\0';
     }
     if (role && *role) {
         strncpy(rec->role, role, sizeof(rec->role) - 1);
         rec->role[sizeof(rec->role) - 1] = '\0';
+    } else if (sync_json_is_null(obj, "role")) {
+        rec->role[0] = '\0';
     }
     if (version && *version) {
         strncpy(rec->version, version, sizeof(rec->version) - 1);
         rec->version[sizeof(rec->version) - 1] = '\0';
+    } else if (sync_json_is_null(obj, "version")) {
+        rec->version[0] = '\0';
     }
-    sync_caps_from_json_value(caps_val, rec->caps, sizeof(rec->caps));
-
-    if (ri->remote_addr[0]) {
-        int probe_port = cfg.port > 0 ? cfg.port : 8080;
-        (void)scan_probe_node(ri->remote_addr, probe_port);
+    /* Omitted caps are kept; null or [] clears them. */
+    if (!compact && caps_val) sync_caps_from_json_value(caps_val, rec->caps, sizeof(rec->caps));
+
+    rec->port = announced_port;
+
+    /* Probe the advertised address when it is a literal IPv4 address or a
+     * DNS name; NAT or multi-homed slaves may not be reachable on the source
+     * IP. Brokered (MQTT) slaves may not serve HTTP at all, so they are never
+     * probed. */
+    struct in_addr probe_ip;
+    char resolved[16];
+    const char *probe_host = remote_ip;
+    if (address && *address && inet_pton(AF_INET, address, &probe_ip) == 1) {
+        probe_host = address;
+    } else if (dnscache_is_hostname(address)) {
+        if (dnscache_resolve(address, cfg->sync_dns_ttl_s, resolved, sizeof(resolved)) == 0) {
+            probe_host = resolved;
+        } else {
+            fprintf(stderr, "sync master: cannot resolve %s for %s, probing %s\n",
+                    address, rec->id, remote_ip);
+        }
+    }
+    if (probe_host[0] && strcmp(rec->transport, "mqtt") != 0 && !rec->bench) {
+        int probe_port = announced_port > 0 ? announced_port : (cfg->port > 0 ? cfg->port : 8080);
+        long long probe_t0 = now_ms();
+        if (scan_refresh_node(probe_host, probe_port) != 0) {
+            rec->probe_ms = -1;
+            if (probe_host == resolved) dnscache_forget(address);
+        } else {
+            rec->probe_ms = now_ms() - probe_t0;
+            dnscache_book_note_node(rec->id, probe_host, probe_port);
+        }
+    } else {
+        rec->probe_ms = -2;
     }
 
     int previous_slot = rec->slot_index;
     int previous_reported_slot = rec->last_reported_slot_index;
     int previous_ack_generation = rec->last_ack_generation;
-    assigned_slot = sync_master_auto_assign_slot_locked(&app->master, rec, &cfg);
+    assigned_slot = sync_master_auto_assign_slot_locked(&app->master, rec, cfg);
+    int version_refused = rec->dispatch_refused;
+    int decommissioning = rec->decommission_ms > 0;
     if (assigned_slot >= 0) {
         slot_generation = app->master.slot_generation[assigned_slot];
         int slot_changed = (previous_slot != assigned_slot) ||
@@ -1323,8 +3075,8 @@ static int h_sync_register(struct mg_connection *c, void *ud) {
                     assigned_slot + 1, send_generation, id, previous_ack_generation,
                     slot_generation, send_reason);
         }
-        if (cfg.sync_slots[assigned_slot].name[0]) {
-            strncpy(slot_label, cfg.sync_slots[assigned_slot].name,
+        if (cfg->sync_slots[assigned_slot].name[0]) {
+            strncpy(slot_label, cfg->sync_slots[assigned_slot].name,
                     sizeof(slot_label) - 1);
             slot_label[sizeof(slot_label) - 1] = '\0';
         }
@@ -1332,33 +3084,60 @@ static int h_sync_register(struct mg_connection *c, void *ud) {
     if (assigned_slot >= 0) {
         rec->last_reported_slot_index = assigned_slot;
     }
+    char node_device[sizeof(rec->device)];
+    char node_role[sizeof(rec->role)];
+    memcpy(node_device, rec->device, sizeof(node_device));
+    memcpy(node_role, rec->role, sizeof(node_role));
+    sync_master_log_binding_changes_locked(&app->master, cfg, before, "auto", id);
     pthread_mutex_unlock(&app->master.lock);
 
+    /* Config fragments go out until the slave reports their versions. */
+    JSON_Value *fragments = fleetcfg_master_registration(cfg, id, node_device, node_role, obj);
+
+    /* Hand out the command catalog until the slave reports its version. */
+    JSON_Value *catalog = catalog_published_json(cfg);
+    if (catalog && catalog_version &&
+        !strcmp(json_object_get_string(json_object(catalog), "version"), catalog_version)) {
+        json_value_free(catalog);
+        catalog = NULL;
+    }
+
     if (assigned_slot < 0) {
         JSON_Value *resp = json_value_init_object();
         JSON_Object *ro = json_object(resp);
+        if (catalog) json_object_set_value(ro, "catalog", catalog);
+        if (fragments) json_object_set_value(ro, "config", fragments);
+        sync_registration_reply_meta(ro, acked_profile);
+        sync_registration_reply_conflict(ro, cfg, conflict_with, suffixed, id);
+        if (credential[0]) json_object_set_string(ro, "credential", credential);
         json_object_set_string(ro, "status", "waiting");
         json_object_set_string(ro, "id", id);
-        json_object_set_number(ro, "interval_s", cfg.sync_register_interval_s);
-        json_object_set_string(ro, "reason", "no_slots_available");
-        json_object_set_number(ro, "max_slots", SYNC_MAX_SLOTS);
+        json_object_set_number(ro, "interval_s", cfg->sync_register_interval_s);
+        json_object_set_string(ro, "reason",
+                               version_refused ? "incompatible_version" :
+                               bench ? "bench" :
+                               decommissioning ? "decommissioning" : "no_slots_available");
+        json_object_set_number(ro, "max_slots", sync_slot_count(cfg));
         json_object_set_null(ro, "slot");
-        send_json(c, resp, 200, 1);
-        json_value_free(resp);
-        json_value_free(root);
-        return 1;
+        *status_out = 200;
+        return resp;
     }
 
     JSON_Value *commands_to_send = NULL;
     if (send_generation > 0) {
-        commands_to_send = sync_master_build_slot_commands(&cfg, assigned_slot);
+        commands_to_send = sync_master_build_slot_commands(cfg, assigned_slot);
     }
 
     JSON_Value *resp = json_value_init_object();
     JSON_Object *ro = json_object(resp);
+    if (catalog) json_object_set_value(ro, "catalog", catalog);
+    if (fragments) json_object_set_value(ro, "config", fragments);
+    sync_registration_reply_meta(ro, acked_profile);
+    sync_registration_reply_conflict(ro, cfg, conflict_with, suffixed, id);
+    if (credential[0]) json_object_set_string(ro, "credential", credential);
     json_object_set_string(ro, "status", "registered");
     json_object_set_string(ro, "id", id);
-    json_object_set_number(ro, "interval_s", cfg.sync_register_interval_s);
+    json_object_set_number(ro, "interval_s", cfg->sync_register_interval_s);
     json_object_set_number(ro, "generation", send_generation);
     json_object_set_number(ro, "slot", assigned_slot + 1);
     json_object_set_number(ro, "slot_generation", slot_generation);
@@ -1367,23 +3146,351 @@ static int h_sync_register(struct mg_connection *c, void *ud) {
         json_object_set_value(ro, "commands", commands_to_send);
     }
 
-    send_json(c, resp, 200, 1);
+    *status_out = 200;
+    return resp;
+}
+
+/*
+ * Seed the registry from another master's GET /sync/slaves payload before this
+ * node starts accepting registrations (POST /admin/promote). Seeded nodes keep
+ * their slot and count as seen now, so they only go down if they never come
+ * back; skip_id (the promoted node itself) is left out.
+ */
+int sync_master_seed_snapshot(app_t *app, const config_t *cfg, JSON_Object *snapshot,
+                              const char *skip_id, const char *reason, const char *actor) {
+    if (!app || !cfg || !snapshot) return 0;
+    JSON_Array *slaves = json_object_get_array(snapshot, "slaves");
+    size_t count = json_array_get_count(slaves);
+    int seeded = 0;
+    char before[SYNC_MAX_SLOTS][64];
+    pthread_mutex_lock(&app->master.lock);
+    sync_master_copy_assignees_locked(&app->master, before);
+    for (size_t i = 0; i < count; i++) {
+        JSON_Object *so = json_array_get_object(slaves, i);
+        const char *id = json_object_get_string(so, "id");
+        if (!id || !*id || strlen(id) >= sizeof(app->master.records[0].id)) continue;
+        if (skip_id && !strcmp(id, skip_id)) continue;
+        if (!sync_master_find_record(&app->master, id, 0) &&
+            sync_master_count_nodes_locked(&app->master) >= capacity_limit(cfg, CAPACITY_NODES)) {
+            fprintf(stderr, "WARN: capacity: registry full at %d nodes (max_nodes), not seeding %s and the rest\n",
+                    capacity_limit(cfg, CAPACITY_NODES), id);
+            break;
+        }
+        sync_slave_record_t *rec = sync_master_find_record(&app->master, id, 1);
+        if (!rec) break;
+        const char *s;
+        if ((s = json_object_get_string(so, "remote_ip")))
+            snprintf(rec->remote_ip, sizeof(rec->remote_ip), "%s", s);
+        if ((s = json_object_get_string(so, "address")))
+            snprintf(rec->announced_address, sizeof(rec->announced_address), "%s", s);
+        if ((s = json_object_get_string(so, "device")))
+            snprintf(rec->device, sizeof(rec->device), "%s", s);
+        if ((s = json_object_get_string(so, "role")))
+            snprintf(rec->role, sizeof(rec->role), "%s", s);
+        if ((s = json_object_get_string(so, "version")))
+            snprintf(rec->version, sizeof(rec->version), "%s", s);
+        if ((s = json_object_get_string(so, "transport")))
+            snprintf(rec->transport, sizeof(rec->transport), "%s", s);
+        sync_caps_from_json_value(json_object_get_value(so, "caps"), rec->caps, sizeof(rec->caps));
+        int port = (int)json_object_get_number(so, "port");
+        rec->port = (port > 0 && port <= 65535) ? port : 0;
+        rec->claim_priority = (int)json_object_get_number(so, "claim_priority");
+        rec->last_seen_ms = now_ms();
+        int slot = (int)json_object_get_number(so, "slot");
+        if (slot >= 1 && slot <= sync_slot_count(cfg)) {
+            (void)sync_master_assign_slot_locked(&app->master, rec, slot - 1, 0);
+            rec->last_reported_slot_index = slot - 1;
+        }
+        seeded++;
+    }
+    sync_master_log_binding_changes_locked(&app->master, cfg, before, reason, actor);
+    pthread_mutex_unlock(&app->master.lock);
+    return seeded;
+}
+
+/* Same address choice as the registration probe: an announced literal IPv4
+ * address or DNS name wins over the source IP. Names are left unresolved so
+ * the caller can resolve them at dispatch time. */
+static void sync_master_record_addr(const sync_slave_record_t *rec, const config_t *cfg,
+                                    char *host, size_t host_sz, int *port) {
+    struct in_addr ip;
+    const char *src = rec->remote_ip;
+    if (rec->announced_address[0] && (inet_pton(AF_INET, rec->announced_address, &ip) == 1 ||
+                                      dnscache_is_hostname(rec->announced_address))) {
+        src = rec->announced_address;
+    }
+    strncpy(host, src, host_sz - 1);
+    host[host_sz - 1] = '\0';
+    *port = rec->port > 0 ? rec->port : (cfg && cfg->port > 0 ? cfg->port : 8080);
+}
+
+/* Fill a from rec, with the address of its gateway when [gateway.ID] routes
+ * it through one. Called with the master lock held. */
+static void sync_master_node_addr_locked(app_t *app, const config_t *cfg,
+                                         const sync_slave_record_t *rec, sync_node_addr_t *a) {
+    memset(a, 0, sizeof(*a));
+    strncpy(a->id, rec->id, sizeof(a->id) - 1);
+    sync_master_record_addr(rec, cfg, a->host, sizeof(a->host), &a->port);
+    if (rec->slot_index >= 0 && rec->slot_index < SYNC_MAX_SLOTS &&
+        sync_master_slot_matches(&app->master, rec->slot_index, rec->id)) {
+        a->slot = rec->slot_index + 1;
+    }
+    a->down = rec->down;
+    a->quarantined = rec->quarantined_ms > 0;
+    strncpy(a->transport, rec->transport[0] ? rec->transport : "http", sizeof(a->transport) - 1);
+    snprintf(a->device, sizeof(a->device), "%s", rec->device);
+    snprintf(a->role, sizeof(a->role), "%s", rec->role);
+    snprintf(a->version, sizeof(a->version), "%s", rec->autod_version);
+    const char *via = gateway_for(cfg, rec->id);
+    if (!via) return;
+    snprintf(a->via, sizeof(a->via), "%s", via);
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        const sync_slave_record_t *gw = &app->master.records[i];
+        if (!gw->in_use || strcmp(gw->id, via) != 0) continue;
+        sync_master_record_addr(gw, cfg, a->via_host, sizeof(a->via_host), &a->via_port);
+        break;
+    }
+}
+
+int sync_master_list_nodes(app_t *app, const config_t *cfg, sync_node_addr_t *out, int max) {
+    if (!app || !out || max <= 0) return 0;
+    int n = 0;
+    pthread_mutex_lock(&app->master.lock);
+    for (int i = 0; i < SYNC_MAX_SLAVES && n < max; i++) {
+        const sync_slave_record_t *rec = &app->master.records[i];
+        if (!rec->in_use || rec->bench) continue;
+        sync_master_node_addr_locked(app, cfg, rec, &out[n++]);
+    }
+    pthread_mutex_unlock(&app->master.lock);
+    return n;
+}
+
+int sync_master_node_addr(app_t *app, const config_t *cfg, const char *id, sync_node_addr_t *out) {
+    if (!app || !id || !*id || !out) return -1;
+    int rc = -1;
+    pthread_mutex_lock(&app->master.lock);
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        const sync_slave_record_t *rec = &app->master.records[i];
+        if (!rec->in_use || rec->bench || strcasecmp(rec->id, id) != 0) continue;
+        sync_master_node_addr_locked(app, cfg, rec, out);
+        rc = 0;
+        break;
+    }
+    pthread_mutex_unlock(&app->master.lock);
+    return rc;
+}
+
+int sync_master_drop_bench(app_t *app) {
+    if (!app) return 0;
+    int dropped = 0;
+    char ids[SYNC_MAX_SLAVES][64];
+    pthread_mutex_lock(&app->master.lock);
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        const sync_slave_record_t *rec = &app->master.records[i];
+        if (rec->in_use && rec->bench) memcpy(ids[dropped++], rec->id, sizeof(ids[0]));
+    }
+    for (int i = 0; i < dropped; i++) (void)sync_master_delete_record_locked(&app->master, ids[i]);
+    pthread_mutex_unlock(&app->master.lock);
+    return dropped;
+}
+
+int sync_master_node_hostname(app_t *app, const char *id, char *host, size_t host_sz, int *port) {
+    if (!app || !id || !*id || !host || host_sz == 0) return -1;
+    int rc = -1;
+    pthread_mutex_lock(&app->master.lock);
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        const sync_slave_record_t *rec = &app->master.records[i];
+        if (!rec->in_use || strcasecmp(rec->id, id) != 0) continue;
+        if (dnscache_is_hostname(rec->announced_address)) {
+            snprintf(host, host_sz, "%s", rec->announced_address);
+            if (port) *port = rec->port;
+            rc = 0;
+        }
+        break;
+    }
+    pthread_mutex_unlock(&app->master.lock);
+    return rc;
+}
+
+long long sync_master_reg_generation(app_t *app, const char *id) {
+    if (!app || !id || !*id) return 0;
+    long long generation = 0;
+    pthread_mutex_lock(&app->master.lock);
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        const sync_slave_record_t *rec = &app->master.records[i];
+        if (rec->in_use && !strcmp(rec->id, id)) {
+            generation = rec->reg_generation;
+            break;
+        }
+    }
+    pthread_mutex_unlock(&app->master.lock);
+    return generation;
+}
+
+static int h_sync_register(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    if (strcasecmp(cfg->sync_role, "master") != 0) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri || strcmp(ri->request_method, "POST") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        if (u.body) free(u.body);
+        JSON_Value *v = json_value_init_object();
+        JSON_Object *o = json_object(v);
+        json_object_set_string(o, "error", "body_read_failed");
+        send_json(c, v, 400, 1);
+        json_value_free(v);
+        free(cfg);
+        return 1;
+    }
+
+    const char *encoding = mg_get_header(c, "Content-Encoding");
+    if (encoding && *encoding && strcasecmp(encoding, "identity") != 0) {
+        char *plain = NULL;
+        size_t plain_len = 0;
+        const char *error = NULL;
+        int code = 400;
+        if (strcasecmp(encoding, "gzip") != 0 || !httpc_gzip_available()) {
+            error = "unsupported_encoding";
+            code = 415;
+        } else if (!u.body ||
+                   httpc_gunzip(u.body, u.len, MAX_BODY_BYTES, &plain, &plain_len) != 0) {
+            error = "bad_gzip";
+        }
+        free(u.body);
+        u.body = plain;
+        u.len = plain_len;
+        if (error) {
+            JSON_Value *v = json_value_init_object();
+            JSON_Object *o = json_object(v);
+            json_object_set_string(o, "error", error);
+            send_json(c, v, code, 1);
+            json_value_free(v);
+            free(cfg);
+            return 1;
+        }
+    }
+
+    JSON_Value *root = json_parse_string(u.body ? u.body : "{}");
+    free(u.body);
+    if (!root) {
+        JSON_Value *v = json_value_init_object();
+        JSON_Object *o = json_object(v);
+        json_object_set_string(o, "error", "bad_json");
+        send_json(c, v, 400, 1);
+        json_value_free(v);
+        free(cfg);
+        return 1;
+    }
+
+    JSON_Object *obj = json_object(root);
+    int status = 500;
+    JSON_Value *resp = sync_master_handle_registration(app, cfg, obj, ri->remote_addr, "http", &status);
+    send_json(c, resp, status, 1);
     json_value_free(resp);
     json_value_free(root);
+    free(cfg);
     return 1;
 }
 
+static void sync_append_pending_claims_locked(const sync_master_state_t *state, int slot_index,
+                                              JSON_Object *dst) {
+    JSON_Value *arr_v = NULL;
+    for (int i = 0; i < SYNC_MAX_CLAIMS; i++) {
+        const sync_slot_claim_t *cl = &state->claims[i];
+        if (!cl->in_use || cl->rejected || cl->slot_index != slot_index) continue;
+        if (!arr_v) arr_v = json_value_init_array();
+        JSON_Value *item = json_value_init_object();
+        JSON_Object *io = json_object(item);
+        json_object_set_string(io, "id", cl->id);
+        json_object_set_number(io, "priority", cl->priority);
+        json_object_set_number(io, "ts_ms", (double)cl->ts_ms);
+        json_array_append_value(json_array(arr_v), item);
+    }
+    if (arr_v) json_object_set_value(dst, "pending_claims", arr_v);
+}
+
+/* One inventory entry. The state is "expected/offline" until the node first
+ * registers, then follows its registry record ("online", "down", or
+ * "offline" once the record has been pruned). */
+static JSON_Value *sync_expected_node_json_locked(sync_master_state_t *state,
+                                                  const sync_expected_node_t *e) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "id", e->id);
+    const char *st = "expected/offline";
+    if (e->first_seen_ms > 0) {
+        const sync_slave_record_t *rec = sync_master_find_record(state, e->id, 0);
+        st = !rec ? "offline" : rec->down ? "down" : "online";
+    }
+    json_object_set_string(o, "state", st);
+    if (e->address[0]) json_object_set_string(o, "address", e->address);
+    if (e->port > 0) json_object_set_number(o, "port", e->port);
+    if (e->device[0]) json_object_set_string(o, "device", e->device);
+    if (e->slot_hint >= 0) json_object_set_number(o, "slot_hint", e->slot_hint + 1);
+    if (e->labels[0]) {
+        JSON_Value *labels = json_parse_string(e->labels);
+        if (labels) json_object_set_value(o, "labels", labels);
+    }
+    json_object_set_number(o, "imported_ms", (double)e->imported_ms);
+    if (e->first_seen_ms > 0) json_object_set_number(o, "first_seen_ms", (double)e->first_seen_ms);
+    return v;
+}
+
 static int h_sync_slaves(struct mg_connection *c, void *ud) {
     app_t *app = (app_t *)ud;
-    config_t cfg; app_config_snapshot(app, &cfg);
-    if (strcasecmp(cfg.sync_role, "master") != 0) {
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    if (replica_handle(c, cfg)) {
+        free(cfg);
+        return 1;
+    }
+    if (strcasecmp(cfg->sync_role, "master") != 0) {
         send_plain(c, 404, "not_found", 1);
+        free(cfg);
         return 1;
     }
 
     const struct mg_request_info *ri = mg_get_request_info(c);
     if (!ri || strcmp(ri->request_method, "GET") != 0) {
         send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+
+    char before[SYNC_MAX_SLOTS][64];
+    pthread_mutex_lock(&app->master.lock);
+    sync_master_copy_assignees_locked(&app->master, before);
+    sync_master_prune_locked(&app->master, cfg);
+    sync_master_log_binding_changes_locked(&app->master, cfg, before, "expired", "master");
+    /* Serve the cached payload while the registry is unchanged. */
+    if (app->master.slaves_cache &&
+        app->master.slaves_cache_version == app->master.version) {
+        send_json_cached(c, app->master.slaves_cache, app->master.slaves_cache_len,
+                         "slaves", app->master.version,
+                         app->master.modified_unix, 1);
+        pthread_mutex_unlock(&app->master.lock);
+        free(cfg);
         return 1;
     }
 
@@ -1391,9 +3498,6 @@ static int h_sync_slaves(struct mg_connection *c, void *ud) {
     JSON_Object *ro = json_object(resp);
     JSON_Value *arr_v = json_value_init_array();
     JSON_Array *arr = json_array(arr_v);
-
-    pthread_mutex_lock(&app->master.lock);
-    sync_master_prune_locked(&app->master, &cfg);
     for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
         sync_slave_record_t *rec = &app->master.records[i];
         if (!rec->in_use) continue;
@@ -1402,67 +3506,208 @@ static int h_sync_slaves(struct mg_connection *c, void *ud) {
         json_object_set_string(io, "id", rec->id);
         json_object_set_string(io, "remote_ip", rec->remote_ip);
         if (rec->announced_address[0]) json_object_set_string(io, "address", rec->announced_address);
+        if (rec->port > 0) json_object_set_number(io, "port", rec->port);
         if (rec->device[0]) json_object_set_string(io, "device", rec->device);
         if (rec->role[0]) json_object_set_string(io, "role", rec->role);
         if (rec->version[0]) json_object_set_string(io, "version", rec->version);
+        if (rec->autod_version[0]) json_object_set_string(io, "autod_version", rec->autod_version);
+        if (rec->id_source[0]) json_object_set_string(io, "id_source", rec->id_source);
+        if (rec->api_version > 0) {
+            json_object_set_number(io, "api_version", rec->api_version);
+            json_object_set_number(io, "api_min_version", rec->api_min_version);
+        }
+        json_object_set_string(io, "compat", sync_api_compat(rec->api_version, rec->api_min_version));
+        if (rec->dispatch_refused) json_object_set_boolean(io, "dispatch_refused", 1);
+        if (rec->bench) json_object_set_boolean(io, "bench", 1);
+        if (rec->decommission_ms > 0) {
+            json_object_set_boolean(io, "decommissioning", 1);
+            json_object_set_number(io, "decommission_ms", (double)rec->decommission_ms);
+        }
+        if (rec->quarantined_ms > 0) {
+            json_object_set_boolean(io, "quarantined", 1);
+            json_object_set_number(io, "quarantined_ms", (double)rec->quarantined_ms);
+            json_object_set_number(io, "quarantine_failures", rec->quarantine_failures);
+        }
         if (rec->caps[0]) json_object_set_string(io, "caps", rec->caps);
         json_object_set_number(io, "last_seen_ms", (double)rec->last_seen_ms);
+        if (rec->down) json_object_set_boolean(io, "down", 1);
+        if (rec->simulated_down_ms > 0) {
+            json_object_set_boolean(io, "simulated_down", 1);
+            json_object_set_number(io, "simulated_down_until_ms", (double)rec->simulated_down_until_ms);
+        }
+        if (rec->transport[0]) json_object_set_string(io, "transport", rec->transport);
         json_object_set_number(io, "last_ack_generation", rec->last_ack_generation);
+        if (rec->reg_generation > 0) {
+            json_object_set_number(io, "reg_generation", (double)rec->reg_generation);
+        }
+        if (rec->stale_registrations) {
+            json_object_set_number(io, "stale_registrations", rec->stale_registrations);
+        }
         if (rec->slot_index >= 0 && rec->slot_index < SYNC_MAX_SLOTS) {
             json_object_set_number(io, "slot", rec->slot_index + 1);
             json_object_set_number(io, "slot_generation",
                                    app->master.slot_generation[rec->slot_index]);
-            if (cfg.sync_slots[rec->slot_index].name[0]) {
+            if (cfg->sync_slots[rec->slot_index].name[0]) {
                 json_object_set_string(io, "slot_label",
-                                       cfg.sync_slots[rec->slot_index].name);
+                                       cfg->sync_slots[rec->slot_index].name);
             }
         }
-        int preferred_slot = sync_preferred_slot_for_id(&cfg, rec->id);
+        int preferred_slot = sync_preferred_slot_for_id(cfg, rec->id);
         if (preferred_slot >= 0) {
             json_object_set_number(io, "preferred_slot", preferred_slot + 1);
         }
+        if (rec->claim_priority) json_object_set_number(io, "claim_priority", rec->claim_priority);
+        if (sync_record_conflict_active_locked(&app->master, rec, cfg)) {
+            JSON_Value *cv = json_value_init_object();
+            JSON_Object *co = json_object(cv);
+            json_object_set_string(co, "with", rec->conflict_with);
+            json_object_set_string(co, "policy", cfg->sync_id_conflict_policy);
+            json_object_set_number(co, "since_ms", (double)rec->conflict_since_ms);
+            json_object_set_number(co, "last_ms", (double)rec->conflict_last_ms);
+            json_object_set_value(io, "conflict", cv);
+        }
+        const sync_expected_node_t *exp = sync_master_find_expected_locked(&app->master, rec->id);
+        if (exp && exp->labels[0]) {
+            JSON_Value *labels = json_parse_string(exp->labels);
+            if (labels) json_object_set_value(io, "labels", labels);
+        }
         json_array_append_value(arr, item);
     }
 
+    JSON_Value *expected_v = json_value_init_array();
+    JSON_Array *expected_arr = json_array(expected_v);
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        const sync_expected_node_t *e = &app->master.expected[i];
+        if (!e->in_use || e->first_seen_ms > 0) continue;
+        json_array_append_value(expected_arr, sync_expected_node_json_locked(&app->master, e));
+    }
+
     JSON_Value *slots_v = json_value_init_array();
     JSON_Array *slots_arr = json_array(slots_v);
-    for (int slot = 0; slot < SYNC_MAX_SLOTS; slot++) {
+    int slot_count = sync_slot_count(cfg);
+    for (int slot = 0; slot < slot_count; slot++) {
         JSON_Value *slot_v = json_value_init_object();
         JSON_Object *so = json_object(slot_v);
         json_object_set_number(so, "slot", slot + 1);
-        if (cfg.sync_slots[slot].name[0]) {
-            json_object_set_string(so, "label", cfg.sync_slots[slot].name);
+        if (cfg->sync_slots[slot].name[0]) {
+            json_object_set_string(so, "label", cfg->sync_slots[slot].name);
+        }
+        if (cfg->sync_slots[slot].template_name[0]) {
+            json_object_set_string(so, "template", cfg->sync_slots[slot].template_name);
+        }
+        if (cfg->sync_slots[slot].alias_count > 0) {
+            JSON_Value *av = json_value_init_array();
+            for (int a = 0; a < cfg->sync_slots[slot].alias_count; a++) {
+                json_array_append_string(json_array(av), cfg->sync_slots[slot].aliases[a]);
+            }
+            json_object_set_value(so, "aliases", av);
         }
-        if (cfg.sync_slots[slot].prefer_id[0]) {
+        JSON_Value *cv = json_value_init_array();
+        sync_slot_conflicts(cfg, slot, json_array(cv), 0);
+        if (json_array_get_count(json_array(cv)) > 0) json_object_set_value(so, "name_conflicts", cv);
+        else json_value_free(cv);
+        if (cfg->sync_slots[slot].prefer_id[0]) {
             json_object_set_string(so, "prefer_id",
-                                   cfg.sync_slots[slot].prefer_id);
+                                   cfg->sync_slots[slot].prefer_id);
+        }
+        if (cfg->sync_slots[slot].ssh[0]) {
+            json_object_set_string(so, "ssh", cfg->sync_slots[slot].ssh);
         }
         if (app->master.slot_assignees[slot][0]) {
             json_object_set_string(so, "assigned_id",
                                    app->master.slot_assignees[slot]);
         }
+        const sync_desired_group_t *group = sync_desired_group_for_slot(&app->master, slot);
+        if (group) json_object_set_string(so, "desired_group", group->name);
+        sync_append_pending_claims_locked(&app->master, slot, so);
+        const sync_slot_lease_t *lease = &app->master.slot_leases[slot];
+        if (lease->lease_id[0]) {
+            JSON_Value *lv = json_value_init_object();
+            JSON_Object *lo = json_object(lv);
+            json_object_set_string(lo, "holder", lease->holder);
+            json_object_set_number(lo, "acquired_ms", (double)lease->acquired_ms);
+            json_object_set_number(lo, "acquired_unix_ms", (double)lease->acquired_unix_ms);
+            json_object_set_number(lo, "expires_ms", (double)lease->expires_ms);
+            json_object_set_number(lo, "expires_unix_ms", (double)sync_unix_ms(lease->expires_ms));
+            json_object_set_value(so, "lease", lv);
+        }
+        const sync_slot_override_t *ov = &app->master.slot_overrides[slot];
+        if (ov->id[0] && !strcmp(ov->id, app->master.slot_assignees[slot])) {
+            JSON_Value *tv = json_value_init_object();
+            JSON_Object *to = json_object(tv);
+            if (ov->previous_id[0]) json_object_set_string(to, "reverts_to", ov->previous_id);
+            else json_object_set_null(to, "reverts_to");
+            json_object_set_number(to, "expires_ms", (double)ov->expires_ms);
+            json_object_set_number(to, "expires_unix_ms", (double)sync_unix_ms(ov->expires_ms));
+            json_object_set_string(to, "set_by", ov->actor);
+            json_object_set_value(so, "temporary", tv);
+        }
+        const sync_slot_health_t *h = &app->master.slot_health[slot];
+        if (cfg->sync_slots[slot].health[0] && h->id[0]) {
+            JSON_Value *hv = json_value_init_object();
+            JSON_Object *ho = json_object(hv);
+            json_object_set_string(ho, "id", h->id);
+            json_object_set_string(ho, "state", h->state);
+            json_object_set_number(ho, "failures", h->failures);
+            json_object_set_number(ho, "since_ms", (double)h->since_ms);
+            if (h->last_rc >= 0) json_object_set_number(ho, "last_rc", h->last_rc);
+            if (h->last_error[0]) json_object_set_string(ho, "last_error", h->last_error);
+            json_object_set_value(so, "health", hv);
+        }
         json_array_append_value(slots_arr, slot_v);
     }
-    pthread_mutex_unlock(&app->master.lock);
 
     json_object_set_value(ro, "slaves", arr_v);
+    json_object_set_value(ro, "expected", expected_v);
+    JSON_Value *retired_v = json_value_init_array();
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        const sync_retired_node_t *r = &app->master.retired[i];
+        if (!r->id[0]) continue;
+        JSON_Value *rv = json_value_init_object();
+        json_object_set_string(json_object(rv), "id", r->id);
+        json_object_set_number(json_object(rv), "ts_ms", (double)r->ts_ms);
+        if (r->actor[0]) json_object_set_string(json_object(rv), "actor", r->actor);
+        json_array_append_value(json_array(retired_v), rv);
+    }
+    json_object_set_value(ro, "decommissioned", retired_v);
     json_object_set_value(ro, "slots", slots_v);
-    send_json(c, resp, 200, 1);
+    char *body = json_serialize_to_string(resp);
     json_value_free(resp);
+    if (!body) {
+        pthread_mutex_unlock(&app->master.lock);
+        send_plain(c, 500, "oom", 1);
+        free(cfg);
+        return 1;
+    }
+    if (app->master.slaves_cache) json_free_serialized_string(app->master.slaves_cache);
+    app->master.slaves_cache = body;
+    app->master.slaves_cache_len = strlen(body);
+    app->master.slaves_cache_version = app->master.version;
+    send_json_cached(c, body, app->master.slaves_cache_len, "slaves",
+                     app->master.version, app->master.modified_unix, 1);
+    pthread_mutex_unlock(&app->master.lock);
+    free(cfg);
     return 1;
 }
 
 static int h_sync_push(struct mg_connection *c, void *ud) {
     app_t *app = (app_t *)ud;
-    config_t cfg; app_config_snapshot(app, &cfg);
-    if (strcasecmp(cfg.sync_role, "master") != 0) {
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    if (strcasecmp(cfg->sync_role, "master") != 0) {
         send_plain(c, 404, "not_found", 1);
+        free(cfg);
         return 1;
     }
 
     const struct mg_request_info *ri = mg_get_request_info(c);
     if (!ri || strcmp(ri->request_method, "POST") != 0) {
         send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
         return 1;
     }
 
@@ -1474,6 +3719,7 @@ static int h_sync_push(struct mg_connection *c, void *ud) {
         json_object_set_string(o, "error", "body_read_failed");
         send_json(c, v, 400, 1);
         json_value_free(v);
+        free(cfg);
         return 1;
     }
 
@@ -1485,6 +3731,7 @@ static int h_sync_push(struct mg_connection *c, void *ud) {
         json_object_set_string(o, "error", "bad_json");
         send_json(c, v, 400, 1);
         json_value_free(v);
+        free(cfg);
         return 1;
     }
 
@@ -1498,6 +3745,9 @@ static int h_sync_push(struct mg_connection *c, void *ud) {
 
     slot_move_t moves[SYNC_MAX_SLOTS];
     int move_count = 0;
+    /* Slot names that did not resolve to exactly one slot. */
+    const char *bad_ref = NULL;
+    int bad_rc = 0;
 
     JSON_Value *moves_v = json_object_get_value(obj, "moves");
     if (moves_v && json_value_get_type(moves_v) == JSONArray) {
@@ -1523,12 +3773,22 @@ static int h_sync_push(struct mg_connection *c, void *ud) {
                 if ((double)slot_int != slot_num) continue;
                 if (slot_int <= 0) {
                     slot_index = -1;
-                } else if (slot_int > SYNC_MAX_SLOTS) {
+                } else if (slot_int > sync_slot_count(cfg)) {
                     continue;
                 } else {
                     slot_index = slot_int - 1;
                 }
                 has_slot = 1;
+            } else if (t == JSONString) {
+                int rc = sync_slot_lookup(cfg, json_value_get_string(slot_v), &slot_index);
+                if (rc != 0) {
+                    if (!bad_ref) {
+                        bad_ref = json_value_get_string(slot_v);
+                        bad_rc = rc;
+                    }
+                    continue;
+                }
+                has_slot = 1;
             } else {
                 continue;
             }
@@ -1556,13 +3816,17 @@ static int h_sync_push(struct mg_connection *c, void *ud) {
                 if ((double)slot_int == slot_num) {
                     if (slot_int <= 0) {
                         slot_index = -1;
-                    } else if (slot_int <= SYNC_MAX_SLOTS) {
+                    } else if (slot_int <= sync_slot_count(cfg)) {
                         slot_index = slot_int - 1;
                     } else {
                         slot_index = -2;
                     }
                     has_slot = 1;
                 }
+            } else if (t == JSONString) {
+                bad_rc = sync_slot_lookup(cfg, json_value_get_string(slot_v), &slot_index);
+                if (bad_rc != 0) bad_ref = json_value_get_string(slot_v);
+                else has_slot = 1;
             }
             if (has_slot && slot_index >= -1) {
                 strncpy(moves[0].id, sid, sizeof(moves[0].id) - 1);
@@ -1602,23 +3866,48 @@ static int h_sync_push(struct mg_connection *c, void *ud) {
             size_t cnt = json_array_get_count(arr);
             for (size_t i = 0; i < cnt && replay_slot_count < SYNC_MAX_SLOTS; i++) {
                 JSON_Value *slot_v = json_array_get_value(arr, i);
+                if (slot_v && json_value_get_type(slot_v) == JSONString) {
+                    unsigned char hits[SYNC_MAX_SLOTS];
+                    if (sync_slot_match(cfg, json_value_get_string(slot_v), hits) == 0) {
+                        if (!bad_ref) {
+                            bad_ref = json_value_get_string(slot_v);
+                            bad_rc = -1;
+                        }
+                        continue;
+                    }
+                    for (int slot = 0; slot < SYNC_MAX_SLOTS &&
+                                       replay_slot_count < SYNC_MAX_SLOTS; slot++) {
+                        if (hits[slot]) replay_slot_requests[replay_slot_count++].slot_index = slot;
+                    }
+                    continue;
+                }
                 if (!slot_v || json_value_get_type(slot_v) != JSONNumber) continue;
                 double slot_num = json_value_get_number(slot_v);
                 int slot_int = (int)slot_num;
                 if ((double)slot_int != slot_num) continue;
-                if (slot_int <= 0 || slot_int > SYNC_MAX_SLOTS) continue;
+                if (slot_int <= 0 || slot_int > sync_slot_count(cfg)) continue;
                 replay_slot_requests[replay_slot_count++].slot_index = slot_int - 1;
             }
         } else if (t == JSONNumber && replay_slot_count < SYNC_MAX_SLOTS) {
             double slot_num = json_value_get_number(replay_slots_v);
             int slot_int = (int)slot_num;
             if ((double)slot_int == slot_num &&
-                slot_int > 0 && slot_int <= SYNC_MAX_SLOTS) {
+                slot_int > 0 && slot_int <= sync_slot_count(cfg)) {
                 replay_slot_requests[replay_slot_count++].slot_index = slot_int - 1;
             }
         }
     }
 
+    if (bad_ref) {
+        int status = 404;
+        JSON_Value *v = sync_slot_lookup_error(cfg, bad_ref, bad_rc, &status);
+        send_json(c, v, status, 1);
+        json_value_free(v);
+        json_value_free(root);
+        free(cfg);
+        return 1;
+    }
+
     JSON_Value *replay_ids_v = json_object_get_value(obj, "replay_ids");
     if (replay_ids_v) {
         JSON_Value_Type t = json_value_get_type(replay_ids_v);
@@ -1692,6 +3981,7 @@ static int h_sync_push(struct mg_connection *c, void *ud) {
         send_json(c, v, 400, 1);
         json_value_free(v);
         json_value_free(root);
+        free(cfg);
         return 1;
     }
 
@@ -1711,8 +4001,13 @@ static int h_sync_push(struct mg_connection *c, void *ud) {
     memset(replay_mask, 0, sizeof(replay_mask));
     int replayed_slots = 0;
 
+    char before[SYNC_MAX_SLOTS][64];
+    const char *actor = ri->remote_addr[0] ? ri->remote_addr : "api";
     pthread_mutex_lock(&app->master.lock);
-    sync_master_prune_locked(&app->master, &cfg);
+    sync_master_copy_assignees_locked(&app->master, before);
+    sync_master_prune_locked(&app->master, cfg);
+    sync_master_log_binding_changes_locked(&app->master, cfg, before, "expired", "master");
+    sync_master_copy_assignees_locked(&app->master, before);
 
     char deleted_ids[SYNC_MAX_SLAVES][64];
     int deleted_count = 0;
@@ -1737,6 +4032,9 @@ static int h_sync_push(struct mg_connection *c, void *ud) {
         }
     }
 
+    sync_master_log_binding_changes_locked(&app->master, cfg, before, "deleted", actor);
+    sync_master_copy_assignees_locked(&app->master, before);
+
     char planned[SYNC_MAX_SLOTS][64];
     for (int i = 0; i < SYNC_MAX_SLOTS; i++) {
         strncpy(planned[i], app->master.slot_assignees[i], sizeof(planned[i]) - 1);
@@ -1752,6 +4050,13 @@ static int h_sync_push(struct mg_connection *c, void *ud) {
             error_slot = moves[i].slot_index + 1;
             break;
         }
+        if (moves[i].slot_index >= 0 && cfg->sync_slots[moves[i].slot_index].ssh[0]) {
+            error_code = 409;
+            strncpy(error_reason, "agentless_slot", sizeof(error_reason) - 1);
+            error_reason[sizeof(error_reason) - 1] = '\0';
+            error_slot = moves[i].slot_index + 1;
+            break;
+        }
         sync_slave_record_t *rec =
             sync_master_find_record(&app->master, moves[i].id, 0);
         if (!rec) {
@@ -1816,9 +4121,10 @@ static int h_sync_push(struct mg_connection *c, void *ud) {
     if (!error_code) {
         for (int slot = 0; slot < SYNC_MAX_SLOTS; slot++) {
             const char *new_id = planned[slot][0] ? planned[slot] : NULL;
-            sync_master_apply_slot_assignment_locked(&app->master, &cfg, slot,
+            sync_master_apply_slot_assignment_locked(&app->master, cfg, slot,
                                                      new_id);
         }
+        sync_master_log_binding_changes_locked(&app->master, cfg, before, "manual", actor);
 
         for (int slot = 0; slot < SYNC_MAX_SLOTS; slot++) {
             if (!replay_mask[slot]) continue;
@@ -1852,6 +4158,7 @@ static int h_sync_push(struct mg_connection *c, void *ud) {
         send_json(c, v, error_code, 1);
         json_value_free(v);
         json_value_free(root);
+        free(cfg);
         return 1;
     }
 
@@ -1880,9 +4187,9 @@ static int h_sync_push(struct mg_connection *c, void *ud) {
         json_object_set_string(io, "slave_id", snapshot[i].id);
         json_object_set_number(io, "generation", snapshot[i].generation);
         if (snapshot[i].slot >= 0 && snapshot[i].slot < SYNC_MAX_SLOTS &&
-            cfg.sync_slots[snapshot[i].slot].name[0]) {
+            cfg->sync_slots[snapshot[i].slot].name[0]) {
             json_object_set_string(io, "slot_label",
-                                   cfg.sync_slots[snapshot[i].slot].name);
+                                   cfg->sync_slots[snapshot[i].slot].name);
         }
         json_array_append_value(assignments, item);
     }
@@ -1891,20 +4198,28 @@ static int h_sync_push(struct mg_connection *c, void *ud) {
     send_json(c, resp, 200, 1);
     json_value_free(resp);
     json_value_free(root);
+    free(cfg);
     return 1;
 }
 
 static int h_sync_bind(struct mg_connection *c, void *ud) {
     app_t *app = (app_t *)ud;
-    config_t cfg; app_config_snapshot(app, &cfg);
-    if (strcasecmp(cfg.sync_role, "slave") != 0 || !cfg.sync_allow_bind) {
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    if (strcasecmp(cfg->sync_role, "slave") != 0 || !cfg->sync_allow_bind) {
         send_plain(c, 404, "not_found", 1);
+        free(cfg);
         return 1;
     }
 
     const struct mg_request_info *ri = mg_get_request_info(c);
     if (!ri || strcmp(ri->request_method, "POST") != 0) {
-        send_plain(c, 405, "method_not_allowed", cfg.ui_public);
+        send_plain(c, 405, "method_not_allowed", cfg->ui_public);
+        free(cfg);
         return 1;
     }
 
@@ -1914,8 +4229,9 @@ static int h_sync_bind(struct mg_connection *c, void *ud) {
         JSON_Value *v = json_value_init_object();
         JSON_Object *o = json_object(v);
         json_object_set_string(o, "error", "body_read_failed");
-        send_json(c, v, 400, cfg.ui_public);
+        send_json(c, v, 400, cfg->ui_public);
         json_value_free(v);
+        free(cfg);
         return 1;
     }
 
@@ -1925,8 +4241,9 @@ static int h_sync_bind(struct mg_connection *c, void *ud) {
         JSON_Value *v = json_value_init_object();
         JSON_Object *o = json_object(v);
         json_object_set_string(o, "error", "bad_json");
-        send_json(c, v, 400, cfg.ui_public);
+        send_json(c, v, 400, cfg->ui_public);
         json_value_free(v);
+        free(cfg);
         return 1;
     }
 
@@ -1939,9 +4256,10 @@ static int h_sync_bind(struct mg_connection *c, void *ud) {
         JSON_Value *v = json_value_init_object();
         JSON_Object *o = json_object(v);
         json_object_set_string(o, "error", "missing_master_reference");
-        send_json(c, v, 400, cfg.ui_public);
+        send_json(c, v, 400, cfg->ui_public);
         json_value_free(v);
         json_value_free(root);
+        free(cfg);
         return 1;
     }
 
@@ -1957,17 +4275,18 @@ static int h_sync_bind(struct mg_connection *c, void *ud) {
             JSON_Value *v = json_value_init_object();
             JSON_Object *o = json_object(v);
             json_object_set_string(o, "error", "invalid_master_reference");
-            send_json(c, v, 400, cfg.ui_public);
+            send_json(c, v, 400, cfg->ui_public);
             json_value_free(v);
             json_value_free(root);
+            free(cfg);
             return 1;
         }
     }
 
-    int new_interval = cfg.sync_register_interval_s;
+    int new_interval = cfg->sync_register_interval_s;
     if (interval_v && json_value_get_type(interval_v) == JSONNumber) {
         new_interval = (int)json_value_get_number(interval_v);
-        if (new_interval <= 0) new_interval = cfg.sync_register_interval_s;
+        if (new_interval <= 0) new_interval = cfg->sync_register_interval_s;
     }
 
     pthread_mutex_lock(&app->cfg_lock);
@@ -1985,57 +4304,2400 @@ static int h_sync_bind(struct mg_connection *c, void *ud) {
     json_object_set_string(ro, "status", "bound");
     json_object_set_string(ro, "master_url", normalized_master);
     json_object_set_number(ro, "register_interval_s", new_interval);
-    send_json(c, resp, 200, cfg.ui_public);
+    send_json(c, resp, 200, cfg->ui_public);
     json_value_free(resp);
     json_value_free(root);
+    free(cfg);
     return 1;
 }
-void sync_append_capabilities(const config_t *cfg, JSON_Array *caps_arr) {
-    if (!cfg || !caps_arr) return;
-    if (!cfg->sync_role[0]) return;
-    const char *sync_cap = (strcasecmp(cfg->sync_role, "master") == 0)
-                               ? "sync-master"
-                               : "sync-slave";
-    json_array_append_string(caps_arr, sync_cap);
+
+/* ---- slot leases ---- */
+
+static void sync_lease_event(int slot_index, const sync_slot_lease_t *l, const char *action,
+                             const char *actor) {
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_number(eo, "slot", slot_index + 1);
+    json_object_set_string(eo, "holder", l->holder);
+    json_object_set_string(eo, "action", action);
+    if (actor) json_object_set_string(eo, "actor", actor);
+    (void)events_emit("slot_lease", ev);
+}
+
+static void sync_master_expire_leases_locked(sync_master_state_t *state) {
+    long long now = now_ms();
+    for (int i = 0; i < SYNC_MAX_SLOTS; i++) {
+        sync_slot_lease_t *l = &state->slot_leases[i];
+        if (!l->lease_id[0] || l->expires_ms > now) continue;
+        fprintf(stderr, "sync master: lease on slot %d held by %s expired\n", i + 1, l->holder);
+        sync_lease_event(i, l, "expired", NULL);
+        memset(l, 0, sizeof(*l));
+        sync_master_touch_locked(state);
+    }
+}
+
+static JSON_Value *sync_lease_json(int slot_index, const sync_slot_lease_t *l, int with_id,
+                                   const char *error) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    if (error) json_object_set_string(o, "error", error);
+    json_object_set_number(o, "slot", slot_index + 1);
+    if (with_id) json_object_set_string(o, "lease_id", l->lease_id);
+    json_object_set_string(o, "holder", l->holder);
+    long long left = l->expires_ms - now_ms();
+    if (left < 0) left = 0;
+    json_object_set_number(o, "expires_in_s", (double)((left + 999) / 1000));
+    json_object_set_number(o, "acquired_ms", (double)l->acquired_ms);
+    json_object_set_number(o, "acquired_unix_ms", (double)l->acquired_unix_ms);
+    json_object_set_number(o, "expires_unix_ms", (double)sync_unix_ms(l->expires_ms));
+    return v;
+}
+
+static JSON_Value *sync_lease_conflict_json(int slot_index, const sync_slot_lease_t *l) {
+    return sync_lease_json(slot_index, l, 0, "slot_leased");
+}
+
+JSON_Value *sync_master_lease_conflict(app_t *app, const char *id, int slot_index,
+                                       const char *lease_id) {
+    if (!app) return NULL;
+    JSON_Value *conflict = NULL;
+    pthread_mutex_lock(&app->master.lock);
+    sync_master_expire_leases_locked(&app->master);
+    if (slot_index < 0 && id && *id) {
+        const sync_slave_record_t *rec = sync_master_find_record(&app->master, id, 0);
+        if (rec) slot_index = rec->slot_index;
+    }
+    if (slot_index >= 0 && slot_index < SYNC_MAX_SLOTS) {
+        const sync_slot_lease_t *l = &app->master.slot_leases[slot_index];
+        if (l->lease_id[0] && (!lease_id || strcmp(lease_id, l->lease_id) != 0)) {
+            conflict = sync_lease_conflict_json(slot_index, l);
+        }
+    }
+    pthread_mutex_unlock(&app->master.lock);
+    return conflict;
+}
+
+JSON_Value *sync_master_version_conflict(app_t *app, const char *id) {
+    if (!app || !id || !*id) return NULL;
+    JSON_Value *conflict = NULL;
+    pthread_mutex_lock(&app->master.lock);
+    const sync_slave_record_t *rec = sync_master_find_record(&app->master, id, 0);
+    if (rec && rec->dispatch_refused) {
+        conflict = json_value_init_object();
+        JSON_Object *o = json_object(conflict);
+        json_object_set_string(o, "error", "incompatible_version");
+        json_object_set_string(o, "id", rec->id);
+        if (rec->autod_version[0]) json_object_set_string(o, "autod_version", rec->autod_version);
+        json_object_set_number(o, "api_version", rec->api_version);
+        json_object_set_number(o, "master_api_version", AUTOD_API_VERSION);
+    }
+    pthread_mutex_unlock(&app->master.lock);
+    return conflict;
+}
+
+JSON_Value *sync_master_quarantine_conflict(app_t *app, const char *id) {
+    if (!app || !id || !*id) return NULL;
+    JSON_Value *conflict = NULL;
+    long long now = now_ms();
+    pthread_mutex_lock(&app->master.lock);
+    const sync_slave_record_t *rec = sync_master_find_record(&app->master, id, 0);
+    if (rec && rec->decommission_ms > 0) {
+        conflict = json_value_init_object();
+        json_object_set_string(json_object(conflict), "error", "node_decommissioning");
+        json_object_set_string(json_object(conflict), "id", rec->id);
+    } else if (rec && rec->quarantined_ms > 0) {
+        conflict = json_value_init_object();
+        JSON_Object *o = json_object(conflict);
+        json_object_set_string(o, "error", "node_quarantined");
+        json_object_set_string(o, "id", rec->id);
+        json_object_set_number(o, "failures", rec->quarantine_failures);
+        long long left_ms = rec->probation_due_ms - now;
+        json_object_set_number(o, "retry_after_s", left_ms > 0 ? (double)((left_ms + 999) / 1000) : 0);
+    }
+    pthread_mutex_unlock(&app->master.lock);
+    return conflict;
+}
+
+int sync_master_node_decommissioning(app_t *app, const char *id) {
+    if (!app || !id || !*id) return 0;
+    pthread_mutex_lock(&app->master.lock);
+    const sync_slave_record_t *rec = sync_master_find_record(&app->master, id, 0);
+    int decommissioning = rec && rec->decommission_ms > 0;
+    pthread_mutex_unlock(&app->master.lock);
+    return decommissioning;
+}
+
+int sync_master_node_quarantined(app_t *app, const char *id) {
+    if (!app || !id || !*id) return 0;
+    pthread_mutex_lock(&app->master.lock);
+    const sync_slave_record_t *rec = sync_master_find_record(&app->master, id, 0);
+    int quarantined = rec && rec->quarantined_ms > 0;
+    pthread_mutex_unlock(&app->master.lock);
+    return quarantined;
+}
+
+#define SYNC_HEALTH_W_HEARTBEAT 30
+#define SYNC_HEALTH_W_DISPATCH  35
+#define SYNC_HEALTH_W_LOAD      15
+#define SYNC_HEALTH_W_PROBE     20
+
+/* 100 up to good, 0 from bad on, linear in between. */
+static int sync_health_linear(double v, double good, double bad) {
+    if (v <= good) return 100;
+    if (v >= bad) return 0;
+    return (int)(100.0 * (bad - v) / (bad - good) + 0.5);
+}
+
+/* A heartbeat is fresh for one and a half register intervals and worthless
+ * once the node would be marked down. Signals a node does not give are left
+ * out of the mean rather than counted against it. */
+static void sync_health_locked(const config_t *cfg, const sync_slave_record_t *rec,
+                               long long now, sync_health_t *out) {
+    long long interval_ms = (cfg && cfg->sync_register_interval_s > 0 ? cfg->sync_register_interval_s : 30) * 1000LL;
+    long long down_ms = (cfg && cfg->sync_node_down_after_s > 0 ? cfg->sync_node_down_after_s : 90) * 1000LL;
+    out->heartbeat = rec->last_seen_ms > 0
+                   ? sync_health_linear((double)(now - rec->last_seen_ms), interval_ms * 1.5, (double)down_ms)
+                   : -1;
+    cluster_node_stats_t st;
+    out->dispatch = cluster_node_stats(rec->id, &st) == 0 && st.attempts > 0
+                  ? (int)(st.success_rate * 100.0 + 0.5) : -1;
+    out->load = rec->load >= 0 ? sync_health_linear(rec->load, 0.5, 2.0) : -1;
+    out->probe = rec->probe_ms == -1 ? 0
+               : rec->probe_ms >= 0 ? sync_health_linear((double)rec->probe_ms, 50, 1000) : -1;
+    const int parts[4][2] = {
+        { out->heartbeat, SYNC_HEALTH_W_HEARTBEAT },
+        { out->dispatch,  SYNC_HEALTH_W_DISPATCH },
+        { out->load,      SYNC_HEALTH_W_LOAD },
+        { out->probe,     SYNC_HEALTH_W_PROBE },
+    };
+    int sum = 0, weight = 0;
+    for (int i = 0; i < 4; i++) {
+        if (parts[i][0] < 0) continue;
+        sum += parts[i][0] * parts[i][1];
+        weight += parts[i][1];
+    }
+    out->score = (rec->down || weight == 0) ? 0 : (sum + weight / 2) / weight;
+}
+
+static int sync_health_compare_locked(const config_t *cfg, const sync_slave_record_t *a,
+                                      const sync_slave_record_t *b) {
+    long long now = now_ms();
+    sync_health_t ha, hb;
+    sync_health_locked(cfg, a, now, &ha);
+    sync_health_locked(cfg, b, now, &hb);
+    if (ha.score != hb.score) return ha.score > hb.score ? -1 : 1;
+    return cluster_node_compare(a->id, b->id);
+}
+
+int sync_master_node_health(app_t *app, const config_t *cfg, const char *id, sync_health_t *out) {
+    if (!app || !id || !*id || !out) return -1;
+    pthread_mutex_lock(&app->master.lock);
+    const sync_slave_record_t *rec = sync_master_find_record(&app->master, id, 0);
+    if (rec) sync_health_locked(cfg, rec, now_ms(), out);
+    pthread_mutex_unlock(&app->master.lock);
+    return rec ? 0 : -1;
+}
+
+JSON_Value *sync_health_json(const sync_health_t *h) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_number(o, "score", h->score);
+    if (h->heartbeat >= 0) json_object_set_number(o, "heartbeat", h->heartbeat);
+    if (h->dispatch >= 0) json_object_set_number(o, "dispatch", h->dispatch);
+    if (h->load >= 0) json_object_set_number(o, "load", h->load);
+    if (h->probe >= 0) json_object_set_number(o, "probe", h->probe);
+    return v;
+}
+
+unsigned long sync_master_health_digest(app_t *app, const config_t *cfg) {
+    if (!app) return 0;
+    unsigned long digest = 5381;
+    long long now = now_ms();
+    pthread_mutex_lock(&app->master.lock);
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        const sync_slave_record_t *rec = &app->master.records[i];
+        if (!rec->in_use) continue;
+        sync_health_t h;
+        sync_health_locked(cfg, rec, now, &h);
+        const int parts[5] = { h.score, h.heartbeat, h.dispatch, h.load, h.probe };
+        digest = digest * 33 + (unsigned long)i;
+        for (int k = 0; k < 5; k++) digest = digest * 33 + (unsigned long)(parts[k] + 1);
+    }
+    pthread_mutex_unlock(&app->master.lock);
+    return digest;
+}
+
+int sync_master_health_compare(app_t *app, const config_t *cfg, const char *a, const char *b) {
+    if (app && a && *a && b && *b) {
+        pthread_mutex_lock(&app->master.lock);
+        const sync_slave_record_t *ra = sync_master_find_record(&app->master, a, 0);
+        const sync_slave_record_t *rb = sync_master_find_record(&app->master, b, 0);
+        int cmp = (ra && rb) ? sync_health_compare_locked(cfg, ra, rb) : 0;
+        pthread_mutex_unlock(&app->master.lock);
+        if (ra && rb) return cmp;
+    }
+    return cluster_node_compare(a, b);
+}
+
+/*
+ * POST   /sync/slots/{slot}/lease  {"holder":"ci-7","ttl_s":60[,"lease_id":".."]}
+ * GET    /sync/slots/{slot}/lease
+ * DELETE /sync/slots/{slot}/lease  (X-Lease-Id header or ?lease_id=, or ?force=1)
+ * Posting the current lease_id renews it.
+ */
+static void sync_handle_lease(struct mg_connection *c, app_t *app, const config_t *cfg,
+                              int slot_index) {
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    const char *method = ri->request_method;
+    char lease_id[40] = "";
+    const char *hdr = mg_get_header(c, "X-Lease-Id");
+    if (hdr) {
+        strncpy(lease_id, hdr, sizeof(lease_id) - 1);
+        lease_id[sizeof(lease_id) - 1] = '\0';
+    } else if (ri->query_string) {
+        mg_get_var(ri->query_string, strlen(ri->query_string), "lease_id",
+                   lease_id, sizeof(lease_id));
+    }
+
+    if (!strcmp(method, "GET")) {
+        JSON_Value *resp;
+        pthread_mutex_lock(&app->master.lock);
+        sync_master_expire_leases_locked(&app->master);
+        const sync_slot_lease_t *l = &app->master.slot_leases[slot_index];
+        if (l->lease_id[0]) {
+            resp = sync_lease_json(slot_index, l, 0, NULL);
+        } else {
+            resp = json_value_init_object();
+            json_object_set_number(json_object(resp), "slot", slot_index + 1);
+            json_object_set_null(json_object(resp), "holder");
+        }
+        pthread_mutex_unlock(&app->master.lock);
+        send_json(c, resp, 200, 1);
+        json_value_free(resp);
+        return;
+    }
+
+    if (!strcmp(method, "DELETE")) {
+        int force = 0;
+        if (ri->query_string) {
+            char buf[8];
+            if (mg_get_var(ri->query_string, strlen(ri->query_string), "force",
+                           buf, sizeof(buf)) > 0) {
+                force = atoi(buf) != 0 || !strcasecmp(buf, "true");
+            }
+        }
+        JSON_Value *resp = NULL;
+        int status = 200;
+        pthread_mutex_lock(&app->master.lock);
+        sync_master_expire_leases_locked(&app->master);
+        sync_slot_lease_t *l = &app->master.slot_leases[slot_index];
+        if (!l->lease_id[0]) {
+            resp = json_value_init_object();
+            json_object_set_string(json_object(resp), "error", "not_leased");
+            status = 404;
+        } else if (!force && strcmp(lease_id, l->lease_id) != 0) {
+            resp = sync_lease_conflict_json(slot_index, l);
+            status = 409;
+        } else {
+            fprintf(stderr, "sync master: lease on slot %d held by %s %s by %s\n",
+                    slot_index + 1, l->holder, force ? "broken" : "released", ri->remote_addr);
+            sync_lease_event(slot_index, l, force ? "broken" : "released", ri->remote_addr);
+            resp = json_value_init_object();
+            json_object_set_number(json_object(resp), "slot", slot_index + 1);
+            json_object_set_string(json_object(resp), "status", "released");
+            memset(l, 0, sizeof(*l));
+            sync_master_touch_locked(&app->master);
+        }
+        pthread_mutex_unlock(&app->master.lock);
+        send_json(c, resp, status, 1);
+        json_value_free(resp);
+        return;
+    }
+
+    if (strcmp(method, "POST") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        return;
+    }
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        free(u.body);
+        send_json_error(c, 400, "body_read_failed");
+        return;
+    }
+    JSON_Value *root = json_parse_string(u.body && *u.body ? u.body : "{}");
+    free(u.body);
+    if (!root || json_value_get_type(root) != JSONObject) {
+        if (root) json_value_free(root);
+        send_json_error(c, 400, "bad_json");
+        return;
+    }
+    JSON_Object *o = json_object(root);
+    const char *holder = json_object_get_string(o, "holder");
+    if (!holder || !*holder) holder = ri->remote_addr;
+    const char *renew = json_object_get_string(o, "lease_id");
+    if (!renew || !*renew) renew = lease_id[0] ? lease_id : NULL;
+    int ttl_s = 60;
+    if (json_object_has_value_of_type(o, "ttl_s", JSONNumber)) {
+        ttl_s = (int)json_object_get_number(o, "ttl_s");
+    }
+    if (ttl_s <= 0 || ttl_s > cfg->sync_lease_max_s) {
+        json_value_free(root);
+        JSON_Value *v = json_value_init_object();
+        json_object_set_string(json_object(v), "error", "invalid_ttl");
+        json_object_set_number(json_object(v), "max_ttl_s", cfg->sync_lease_max_s);
+        send_json(c, v, 400, 1);
+        json_value_free(v);
+        return;
+    }
+
+    JSON_Value *resp;
+    int status = 200;
+    pthread_mutex_lock(&app->master.lock);
+    sync_master_expire_leases_locked(&app->master);
+    sync_slot_lease_t *l = &app->master.slot_leases[slot_index];
+    long long now = now_ms();
+    int acquire = !l->lease_id[0];
+    if (!acquire && (!renew || strcmp(renew, l->lease_id) != 0)) {
+        resp = sync_lease_conflict_json(slot_index, l);
+        status = 409;
+    } else if (acquire && random_token(l->lease_id, sizeof(l->lease_id)) < 0) {
+        resp = json_value_init_object();
+        json_object_set_string(json_object(resp), "error", "entropy_unavailable");
+        status = 500;
+    } else {
+        const char *action = acquire ? "acquired" : "renewed";
+        if (acquire) {
+            l->acquired_ms = now;
+            l->acquired_unix_ms = jobs_unix_ms();
+        }
+        strncpy(l->holder, holder, sizeof(l->holder) - 1);
+        l->holder[sizeof(l->holder) - 1] = '\0';
+        l->expires_ms = now + (long long)ttl_s * 1000LL;
+        sync_master_touch_locked(&app->master);
+        if (!strcmp(action, "acquired")) {
+            fprintf(stderr, "sync master: slot %d leased to %s for %ds\n",
+                    slot_index + 1, l->holder, ttl_s);
+        }
+        sync_lease_event(slot_index, l, action, ri->remote_addr);
+        resp = sync_lease_json(slot_index, l, 1, NULL);
+    }
+    pthread_mutex_unlock(&app->master.lock);
+    json_value_free(root);
+    send_json(c, resp, status, 1);
+    json_value_free(resp);
+}
+
+#define SYNC_SLOT_TTL_MAX_S (7 * 86400)
+
+/* The ttl of a temporary binding: seconds, or a count with an s, m or h
+ * suffix ("90s", "15m", "1h"). Returns -1 when invalid. */
+static int sync_parse_ttl(const JSON_Value *v) {
+    if (json_value_get_type(v) == JSONNumber) {
+        double d = json_value_get_number(v);
+        return d > 0 && d <= SYNC_SLOT_TTL_MAX_S && d == (int)d ? (int)d : -1;
+    }
+    const char *s = json_value_get_string(v);
+    if (!s) return -1;
+    char *end = NULL;
+    long n = strtol(s, &end, 10);
+    if (end == s || n <= 0) return -1;
+    long unit = *end == 'h' ? 3600 : *end == 'm' ? 60 : 1;
+    if (*end == 'h' || *end == 'm' || *end == 's') end++;
+    if (*end || n > SYNC_SLOT_TTL_MAX_S / unit) return -1;
+    return (int)(n * unit);
+}
+
+/* Put id (NULL = nobody) on slot_index, taking it off any other slot. */
+static void sync_master_bind_slot_locked(sync_master_state_t *state, const config_t *cfg,
+                                         int slot_index, const char *id) {
+    if (id && *id) {
+        for (int s = 0; s < SYNC_MAX_SLOTS; s++) {
+            if (s != slot_index && !strcmp(state->slot_assignees[s], id)) {
+                sync_master_apply_slot_assignment_locked(state, cfg, s, NULL);
+            }
+        }
+    }
+    sync_master_apply_slot_assignment_locked(state, cfg, slot_index, id);
+}
+
+/*
+ * End the temporary binding on slot_index: the slot goes back to the node
+ * that held it before (if that node is still registered), or is left free.
+ * A slot rebound some other way in the meantime is left alone; the
+ * slot_binding_reverted event then says reverted:false.
+ */
+static void sync_master_end_override_locked(sync_master_state_t *state, const config_t *cfg,
+                                            int slot_index, const char *reason,
+                                            const char *actor) {
+    sync_slot_override_t o = state->slot_overrides[slot_index];
+    memset(&state->slot_overrides[slot_index], 0, sizeof(o));
+    sync_master_touch_locked(state);
+    int reverted = !strcmp(state->slot_assignees[slot_index], o.id);
+    const char *restore = o.previous_id[0] && sync_master_find_record(state, o.previous_id, 0)
+                              ? o.previous_id : NULL;
+    if (reverted) {
+        char before[SYNC_MAX_SLOTS][64];
+        sync_master_copy_assignees_locked(state, before);
+        sync_master_bind_slot_locked(state, cfg, slot_index, restore);
+        sync_master_log_binding_changes_locked(state, cfg, before, reason, actor);
+    }
+    fprintf(stderr, "sync master: temporary binding of slot %d to %s ended (%s)%s%s\n",
+            slot_index + 1, o.id, reason, reverted ? ", back to " : ", slot rebound since",
+            reverted ? (restore ? restore : "-") : "");
+
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_number(eo, "slot", slot_index + 1);
+    json_object_set_string(eo, "id", o.id);
+    if (reverted && restore) json_object_set_string(eo, "restored_id", restore);
+    else json_object_set_null(eo, "restored_id");
+    json_object_set_boolean(eo, "reverted", reverted);
+    json_object_set_string(eo, "reason", reason);
+    json_object_set_number(eo, "held_s", (double)((now_ms() - o.set_ms) / 1000));
+    if (o.actor[0]) json_object_set_string(eo, "set_by", o.actor);
+    if (actor) json_object_set_string(eo, "actor", actor);
+    (void)events_emit("slot_binding_reverted", ev);
+}
+
+static void sync_master_expire_overrides_locked(sync_master_state_t *state, const config_t *cfg) {
+    long long now = now_ms();
+    for (int i = 0; i < SYNC_MAX_SLOTS; i++) {
+        const sync_slot_override_t *o = &state->slot_overrides[i];
+        if (o->id[0] && o->expires_ms <= now) {
+            sync_master_end_override_locked(state, cfg, i, "ttl_expired", "master");
+        }
+    }
+}
+
+static void sync_slot_binding_error(struct mg_connection *c, int status, const char *error,
+                                    int slot_index) {
+    JSON_Value *v = json_value_init_object();
+    json_object_set_string(json_object(v), "error", error);
+    if (slot_index >= 0) json_object_set_number(json_object(v), "slot", slot_index + 1);
+    send_json(c, v, status, 1);
+    json_value_free(v);
+}
+
+/*
+ * PUT    /sync/slots/{slot}  {"id":"bench-1"[,"ttl":3600|"1h"]} or {"id":null}
+ * DELETE /sync/slots/{slot}  (end a temporary binding now)
+ * With a ttl the binding reverts to the slot's previous holder when it
+ * runs out; replacing a temporary binding keeps the original holder to
+ * revert to.
+ */
+static void sync_handle_slot_binding(struct mg_connection *c, app_t *app, const config_t *cfg,
+                                     int slot_index) {
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    const char *actor = ri->remote_addr[0] ? ri->remote_addr : "api";
+    sync_master_state_t *state = &app->master;
+
+    if (!strcmp(ri->request_method, "DELETE")) {
+        pthread_mutex_lock(&state->lock);
+        if (!state->slot_overrides[slot_index].id[0]) {
+            pthread_mutex_unlock(&state->lock);
+            sync_slot_binding_error(c, 404, "not_temporary", slot_index);
+            return;
+        }
+        sync_master_end_override_locked(state, cfg, slot_index, "ttl_ended", actor);
+        JSON_Value *resp = json_value_init_object();
+        JSON_Object *ro = json_object(resp);
+        json_object_set_number(ro, "slot", slot_index + 1);
+        json_object_set_string(ro, "status", "reverted");
+        if (state->slot_assignees[slot_index][0]) {
+            json_object_set_string(ro, "assigned_id", state->slot_assignees[slot_index]);
+        } else {
+            json_object_set_null(ro, "assigned_id");
+        }
+        pthread_mutex_unlock(&state->lock);
+        send_json(c, resp, 200, 1);
+        json_value_free(resp);
+        return;
+    }
+    if (strcmp(ri->request_method, "PUT") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        return;
+    }
+
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        free(u.body);
+        sync_slot_binding_error(c, 400, "body_read_failed", -1);
+        return;
+    }
+    JSON_Value *root = json_parse_string(u.body && *u.body ? u.body : "{}");
+    free(u.body);
+    if (!root || json_value_get_type(root) != JSONObject) {
+        if (root) json_value_free(root);
+        sync_slot_binding_error(c, 400, "bad_json", -1);
+        return;
+    }
+    JSON_Object *o = json_object(root);
+    JSON_Value *id_v = json_object_get_value(o, "id");
+    const char *id = json_value_get_string(id_v);
+    if (!id_v || (json_value_get_type(id_v) != JSONNull && (!id || !*id || strlen(id) >= 64))) {
+        json_value_free(root);
+        sync_slot_binding_error(c, 400, "invalid_id", -1);
+        return;
+    }
+    int ttl_s = 0;
+    JSON_Value *ttl_v = json_object_get_value(o, "ttl");
+    if (ttl_v && (ttl_s = sync_parse_ttl(ttl_v)) < 0) {
+        json_value_free(root);
+        JSON_Value *v = json_value_init_object();
+        json_object_set_string(json_object(v), "error", "invalid_ttl");
+        json_object_set_number(json_object(v), "max_ttl_s", SYNC_SLOT_TTL_MAX_S);
+        send_json(c, v, 400, 1);
+        json_value_free(v);
+        return;
+    }
+    if (ttl_s && !id) {
+        /* An empty slot has nothing to expire; free it with /sync/push. */
+        json_value_free(root);
+        sync_slot_binding_error(c, 400, "ttl_needs_id", -1);
+        return;
+    }
+    if (cfg->sync_slots[slot_index].ssh[0]) {
+        json_value_free(root);
+        sync_slot_binding_error(c, 409, "agentless_slot", slot_index);
+        return;
+    }
+
+    pthread_mutex_lock(&state->lock);
+    sync_slave_record_t *rec = id ? sync_master_find_record(state, id, 0) : NULL;
+    if (id && !rec) {
+        pthread_mutex_unlock(&state->lock);
+        JSON_Value *v = json_value_init_object();
+        json_object_set_string(json_object(v), "error", "slave_not_found");
+        json_object_set_string(json_object(v), "id", id);
+        send_json(c, v, 404, 1);
+        json_value_free(v);
+        json_value_free(root);
+        return;
+    }
+    const sync_desired_group_t *group = sync_desired_group_for_slot(state, slot_index);
+    if (group && rec && sync_desired_mismatch_locked(state, group, rec)) {
+        JSON_Value *v = json_value_init_object();
+        json_object_set_string(json_object(v), "error", "slot_managed");
+        json_object_set_number(json_object(v), "slot", slot_index + 1);
+        json_object_set_string(json_object(v), "group", group->name);
+        pthread_mutex_unlock(&state->lock);
+        send_json(c, v, 409, 1);
+        json_value_free(v);
+        json_value_free(root);
+        return;
+    }
+
+    sync_slot_override_t *ov = &state->slot_overrides[slot_index];
+    char previous[64];
+    snprintf(previous, sizeof(previous), "%s",
+             ov->id[0] && !strcmp(state->slot_assignees[slot_index], ov->id)
+                 ? ov->previous_id : state->slot_assignees[slot_index]);
+    char before[SYNC_MAX_SLOTS][64];
+    sync_master_copy_assignees_locked(state, before);
+    sync_master_bind_slot_locked(state, cfg, slot_index, id);
+    sync_master_log_binding_changes_locked(state, cfg, before, ttl_s ? "temporary" : "manual", actor);
+    memset(ov, 0, sizeof(*ov));
+    long long now = now_ms();
+    if (ttl_s) {
+        snprintf(ov->id, sizeof(ov->id), "%s", id);
+        snprintf(ov->previous_id, sizeof(ov->previous_id), "%s", previous);
+        snprintf(ov->actor, sizeof(ov->actor), "%s", actor);
+        ov->set_ms = now;
+        ov->expires_ms = now + (long long)ttl_s * 1000LL;
+        fprintf(stderr, "sync master: slot %d bound to %s for %ds, then back to %s (by %s)\n",
+                slot_index + 1, id, ttl_s, previous[0] ? previous : "-", actor);
+    }
+    sync_master_touch_locked(state);
+
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    json_object_set_number(ro, "slot", slot_index + 1);
+    if (id) json_object_set_string(ro, "assigned_id", id);
+    else json_object_set_null(ro, "assigned_id");
+    json_object_set_number(ro, "generation", state->slot_generation[slot_index]);
+    if (ttl_s) {
+        json_object_set_number(ro, "ttl_s", ttl_s);
+        json_object_set_number(ro, "expires_ms", (double)ov->expires_ms);
+        json_object_set_number(ro, "expires_unix_ms", (double)sync_unix_ms(ov->expires_ms));
+        if (previous[0]) json_object_set_string(ro, "reverts_to", previous);
+        else json_object_set_null(ro, "reverts_to");
+    }
+    pthread_mutex_unlock(&state->lock);
+    json_value_free(root);
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+}
+
+/* Split "/sync/slots/<slot>[/<action>]" into a zero-based slot index and
+ * action. <slot> is a number, name or alias (names may contain '/'). Returns
+ * 0, or the sync_slot_lookup() error with the slot reference left in ref. */
+static int sync_parse_slot_path(const config_t *cfg, const char *uri, int *slot_index,
+                                char *ref, size_t ref_sz, char *action, size_t action_sz) {
+    const char *prefix = "/sync/slots/";
+    size_t plen = strlen(prefix);
+    ref[0] = '\0';
+    action[0] = '\0';
+    if (!uri || strncmp(uri, prefix, plen) != 0) return -1;
+    snprintf(ref, ref_sz, "%s", uri + plen);
+    int rc = sync_slot_lookup(cfg, ref, slot_index);
+    if (rc == 0) return 0;
+    char *sep = strrchr(ref, '/');
+    if (!sep) return rc;
+    char head[128];
+    snprintf(head, sizeof(head), "%.*s", (int)(sep - ref), ref);
+    int head_rc = sync_slot_lookup(cfg, head, slot_index);
+    if (head_rc == 0 || rc != -2) {
+        snprintf(action, action_sz, "%s", sep + 1);
+        snprintf(ref, ref_sz, "%s", head);
+        return head_rc;
+    }
+    return rc;
+}
+
+static const char *sync_claim_policy(const config_t *cfg) {
+    return cfg->sync_claim_policy[0] ? cfg->sync_claim_policy : "first_come";
+}
+
+/*
+ * Hand slot_index to rec on behalf of a claim. A displaced holder is re-seated
+ * on a free slot right away (like a prefer_id reclaim) instead of waiting for
+ * its next heartbeat.
+ */
+static void sync_master_grant_claim_locked(sync_master_state_t *state, const config_t *cfg,
+                                           sync_slave_record_t *rec, int slot_index,
+                                           int priority, char *displaced_out,
+                                           size_t displaced_sz) {
+    char displaced_id[64];
+    displaced_id[0] = '\0';
+    if (state->slot_assignees[slot_index][0] &&
+        !sync_master_slot_matches(state, slot_index, rec->id)) {
+        strncpy(displaced_id, state->slot_assignees[slot_index], sizeof(displaced_id) - 1);
+        displaced_id[sizeof(displaced_id) - 1] = '\0';
+    }
+    (void)sync_master_assign_slot_locked(state, rec, slot_index, 0);
+    rec->claim_priority = priority;
+    sync_master_drop_claims_locked(state, rec->id, -1);
+    if (displaced_id[0]) {
+        sync_slave_record_t *displaced = sync_master_find_record(state, displaced_id, 0);
+        if (displaced) {
+            displaced->slot_index = -1;
+            displaced->claim_priority = 0;
+            (void)sync_master_auto_assign_slot_locked_impl(state, displaced, cfg, slot_index);
+        }
+    }
+    if (displaced_out && displaced_sz > 0) {
+        strncpy(displaced_out, displaced_id, displaced_sz - 1);
+        displaced_out[displaced_sz - 1] = '\0';
+    }
+}
+
+static JSON_Value *sync_claim_error(const char *error, int slot_index, int *status_out,
+                                    int status) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "error", error);
+    if (slot_index >= 0) json_object_set_number(o, "slot", slot_index + 1);
+    *status_out = status;
+    return v;
+}
+
+/*
+ * POST /sync/slots/{slot}/claim: a registered slave asks for a specific slot.
+ * [sync] claim_policy decides: first_come grants free slots only, priority
+ * also lets a higher "priority" displace the current holder, and manual
+ * parks the claim until an operator approves or rejects it. Slots reserved
+ * for another node via prefer_id are never granted by claim.
+ */
+static JSON_Value *sync_master_handle_claim(app_t *app, const config_t *cfg, int slot_index,
+                                            JSON_Object *obj, int *status_out) {
+    const char *id = obj ? json_object_get_string(obj, "id") : NULL;
+    if (!id || !*id) return sync_claim_error("missing_id", -1, status_out, 400);
+    int priority = (int)json_object_get_number(obj, "priority");
+    const char *policy = sync_claim_policy(cfg);
+
+    char before[SYNC_MAX_SLOTS][64];
+    pthread_mutex_lock(&app->master.lock);
+    sync_master_copy_assignees_locked(&app->master, before);
+    sync_master_prune_locked(&app->master, cfg);
+    sync_master_log_binding_changes_locked(&app->master, cfg, before, "expired", "master");
+    sync_master_copy_assignees_locked(&app->master, before);
+
+    sync_slave_record_t *rec = sync_master_find_record(&app->master, id, 0);
+    if (!rec) {
+        pthread_mutex_unlock(&app->master.lock);
+        return sync_claim_error("unknown_id", slot_index, status_out, 404);
+    }
+
+    if (cfg->sync_slots[slot_index].ssh[0]) {
+        pthread_mutex_unlock(&app->master.lock);
+        return sync_claim_error("agentless_slot", slot_index, status_out, 409);
+    }
+
+    const char *prefer_id = cfg->sync_slots[slot_index].prefer_id;
+    if (prefer_id[0] && strcmp(prefer_id, id) != 0) {
+        pthread_mutex_unlock(&app->master.lock);
+        JSON_Value *v = sync_claim_error("slot_reserved", slot_index, status_out, 409);
+        json_object_set_string(json_object(v), "prefer_id", prefer_id);
+        return v;
+    }
+
+    const sync_desired_group_t *group = sync_desired_group_for_slot(&app->master, slot_index);
+    if (group && sync_desired_mismatch_locked(&app->master, group, rec)) {
+        JSON_Value *v = sync_claim_error("slot_managed", slot_index, status_out, 409);
+        json_object_set_string(json_object(v), "group", group->name);
+        pthread_mutex_unlock(&app->master.lock);
+        return v;
+    }
+
+    char holder[64];
+    strncpy(holder, app->master.slot_assignees[slot_index], sizeof(holder) - 1);
+    holder[sizeof(holder) - 1] = '\0';
+    int already = holder[0] && strcmp(holder, id) == 0;
+    const char *status = "granted";
+    char displaced[64];
+    displaced[0] = '\0';
+
+    if (already) {
+        rec->claim_priority = priority;
+        sync_master_drop_claims_locked(&app->master, id, -1);
+    } else if (!strcmp(policy, "manual")) {
+        sync_slot_claim_t *slot_claim = NULL;
+        for (int i = 0; i < SYNC_MAX_CLAIMS && !slot_claim; i++) {
+            sync_slot_claim_t *cl = &app->master.claims[i];
+            if (cl->in_use && cl->slot_index == slot_index && !strcmp(cl->id, id)) slot_claim = cl;
+        }
+        for (int i = 0; i < SYNC_MAX_CLAIMS && !slot_claim; i++) {
+            if (!app->master.claims[i].in_use) slot_claim = &app->master.claims[i];
+        }
+        if (!slot_claim) {
+            pthread_mutex_unlock(&app->master.lock);
+            return sync_claim_error("too_many_claims", slot_index, status_out, 503);
+        }
+        if (slot_claim->rejected) {
+            pthread_mutex_unlock(&app->master.lock);
+            return sync_claim_error("claim_rejected", slot_index, status_out, 409);
+        }
+        int fresh = !slot_claim->in_use;
+        if (fresh) {
+            memset(slot_claim, 0, sizeof(*slot_claim));
+            slot_claim->in_use = 1;
+            slot_claim->slot_index = slot_index;
+            strncpy(slot_claim->id, id, sizeof(slot_claim->id) - 1);
+            slot_claim->ts_ms = now_ms();
+        }
+        if (fresh || slot_claim->priority != priority) {
+            slot_claim->priority = priority;
+            sync_master_touch_locked(&app->master);
+        }
+        status = "pending";
+        if (fresh) {
+            fprintf(stderr, "sync master: %s claims slot %d (awaiting approval)\n",
+                    id, slot_index + 1);
+            JSON_Value *ev = json_value_init_object();
+            JSON_Object *eo = json_object(ev);
+            json_object_set_number(eo, "slot", slot_index + 1);
+            json_object_set_string(eo, "id", id);
+            json_object_set_number(eo, "priority", priority);
+            (void)events_emit("slot_claim", ev);
+        }
+    } else if (holder[0]) {
+        sync_slave_record_t *hrec = sync_master_find_record(&app->master, holder, 0);
+        int holder_priority = hrec ? hrec->claim_priority : 0;
+        if (strcmp(policy, "priority") != 0 || priority <= holder_priority) {
+            pthread_mutex_unlock(&app->master.lock);
+            int lower = !strcmp(policy, "priority");
+            JSON_Value *v = sync_claim_error(lower ? "lower_priority" : "slot_taken",
+                                             slot_index, status_out, 409);
+            JSON_Object *o = json_object(v);
+            json_object_set_string(o, "holder", holder);
+            if (lower) json_object_set_number(o, "holder_priority", holder_priority);
+            return v;
+        }
+        sync_master_grant_claim_locked(&app->master, cfg, rec, slot_index, priority,
+                                       displaced, sizeof(displaced));
+    } else {
+        sync_master_grant_claim_locked(&app->master, cfg, rec, slot_index, priority,
+                                       displaced, sizeof(displaced));
+    }
+    int generation = app->master.slot_generation[slot_index];
+    sync_master_log_binding_changes_locked(&app->master, cfg, before, "claim", id);
+    pthread_mutex_unlock(&app->master.lock);
+
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    json_object_set_string(ro, "status", status);
+    json_object_set_string(ro, "id", id);
+    json_object_set_number(ro, "slot", slot_index + 1);
+    json_object_set_string(ro, "policy", policy);
+    if (!strcmp(status, "granted")) {
+        json_object_set_number(ro, "slot_generation", generation);
+        if (displaced[0]) json_object_set_string(ro, "displaced", displaced);
+    }
+    *status_out = !strcmp(status, "pending") ? 202 : 200;
+    return resp;
+}
+
+/*
+ * POST /sync/slots/{slot}/approve|reject {"id": ...}: operator decision on a
+ * pending manual claim. Approving ignores the holder's priority; the claim
+ * is an explicit hand-over.
+ */
+static JSON_Value *sync_master_decide_claim(app_t *app, const config_t *cfg, int slot_index,
+                                            JSON_Object *obj, int approve, const char *actor,
+                                            int *status_out) {
+    const char *id = obj ? json_object_get_string(obj, "id") : NULL;
+    if (!id || !*id) return sync_claim_error("missing_id", -1, status_out, 400);
+
+    char before[SYNC_MAX_SLOTS][64];
+    pthread_mutex_lock(&app->master.lock);
+    sync_slot_claim_t *claim = NULL;
+    for (int i = 0; i < SYNC_MAX_CLAIMS && !claim; i++) {
+        sync_slot_claim_t *cl = &app->master.claims[i];
+        if (cl->in_use && !cl->rejected && cl->slot_index == slot_index &&
+            !strcmp(cl->id, id)) {
+            claim = cl;
+        }
+    }
+    if (!claim) {
+        pthread_mutex_unlock(&app->master.lock);
+        return sync_claim_error("claim_not_found", slot_index, status_out, 404);
+    }
+    int priority = claim->priority;
+    char displaced[64];
+    displaced[0] = '\0';
+    if (approve) {
+        sync_slave_record_t *rec = sync_master_find_record(&app->master, id, 0);
+        if (!rec) {
+            sync_master_drop_claims_locked(&app->master, id, -1);
+            pthread_mutex_unlock(&app->master.lock);
+            return sync_claim_error("unknown_id", slot_index, status_out, 404);
+        }
+        sync_master_copy_assignees_locked(&app->master, before);
+        sync_master_grant_claim_locked(&app->master, cfg, rec, slot_index, priority,
+                                       displaced, sizeof(displaced));
+        sync_master_log_binding_changes_locked(&app->master, cfg, before, "claim", actor);
+    } else {
+        claim->rejected = 1;
+        sync_master_touch_locked(&app->master);
+    }
+    pthread_mutex_unlock(&app->master.lock);
+
+    fprintf(stderr, "sync master: claim by %s for slot %d %s\n", id, slot_index + 1,
+            approve ? "approved" : "rejected");
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    json_object_set_string(ro, "status", approve ? "granted" : "rejected");
+    json_object_set_string(ro, "id", id);
+    json_object_set_number(ro, "slot", slot_index + 1);
+    if (displaced[0]) json_object_set_string(ro, "displaced", displaced);
+    *status_out = 200;
+    return resp;
+}
+
+static void sync_send_slot_log(struct mg_connection *c, app_t *app, const config_t *cfg,
+                               int slot_index, int limit) {
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    JSON_Value *arr_v = json_value_init_array();
+    JSON_Array *arr = json_array(arr_v);
+
+    json_object_set_number(ro, "slot", slot_index + 1);
+    if (cfg->sync_slots[slot_index].name[0]) {
+        json_object_set_string(ro, "label", cfg->sync_slots[slot_index].name);
+    }
+
+    pthread_mutex_lock(&app->master.lock);
+    unsigned long long version = app->master.version;
+    long long modified = app->master.modified_unix;
+    if (app->master.slot_assignees[slot_index][0]) {
+        json_object_set_string(ro, "assigned_id", app->master.slot_assignees[slot_index]);
+    }
+    unsigned total = app->master.binding_log_total;
+    unsigned kept = total < SYNC_BINDING_LOG_MAX ? total : SYNC_BINDING_LOG_MAX;
+    int added = 0;
+    for (unsigned i = 0; i < kept && added < limit; i++) {
+        const sync_binding_change_t *e =
+            &app->master.binding_log[(total - 1 - i) % SYNC_BINDING_LOG_MAX];
+        if (e->slot_index != slot_index) continue;
+        JSON_Value *item = json_value_init_object();
+        JSON_Object *io = json_object(item);
+        json_object_set_number(io, "ts_ms", (double)e->ts_ms);
+        json_object_set_number(io, "ts_unix_ms", (double)e->ts_unix_ms);
+        if (e->old_id[0]) json_object_set_string(io, "old_id", e->old_id);
+        else json_object_set_null(io, "old_id");
+        if (e->new_id[0]) json_object_set_string(io, "new_id", e->new_id);
+        else json_object_set_null(io, "new_id");
+        json_object_set_string(io, "reason", e->reason);
+        if (e->actor[0]) json_object_set_string(io, "actor", e->actor);
+        json_array_append_value(arr, item);
+        added++;
+    }
+    pthread_mutex_unlock(&app->master.lock);
+
+    json_object_set_value(ro, "changes", arr_v);
+    char *body = json_serialize_to_string(resp);
+    json_value_free(resp);
+    if (!body) {
+        send_plain(c, 500, "oom", 1);
+        return;
+    }
+    char scope[32];
+    snprintf(scope, sizeof(scope), "slot%d-log%d", slot_index + 1, limit);
+    send_json_cached(c, body, strlen(body), scope, version, modified, 1);
+    json_free_serialized_string(body);
+}
+
+/* ---------- Desired slot topology ---------- */
+
+/* Best node to fill slot_index of g: the slot's prefer_id, then nodes that
+ * hold no slot, then nodes on a slot outside the topology; ties go to the
+ * better dispatch record and then the most recent heartbeat. */
+static sync_slave_record_t *sync_desired_candidate_locked(sync_master_state_t *state,
+                                                          const config_t *cfg,
+                                                          const sync_desired_group_t *g,
+                                                          int slot_index) {
+    const char *prefer = cfg ? cfg->sync_slots[slot_index].prefer_id : "";
+    sync_slave_record_t *cand = NULL;
+    int cand_rank = 0;
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        sync_slave_record_t *rec = &state->records[i];
+        if (!rec->in_use || rec->down || rec->quarantined_ms || rec->decommission_ms ||
+            rec->last_seen_ms <= 0) {
+            continue;
+        }
+        int held = rec->slot_index >= 0 &&
+                   sync_master_slot_matches(state, rec->slot_index, rec->id);
+        if (held && sync_desired_group_for_slot(state, rec->slot_index)) continue;
+        if (sync_desired_mismatch_locked(state, g, rec)) continue;
+        int rank = (prefer[0] && !strcmp(prefer, rec->id)) ? 0 : (held ? 2 : 1);
+        if (cand) {
+            if (rank > cand_rank) continue;
+            if (rank == cand_rank) {
+                int cmp = sync_health_compare_locked(cfg, rec, cand);
+                if (cmp > 0 || (cmp == 0 && rec->last_seen_ms <= cand->last_seen_ms)) continue;
+            }
+        }
+        cand = rec;
+        cand_rank = rank;
+    }
+    return cand;
+}
+
+/*
+ * One pass over the desired topology: release holders that are down, fail
+ * their group's constraints or exceed its replica count, then fill the
+ * group's free slots from sync_desired_candidate_locked. Drift (fewer
+ * matching holders than replicas) is published as slot_drift when it starts
+ * and slot_converged when it ends. Callers log the binding changes.
+ */
+static void sync_master_reconcile_locked(sync_master_state_t *state, const config_t *cfg) {
+    long long now = now_ms();
+    state->reconciled_ms = now;
+    for (int gi = 0; gi < state->desired_count; gi++) {
+        const sync_desired_group_t *g = &state->desired[gi];
+        int kept = 0;
+        for (int slot = 0; slot < SYNC_MAX_SLOTS; slot++) {
+            if (!g->slots[slot] || !state->slot_assignees[slot][0]) continue;
+            sync_slave_record_t *rec =
+                sync_master_find_record(state, state->slot_assignees[slot], 0);
+            if (rec && !rec->down && kept < g->replicas &&
+                !sync_desired_mismatch_locked(state, g, rec)) {
+                kept++;
+                continue;
+            }
+            sync_master_release_slot_locked(state, slot);
+        }
+    }
+
+    for (int gi = 0; gi < state->desired_count; gi++) {
+        sync_desired_group_t *g = &state->desired[gi];
+        int bound = 0;
+        for (int slot = 0; slot < SYNC_MAX_SLOTS; slot++) {
+            if (g->slots[slot] && state->slot_assignees[slot][0]) bound++;
+        }
+        for (int slot = 0; slot < SYNC_MAX_SLOTS && bound < g->replicas; slot++) {
+            if (!g->slots[slot] || state->slot_assignees[slot][0]) continue;
+            sync_slave_record_t *cand = sync_desired_candidate_locked(state, cfg, g, slot);
+            if (!cand) break;
+            (void)sync_master_assign_slot_locked(state, cand, slot, 0);
+            bound++;
+        }
+        if (g->bound != bound) {
+            g->bound = bound;
+            sync_master_touch_locked(state);
+        }
+
+        if (bound < g->replicas && !g->drift_since_ms) {
+            g->drift_since_ms = now;
+            sync_master_touch_locked(state);
+            fprintf(stderr, "sync master: desired group %s drifted (%d of %d bound)\n",
+                    g->name, bound, g->replicas);
+            JSON_Value *ev = json_value_init_object();
+            JSON_Object *eo = json_object(ev);
+            json_object_set_string(eo, "group", g->name);
+            json_object_set_number(eo, "bound", bound);
+            json_object_set_number(eo, "replicas", g->replicas);
+            (void)events_emit("slot_drift", ev);
+        } else if (bound >= g->replicas && g->drift_since_ms) {
+            long long drift_s = (now - g->drift_since_ms) / 1000;
+            g->drift_since_ms = 0;
+            sync_master_touch_locked(state);
+            fprintf(stderr, "sync master: desired group %s converged after %llds\n",
+                    g->name, drift_s);
+            JSON_Value *ev = json_value_init_object();
+            JSON_Object *eo = json_object(ev);
+            json_object_set_string(eo, "group", g->name);
+            json_object_set_number(eo, "replicas", g->replicas);
+            json_object_set_number(eo, "drift_s", (double)drift_s);
+            (void)events_emit("slot_converged", ev);
+        }
+    }
+}
+
+static int sync_desired_copy(char *dst, size_t dst_sz, JSON_Value *v) {
+    const char *s = json_value_get_string(v);
+    if (!s || strlen(s) >= dst_sz) return -1;
+    snprintf(dst, dst_sz, "%s", s);
+    return 0;
+}
+
+static const char *sync_parse_desired_match(JSON_Object *mo, sync_desired_group_t *out,
+                                            const char **field) {
+    size_t n = json_object_get_count(mo);
+    for (size_t i = 0; i < n; i++) {
+        const char *k = json_object_get_name(mo, i);
+        JSON_Value *v = json_object_get_value_at(mo, i);
+        *field = k;
+        if (!strcmp(k, "ids")) {
+            JSON_Array *arr = json_value_get_array(v);
+            size_t cnt = json_array_get_count(arr);
+            if (!arr || cnt > SYNC_DESIRED_MAX_IDS) return "invalid_group";
+            for (size_t j = 0; j < cnt; j++) {
+                if (sync_desired_copy(out->ids[j], sizeof(out->ids[j]),
+                                      json_array_get_value(arr, j)) != 0 || !out->ids[j][0]) {
+                    return "invalid_group";
+                }
+            }
+            out->id_count = (int)cnt;
+        } else if (!strcmp(k, "device")) {
+            if (sync_desired_copy(out->device, sizeof(out->device), v) != 0) return "invalid_group";
+        } else if (!strcmp(k, "role")) {
+            if (sync_desired_copy(out->role, sizeof(out->role), v) != 0) return "invalid_group";
+        } else if (!strcmp(k, "caps")) {
+            JSON_Array *arr = json_value_get_array(v);
+            if (!arr) return "invalid_group";
+            size_t pos = 0;
+            for (size_t j = 0; j < json_array_get_count(arr); j++) {
+                const char *cap = json_array_get_string(arr, j);
+                if (!cap || !*cap || strchr(cap, ',')) return "invalid_group";
+                size_t len = strlen(cap);
+                if (pos + len + 1 >= sizeof(out->caps)) return "invalid_group";
+                if (pos) out->caps[pos++] = ',';
+                memcpy(out->caps + pos, cap, len + 1);
+                pos += len;
+            }
+        } else if (!strcmp(k, "labels")) {
+            JSON_Object *lo = json_value_get_object(v);
+            size_t cnt = json_object_get_count(lo);
+            if (!lo || cnt > SYNC_DESIRED_MAX_LABELS) return "invalid_group";
+            for (size_t j = 0; j < cnt; j++) {
+                const char *lk = json_object_get_name(lo, j);
+                if (!*lk || strlen(lk) >= sizeof(out->labels[j].key) ||
+                    sync_desired_copy(out->labels[j].value, sizeof(out->labels[j].value),
+                                      json_object_get_value_at(lo, j)) != 0) {
+                    return "invalid_group";
+                }
+                snprintf(out->labels[j].key, sizeof(out->labels[j].key), "%s", lk);
+            }
+            out->label_count = (int)cnt;
+        } else {
+            return "invalid_group";
+        }
+    }
+    return NULL;
+}
+
+/* Validate one group of a desired topology. Returns NULL or an error code,
+ * with the offending field in *field. */
+static const char *sync_parse_desired_group(const config_t *cfg, JSON_Object *go,
+                                            sync_desired_group_t *out, const char **field) {
+    memset(out, 0, sizeof(*out));
+    *field = NULL;
+    if (!go) return "invalid_group";
+    *field = "name";
+    if (sync_desired_copy(out->name, sizeof(out->name), json_object_get_value(go, "name")) != 0 ||
+        !out->name[0]) {
+        return "invalid_group";
+    }
+    *field = "slots";
+    JSON_Array *slots = json_object_get_array(go, "slots");
+    int nslots = 0;
+    if (!slots || json_array_get_count(slots) == 0) return "invalid_group";
+    for (size_t i = 0; i < json_array_get_count(slots); i++) {
+        JSON_Value *sv = json_array_get_value(slots, i);
+        if (json_value_get_type(sv) == JSONString) {
+            unsigned char hits[SYNC_MAX_SLOTS];
+            if (sync_slot_match(cfg, json_value_get_string(sv), hits) == 0) return "invalid_slot";
+            for (int slot = 0; slot < SYNC_MAX_SLOTS; slot++) {
+                if (!hits[slot]) continue;
+                if (!out->slots[slot]) nslots++;
+                out->slots[slot] = 1;
+            }
+            continue;
+        }
+        double slot = json_value_get_number(sv);
+        if (json_value_get_type(sv) != JSONNumber || slot < 1 || slot > sync_slot_count(cfg)) {
+            return "invalid_slot";
+        }
+        if (!out->slots[(int)slot - 1]) nslots++;
+        out->slots[(int)slot - 1] = 1;
+    }
+    out->replicas = nslots;
+    JSON_Value *rv = json_object_get_value(go, "replicas");
+    if (rv) {
+        *field = "replicas";
+        double replicas = json_value_get_number(rv);
+        if (json_value_get_type(rv) != JSONNumber || replicas < 1 || replicas > nslots) {
+            return "invalid_replicas";
+        }
+        out->replicas = (int)replicas;
+    }
+    JSON_Value *mv = json_object_get_value(go, "match");
+    if (mv) {
+        *field = "match";
+        JSON_Object *mo = json_value_get_object(mv);
+        if (!mo) return "invalid_group";
+        const char *err = sync_parse_desired_match(mo, out, field);
+        if (err) return err;
+    }
+    for (size_t i = 0; i < json_object_get_count(go); i++) {
+        const char *k = json_object_get_name(go, i);
+        if (strcmp(k, "name") && strcmp(k, "slots") && strcmp(k, "replicas") &&
+            strcmp(k, "match")) {
+            *field = k;
+            return "invalid_group";
+        }
+    }
+    *field = NULL;
+    return NULL;
+}
+
+/* Parse {"groups":[...]} into out. Returns NULL or an error code with the
+ * failing group's index in *index (-1 for the document). */
+static const char *sync_parse_desired(const config_t *cfg, JSON_Object *root,
+                                      sync_desired_group_t *out, int *count,
+                                      int *index, const char **field) {
+    *count = 0;
+    *index = -1;
+    *field = NULL;
+    JSON_Array *groups = json_object_get_array(root, "groups");
+    if (!groups) return "missing_groups";
+    size_t n = json_array_get_count(groups);
+    if (n > SYNC_MAX_SLOTS) return "too_many_groups";
+    for (size_t i = 0; i < n; i++) {
+        *index = (int)i;
+        const char *err = sync_parse_desired_group(cfg, json_array_get_object(groups, i), &out[i], field);
+        if (err) return err;
+        for (size_t j = 0; j < i; j++) {
+            if (!strcmp(out[j].name, out[i].name)) {
+                *field = "name";
+                return "duplicate_group";
+            }
+            for (int slot = 0; slot < SYNC_MAX_SLOTS; slot++) {
+                if (out[j].slots[slot] && out[i].slots[slot]) {
+                    *field = "slots";
+                    return "slot_in_two_groups";
+                }
+            }
+        }
+    }
+    *index = -1;
+    *count = (int)n;
+    return NULL;
+}
+
+static JSON_Value *sync_desired_group_json(const sync_desired_group_t *g) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "name", g->name);
+    JSON_Value *slots_v = json_value_init_array();
+    for (int slot = 0; slot < SYNC_MAX_SLOTS; slot++) {
+        if (g->slots[slot]) json_array_append_number(json_array(slots_v), slot + 1);
+    }
+    json_object_set_value(o, "slots", slots_v);
+    json_object_set_number(o, "replicas", g->replicas);
+    JSON_Value *mv = json_value_init_object();
+    JSON_Object *mo = json_object(mv);
+    if (g->id_count > 0) {
+        JSON_Value *ids_v = json_value_init_array();
+        for (int i = 0; i < g->id_count; i++) json_array_append_string(json_array(ids_v), g->ids[i]);
+        json_object_set_value(mo, "ids", ids_v);
+    }
+    if (g->device[0]) json_object_set_string(mo, "device", g->device);
+    if (g->role[0]) json_object_set_string(mo, "role", g->role);
+    if (g->caps[0]) {
+        JSON_Value *caps_v = json_value_init_array();
+        char caps[sizeof(g->caps)];
+        snprintf(caps, sizeof(caps), "%s", g->caps);
+        char *save = NULL;
+        for (char *tok = strtok_r(caps, ",", &save); tok; tok = strtok_r(NULL, ",", &save)) {
+            json_array_append_string(json_array(caps_v), tok);
+        }
+        json_object_set_value(mo, "caps", caps_v);
+    }
+    if (g->label_count > 0) {
+        JSON_Value *lv = json_value_init_object();
+        for (int i = 0; i < g->label_count; i++) {
+            json_object_set_string(json_object(lv), g->labels[i].key, g->labels[i].value);
+        }
+        json_object_set_value(mo, "labels", lv);
+    }
+    json_object_set_value(o, "match", mv);
+    return v;
+}
+
+static JSON_Value *sync_desired_json_locked(const sync_master_state_t *state) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Value *groups_v = json_value_init_array();
+    for (int i = 0; i < state->desired_count; i++) {
+        json_array_append_value(json_array(groups_v), sync_desired_group_json(&state->desired[i]));
+    }
+    json_object_set_value(json_object(v), "groups", groups_v);
+    json_object_set_number(json_object(v), "updated", (double)state->desired_updated_unix);
+    return v;
+}
+
+/* Write the desired topology to [sync] desired_path, replacing the file
+ * atomically. */
+static void sync_persist_desired(const config_t *cfg, JSON_Value *doc) {
+    if (!cfg->sync_desired_path[0]) return;
+    char tmp[sizeof(cfg->sync_desired_path) + 8];
+    snprintf(tmp, sizeof(tmp), "%s.tmp", cfg->sync_desired_path);
+    if (json_serialize_to_file_pretty(doc, tmp) != JSONSuccess ||
+        rename(tmp, cfg->sync_desired_path) != 0) {
+        fprintf(stderr, "WARN: cannot write desired slot topology to %s\n",
+                cfg->sync_desired_path);
+        (void)unlink(tmp);
+    }
+}
+
+void sync_master_load_desired(app_t *app, const config_t *cfg) {
+    if (!app || !cfg || strcasecmp(cfg->sync_role, "master") != 0) return;
+    if (!cfg->sync_desired_path[0] || access(cfg->sync_desired_path, F_OK) != 0) return;
+    JSON_Value *v = json_parse_file(cfg->sync_desired_path);
+    sync_desired_group_t groups[SYNC_MAX_SLOTS];
+    int count = 0, index = -1;
+    const char *field = NULL;
+    const char *err = json_object(v)
+        ? sync_parse_desired(cfg, json_object(v), groups, &count, &index, &field)
+        : "bad_json";
+    if (err) {
+        fprintf(stderr, "WARN: ignoring desired slot topology %s (%s)\n",
+                cfg->sync_desired_path, err);
+        if (v) json_value_free(v);
+        return;
+    }
+    pthread_mutex_lock(&app->master.lock);
+    memcpy(app->master.desired, groups, sizeof(groups));
+    app->master.desired_count = count;
+    app->master.desired_updated_unix = (long long)json_object_get_number(json_object(v), "updated");
+    sync_master_touch_locked(&app->master);
+    pthread_mutex_unlock(&app->master.lock);
+    fprintf(stderr, "sync master: loaded %d desired slot groups from %s\n",
+            count, cfg->sync_desired_path);
+    json_value_free(v);
+}
+
+/* The part of the registry worth keeping across a restart, in the shape of
+ * GET /sync/slaves so sync_master_seed_snapshot reads it back. Heartbeat
+ * details (last seen, load, probes) are left out: they change on every
+ * registration and would make every one of them a write. */
+static JSON_Value *sync_registry_json_locked(const sync_master_state_t *state, const config_t *cfg) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Value *arr_v = json_value_init_array();
+    JSON_Array *arr = json_array(arr_v);
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        const sync_slave_record_t *rec = &state->records[i];
+        if (!rec->in_use || rec->bench) continue;
+        JSON_Value *rv = json_value_init_object();
+        JSON_Object *ro = json_object(rv);
+        json_object_set_string(ro, "id", rec->id);
+        if (rec->remote_ip[0]) json_object_set_string(ro, "remote_ip", rec->remote_ip);
+        if (rec->announced_address[0]) json_object_set_string(ro, "address", rec->announced_address);
+        if (rec->port > 0) json_object_set_number(ro, "port", rec->port);
+        if (rec->device[0]) json_object_set_string(ro, "device", rec->device);
+        if (rec->role[0]) json_object_set_string(ro, "role", rec->role);
+        if (rec->version[0]) json_object_set_string(ro, "version", rec->version);
+        if (rec->transport[0]) json_object_set_string(ro, "transport", rec->transport);
+        if (rec->caps[0]) json_object_set_string(ro, "caps", rec->caps);
+        if (rec->claim_priority) json_object_set_number(ro, "claim_priority", rec->claim_priority);
+        if (rec->slot_index >= 0 && rec->slot_index < sync_slot_count(cfg) &&
+            sync_master_slot_matches(state, rec->slot_index, rec->id)) {
+            json_object_set_number(ro, "slot", rec->slot_index + 1);
+        }
+        json_array_append_value(arr, rv);
+    }
+    json_object_set_value(json_object(v), "slaves", arr_v);
+    JSON_Value *tmp_v = json_value_init_array();
+    long long now = now_ms();
+    for (int slot = 0; slot < SYNC_MAX_SLOTS; slot++) {
+        const sync_slot_override_t *ov = &state->slot_overrides[slot];
+        if (!ov->id[0]) continue;
+        JSON_Value *tv = json_value_init_object();
+        JSON_Object *to = json_object(tv);
+        json_object_set_number(to, "slot", slot + 1);
+        json_object_set_string(to, "id", ov->id);
+        if (ov->previous_id[0]) json_object_set_string(to, "previous_id", ov->previous_id);
+        json_object_set_number(to, "expires_unix",
+                               (double)((long long)time(NULL) + (ov->expires_ms - now) / 1000));
+        if (ov->actor[0]) json_object_set_string(to, "set_by", ov->actor);
+        json_array_append_value(json_array(tmp_v), tv);
+    }
+    if (json_array_get_count(json_array(tmp_v)) > 0) {
+        json_object_set_value(json_object(v), "temporary_bindings", tmp_v);
+    } else {
+        json_value_free(tmp_v);
+    }
+    return v;
+}
+
+static pthread_mutex_t g_registry_write_lock = PTHREAD_MUTEX_INITIALIZER;
+
+/* LOADED takes the registry as written: it was just read back from the file. */
+enum { SYNC_REGISTRY_TICK, SYNC_REGISTRY_IF_CHANGED, SYNC_REGISTRY_ALWAYS, SYNC_REGISTRY_LOADED };
+
+/* Write-behind of the registry. A tick writes once a change has waited
+ * [sync] registry_flush_s or registry_flush_changes changes piled up, so a
+ * busy fleet does not rewrite the file (and wear the flash under it) on
+ * every heartbeat. Returns 0 when nothing had to be written or the write
+ * succeeded. */
+static int sync_registry_sync(app_t *app, const config_t *cfg, int mode, JSON_Object *out) {
+    if (!cfg->sync_registry_path[0]) return -1;
+    sync_master_state_t *state = &app->master;
+    pthread_mutex_lock(&g_registry_write_lock);
+    pthread_mutex_lock(&state->lock);
+    if (mode == SYNC_REGISTRY_TICK && !state->registry_dirty_ms &&
+        state->registry_seen_version == state->version) {
+        pthread_mutex_unlock(&state->lock);
+        pthread_mutex_unlock(&g_registry_write_lock);
+        return 0;
+    }
+    state->registry_seen_version = state->version;
+    JSON_Value *doc = sync_registry_json_locked(state, cfg);
+    size_t nodes = json_array_get_count(json_object_get_array(json_object(doc), "slaves"));
+    char *ser = json_serialize_to_string_pretty(doc);
+    json_value_free(doc);
+    if (!ser) {
+        pthread_mutex_unlock(&state->lock);
+        pthread_mutex_unlock(&g_registry_write_lock);
+        return -1;
+    }
+    char hash[17];
+    sync_profile_hash(ser, hash, sizeof(hash));
+    long long now = now_ms();
+    int write = mode == SYNC_REGISTRY_ALWAYS;
+    int changed = strcmp(hash, state->registry_written) != 0;
+    if (mode == SYNC_REGISTRY_LOADED) memcpy(state->registry_written, hash, sizeof(hash));
+    if (!write && !strcmp(hash, state->registry_written)) {
+        state->registry_dirty_ms = 0;
+        state->registry_changes = 0;
+    } else if (!write) {
+        if (strcmp(hash, state->registry_seen) != 0) state->registry_changes++;
+        if (!state->registry_dirty_ms) state->registry_dirty_ms = now;
+        write = mode == SYNC_REGISTRY_IF_CHANGED ||
+                now - state->registry_dirty_ms >= (long long)cfg->sync_registry_flush_s * 1000 ||
+                state->registry_changes >= cfg->sync_registry_flush_changes;
+    }
+    memcpy(state->registry_seen, hash, sizeof(hash));
+    pthread_mutex_unlock(&state->lock);
+
+    int rc = 0;
+    size_t len = strlen(ser);
+    if (write) {
+        char tmp[sizeof(cfg->sync_registry_path) + 8];
+        snprintf(tmp, sizeof(tmp), "%s.tmp", cfg->sync_registry_path);
+        FILE *f = fopen(tmp, "w");
+        int ok = f && fwrite(ser, 1, len, f) == len;
+        if (f && fclose(f) != 0) ok = 0;
+        if (!ok || rename(tmp, cfg->sync_registry_path) != 0) {
+            fprintf(stderr, "WARN: cannot write node registry to %s\n", cfg->sync_registry_path);
+            (void)unlink(tmp);
+            rc = -1;
+        } else {
+            pthread_mutex_lock(&state->lock);
+            memcpy(state->registry_written, hash, sizeof(hash));
+            state->registry_dirty_ms = 0;
+            state->registry_changes = 0;
+            state->registry_flushed_unix = (long long)time(NULL);
+            state->registry_writes++;
+            pthread_mutex_unlock(&state->lock);
+        }
+    }
+    json_free_serialized_string(ser);
+    pthread_mutex_unlock(&g_registry_write_lock);
+    if (out) {
+        json_object_set_string(out, "path", cfg->sync_registry_path);
+        json_object_set_number(out, "nodes", (double)nodes);
+        json_object_set_number(out, "bytes", (double)len);
+        json_object_set_boolean(out, "changed", changed);
+        json_object_set_boolean(out, "written", write && rc == 0);
+    }
+    return rc;
+}
+
+int sync_master_flush_registry(app_t *app, const config_t *cfg, int force, JSON_Object *out) {
+    if (!app || !cfg) return -1;
+    return sync_registry_sync(app, cfg, force ? SYNC_REGISTRY_ALWAYS : SYNC_REGISTRY_IF_CHANGED, out);
+}
+
+void sync_master_load_registry(app_t *app, const config_t *cfg) {
+    if (!app || !cfg || strcasecmp(cfg->sync_role, "master") != 0) return;
+    if (!cfg->sync_registry_path[0] || access(cfg->sync_registry_path, F_OK) != 0) return;
+    JSON_Value *v = json_parse_file(cfg->sync_registry_path);
+    if (!json_object_get_array(json_object(v), "slaves")) {
+        fprintf(stderr, "WARN: ignoring node registry %s (bad_json)\n", cfg->sync_registry_path);
+        if (v) json_value_free(v);
+        return;
+    }
+    int seeded = sync_master_seed_snapshot(app, cfg, json_object(v), NULL, "restore", "master");
+    /* Temporary bindings keep counting down across the restart; one that
+     * ran out meanwhile reverts on the first tick. */
+    JSON_Array *tmp = json_object_get_array(json_object(v), "temporary_bindings");
+    long long now = now_ms(), now_unix = (long long)time(NULL);
+    pthread_mutex_lock(&app->master.lock);
+    for (size_t i = 0; i < json_array_get_count(tmp); i++) {
+        JSON_Object *to = json_array_get_object(tmp, i);
+        int slot = (int)json_object_get_number(to, "slot") - 1;
+        const char *id = json_object_get_string(to, "id");
+        const char *previous = json_object_get_string(to, "previous_id");
+        const char *set_by = json_object_get_string(to, "set_by");
+        if (slot < 0 || slot >= sync_slot_count(cfg) || !id ||
+            strcmp(app->master.slot_assignees[slot], id) != 0) {
+            continue;
+        }
+        sync_slot_override_t *ov = &app->master.slot_overrides[slot];
+        snprintf(ov->id, sizeof(ov->id), "%s", id);
+        snprintf(ov->previous_id, sizeof(ov->previous_id), "%s", previous ? previous : "");
+        snprintf(ov->actor, sizeof(ov->actor), "%s", set_by ? set_by : "");
+        ov->set_ms = now;
+        ov->expires_ms = now + ((long long)json_object_get_number(to, "expires_unix") - now_unix) * 1000LL;
+    }
+    pthread_mutex_unlock(&app->master.lock);
+    json_value_free(v);
+    fprintf(stderr, "sync master: restored %d nodes from %s\n", seeded, cfg->sync_registry_path);
+    (void)sync_registry_sync(app, cfg, SYNC_REGISTRY_LOADED, NULL);
+}
+
+static void *sync_recall_thread(void *arg) {
+    (void)arg;
+    dnscache_book_node_t nodes[SYNC_MAX_SLAVES];
+    int n = dnscache_book_nodes(nodes, SYNC_MAX_SLAVES);
+    int found = 0;
+    for (int i = 0; i < n; i++) {
+        if (nodes[i].port > 0 && scan_probe_node(nodes[i].ip, nodes[i].port) == 0) found++;
+    }
+    fprintf(stderr, "sync master: %d of %d remembered nodes answered at their last address\n",
+            found, n);
+    return NULL;
+}
+
+void sync_master_recall_nodes(const config_t *cfg) {
+    if (!cfg || strcasecmp(cfg->sync_role, "master") != 0 || !cfg->sync_address_book_path[0]) return;
+    dnscache_book_node_t first;
+    if (dnscache_book_nodes(&first, 1) == 0) return;
+    pthread_t th;
+    if (pthread_create(&th, NULL, sync_recall_thread, NULL) == 0) pthread_detach(th);
+}
+
+/*
+ * GET    /sync/slots/desired - the declared topology
+ * PUT    /sync/slots/desired - {"groups":[{"name":..,"slots":[..],"replicas":..,
+ *                               "match":{"ids":[..],"device":..,"role":..,
+ *                               "caps":[..],"labels":{..}}}]}
+ * DELETE /sync/slots/desired - stop managing slots; bindings stay as they are
+ */
+static void sync_handle_desired(struct mg_connection *c, app_t *app, const config_t *cfg) {
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    int is_put = !strcmp(ri->request_method, "PUT");
+    int is_delete = !strcmp(ri->request_method, "DELETE");
+    if (!is_put && !is_delete && strcmp(ri->request_method, "GET") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        return;
+    }
+
+    sync_desired_group_t groups[SYNC_MAX_SLOTS];
+    int count = 0;
+    memset(groups, 0, sizeof(groups));
+    if (is_put) {
+        upload_t u = {0};
+        if (read_body(c, &u) != 0) {
+            free(u.body);
+            send_json_error(c, 400, "body_read_failed");
+            return;
+        }
+        JSON_Value *root = json_parse_string(u.body ? u.body : "");
+        free(u.body);
+        int index = -1;
+        const char *field = NULL;
+        const char *err = json_object(root)
+            ? sync_parse_desired(cfg, json_object(root), groups, &count, &index, &field)
+            : "bad_json";
+        if (err) {
+            JSON_Value *v = json_value_init_object();
+            JSON_Object *o = json_object(v);
+            json_object_set_string(o, "error", err);
+            if (index >= 0) json_object_set_number(o, "index", index);
+            if (field) json_object_set_string(o, "field", field);
+            send_json(c, v, 400, 1);
+            json_value_free(v);
+            if (root) json_value_free(root);
+            return;
+        }
+        json_value_free(root);
+    }
+
+    pthread_mutex_lock(&app->master.lock);
+    if (is_put || is_delete) {
+        char before[SYNC_MAX_SLOTS][64];
+        memcpy(app->master.desired, groups, sizeof(groups));
+        app->master.desired_count = count;
+        app->master.desired_updated_unix = (long long)time(NULL);
+        sync_master_touch_locked(&app->master);
+        sync_master_copy_assignees_locked(&app->master, before);
+        sync_master_reconcile_locked(&app->master, cfg);
+        sync_master_log_binding_changes_locked(&app->master, cfg, before, "reconcile",
+                                               ri->remote_addr);
+    }
+    JSON_Value *resp = sync_desired_json_locked(&app->master);
+    pthread_mutex_unlock(&app->master.lock);
+
+    if (is_put || is_delete) {
+        fprintf(stderr, "sync master: desired slot topology %s by %s (%d groups)\n",
+                is_put ? "set" : "cleared", ri->remote_addr, count);
+        sync_persist_desired(cfg, resp);
+    }
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+}
+
+/* GET /sync/slots/status: per group, how far the bindings are from the
+ * desired topology; slots outside it are listed as unmanaged. */
+static void sync_send_slots_status(struct mg_connection *c, app_t *app, const config_t *cfg) {
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    JSON_Value *groups_v = json_value_init_array();
+    JSON_Value *unmanaged_v = json_value_init_array();
+    int in_sync = 1;
+    long long now = now_ms();
+
+    pthread_mutex_lock(&app->master.lock);
+    sync_master_state_t *st = &app->master;
+    for (int gi = 0; gi < st->desired_count; gi++) {
+        const sync_desired_group_t *g = &st->desired[gi];
+        JSON_Value *gv = json_value_init_object();
+        JSON_Object *go = json_object(gv);
+        JSON_Value *slots_v = json_value_init_array();
+        int bound = 0;
+        for (int slot = 0; slot < SYNC_MAX_SLOTS; slot++) {
+            if (!g->slots[slot]) continue;
+            JSON_Value *sv = json_value_init_object();
+            JSON_Object *so = json_object(sv);
+            json_object_set_number(so, "slot", slot + 1);
+            if (cfg->sync_slots[slot].name[0]) {
+                json_object_set_string(so, "label", cfg->sync_slots[slot].name);
+            }
+            const char *holder = st->slot_assignees[slot];
+            const char *state = "unbound";
+            const char *mismatch = NULL;
+            if (holder[0]) {
+                json_object_set_string(so, "holder", holder);
+                sync_slave_record_t *rec = sync_master_find_record(st, holder, 0);
+                if (!rec || rec->down) {
+                    state = "down";
+                } else if ((mismatch = sync_desired_mismatch_locked(st, g, rec))) {
+                    state = "mismatch";
+                } else {
+                    state = "bound";
+                    bound++;
+                }
+            } else {
+                json_object_set_null(so, "holder");
+            }
+            json_object_set_string(so, "state", state);
+            if (mismatch) json_object_set_string(so, "mismatch", mismatch);
+            json_array_append_value(json_array(slots_v), sv);
+        }
+        /* Free slots beyond the replica count are spare, not missing. */
+        if (bound >= g->replicas) {
+            JSON_Array *arr = json_array(slots_v);
+            for (size_t i = 0; i < json_array_get_count(arr); i++) {
+                JSON_Object *so = json_array_get_object(arr, i);
+                if (!strcmp(json_object_get_string(so, "state"), "unbound")) {
+                    json_object_set_string(so, "state", "spare");
+                }
+            }
+        }
+        int drift = bound != g->replicas;
+        if (drift) in_sync = 0;
+        json_object_set_string(go, "name", g->name);
+        json_object_set_number(go, "replicas", g->replicas);
+        json_object_set_number(go, "bound", bound);
+        json_object_set_string(go, "state", drift ? "drift" : "converged");
+        if (g->drift_since_ms) {
+            json_object_set_number(go, "drift_since_ms", (double)g->drift_since_ms);
+            json_object_set_number(go, "drift_s", (double)((now - g->drift_since_ms) / 1000));
+        }
+        json_object_set_value(go, "slots", slots_v);
+        json_array_append_value(json_array(groups_v), gv);
+    }
+    for (int slot = 0; slot < sync_slot_count(cfg); slot++) {
+        if (!sync_desired_group_for_slot(st, slot)) {
+            json_array_append_number(json_array(unmanaged_v), slot + 1);
+        }
+    }
+    json_object_set_boolean(ro, "desired", st->desired_count > 0);
+    json_object_set_boolean(ro, "in_sync", in_sync);
+    if (st->reconciled_ms > 0) json_object_set_number(ro, "reconciled_ms", (double)st->reconciled_ms);
+    pthread_mutex_unlock(&app->master.lock);
+
+    json_object_set_value(ro, "groups", groups_v);
+    json_object_set_value(ro, "unmanaged_slots", unmanaged_v);
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+}
+
+/* GET /sync/slots: the slot definitions, including those templates made. */
+static void sync_send_slot_list(struct mg_connection *c, app_t *app, const config_t *cfg) {
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    int count = sync_slot_count(cfg);
+    json_object_set_number(ro, "slot_count", count);
+    json_object_set_number(ro, "max_slots", SYNC_MAX_SLOTS);
+    JSON_Value *slots_v = json_value_init_array();
+    pthread_mutex_lock(&app->master.lock);
+    for (int i = 0; i < count; i++) {
+        const sync_slot_config_t *sc = &cfg->sync_slots[i];
+        JSON_Value *sv = json_value_init_object();
+        JSON_Object *so = json_object(sv);
+        json_object_set_number(so, "slot", i + 1);
+        if (sc->name[0]) json_object_set_string(so, "name", sc->name);
+        if (sc->template_name[0]) json_object_set_string(so, "template", sc->template_name);
+        if (sc->prefer_id[0]) json_object_set_string(so, "prefer_id", sc->prefer_id);
+        if (sc->ssh[0]) json_object_set_string(so, "ssh", sc->ssh);
+        json_object_set_number(so, "commands", sc->command_count);
+        if (sc->health[0]) {
+            JSON_Value *hv = json_parse_string(sc->health);
+            if (hv) json_object_set_value(so, "health", hv);
+        }
+        if (sc->env_count) json_object_set_value(so, "env", sync_slot_vars_json(cfg, i, 0));
+        if (sc->param_count) json_object_set_value(so, "params", sync_slot_vars_json(cfg, i, 1));
+        if (app->master.slot_assignees[i][0]) {
+            json_object_set_string(so, "assigned_id", app->master.slot_assignees[i]);
+        }
+        json_array_append_value(json_array(slots_v), sv);
+    }
+    pthread_mutex_unlock(&app->master.lock);
+    json_object_set_value(ro, "slots", slots_v);
+    JSON_Value *templates_v = json_value_init_array();
+    for (int i = 0; i < cfg->sync_slot_template_count; i++) {
+        const sync_slot_template_t *t = &cfg->sync_slot_templates[i];
+        JSON_Value *tv = json_value_init_object();
+        json_object_set_string(json_object(tv), "name", t->name);
+        json_object_set_string(json_object(tv), "names", t->names);
+        if (t->first > 0) json_object_set_number(json_object(tv), "first", t->first);
+        json_array_append_value(json_array(templates_v), tv);
+    }
+    json_object_set_value(ro, "templates", templates_v);
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+}
+
+/*
+ * POST /sync/slots - {"names":"cam-{01..08}","template":..,"first":..,
+ *                     "prefer_id":..,"exec":[{..}],"health":{..},
+ *                     "env":{..},"params":{..}}
+ * Appends slots after the last one (or from "first"), filled from the named
+ * template and the fields given, which override the template's. Slots made
+ * here last until the master restarts; put them in the config to keep them.
+ */
+static void sync_handle_slot_create(struct mg_connection *c, app_t *app) {
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        free(u.body);
+        send_json_error(c, 400, "body_read_failed");
+        return;
+    }
+    JSON_Value *root = json_parse_string(u.body ? u.body : "");
+    free(u.body);
+    JSON_Object *o = json_object(root);
+    if (!o) {
+        if (root) json_value_free(root);
+        send_json_error(c, 400, "bad_json");
+        return;
+    }
+    const char *template_name = json_object_get_string(o, "template");
+    const char *names = json_object_get_string(o, "names");
+    const char *prefer_id = json_object_get_string(o, "prefer_id");
+    JSON_Value *exec_v = json_object_get_value(o, "exec");
+    JSON_Value *health_v = json_object_get_value(o, "health");
+    int first = (int)json_object_get_number(o, "first");
+    if ((exec_v && json_value_get_type(exec_v) != JSONArray) ||
+        json_array_get_count(json_array(exec_v)) > SYNC_SLOT_MAX_COMMANDS) {
+        json_value_free(root);
+        send_json_error(c, 400, "invalid_command");
+        return;
+    }
+    for (size_t i = 0; i < json_array_get_count(json_array(exec_v)); i++) {
+        if (!json_object(json_array_get_value(json_array(exec_v), i))) {
+            json_value_free(root);
+            send_json_error(c, 400, "invalid_command");
+            return;
+        }
+    }
+    if (health_v && !json_object_get_string(json_object(health_v), "path")) {
+        json_value_free(root);
+        send_json_error(c, 400, "invalid_health");
+        return;
+    }
+    if (first < 0 || first > SYNC_MAX_SLOTS) {
+        json_value_free(root);
+        send_json_error(c, 400, "invalid_slot");
+        return;
+    }
+
+    pthread_mutex_lock(&app->cfg_lock);
+    config_t *base = &app->base_cfg;
+    sync_slot_template_t t;
+    memset(&t, 0, sizeof(t));
+    if (template_name) {
+        const sync_slot_template_t *found = NULL;
+        for (int i = 0; i < base->sync_slot_template_count; i++) {
+            if (!strcmp(base->sync_slot_templates[i].name, template_name)) {
+                found = &base->sync_slot_templates[i];
+            }
+        }
+        if (!found) {
+            pthread_mutex_unlock(&app->cfg_lock);
+            send_json_error_field(c, 404, "unknown_template", "name", template_name);
+            json_value_free(root);
+            return;
+        }
+        t = *found;
+    }
+    if (names) snprintf(t.names, sizeof(t.names), "%s", names);
+    if (prefer_id) snprintf(t.slot.prefer_id, sizeof(t.slot.prefer_id), "%s", prefer_id);
+    int pool_before = base->sync_slot_command_count;
+    int vars_before = base->sync_slot_var_count;
+    const char *err = NULL;
+    if (exec_v) {
+        t.slot.command_count = 0;
+        for (size_t i = 0; i < json_array_get_count(json_array(exec_v)); i++) {
+            char *raw = json_serialize_to_string(json_array_get_value(json_array(exec_v), i));
+            int id = raw && strlen(raw) < sizeof(base->sync_slot_commands[0].json)
+                ? sync_slot_command_intern(base, raw) : -1;
+            if (raw) json_free_serialized_string(raw);
+            if (id < 0) {
+                err = "invalid_command";
+                break;
+            }
+            t.slot.command_ids[t.slot.command_count++] = (unsigned char)id;
+        }
+    }
+    const char *var_keys[2] = { "env", "params" };
+    for (int k = 0; k < 2 && !err; k++) {
+        JSON_Object *vars = json_object_get_object(o, var_keys[k]);
+        if (!json_object_has_value(o, var_keys[k])) continue;
+        unsigned char *into = k == 0 ? t.slot.env_ids : t.slot.param_ids;
+        int *count = k == 0 ? &t.slot.env_count : &t.slot.param_count;
+        *count = 0;
+        for (size_t i = 0; vars && i < json_object_get_count(vars); i++) {
+            const char *name = json_object_get_name(vars, i);
+            const char *value = json_string(json_object_get_value_at(vars, i));
+            char var[sizeof(base->sync_slot_vars[0].text)];
+            int id = -1;
+            if (*count < SYNC_SLOT_MAX_VARS && exec_var_name_valid(name) && value &&
+                strlen(name) + strlen(value) + 1 < sizeof(var)) {
+                snprintf(var, sizeof(var), "%s=%s", name, value);
+                id = sync_slot_var_intern(base, var);
+            }
+            if (id < 0) {
+                vars = NULL;
+                break;
+            }
+            into[(*count)++] = (unsigned char)id;
+        }
+        if (!vars) err = k == 0 ? "invalid_env" : "invalid_params";
+    }
+    if (!err && health_v) {
+        char *raw = json_serialize_to_string(health_v);
+        if (raw && strlen(raw) < sizeof(t.slot.health)) {
+            snprintf(t.slot.health, sizeof(t.slot.health), "%s", raw);
+        } else {
+            err = "invalid_health";
+        }
+        if (raw) json_free_serialized_string(raw);
+    }
+
+    int created[SYNC_MAX_SLOTS];
+    char err_name[64] = "";
+    int start = first > 0 ? first - 1 : sync_slot_count(base);
+    int n = -1;
+    if (!err) n = sync_template_apply(base, &t, start, created, &err, err_name, sizeof(err_name));
+    if (n < 0) {
+        base->sync_slot_command_count = pool_before;
+        base->sync_slot_var_count = vars_before;
+        pthread_mutex_unlock(&app->cfg_lock);
+        json_value_free(root);
+        int status = !strcmp(err, "slot_name_taken") || !strcmp(err, "too_many_slots") ? 409 : 400;
+        send_json_error_field(c, status, err, "name", err_name);
+        return;
+    }
+    if (base->sync_slot_count < start + n) base->sync_slot_count = start + n;
+    int slot_count = sync_slot_count(base);
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    JSON_Value *slots_v = json_value_init_array();
+    for (int k = 0; k < n; k++) {
+        JSON_Value *sv = json_value_init_object();
+        json_object_set_number(json_object(sv), "slot", created[k] + 1);
+        json_object_set_string(json_object(sv), "name", base->sync_slots[created[k]].name);
+        json_array_append_value(json_array(slots_v), sv);
+    }
+    app_rebuild_config_locked(app);
+    pthread_mutex_unlock(&app->cfg_lock);
+    json_value_free(root);
+
+    pthread_mutex_lock(&app->master.lock);
+    sync_master_touch_locked(&app->master);
+    pthread_mutex_unlock(&app->master.lock);
+
+    fprintf(stderr, "sync master: %s created slots %d-%d (%s, request %s)\n",
+            ri->remote_addr, start + 1, start + n, t.names, api_request_id());
+    json_object_set_value(ro, "slots", slots_v);
+    json_object_set_number(ro, "slot_count", slot_count);
+    send_json(c, resp, 201, 1);
+    json_value_free(resp);
+}
+
+static int h_sync_slots(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    if (replica_handle(c, cfg)) {
+        free(cfg);
+        return 1;
+    }
+    if (strcasecmp(cfg->sync_role, "master") != 0) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    const char *uri = api_local_uri(c);
+    if (ri && !strcmp(uri, "/sync/slots")) {
+        if (!strcmp(ri->request_method, "GET")) {
+            sync_send_slot_list(c, app, cfg);
+        } else if (!strcmp(ri->request_method, "POST")) {
+            sync_handle_slot_create(c, app);
+        } else {
+            send_plain(c, 405, "method_not_allowed", 1);
+        }
+        free(cfg);
+        return 1;
+    }
+    if (ri && !strcmp(uri, "/sync/slots/desired")) {
+        sync_handle_desired(c, app, cfg);
+        free(cfg);
+        return 1;
+    }
+    if (ri && !strcmp(uri, "/sync/slots/status")) {
+        if (strcmp(ri->request_method, "GET") != 0) {
+            send_plain(c, 405, "method_not_allowed", 1);
+            free(cfg);
+            return 1;
+        }
+        sync_send_slots_status(c, app, cfg);
+        free(cfg);
+        return 1;
+    }
+    int slot_index = -1;
+    char ref[128] = "", action[32] = "";
+    int rc = ri ? sync_parse_slot_path(cfg, uri, &slot_index, ref, sizeof(ref),
+                                       action, sizeof(action))
+                : -1;
+    if (rc != 0) {
+        int status = 404;
+        JSON_Value *v = sync_slot_lookup_error(cfg, ref, rc, &status);
+        send_json(c, v, status, 1);
+        json_value_free(v);
+        free(cfg);
+        return 1;
+    }
+
+    if (!action[0]) {
+        sync_handle_slot_binding(c, app, cfg, slot_index);
+        free(cfg);
+        return 1;
+    }
+
+    if (!strcmp(action, "log")) {
+        if (strcmp(ri->request_method, "GET") != 0) {
+            send_plain(c, 405, "method_not_allowed", 1);
+            free(cfg);
+            return 1;
+        }
+        int limit = SYNC_BINDING_LOG_MAX;
+        if (ri->query_string) {
+            char buf[16];
+            if (mg_get_var(ri->query_string, strlen(ri->query_string), "limit",
+                           buf, sizeof(buf)) > 0) {
+                int v = atoi(buf);
+                if (v > 0 && v < limit) limit = v;
+            }
+        }
+        sync_send_slot_log(c, app, cfg, slot_index, limit);
+        free(cfg);
+        return 1;
+    }
+
+    if (!strcmp(action, "lease")) {
+        sync_handle_lease(c, app, cfg, slot_index);
+        free(cfg);
+        return 1;
+    }
+
+    int is_claim = !strcmp(action, "claim");
+    if (is_claim || !strcmp(action, "approve") || !strcmp(action, "reject")) {
+        if (strcmp(ri->request_method, "POST") != 0) {
+            send_plain(c, 405, "method_not_allowed", 1);
+            free(cfg);
+            return 1;
+        }
+        upload_t u = {0};
+        if (read_body(c, &u) != 0) {
+            if (u.body) free(u.body);
+            send_json_error(c, 400, "body_read_failed");
+            free(cfg);
+            return 1;
+        }
+        JSON_Value *root = json_parse_string(u.body ? u.body : "{}");
+        free(u.body);
+        if (!root || json_value_get_type(root) != JSONObject) {
+            if (root) json_value_free(root);
+            send_json_error(c, 400, "bad_json");
+            free(cfg);
+            return 1;
+        }
+        int status = 200;
+        JSON_Value *resp = is_claim
+            ? sync_master_handle_claim(app, cfg, slot_index, json_object(root), &status)
+            : sync_master_decide_claim(app, cfg, slot_index, json_object(root),
+                                       !strcmp(action, "approve"), ri->remote_addr, &status);
+        json_value_free(root);
+        send_json(c, resp, status, 1);
+        json_value_free(resp);
+        free(cfg);
+        return 1;
+    }
+
+    send_plain(c, 404, "not_found", 1);
+    free(cfg);
+    return 1;
+}
+
+void sync_append_capabilities(const config_t *cfg, JSON_Array *caps_arr) {
+    if (!cfg || !caps_arr) return;
+    if (!cfg->sync_role[0]) return;
+    const char *sync_cap = (strcasecmp(cfg->sync_role, "master") == 0)
+                               ? "sync-master"
+                               : replica_is_active(cfg) ? "sync-replica" : "sync-slave";
+    json_array_append_string(caps_arr, sync_cap);
+}
+
+JSON_Value *sync_build_status_json(const config_t *cfg, sync_slave_state_t *state) {
+    if (!cfg || !cfg->sync_role[0]) return NULL;
+    JSON_Value *sync_v = json_value_init_object();
+    JSON_Object *so = json_object(sync_v);
+    json_object_set_string(so, "role", cfg->sync_role);
+    if (cfg->sync_id[0]) json_object_set_string(so, "id", cfg->sync_id);
+    json_object_set_number(so, "allow_bind", cfg->sync_allow_bind ? 1 : 0);
+    if (replica_is_active(cfg)) {
+        if (cfg->sync_master_url[0]) {
+            json_object_set_string(so, "master_url", cfg->sync_master_url);
+        }
+        json_object_set_number(so, "replica_interval_s", cfg->sync_replica_interval_s);
+        replica_append_status(so);
+    }
+    if (strcasecmp(cfg->sync_role, "slave") == 0) {
+        if (cfg->sync_master_url[0]) {
+            json_object_set_string(so, "master_url", cfg->sync_master_url);
+        }
+        json_object_set_number(so, "register_interval_s",
+                               cfg->sync_register_interval_s);
+        pthread_mutex_lock(&state->lock);
+        if (state->advertised_address[0]) {
+            json_object_set_string(so, "advertise", state->advertised_address);
+        }
+        pthread_mutex_unlock(&state->lock);
+        json_object_set_number(so, "last_received_generation",
+                               sync_slave_get_last_received(state));
+        json_object_set_number(so, "applied_generation",
+                               sync_slave_get_applied_generation(state));
+        int cur_slot = sync_slave_get_current_slot(state);
+        if (cur_slot > 0) {
+            json_object_set_number(so, "current_slot", cur_slot);
+            char slot_label_buf[64];
+            sync_slave_get_current_slot_label(state, slot_label_buf,
+                                              sizeof(slot_label_buf));
+            if (slot_label_buf[0]) {
+                json_object_set_string(so, "current_slot_label", slot_label_buf);
+            }
+        }
+    }
+    if (strcasecmp(cfg->sync_role, "master") == 0) svcpub_append_status(so);
+    return sync_v;
+}
+
+/* Fields an import entry carries; the rest of an existing entry is kept. */
+enum {
+    SYNC_EXP_ADDRESS = 1 << 0,
+    SYNC_EXP_PORT = 1 << 1,
+    SYNC_EXP_DEVICE = 1 << 2,
+    SYNC_EXP_SLOT = 1 << 3,
+    SYNC_EXP_LABELS = 1 << 4,
+};
+
+/* Validate one entry of an import and note in *given which fields it
+ * carries; a null field is carried and left empty. Returns NULL or an error
+ * code. */
+static const char *sync_parse_expected_node(const config_t *cfg, JSON_Object *no,
+                                            sync_expected_node_t *out, unsigned *given) {
+    memset(out, 0, sizeof(*out));
+    out->slot_hint = -1;
+    *given = 0;
+    if (!no) return "invalid_entry";
+    const char *id = json_object_get_string(no, "id");
+    if (!id || !*id || strlen(id) >= sizeof(out->id)) return "invalid_id";
+    strncpy(out->id, id, sizeof(out->id) - 1);
+    out->id[sizeof(out->id) - 1] = '\0';
+
+    JSON_Value *v = json_object_get_value(no, "address");
+    if (v) *given |= SYNC_EXP_ADDRESS;
+    if (v && json_value_get_type(v) != JSONNull) {
+        const char *addr = json_value_get_string(v);
+        struct in_addr ip;
+        if (!addr || strlen(addr) >= sizeof(out->address) ||
+            (inet_pton(AF_INET, addr, &ip) != 1 && !dnscache_is_hostname(addr))) {
+            return "invalid_address";
+        }
+        strncpy(out->address, addr, sizeof(out->address) - 1);
+        out->address[sizeof(out->address) - 1] = '\0';
+    }
+    v = json_object_get_value(no, "port");
+    if (v) *given |= SYNC_EXP_PORT;
+    if (v && json_value_get_type(v) != JSONNull) {
+        double port = json_value_get_number(v);
+        if (json_value_get_type(v) != JSONNumber || port < 1 || port > 65535) return "invalid_port";
+        out->port = (int)port;
+    }
+    v = json_object_get_value(no, "device");
+    if (v) *given |= SYNC_EXP_DEVICE;
+    if (v && json_value_get_type(v) != JSONNull) {
+        const char *device = json_value_get_string(v);
+        if (!device || strlen(device) >= sizeof(out->device)) return "invalid_device";
+        strncpy(out->device, device, sizeof(out->device) - 1);
+        out->device[sizeof(out->device) - 1] = '\0';
+    }
+    v = json_object_get_value(no, "slot");
+    if (v) *given |= SYNC_EXP_SLOT;
+    if (v && json_value_get_type(v) == JSONString) {
+        if (sync_slot_lookup(cfg, json_value_get_string(v), &out->slot_hint) != 0) {
+            return "invalid_slot";
+        }
+    } else if (v && json_value_get_type(v) != JSONNull) {
+        double slot = json_value_get_number(v);
+        if (json_value_get_type(v) != JSONNumber || slot < 1 || slot > sync_slot_count(cfg)) {
+            return "invalid_slot";
+        }
+        out->slot_hint = (int)slot - 1;
+    }
+    v = json_object_get_value(no, "labels");
+    if (v) *given |= SYNC_EXP_LABELS;
+    if (v && json_value_get_type(v) != JSONNull) {
+        JSON_Object *lo = json_value_get_object(v);
+        if (!lo) return "invalid_labels";
+        for (size_t i = 0; i < json_object_get_count(lo); i++) {
+            JSON_Value_Type t = json_value_get_type(json_object_get_value_at(lo, i));
+            if (t != JSONString && t != JSONNull) return "invalid_labels";
+        }
+        char *ser = json_serialize_to_string(v);
+        if (!ser) return "invalid_labels";
+        size_t n = strlen(ser);
+        if (n < sizeof(out->labels)) memcpy(out->labels, ser, n + 1);
+        json_free_serialized_string(ser);
+        if (n >= sizeof(out->labels)) return "labels_too_long";
+    }
+    return NULL;
+}
+
+/* Apply the fields an import entry carries onto e; labels merge key by key
+ * and a null label drops its key. Returns NULL or an error code. */
+static const char *sync_expected_merge(sync_expected_node_t *e, const sync_expected_node_t *in,
+                                       unsigned given) {
+    if (given & SYNC_EXP_ADDRESS) memcpy(e->address, in->address, sizeof(e->address));
+    if (given & SYNC_EXP_PORT) e->port = in->port;
+    if (given & SYNC_EXP_DEVICE) memcpy(e->device, in->device, sizeof(e->device));
+    if (given & SYNC_EXP_SLOT) e->slot_hint = in->slot_hint;
+    if (!(given & SYNC_EXP_LABELS)) return NULL;
+    if (!in->labels[0]) {
+        e->labels[0] = '\0';
+        return NULL;
+    }
+    JSON_Value *base = e->labels[0] ? json_parse_string(e->labels) : NULL;
+    if (!base || json_value_get_type(base) != JSONObject) {
+        if (base) json_value_free(base);
+        base = json_value_init_object();
+    }
+    JSON_Value *upd = json_parse_string(in->labels);
+    JSON_Object *bo = json_object(base);
+    JSON_Object *uo = json_object(upd);
+    for (size_t i = 0; i < json_object_get_count(uo); i++) {
+        const char *key = json_object_get_name(uo, i);
+        const char *value = json_value_get_string(json_object_get_value_at(uo, i));
+        if (value) json_object_set_string(bo, key, value);
+        else json_object_remove(bo, key);
+    }
+    if (upd) json_value_free(upd);
+    const char *err = NULL;
+    if (json_object_get_count(bo) == 0) {
+        e->labels[0] = '\0';
+    } else {
+        char *ser = json_serialize_to_string(base);
+        size_t n = ser ? strlen(ser) : 0;
+        if (!ser) err = "invalid_labels";
+        else if (n >= sizeof(e->labels)) err = "labels_too_long";
+        else memcpy(e->labels, ser, n + 1);
+        if (ser) json_free_serialized_string(ser);
+    }
+    json_value_free(base);
+    return err;
 }
 
-JSON_Value *sync_build_status_json(const config_t *cfg, sync_slave_state_t *state) {
-    if (!cfg || !cfg->sync_role[0]) return NULL;
-    JSON_Value *sync_v = json_value_init_object();
-    JSON_Object *so = json_object(sync_v);
-    json_object_set_string(so, "role", cfg->sync_role);
-    if (cfg->sync_id[0]) json_object_set_string(so, "id", cfg->sync_id);
-    json_object_set_number(so, "allow_bind", cfg->sync_allow_bind ? 1 : 0);
-    if (strcasecmp(cfg->sync_role, "slave") == 0) {
-        if (cfg->sync_master_url[0]) {
-            json_object_set_string(so, "master_url", cfg->sync_master_url);
+/*
+ * GET  /nodes/import  - the imported inventory with each node's state
+ * POST /nodes/import  - {"nodes":[{"id":..,"address":..,"port":..,"device":..,
+ *                        "slot":..,"labels":{..}}], "replace":false}
+ * Entries are upserted by id and only the fields an entry carries change
+ * (null clears one); replace drops every entry not in the list and takes the
+ * listed ones as given.
+ */
+static int h_nodes_import(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    if (strcasecmp(cfg->sync_role, "master") != 0) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri) {
+        free(cfg);
+        return 0;
+    }
+
+    if (!strcmp(ri->request_method, "GET")) {
+        JSON_Value *resp = json_value_init_object();
+        JSON_Value *arr_v = json_value_init_array();
+        JSON_Array *arr = json_array(arr_v);
+        pthread_mutex_lock(&app->master.lock);
+        for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+            const sync_expected_node_t *e = &app->master.expected[i];
+            if (!e->in_use) continue;
+            json_array_append_value(arr, sync_expected_node_json_locked(&app->master, e));
+        }
+        pthread_mutex_unlock(&app->master.lock);
+        json_object_set_value(json_object(resp), "nodes", arr_v);
+        send_json(c, resp, 200, 1);
+        json_value_free(resp);
+        free(cfg);
+        return 1;
+    }
+    if (strcmp(ri->request_method, "POST") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        free(u.body);
+        send_json_error(c, 400, "body_read_failed");
+        free(cfg);
+        return 1;
+    }
+    JSON_Value *root = json_parse_string(u.body ? u.body : "");
+    free(u.body);
+    JSON_Array *nodes = NULL;
+    int replace = 0;
+    if (root && json_value_get_type(root) == JSONArray) {
+        nodes = json_value_get_array(root);
+    } else if (root && json_value_get_type(root) == JSONObject) {
+        nodes = json_object_get_array(json_object(root), "nodes");
+        replace = json_object_get_boolean(json_object(root), "replace") == 1;
+    }
+    if (!nodes) {
+        send_json_error(c, 400, root ? "missing_nodes" : "bad_json");
+        if (root) json_value_free(root);
+        free(cfg);
+        return 1;
+    }
+
+    size_t count = json_array_get_count(nodes);
+    sync_expected_node_t *parsed = calloc(count ? count : 1, sizeof(*parsed));
+    unsigned *given = calloc(count ? count : 1, sizeof(*given));
+    if (!parsed || !given) {
+        free(parsed);
+        free(given);
+        json_value_free(root);
+        send_plain(c, 500, "oom", 1);
+        free(cfg);
+        return 1;
+    }
+    JSON_Value *errors_v = json_value_init_array();
+    JSON_Array *errors = json_array(errors_v);
+    size_t valid = 0;
+    for (size_t i = 0; i < count; i++) {
+        const char *err = sync_parse_expected_node(cfg, json_array_get_object(nodes, i), &parsed[i],
+                                                   &given[i]);
+        if (!err) {
+            valid++;
+            continue;
+        }
+        parsed[i].in_use = -1;
+        JSON_Value *ev = json_value_init_object();
+        JSON_Object *eo = json_object(ev);
+        json_object_set_number(eo, "index", (double)i);
+        if (parsed[i].id[0]) json_object_set_string(eo, "id", parsed[i].id);
+        json_object_set_string(eo, "error", err);
+        json_array_append_value(errors, ev);
+    }
+    json_value_free(root);
+
+    if (count > 0 && valid == 0) {
+        free(parsed);
+        free(given);
+        JSON_Value *v = json_value_init_object();
+        JSON_Object *o = json_object(v);
+        json_object_set_string(o, "error", "no_valid_nodes");
+        json_object_set_value(o, "errors", errors_v);
+        send_json(c, v, 400, 1);
+        json_value_free(v);
+        free(cfg);
+        return 1;
+    }
+
+    int imported = 0, updated = 0, removed = 0, total = 0;
+    long long now = now_ms();
+    pthread_mutex_lock(&app->master.lock);
+    sync_master_state_t *st = &app->master;
+    if (replace) {
+        for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+            sync_expected_node_t *e = &st->expected[i];
+            if (!e->in_use) continue;
+            int keep = 0;
+            for (size_t j = 0; j < count && !keep; j++) {
+                keep = parsed[j].in_use == 0 && strcmp(parsed[j].id, e->id) == 0;
+            }
+            if (!keep) {
+                memset(e, 0, sizeof(*e));
+                removed++;
+            }
         }
-        json_object_set_number(so, "register_interval_s",
-                               cfg->sync_register_interval_s);
-        json_object_set_number(so, "last_received_generation",
-                               sync_slave_get_last_received(state));
-        json_object_set_number(so, "applied_generation",
-                               sync_slave_get_applied_generation(state));
-        int cur_slot = sync_slave_get_current_slot(state);
-        if (cur_slot > 0) {
-            json_object_set_number(so, "current_slot", cur_slot);
-            char slot_label_buf[64];
-            sync_slave_get_current_slot_label(state, slot_label_buf,
-                                              sizeof(slot_label_buf));
-            if (slot_label_buf[0]) {
-                json_object_set_string(so, "current_slot_label", slot_label_buf);
+    }
+    for (size_t i = 0; i < count; i++) {
+        sync_expected_node_t *in = &parsed[i];
+        if (in->in_use != 0) continue;
+        sync_expected_node_t *e = sync_master_find_expected_locked(st, in->id);
+        int fresh = !e;
+        for (int k = 0; k < SYNC_MAX_SLAVES && !e; k++) {
+            if (!st->expected[k].in_use) e = &st->expected[k];
+        }
+        const char *err = e ? NULL : "inventory_full";
+        sync_expected_node_t merged;
+        if (e) {
+            memset(&merged, 0, sizeof(merged));
+            memcpy(merged.id, in->id, sizeof(merged.id));
+            merged.slot_hint = -1;
+            if (fresh) {
+                merged.imported_ms = now;
+                /* Nodes that are already registered are not "expected". */
+                const sync_slave_record_t *rec = sync_master_find_record(st, in->id, 0);
+                if (rec && rec->last_seen_ms > 0) merged.first_seen_ms = rec->last_seen_ms;
+            } else if (replace) {
+                merged.imported_ms = e->imported_ms;
+                merged.first_seen_ms = e->first_seen_ms;
+            } else {
+                merged = *e;
             }
+            err = sync_expected_merge(&merged, in, given[i]);
+        }
+        if (err) {
+            JSON_Value *ev = json_value_init_object();
+            JSON_Object *eo = json_object(ev);
+            json_object_set_number(eo, "index", (double)i);
+            json_object_set_string(eo, "id", in->id);
+            json_object_set_string(eo, "error", err);
+            json_array_append_value(errors, ev);
+            continue;
         }
+        if (fresh) imported++;
+        else updated++;
+        merged.in_use = 1;
+        *e = merged;
     }
-    return sync_v;
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        if (st->expected[i].in_use) total++;
+    }
+    sync_master_touch_locked(st);
+    pthread_mutex_unlock(&app->master.lock);
+    free(parsed);
+    free(given);
+
+    fprintf(stderr, "sync master: imported %d new, %d updated, %d removed expected nodes\n",
+            imported, updated, removed);
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    json_object_set_number(ro, "imported", imported);
+    json_object_set_number(ro, "updated", updated);
+    json_object_set_number(ro, "removed", removed);
+    json_object_set_number(ro, "total", total);
+    json_object_set_value(ro, "errors", errors_v);
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+    free(cfg);
+    return 1;
 }
 
 void sync_register_http_handlers(struct mg_context *ctx, app_t *app) {
     if (!ctx) return;
-    mg_set_request_handler(ctx, "/sync/register", h_sync_register, app);
-    mg_set_request_handler(ctx, "/sync/slaves", h_sync_slaves, app);
-    mg_set_request_handler(ctx, "/sync/push", h_sync_push, app);
-    mg_set_request_handler(ctx, "/sync/bind", h_sync_bind, app);
+    api_set_handler(ctx, "/sync/register", h_sync_register, app);
+    api_set_handler(ctx, "/sync/slaves", h_sync_slaves, app);
+    api_set_handler(ctx, "/sync/push", h_sync_push, app);
+    api_set_handler(ctx, "/sync/bind", h_sync_bind, app);
+    api_set_handler(ctx, "/sync/slots", h_sync_slots, app);
+    api_set_handler(ctx, "/nodes/import", h_nodes_import, app);
+    sync_results_register_http_handlers(ctx, app);
 }
 
 int sync_slave_start_thread(app_t *app) {
@@ -2068,3 +6730,748 @@ void sync_slave_stop_thread(sync_slave_state_t *state) {
         pthread_mutex_unlock(&state->lock);
     }
 }
+
+/*
+ * Emit node_down for slaves that missed their heartbeats for longer than
+ * [sync] node_down_after_s. The matching node_up is emitted by
+ * h_sync_register when the slave checks in again.
+ */
+static void sync_master_detect_down_locked(sync_master_state_t *state,
+                                           const config_t *cfg) {
+    if (!state || !cfg || cfg->sync_node_down_after_s <= 0) return;
+    long long now = now_ms();
+    long long cutoff = now - (long long)cfg->sync_node_down_after_s * 1000LL;
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        sync_slave_record_t *rec = &state->records[i];
+        if (!rec->in_use || rec->down || rec->last_seen_ms <= 0) continue;
+        if (rec->last_seen_ms >= cutoff) continue;
+        rec->down = 1;
+        sync_master_touch_locked(state);
+        fprintf(stderr, "sync master: node %s is down (no heartbeat for %llds)\n",
+                rec->id, (now - rec->last_seen_ms) / 1000);
+        JSON_Value *ev = json_value_init_object();
+        JSON_Object *eo = json_object(ev);
+        json_object_set_string(eo, "id", rec->id);
+        json_object_set_string(eo, "remote_ip", rec->remote_ip);
+        json_object_set_number(eo, "last_seen_ms", (double)rec->last_seen_ms);
+        json_object_set_number(eo, "last_seen_s", (double)((now - rec->last_seen_ms) / 1000));
+        if (rec->slot_index >= 0 && rec->slot_index < SYNC_MAX_SLOTS) {
+            json_object_set_number(eo, "slot", rec->slot_index + 1);
+        }
+        (void)events_emit("node_down", ev);
+    }
+}
+
+/* A drill is over: the node is up again unless it really stopped sending
+ * heartbeats meanwhile, in which case it stays down as it would have. */
+static void sync_master_end_simulation_locked(sync_master_state_t *state, const config_t *cfg,
+                                              sync_slave_record_t *rec, const char *actor) {
+    long long now = now_ms();
+    long long since = rec->simulated_down_ms;
+    rec->simulated_down_ms = 0;
+    rec->simulated_down_until_ms = 0;
+    sync_master_touch_locked(state);
+    if (cfg->sync_node_down_after_s > 0 &&
+        now - rec->last_seen_ms > (long long)cfg->sync_node_down_after_s * 1000LL) {
+        fprintf(stderr, "sync master: simulated outage of %s ended, node stays down\n", rec->id);
+        return;
+    }
+    rec->down = 0;
+    fprintf(stderr, "sync master: simulated outage of %s ended (%s)\n", rec->id, actor);
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_string(eo, "id", rec->id);
+    json_object_set_string(eo, "remote_ip", rec->remote_ip);
+    json_object_set_number(eo, "down_s", (double)((now - since) / 1000));
+    json_object_set_boolean(eo, "simulated", 1);
+    json_object_set_string(eo, "actor", actor);
+    (void)events_emit("node_up", ev);
+}
+
+static void sync_master_expire_simulations_locked(sync_master_state_t *state, const config_t *cfg) {
+    long long now = now_ms();
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        sync_slave_record_t *rec = &state->records[i];
+        if (!rec->in_use || !rec->simulated_down_ms || now < rec->simulated_down_until_ms) continue;
+        sync_master_end_simulation_locked(state, cfg, rec, "expired");
+    }
+}
+
+int sync_master_simulate_down(app_t *app, const config_t *cfg, const char *id, int duration_s,
+                              const char *actor) {
+    if (!app || !cfg || !id) return -1;
+    long long now = now_ms();
+    pthread_mutex_lock(&app->master.lock);
+    sync_slave_record_t *rec = sync_master_find_record(&app->master, id, 0);
+    if (!rec) {
+        pthread_mutex_unlock(&app->master.lock);
+        return -1;
+    }
+    int was_down = rec->down;
+    if (!rec->simulated_down_ms) rec->simulated_down_ms = now;
+    rec->simulated_down_until_ms = now + (long long)duration_s * 1000LL;
+    rec->down = 1;
+    sync_master_touch_locked(&app->master);
+    if (!was_down) {
+        fprintf(stderr, "sync master: simulating an outage of %s for %ds (%s)\n",
+                rec->id, duration_s, actor);
+        JSON_Value *ev = json_value_init_object();
+        JSON_Object *eo = json_object(ev);
+        json_object_set_string(eo, "id", rec->id);
+        json_object_set_string(eo, "remote_ip", rec->remote_ip);
+        json_object_set_number(eo, "last_seen_ms", (double)rec->last_seen_ms);
+        json_object_set_number(eo, "last_seen_s", (double)((now - rec->last_seen_ms) / 1000));
+        if (rec->slot_index >= 0 && rec->slot_index < SYNC_MAX_SLOTS) {
+            json_object_set_number(eo, "slot", rec->slot_index + 1);
+        }
+        json_object_set_boolean(eo, "simulated", 1);
+        json_object_set_number(eo, "duration_s", duration_s);
+        json_object_set_string(eo, "actor", actor);
+        (void)events_emit("node_down", ev);
+    }
+    pthread_mutex_unlock(&app->master.lock);
+    return 0;
+}
+
+int sync_master_simulate_down_end(app_t *app, const config_t *cfg, const char *id,
+                                  const char *actor) {
+    if (!app || !cfg || !id) return 0;
+    pthread_mutex_lock(&app->master.lock);
+    sync_slave_record_t *rec = sync_master_find_record(&app->master, id, 0);
+    int running = rec && rec->simulated_down_ms;
+    if (running) sync_master_end_simulation_locked(&app->master, cfg, rec, actor);
+    pthread_mutex_unlock(&app->master.lock);
+    return running;
+}
+
+/* ---------- Slot health checks ---------- */
+
+typedef struct {
+    app_t *app;
+    int slot_index;
+    char id[64];
+    sync_node_addr_t node;        /* where to send it (maybe through a gateway) */
+    char body[SYNC_HEALTH_BODY_MAX];
+    int timeout_ms;
+    int dns_ttl_s;
+    int threshold;
+    int failover;
+} sync_health_job_t;
+
+static void sync_master_set_health_state_locked(sync_master_state_t *state,
+                                                sync_slot_health_t *h, const char *name) {
+    if (!strcmp(h->state, name)) return;
+    strncpy(h->state, name, sizeof(h->state) - 1);
+    h->state[sizeof(h->state) - 1] = '\0';
+    h->since_ms = now_ms();
+    sync_master_touch_locked(state);
+}
+
+/* Hand a degraded slot to a slave that holds no slot, preferring the best
+ * dispatch record and then the most recent heartbeat. Returns NULL after
+ * moving it, else why the slot stayed put. */
+static const char *sync_master_failover_locked(sync_master_state_t *state, const config_t *cfg,
+                                               int slot_index, const char *id,
+                                               char *to, size_t to_sz) {
+    if (cfg && cfg->sync_slots[slot_index].prefer_id[0] &&
+        strcmp(cfg->sync_slots[slot_index].prefer_id, id) == 0) {
+        return "reserved";
+    }
+    sync_slave_record_t *cand = NULL;
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        sync_slave_record_t *rec = &state->records[i];
+        if (!rec->in_use || rec->down || rec->quarantined_ms || strcmp(rec->id, id) == 0) continue;
+        if (rec->slot_index >= 0 && sync_master_slot_matches(state, rec->slot_index, rec->id)) continue;
+        if (!sync_master_slot_accepts_locked(state, slot_index, rec)) continue;
+        if (cand) {
+            int cmp = sync_health_compare_locked(cfg, rec, cand);
+            if (cmp > 0 || (cmp == 0 && rec->last_seen_ms <= cand->last_seen_ms)) continue;
+        }
+        cand = rec;
+    }
+    if (!cand) return "no_candidate";
+    char before[SYNC_MAX_SLOTS][64];
+    sync_master_copy_assignees_locked(state, before);
+    (void)sync_master_assign_slot_locked(state, cand, slot_index, 0);
+    sync_master_log_binding_changes_locked(state, cfg, before, "failover", "master");
+    snprintf(to, to_sz, "%s", cand->id);
+    return NULL;
+}
+
+static void sync_master_health_result_locked(sync_master_state_t *state, const config_t *cfg,
+                                             const sync_health_job_t *job, int rc,
+                                             const char *error) {
+    sync_slot_health_t *h = &state->slot_health[job->slot_index];
+    h->in_flight = 0;
+    /* The slot changed hands while the check ran. */
+    if (strcmp(h->id, job->id) != 0 ||
+        !sync_master_slot_matches(state, job->slot_index, job->id)) {
+        return;
+    }
+    h->last_rc = rc;
+    snprintf(h->last_error, sizeof(h->last_error), "%s", error ? error : "");
+
+    if (!error) {
+        int was_degraded = !strcmp(h->state, "degraded");
+        if (h->failures) sync_master_touch_locked(state);
+        h->failures = 0;
+        sync_master_set_health_state_locked(state, h, "ok");
+        if (was_degraded) {
+            fprintf(stderr, "sync master: slot %d health recovered on %s\n",
+                    job->slot_index + 1, job->id);
+            JSON_Value *ev = json_value_init_object();
+            JSON_Object *eo = json_object(ev);
+            json_object_set_number(eo, "slot", job->slot_index + 1);
+            json_object_set_string(eo, "id", job->id);
+            (void)events_emit("slot_recovered", ev);
+        }
+        return;
+    }
+
+    h->failures++;
+    sync_master_touch_locked(state);
+    if (!strcmp(h->state, "degraded")) return;
+    if (h->failures < job->threshold) {
+        sync_master_set_health_state_locked(state, h, "failing");
+        return;
+    }
+    sync_master_set_health_state_locked(state, h, "degraded");
+    fprintf(stderr, "sync master: slot %d degraded on %s (%d failed checks, %s)\n",
+            job->slot_index + 1, job->id, h->failures, error);
+
+    char failover_to[64];
+    failover_to[0] = '\0';
+    const char *failover_skip = NULL;
+    if (job->failover) {
+        failover_skip = sync_master_failover_locked(state, cfg, job->slot_index, job->id,
+                                                    failover_to, sizeof(failover_to));
+    }
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_number(eo, "slot", job->slot_index + 1);
+    json_object_set_string(eo, "id", job->id);
+    json_object_set_number(eo, "failures", job->threshold);
+    json_object_set_string(eo, "error", error);
+    if (rc >= 0) json_object_set_number(eo, "rc", rc);
+    if (failover_to[0]) json_object_set_string(eo, "failover_to", failover_to);
+    else if (failover_skip) json_object_set_string(eo, "failover", failover_skip);
+    (void)events_emit("slot_degraded", ev);
+}
+
+static void *sync_health_worker(void *arg) {
+    sync_health_job_t *job = (sync_health_job_t *)arg;
+    const char *error = NULL;
+    int rc = -1;
+    int status = -1;
+    http_url_t url;
+    char relay_hdr[GATEWAY_HEADER_MAX];
+    char host[128] = "";
+    if (gateway_route(&job->node, AUTOD_PEER_PREFIX "/exec", job->timeout_ms, &url, relay_hdr,
+                      sizeof(relay_hdr)) == 0) {
+        snprintf(host, sizeof(host), "%s", url.host);
+    }
+    if (!host[0] || dnscache_resolve(host, job->dns_ttl_s, url.host, sizeof(url.host)) != 0) {
+        error = host[0] ? "resolve_failed" : "gateway_unavailable";
+    } else {
+        char *resp = NULL;
+        long long t0 = now_ms();
+        status = httpc_send_json("POST", &url, relay_hdr, job->body, &resp, NULL, job->timeout_ms);
+        cluster_note_node_dispatch(job->id, status == 200, now_ms() - t0,
+                                   status >= 0 ? strlen(job->body) : 0, resp ? strlen(resp) : 0);
+        if (status < 0) {
+            error = "unreachable";
+            if (dnscache_is_hostname(host)) dnscache_forget(host);
+        } else if (status != 200) {
+            error = "http_error";
+        } else {
+            JSON_Value *rv = resp ? json_parse_string(resp) : NULL;
+            JSON_Object *ro = json_object(rv);
+            if (!ro || !json_object_has_value_of_type(ro, "rc", JSONNumber)) {
+                error = "bad_response";
+            } else {
+                rc = (int)json_object_get_number(ro, "rc");
+                if (rc != 0) error = "nonzero_rc";
+            }
+            if (rv) json_value_free(rv);
+        }
+        free(resp);
+        cluster_note_dispatch("health", status == 200);
+    }
+
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (cfg) app_config_snapshot(job->app, cfg);
+    pthread_mutex_lock(&job->app->master.lock);
+    sync_master_health_result_locked(&job->app->master, cfg, job, rc, error);
+    pthread_mutex_unlock(&job->app->master.lock);
+    free(cfg);
+    free(job);
+    return NULL;
+}
+
+/*
+ * Run each slot's [sync.slotN] health command against the node holding it,
+ * at most one check per slot at a time. Checks run on detached threads so a
+ * slow node does not hold up heartbeat bookkeeping.
+ */
+static void sync_master_schedule_health_checks(app_t *app, const config_t *cfg) {
+    sync_health_job_t *jobs[SYNC_MAX_SLOTS];
+    int job_count = 0;
+    long long now = now_ms();
+    pthread_mutex_lock(&app->master.lock);
+    for (int slot = 0; slot < SYNC_MAX_SLOTS; slot++) {
+        const sync_slot_config_t *sc = &cfg->sync_slots[slot];
+        sync_slot_health_t *h = &app->master.slot_health[slot];
+        const char *holder = app->master.slot_assignees[slot];
+        if (!sc->health[0] || !holder[0]) {
+            if (h->id[0]) {
+                int in_flight = h->in_flight;
+                memset(h, 0, sizeof(*h));
+                h->in_flight = in_flight;
+                sync_master_touch_locked(&app->master);
+            }
+            continue;
+        }
+        long long interval_ms = (long long)(sc->health_interval_s > 0 ? sc->health_interval_s : 30) * 1000LL;
+        if (strcmp(h->id, holder) != 0) {
+            /* New holder: give its slot commands one interval to settle. */
+            int in_flight = h->in_flight;
+            memset(h, 0, sizeof(*h));
+            h->in_flight = in_flight;
+            strncpy(h->id, holder, sizeof(h->id) - 1);
+            strncpy(h->state, "unknown", sizeof(h->state) - 1);
+            h->since_ms = now;
+            h->last_rc = -1;
+            h->next_due_ms = now + interval_ms;
+            sync_master_touch_locked(&app->master);
+        }
+        if (h->in_flight || now < h->next_due_ms) continue;
+        h->next_due_ms = now + interval_ms;
+        sync_slave_record_t *rec = sync_master_find_record(&app->master, holder, 0);
+        if (!rec || rec->down || rec->dispatch_refused || !strcmp(rec->transport, "mqtt")) continue;
+        sync_health_job_t *job = calloc(1, sizeof(*job));
+        if (!job) continue;
+        job->app = app;
+        job->slot_index = slot;
+        strncpy(job->id, holder, sizeof(job->id) - 1);
+        sync_master_node_addr_locked(app, cfg, rec, &job->node);
+        (void)sync_slot_health_body(cfg, slot, job->body, sizeof(job->body));
+        job->timeout_ms = cfg->exec_timeout_ms + 2000;
+        job->dns_ttl_s = cfg->sync_dns_ttl_s;
+        job->threshold = sc->health_failures > 0 ? sc->health_failures : 3;
+        job->failover = sc->health_failover;
+        h->in_flight = 1;
+        jobs[job_count++] = job;
+    }
+    pthread_mutex_unlock(&app->master.lock);
+
+    for (int i = 0; i < job_count; i++) {
+        pthread_t th;
+        if (pthread_create(&th, NULL, sync_health_worker, jobs[i]) == 0) {
+            pthread_detach(th);
+            continue;
+        }
+        pthread_mutex_lock(&app->master.lock);
+        app->master.slot_health[jobs[i]->slot_index].in_flight = 0;
+        pthread_mutex_unlock(&app->master.lock);
+        free(jobs[i]);
+    }
+}
+
+/* ---------- Node quarantine ---------- */
+
+typedef struct {
+    app_t *app;
+    char id[64];
+    sync_node_addr_t node;
+    int dns_ttl_s;
+    int probation_s;
+} sync_probe_job_t;
+
+static void sync_quarantine_event(const char *type, const sync_slave_record_t *rec,
+                                  long long now, int probation_s) {
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_string(eo, "id", rec->id);
+    json_object_set_number(eo, "failures", rec->quarantine_failures);
+    if (!strcmp(type, "node_quarantined")) {
+        json_object_set_number(eo, "probation_s", probation_s);
+    } else {
+        json_object_set_number(eo, "quarantined_s", (double)((now - rec->quarantined_ms) / 1000));
+    }
+    (void)events_emit(type, ev);
+}
+
+static void sync_master_readmit_locked(sync_master_state_t *state, sync_slave_record_t *rec,
+                                       long long now) {
+    sync_quarantine_event("node_readmitted", rec, now, 0);
+    cluster_node_reset_streak(rec->id);
+    rec->quarantined_ms = 0;
+    rec->probation_due_ms = 0;
+    rec->quarantine_failures = 0;
+    sync_master_touch_locked(state);
+}
+
+/* Re-admit a node after a passed probation check, or give it another
+ * probation period. */
+static void sync_master_probe_result(app_t *app, const char *id, int ok, int probation_s) {
+    long long now = now_ms();
+    pthread_mutex_lock(&app->master.lock);
+    sync_slave_record_t *rec = sync_master_find_record(&app->master, id, 0);
+    if (rec) {
+        rec->probe_in_flight = 0;
+        if (rec->quarantined_ms > 0 && ok) {
+            fprintf(stderr, "sync master: %s passed its health check, back in rotation\n", rec->id);
+            sync_master_readmit_locked(&app->master, rec, now);
+        } else if (rec->quarantined_ms > 0) {
+            rec->probation_due_ms = now + (long long)probation_s * 1000LL;
+        }
+    }
+    pthread_mutex_unlock(&app->master.lock);
+}
+
+static void *sync_probe_worker(void *arg) {
+    sync_probe_job_t *job = (sync_probe_job_t *)arg;
+    http_url_t url;
+    char relay_hdr[GATEWAY_HEADER_MAX];
+    char host[128];
+    int ok = 0;
+    if (gateway_route(&job->node, AUTOD_PEER_PREFIX "/health", 3000, &url, relay_hdr, sizeof(relay_hdr)) == 0 &&
+        snprintf(host, sizeof(host), "%s", url.host) > 0 &&
+        dnscache_resolve(host, job->dns_ttl_s, url.host, sizeof(url.host)) == 0) {
+        char *resp = NULL;
+        ok = httpc_send_json("GET", &url, relay_hdr, NULL, &resp, NULL, 3000) == 200;
+        free(resp);
+        if (!ok && dnscache_is_hostname(host)) dnscache_forget(host);
+    }
+    sync_master_probe_result(job->app, job->id, ok, job->probation_s);
+    free(job);
+    return NULL;
+}
+
+/*
+ * Take a node out of routing once [sync] quarantine_failures dispatches to it
+ * failed in a row, and put it back when a GET /health after
+ * quarantine_probation_s succeeds (an MQTT node only needs to be heartbeating).
+ * A failed check starts another probation period.
+ */
+static void sync_master_check_quarantine(app_t *app, const config_t *cfg) {
+    sync_probe_job_t *jobs[SYNC_MAX_SLAVES];
+    int job_count = 0;
+    long long now = now_ms();
+    int probation_s = cfg->sync_quarantine_probation_s;
+    pthread_mutex_lock(&app->master.lock);
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        sync_slave_record_t *rec = &app->master.records[i];
+        if (!rec->in_use) continue;
+        if (!rec->quarantined_ms) {
+            if (cfg->sync_quarantine_failures <= 0) continue;
+            cluster_node_stats_t st;
+            if (cluster_node_stats(rec->id, &st) != 0 ||
+                st.consecutive_failures < (unsigned)cfg->sync_quarantine_failures) {
+                continue;
+            }
+            rec->quarantined_ms = now;
+            rec->probation_due_ms = now + (long long)probation_s * 1000LL;
+            rec->quarantine_failures = (int)st.consecutive_failures;
+            sync_master_touch_locked(&app->master);
+            fprintf(stderr, "sync master: quarantining %s after %u failed dispatches in a row\n",
+                    rec->id, st.consecutive_failures);
+            sync_quarantine_event("node_quarantined", rec, now, probation_s);
+            continue;
+        }
+        if (rec->probe_in_flight || rec->down || now < rec->probation_due_ms) continue;
+        if (!strcmp(rec->transport, "mqtt")) {
+            /* No HTTP to probe; a current heartbeat is its health check. */
+            fprintf(stderr, "sync master: %s is heartbeating again, back in rotation\n", rec->id);
+            sync_master_readmit_locked(&app->master, rec, now);
+            continue;
+        }
+        sync_probe_job_t *job = calloc(1, sizeof(*job));
+        if (!job) continue;
+        job->app = app;
+        strncpy(job->id, rec->id, sizeof(job->id) - 1);
+        sync_master_node_addr_locked(app, cfg, rec, &job->node);
+        job->dns_ttl_s = cfg->sync_dns_ttl_s;
+        job->probation_s = probation_s;
+        rec->probe_in_flight = 1;
+        jobs[job_count++] = job;
+    }
+    pthread_mutex_unlock(&app->master.lock);
+
+    for (int i = 0; i < job_count; i++) {
+        pthread_t th;
+        if (pthread_create(&th, NULL, sync_probe_worker, jobs[i]) == 0) {
+            pthread_detach(th);
+            continue;
+        }
+        pthread_mutex_lock(&app->master.lock);
+        sync_slave_record_t *rec = sync_master_find_record(&app->master, jobs[i]->id, 0);
+        if (rec) rec->probe_in_flight = 0;
+        pthread_mutex_unlock(&app->master.lock);
+        free(jobs[i]);
+    }
+}
+
+/* ---------- Node decommission ---------- */
+
+/* Who takes over slot_index from id: the desired topology's pick for a
+ * managed slot, otherwise the slot's prefer_id and then any live node that
+ * holds no slot, the healthiest first. */
+static sync_slave_record_t *sync_master_handover_candidate_locked(sync_master_state_t *state,
+                                                                  const config_t *cfg,
+                                                                  int slot_index, const char *id) {
+    const sync_desired_group_t *g = sync_desired_group_for_slot(state, slot_index);
+    if (g) return sync_desired_candidate_locked(state, cfg, g, slot_index);
+    const char *prefer = cfg->sync_slots[slot_index].prefer_id;
+    sync_slave_record_t *cand = NULL;
+    int cand_rank = 0;
+    for (int i = 0; i < SYNC_MAX_SLAVES; i++) {
+        sync_slave_record_t *rec = &state->records[i];
+        if (!rec->in_use || rec->down || rec->quarantined_ms || rec->last_seen_ms <= 0 ||
+            strcmp(rec->id, id) == 0) {
+            continue;
+        }
+        if (rec->slot_index >= 0 && sync_master_slot_matches(state, rec->slot_index, rec->id)) continue;
+        if (!sync_master_slot_accepts_locked(state, slot_index, rec)) continue;
+        int rank = (prefer[0] && !strcmp(prefer, rec->id)) ? 0 : 1;
+        if (cand) {
+            if (rank > cand_rank) continue;
+            if (rank == cand_rank) {
+                int cmp = sync_health_compare_locked(cfg, rec, cand);
+                if (cmp > 0 || (cmp == 0 && rec->last_seen_ms <= cand->last_seen_ms)) continue;
+            }
+        }
+        cand = rec;
+        cand_rank = rank;
+    }
+    return cand;
+}
+
+static void sync_decommission_warning(JSON_Array *warnings, const char *what, int slot,
+                                      const char *group) {
+    JSON_Value *wv = json_value_init_object();
+    JSON_Object *wo = json_object(wv);
+    json_object_set_string(wo, "warning", what);
+    if (slot > 0) json_object_set_number(wo, "slot", slot);
+    if (group) json_object_set_string(wo, "group", group);
+    json_array_append_value(warnings, wv);
+}
+
+JSON_Value *sync_master_decommission_plan(app_t *app, const config_t *cfg, const char *id,
+                                          int execute, int force, const char *actor,
+                                          int *status) {
+    *status = 200;
+    JSON_Value *plan = json_value_init_object();
+    JSON_Object *po = json_object(plan);
+    json_object_set_string(po, "id", id);
+    long long now = now_ms();
+    pthread_mutex_lock(&app->master.lock);
+    sync_master_state_t *state = &app->master;
+    sync_slave_record_t *rec = sync_master_find_record(state, id, 0);
+    if (!rec || rec->bench) {
+        pthread_mutex_unlock(&app->master.lock);
+        json_object_set_string(po, "error", sync_master_find_retired_locked(state, id) ?
+                                            "already_decommissioned" : "unknown_node");
+        *status = 404;
+        return plan;
+    }
+    json_object_set_boolean(po, "down", rec->down != 0);
+    if (rec->quarantined_ms > 0) json_object_set_boolean(po, "quarantined", 1);
+
+    JSON_Value *slots_v = json_value_init_array();
+    JSON_Value *warnings_v = json_value_init_array();
+    JSON_Value *blockers_v = json_value_init_array();
+    int held = rec->slot_index >= 0 && rec->slot_index < SYNC_MAX_SLOTS &&
+               sync_master_slot_matches(state, rec->slot_index, rec->id) ? rec->slot_index : -1;
+    sync_slave_record_t *to = NULL;
+    if (held >= 0) {
+        JSON_Value *sv = json_value_init_object();
+        JSON_Object *so = json_object(sv);
+        json_object_set_number(so, "slot", held + 1);
+        if (cfg->sync_slots[held].name[0]) json_object_set_string(so, "label", cfg->sync_slots[held].name);
+        const sync_desired_group_t *g = sync_desired_group_for_slot(state, held);
+        if (g) json_object_set_string(so, "group", g->name);
+        to = sync_master_handover_candidate_locked(state, cfg, held, rec->id);
+        if (to) {
+            json_object_set_string(so, "action", "rebind");
+            json_object_set_string(so, "to", to->id);
+        } else {
+            json_object_set_string(so, "action", "release");
+            json_object_set_string(so, "reason", "no_candidate");
+        }
+        const sync_slot_lease_t *lease = &state->slot_leases[held];
+        if (lease->lease_id[0] && lease->expires_ms > now) {
+            JSON_Value *bv = json_value_init_object();
+            JSON_Object *bo = json_object(bv);
+            json_object_set_string(bo, "error", "slot_leased");
+            json_object_set_number(bo, "slot", held + 1);
+            json_object_set_string(bo, "holder", lease->holder);
+            json_object_set_number(bo, "expires_in_s", (double)((lease->expires_ms - now + 999) / 1000));
+            if (force) json_object_set_boolean(bo, "overridden", 1);
+            json_array_append_value(json_array(blockers_v), bv);
+        }
+        json_array_append_value(json_array(slots_v), sv);
+    }
+    /* What the node leaves behind in configuration the master cannot edit. */
+    for (int slot = 0; slot < sync_slot_count(cfg); slot++) {
+        if (cfg->sync_slots[slot].prefer_id[0] && !strcmp(cfg->sync_slots[slot].prefer_id, rec->id)) {
+            sync_decommission_warning(json_array(warnings_v), "prefer_id", slot + 1, NULL);
+        }
+    }
+    for (int gi = 0; gi < state->desired_count; gi++) {
+        const sync_desired_group_t *g = &state->desired[gi];
+        for (int k = 0; k < g->id_count; k++) {
+            if (!strcmp(g->ids[k], rec->id)) {
+                sync_decommission_warning(json_array(warnings_v), "desired_ids", 0, g->name);
+            }
+        }
+    }
+    if (sync_master_find_expected_locked(state, rec->id)) json_object_set_boolean(po, "inventory", 1);
+    json_object_set_value(po, "slots", slots_v);
+    json_object_set_value(po, "warnings", warnings_v);
+    json_object_set_value(po, "blockers", blockers_v);
+
+    int blocked = json_array_get_count(json_array(blockers_v)) > 0 && !force;
+    if (execute && blocked) {
+        json_object_set_string(po, "error", "slot_leased");
+        *status = 409;
+    } else if (execute) {
+        if (!rec->decommission_ms) rec->decommission_ms = now;
+        char before[SYNC_MAX_SLOTS][64];
+        sync_master_copy_assignees_locked(state, before);
+        if (held >= 0) {
+            if (to) (void)sync_master_assign_slot_locked(state, to, held, 0);
+            else sync_master_release_slot_locked(state, held);
+        }
+        rec->slot_index = -1;
+        sync_master_drop_claims_locked(state, rec->id, -1);
+        sync_master_log_binding_changes_locked(state, cfg, before, "decommission", actor);
+        sync_master_touch_locked(state);
+        fprintf(stderr, "sync master: decommissioning %s (by %s)\n", rec->id, actor);
+    }
+    pthread_mutex_unlock(&app->master.lock);
+    return plan;
+}
+
+int sync_master_decommission_finish(app_t *app, const config_t *cfg, const char *id,
+                                    const char *actor) {
+    pthread_mutex_lock(&app->master.lock);
+    sync_master_state_t *state = &app->master;
+    char before[SYNC_MAX_SLOTS][64];
+    sync_master_copy_assignees_locked(state, before);
+    if (!sync_master_delete_record_locked(state, id)) {
+        pthread_mutex_unlock(&app->master.lock);
+        return -1;
+    }
+    sync_master_log_binding_changes_locked(state, cfg, before, "decommission", actor);
+    sync_expected_node_t *exp = sync_master_find_expected_locked(state, id);
+    if (exp) memset(exp, 0, sizeof(*exp));
+    sync_retired_node_t *r = sync_master_find_retired_locked(state, id);
+    for (int i = 0; !r && i < SYNC_MAX_SLAVES; i++) {
+        if (!state->retired[i].id[0]) r = &state->retired[i];
+    }
+    if (!r) {
+        /* Full: the oldest entry makes room. */
+        r = &state->retired[0];
+        for (int i = 1; i < SYNC_MAX_SLAVES; i++) {
+            if (state->retired[i].ts_ms < r->ts_ms) r = &state->retired[i];
+        }
+    }
+    memset(r, 0, sizeof(*r));
+    snprintf(r->id, sizeof(r->id), "%s", id);
+    snprintf(r->actor, sizeof(r->actor), "%s", actor ? actor : "");
+    r->ts_ms = now_ms();
+    sync_master_touch_locked(state);
+    pthread_mutex_unlock(&app->master.lock);
+    fprintf(stderr, "sync master: %s decommissioned and removed\n", id);
+    return 0;
+}
+
+int sync_master_decommission_cancel(app_t *app, const char *id) {
+    int undone = 0;
+    pthread_mutex_lock(&app->master.lock);
+    sync_slave_record_t *rec = sync_master_find_record(&app->master, id, 0);
+    if (rec && rec->decommission_ms) {
+        rec->decommission_ms = 0;
+        undone = 1;
+    }
+    sync_retired_node_t *r = sync_master_find_retired_locked(&app->master, id);
+    if (r) {
+        memset(r, 0, sizeof(*r));
+        undone = 1;
+    }
+    if (undone) sync_master_touch_locked(&app->master);
+    pthread_mutex_unlock(&app->master.lock);
+    if (undone) fprintf(stderr, "sync master: decommission of %s canceled\n", id);
+    return undone;
+}
+
+static int sync_master_should_stop(sync_master_state_t *state) {
+    pthread_mutex_lock(&state->lock);
+    int stop = state->stop;
+    pthread_mutex_unlock(&state->lock);
+    return stop;
+}
+
+static void *sync_master_thread_main(void *arg) {
+    app_t *app = (app_t *)arg;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) return NULL;
+    while (!sync_master_should_stop(&app->master)) {
+        app_config_snapshot(app, cfg);
+        char before[SYNC_MAX_SLOTS][64];
+        pthread_mutex_lock(&app->master.lock);
+        sync_master_detect_down_locked(&app->master, cfg);
+        sync_master_expire_simulations_locked(&app->master, cfg);
+        sync_master_expire_leases_locked(&app->master);
+        sync_master_expire_overrides_locked(&app->master, cfg);
+        sync_master_copy_assignees_locked(&app->master, before);
+        sync_master_note_agentless_locked(&app->master, cfg);
+        sync_master_prune_locked(&app->master, cfg);
+        sync_master_log_binding_changes_locked(&app->master, cfg, before, "expired", "master");
+        if (app->master.desired_count > 0) {
+            sync_master_copy_assignees_locked(&app->master, before);
+            sync_master_reconcile_locked(&app->master, cfg);
+            sync_master_log_binding_changes_locked(&app->master, cfg, before, "reconcile", "master");
+        }
+        pthread_mutex_unlock(&app->master.lock);
+        sync_master_schedule_health_checks(app, cfg);
+        sync_master_check_quarantine(app, cfg);
+        (void)sync_registry_sync(app, cfg, SYNC_REGISTRY_TICK, NULL);
+        sleep(1);
+    }
+    free(cfg);
+    return NULL;
+}
+
+int sync_master_start_thread(app_t *app) {
+    if (!app) return -1;
+    pthread_mutex_lock(&app->master.lock);
+    app->master.stop = 0;
+    if (app->master.running) {
+        pthread_mutex_unlock(&app->master.lock);
+        return 0;
+    }
+    if (pthread_create(&app->master.thread, NULL, sync_master_thread_main, app) == 0) {
+        app->master.running = 1;
+        pthread_mutex_unlock(&app->master.lock);
+        return 0;
+    }
+    pthread_mutex_unlock(&app->master.lock);
+    fprintf(stderr, "WARN: failed to start sync master thread\n");
+    return -1;
+}
+
+void sync_master_stop_thread(sync_master_state_t *state) {
+    if (!state) return;
+    pthread_mutex_lock(&state->lock);
+    state->stop = 1;
+    int running = state->running;
+    pthread_mutex_unlock(&state->lock);
+    if (running) {
+        pthread_join(state->thread, NULL);
+        pthread_mutex_lock(&state->lock);
+        state->running = 0;
+        pthread_mutex_unlock(&state->lock);
+    }
+}
@@ -6,22 +6,56 @@
 
 #include "parson.h"
 
-#define SYNC_MAX_SLOTS 4
+#define SYNC_MAX_SLOTS 32
+#define SYNC_DEFAULT_SLOTS 4
 #define SYNC_SLOT_MAX_COMMANDS 16
+#define SYNC_SLOT_COMMAND_POOL 64
+#define SYNC_MAX_SLOT_TEMPLATES 4
 #define SYNC_MAX_SLAVES 64
+#define SYNC_BINDING_LOG_MAX 128
+#define SYNC_MAX_CLAIMS 16
+#define SYNC_DESIRED_MAX_IDS 8
+#define SYNC_DESIRED_MAX_LABELS 4
+#define SYNC_SLOT_MAX_ALIASES 4
+#define SYNC_SLOT_MAX_VARS 8
+#define SYNC_SLOT_VAR_POOL 64
 
 typedef struct {
     char name[64];
+    char aliases[SYNC_SLOT_MAX_ALIASES][64];   /* other names the slot answers to */
+    int alias_count;
     char prefer_id[64];
     int command_count;
-    struct { char json[512]; } commands[SYNC_SLOT_MAX_COMMANDS];
+    unsigned char command_ids[SYNC_SLOT_MAX_COMMANDS];   /* into config sync_slot_commands */
+    char health[512];          /* /exec body run against the holder; empty = off */
+    int health_interval_s;     /* 0 = default (30) */
+    int health_failures;       /* consecutive failures before degraded; 0 = default (3) */
+    int health_failover;       /* hand a degraded slot to a waiting slave */
+    char template_name[32];    /* [sync.template.NAME] it was created from */
+    char ssh[192];             /* ssh://user@host[:port]: agentless, run by the master */
+    char ssh_identity[256];    /* key for ssh; empty = [ssh] identity_file */
+    unsigned char env_ids[SYNC_SLOT_MAX_VARS];     /* NAME=VALUE for the handler's environment */
+    int env_count;
+    unsigned char param_ids[SYNC_SLOT_MAX_VARS];   /* NAME=VALUE filling {NAME} in args */
+    int param_count;                               /* (both into config sync_slot_vars) */
 } sync_slot_config_t;
 
+/* [sync.template.NAME]: slots created from a name pattern such as
+ * cam-{01..24}, each taking the template's commands, health check and
+ * prefer_id; {name} and {slot} in them stand for the slot's own. */
+typedef struct {
+    char name[32];
+    char names[96];            /* pattern; one {A..B} range, zero-padded like A */
+    int first;                 /* first slot number; 0 = after the highest in use */
+    sync_slot_config_t slot;   /* defaults for the slots it creates */
+} sync_slot_template_t;
+
 typedef struct {
     int in_use;
     char id[64];
     char remote_ip[64];
     char announced_address[256];
+    int port;
     char device[64];
     char role[64];
     char version[32];
@@ -30,14 +64,165 @@ typedef struct {
     int slot_index;
     int last_reported_slot_index;
     int last_ack_generation;
+    int down;
+    char transport[8];
+    int claim_priority;
+    char profile_hash[17];     /* hash of the last full registration payload */
+    char catalog_version[24];  /* as reported in that payload */
+    char instance[17];         /* random per slave process; tells boxes sharing an id apart */
+    char id_source[16];        /* how the slave derived its id (config, machine-id, mac, ...) */
+    long long reg_generation;  /* last registration applied from that instance */
+    int stale_registrations;   /* older or repeated generations that were ignored */
+    char conflict_with[272];   /* other registrant of this id: its address:port, or its suffixed id */
+    long long conflict_since_ms;
+    long long conflict_last_ms;
+    char autod_version[32];    /* build the slave runs; empty before versioning */
+    int api_version;           /* node API range it speaks; 0 = not reported */
+    int api_min_version;
+    int dispatch_refused;      /* incompatible under [sync] version_policy = refuse */
+    long long quarantined_ms;  /* taken out of routing after failed dispatches; 0 = not */
+    long long probation_due_ms; /* next health check that may re-admit it */
+    int quarantine_failures;   /* failures in a row that led to it */
+    int probe_in_flight;
+    double load;               /* 1-minute load per CPU from the last heartbeat; < 0 = not sent */
+    long long probe_ms;        /* last registration probe round trip; -1 = failed, -2 = not probed */
+    int bench;                 /* synthetic node of autod bench: no slot, probe or dispatch */
+    long long decommission_ms; /* being decommissioned: no slot or dispatch; 0 = not */
+    long long simulated_down_ms;       /* failover drill: treated as down since; 0 = not */
+    long long simulated_down_until_ms; /* ... until then, whatever its heartbeats say */
 } sync_slave_record_t;
 
+typedef struct {
+    long long ts_ms;           /* monotonic */
+    long long ts_unix_ms;      /* wall clock, as reported */
+    int slot_index;
+    char old_id[64];
+    char new_id[64];
+    char reason[16];
+    char actor[64];
+} sync_binding_change_t;
+
+/* A slot claim waiting for an operator under claim_policy = manual. Rejected
+ * claims stay in the table so the slave's retries keep getting refused. */
+typedef struct {
+    int in_use;
+    int rejected;
+    int slot_index;
+    char id[64];
+    int priority;
+    long long ts_ms;
+} sync_slot_claim_t;
+
+/* Outcome of a slot's health command against its current holder. The state
+ * is reset whenever the slot changes hands. */
+typedef struct {
+    char id[64];
+    char state[12];            /* unknown, ok, failing, degraded */
+    int failures;              /* consecutive */
+    int in_flight;
+    int last_rc;
+    char last_error[32];
+    long long next_due_ms;
+    long long since_ms;        /* last state change */
+} sync_slot_health_t;
+
+/* Exclusive exec lock on a slot held by one client until expires_ms. */
+typedef struct {
+    char lease_id[33];         /* empty = not leased */
+    char holder[64];
+    long long acquired_ms;     /* monotonic, for the TTL */
+    long long acquired_unix_ms;
+    long long expires_ms;
+} sync_slot_lease_t;
+
+/* A binding made by PUT /sync/slots/{slot} with a ttl. When expires_ms
+ * passes the slot goes back to previous_id (empty = unbound). */
+typedef struct {
+    char id[64];               /* empty = none */
+    char previous_id[64];
+    long long set_ms;
+    long long expires_ms;
+    char actor[64];
+} sync_slot_override_t;
+
+/* A node declared through POST /nodes/import before it ever registers. The
+ * entry outlives retention pruning; first_seen_ms stays 0 until first contact. */
+typedef struct {
+    int in_use;
+    char id[64];
+    char address[128];
+    int port;
+    char device[64];
+    char labels[256];          /* serialized JSON object */
+    int slot_hint;             /* 0-based, -1 = none */
+    long long imported_ms;
+    long long first_seen_ms;
+} sync_expected_node_t;
+
+/* One group of the declared slot topology (PUT /sync/slots/desired): keep
+ * `replicas` of its slots bound to live nodes that pass every constraint.
+ * Empty constraints match any node. */
+typedef struct {
+    char name[32];
+    unsigned char slots[SYNC_MAX_SLOTS];   /* 1 = slot belongs to the group */
+    int replicas;
+    char ids[SYNC_DESIRED_MAX_IDS][64];
+    int id_count;
+    char device[64];
+    char role[64];
+    char caps[256];            /* comma separated; every one is required */
+    struct { char key[32]; char value[64]; } labels[SYNC_DESIRED_MAX_LABELS];
+    int label_count;
+    int bound;                 /* matching holders after the last pass */
+    long long drift_since_ms;  /* 0 = converged */
+} sync_desired_group_t;
+
+/* A node removed by POST /nodes/{id}/decommission. Its registrations are
+ * refused until DELETE /nodes/{id}/decommission readmits it. */
+typedef struct {
+    char id[64];               /* empty = free */
+    long long ts_ms;
+    char actor[64];
+} sync_retired_node_t;
+
 typedef struct {
     pthread_mutex_t lock;
     sync_slave_record_t records[SYNC_MAX_SLAVES];
+    sync_expected_node_t expected[SYNC_MAX_SLAVES];
     int slot_generation[SYNC_MAX_SLOTS];
     char slot_assignees[SYNC_MAX_SLOTS][64];
     unsigned char slot_manual_overrides[SYNC_MAX_SLOTS];
+    unsigned char slot_agentless[SYNC_MAX_SLOTS];   /* has ssh; never given to a slave */
+    sync_binding_change_t binding_log[SYNC_BINDING_LOG_MAX];
+    unsigned binding_log_total;
+    sync_slot_claim_t claims[SYNC_MAX_CLAIMS];
+    sync_slot_health_t slot_health[SYNC_MAX_SLOTS];
+    sync_slot_lease_t slot_leases[SYNC_MAX_SLOTS];
+    sync_slot_override_t slot_overrides[SYNC_MAX_SLOTS];
+    sync_desired_group_t desired[SYNC_MAX_SLOTS];
+    int desired_count;
+    long long desired_updated_unix;
+    long long reconciled_ms;   /* last reconcile pass */
+    sync_retired_node_t retired[SYNC_MAX_SLAVES];
+    /* Write-behind of [sync] registry_path: what was last written, and the
+     * changes seen since. */
+    char registry_written[17];
+    char registry_seen[17];
+    unsigned long long registry_seen_version;
+    int registry_changes;
+    long long registry_dirty_ms;   /* first unwritten change, 0 = clean */
+    long long registry_flushed_unix;
+    unsigned registry_writes;
+    /* Bumped on every registry change; drives ETag/Last-Modified and the
+     * cached GET /sync/slaves payload. */
+    unsigned long long version;
+    long long modified_unix;
+    char *slaves_cache;
+    size_t slaves_cache_len;
+    unsigned long long slaves_cache_version;
+    pthread_t thread;
+    int running;
+    int stop;
 } sync_master_state_t;
 
 typedef struct {
@@ -49,8 +234,26 @@ typedef struct {
     int last_received_generation;
     int current_slot;
     char current_slot_label[64];
+    char advertised_address[128];
 } sync_slave_state_t;
 
+/* Where the master reaches a registered slave's HTTP API. */
+typedef struct {
+    char id[64];
+    char host[128];
+    int port;
+    int slot;          /* 1-based, 0 = unassigned */
+    int down;
+    int quarantined;
+    char transport[8];
+    char device[64];
+    char role[64];
+    char version[32];
+    char via[64];      /* gateway the master reaches it through, or "" */
+    char via_host[128];/* the gateway's address ("" while it is not registered) */
+    int via_port;
+} sync_node_addr_t;
+
 typedef struct config config_t;
 typedef struct app app_t;
 struct mg_context;
@@ -58,11 +261,42 @@ struct mg_connection;
 
 void sync_cfg_defaults(config_t *cfg);
 int sync_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+/* Fill in [sync] id when it is unset, from the first of id_sources that
+ * yields a value, and the id id_migrate_from gives as sync_previous_id. */
 void sync_ensure_id(config_t *cfg);
 
 void sync_caps_from_json_value(const JSON_Value *value, char *dest, size_t dest_sz);
 int sync_preferred_slot_for_id(const config_t *cfg, const char *id);
 
+/* Slots a reference names: "2", a slot name or alias, or a glob over names
+ * and aliases in which * stays within one '/'-separated level and ** spans
+ * levels. Sets hits[i] for each slot and returns how many there are. */
+int sync_slot_match(const config_t *cfg, const char *ref, unsigned char hits[SYNC_MAX_SLOTS]);
+/* The one slot a reference names. Returns 0 with *slot_index set, -1 when no
+ * slot matches and -2 when several do. */
+int sync_slot_lookup(const config_t *cfg, const char *ref, int *slot_index);
+/* Body for a failed lookup: 404 unknown_slot, or 409 ambiguous_slot listing
+ * the slots that matched. */
+JSON_Value *sync_slot_lookup_error(const config_t *cfg, const char *ref, int rc, int *status);
+/* Merge the env and params of slot slot_index (0-based) into an /exec body
+ * as its "env" and "params" objects; names the body sets itself are kept.
+ * Returns 1 when anything was added. */
+int sync_slot_exec_context(const config_t *cfg, int slot_index, JSON_Object *exec);
+#define SYNC_HEALTH_BODY_MAX 2048
+/* The slot's health command as sent to its holder, with the slot's env and
+ * params merged in (as configured when that does not fit out_sz). Returns
+ * -1 when the slot has none. */
+int sync_slot_health_body(const config_t *cfg, int slot_index, char *out, size_t out_sz);
+/* Warn about names and aliases that more than one slot answers to, and
+ * about slots beyond [capacity] max_slots. */
+void sync_cfg_check_slots(const config_t *cfg);
+/* Create the slots of every [sync.template.NAME]; called once the whole
+ * config is read. */
+void sync_cfg_expand_templates(config_t *cfg);
+/* Slots the master manages: [sync] slots, raised to the highest defined,
+ * and capped at [capacity] max_slots. */
+int sync_slot_count(const config_t *cfg);
+
 void sync_master_state_init(sync_master_state_t *state);
 void sync_slave_state_init(sync_slave_state_t *state);
 void sync_slave_reset_tracking(sync_slave_state_t *state);
@@ -78,7 +312,144 @@ void sync_slave_get_current_slot_label(sync_slave_state_t *state, char *out, siz
 void sync_append_capabilities(const config_t *cfg, JSON_Array *caps_arr);
 JSON_Value *sync_build_status_json(const config_t *cfg, sync_slave_state_t *state);
 
+JSON_Value *sync_master_handle_registration(app_t *app, const config_t *cfg, JSON_Object *obj,
+                                            const char *remote_ip, const char *transport,
+                                            int *status_out);
+
+/* Snapshot of every registered slave with its HTTP address. Returns the count. */
+int sync_master_list_nodes(app_t *app, const config_t *cfg, sync_node_addr_t *out, int max);
+/* The same for one slave. Returns 0, or -1 when id is not registered. */
+int sync_master_node_addr(app_t *app, const config_t *cfg, const char *id, sync_node_addr_t *out);
+
+/* Forget every record registered by autod bench. Returns how many. */
+int sync_master_drop_bench(app_t *app);
+
+/* Registry records, bench nodes excluded. *stale (may be NULL) gets how many
+ * of them hold no slot and were last heard from more than stale_ms ago. */
+int sync_master_registry_count(app_t *app, long long stale_ms, int *stale);
+/* Mark the slots of the desired group named name (PUT /sync/slots/desired).
+ * Returns -1 when there is no such group. */
+int sync_master_group_slots(app_t *app, const char *name, unsigned char want[SYNC_MAX_SLOTS]);
+
+/* Registration generation last applied for a slave, or 0 when the id is
+ * unknown or its slave does not send one. */
+long long sync_master_reg_generation(app_t *app, const char *id);
+
+/* DNS name a slave announced instead of an IP, with its API port (0 when it
+ * reported none). Returns -1 when the id is unknown or announced no name. */
+int sync_master_node_hostname(app_t *app, const char *id, char *host, size_t host_sz, int *port);
+
+/* Exec aimed at a node (by id) or slot while another client leases that
+ * slot. Returns NULL when allowed, otherwise the 409 slot_leased body. */
+JSON_Value *sync_master_lease_conflict(app_t *app, const char *id, int slot_index,
+                                       const char *lease_id);
+
+/* "compatible" when a peer speaking API revisions api_min..api overlaps this
+ * build's range, "incompatible" when not, "unknown" when api is 0 (a build
+ * from before version reporting). */
+const char *sync_api_compat(int api, int api_min);
+
+/* Exec aimed at a node whose version the master refuses to dispatch to.
+ * Returns NULL when allowed, otherwise the 409 incompatible_version body. */
+JSON_Value *sync_master_version_conflict(app_t *app, const char *id);
+
+/* Exec aimed at a node quarantined after repeated failed dispatches, or
+ * one being decommissioned. Returns NULL when allowed, otherwise the 409
+ * node_quarantined or node_decommissioning body. */
+JSON_Value *sync_master_quarantine_conflict(app_t *app, const char *id);
+
+/* How id came to hold slot_index: the reason of the binding change that gave
+ * it the slot ("auto", "failover", "push", ...) and who held it before (empty
+ * when nobody did). Returns -1 when id does not hold the slot or the binding
+ * log no longer reaches back that far. */
+int sync_master_slot_binding(app_t *app, int slot_index, const char *id, char *reason,
+                             size_t reason_sz, char *from, size_t from_sz);
+
+/* Whether the node is quarantined (for routing among several candidates). */
+int sync_master_node_quarantined(app_t *app, const char *id);
+
+/* A label of node id, from its metadata or else its import. Returns 0 when
+ * the label is set. */
+int sync_master_node_label(app_t *app, const char *id, const char *key, char *out, size_t out_sz);
+
+/* Whether the node is being decommissioned and takes no new work. */
+int sync_master_node_decommissioning(app_t *app, const char *id);
+
+/* Decommission plan for node id: the slot it holds and who would take it
+ * over (the desired topology's pick for a managed slot, else the healthiest
+ * live node without a slot), what blocks it (a lease on that slot unless
+ * force) and what stays behind (prefer_id, desired ids). With execute the
+ * node is also taken out of routing and the slot handed over (reason
+ * "decommission", by actor). Returns the plan and sets *status: 200, 404
+ * unknown_node, or 409 slot_leased (with the plan) when execute is blocked. */
+JSON_Value *sync_master_decommission_plan(app_t *app, const config_t *cfg, const char *id,
+                                          int execute, int force, const char *actor,
+                                          int *status);
+/* Last step: drop the record and the imported inventory entry and refuse the
+ * id's registrations from now on. Returns 0, or -1 when id is not registered. */
+int sync_master_decommission_finish(app_t *app, const config_t *cfg, const char *id,
+                                    const char *actor);
+/* Undo: put a node that is still draining back into routing, or readmit a
+ * removed one. Returns 1 when either was the case, 0 otherwise. */
+int sync_master_decommission_cancel(app_t *app, const char *id);
+
+/* Failover drill (POST /nodes/{id}/simulate-down): treat the node as down
+ * for duration_s without touching it, with the usual node_down event (and
+ * node_up once it ends) marked "simulated". Returns 0, or -1 when id is not
+ * registered. A drill that is already running is extended. */
+int sync_master_simulate_down(app_t *app, const config_t *cfg, const char *id, int duration_s,
+                              const char *actor);
+/* End a drill early. Returns 1 when one was running, 0 otherwise. */
+int sync_master_simulate_down_end(app_t *app, const config_t *cfg, const char *id,
+                                  const char *actor);
+
+/* Routing health of a registered slave, 0-100: the weighted mean of
+ * heartbeat recency, dispatch success rate, load per CPU and registration
+ * probe latency, each scored 0-100 (-1 when the node gives no such signal
+ * and it is left out). A node that is down scores 0. */
+typedef struct {
+    int score;
+    int heartbeat;
+    int dispatch;
+    int load;
+    int probe;
+} sync_health_t;
+
+/* Returns 0 and fills out when the id is registered. */
+int sync_master_node_health(app_t *app, const config_t *cfg, const char *id, sync_health_t *out);
+JSON_Value *sync_health_json(const sync_health_t *h);
+/* Changes whenever any registered node's health does (for response caches). */
+unsigned long sync_master_health_digest(app_t *app, const config_t *cfg);
+/* Order two nodes for routing: negative when a looks healthier than b
+ * (higher health score, then cluster_node_compare). */
+int sync_master_health_compare(app_t *app, const config_t *cfg, const char *a, const char *b);
+
+/* Load another master's GET /sync/slaves payload into the registry (role
+ * promotion, or the file at [sync] registry_path on start); slot bindings
+ * are logged with reason. Returns the number of nodes seeded. */
+int sync_master_seed_snapshot(app_t *app, const config_t *cfg, JSON_Object *snapshot,
+                              const char *skip_id, const char *reason, const char *actor);
+
+/* Restore the registry kept at [sync] registry_path. */
+void sync_master_load_registry(app_t *app, const config_t *cfg);
+
+/* Write the registry to [sync] registry_path now. With force 0 it is only
+ * written when it changed since the last write. Fills out (when given) with
+ * the path, node count and size. Returns 0, or -1 when there is no path or
+ * the write failed. */
+int sync_master_flush_registry(app_t *app, const config_t *cfg, int force, JSON_Object *out);
+
+/* Restore the desired slot topology persisted at [sync] desired_path. */
+void sync_master_load_desired(app_t *app, const config_t *cfg);
+
+/* Probe the nodes remembered in [sync] address_book_path in the background
+ * so they are listed and addressable before they register or a scan finds
+ * them. */
+void sync_master_recall_nodes(const config_t *cfg);
+
 void sync_register_http_handlers(struct mg_context *ctx, app_t *app);
+int sync_master_start_thread(app_t *app);
+void sync_master_stop_thread(sync_master_state_t *state);
 int sync_slave_start_thread(app_t *app);
 void sync_slave_stop_thread(sync_slave_state_t *state);
 
@@ -0,0 +1,422 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <signal.h>
+#include <time.h>
+#include <unistd.h>
+#include <pthread.h>
+
+#include "parson.h"
+#include "autod.h"
+#include "events.h"
+#include "mqtt.h"
+#include "cluster.h"
+#include "sync_mqtt.h"
+#include "sync_results.h"
+#include "caller.h"
+
+extern volatile sig_atomic_t g_stop;
+
+#define SYNC_MQTT_CONNECT_TIMEOUT_MS 5000
+#define SYNC_MQTT_RETRY_S 5
+
+/* ---------- Slave ---------- */
+
+static mqtt_client_t g_slave_client = { .fd = -1 };
+static char g_slave_broker[128];
+static char g_slave_id[64];
+static long long g_slave_retry_after_ms;
+
+static void sync_mqtt_topic(char *out, size_t out_sz, const config_t *cfg,
+                            const char *id, const char *suffix) {
+    const char *prefix = cfg->sync_mqtt_prefix[0] ? cfg->sync_mqtt_prefix : "autod";
+    if (id) snprintf(out, out_sz, "%s/node/%s/%s", prefix, id, suffix);
+    else snprintf(out, out_sz, "%s/%s", prefix, suffix);
+}
+
+void sync_mqtt_slave_close(void) {
+    if (g_slave_client.fd >= 0) mqtt_client_close(&g_slave_client);
+    g_slave_broker[0] = '\0';
+    g_slave_id[0] = '\0';
+}
+
+static int sync_mqtt_slave_connect(const config_t *cfg) {
+    if (g_slave_client.fd >= 0 &&
+        strcmp(g_slave_broker, cfg->sync_mqtt_broker) == 0 &&
+        strcmp(g_slave_id, cfg->sync_id) == 0) {
+        return 0;
+    }
+    sync_mqtt_slave_close();
+    if (now_ms() < g_slave_retry_after_ms) return -1;
+
+    char host[128];
+    int port = 0;
+    if (mqtt_parse_url(cfg->sync_mqtt_broker, host, sizeof(host), &port) != 0) {
+        fprintf(stderr, "sync slave: invalid mqtt_broker '%s'\n", cfg->sync_mqtt_broker);
+        g_slave_retry_after_ms = now_ms() + SYNC_MQTT_RETRY_S * 1000LL;
+        return -1;
+    }
+    char client_id[80];
+    snprintf(client_id, sizeof(client_id), "autod-%s", cfg->sync_id);
+    int keepalive = cfg->sync_register_interval_s > 0 ? cfg->sync_register_interval_s * 2 : 60;
+    if (mqtt_client_connect(&g_slave_client, host, port, client_id, keepalive,
+                            SYNC_MQTT_CONNECT_TIMEOUT_MS) != 0) {
+        fprintf(stderr, "sync slave: mqtt connect to %s:%d failed\n", host, port);
+        g_slave_retry_after_ms = now_ms() + SYNC_MQTT_RETRY_S * 1000LL;
+        return -1;
+    }
+
+    char topic[256];
+    sync_mqtt_topic(topic, sizeof(topic), cfg, cfg->sync_id, "sync");
+    int rc = mqtt_client_subscribe(&g_slave_client, topic);
+    sync_mqtt_topic(topic, sizeof(topic), cfg, cfg->sync_id, "exec");
+    if (rc == 0) rc = mqtt_client_subscribe(&g_slave_client, topic);
+    if (rc != 0) {
+        mqtt_client_close(&g_slave_client);
+        return -1;
+    }
+    strncpy(g_slave_broker, cfg->sync_mqtt_broker, sizeof(g_slave_broker) - 1);
+    g_slave_broker[sizeof(g_slave_broker) - 1] = '\0';
+    strncpy(g_slave_id, cfg->sync_id, sizeof(g_slave_id) - 1);
+    g_slave_id[sizeof(g_slave_id) - 1] = '\0';
+    fprintf(stderr, "sync slave: connected to mqtt broker %s:%d\n", host, port);
+    return 0;
+}
+
+/* Run an /exec body received on <prefix>/node/<id>/exec and publish the result. */
+static void sync_mqtt_slave_run_exec(app_t *app, const config_t *cfg, const char *payload) {
+    char topic[256];
+    sync_mqtt_topic(topic, sizeof(topic), cfg, cfg->sync_id, "result");
+
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    json_object_set_string(ro, "id", cfg->sync_id);
+
+    JSON_Value *root = json_parse_string(payload);
+    JSON_Object *req = root ? json_object(root) : NULL;
+    const char *path = req ? json_object_get_string(req, "path") : NULL;
+    const char *request_id = req ? json_object_get_string(req, "request_id") : NULL;
+    if (request_id) json_object_set_string(ro, "request_id", request_id);
+    const blackout_window_t *bw = NULL;
+    long long bw_ends = 0;
+    JSON_Value *filled_args = NULL;
+    const char *context_err = NULL;
+
+    if (!req) {
+        json_object_set_string(ro, "error", "bad_json");
+    } else if (!path || !*path) {
+        json_object_set_string(ro, "error", "missing_path");
+    } else if (!catalog_allows(cfg, path)) {
+        json_object_set_string(ro, "path", path);
+        json_object_set_string(ro, "error", "command_not_allowed");
+    } else if (exec_parse_output_mode(cfg, path, json_object_get_string(req, "parse_output")) < 0) {
+        json_object_set_string(ro, "path", path);
+        json_object_set_string(ro, "error", "bad_parse_output");
+    } else if (json_object_get_string(req, "profile") &&
+               !profile_find(cfg, json_object_get_string(req, "profile"))) {
+        json_object_set_string(ro, "path", path);
+        json_object_set_string(ro, "error", "unknown_profile");
+    } else if ((context_err = exec_context_check(req, json_object_get_array(req, "args"),
+                                                 &filled_args)) != NULL) {
+        json_object_set_string(ro, "path", path);
+        json_object_set_string(ro, "error", context_err);
+    } else if ((bw = blackout_check(app, cfg, path, &bw_ends)) != NULL) {
+        /* No admin token or queue over the broker: blackouts refuse. */
+        json_object_set_string(ro, "path", path);
+        json_object_set_string(ro, "error", "blackout");
+        json_object_set_string(ro, "window", bw->name);
+        if (bw_ends > 0) json_object_set_number(ro, "ends_unix", (double)bw_ends);
+        blackout_emit(path, bw->name, "rejected", "mqtt", 0);
+    } else {
+        const exec_profile_t *profile =
+            profile_select(cfg, path, json_object_get_string(req, "profile"), NULL);
+        JSON_Array *args = filled_args ? json_array(filled_args) : json_object_get_array(req, "args");
+        int rc = 0;
+        long long elapsed = 0;
+        char *out = NULL, *err = NULL;
+        size_t out_len = 0, err_len = 0;
+        exec_usage_t usage;
+        /* Nothing vouches for a request taken off the broker. */
+        caller_set("mqtt", "anonymous");
+        exec_context_set(req);
+        int exec_r = run_exec(cfg, path, args, cfg->exec_timeout_ms, cfg->max_output_bytes,
+                              profile, request_id, &rc, &elapsed, &out, &err, &out_len, &err_len,
+                              &usage);
+        exec_context_set(NULL);
+        caller_set(NULL, NULL);
+        if (exec_r != 0) {
+            json_object_set_string(ro, "error",
+                                   exec_r == EXEC_ERR_NOT_FOUND ? "binary_not_found" :
+                                   exec_r == EXEC_ERR_CAPACITY ? "jobs_full" :
+                                   exec_r == EXEC_ERR_INTEGRITY ? "integrity_mismatch" : "spawn_failed");
+        } else {
+            json_object_set_string(ro, "path", path);
+            json_object_set_number(ro, "rc", rc);
+            json_object_set_number(ro, "elapsed_ms", (double)elapsed);
+            exec_set_usage(ro, &usage);
+            if (profile) json_object_set_string(ro, "profile", profile->name);
+            if (!exec_parse_output_mode(cfg, path, json_object_get_string(req, "parse_output")) ||
+                exec_set_result(ro, out, out_len) != 0) {
+                (void)exec_set_output(ro, "stdout", out, out_len, 0);
+            }
+            (void)exec_set_output(ro, "stderr", err, err_len, 0);
+        }
+        free(out);
+        free(err);
+    }
+    if (filled_args) json_value_free(filled_args);
+    if (root) json_value_free(root);
+
+    char *s = json_serialize_to_string(resp);
+    if (s) {
+        if (mqtt_client_publish(&g_slave_client, topic, s, strlen(s)) != 0) {
+            mqtt_client_close(&g_slave_client);
+        }
+        json_free_serialized_string(s);
+    }
+    json_value_free(resp);
+}
+
+/* Wait up to timeout_ms for one message. Exec requests are served inline; a
+ * registration reply is returned through *reply when requested. */
+static int sync_mqtt_slave_poll(app_t *app, const config_t *cfg, int timeout_ms, char **reply) {
+    char *topic = NULL, *payload = NULL;
+    int r = mqtt_client_poll(&g_slave_client, timeout_ms, &topic, &payload, NULL);
+    if (r < 0) {
+        fprintf(stderr, "sync slave: mqtt connection lost\n");
+        mqtt_client_close(&g_slave_client);
+        return -1;
+    }
+    if (r == 0) return 0;
+
+    char sync_topic[256], exec_topic[256];
+    sync_mqtt_topic(sync_topic, sizeof(sync_topic), cfg, cfg->sync_id, "sync");
+    sync_mqtt_topic(exec_topic, sizeof(exec_topic), cfg, cfg->sync_id, "exec");
+    int got_reply = 0;
+    if (strcmp(topic, exec_topic) == 0) {
+        sync_mqtt_slave_run_exec(app, cfg, payload);
+    } else if (strcmp(topic, sync_topic) == 0 && reply) {
+        *reply = payload;
+        payload = NULL;
+        got_reply = 1;
+    }
+    free(topic);
+    free(payload);
+    return got_reply;
+}
+
+int sync_mqtt_slave_exchange(app_t *app, const config_t *cfg, const char *body,
+                             char **resp_body, int timeout_ms) {
+    if (!cfg || !body || !resp_body) return -1;
+    *resp_body = NULL;
+    if (sync_mqtt_slave_connect(cfg) != 0) return -1;
+
+    char topic[256];
+    snprintf(topic, sizeof(topic), "%s/register/%s",
+             cfg->sync_mqtt_prefix[0] ? cfg->sync_mqtt_prefix : "autod", cfg->sync_id);
+    if (mqtt_client_publish(&g_slave_client, topic, body, strlen(body)) != 0) {
+        mqtt_client_close(&g_slave_client);
+        return -1;
+    }
+
+    long long deadline = now_ms() + (timeout_ms > 0 ? timeout_ms : 5000);
+    while (now_ms() < deadline && !g_stop) {
+        int r = sync_mqtt_slave_poll(app, cfg, (int)(deadline - now_ms()), resp_body);
+        if (r < 0) return -1;
+        if (r == 1) return 0;
+    }
+    return -1;
+}
+
+int sync_mqtt_slave_publish(const config_t *cfg, const char *suffix, const char *body) {
+    if (!cfg || !suffix || !body) return -1;
+    if (sync_mqtt_slave_connect(cfg) != 0) return -1;
+    char topic[256];
+    sync_mqtt_topic(topic, sizeof(topic), cfg, cfg->sync_id, suffix);
+    if (mqtt_client_publish(&g_slave_client, topic, body, strlen(body)) != 0) {
+        mqtt_client_close(&g_slave_client);
+        return -1;
+    }
+    return 0;
+}
+
+void sync_mqtt_slave_idle(app_t *app, const config_t *cfg, int seconds) {
+    long long deadline = now_ms() + (long long)seconds * 1000LL;
+    while (now_ms() < deadline && !app->slave.stop && !g_stop) {
+        if (g_slave_client.fd < 0 && sync_mqtt_slave_connect(cfg) != 0) {
+            sleep(1);
+            continue;
+        }
+        long long left = deadline - now_ms();
+        (void)sync_mqtt_slave_poll(app, cfg, left > 1000 ? 1000 : (int)left, NULL);
+    }
+}
+
+/* ---------- Master ---------- */
+
+static pthread_t g_master_thread;
+static int g_master_running;
+static volatile int g_master_stop;
+
+static void sync_mqtt_master_handle(app_t *app, mqtt_client_t *client, const config_t *cfg,
+                                    const char *topic, const char *payload) {
+    const char *prefix = cfg->sync_mqtt_prefix[0] ? cfg->sync_mqtt_prefix : "autod";
+    size_t plen = strlen(prefix);
+    if (strncmp(topic, prefix, plen) != 0 || topic[plen] != '/') return;
+    const char *rest = topic + plen + 1;
+
+    if (strncmp(rest, "register/", 9) == 0) {
+        const char *topic_id = rest + 9;
+        JSON_Value *root = json_parse_string(payload);
+        if (!root || json_value_get_type(root) != JSONObject) {
+            if (root) json_value_free(root);
+            fprintf(stderr, "sync master: ignoring malformed mqtt registration on %s\n", topic);
+            return;
+        }
+        JSON_Object *obj = json_object(root);
+        const char *id = json_object_get_string(obj, "id");
+        if (!id || strcmp(id, topic_id) != 0) {
+            fprintf(stderr, "sync master: mqtt registration id does not match topic %s\n", topic);
+            json_value_free(root);
+            return;
+        }
+        int status = 0;
+        JSON_Value *resp = sync_master_handle_registration(app, cfg, obj, "", "mqtt", &status);
+        char reply_topic[256];
+        sync_mqtt_topic(reply_topic, sizeof(reply_topic), cfg, id, "sync");
+        char *s = json_serialize_to_string(resp);
+        if (s) {
+            (void)mqtt_client_publish(client, reply_topic, s, strlen(s));
+            json_free_serialized_string(s);
+        }
+        json_value_free(resp);
+        json_value_free(root);
+        return;
+    }
+
+    if (mqtt_topic_matches("node/+/results", rest)) {
+        char node[64];
+        const char *id = rest + 5;
+        size_t n = strcspn(id, "/");
+        if (n >= sizeof(node)) return;
+        memcpy(node, id, n);
+        node[n] = '\0';
+        JSON_Value *root = json_parse_string(payload);
+        if (root && json_value_get_type(root) == JSONObject) {
+            (void)sync_results_ingest(node, json_object(root));
+        }
+        if (root) json_value_free(root);
+        return;
+    }
+
+    if (mqtt_topic_matches("node/+/metrics", rest)) {
+        char node[64];
+        const char *id = rest + 5;
+        size_t n = strcspn(id, "/");
+        if (n >= sizeof(node)) return;
+        memcpy(node, id, n);
+        node[n] = '\0';
+        JSON_Value *root = json_parse_string(payload);
+        if (root && json_value_get_type(root) == JSONObject) {
+            fedmetrics_ingest(node, json_object(root));
+        }
+        if (root) json_value_free(root);
+        return;
+    }
+
+    if (mqtt_topic_matches("node/+/result", rest)) {
+        JSON_Value *data = json_parse_string(payload);
+        if (data && json_value_get_type(data) == JSONObject) {
+            JSON_Object *d = json_object(data);
+            int ok = !json_object_has_value(d, "error") && json_object_get_number(d, "rc") == 0;
+            cluster_note_dispatch("mqtt_exec", ok);
+            /* Published requests are not timed, so no latency sample. */
+            cluster_note_node_dispatch(json_object_get_string(d, "id"), ok, -1, 0, strlen(payload));
+            const char *out = json_object_get_string(d, "stdout");
+            const char *err = json_object_get_string(d, "stderr");
+            jobs_record_t jr = {
+                .node = json_object_get_string(d, "id"), .source = "mqtt_exec",
+                .requester = "mqtt", .path = json_object_get_string(d, "path"),
+                .spawned = !json_object_has_value(d, "error"),
+                .rc = (int)json_object_get_number(d, "rc"),
+                .elapsed_ms = (long long)json_object_get_number(d, "elapsed_ms"),
+                .out = out, .out_len = out ? strlen(out) : 0,
+                .err = err, .err_len = err ? strlen(err) : 0
+            };
+            jobs_store_record(&jr);
+            (void)events_emit("exec_result", data);
+        } else if (data) {
+            json_value_free(data);
+        }
+    }
+}
+
+static void *sync_mqtt_master_main(void *arg) {
+    app_t *app = (app_t *)arg;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) return NULL;
+    mqtt_client_t client = { .fd = -1 };
+
+    while (!g_master_stop && !g_stop) {
+        app_config_snapshot(app, cfg);
+        if (client.fd < 0) {
+            char host[128];
+            int port = 0;
+            char client_id[80];
+            snprintf(client_id, sizeof(client_id), "autod-master-%s", cfg->sync_id);
+            if (mqtt_parse_url(cfg->sync_mqtt_broker, host, sizeof(host), &port) != 0 ||
+                mqtt_client_connect(&client, host, port, client_id, 60,
+                                    SYNC_MQTT_CONNECT_TIMEOUT_MS) != 0) {
+                for (int i = 0; i < SYNC_MQTT_RETRY_S && !g_master_stop && !g_stop; i++) sleep(1);
+                continue;
+            }
+            char topic[256];
+            sync_mqtt_topic(topic, sizeof(topic), cfg, NULL, "register/+");
+            int rc = mqtt_client_subscribe(&client, topic);
+            sync_mqtt_topic(topic, sizeof(topic), cfg, "+", "result");
+            if (rc == 0) rc = mqtt_client_subscribe(&client, topic);
+            sync_mqtt_topic(topic, sizeof(topic), cfg, "+", "results");
+            if (rc == 0) rc = mqtt_client_subscribe(&client, topic);
+            sync_mqtt_topic(topic, sizeof(topic), cfg, "+", "metrics");
+            if (rc == 0) rc = mqtt_client_subscribe(&client, topic);
+            if (rc != 0) {
+                mqtt_client_close(&client);
+                continue;
+            }
+            fprintf(stderr, "sync master: bridging mqtt broker %s:%d\n", host, port);
+        }
+
+        char *topic = NULL, *payload = NULL;
+        int r = mqtt_client_poll(&client, 1000, &topic, &payload, NULL);
+        if (r < 0) {
+            fprintf(stderr, "sync master: mqtt connection lost\n");
+            mqtt_client_close(&client);
+            continue;
+        }
+        if (r == 1) sync_mqtt_master_handle(app, &client, cfg, topic, payload);
+        free(topic);
+        free(payload);
+    }
+    if (client.fd >= 0) mqtt_client_close(&client);
+    free(cfg);
+    return NULL;
+}
+
+int sync_mqtt_master_start(app_t *app) {
+    if (!app || g_master_running) return 0;
+    g_master_stop = 0;
+    if (pthread_create(&g_master_thread, NULL, sync_mqtt_master_main, app) != 0) {
+        fprintf(stderr, "WARN: failed to start sync mqtt bridge thread\n");
+        return -1;
+    }
+    g_master_running = 1;
+    return 0;
+}
+
+void sync_mqtt_master_stop(void) {
+    if (!g_master_running) return;
+    g_master_stop = 1;
+    pthread_join(g_master_thread, NULL);
+    g_master_running = 0;
+}
@@ -0,0 +1,31 @@
+#ifndef AUTOD_SYNC_MQTT_H
+#define AUTOD_SYNC_MQTT_H
+
+/*
+ * MQTT transport for sync ([sync] transport = mqtt). Topics, relative to
+ * [sync] mqtt_prefix:
+ *   <prefix>/register/<id>     slave -> master  registration/heartbeat body
+ *   <prefix>/node/<id>/sync    master -> slave  registration reply (slot, commands)
+ *   <prefix>/node/<id>/exec    any -> slave     /exec request body
+ *   <prefix>/node/<id>/result  slave -> any     /exec result
+ *   <prefix>/node/<id>/results slave -> master  locally started work (see sync_results.h)
+ */
+
+typedef struct config config_t;
+typedef struct app app_t;
+
+/* Slave: publish a registration body and wait for the master's reply.
+ * Returns 0 and a malloc'd reply in *resp_body on success. */
+int sync_mqtt_slave_exchange(app_t *app, const config_t *cfg, const char *body,
+                             char **resp_body, int timeout_ms);
+/* Slave: wait between heartbeats while serving <prefix>/node/<id>/exec. */
+void sync_mqtt_slave_idle(app_t *app, const config_t *cfg, int seconds);
+/* Slave: publish body on <prefix>/node/<id>/<suffix>. Returns 0 on success. */
+int sync_mqtt_slave_publish(const config_t *cfg, const char *suffix, const char *body);
+void sync_mqtt_slave_close(void);
+
+/* Master: bridge broker registrations into the registry. */
+int sync_mqtt_master_start(app_t *app);
+void sync_mqtt_master_stop(void);
+
+#endif
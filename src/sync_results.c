@@ -0,0 +1,610 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <errno.h>
+#include <pthread.h>
+#include <unistd.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "events.h"
+#include "httpc.h"
+#include "sync_mqtt.h"
+#include "sync_results.h"
+#include "version.h"
+
+#define SYNC_RESULTS_MAX_NODES 64
+
+typedef struct {
+    unsigned long long seq;
+    long long ts_ms;
+    long long ts_unix_ms;
+    char node[64];
+    char source[16];
+    int slot;
+    char path[256];
+    char state[32];             /* the event type for source "event" */
+    int rc;
+    long long elapsed_ms;
+    char *data;                 /* event payload (JSON), malloc'd */
+} result_entry_t;
+
+/* ---------- Slave outbox ---------- */
+
+static pthread_mutex_t g_outbox_lock = PTHREAD_MUTEX_INITIALIZER;
+static result_entry_t g_outbox[SYNC_RESULTS_OUTBOX];
+static unsigned long long g_outbox_first = 1;   /* oldest unacknowledged seq */
+static unsigned long long g_outbox_next = 1;
+static unsigned long long g_outbox_dropped;     /* not yet reported to the master */
+static unsigned long long g_outbox_dropped_total;
+static long long g_outbox_boot_ms;
+static long long g_outbox_last_ack_ms;
+static int g_outbox_events;                     /* slave: queue local events too */
+static char g_outbox_path[256];                 /* empty = memory only */
+static size_t g_outbox_max_bytes;
+static long long g_outbox_last_heartbeat_ms;
+
+/* ---------- Master store ---------- */
+
+typedef struct {
+    char node[64];
+    long long boot;
+    unsigned long long last_seq;
+    unsigned long long dropped;
+    long long updated_ms;
+} node_cursor_t;
+
+static pthread_mutex_t g_store_lock = PTHREAD_MUTEX_INITIALIZER;
+static result_entry_t g_store[SYNC_RESULTS_STORE];
+static unsigned long long g_store_next = 1;
+static node_cursor_t g_cursors[SYNC_RESULTS_MAX_NODES];
+static unsigned long long g_local_seq;
+
+static void result_fill(result_entry_t *e, const char *source, int slot, const char *path,
+                        const char *state, int rc, long long elapsed_ms) {
+    e->ts_ms = now_ms();
+    e->ts_unix_ms = jobs_unix_ms();
+    strncpy(e->source, source ? source : "", sizeof(e->source) - 1);
+    e->source[sizeof(e->source) - 1] = '\0';
+    e->slot = slot;
+    strncpy(e->path, path ? path : "", sizeof(e->path) - 1);
+    e->path[sizeof(e->path) - 1] = '\0';
+    strncpy(e->state, state ? state : "", sizeof(e->state) - 1);
+    e->state[sizeof(e->state) - 1] = '\0';
+    e->rc = rc;
+    e->elapsed_ms = elapsed_ms;
+}
+
+static void result_set_data(result_entry_t *e, const char *data) {
+    free(e->data);
+    e->data = data ? strdup(data) : NULL;
+}
+
+static JSON_Value *result_to_json(const result_entry_t *e, int with_node) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    if (with_node) json_object_set_string(o, "node", e->node);
+    json_object_set_number(o, "seq", (double)e->seq);
+    json_object_set_number(o, "ts_ms", (double)e->ts_ms);
+    json_object_set_number(o, "ts_unix_ms", (double)e->ts_unix_ms);
+    json_object_set_string(o, "source", e->source);
+    if (e->slot > 0) json_object_set_number(o, "slot", e->slot);
+    json_object_set_string(o, "path", e->path);
+    json_object_set_string(o, "state", e->state);
+    if (e->data) {
+        JSON_Value *dv = json_parse_string(e->data);
+        if (dv) json_object_set_value(o, "data", dv);
+    } else if (strcmp(e->state, "started") != 0 && strcmp(e->source, "heartbeat") != 0) {
+        json_object_set_number(o, "rc", e->rc);
+        json_object_set_number(o, "elapsed_ms", (double)e->elapsed_ms);
+    }
+    return v;
+}
+
+/* Add a finished run to the jobs history store (no-op without one). */
+static void result_store_job(const result_entry_t *e, const char *node, const char *requester) {
+    if (!strcmp(e->state, "started") || !strcmp(e->source, "event") ||
+        !strcmp(e->source, "heartbeat")) {
+        return;
+    }
+    jobs_record_t jr = {
+        .node = node, .source = e->source, .requester = requester, .path = e->path,
+        .spawned = strcmp(e->state, "failed") != 0 && strcmp(e->state, "refused") != 0,
+        .rc = e->rc,
+        .elapsed_ms = e->elapsed_ms, .finished_unix_ms = e->ts_unix_ms
+    };
+    jobs_store_record(&jr);
+}
+
+/* Append to the master store (renumbered with the store's own sequence) and
+ * announce it on /events. */
+static void store_append(const result_entry_t *src, const char *node) {
+    pthread_mutex_lock(&g_store_lock);
+    unsigned long long seq = g_store_next++;
+    result_entry_t *e = &g_store[seq % SYNC_RESULTS_STORE];
+    free(e->data);
+    *e = *src;
+    e->data = NULL;
+    result_set_data(e, src->data);
+    e->seq = seq;
+    strncpy(e->node, node, sizeof(e->node) - 1);
+    e->node[sizeof(e->node) - 1] = '\0';
+    JSON_Value *data = NULL;
+    if (!strcmp(src->source, "event")) {
+        /* A slave's own event, republished here under its original time. */
+        data = json_value_init_object();
+        JSON_Object *d = json_object(data);
+        json_object_set_string(d, "node", node);
+        json_object_set_string(d, "type", e->state);
+        json_object_set_number(d, "ts_unix_ms", (double)e->ts_unix_ms);
+        JSON_Value *payload = e->data ? json_parse_string(e->data) : NULL;
+        if (payload) json_object_set_value(d, "data", payload);
+    } else if (strcmp(src->source, "heartbeat") != 0) {
+        data = result_to_json(e, 1);
+    }
+    pthread_mutex_unlock(&g_store_lock);
+    if (data) (void)events_emit(!strcmp(src->source, "event") ? "node_event" : "node_result", data);
+
+    result_store_job(src, node, node);
+}
+
+/* ---------- Slave outbox persistence ---------- */
+
+static void result_from_json(result_entry_t *e, JSON_Object *r) {
+    memset(e, 0, sizeof(*e));
+    result_fill(e, json_object_get_string(r, "source"),
+                (int)json_object_get_number(r, "slot"),
+                json_object_get_string(r, "path"),
+                json_object_get_string(r, "state"),
+                (int)json_object_get_number(r, "rc"),
+                (long long)json_object_get_number(r, "elapsed_ms"));
+    e->seq = (unsigned long long)json_object_get_number(r, "seq");
+    long long ts = (long long)json_object_get_number(r, "ts_ms");
+    if (ts > 0) e->ts_ms = ts;
+    long long ts_unix = (long long)json_object_get_number(r, "ts_unix_ms");
+    if (ts_unix > 0) e->ts_unix_ms = ts_unix;
+    JSON_Value *dv = json_object_get_value(r, "data");
+    if (dv) {
+        char *s = json_serialize_to_string(dv);
+        result_set_data(e, s);
+        if (s) json_free_serialized_string(s);
+    }
+}
+
+static void outbox_drop_oldest_locked(void) {
+    free(g_outbox[g_outbox_first % SYNC_RESULTS_OUTBOX].data);
+    g_outbox[g_outbox_first % SYNC_RESULTS_OUTBOX].data = NULL;
+    g_outbox_first++;
+    g_outbox_dropped++;
+    g_outbox_dropped_total++;
+}
+
+/* Rewrite the outbox file (write to a temporary, then rename), dropping the
+ * oldest entries while it is larger than outbox_max_kb. */
+static void outbox_persist_locked(void) {
+    if (!g_outbox_path[0]) return;
+    char *s = NULL;
+    for (;;) {
+        JSON_Value *root = json_value_init_object();
+        JSON_Object *ro = json_object(root);
+        json_object_set_number(ro, "boot", (double)g_outbox_boot_ms);
+        json_object_set_number(ro, "next_seq", (double)g_outbox_next);
+        json_object_set_number(ro, "dropped", (double)g_outbox_dropped);
+        JSON_Value *arr_v = json_value_init_array();
+        for (unsigned long long seq = g_outbox_first; seq < g_outbox_next; seq++) {
+            json_array_append_value(json_array(arr_v), result_to_json(&g_outbox[seq % SYNC_RESULTS_OUTBOX], 0));
+        }
+        json_object_set_value(ro, "results", arr_v);
+        s = json_serialize_to_string(root);
+        json_value_free(root);
+        if (!s) return;
+        size_t len = strlen(s);
+        unsigned long long pending = g_outbox_next - g_outbox_first;
+        if (len <= g_outbox_max_bytes || pending == 0) break;
+        json_free_serialized_string(s);
+        s = NULL;
+        /* Drop roughly the excess, at least one entry per pass. */
+        unsigned long long drop = (unsigned long long)((len - g_outbox_max_bytes) / (len / pending)) + 1;
+        while (drop-- > 0 && g_outbox_first < g_outbox_next) outbox_drop_oldest_locked();
+    }
+
+    char tmp[300];
+    snprintf(tmp, sizeof(tmp), "%s.tmp", g_outbox_path);
+    FILE *f = fopen(tmp, "w");
+    int ok = f && fputs(s, f) >= 0;
+    if (f && fclose(f) != 0) ok = 0;
+    json_free_serialized_string(s);
+    if (!ok || rename(tmp, g_outbox_path) != 0) {
+        static int warned;
+        if (!warned) {
+            fprintf(stderr, "sync slave: cannot write outbox %s: %s\n", g_outbox_path, strerror(errno));
+            warned = 1;
+        }
+        unlink(tmp);
+    }
+}
+
+static void outbox_push_locked(result_entry_t *e) {
+    if (g_outbox_boot_ms == 0) g_outbox_boot_ms = now_ms();
+    if (g_outbox_next - g_outbox_first >= SYNC_RESULTS_OUTBOX) outbox_drop_oldest_locked();
+    e->seq = g_outbox_next++;
+    result_entry_t *slot = &g_outbox[e->seq % SYNC_RESULTS_OUTBOX];
+    free(slot->data);
+    *slot = *e;
+    outbox_persist_locked();
+}
+
+void sync_results_configure(const config_t *cfg) {
+    if (!cfg || strcasecmp(cfg->sync_role, "slave") != 0) return;
+    pthread_mutex_lock(&g_outbox_lock);
+    g_outbox_events = 1;
+    snprintf(g_outbox_path, sizeof(g_outbox_path), "%s", cfg->sync_outbox_path);
+    g_outbox_max_bytes = (size_t)cfg->sync_outbox_max_kb * 1024;
+    JSON_Value *root = g_outbox_path[0] ? json_parse_file(g_outbox_path) : NULL;
+    JSON_Object *ro = json_object(root);
+    JSON_Array *arr = json_object_get_array(ro, "results");
+    long long boot = (long long)json_object_get_number(ro, "boot");
+    if (boot > 0) {
+        /* Carry on the previous run's numbering so the master, which tracks
+         * sequence numbers per boot, accepts the entries exactly once. */
+        g_outbox_boot_ms = boot;
+        g_outbox_dropped = (unsigned long long)json_object_get_number(ro, "dropped");
+        unsigned long long next = (unsigned long long)json_object_get_number(ro, "next_seq");
+        g_outbox_first = g_outbox_next = next > 0 ? next : 1;
+        size_t n = arr ? json_array_get_count(arr) : 0;
+        size_t skip = n > SYNC_RESULTS_OUTBOX ? n - SYNC_RESULTS_OUTBOX : 0;
+        for (size_t i = skip; i < n; i++) {
+            result_entry_t e;
+            JSON_Object *r = json_array_get_object(arr, i);
+            if (!r) continue;
+            result_from_json(&e, r);
+            if (e.seq == 0 || e.seq >= g_outbox_next) {
+                free(e.data);
+                continue;
+            }
+            if (g_outbox_first == g_outbox_next || e.seq < g_outbox_first) g_outbox_first = e.seq;
+            g_outbox[e.seq % SYNC_RESULTS_OUTBOX] = e;
+        }
+        if (g_outbox_next - g_outbox_first > 0) {
+            fprintf(stderr, "sync slave: restored %llu queued result(s) from %s\n",
+                    g_outbox_next - g_outbox_first, g_outbox_path);
+        }
+    }
+    if (root) json_value_free(root);
+    pthread_mutex_unlock(&g_outbox_lock);
+}
+
+void sync_results_record(const config_t *cfg, const char *source, int slot,
+                         const char *path, const char *state, int rc,
+                         long long elapsed_ms) {
+    if (!cfg) return;
+    result_entry_t tmp;
+    memset(&tmp, 0, sizeof(tmp));
+    result_fill(&tmp, source, slot, path, state, rc, elapsed_ms);
+
+    if (strcasecmp(cfg->sync_role, "master") == 0) {
+        pthread_mutex_lock(&g_store_lock);
+        tmp.seq = ++g_local_seq;
+        pthread_mutex_unlock(&g_store_lock);
+        store_append(&tmp, cfg->sync_id);
+        return;
+    }
+    /* Other nodes keep their own runs in their own history as well. */
+    result_store_job(&tmp, cfg->sync_id, "local");
+    if (strcasecmp(cfg->sync_role, "slave") != 0) return;
+
+    pthread_mutex_lock(&g_outbox_lock);
+    outbox_push_locked(&tmp);
+    pthread_mutex_unlock(&g_outbox_lock);
+}
+
+void sync_results_record_event(const char *type, const char *data_json) {
+    pthread_mutex_lock(&g_outbox_lock);
+    if (g_outbox_events) {
+        result_entry_t tmp;
+        memset(&tmp, 0, sizeof(tmp));
+        result_fill(&tmp, "event", 0, "", type, 0, 0);
+        tmp.data = data_json ? strdup(data_json) : NULL;
+        outbox_push_locked(&tmp);
+    }
+    pthread_mutex_unlock(&g_outbox_lock);
+}
+
+void sync_results_heartbeat(const config_t *cfg, int slot) {
+    if (!cfg || cfg->sync_offline_heartbeat_s <= 0 ||
+        strcasecmp(cfg->sync_role, "slave") != 0) {
+        return;
+    }
+    pthread_mutex_lock(&g_outbox_lock);
+    long long now = now_ms();
+    if (g_outbox_last_heartbeat_ms == 0 ||
+        now - g_outbox_last_heartbeat_ms >= (long long)cfg->sync_offline_heartbeat_s * 1000) {
+        g_outbox_last_heartbeat_ms = now;
+        result_entry_t tmp;
+        memset(&tmp, 0, sizeof(tmp));
+        result_fill(&tmp, "heartbeat", slot, "", "offline", 0, 0);
+        outbox_push_locked(&tmp);
+    }
+    pthread_mutex_unlock(&g_outbox_lock);
+}
+
+/* Serialize up to SYNC_RESULTS_BATCH queued results; *last_out receives the
+ * last sequence number included. Returns NULL when there is nothing to send. */
+static char *outbox_build_batch(const config_t *cfg, unsigned long long *last_out) {
+    pthread_mutex_lock(&g_outbox_lock);
+    if (g_outbox_first >= g_outbox_next && g_outbox_dropped == 0) {
+        pthread_mutex_unlock(&g_outbox_lock);
+        return NULL;
+    }
+    JSON_Value *root = json_value_init_object();
+    JSON_Object *ro = json_object(root);
+    json_object_set_string(ro, "id", cfg->sync_id);
+    json_object_set_number(ro, "boot", (double)g_outbox_boot_ms);
+    if (g_outbox_dropped) json_object_set_number(ro, "dropped", (double)g_outbox_dropped);
+    JSON_Value *arr_v = json_value_init_array();
+    int n = 0;
+    *last_out = g_outbox_first - 1;
+    for (unsigned long long seq = g_outbox_first; seq < g_outbox_next && n < SYNC_RESULTS_BATCH; seq++, n++) {
+        json_array_append_value(json_array(arr_v), result_to_json(&g_outbox[seq % SYNC_RESULTS_OUTBOX], 0));
+        *last_out = seq;
+    }
+    json_object_set_value(ro, "results", arr_v);
+    pthread_mutex_unlock(&g_outbox_lock);
+
+    char *s = json_serialize_to_string(root);
+    json_value_free(root);
+    return s;
+}
+
+static int outbox_ack(unsigned long long ack_seq) {
+    pthread_mutex_lock(&g_outbox_lock);
+    int acked = 0;
+    if (ack_seq >= g_outbox_next) ack_seq = g_outbox_next - 1;
+    if (ack_seq >= g_outbox_first) {
+        acked = (int)(ack_seq - g_outbox_first + 1);
+        for (; g_outbox_first <= ack_seq; g_outbox_first++) {
+            result_entry_t *e = &g_outbox[g_outbox_first % SYNC_RESULTS_OUTBOX];
+            free(e->data);
+            e->data = NULL;
+        }
+    }
+    g_outbox_dropped = 0;
+    g_outbox_last_ack_ms = now_ms();
+    g_outbox_last_heartbeat_ms = 0;
+    outbox_persist_locked();
+    pthread_mutex_unlock(&g_outbox_lock);
+    return acked;
+}
+
+int sync_results_flush(const config_t *cfg, const http_url_t *target) {
+    if (!cfg) return -1;
+    http_url_t url;
+    if (target) {
+        url = *target;
+        strncpy(url.path, AUTOD_PEER_PREFIX "/sync/results", sizeof(url.path) - 1);
+        url.path[sizeof(url.path) - 1] = '\0';
+    }
+    int total = 0;
+    int timeout_ms = 5000;
+    for (int round = 0; round < 8; round++) {
+        unsigned long long ack = 0;
+        char *body = outbox_build_batch(cfg, &ack);
+        if (!body) break;
+
+        if (!target) {
+            /* MQTT is fire-and-forget at QoS 0: a successful publish counts
+             * as delivered. */
+            int r = sync_mqtt_slave_publish(cfg, "results", body);
+            json_free_serialized_string(body);
+            if (r != 0) return total > 0 ? total : -1;
+        } else {
+            char *resp_body = NULL;
+            int status = httpc_post_json(&url, body, &resp_body, NULL, timeout_ms);
+            json_free_serialized_string(body);
+            JSON_Value *resp = (status == 200 && resp_body) ? json_parse_string(resp_body) : NULL;
+            free(resp_body);
+            if (!resp) return total > 0 ? total : -1;
+            ack = (unsigned long long)json_object_get_number(json_object(resp), "ack_seq");
+            json_value_free(resp);
+        }
+        int acked = outbox_ack(ack);
+        total += acked;
+        if (acked == 0) break;
+    }
+    return total;
+}
+
+static node_cursor_t *cursor_for_locked(const char *node) {
+    node_cursor_t *free_slot = NULL, *oldest = NULL;
+    for (int i = 0; i < SYNC_RESULTS_MAX_NODES; i++) {
+        node_cursor_t *cur = &g_cursors[i];
+        if (cur->node[0] && strcmp(cur->node, node) == 0) return cur;
+        if (!cur->node[0] && !free_slot) free_slot = cur;
+        if (cur->node[0] && (!oldest || cur->updated_ms < oldest->updated_ms)) oldest = cur;
+    }
+    node_cursor_t *cur = free_slot ? free_slot : oldest;
+    memset(cur, 0, sizeof(*cur));
+    strncpy(cur->node, node, sizeof(cur->node) - 1);
+    return cur;
+}
+
+unsigned long long sync_results_ingest(const char *node, JSON_Object *batch) {
+    if (!node || !*node || !batch) return 0;
+    long long boot = (long long)json_object_get_number(batch, "boot");
+    unsigned long long dropped = (unsigned long long)json_object_get_number(batch, "dropped");
+    JSON_Array *arr = json_object_get_array(batch, "results");
+
+    pthread_mutex_lock(&g_store_lock);
+    node_cursor_t *cur = cursor_for_locked(node);
+    if (cur->boot != boot) {
+        /* The node restarted and numbers its results from 1 again. */
+        cur->boot = boot;
+        cur->last_seq = 0;
+    }
+    cur->dropped += dropped;
+    cur->updated_ms = now_ms();
+    unsigned long long last_seq = cur->last_seq;
+    pthread_mutex_unlock(&g_store_lock);
+
+    if (dropped) {
+        fprintf(stderr, "sync master: node %s dropped %llu queued result(s)\n", node, dropped);
+    }
+
+    size_t n = arr ? json_array_get_count(arr) : 0;
+    for (size_t i = 0; i < n; i++) {
+        JSON_Object *r = json_array_get_object(arr, i);
+        if (!r) continue;
+        unsigned long long seq = (unsigned long long)json_object_get_number(r, "seq");
+        if (seq == 0 || seq <= last_seq) continue;
+        result_entry_t e;
+        result_from_json(&e, r);
+        store_append(&e, node);
+        free(e.data);
+        last_seq = seq;
+    }
+
+    pthread_mutex_lock(&g_store_lock);
+    if (cur->boot == boot && strcmp(cur->node, node) == 0 && last_seq > cur->last_seq) {
+        cur->last_seq = last_seq;
+    }
+    pthread_mutex_unlock(&g_store_lock);
+    return last_seq;
+}
+
+/* ---------- HTTP ---------- */
+
+static int h_sync_results_post(struct mg_connection *c) {
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        if (u.body) free(u.body);
+        send_plain(c, 400, "body_read_failed", 1);
+        return 1;
+    }
+    JSON_Value *root = json_parse_string(u.body ? u.body : "");
+    free(u.body);
+    JSON_Object *obj = root ? json_object(root) : NULL;
+    const char *id = obj ? json_object_get_string(obj, "id") : NULL;
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    if (!id || !*id) {
+        json_object_set_string(ro, "error", root ? "missing_id" : "bad_json");
+        send_json(c, resp, 400, 1);
+    } else {
+        unsigned long long ack = sync_results_ingest(id, obj);
+        json_object_set_number(ro, "ack_seq", (double)ack);
+        send_json(c, resp, 200, 1);
+    }
+    json_value_free(resp);
+    if (root) json_value_free(root);
+    return 1;
+}
+
+static int h_sync_results_list(struct mg_connection *c, const struct mg_request_info *ri) {
+    unsigned long long since = 0;
+    int limit = 100;
+    char node[64] = "", state[16] = "";
+    const char *qs = ri->query_string;
+    if (qs) {
+        char buf[32];
+        size_t qlen = strlen(qs);
+        if (mg_get_var(qs, qlen, "since", buf, sizeof(buf)) > 0) since = strtoull(buf, NULL, 10);
+        if (mg_get_var(qs, qlen, "limit", buf, sizeof(buf)) > 0) limit = atoi(buf);
+        if (mg_get_var(qs, qlen, "node", node, sizeof(node)) <= 0) node[0] = '\0';
+        if (mg_get_var(qs, qlen, "state", state, sizeof(state)) <= 0) state[0] = '\0';
+    }
+    if (limit <= 0 || limit > SYNC_RESULTS_STORE) limit = SYNC_RESULTS_STORE;
+
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    JSON_Value *arr_v = json_value_init_array();
+    JSON_Value *nodes_v = json_value_init_object();
+
+    pthread_mutex_lock(&g_store_lock);
+    unsigned long long last = g_store_next - 1;
+    unsigned long long oldest = last >= SYNC_RESULTS_STORE ? last - SYNC_RESULTS_STORE + 1 : 1;
+    unsigned long long start = since + 1 < oldest ? oldest : since + 1;
+    int added = 0;
+    for (unsigned long long seq = start; seq <= last && added < limit; seq++) {
+        const result_entry_t *e = &g_store[seq % SYNC_RESULTS_STORE];
+        if (e->seq != seq) continue;
+        if (node[0] && strcmp(node, e->node) != 0) continue;
+        if (state[0] && strcmp(state, e->state) != 0) continue;
+        json_array_append_value(json_array(arr_v), result_to_json(e, 1));
+        added++;
+    }
+    for (int i = 0; i < SYNC_RESULTS_MAX_NODES; i++) {
+        const node_cursor_t *cur = &g_cursors[i];
+        if (!cur->node[0]) continue;
+        JSON_Value *nv = json_value_init_object();
+        json_object_set_number(json_object(nv), "acked_seq", (double)cur->last_seq);
+        json_object_set_number(json_object(nv), "dropped", (double)cur->dropped);
+        json_object_set_number(json_object(nv), "updated_ms", (double)cur->updated_ms);
+        json_object_set_value(json_object(nodes_v), cur->node, nv);
+    }
+    pthread_mutex_unlock(&g_store_lock);
+
+    json_object_set_value(ro, "results", arr_v);
+    json_object_set_number(ro, "last_seq", (double)last);
+    json_object_set_value(ro, "nodes", nodes_v);
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+    return 1;
+}
+
+static int h_sync_results_outbox(struct mg_connection *c) {
+    JSON_Value *resp = json_value_init_object();
+    JSON_Object *ro = json_object(resp);
+    JSON_Value *arr_v = json_value_init_array();
+    pthread_mutex_lock(&g_outbox_lock);
+    for (unsigned long long seq = g_outbox_first; seq < g_outbox_next; seq++) {
+        json_array_append_value(json_array(arr_v), result_to_json(&g_outbox[seq % SYNC_RESULTS_OUTBOX], 0));
+    }
+    json_object_set_number(ro, "pending", (double)(g_outbox_next - g_outbox_first));
+    json_object_set_number(ro, "dropped_total", (double)g_outbox_dropped_total);
+    json_object_set_number(ro, "last_ack_ms", (double)g_outbox_last_ack_ms);
+    pthread_mutex_unlock(&g_outbox_lock);
+    json_object_set_value(ro, "results", arr_v);
+    send_json(c, resp, 200, 1);
+    json_value_free(resp);
+    return 1;
+}
+
+static int h_sync_results(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri) {
+        free(cfg);
+        return 0;
+    }
+    int is_master = strcasecmp(cfg->sync_role, "master") == 0;
+    int is_slave = strcasecmp(cfg->sync_role, "slave") == 0;
+    if (!is_master && !is_slave) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    if (strcmp(ri->request_method, "POST") == 0 && is_master) {
+        free(cfg);
+        return h_sync_results_post(c);
+    }
+    if (strcmp(ri->request_method, "GET") == 0) {
+        free(cfg);
+        return is_master ? h_sync_results_list(c, ri) : h_sync_results_outbox(c);
+    }
+    send_plain(c, 405, "method_not_allowed", 1);
+    free(cfg);
+    return 1;
+}
+
+void sync_results_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    api_set_handler(ctx, "/sync/results", h_sync_results, app);
+}
@@ -0,0 +1,54 @@
+#ifndef AUTOD_SYNC_RESULTS_H
+#define AUTOD_SYNC_RESULTS_H
+
+#include "parson.h"
+#include "httpc.h"
+
+/*
+ * Results of work a node starts on its own (slot commands, startup execs).
+ * Slaves queue status transitions in a bounded outbox and stream them to the
+ * master in batches (POST /sync/results, or <prefix>/node/<id>/results over
+ * MQTT); entries stay queued until the master acknowledges them, so results
+ * produced while the master is unreachable are delivered later. When the
+ * outbox overflows the oldest entries are dropped and counted. Slaves also
+ * queue their own events and heartbeats missed while offline, and can keep
+ * the outbox on disk across restarts.
+ */
+
+#define SYNC_RESULTS_OUTBOX 256
+#define SYNC_RESULTS_BATCH 32
+#define SYNC_RESULTS_STORE 512
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_context;
+
+/* Record one status transition ("started", "finished", "failed"). On a
+ * master it goes straight into the local store; on a slave into the outbox. */
+void sync_results_record(const config_t *cfg, const char *source, int slot,
+                         const char *path, const char *state, int rc,
+                         long long elapsed_ms);
+
+/* Slave: queue local events as well and keep the outbox in [sync] outbox_path,
+ * restoring what a previous run left there (called once at startup). */
+void sync_results_configure(const config_t *cfg);
+
+/* Slave: queue one event emitted on this node. No-op elsewhere. */
+void sync_results_record_event(const char *type, const char *data_json);
+
+/* Slave: note a missed heartbeat while the master is unreachable, at most
+ * once per [sync] offline_heartbeat_s. */
+void sync_results_heartbeat(const config_t *cfg, int slot);
+
+/* Slave: send queued results. target is the registration URL (its path is
+ * replaced) or NULL to publish over the MQTT transport. Returns the number of
+ * results acknowledged or -1 when the master could not be reached. */
+int sync_results_flush(const config_t *cfg, const http_url_t *target);
+
+/* Master: store a batch received from node. Returns the highest sequence
+ * number accepted from that node (the ack). */
+unsigned long long sync_results_ingest(const char *node, JSON_Object *batch);
+
+void sync_results_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
@@ -0,0 +1,569 @@
+#define _GNU_SOURCE
+#include <stdio.h>
+#include <stdlib.h>
+#include <stdint.h>
+#include <string.h>
+#include <strings.h>
+#include <errno.h>
+#include <time.h>
+#include <unistd.h>
+#include <pthread.h>
+#include <netdb.h>
+#include <sys/reboot.h>
+#include <sys/socket.h>
+#include <sys/time.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "confirm.h"
+#include "dnscache.h"
+#include "events.h"
+#include "httpc.h"
+#include "sync.h"
+#include "system.h"
+#include "version.h"
+
+#define SYSTEM_DEFAULT_DELAY_S 5
+#define SYSTEM_MAX_DELAY_S 3600
+#define SYSTEM_PROXY_TIMEOUT_MS 5000
+#define SYSTEM_SNTP_TIMEOUT_MS 2000
+#define SYSTEM_NTP_EPOCH_OFFSET 2208988800LL   /* 1900-01-01 to 1970-01-01 */
+
+/* The one reboot or shutdown waiting out its delay. */
+static pthread_mutex_t g_system_lock = PTHREAD_MUTEX_INITIALIZER;
+static pthread_cond_t g_system_cond;          /* CLOCK_MONOTONIC, see register */
+static char g_system_pending[16];
+static long long g_system_due_ms;              /* now_ms() deadline */
+static long long g_system_due_unix_ms;         /* the same, for display */
+static unsigned g_system_generation;
+
+void system_cfg_defaults(config_t *cfg) {
+    if (!cfg) return;
+    memset(&cfg->system, 0, sizeof(cfg->system));
+    cfg->system.reboot = 1;
+    cfg->system.shutdown = 1;
+    cfg->system.sync_time = 1;
+    cfg->system.default_delay_s = SYSTEM_DEFAULT_DELAY_S;
+}
+
+int system_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value) {
+    if (!cfg || !section || !key || !value) return 0;
+    if (strcmp(section, "system") != 0) return 0;
+    system_config_t *s = &cfg->system;
+    if (!strcmp(key, "actions")) {
+        s->reboot = s->shutdown = s->sync_time = 0;
+        char buf[128];
+        strncpy(buf, value, sizeof(buf) - 1);
+        buf[sizeof(buf) - 1] = '\0';
+        char *save = NULL;
+        for (char *tok = strtok_r(buf, ", \t", &save); tok; tok = strtok_r(NULL, ", \t", &save)) {
+            if (!strcmp(tok, "reboot")) s->reboot = 1;
+            else if (!strcmp(tok, "shutdown")) s->shutdown = 1;
+            else if (!strcmp(tok, "sync-time")) s->sync_time = 1;
+            else if (strcmp(tok, "none") != 0)
+                fprintf(stderr, "WARN: system: ignoring unknown action '%s'\n", tok);
+        }
+    } else if (!strcmp(key, "default_delay_s")) {
+        char *end = NULL;
+        long v = strtol(value, &end, 10);
+        if (!end || *end || v < 0 || v > SYSTEM_MAX_DELAY_S) {
+            fprintf(stderr, "WARN: system: ignoring default_delay_s '%s' (0-%d)\n",
+                    value, SYSTEM_MAX_DELAY_S);
+        } else {
+            s->default_delay_s = (int)v;
+        }
+    } else if (!strcmp(key, "ntp_server")) {
+        if (strlen(value) >= sizeof(s->ntp_server)) {
+            fprintf(stderr, "WARN: system: ignoring ntp_server '%s' (too long)\n", value);
+        } else {
+            strcpy(s->ntp_server, value);
+        }
+    } else {
+        fprintf(stderr, "WARN: system: ignoring unknown key '%s'\n", key);
+    }
+    return 1;
+}
+
+static long long system_unix_ms(void) {
+    struct timespec ts;
+    clock_gettime(CLOCK_REALTIME, &ts);
+    return (long long)ts.tv_sec * 1000 + ts.tv_nsec / 1000000;
+}
+
+static int system_action_enabled(const config_t *cfg, const char *action) {
+    if (!strcmp(action, "reboot")) return cfg->system.reboot;
+    if (!strcmp(action, "shutdown")) return cfg->system.shutdown;
+    if (!strcmp(action, "sync-time")) return cfg->system.sync_time;
+    return 0;
+}
+
+static void system_emit(const char *action, const char *status, int delay_s,
+                        const char *remote_ip) {
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_string(eo, "action", action);
+    json_object_set_string(eo, "status", status);
+    json_object_set_number(eo, "delay_s", delay_s);
+    json_object_set_string(eo, "remote_ip", remote_ip ? remote_ip : "");
+    (void)events_emit("system_action", ev);
+}
+
+/* ---------- Reboot / shutdown ---------- */
+
+static void *system_action_main(void *arg) {
+    unsigned generation = (unsigned)(uintptr_t)arg;
+    char action[16];
+    pthread_mutex_lock(&g_system_lock);
+    while (g_system_generation == generation && g_system_pending[0]) {
+        /* Timed against the monotonic clock so a sync-time jump cannot fire
+         * (or postpone) the action. */
+        long long due = g_system_due_ms;
+        if (now_ms() >= due) break;
+        struct timespec until = { .tv_sec = due / 1000, .tv_nsec = (due % 1000) * 1000000 };
+        pthread_cond_timedwait(&g_system_cond, &g_system_lock, &until);
+    }
+    if (g_system_generation != generation || !g_system_pending[0]) {
+        pthread_mutex_unlock(&g_system_lock);
+        return NULL;
+    }
+    strcpy(action, g_system_pending);
+    pthread_mutex_unlock(&g_system_lock);
+
+    int shutdown = !strcmp(action, "shutdown");
+    fprintf(stderr, "system: %s now\n", action);
+    sync();
+    if (reboot(shutdown ? RB_POWER_OFF : RB_AUTOBOOT) != 0) {
+        int err = errno;
+        fprintf(stderr, "system: %s failed: %s\n", action, strerror(err));
+        pthread_mutex_lock(&g_system_lock);
+        if (g_system_generation == generation) g_system_pending[0] = '\0';
+        pthread_mutex_unlock(&g_system_lock);
+        system_emit(action, "failed", 0, NULL);
+    }
+    return NULL;
+}
+
+/* Schedule action after delay_s. Returns 0, or -1 when one is already pending
+ * (or the timer thread cannot start). */
+static int system_schedule(const char *action, int delay_s, long long *due_out) {
+    pthread_mutex_lock(&g_system_lock);
+    if (g_system_pending[0]) {
+        pthread_mutex_unlock(&g_system_lock);
+        return -1;
+    }
+    strncpy(g_system_pending, action, sizeof(g_system_pending) - 1);
+    g_system_due_ms = now_ms() + (long long)delay_s * 1000;
+    g_system_due_unix_ms = system_unix_ms() + (long long)delay_s * 1000;
+    unsigned generation = ++g_system_generation;
+    *due_out = g_system_due_unix_ms;
+    pthread_mutex_unlock(&g_system_lock);
+
+    pthread_t th;
+    if (pthread_create(&th, NULL, system_action_main, (void *)(uintptr_t)generation) != 0) {
+        pthread_mutex_lock(&g_system_lock);
+        g_system_pending[0] = '\0';
+        pthread_mutex_unlock(&g_system_lock);
+        return -1;
+    }
+    pthread_detach(th);
+    return 0;
+}
+
+static void system_handle_power(struct mg_connection *c, app_t *app, const config_t *cfg,
+                                const char *action, JSON_Object *body) {
+    int delay_s = cfg->system.default_delay_s;
+    JSON_Value *dv = json_object_get_value(body, "delay_s");
+    if (dv) {
+        double d = json_value_get_number(dv);
+        if (json_value_get_type(dv) != JSONNumber || d < 0 || d > SYSTEM_MAX_DELAY_S ||
+            d != (int)d) {
+            send_json_error(c, 400, "invalid_delay");
+            return;
+        }
+        delay_s = (int)d;
+    }
+
+    pthread_mutex_lock(&g_system_lock);
+    int busy = g_system_pending[0] != '\0';
+    pthread_mutex_unlock(&g_system_lock);
+    if (busy) {
+        send_json_error(c, 409, "action_pending");
+        return;
+    }
+
+    JSON_Value *req = json_value_init_object();
+    json_object_set_string(json_object(req), "action", action);
+    json_object_set_number(json_object(req), "delay_s", delay_s);
+    int sent = confirm_gate(c, cfg, body, req, json_value_deep_copy(req));
+    json_value_free(req);
+    if (sent) return;
+
+    /* A blackout window refuses the action or, for a queue window, pushes it
+     * back until the window lifts. */
+    char bpath[32];
+    snprintf(bpath, sizeof(bpath), "/system/%s", action);
+    long long ends = 0;
+    const blackout_window_t *w = blackout_check(app, cfg, bpath, &ends);
+    int held_s = 0;
+    if (w) {
+        int ov = blackout_override(c, cfg, body, bpath, w);
+        if (ov < 0) return;
+        if (!ov) {
+            if (w->action != BLACKOUT_QUEUE || ends <= 0) {
+                blackout_send_blocked(c, w, bpath, ends);
+                return;
+            }
+            long long left = ends - (long long)time(NULL);
+            held_s = left > 0 ? (int)left : 0;
+        }
+    }
+
+    long long due = 0;
+    if (system_schedule(action, delay_s + held_s, &due) != 0) {
+        send_json_error(c, 409, "action_pending");
+        return;
+    }
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    fprintf(stderr, "system: %s scheduled in %ds by %s (request %s)\n", action, delay_s + held_s,
+            ri ? ri->remote_addr : "?", api_request_id());
+    system_emit(action, "scheduled", delay_s + held_s, ri ? ri->remote_addr : NULL);
+    if (held_s) blackout_emit(bpath, w->name, "queued", ri ? ri->remote_addr : NULL, 0);
+
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "status", "scheduled");
+    json_object_set_string(o, "action", action);
+    json_object_set_number(o, "delay_s", delay_s + held_s);
+    json_object_set_number(o, "due_unix_ms", (double)due);
+    if (held_s) json_object_set_string(o, "blackout", w->name);
+    send_json(c, v, 202, 1);
+    json_value_free(v);
+}
+
+static void system_handle_cancel(struct mg_connection *c) {
+    char action[16] = "";
+    pthread_mutex_lock(&g_system_lock);
+    if (g_system_pending[0]) {
+        strcpy(action, g_system_pending);
+        g_system_pending[0] = '\0';
+        g_system_generation++;
+        pthread_cond_broadcast(&g_system_cond);
+    }
+    pthread_mutex_unlock(&g_system_lock);
+    if (!action[0]) {
+        send_json_error(c, 404, "nothing_pending");
+        return;
+    }
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    fprintf(stderr, "system: %s cancelled\n", action);
+    system_emit(action, "cancelled", 0, ri ? ri->remote_addr : NULL);
+
+    JSON_Value *v = json_value_init_object();
+    json_object_set_string(json_object(v), "status", "cancelled");
+    json_object_set_string(json_object(v), "action", action);
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+}
+
+/* ---------- Time ---------- */
+
+/* One SNTP exchange with server (host or host:port). On success stores the
+ * server's clock, corrected by half the round trip, in *unix_ms. */
+static int system_sntp_query(const char *server, long long *unix_ms) {
+    char host[128];
+    const char *port = "123";
+    strncpy(host, server, sizeof(host) - 1);
+    host[sizeof(host) - 1] = '\0';
+    char *colon = strrchr(host, ':');
+    if (colon && !strchr(colon + 1, ']') && strchr(host, ':') == colon) {
+        *colon = '\0';
+        port = colon + 1;
+    }
+
+    struct addrinfo hints = { .ai_family = AF_UNSPEC, .ai_socktype = SOCK_DGRAM };
+    struct addrinfo *res = NULL;
+    if (getaddrinfo(host, port, &hints, &res) != 0 || !res) return -1;
+    int fd = socket(res->ai_family, res->ai_socktype, res->ai_protocol);
+    if (fd < 0) {
+        freeaddrinfo(res);
+        return -1;
+    }
+    struct timeval tv = { SYSTEM_SNTP_TIMEOUT_MS / 1000, (SYSTEM_SNTP_TIMEOUT_MS % 1000) * 1000 };
+    setsockopt(fd, SOL_SOCKET, SO_RCVTIMEO, &tv, sizeof(tv));
+
+    unsigned char pkt[48] = { 0x23 };   /* LI 0, version 4, mode 3 (client) */
+    long long sent_ms = now_ms();
+    int rc = -1;
+    if (sendto(fd, pkt, sizeof(pkt), 0, res->ai_addr, res->ai_addrlen) == (ssize_t)sizeof(pkt)) {
+        ssize_t n = recv(fd, pkt, sizeof(pkt), 0);
+        long long rtt = now_ms() - sent_ms;
+        int mode = pkt[0] & 0x7;
+        int stratum = pkt[1];
+        if (n == (ssize_t)sizeof(pkt) && mode == 4 && stratum > 0 && stratum < 16) {
+            unsigned long long secs = ((unsigned long long)pkt[40] << 24) | ((unsigned long long)pkt[41] << 16) |
+                                      ((unsigned long long)pkt[42] << 8) | pkt[43];
+            unsigned long long frac = ((unsigned long long)pkt[44] << 24) | ((unsigned long long)pkt[45] << 16) |
+                                      ((unsigned long long)pkt[46] << 8) | pkt[47];
+            if (secs > (unsigned long long)SYSTEM_NTP_EPOCH_OFFSET) {
+                *unix_ms = ((long long)secs - SYSTEM_NTP_EPOCH_OFFSET) * 1000 +
+                           (long long)((frac * 1000) >> 32) + rtt / 2;
+                rc = 0;
+            }
+        }
+    }
+    close(fd);
+    freeaddrinfo(res);
+    return rc;
+}
+
+static void system_handle_sync_time(struct mg_connection *c, const config_t *cfg,
+                                    JSON_Object *body) {
+    long long target = 0;
+    const char *source = "request";
+    JSON_Value *tv = json_object_get_value(body, "unix_ms");
+    if (tv) {
+        double d = json_value_get_number(tv);
+        if (json_value_get_type(tv) != JSONNumber || d <= 0) {
+            send_json_error(c, 400, "invalid_time");
+            return;
+        }
+        target = (long long)d;
+    } else if (cfg->system.ntp_server[0]) {
+        if (system_sntp_query(cfg->system.ntp_server, &target) != 0) {
+            send_json_error(c, 502, "ntp_unreachable");
+            return;
+        }
+        source = "ntp";
+    } else {
+        send_json_error(c, 400, "missing_time");
+        return;
+    }
+
+    long long before = system_unix_ms();
+    struct timespec ts = { .tv_sec = target / 1000, .tv_nsec = (target % 1000) * 1000000 };
+    if (clock_settime(CLOCK_REALTIME, &ts) != 0) {
+        int err = errno;
+        fprintf(stderr, "system: sync-time failed: %s\n", strerror(err));
+        send_json_error(c, err == EPERM ? 403 : 500, err == EPERM ? "permission_denied" : "set_time_failed");
+        return;
+    }
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    fprintf(stderr, "system: clock set from %s (offset %lld ms)\n", source, target - before);
+    system_emit("sync-time", "done", 0, ri ? ri->remote_addr : NULL);
+
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "status", "done");
+    json_object_set_string(o, "action", "sync-time");
+    json_object_set_string(o, "source", source);
+    json_object_set_number(o, "previous_unix_ms", (double)before);
+    json_object_set_number(o, "unix_ms", (double)target);
+    json_object_set_number(o, "offset_ms", (double)(target - before));
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+}
+
+/* ---------- Master dispatch ---------- */
+
+/* Forward a /system action to a registered slave and relay its reply, so the
+ * confirmation round trip happens against the node that will act. */
+static void system_proxy(struct mg_connection *c, app_t *app, const config_t *cfg,
+                         const char *node, const char *action, JSON_Value *body) {
+    sync_node_addr_t *nodes = calloc(SYNC_MAX_SLAVES, sizeof(*nodes));
+    int count = nodes ? sync_master_list_nodes(app, cfg, nodes, SYNC_MAX_SLAVES) : 0;
+    sync_node_addr_t target;
+    int found = 0;
+    for (int i = 0; i < count; i++) {
+        if (!strcmp(nodes[i].id, node)) {
+            target = nodes[i];
+            found = 1;
+            break;
+        }
+    }
+    free(nodes);
+    if (!found) {
+        send_json_error(c, 404, "unknown_node");
+        return;
+    }
+    if (strcmp(target.transport, "http") != 0) {
+        send_json_error(c, 409, "unsupported_transport");
+        return;
+    }
+    JSON_Value *conflict = sync_master_version_conflict(app, node);
+    if (conflict) {
+        send_json(c, conflict, 409, 1);
+        json_value_free(conflict);
+        return;
+    }
+    http_url_t url;
+    memset(&url, 0, sizeof(url));
+    if (!target.host[0] ||
+        dnscache_resolve(target.host, cfg->sync_dns_ttl_s, url.host, sizeof(url.host)) != 0) {
+        send_json_error(c, 502, "node_unreachable");
+        return;
+    }
+    url.port = target.port;
+    snprintf(url.path, sizeof(url.path), AUTOD_PEER_PREFIX "/system/%s", action);
+
+    JSON_Object *o = json_object(body);
+    json_object_remove(o, "node");
+    const char *hdr = mg_get_header(c, "X-Confirm-Token");
+    if (hdr && *hdr && !json_object_has_value(o, "confirm_token")) {
+        json_object_set_string(o, "confirm_token", hdr);
+    }
+    /* Without an explicit time the node takes the master's clock. */
+    if (!strcmp(action, "sync-time") && !json_object_has_value(o, "unix_ms")) {
+        json_object_set_number(o, "unix_ms", (double)system_unix_ms());
+    }
+    char *payload = json_serialize_to_string(body);
+    char *resp = NULL;
+    size_t resp_len = 0;
+    int status = payload ? httpc_post_json(&url, payload, &resp, &resp_len,
+                                           SYSTEM_PROXY_TIMEOUT_MS) : -1;
+    if (payload) json_free_serialized_string(payload);
+    JSON_Value *rv = (status > 0 && resp) ? json_parse_string(resp) : NULL;
+    free(resp);
+    if (!rv) {
+        send_json_error(c, 502, "node_unreachable");
+        return;
+    }
+    json_object_set_string(json_object(rv), "node", node);
+    send_json(c, rv, status, 1);
+    json_value_free(rv);
+}
+
+/* ---------- HTTP ---------- */
+
+static void system_send_status(struct mg_connection *c, const config_t *cfg) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    JSON_Value *av = json_value_init_array();
+    static const char *actions[] = { "reboot", "shutdown", "sync-time" };
+    for (size_t i = 0; i < sizeof(actions) / sizeof(actions[0]); i++) {
+        if (system_action_enabled(cfg, actions[i])) {
+            json_array_append_string(json_array(av), actions[i]);
+        }
+    }
+    json_object_set_value(o, "actions", av);
+    pthread_mutex_lock(&g_system_lock);
+    if (g_system_pending[0]) {
+        JSON_Value *pv = json_value_init_object();
+        json_object_set_string(json_object(pv), "action", g_system_pending);
+        json_object_set_number(json_object(pv), "due_unix_ms", (double)g_system_due_unix_ms);
+        json_object_set_value(o, "pending", pv);
+    } else {
+        json_object_set_null(o, "pending");
+    }
+    pthread_mutex_unlock(&g_system_lock);
+    json_object_set_number(o, "unix_ms", (double)system_unix_ms());
+    json_object_set_string(o, "ntp_server", cfg->system.ntp_server);
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+}
+
+/*
+ * GET  /system            — enabled actions, the pending one, the clock
+ * POST /system/reboot     — {delay_s, confirm_token, node}
+ * POST /system/shutdown   — same as reboot
+ * POST /system/sync-time  — {unix_ms, node}; without unix_ms from ntp_server
+ * POST /system/cancel     — drop a pending reboot or shutdown
+ * On a master, node selects a registered slave the request is relayed to.
+ */
+static int h_system(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri) {
+        free(cfg);
+        return 0;
+    }
+    const char *uri = api_local_uri(c);
+
+    if (!strcmp(uri, "/system") || !strcmp(uri, "/system/")) {
+        if (strcmp(ri->request_method, "GET") != 0) {
+            send_plain(c, 405, "method_not_allowed", 1);
+            free(cfg);
+            return 1;
+        }
+        system_send_status(c, cfg);
+        free(cfg);
+        return 1;
+    }
+    if (strncmp(uri, "/system/", 8) != 0) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    const char *action = uri + 8;
+    if (strcmp(action, "reboot") != 0 && strcmp(action, "shutdown") != 0 &&
+        strcmp(action, "sync-time") != 0 && strcmp(action, "cancel") != 0) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    if (strcmp(ri->request_method, "POST") != 0) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        free(u.body);
+        send_json_error(c, 400, "body_read_failed");
+        free(cfg);
+        return 1;
+    }
+    JSON_Value *root = u.len ? json_parse_string(u.body) : json_value_init_object();
+    free(u.body);
+    if (!root || json_value_get_type(root) != JSONObject) {
+        if (root) json_value_free(root);
+        send_json_error(c, 400, "bad_json");
+        free(cfg);
+        return 1;
+    }
+    JSON_Object *o = json_object(root);
+
+    const char *node = json_object_get_string(o, "node");
+    if (node && *node && strcmp(node, cfg->sync_id) != 0) {
+        if (strcasecmp(cfg->sync_role, "master") != 0) {
+            send_json_error(c, 404, "unknown_node");
+        } else {
+            char id[64];
+            snprintf(id, sizeof(id), "%s", node);
+            system_proxy(c, app, cfg, id, action, root);
+        }
+        json_value_free(root);
+        free(cfg);
+        return 1;
+    }
+
+    if (!strcmp(action, "cancel")) {
+        system_handle_cancel(c);
+    } else if (!system_action_enabled(cfg, action)) {
+        send_json_error(c, 403, "action_disabled");
+    } else if (!strcmp(action, "sync-time")) {
+        system_handle_sync_time(c, cfg, o);
+    } else {
+        system_handle_power(c, app, cfg, action, o);
+    }
+    json_value_free(root);
+    free(cfg);
+    return 1;
+}
+
+void system_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    pthread_condattr_t attr;
+    pthread_condattr_init(&attr);
+    pthread_condattr_setclock(&attr, CLOCK_MONOTONIC);
+    pthread_cond_init(&g_system_cond, &attr);
+    pthread_condattr_destroy(&attr);
+    api_set_handler(ctx, "/system", h_system, app);
+}
@@ -0,0 +1,24 @@
+#ifndef AUTOD_SYSTEM_H
+#define AUTOD_SYSTEM_H
+
+/* [system] — built-in device actions (POST /system/reboot, /system/shutdown,
+ * /system/sync-time) so they do not depend on each image's handler script.
+ * Reboot and shutdown need a confirmation token and run after delay_s. */
+typedef struct {
+    int  reboot;                  /* actions this node accepts */
+    int  shutdown;
+    int  sync_time;
+    int  default_delay_s;
+    char ntp_server[128];         /* sync-time source when no time is given */
+} system_config_t;
+
+typedef struct config config_t;
+typedef struct app app_t;
+struct mg_context;
+
+void system_cfg_defaults(config_t *cfg);
+int system_cfg_parse(config_t *cfg, const char *section, const char *key, const char *value);
+
+void system_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
@@ -0,0 +1,50 @@
+#include <stdio.h>
+
+#include "parson.h"
+#include "version.h"
+
+#if defined(__VERSION__)
+#if defined(__clang__)
+#define VERSION_COMPILER "clang " __VERSION__
+#else
+#define VERSION_COMPILER "gcc " __VERSION__
+#endif
+#else
+#define VERSION_COMPILER "unknown"
+#endif
+
+/* Optional features compiled in; NULL-terminated. */
+static const char *const g_build_tags[] = {
+#ifdef AUTOD_ZLIB
+    "zlib",
+#endif
+#ifdef AUTOD_DEBUG
+    "debug",
+#endif
+    NULL
+};
+
+void version_build_info(JSON_Object *o) {
+    if (!o) return;
+    json_object_set_string(o, "autod_version", AUTOD_VERSION);
+    json_object_set_string(o, "commit", AUTOD_COMMIT);
+    json_object_set_string(o, "target", AUTOD_TARGET);
+    json_object_set_string(o, "compiler", VERSION_COMPILER);
+    JSON_Value *tags = json_value_init_array();
+    for (int i = 0; g_build_tags[i]; i++) json_array_append_string(json_array(tags), g_build_tags[i]);
+    json_object_set_value(o, "build_tags", tags);
+    json_object_set_number(o, "api_version", AUTOD_API_VERSION);
+    json_object_set_number(o, "api_min_version", AUTOD_API_VERSION_MIN);
+    json_object_set_number(o, "wire_version", AUTOD_WIRE_VERSION);
+    json_object_set_number(o, "wire_min_version", AUTOD_WIRE_VERSION_MIN);
+}
+
+void version_print(FILE *f) {
+    fprintf(f, "autod %s (commit %s, %s)\n", AUTOD_VERSION, AUTOD_COMMIT, AUTOD_TARGET);
+    fprintf(f, "compiler: %s\n", VERSION_COMPILER);
+    fprintf(f, "build tags:");
+    if (!g_build_tags[0]) fprintf(f, " none");
+    for (int i = 0; g_build_tags[i]; i++) fprintf(f, " %s", g_build_tags[i]);
+    fprintf(f, "\nnode API: %d-%d, wire API: %d-%d\n", AUTOD_API_VERSION_MIN, AUTOD_API_VERSION,
+            AUTOD_WIRE_VERSION_MIN, AUTOD_WIRE_VERSION);
+}
@@ -0,0 +1,48 @@
+#ifndef AUTOD_VERSION_H
+#define AUTOD_VERSION_H
+
+#include <stdio.h>
+#include "parson.h"
+
+/* Build version; the Makefile passes git describe as -DAUTOD_VERSION. */
+#ifndef AUTOD_VERSION
+#define AUTOD_VERSION "dev"
+#endif
+
+/* Revision and compiler target triple, also from the Makefile. */
+#ifndef AUTOD_COMMIT
+#define AUTOD_COMMIT "unknown"
+#endif
+#ifndef AUTOD_TARGET
+#define AUTOD_TARGET "unknown"
+#endif
+
+/* Revision of the node-to-node API (registration, slot commands, /exec and
+ * /jobs as used by a master). Bump AUTOD_API_VERSION when peers need to know
+ * about a change; raise AUTOD_API_VERSION_MIN when this build stops speaking
+ * an older revision. Two nodes are compatible when their ranges overlap. */
+#define AUTOD_API_VERSION 1
+#define AUTOD_API_VERSION_MIN 1
+
+/* Revision of the HTTP wire format clients see (error model, exec schema,
+ * response shapes), served under /v<N>/. A breaking change adds a revision
+ * and keeps the older ones until AUTOD_WIRE_VERSION_MIN is raised. The
+ * unprefixed paths are deprecated aliases frozen at AUTOD_WIRE_LEGACY. */
+#define AUTOD_WIRE_VERSION 1
+#define AUTOD_WIRE_VERSION_MIN 1
+#define AUTOD_WIRE_LEGACY 1
+/* Prefix nodes put on the paths they call on each other (/exec,
+ * /sync/register), so internal traffic never goes through the deprecated
+ * unprefixed aliases. */
+#define AUTOD_PEER_PREFIX "/v1"
+
+/* Add the build (autod_version, commit, target, compiler, build_tags) and
+ * the API and wire ranges to o, as /version and /health report them. */
+void version_build_info(JSON_Object *o);
+/* The same for `autod --version`. */
+void version_print(FILE *f);
+
+#define AUTOD_STR_(x) #x
+#define AUTOD_STR(x) AUTOD_STR_(x)
+
+#endif
@@ -0,0 +1,979 @@
+#define _GNU_SOURCE
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <ctype.h>
+#include <signal.h>
+#include <time.h>
+#include <pthread.h>
+
+#include "civetweb.h"
+#include "parson.h"
+#include "autod.h"
+#include "version.h"
+#include "confirm.h"
+#include "dnscache.h"
+#include "events.h"
+#include "httpc.h"
+#include "sync.h"
+#include "workflow.h"
+
+extern volatile sig_atomic_t g_stop;
+
+#define WORKFLOW_ID_MAX 33
+#define WORKFLOW_STEP_ID_MAX 32
+#define WORKFLOW_GRACE_MS 2000
+#define WORKFLOW_CANCEL_TIMEOUT_MS 2000
+
+typedef struct {
+    char id[WORKFLOW_STEP_ID_MAX];
+    char node[64];                 /* "" = the node running the workflow */
+    char path[256];
+    JSON_Value *args;              /* as submitted, placeholders included */
+    JSON_Value *resolved;          /* args actually sent, set when it starts */
+    char profile[32];
+    char parse_output[8];
+    unsigned deps;                 /* bit i = depends on steps[i] */
+    const char *status;            /* pending, running, succeeded, failed, skipped, canceled */
+    char error[48];
+    char request_id[33];           /* forwarded to the node, for POST /jobs/cancel */
+    char address[64];              /* where it was sent */
+    int port;
+    char relay[GATEWAY_HEADER_MAX];/* X-Relay-* lines when sent through a gateway */
+    int http_status;
+    JSON_Value *response;          /* the node's /exec reply */
+    long long started_unix_ms;
+    long long finished_unix_ms;
+} workflow_step_t;
+
+typedef struct {
+    int in_use;
+    char id[WORKFLOW_ID_MAX];
+    char name[64];
+    char after[WORKFLOW_MAX_AFTER][WORKFLOW_ID_MAX];  /* workflows that must succeed first */
+    int after_count;
+    const char *status;            /* waiting, running, succeeded, failed, canceled */
+    char error[48];
+    char requester[48];
+    char request_id[AUTOD_REQUEST_ID_MAX];  /* X-Request-ID of the submission */
+    char lease_id[64];
+    int confirmed;                 /* answer the nodes' own confirmation prompts */
+    int canceled;
+    long long created_unix_ms;
+    long long finished_unix_ms;
+    int step_count;
+    workflow_step_t steps[WORKFLOW_MAX_STEPS];
+} workflow_t;
+
+typedef struct {
+    app_t *app;
+    workflow_t *wf;
+    int step;
+} workflow_task_t;
+
+static pthread_mutex_t g_wf_lock = PTHREAD_MUTEX_INITIALIZER;
+static pthread_cond_t g_wf_cond = PTHREAD_COND_INITIALIZER;
+static workflow_t g_workflows[WORKFLOW_MAX_KEPT];
+
+static int workflow_finished(const workflow_t *wf) {
+    return strcmp(wf->status, "waiting") != 0 && strcmp(wf->status, "running") != 0;
+}
+
+static void workflow_clear_locked(workflow_t *wf) {
+    for (int i = 0; i < wf->step_count; i++) {
+        json_value_free(wf->steps[i].args);
+        json_value_free(wf->steps[i].resolved);
+        json_value_free(wf->steps[i].response);
+    }
+    memset(wf, 0, sizeof(*wf));
+}
+
+static workflow_t *workflow_find_locked(const char *id) {
+    for (int i = 0; i < WORKFLOW_MAX_KEPT; i++) {
+        if (g_workflows[i].in_use && !strcmp(g_workflows[i].id, id)) return &g_workflows[i];
+    }
+    return NULL;
+}
+
+/* A free record, else the oldest finished one. NULL when all are active. */
+static workflow_t *workflow_alloc_locked(void) {
+    workflow_t *oldest = NULL;
+    for (int i = 0; i < WORKFLOW_MAX_KEPT; i++) {
+        workflow_t *wf = &g_workflows[i];
+        if (!wf->in_use) return wf;
+        if (workflow_finished(wf) &&
+            (!oldest || wf->created_unix_ms < oldest->created_unix_ms)) {
+            oldest = wf;
+        }
+    }
+    if (oldest) workflow_clear_locked(oldest);
+    return oldest;
+}
+
+static int workflow_step_index(const workflow_t *wf, const char *id) {
+    for (int i = 0; i < wf->step_count; i++) {
+        if (!strcmp(wf->steps[i].id, id)) return i;
+    }
+    return -1;
+}
+
+/* ---------- Output references ---------- */
+
+/* Split "step.field[.key...]" into the step id and the rest. Returns -1 when
+ * the field is not one of stdout, stderr, rc or result. */
+static int workflow_ref_parse(const char *ref, char *step, size_t step_sz, const char **field) {
+    const char *dot = strchr(ref, '.');
+    if (!dot || dot == ref || (size_t)(dot - ref) >= step_sz) return -1;
+    memcpy(step, ref, (size_t)(dot - ref));
+    step[dot - ref] = '\0';
+    *field = dot + 1;
+    if (!strcmp(*field, "stdout") || !strcmp(*field, "stderr") || !strcmp(*field, "rc") ||
+        !strcmp(*field, "result") || (!strncmp(*field, "result.", 7) && (*field)[7])) {
+        return 0;
+    }
+    return -1;
+}
+
+/* Call fn for every {{ref}} in s. Stops and returns fn's value when non-zero. */
+static int workflow_each_ref(const char *s, int (*fn)(const char *ref, void *ud), void *ud) {
+    for (const char *p = strstr(s, "{{"); p; p = strstr(p, "{{")) {
+        const char *end = strstr(p + 2, "}}");
+        if (!end) break;
+        char ref[128];
+        size_t n = (size_t)(end - p - 2);
+        if (n >= sizeof(ref)) n = sizeof(ref) - 1;
+        memcpy(ref, p + 2, n);
+        ref[n] = '\0';
+        int r = fn(ref, ud);
+        if (r) return r;
+        p = end + 2;
+    }
+    return 0;
+}
+
+typedef struct {
+    const workflow_t *wf;
+    unsigned ancestors;
+} workflow_refcheck_t;
+
+static int workflow_check_ref(const char *ref, void *ud) {
+    workflow_refcheck_t *rc = (workflow_refcheck_t *)ud;
+    char step[WORKFLOW_STEP_ID_MAX];
+    const char *field = NULL;
+    int idx = -1;
+    if (workflow_ref_parse(ref, step, sizeof(step), &field) == 0) {
+        idx = workflow_step_index(rc->wf, step);
+    }
+    /* Only a step that is certain to have finished can be referenced. */
+    return idx < 0 || !(rc->ancestors & (1u << idx));
+}
+
+static void workflow_write_value(FILE *f, const JSON_Value *v) {
+    switch (json_value_get_type(v)) {
+    case JSONString: {
+        const char *s = json_value_get_string(v);
+        size_t n = strlen(s);
+        if (n && s[n - 1] == '\n') n--;
+        fwrite(s, 1, n, f);
+        break;
+    }
+    case JSONNumber:
+        fprintf(f, "%.15g", json_value_get_number(v));
+        break;
+    case JSONBoolean:
+        fputs(json_value_get_boolean(v) ? "true" : "false", f);
+        break;
+    case JSONObject:
+    case JSONArray: {
+        char *s = json_serialize_to_string(v);
+        if (s) {
+            fputs(s, f);
+            json_free_serialized_string(s);
+        }
+        break;
+    }
+    default:
+        break;
+    }
+}
+
+/* Copy s with every {{step.field}} replaced by that step's output. */
+static char *workflow_expand_locked(const workflow_t *wf, const char *s) {
+    char *out = NULL;
+    size_t out_len = 0;
+    FILE *f = open_memstream(&out, &out_len);
+    if (!f) return NULL;
+    const char *p = s;
+    for (const char *open = strstr(p, "{{"); open; open = strstr(p, "{{")) {
+        const char *end = strstr(open + 2, "}}");
+        if (!end) break;
+        fwrite(p, 1, (size_t)(open - p), f);
+        char ref[128], step[WORKFLOW_STEP_ID_MAX];
+        size_t n = (size_t)(end - open - 2);
+        if (n >= sizeof(ref)) n = sizeof(ref) - 1;
+        memcpy(ref, open + 2, n);
+        ref[n] = '\0';
+        const char *field = NULL;
+        if (workflow_ref_parse(ref, step, sizeof(step), &field) == 0) {
+            int idx = workflow_step_index(wf, step);
+            JSON_Object *resp = idx >= 0 ? json_object(wf->steps[idx].response) : NULL;
+            if (resp) workflow_write_value(f, json_object_dotget_value(resp, field));
+        }
+        p = end + 2;
+    }
+    fputs(p, f);
+    fclose(f);
+    return out;
+}
+
+static JSON_Value *workflow_resolve_args_locked(const workflow_t *wf, const workflow_step_t *st) {
+    JSON_Value *out = json_value_init_array();
+    JSON_Array *in = json_array(st->args);
+    for (size_t i = 0; in && i < json_array_get_count(in); i++) {
+        JSON_Value *v = json_array_get_value(in, i);
+        if (json_value_get_type(v) != JSONString) {
+            json_array_append_value(json_array(out), json_value_deep_copy(v));
+            continue;
+        }
+        char *s = workflow_expand_locked(wf, json_value_get_string(v));
+        json_array_append_string(json_array(out), s ? s : "");
+        free(s);
+    }
+    return out;
+}
+
+/* ---------- Running a step ---------- */
+
+/* The node answered with a confirmation prompt: redeem its token once. */
+static int workflow_confirm_node(const http_url_t *url, const char *relay_hdr, JSON_Value *body,
+                                 char **resp, int timeout_ms) {
+    JSON_Value *prompt = *resp ? json_parse_string(*resp) : NULL;
+    const char *token = json_object_get_string(json_object(prompt), "confirm_token");
+    char *s = NULL;
+    if (token) {
+        json_object_set_string(json_object(body), "confirm_token", token);
+        s = json_serialize_to_string(body);
+    }
+    json_value_free(prompt);
+    if (!s) return 428;
+    free(*resp);
+    *resp = NULL;
+    int status = httpc_send_json("POST", url, relay_hdr, s, resp, NULL, timeout_ms);
+    json_free_serialized_string(s);
+    return status;
+}
+
+/* Where a step's node takes /exec requests, and the gateway lines to send
+ * with them. Returns NULL or an error code. */
+static const char *workflow_locate(app_t *app, const config_t *cfg, const workflow_t *wf,
+                                   const workflow_step_t *st, http_url_t *url,
+                                   char *relay_hdr, size_t relay_sz) {
+    memset(url, 0, sizeof(*url));
+    relay_hdr[0] = '\0';
+    strncpy(url->path, AUTOD_PEER_PREFIX "/exec", sizeof(url->path) - 1);
+    if (!st->node[0] || !strcmp(st->node, cfg->sync_id)) {
+        /* Going through our own /exec keeps catalog, profile, redaction and
+         * confirmation rules identical for local and remote steps. */
+        server_local_address(cfg, url->host, sizeof(url->host), &url->port);
+        return NULL;
+    }
+    sync_node_addr_t *nodes = calloc(SYNC_MAX_SLAVES, sizeof(*nodes));
+    int count = nodes ? sync_master_list_nodes(app, cfg, nodes, SYNC_MAX_SLAVES) : 0;
+    sync_node_addr_t target;
+    int found = 0;
+    for (int i = 0; i < count; i++) {
+        if (!strcmp(nodes[i].id, st->node)) {
+            target = nodes[i];
+            found = 1;
+            break;
+        }
+    }
+    free(nodes);
+    if (!found) return "unknown_node";
+    if (target.down) return "node_down";
+    if (strcmp(target.transport, "http") != 0) return "unsupported_transport";
+    JSON_Value *conflict = sync_master_lease_conflict(app, target.id, -1,
+                                                      wf->lease_id[0] ? wf->lease_id : NULL);
+    if (conflict) {
+        json_value_free(conflict);
+        return "slot_leased";
+    }
+    conflict = sync_master_version_conflict(app, target.id);
+    if (conflict) {
+        json_value_free(conflict);
+        return "incompatible_version";
+    }
+    if (sync_master_node_quarantined(app, target.id)) return "node_quarantined";
+    if (sync_master_node_decommissioning(app, target.id)) return "node_decommissioning";
+    if (gateway_route(&target, AUTOD_PEER_PREFIX "/exec", cfg->exec_timeout_ms + WORKFLOW_GRACE_MS, url,
+                      relay_hdr, relay_sz) != 0) {
+        return "gateway_unavailable";
+    }
+    char host[128];
+    snprintf(host, sizeof(host), "%s", url->host);
+    if (!host[0] || dnscache_resolve(host, cfg->sync_dns_ttl_s, url->host, sizeof(url->host)) != 0) {
+        return "node_unreachable";
+    }
+    return NULL;
+}
+
+static void *workflow_step_main(void *arg) {
+    workflow_task_t *task = (workflow_task_t *)arg;
+    workflow_t *wf = task->wf;
+    workflow_step_t *st = &wf->steps[task->step];
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (cfg) app_config_snapshot(task->app, cfg);
+    api_set_request_id(wf->request_id);
+
+    /* Fields set before the step was marked running do not change. */
+    JSON_Value *body = json_value_init_object();
+    JSON_Object *bo = json_object(body);
+    json_object_set_string(bo, "path", st->path);
+    pthread_mutex_lock(&g_wf_lock);
+    json_object_set_value(bo, "args", json_value_deep_copy(st->resolved));
+    int confirmed = wf->confirmed;
+    pthread_mutex_unlock(&g_wf_lock);
+    if (st->profile[0]) json_object_set_string(bo, "profile", st->profile);
+    if (st->parse_output[0]) json_object_set_string(bo, "parse_output", st->parse_output);
+    json_object_set_string(bo, "request_id", st->request_id);
+
+    http_url_t url;
+    char relay_hdr[GATEWAY_HEADER_MAX];
+    const char *error = cfg ? workflow_locate(task->app, cfg, wf, st, &url, relay_hdr, sizeof(relay_hdr))
+                            : "oom";
+    int status = -1;
+    char *resp = NULL;
+    if (!error) {
+        pthread_mutex_lock(&g_wf_lock);
+        strncpy(st->address, url.host, sizeof(st->address) - 1);
+        st->port = url.port;
+        snprintf(st->relay, sizeof(st->relay), "%s", relay_hdr);
+        if (wf->canceled) error = "canceled";
+        pthread_mutex_unlock(&g_wf_lock);
+    }
+    sync_node_addr_t held;
+    if (!error && st->node[0] && sync_master_node_addr(task->app, cfg, st->node, &held) == 0) {
+        /* The env and params of the slot the node holds. */
+        (void)sync_slot_exec_context(cfg, held.slot - 1, bo);
+    }
+    if (!error) {
+        int timeout_ms = cfg->exec_timeout_ms + WORKFLOW_GRACE_MS;
+        char *s = json_serialize_to_string(body);
+        status = s ? httpc_send_json("POST", &url, relay_hdr, s, &resp, NULL, timeout_ms) : -1;
+        if (s) json_free_serialized_string(s);
+        if (status == 428 && confirmed) {
+            status = workflow_confirm_node(&url, relay_hdr, body, &resp, timeout_ms);
+        }
+    }
+    free(cfg);
+    json_value_free(body);
+    JSON_Value *rv = resp ? json_parse_string(resp) : NULL;
+    free(resp);
+
+    pthread_mutex_lock(&g_wf_lock);
+    st->http_status = status;
+    st->response = rv;
+    st->finished_unix_ms = jobs_unix_ms();
+    JSON_Object *ro = json_object(rv);
+    if (error && !strcmp(error, "canceled")) {
+        st->status = "canceled";
+    } else if (error) {
+        snprintf(st->error, sizeof(st->error), "%s", error);
+        st->status = "failed";
+    } else if (status < 0) {
+        snprintf(st->error, sizeof(st->error), "node_unreachable");
+        st->status = "failed";
+    } else if (status != 200) {
+        const char *e = json_object_get_string(ro, "error");
+        snprintf(st->error, sizeof(st->error), "%s", e ? e : "exec_failed");
+        st->status = "failed";
+    } else if (wf->canceled && json_object_get_boolean(ro, "canceled") == 1) {
+        st->status = "canceled";
+    } else {
+        st->status = json_object_get_number(ro, "rc") == 0 ? "succeeded" : "failed";
+    }
+    pthread_cond_broadcast(&g_wf_cond);
+    pthread_mutex_unlock(&g_wf_lock);
+    free(task);
+    return NULL;
+}
+
+/* Ask the node running a step to kill it (through its gateway when node is
+ * behind one: relay_hdr is then set). */
+static void workflow_cancel_step(const char *address, int port, const char *node,
+                                 const char *relay_hdr, const char *request_id) {
+    http_url_t url;
+    memset(&url, 0, sizeof(url));
+    strncpy(url.host, address, sizeof(url.host) - 1);
+    url.port = port;
+    if (relay_hdr[0]) gateway_relay_path(node, AUTOD_PEER_PREFIX "/jobs/cancel", url.path, sizeof(url.path));
+    else strncpy(url.path, AUTOD_PEER_PREFIX "/jobs/cancel", sizeof(url.path) - 1);
+    char body[96];
+    snprintf(body, sizeof(body), "{\"request_id\":\"%s\"}", request_id);
+    char *resp = NULL;
+    int status = httpc_send_json("POST", &url, relay_hdr, body, &resp, NULL, WORKFLOW_CANCEL_TIMEOUT_MS);
+    free(resp);
+    if (status != 200) {
+        fprintf(stderr, "workflow: cancel of %s on %s:%d failed (%d)\n",
+                request_id, address, port, status);
+    }
+}
+
+/* ---------- Sequencing ---------- */
+
+static int workflow_step_done(const workflow_step_t *st) {
+    return strcmp(st->status, "pending") != 0 && strcmp(st->status, "running") != 0;
+}
+
+/* Wait for the workflows this one runs after. Returns 0 when they all
+ * succeeded; otherwise sets the error. Called and returns with the lock. */
+static int workflow_wait_after_locked(workflow_t *wf) {
+    while (!wf->canceled && !g_stop) {
+        int pending = 0;
+        for (int i = 0; i < wf->after_count; i++) {
+            workflow_t *dep = workflow_find_locked(wf->after[i]);
+            if (!dep || (workflow_finished(dep) && strcmp(dep->status, "succeeded") != 0)) {
+                snprintf(wf->error, sizeof(wf->error), "dependency_failed");
+                return -1;
+            }
+            if (!workflow_finished(dep)) pending = 1;
+        }
+        if (!pending) return 0;
+        struct timespec until;
+        clock_gettime(CLOCK_REALTIME, &until);
+        until.tv_sec += 1;
+        pthread_cond_timedwait(&g_wf_cond, &g_wf_lock, &until);
+    }
+    return -1;
+}
+
+static void *workflow_main(void *arg) {
+    workflow_task_t *task = (workflow_task_t *)arg;
+    app_t *app = task->app;
+    workflow_t *wf = task->wf;
+    free(task);
+    api_set_request_id(wf->request_id);
+
+    pthread_mutex_lock(&g_wf_lock);
+    int ok = workflow_wait_after_locked(wf) == 0;
+    if (ok) wf->status = "running";
+    for (;;) {
+        int active = 0;
+        for (int i = 0; i < wf->step_count; i++) {
+            workflow_step_t *st = &wf->steps[i];
+            if (!strcmp(st->status, "running")) active = 1;
+            if (strcmp(st->status, "pending") != 0) continue;
+            if (!ok || wf->canceled || g_stop) {
+                st->status = "canceled";
+                continue;
+            }
+            int ready = 1, blocked = 0;
+            for (int d = 0; d < wf->step_count; d++) {
+                if (!(st->deps & (1u << d))) continue;
+                const char *ds = wf->steps[d].status;
+                if (!workflow_step_done(&wf->steps[d])) ready = 0;
+                else if (strcmp(ds, "succeeded") != 0) blocked = 1;
+            }
+            if (blocked) {
+                st->status = "skipped";
+                snprintf(st->error, sizeof(st->error), "dependency_failed");
+                continue;
+            }
+            if (!ready) {
+                active = 1;
+                continue;
+            }
+            workflow_task_t *t = calloc(1, sizeof(*t));
+            pthread_t th;
+            if (t) {
+                t->app = app;
+                t->wf = wf;
+                t->step = i;
+                st->resolved = workflow_resolve_args_locked(wf, st);
+                random_id(st->request_id, sizeof(st->request_id));
+                st->started_unix_ms = jobs_unix_ms();
+                st->status = "running";
+            }
+            if (!t || pthread_create(&th, NULL, workflow_step_main, t) != 0) {
+                free(t);
+                st->status = "failed";
+                snprintf(st->error, sizeof(st->error), "spawn_failed");
+                continue;
+            }
+            pthread_detach(th);
+            active = 1;
+        }
+        if (!active) break;
+        pthread_cond_wait(&g_wf_cond, &g_wf_lock);
+    }
+
+    int counts[4] = {0};   /* succeeded, failed, skipped, canceled */
+    for (int i = 0; i < wf->step_count; i++) {
+        const char *s = wf->steps[i].status;
+        if (!strcmp(s, "succeeded")) counts[0]++;
+        else if (!strcmp(s, "failed")) counts[1]++;
+        else if (!strcmp(s, "skipped")) counts[2]++;
+        else counts[3]++;
+    }
+    if (wf->canceled) wf->status = "canceled";
+    else if (!ok || counts[1] || counts[2] || counts[3]) wf->status = "failed";
+    else wf->status = "succeeded";
+    wf->finished_unix_ms = jobs_unix_ms();
+    pthread_cond_broadcast(&g_wf_cond);
+
+    JSON_Value *ev = json_value_init_object();
+    JSON_Object *eo = json_object(ev);
+    json_object_set_string(eo, "id", wf->id);
+    json_object_set_string(eo, "name", wf->name);
+    json_object_set_string(eo, "status", wf->status);
+    json_object_set_number(eo, "succeeded", counts[0]);
+    json_object_set_number(eo, "failed", counts[1]);
+    json_object_set_number(eo, "skipped", counts[2]);
+    json_object_set_number(eo, "elapsed_ms", (double)(wf->finished_unix_ms - wf->created_unix_ms));
+    fprintf(stderr, "workflow %s (%s): %s, %d/%d steps succeeded\n",
+            wf->id, wf->name[0] ? wf->name : "-", wf->status, counts[0], wf->step_count);
+    pthread_mutex_unlock(&g_wf_lock);
+    (void)events_emit("workflow_finished", ev);
+    return NULL;
+}
+
+/* ---------- JSON ---------- */
+
+static JSON_Value *workflow_to_json_locked(const workflow_t *wf, int detail) {
+    JSON_Value *v = json_value_init_object();
+    JSON_Object *o = json_object(v);
+    json_object_set_string(o, "id", wf->id);
+    json_object_set_string(o, "name", wf->name);
+    json_object_set_string(o, "status", wf->status);
+    if (wf->error[0]) json_object_set_string(o, "error", wf->error);
+    if (wf->request_id[0]) json_object_set_string(o, "request_id", wf->request_id);
+    json_object_set_number(o, "created_unix_ms", (double)wf->created_unix_ms);
+    if (wf->finished_unix_ms) {
+        json_object_set_number(o, "finished_unix_ms", (double)wf->finished_unix_ms);
+    }
+    if (wf->after_count) {
+        JSON_Value *av = json_value_init_array();
+        for (int i = 0; i < wf->after_count; i++) json_array_append_string(json_array(av), wf->after[i]);
+        json_object_set_value(o, "depends_on", av);
+    }
+    JSON_Value *cv = json_value_init_object();
+    static const char *states[] = { "pending", "running", "succeeded", "failed", "skipped", "canceled" };
+    for (size_t s = 0; s < sizeof(states) / sizeof(states[0]); s++) {
+        int n = 0;
+        for (int i = 0; i < wf->step_count; i++) n += !strcmp(wf->steps[i].status, states[s]);
+        json_object_set_number(json_object(cv), states[s], n);
+    }
+    json_object_set_value(o, "steps_by_status", cv);
+    if (!detail) {
+        json_object_set_number(o, "steps", wf->step_count);
+        return v;
+    }
+
+    JSON_Value *sv = json_value_init_array();
+    for (int i = 0; i < wf->step_count; i++) {
+        const workflow_step_t *st = &wf->steps[i];
+        JSON_Value *pv = json_value_init_object();
+        JSON_Object *po = json_object(pv);
+        json_object_set_string(po, "id", st->id);
+        if (st->node[0]) json_object_set_string(po, "node", st->node);
+        json_object_set_string(po, "path", st->path);
+        json_object_set_value(po, "args", json_value_deep_copy(st->resolved ? st->resolved : st->args));
+        if (st->deps) {
+            JSON_Value *dv = json_value_init_array();
+            for (int d = 0; d < wf->step_count; d++) {
+                if (st->deps & (1u << d)) json_array_append_string(json_array(dv), wf->steps[d].id);
+            }
+            json_object_set_value(po, "depends_on", dv);
+        }
+        json_object_set_string(po, "status", st->status);
+        if (st->error[0]) json_object_set_string(po, "error", st->error);
+        if (st->started_unix_ms) json_object_set_number(po, "started_unix_ms", (double)st->started_unix_ms);
+        if (st->finished_unix_ms) json_object_set_number(po, "finished_unix_ms", (double)st->finished_unix_ms);
+        if (st->request_id[0]) json_object_set_string(po, "request_id", st->request_id);
+        JSON_Object *ro = json_object(st->response);
+        static const char *keys[] = { "rc", "elapsed_ms", "job_id", "stdout", "stdout_encoding",
+                                      "stderr", "stderr_encoding", "result", "parse_error" };
+        for (size_t k = 0; ro && k < sizeof(keys) / sizeof(keys[0]); k++) {
+            JSON_Value *kv = json_object_get_value(ro, keys[k]);
+            if (kv) json_object_set_value(po, keys[k], json_value_deep_copy(kv));
+        }
+        json_array_append_value(json_array(sv), pv);
+    }
+    json_object_set_value(o, "steps", sv);
+    return v;
+}
+
+/* ---------- Submission ---------- */
+
+static int workflow_valid_id(const char *s) {
+    if (!s || !*s || strlen(s) >= WORKFLOW_STEP_ID_MAX) return 0;
+    for (; *s; s++) {
+        if (!isalnum((unsigned char)*s) && *s != '_' && *s != '-') return 0;
+    }
+    return 1;
+}
+
+/* Add one steps[] entry to wf. nodes is the registry snapshot, taken on
+ * first use. Returns NULL or the error. */
+static const char *workflow_parse_step(workflow_t *wf, const config_t *cfg, app_t *app,
+                                       JSON_Object *so, const char **step,
+                                       sync_node_addr_t **nodes, int *node_count) {
+    workflow_step_t *st = &wf->steps[wf->step_count];
+    const char *id = json_object_get_string(so, "id");
+    *step = id;
+    if (!so || !workflow_valid_id(id)) return "bad_step_id";
+    if (workflow_step_index(wf, id) >= 0) return "duplicate_step";
+    strcpy(st->id, id);
+    st->status = "pending";
+    wf->step_count++;
+    const char *path = json_object_get_string(so, "path");
+    if (!path || !*path || strlen(path) >= sizeof(st->path)) return "missing_path";
+    strcpy(st->path, path);
+    JSON_Value *args = json_object_get_value(so, "args");
+    if (args && json_value_get_type(args) != JSONArray) return "bad_args";
+    st->args = args ? json_value_deep_copy(args) : json_value_init_array();
+    const char *profile = json_object_get_string(so, "profile");
+    if (profile) snprintf(st->profile, sizeof(st->profile), "%s", profile);
+    const char *parse_output = json_object_get_string(so, "parse_output");
+    if (parse_output) snprintf(st->parse_output, sizeof(st->parse_output), "%s", parse_output);
+
+    const char *node = json_object_get_string(so, "node");
+    if (!node || !*node || !strcmp(node, cfg->sync_id)) return NULL;
+    if (strcasecmp(cfg->sync_role, "master") != 0) return "unknown_node";
+    if (!*nodes) {
+        *nodes = calloc(SYNC_MAX_SLAVES, sizeof(**nodes));
+        *node_count = *nodes ? sync_master_list_nodes(app, cfg, *nodes, SYNC_MAX_SLAVES) : 0;
+    }
+    for (int k = 0; k < *node_count; k++) {
+        if (!strcmp((*nodes)[k].id, node)) {
+            snprintf(st->node, sizeof(st->node), "%s", node);
+            return NULL;
+        }
+    }
+    return "unknown_node";
+}
+
+/* Fill wf from the request body. Returns NULL or the error, with the
+ * offending step id in *step. */
+static const char *workflow_parse(workflow_t *wf, const config_t *cfg, app_t *app,
+                                  JSON_Object *o, const char **step) {
+    *step = NULL;
+    const char *name = json_object_get_string(o, "name");
+    if (name) snprintf(wf->name, sizeof(wf->name), "%s", name);
+
+    JSON_Array *after = json_object_get_array(o, "depends_on");
+    if (json_object_has_value(o, "depends_on") && !after) return "bad_depends_on";
+    if (after && json_array_get_count(after) > WORKFLOW_MAX_AFTER) return "too_many_dependencies";
+    for (size_t i = 0; after && i < json_array_get_count(after); i++) {
+        const char *id = json_array_get_string(after, i);
+        if (!id || !workflow_find_locked(id)) return "unknown_workflow";
+        snprintf(wf->after[wf->after_count++], WORKFLOW_ID_MAX, "%s", id);
+    }
+
+    JSON_Array *steps = json_object_get_array(o, "steps");
+    size_t n = steps ? json_array_get_count(steps) : 0;
+    if (n == 0) return "missing_steps";
+    if (n > WORKFLOW_MAX_STEPS) return "too_many_steps";
+    sync_node_addr_t *nodes = NULL;
+    int node_count = 0;
+
+    const char *error = NULL;
+    for (size_t i = 0; i < n && !error; i++) {
+        error = workflow_parse_step(wf, cfg, app, json_array_get_object(steps, i), step,
+                                    &nodes, &node_count);
+    }
+    free(nodes);
+    if (error) return error;
+
+    /* Dependencies may name later steps; resolve them once all ids are known. */
+    for (int i = 0; i < wf->step_count; i++) {
+        JSON_Array *deps = json_object_get_array(json_array_get_object(steps, (size_t)i), "depends_on");
+        *step = wf->steps[i].id;
+        for (size_t d = 0; deps && d < json_array_get_count(deps); d++) {
+            const char *dep = json_array_get_string(deps, d);
+            int idx = dep ? workflow_step_index(wf, dep) : -1;
+            if (idx < 0 || idx == i) return "unknown_dependency";
+            wf->steps[i].deps |= 1u << idx;
+        }
+    }
+    unsigned ancestors[WORKFLOW_MAX_STEPS];
+    for (int i = 0; i < wf->step_count; i++) ancestors[i] = wf->steps[i].deps;
+    for (int round = 0; round < wf->step_count; round++) {
+        for (int i = 0; i < wf->step_count; i++) {
+            for (int d = 0; d < wf->step_count; d++) {
+                if (ancestors[i] & (1u << d)) ancestors[i] |= ancestors[d];
+            }
+        }
+    }
+    for (int i = 0; i < wf->step_count; i++) {
+        *step = wf->steps[i].id;
+        if (ancestors[i] & (1u << i)) return "dependency_cycle";
+        workflow_refcheck_t rc = { .wf = wf, .ancestors = ancestors[i] };
+        JSON_Array *args = json_array(wf->steps[i].args);
+        for (size_t a = 0; a < json_array_get_count(args); a++) {
+            const char *s = json_array_get_string(args, a);
+            if (s && workflow_each_ref(s, workflow_check_ref, &rc)) return "bad_reference";
+        }
+    }
+    *step = NULL;
+    return NULL;
+}
+
+static int h_workflow_submit(struct mg_connection *c, app_t *app, const config_t *cfg) {
+    upload_t u = {0};
+    if (read_body(c, &u) != 0) {
+        free(u.body);
+        send_json_error(c, 400, "body_read_failed");
+        return 1;
+    }
+    JSON_Value *root = json_parse_string(u.body ? u.body : "");
+    free(u.body);
+    if (!root || json_value_get_type(root) != JSONObject) {
+        if (root) json_value_free(root);
+        send_json_error(c, 400, "bad_json");
+        return 1;
+    }
+    JSON_Object *o = json_object(root);
+
+    workflow_t *wf = calloc(1, sizeof(*wf));
+    if (!wf) {
+        json_value_free(root);
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    const char *step = NULL;
+    pthread_mutex_lock(&g_wf_lock);
+    const char *error = workflow_parse(wf, cfg, app, o, &step);
+    pthread_mutex_unlock(&g_wf_lock);
+    if (error) {
+        send_json_error_field(c, 400, error, "step", step);
+        workflow_clear_locked(wf);
+        free(wf);
+        json_value_free(root);
+        return 1;
+    }
+
+    int gated = 0;
+    for (int i = 0; i < wf->step_count; i++) gated |= confirm_required(cfg, wf->steps[i].path);
+    if (gated) {
+        JSON_Value *req = json_value_init_array();
+        for (int i = 0; i < wf->step_count; i++) {
+            JSON_Value *sv = json_value_init_object();
+            JSON_Object *so = json_object(sv);
+            json_object_set_string(so, "id", wf->steps[i].id);
+            json_object_set_string(so, "node", wf->steps[i].node[0] ? wf->steps[i].node : cfg->sync_id);
+            json_object_set_string(so, "path", wf->steps[i].path);
+            json_object_set_value(so, "args", json_value_deep_copy(wf->steps[i].args));
+            json_array_append_value(json_array(req), sv);
+        }
+        JSON_Value *preview = json_value_init_object();
+        json_object_set_value(json_object(preview), "steps", json_value_deep_copy(req));
+        int sent = confirm_gate(c, cfg, o, req, preview);
+        json_value_free(req);
+        if (sent) {
+            workflow_clear_locked(wf);
+            free(wf);
+            json_value_free(root);
+            return 1;
+        }
+        wf->confirmed = 1;
+    }
+
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    const char *lease_id = mg_get_header(c, "X-Lease-Id");
+    if (!lease_id) lease_id = json_object_get_string(o, "lease_id");
+    if (lease_id) snprintf(wf->lease_id, sizeof(wf->lease_id), "%s", lease_id);
+    if (ri) snprintf(wf->requester, sizeof(wf->requester), "%s", ri->remote_addr);
+    snprintf(wf->request_id, sizeof(wf->request_id), "%s", api_request_id());
+    random_id(wf->id, sizeof(wf->id));
+    wf->status = "waiting";
+    wf->created_unix_ms = jobs_unix_ms();
+    wf->in_use = 1;
+    json_value_free(root);
+
+    pthread_mutex_lock(&g_wf_lock);
+    workflow_t *slot = workflow_alloc_locked();
+    workflow_task_t *task = slot ? calloc(1, sizeof(*task)) : NULL;
+    pthread_t th;
+    if (slot) *slot = *wf;
+    free(wf);
+    if (!slot || !task) {
+        if (slot) memset(slot, 0, sizeof(*slot));
+        pthread_mutex_unlock(&g_wf_lock);
+        free(task);
+        send_json_error(c, 503, "too_many_workflows");
+        return 1;
+    }
+    task->app = app;
+    task->wf = slot;
+    if (pthread_create(&th, NULL, workflow_main, task) != 0) {
+        workflow_clear_locked(slot);
+        pthread_mutex_unlock(&g_wf_lock);
+        free(task);
+        send_plain(c, 500, "thread_failed", 1);
+        return 1;
+    }
+    pthread_detach(th);
+    fprintf(stderr, "workflow %s (%s): %d steps submitted by %s (request %s)\n", slot->id,
+            slot->name[0] ? slot->name : "-", slot->step_count, slot->requester, slot->request_id);
+    JSON_Value *v = workflow_to_json_locked(slot, 1);
+    pthread_mutex_unlock(&g_wf_lock);
+    send_json(c, v, 202, 1);
+    json_value_free(v);
+    return 1;
+}
+
+static int h_workflow_cancel(struct mg_connection *c, const char *id) {
+    struct {
+        char address[64]; int port; char node[64]; char relay[GATEWAY_HEADER_MAX]; char request_id[33];
+    } running[WORKFLOW_MAX_STEPS];
+    int nrunning = 0;
+    pthread_mutex_lock(&g_wf_lock);
+    workflow_t *wf = workflow_find_locked(id);
+    if (!wf) {
+        pthread_mutex_unlock(&g_wf_lock);
+        send_json_error(c, 404, "unknown_workflow");
+        return 1;
+    }
+    if (workflow_finished(wf)) {
+        JSON_Value *v = workflow_to_json_locked(wf, 0);
+        pthread_mutex_unlock(&g_wf_lock);
+        json_object_set_string(json_object(v), "error", "already_finished");
+        send_json(c, v, 409, 1);
+        json_value_free(v);
+        return 1;
+    }
+    wf->canceled = 1;
+    for (int i = 0; i < wf->step_count; i++) {
+        const workflow_step_t *st = &wf->steps[i];
+        if (strcmp(st->status, "running") != 0 || !st->address[0]) continue;
+        strcpy(running[nrunning].address, st->address);
+        running[nrunning].port = st->port;
+        strcpy(running[nrunning].node, st->node);
+        strcpy(running[nrunning].relay, st->relay);
+        strcpy(running[nrunning].request_id, st->request_id);
+        nrunning++;
+    }
+    pthread_cond_broadcast(&g_wf_cond);
+    pthread_mutex_unlock(&g_wf_lock);
+
+    for (int i = 0; i < nrunning; i++) {
+        workflow_cancel_step(running[i].address, running[i].port, running[i].node,
+                             running[i].relay, running[i].request_id);
+    }
+    JSON_Value *v = json_value_init_object();
+    json_object_set_string(json_object(v), "id", id);
+    json_object_set_string(json_object(v), "status", "canceling");
+    json_object_set_number(json_object(v), "running_steps", nrunning);
+    send_json(c, v, 202, 1);
+    json_value_free(v);
+    return 1;
+}
+
+static int h_workflows(struct mg_connection *c, void *ud) {
+    app_t *app = (app_t *)ud;
+    config_t *cfg = malloc(sizeof(*cfg));
+    if (!cfg) {
+        send_plain(c, 500, "oom", 1);
+        return 1;
+    }
+    app_config_snapshot(app, cfg);
+    const struct mg_request_info *ri = mg_get_request_info(c);
+    if (!ri) {
+        free(cfg);
+        return 0;
+    }
+    const char *uri = api_local_uri(c);
+    int is_get = !strcmp(ri->request_method, "GET");
+    int is_post = !strcmp(ri->request_method, "POST");
+
+    if (!strcmp(uri, "/workflows") || !strcmp(uri, "/workflows/")) {
+        if (is_post) {
+            int rc = h_workflow_submit(c, app, cfg);
+            free(cfg);
+            return rc;
+        }
+        if (!is_get) {
+            send_plain(c, 405, "method_not_allowed", 1);
+            free(cfg);
+            return 1;
+        }
+        JSON_Value *v = json_value_init_object();
+        JSON_Value *av = json_value_init_array();
+        pthread_mutex_lock(&g_wf_lock);
+        /* Newest first. */
+        int order[WORKFLOW_MAX_KEPT], count = 0;
+        for (int i = 0; i < WORKFLOW_MAX_KEPT; i++) {
+            if (!g_workflows[i].in_use) continue;
+            int k = count++;
+            while (k > 0 && g_workflows[order[k - 1]].created_unix_ms < g_workflows[i].created_unix_ms) {
+                order[k] = order[k - 1];
+                k--;
+            }
+            order[k] = i;
+        }
+        for (int i = 0; i < count; i++) {
+            json_array_append_value(json_array(av), workflow_to_json_locked(&g_workflows[order[i]], 0));
+        }
+        pthread_mutex_unlock(&g_wf_lock);
+        json_object_set_value(json_object(v), "workflows", av);
+        send_json(c, v, 200, 1);
+        json_value_free(v);
+        free(cfg);
+        return 1;
+    }
+    if (strncmp(uri, "/workflows/", 11) != 0) {
+        send_plain(c, 404, "not_found", 1);
+        free(cfg);
+        return 1;
+    }
+    char id[WORKFLOW_ID_MAX];
+    const char *rest = uri + 11;
+    const char *slash = strchr(rest, '/');
+    size_t idlen = slash ? (size_t)(slash - rest) : strlen(rest);
+    if (idlen == 0 || idlen >= sizeof(id)) {
+        send_json_error(c, 404, "unknown_workflow");
+        free(cfg);
+        return 1;
+    }
+    memcpy(id, rest, idlen);
+    id[idlen] = '\0';
+    if (slash) {
+        if (strcmp(slash, "/cancel") != 0) {
+            send_plain(c, 404, "not_found", 1);
+            free(cfg);
+            return 1;
+        }
+        if (!is_post) {
+            send_plain(c, 405, "method_not_allowed", 1);
+            free(cfg);
+            return 1;
+        }
+        free(cfg);
+        return h_workflow_cancel(c, id);
+    }
+    if (!is_get) {
+        send_plain(c, 405, "method_not_allowed", 1);
+        free(cfg);
+        return 1;
+    }
+    pthread_mutex_lock(&g_wf_lock);
+    workflow_t *wf = workflow_find_locked(id);
+    JSON_Value *v = wf ? workflow_to_json_locked(wf, 1) : NULL;
+    pthread_mutex_unlock(&g_wf_lock);
+    if (!v) {
+        send_json_error(c, 404, "unknown_workflow");
+        free(cfg);
+        return 1;
+    }
+    send_json(c, v, 200, 1);
+    json_value_free(v);
+    free(cfg);
+    return 1;
+}
+
+void workflow_register_http_handlers(struct mg_context *ctx, app_t *app) {
+    if (!ctx) return;
+    api_set_handler(ctx, "/workflows", h_workflows, app);
+}
@@ -0,0 +1,20 @@
+#ifndef AUTOD_WORKFLOW_H
+#define AUTOD_WORKFLOW_H
+
+#define WORKFLOW_MAX_STEPS 16
+#define WORKFLOW_MAX_KEPT 16
+#define WORKFLOW_MAX_AFTER 4
+
+typedef struct app app_t;
+struct mg_context;
+
+/*
+ * POST /workflows — run a small DAG of exec steps, each on this node or (on a
+ * master) a registered slave. A step starts once the steps it depends_on
+ * succeeded and may use their output in its args ({{step.stdout}},
+ * {{step.rc}}, {{step.result.key}}); steps after a failure are skipped.
+ * GET /workflows[/ID] reports progress, POST /workflows/ID/cancel stops one.
+ */
+void workflow_register_http_handlers(struct mg_context *ctx, app_t *app);
+
+#endif
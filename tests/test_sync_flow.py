@@ -1,3 +1,7 @@
+import fnmatch
+import functools
+import json
+import re
 import unittest
 from typing import Optional, Set
 
@@ -53,7 +57,7 @@ def parse_sync_reference(value: str) -> tuple[str, str]:
     slash_index = cursor.find("/")
     if slash_index == -1:
         sync_id = cursor
-        path = "/sync/register"
+        path = "/v1/sync/register"
     else:
         sync_id = cursor[:slash_index]
         path = cursor[slash_index:]
@@ -166,6 +170,523 @@ def apply_slot_plan(current_assignments: dict[int, str],
     return assignments, records
 
 
+def binding_changes(before: dict[int, str],
+                    after: dict[int, str],
+                    preferences: dict[int, str],
+                    reason: str) -> list[dict]:
+    """Mirror sync_master_log_binding_changes_locked diffing."""
+
+    changes: list[dict] = []
+    for slot in sorted(set(before) | set(after)):
+        old_id = before.get(slot)
+        new_id = after.get(slot)
+        if old_id == new_id:
+            continue
+        why = reason
+        if why == "auto" and new_id and preferences.get(slot) == new_id:
+            why = "preferred"
+        changes.append({"slot": slot, "old_id": old_id, "new_id": new_id, "reason": why})
+    return changes
+
+
+SYNC_MAX_SLOTS = 32
+
+
+def expand_slot_names(pattern: str, max_names: int = SYNC_MAX_SLOTS) -> Optional[list[str]]:
+    """Mirror sync_expand_names: one {A..B} range, zero-padded to A's width."""
+
+    if not pattern or len(pattern) >= 64:
+        return None
+    if "{" not in pattern:
+        return [pattern] if max_names >= 1 else None
+    start = pattern.index("{")
+    end = pattern.find("}", start)
+    if end == -1 or "{" in pattern[end + 1:]:
+        return None
+    rng = pattern[start + 1:end]
+    parts = rng.split("..")
+    if len(parts) != 2 or not parts[0].isdigit() or not parts[1].isdigit():
+        return None
+    a, b = int(parts[0]), int(parts[1])
+    if b < a or b - a + 1 > max_names:
+        return None
+    width = len(parts[0]) if rng[0] == "0" and rng[1] != "." else 0
+    return [f"{pattern[:start]}{v:0{width}d}{pattern[end + 1:]}" for v in range(a, b + 1)]
+
+
+def template_slots(pattern: str, first_index: int, max_slots: int = SYNC_MAX_SLOTS) -> list[int]:
+    """Mirror the checks of sync_template_apply: the slot numbers created."""
+
+    names = expand_slot_names(pattern)
+    if names is None:
+        raise ValueError("invalid_names")
+    if first_index < 0 or first_index + len(names) > max_slots:
+        raise ValueError("too_many_slots")
+    return [first_index + k + 1 for k in range(len(names))]
+
+
+def desired_mismatch(group: dict, node: dict) -> Optional[str]:
+    """Mirror sync_desired_mismatch_locked: the first constraint node fails."""
+
+    if group.get("ids") and node["id"] not in group["ids"]:
+        return "ids"
+    for key in ("device", "role"):
+        if group.get(key) and group[key] != node.get(key, ""):
+            return key
+    if any(cap not in node.get("caps", []) for cap in group.get("caps", [])):
+        return "caps"
+    labels = node.get("labels", {})
+    if any(labels.get(k) != v for k, v in group.get("labels", {}).items()):
+        return "labels"
+    return None
+
+
+def desired_candidate(assignments: dict[int, str],
+                      nodes: dict[str, dict],
+                      groups: list[dict],
+                      group: dict,
+                      slot: int,
+                      preferences: dict[int, str]) -> Optional[str]:
+    """Mirror sync_desired_candidate_locked: prefer_id, then free nodes, then
+    nodes on a slot outside the topology; ties go to the better health score
+    and then the newest heartbeat."""
+
+    desired_slots = {s for g in groups for s in g["slots"]}
+    best: Optional[str] = None
+    best_key: Optional[tuple] = None
+    for node_id, node in nodes.items():
+        if node.get("down") or node.get("quarantined"):
+            continue
+        held = [s for s, holder in assignments.items() if holder == node_id]
+        if any(s in desired_slots for s in held):
+            continue
+        if desired_mismatch(group, node):
+            continue
+        rank = 0 if preferences.get(slot) == node_id else (2 if held else 1)
+        key = (rank, -node.get("score", 100), -node.get("last_seen_ms", 0))
+        if best_key is None or key < best_key:
+            best, best_key = node_id, key
+    return best
+
+
+def reconcile(assignments: dict[int, str],
+              nodes: dict[str, dict],
+              groups: list[dict],
+              preferences: Optional[dict[int, str]] = None) -> tuple[dict[int, str], dict[str, int]]:
+    """Mirror sync_master_reconcile_locked: release holders that are down, fail
+    their group's constraints or exceed its replicas, then fill free slots.
+    Returns the new assignments and the bound count per group."""
+
+    preferences = preferences or {}
+    result = dict(assignments)
+    for group in groups:
+        kept = 0
+        for slot in sorted(group["slots"]):
+            holder = result.get(slot)
+            if not holder:
+                continue
+            node = nodes.get(holder)
+            if node and not node.get("down") and kept < group["replicas"] and \
+                    desired_mismatch(group, node) is None:
+                kept += 1
+                continue
+            del result[slot]
+
+    bound: dict[str, int] = {}
+    for group in groups:
+        count = sum(1 for slot in group["slots"] if slot in result)
+        for slot in sorted(group["slots"]):
+            if count >= group["replicas"]:
+                break
+            if slot in result:
+                continue
+            cand = desired_candidate(result, nodes, groups, group, slot, preferences)
+            if cand is None:
+                break
+            for held in [s for s, holder in result.items() if holder == cand]:
+                del result[held]
+            result[slot] = cand
+            count += 1
+        bound[group["name"]] = count
+    return result, bound
+
+
+def _glob_regex(pattern: str) -> str:
+    """fnmatch(3) with FNM_PATHNAME: wildcards do not match '/'."""
+
+    out: list[str] = []
+    i = 0
+    while i < len(pattern):
+        ch = pattern[i]
+        end = pattern.find("]", i + 2) if ch == "[" else -1
+        if ch == "*":
+            out.append("[^/]*")
+        elif ch == "?":
+            out.append("[^/]")
+        elif end != -1:
+            body = pattern[i + 1:end]
+            if body.startswith("!"):
+                body = "^" + body[1:]
+            out.append("(?!/)[" + body + "]")
+            i = end
+        else:
+            out.append(re.escape(ch))
+        i += 1
+    return "".join(out)
+
+
+def slot_name_matches(ref: str, name: str) -> bool:
+    """Mirror sync_slot_name_matches: "**" spans levels, "*" does not."""
+
+    if not name:
+        return False
+    if not any(ch in ref for ch in "*?["):
+        return ref == name
+    if "**" in ref:
+        return re.fullmatch(fnmatch.translate(ref.replace("**", "*")), name) is not None
+    return re.fullmatch(_glob_regex(ref), name) is not None
+
+
+def slot_match(slots: list[dict], ref: str) -> list[int]:
+    """Mirror sync_slot_match: slot numbers a number, name, alias or pattern hits."""
+
+    if not ref:
+        return []
+    if ref.isdigit():
+        n = int(ref)
+        return [n] if 1 <= n <= len(slots) else []
+    hits = []
+    for number, slot in enumerate(slots, start=1):
+        names = [slot.get("name", "")] + slot.get("aliases", [])
+        if any(slot_name_matches(ref, name) for name in names):
+            hits.append(number)
+    return hits
+
+
+def slot_lookup(slots: list[dict], ref: str) -> int:
+    """Mirror sync_slot_lookup and sync_slot_lookup_error: one slot or an error."""
+
+    hits = slot_match(slots, ref)
+    if not hits:
+        raise LookupError("unknown_slot")
+    if len(hits) > 1:
+        raise LookupError("ambiguous_slot", hits)
+    return hits[0]
+
+
+def slot_conflicts(slots: list[dict], number: int) -> list[str]:
+    """Mirror sync_slot_conflicts: names of a slot another slot answers to."""
+
+    slot = slots[number - 1]
+    names = [slot.get("name", "")] + slot.get("aliases", [])
+    return [n for n in names
+            if n and not any(ch in n for ch in "*?[") and len(slot_match(slots, n)) > 1]
+
+
+JSONQ_MAX_DEPTH = 16
+JSONQ_BUILTINS = ("length", "add", "min", "max", "sort", "unique", "first", "last", "keys",
+                  "any", "all", "not")
+_DROPPED = object()
+
+
+class JsonqError(ValueError):
+    pass
+
+
+def _jq_type(v: object) -> str:
+    if v is None:
+        return "null"
+    if isinstance(v, bool):
+        return "boolean"
+    if isinstance(v, (int, float)):
+        return "number"
+    if isinstance(v, str):
+        return "string"
+    return "array" if isinstance(v, list) else "object"
+
+
+class JsonqParser:
+    """Mirror jsonq_compile: paths, pipes, map(F), select(F [OP LIT]), builtins."""
+
+    def __init__(self, expr: str) -> None:
+        self.s = expr
+        self.i = 0
+        self.depth = 0
+
+    def _peek(self, k: int = 0) -> str:
+        return self.s[self.i + k] if self.i + k < len(self.s) else ""
+
+    def _skip_space(self) -> None:
+        while self._peek().isspace():
+            self.i += 1
+
+    def _name(self) -> str:
+        m = re.match(r"[A-Za-z0-9_]*", self.s[self.i:])
+        self.i += m.end()  # type: ignore[union-attr]
+        return m.group(0)  # type: ignore[union-attr]
+
+    def compile(self) -> tuple:
+        root = self._pipe()
+        self._skip_space()
+        if self.i < len(self.s):
+            raise JsonqError("trailing_input")
+        return root
+
+    def _pipe(self) -> tuple:
+        self.depth += 1
+        if self.depth > JSONQ_MAX_DEPTH:
+            raise JsonqError("too_deep")
+        parts = []
+        while True:
+            parts.append(self._term())
+            self._skip_space()
+            if self._peek() != "|":
+                break
+            self.i += 1
+        self.depth -= 1
+        return parts[0] if len(parts) == 1 else ("pipe", parts)
+
+    def _term(self) -> tuple:
+        self._skip_space()
+        if self._peek() == ".":
+            return self._path()
+        if self._peek() == "(":
+            self.i += 1
+            node = self._pipe()
+            self._expect(")", "expected_close_paren")
+            return node
+        if not self._peek().isalpha():
+            raise JsonqError("expected_filter")
+        name = self._name()
+        if name in ("map", "select"):
+            self._skip_space()
+            self._expect("(", "expected_open_paren")
+            sub = self._pipe()
+            op, literal = self._op(), None
+            if name == "select" and op:
+                literal = self._literal()
+            elif op:
+                raise JsonqError("expected_close_paren")
+            self._expect(")", "expected_close_paren")
+            return (name, sub, op, literal)
+        if name not in JSONQ_BUILTINS:
+            raise JsonqError("unknown_function")
+        return ("builtin", name)
+
+    def _expect(self, ch: str, why: str) -> None:
+        self._skip_space()
+        if self._peek() != ch:
+            raise JsonqError(why)
+        self.i += 1
+
+    def _path(self) -> tuple:
+        self.i += 1
+        steps: list = []
+        first = True
+        while True:
+            ch = self._peek()
+            if ch == "[":
+                m = re.match(r"\[(-?\d+)\]", self.s[self.i:])
+                if not m:
+                    raise JsonqError("expected_index")
+                index = int(m.group(1))
+                if not -2**31 <= index < 2**31:
+                    raise JsonqError("index_out_of_range")
+                steps.append(index)
+                self.i += m.end()
+            elif ch.isalpha() or ch == "_":
+                if not first and self.s[self.i - 1] != ".":
+                    raise JsonqError("unexpected_name")
+                steps.append(self._name())
+            elif ch == '"':
+                end = self.s.find('"', self.i + 1)
+                if end == -1:
+                    raise JsonqError("unterminated_string")
+                steps.append(self.s[self.i + 1:end])
+                self.i = end + 1
+            elif not first:
+                raise JsonqError("expected_key")
+            first = False
+            nxt = self._peek(1)
+            if self._peek() == "." and (nxt.isalpha() or nxt in ('_', '"', "[")):
+                self.i += 1
+                continue
+            if self._peek() == "[":
+                continue
+            return ("path", steps)
+
+    def _op(self) -> Optional[str]:
+        self._skip_space()
+        for op in ("==", "!=", "<=", ">=", "<", ">"):
+            if self.s.startswith(op, self.i):
+                self.i += len(op)
+                return op
+        return None
+
+    def _literal(self) -> object:
+        self._skip_space()
+        start = self.i
+        if self._peek() == '"':
+            j = self.i + 1
+            while j < len(self.s) and self.s[j] != '"':
+                j += 2 if self.s[j] == "\\" and j + 1 < len(self.s) else 1
+            if j >= len(self.s):
+                raise JsonqError("expected_literal")
+            self.i = j + 1
+        else:
+            while self._peek() and (self._peek().isalnum() or self._peek() in "+-."):
+                self.i += 1
+        try:
+            value = json.loads(self.s[start:self.i])
+        except ValueError:
+            raise JsonqError("expected_literal") from None
+        if isinstance(value, (list, dict)):
+            raise JsonqError("expected_literal")
+        return value
+
+
+def _jq_rank(v: object) -> int:
+    t = _jq_type(v)
+    if t == "boolean":
+        return 2 if v else 1
+    return {"null": 0, "number": 3, "string": 4, "array": 5, "object": 6}[t]
+
+
+def _jq_cmp(a: object, b: object) -> int:
+    ra, rb = _jq_rank(a), _jq_rank(b)
+    if ra != rb:
+        return -1 if ra < rb else 1
+    if ra in (3, 4):
+        return (a > b) - (a < b)  # type: ignore[operator]
+    if ra == 5:
+        for x, y in zip(a, b):  # type: ignore[call-overload]
+            c = _jq_cmp(x, y)
+            if c:
+                return c
+        return (len(a) > len(b)) - (len(a) < len(b))  # type: ignore[arg-type]
+    if ra == 6 and a != b:
+        x, y = json.dumps(a, separators=(",", ":")), json.dumps(b, separators=(",", ":"))
+        return (x > y) - (x < y)
+    return 0
+
+
+def _jq_sorted(items: list, unique: bool) -> list:
+    out: list = []
+    for v in sorted(items, key=functools.cmp_to_key(_jq_cmp)):
+        if unique and out and _jq_cmp(out[-1], v) == 0:
+            continue
+        out.append(v)
+    return out
+
+
+def _jq_add(items: list) -> object:
+    acc = None
+    for v in items:
+        if v is None:
+            continue
+        if acc is None:
+            acc = v
+        elif _jq_type(acc) != _jq_type(v):
+            raise JsonqError("cannot_add_mixed_types")
+        elif _jq_type(v) == "boolean":
+            raise JsonqError("cannot_add_booleans")
+        elif isinstance(v, dict):
+            acc = {**acc, **v}  # type: ignore[dict-item]
+        else:
+            acc = acc + v  # type: ignore[operator]
+    return acc
+
+
+def _jq_builtin(name: str, v: object) -> object:
+    t = _jq_type(v)
+    if name == "length":
+        if t in ("array", "object"):
+            return len(v)  # type: ignore[arg-type]
+        if t == "string":
+            return len(v.encode())  # type: ignore[union-attr]
+        if t == "number":
+            return abs(v)  # type: ignore[arg-type]
+        if t == "null":
+            return 0
+        raise JsonqError("boolean_has_no_length")
+    if name == "not":
+        return _jq_rank(v) in (0, 1)
+    if name == "keys":
+        if t == "object":
+            return _jq_sorted(list(v), False)  # type: ignore[arg-type]
+        if t == "array":
+            return list(range(len(v)))  # type: ignore[arg-type]
+        raise JsonqError("keys_needs_object_or_array")
+    if t != "array":
+        raise JsonqError("needs_array")
+    items: list = v  # type: ignore[assignment]
+    if name == "add":
+        return _jq_add(items)
+    if name in ("sort", "unique"):
+        return _jq_sorted(items, name == "unique")
+    if name in ("first", "last"):
+        return (items[0] if name == "first" else items[-1]) if items else None
+    if name in ("min", "max"):
+        best: object = _DROPPED
+        sign = -1 if name == "min" else 1
+        for item in items:
+            if best is _DROPPED or _jq_cmp(item, best) * sign > 0:
+                best = item
+        return None if best is _DROPPED else best
+    truths = [_jq_rank(item) not in (0, 1) for item in items]
+    return all(truths) if name == "all" else any(truths)
+
+
+def _jq_eval(node: tuple, v: object) -> object:
+    kind = node[0]
+    if kind == "path":
+        cur = v
+        for step in node[1]:
+            if cur is None:
+                break
+            if isinstance(step, str):
+                if _jq_type(cur) != "object":
+                    raise JsonqError("cannot_index_with_key")
+                cur = cur.get(step)  # type: ignore[union-attr]
+            else:
+                if _jq_type(cur) != "array":
+                    raise JsonqError("cannot_index_with_number")
+                idx = step + len(cur) if step < 0 else step  # type: ignore[arg-type]
+                cur = cur[idx] if 0 <= idx < len(cur) else None  # type: ignore[index, arg-type]
+        return cur
+    if kind == "pipe":
+        for part in node[1]:
+            v = _jq_eval(part, v)
+            if v is _DROPPED:
+                break
+        return v
+    if kind == "map":
+        if _jq_type(v) != "array":
+            raise JsonqError("map_needs_array")
+        results = [_jq_eval(node[1], item) for item in v]  # type: ignore[union-attr]
+        return [r for r in results if r is not _DROPPED]
+    if kind == "select":
+        r = _jq_eval(node[1], v)
+        if r is _DROPPED:
+            return r
+        _, _, op, literal = node
+        if op is None:
+            keep = _jq_rank(r) not in (0, 1)
+        else:
+            c = _jq_cmp(r, literal)
+            keep = {"==": c == 0, "!=": c != 0, "<": c < 0, "<=": c <= 0,
+                    ">": c > 0, ">=": c >= 0}[op]
+        return v if keep else _DROPPED
+    return _jq_builtin(node[1], v)
+
+
+def jsonq(expr: str, value: object) -> object:
+    """Mirror jsonq_compile + jsonq_eval: an input the expression drops gives null."""
+
+    result = _jq_eval(JsonqParser(expr).compile(), value)
+    return None if result is _DROPPED else result
+
+
 class SyncFlowTest(unittest.TestCase):
     def test_slave_request_splits_caps(self) -> None:
         req = build_slave_request("sync,exec, nodes ", "node-1", 7)
@@ -198,12 +719,12 @@ class SyncFlowTest(unittest.TestCase):
     def test_parse_sync_reference_default_path(self) -> None:
         sync_id, path = parse_sync_reference("sync://node-master")
         self.assertEqual(sync_id, "node-master")
-        self.assertEqual(path, "/sync/register")
+        self.assertEqual(path, "/v1/sync/register")
 
     def test_parse_sync_reference_plain_id(self) -> None:
         sync_id, path = parse_sync_reference("my-master")
         self.assertEqual(sync_id, "my-master")
-        self.assertEqual(path, "/sync/register")
+        self.assertEqual(path, "/v1/sync/register")
 
     def test_parse_sync_reference_with_custom_path(self) -> None:
         sync_id, path = parse_sync_reference("sync://master-1/custom/register")
@@ -301,6 +822,190 @@ class SyncFlowTest(unittest.TestCase):
         remaining = delete_assignments(assignments, ["ghost"])
         self.assertEqual(remaining, assignments)
 
+    def test_binding_changes_reports_preferred_takeover(self) -> None:
+        before = {1: "alpha", 2: "placeholder"}
+        after = enforce_preferred_assignment(before, {2: "bravo"}, "bravo")
+        changes = binding_changes(before, after, {2: "bravo"}, "auto")
+        self.assertEqual(changes[0], {"slot": 2, "old_id": "placeholder",
+                                      "new_id": "bravo", "reason": "preferred"})
+        self.assertEqual(changes[1]["new_id"], "placeholder")
+        self.assertEqual(changes[1]["reason"], "auto")
+
+    def test_binding_changes_ignores_unchanged_slots(self) -> None:
+        assignments = {1: "alpha", 3: "charlie"}
+        self.assertEqual(binding_changes(assignments, dict(assignments), {}, "manual"), [])
+        moved = reassign_slots(assignments, [{"slave_id": "alpha", "slot": 2}])
+        changes = binding_changes(assignments, moved, {}, "manual")
+        self.assertEqual([c["slot"] for c in changes], [1, 2])
+        self.assertTrue(all(c["reason"] == "manual" for c in changes))
+
+
+    def test_expand_slot_names_zero_pads_like_start(self) -> None:
+        self.assertEqual(expand_slot_names("cam-{01..03}"), ["cam-01", "cam-02", "cam-03"])
+        self.assertEqual(expand_slot_names("gate-{8..10}"), ["gate-8", "gate-9", "gate-10"])
+        self.assertEqual(expand_slot_names("x{008..010}y"), ["x008y", "x009y", "x010y"])
+        self.assertEqual(expand_slot_names("solo"), ["solo"])
+
+    def test_expand_slot_names_rejects_bad_ranges(self) -> None:
+        self.assertIsNone(expand_slot_names("cam-{5..3}"))
+        self.assertIsNone(expand_slot_names("cam-{-1..3}"))
+        self.assertIsNone(expand_slot_names("cam-{1..}"))
+        self.assertIsNone(expand_slot_names("cam-{1..3"))
+        self.assertIsNone(expand_slot_names("cam-{1..2}-{1..2}"))
+
+    def test_expand_slot_names_caps_at_max_slots(self) -> None:
+        self.assertEqual(len(expand_slot_names("cam-{01..32}") or []), SYNC_MAX_SLOTS)
+        self.assertIsNone(expand_slot_names("cam-{01..33}"))
+
+    def test_template_slots_overflow_past_max_slots(self) -> None:
+        self.assertEqual(template_slots("cam-{01..24}", 4), list(range(5, 29)))
+        self.assertEqual(template_slots("cam-{25..28}", 28), [29, 30, 31, 32])
+        with self.assertRaises(ValueError) as ctx:
+            template_slots("cam-{29..29}", 32)
+        self.assertEqual(str(ctx.exception), "too_many_slots")
+        with self.assertRaises(ValueError):
+            template_slots("cam-{01..32}", 4)
+
+    def test_reconcile_fills_group_from_matching_nodes(self) -> None:
+        nodes = {
+            "a": {"id": "a", "device": "cam", "last_seen_ms": 10},
+            "b": {"id": "b", "device": "cam", "last_seen_ms": 20},
+            "c": {"id": "c", "device": "mic", "last_seen_ms": 30},
+        }
+        groups = [{"name": "cams", "slots": [1, 2, 3], "replicas": 2, "device": "cam"}]
+        after, bound = reconcile({}, nodes, groups)
+        self.assertEqual(after, {1: "b", 2: "a"})
+        self.assertEqual(bound, {"cams": 2})
+
+    def test_reconcile_releases_down_and_mismatched_holders(self) -> None:
+        nodes = {
+            "a": {"id": "a", "role": "edge", "down": True},
+            "b": {"id": "b", "role": "core"},
+            "c": {"id": "c", "role": "edge"},
+        }
+        groups = [{"name": "edge", "slots": [1, 2], "replicas": 2, "role": "edge"}]
+        after, bound = reconcile({1: "a", 2: "b"}, nodes, groups)
+        self.assertEqual(after, {1: "c"})
+        self.assertEqual(bound, {"edge": 1})
+
+    def test_reconcile_trims_holders_beyond_replicas(self) -> None:
+        nodes = {n: {"id": n} for n in ("a", "b", "c")}
+        groups = [{"name": "g", "slots": [1, 2, 3], "replicas": 2}]
+        after, bound = reconcile({1: "a", 2: "b", 3: "c"}, nodes, groups)
+        self.assertEqual(after, {1: "a", 2: "b"})
+        self.assertEqual(bound, {"g": 2})
+
+    def test_reconcile_prefers_prefer_id_then_free_nodes(self) -> None:
+        nodes = {
+            "free": {"id": "free", "score": 90},
+            "outside": {"id": "outside", "score": 100},
+            "pinned": {"id": "pinned", "score": 10},
+        }
+        groups = [{"name": "g", "slots": [1, 2], "replicas": 2}]
+        after, _ = reconcile({5: "outside"}, nodes, groups, preferences={2: "pinned"})
+        self.assertEqual(after[1], "free")
+        self.assertEqual(after[2], "pinned")
+        self.assertEqual(after[5], "outside")
+
+    def test_reconcile_moves_node_off_slot_outside_topology(self) -> None:
+        nodes = {"a": {"id": "a", "caps": ["video"]}, "b": {"id": "b"}}
+        groups = [{"name": "video", "slots": [1], "replicas": 1, "caps": ["video"]}]
+        after, bound = reconcile({4: "a"}, nodes, groups)
+        self.assertEqual(after, {1: "a"})
+        self.assertEqual(bound, {"video": 1})
+
+    def test_reconcile_does_not_steal_from_other_groups(self) -> None:
+        nodes = {"a": {"id": "a", "labels": {"site": "north"}}}
+        groups = [
+            {"name": "north", "slots": [1], "replicas": 1, "labels": {"site": "north"}},
+            {"name": "any", "slots": [2], "replicas": 1},
+        ]
+        after, bound = reconcile({}, nodes, groups)
+        self.assertEqual(after, {1: "a"})
+        self.assertEqual(bound, {"north": 1, "any": 0})
+
+    def test_slot_lookup_by_number_name_and_alias(self) -> None:
+        slots = [{"name": "cam01", "aliases": ["camera-front"]}, {"name": "cam02"}]
+        self.assertEqual(slot_lookup(slots, "2"), 2)
+        self.assertEqual(slot_lookup(slots, "cam01"), 1)
+        self.assertEqual(slot_lookup(slots, "camera-front"), 1)
+
+    def test_slot_lookup_pattern_stays_on_one_level(self) -> None:
+        slots = [{"name": "video/front"}, {"name": "video/rear/left"}, {"name": "audio/front"}]
+        self.assertEqual(slot_match(slots, "video/*"), [1])
+        self.assertEqual(slot_match(slots, "video/**"), [1, 2])
+        self.assertEqual(slot_match(slots, "*/front"), [1, 3])
+        self.assertEqual(slot_match(slots, "video/[!f]*/left"), [2])
+        self.assertEqual(slot_lookup(slots, "video/*"), 1)
+
+    def test_slot_lookup_alias_collision_is_ambiguous(self) -> None:
+        slots = [{"name": "cam01", "aliases": ["door"]}, {"name": "cam02", "aliases": ["door"]},
+                 {"name": "cam03"}]
+        with self.assertRaises(LookupError) as ctx:
+            slot_lookup(slots, "door")
+        self.assertEqual(ctx.exception.args, ("ambiguous_slot", [1, 2]))
+        self.assertEqual(slot_conflicts(slots, 1), ["door"])
+        self.assertEqual(slot_conflicts(slots, 3), [])
+        with self.assertRaises(LookupError):
+            slot_lookup(slots, "cam*")
+
+    def test_slot_lookup_without_match(self) -> None:
+        slots = [{"name": "cam01"}, {"name": ""}]
+        for ref in ("cam02", "3", "0", "", "video/*"):
+            with self.assertRaises(LookupError) as ctx:
+                slot_lookup(slots, ref)
+            self.assertEqual(ctx.exception.args, ("unknown_slot",))
+
+    def test_jsonq_paths(self) -> None:
+        doc = {"a": {"b": [10, 20, 30]}, "x-y": 1}
+        self.assertEqual(jsonq(".", doc), doc)
+        self.assertEqual(jsonq(".a.b", doc), [10, 20, 30])
+        self.assertEqual(jsonq(".a.b[1]", doc), 20)
+        self.assertEqual(jsonq(".a.b[-1]", doc), 30)
+        self.assertEqual(jsonq('."x-y"', doc), 1)
+        self.assertEqual(jsonq(".a | .b | length", doc), 3)
+        self.assertEqual(jsonq(".a.b | first", doc), 10)
+
+    def test_jsonq_missing_keys_give_null(self) -> None:
+        doc = {"a": {"b": 1}, "list": [1]}
+        self.assertIsNone(jsonq(".missing", doc))
+        self.assertIsNone(jsonq(".missing.deeper[3]", doc))
+        self.assertIsNone(jsonq(".list[5]", doc))
+        self.assertEqual(jsonq(".missing | length", doc), 0)
+        with self.assertRaises(JsonqError) as ctx:
+            jsonq(".list.name", doc)
+        self.assertEqual(str(ctx.exception), "cannot_index_with_key")
+        with self.assertRaises(JsonqError) as ctx:
+            jsonq(".a[0]", doc)
+        self.assertEqual(str(ctx.exception), "cannot_index_with_number")
+
+    def test_jsonq_filters_merged_results(self) -> None:
+        results = [
+            {"id": "a", "rc": 0, "result": {"temp": 41}},
+            {"id": "b", "rc": 1, "result": None},
+            {"id": "c", "rc": 0, "result": {"temp": 57}},
+        ]
+        self.assertEqual(jsonq("map(select(.rc == 0)) | map(.id)", results), ["a", "c"])
+        self.assertEqual(jsonq("map(.result.temp) | max", results), 57)
+        self.assertIsNone(jsonq("map(.result.temp) | min", results))
+        self.assertEqual(jsonq("map(select(.result.temp > 50) | .id)", results), ["c"])
+        self.assertEqual(jsonq("map(.rc) | add", results), 1)
+        self.assertEqual(jsonq("map(.id) | sort | last", results), "c")
+        self.assertEqual(jsonq("map(.result) | unique | length", results), 3)
+        self.assertEqual(jsonq("map(.rc) | all", results), True)
+        self.assertIsNone(jsonq("select(length > 5)", results))
+
+    def test_jsonq_compile_errors(self) -> None:
+        for expr, why in (("", "expected_filter"), ("frobnicate", "unknown_function"),
+                          (".a .b", "trailing_input"), ("select(.a == [1])", "expected_literal"),
+                          ("map(.a", "expected_close_paren"), ("map .a", "expected_open_paren"),
+                          (".[x]", "expected_index"),
+                          (".[-99999999999999999999]", "index_out_of_range"),
+                          (".[4294967296]", "index_out_of_range")):
+            with self.assertRaises(JsonqError) as ctx:
+                jsonq(expr, {})
+            self.assertEqual(str(ctx.exception), why, expr)
+
 
 if __name__ == "__main__":
     unittest.main()